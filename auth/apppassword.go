@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/emersion/hydroxide/config"
+)
+
+// App passwords are additional bridge passwords, usually one per device, which
+// can be revoked independently. An app password is a random key decrypting a
+// copy of the bridge password. The app password itself is kept encrypted with
+// the bridge password, so that it survives bridge password changes.
+
+func appPasswordsFilePath() (string, error) {
+	return config.Path("app-passwords.json")
+}
+
+type appPasswordEntry struct {
+	Created time.Time
+	// BridgeKey is the bridge password encrypted with the app password
+	BridgeKey string
+	// Key is the app password encrypted with the bridge password
+	Key string
+}
+
+// AppPassword describes an app password.
+type AppPassword struct {
+	Name    string
+	Created time.Time
+}
+
+// readAppPasswords returns the app passwords of all users, indexed by username
+// and name.
+func readAppPasswords() (map[string]map[string]*appPasswordEntry, error) {
+	p, err := appPasswordsFilePath()
+	if err != nil {
+		return nil, err
+	}
+
+	all := make(map[string]map[string]*appPasswordEntry)
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return all, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+func saveAppPasswords(all map[string]map[string]*appPasswordEntry) error {
+	p, err := appPasswordsFilePath()
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(p, b)
+}
+
+// AddAppPassword creates a new app password for a user and returns it.
+func AddAppPassword(username, bridgePassword, name string) (string, error) {
+	secretKey, err := parseBridgePassword(bridgePassword)
+	if err != nil {
+		return "", err
+	}
+	if _, err := readCachedAuth(username, secretKey); err != nil {
+		return "", err
+	}
+
+	all, err := readAppPasswords()
+	if err != nil {
+		return "", err
+	}
+	if _, ok := all[username][name]; ok {
+		return "", fmt.Errorf("app password %q already exists", name)
+	}
+
+	appKey, password, err := GeneratePassword()
+	if err != nil {
+		return "", err
+	}
+
+	entry := &appPasswordEntry{Created: time.Now()}
+	if entry.BridgeKey, err = encrypt(secretKey[:], appKey); err != nil {
+		return "", err
+	}
+	if entry.Key, err = encrypt(appKey[:], secretKey); err != nil {
+		return "", err
+	}
+
+	if all[username] == nil {
+		all[username] = make(map[string]*appPasswordEntry)
+	}
+	all[username][name] = entry
+	if err := saveAppPasswords(all); err != nil {
+		return "", err
+	}
+	return password, nil
+}
+
+// ListAppPasswords returns the app passwords of a user, sorted by name.
+func ListAppPasswords(username string) ([]*AppPassword, error) {
+	all, err := readAppPasswords()
+	if err != nil {
+		return nil, err
+	}
+
+	l := make([]*AppPassword, 0, len(all[username]))
+	for name, entry := range all[username] {
+		l = append(l, &AppPassword{Name: name, Created: entry.Created})
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Name < l[j].Name
+	})
+	return l, nil
+}
+
+// RevokeAppPassword deletes an app password. It stops working right away,
+// including in running servers. Sessions already logged in with it aren't
+// closed.
+func RevokeAppPassword(username, name string) error {
+	all, err := readAppPasswords()
+	if err != nil {
+		return err
+	}
+	if _, ok := all[username][name]; !ok {
+		return fmt.Errorf("no app password named %q", name)
+	}
+
+	delete(all[username], name)
+	if len(all[username]) == 0 {
+		delete(all, username)
+	}
+	return saveAppPasswords(all)
+}
+
+// RevokeAppPasswords deletes all the app passwords of a user.
+func RevokeAppPasswords(username string) error {
+	all, err := readAppPasswords()
+	if err != nil {
+		return err
+	}
+	if _, ok := all[username]; !ok {
+		return nil
+	}
+
+	delete(all, username)
+	return saveAppPasswords(all)
+}
+
+// ResolveAppPassword returns the bridge password unlocked by an app password,
+// and the name of the app password. Other passwords are returned unchanged,
+// with an empty name.
+func ResolveAppPassword(username, password string) (bridgePassword, name string, err error) {
+	key, err := parseBridgePassword(password)
+	if err != nil {
+		return password, "", nil
+	}
+
+	all, err := readAppPasswords()
+	if err != nil {
+		return "", "", err
+	}
+
+	for name, entry := range all[username] {
+		b, err := decrypt(entry.BridgeKey, key)
+		if err != nil {
+			continue
+		}
+		return base64.StdEncoding.EncodeToString(b), name, nil
+	}
+	return password, "", nil
+}
+
+// rewrapAppPasswords encrypts the app passwords of a user with a new bridge
+// password. App passwords which don't decrypt with the previous bridge
+// password are dropped.
+func rewrapAppPasswords(username string, oldKey, newKey *[32]byte) error {
+	all, err := readAppPasswords()
+	if err != nil {
+		return err
+	}
+	if len(all[username]) == 0 {
+		return nil
+	}
+
+	for name, entry := range all[username] {
+		b, err := decrypt(entry.Key, oldKey)
+		if err != nil || len(b) != 32 {
+			delete(all[username], name)
+			continue
+		}
+		var appKey [32]byte
+		copy(appKey[:], b)
+
+		if entry.BridgeKey, err = encrypt(newKey[:], &appKey); err != nil {
+			return err
+		}
+		if entry.Key, err = encrypt(appKey[:], newKey); err != nil {
+			return err
+		}
+	}
+	return saveAppPasswords(all)
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func appPasswordNames(t *testing.T, username string) []string {
+	l, err := ListAppPasswords(username)
+	if err != nil {
+		t.Fatalf("ListAppPasswords() = %v", err)
+	}
+	names := []string{}
+	for _, appPassword := range l {
+		names = append(names, appPassword.Name)
+	}
+	return names
+}
+
+func TestAppPasswords(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	secretKey, bridgePassword, err := GeneratePassword()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := EncryptAndSave(&CachedAuth{}, "user", secretKey); err != nil {
+		t.Fatalf("EncryptAndSave() = %v", err)
+	}
+	_, wrongPassword, err := GeneratePassword()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := AddAppPassword("user", wrongPassword, "phone"); err == nil {
+		t.Errorf("AddAppPassword() with a wrong bridge password = nil, want an error")
+	}
+	phone, err := AddAppPassword("user", bridgePassword, "phone")
+	if err != nil {
+		t.Fatalf("AddAppPassword() = %v", err)
+	}
+	if _, err := AddAppPassword("user", bridgePassword, "phone"); err == nil {
+		t.Errorf("AddAppPassword() with a duplicate name = nil, want an error")
+	}
+	laptop, err := AddAppPassword("user", bridgePassword, "laptop")
+	if err != nil {
+		t.Fatalf("AddAppPassword() = %v", err)
+	}
+
+	if names, want := appPasswordNames(t, "user"), []string{"laptop", "phone"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ListAppPasswords() = %v, want %v", names, want)
+	}
+	if names := appPasswordNames(t, "other"); len(names) != 0 {
+		t.Errorf("ListAppPasswords() for another user = %v, want none", names)
+	}
+
+	tests := []struct {
+		name, username, password string
+		want, wantName           string
+	}{
+		{"phone", "user", phone, bridgePassword, "phone"},
+		{"laptop", "user", laptop, bridgePassword, "laptop"},
+		{"bridge password", "user", bridgePassword, bridgePassword, ""},
+		{"wrong password", "user", wrongPassword, wrongPassword, ""},
+		{"not a bridge password", "user", "hunter2", "hunter2", ""},
+		{"other user", "other", phone, phone, ""},
+	}
+	for _, tc := range tests {
+		got, name, err := ResolveAppPassword(tc.username, tc.password)
+		if err != nil {
+			t.Errorf("%v: ResolveAppPassword() = %v", tc.name, err)
+		} else if got != tc.want || name != tc.wantName {
+			t.Errorf("%v: ResolveAppPassword() = %q, %q, want %q, %q", tc.name, got, name, tc.want, tc.wantName)
+		}
+	}
+
+	// App passwords survive bridge password changes
+	newBridgePassword, err := ChangeBridgePassword("user", bridgePassword)
+	if err != nil {
+		t.Fatalf("ChangeBridgePassword() = %v", err)
+	}
+	if got, name, err := ResolveAppPassword("user", phone); err != nil || got != newBridgePassword || name != "phone" {
+		t.Errorf("ResolveAppPassword() after ChangeBridgePassword() = %q, %q, %v, want the new bridge password", got, name, err)
+	}
+
+	if err := RevokeAppPassword("user", "unknown"); err == nil {
+		t.Errorf("RevokeAppPassword() with an unknown name = nil, want an error")
+	}
+	if err := RevokeAppPassword("user", "phone"); err != nil {
+		t.Fatalf("RevokeAppPassword() = %v", err)
+	}
+	if got, name, err := ResolveAppPassword("user", phone); err != nil || got != phone || name != "" {
+		t.Errorf("ResolveAppPassword() with a revoked password = %q, %q, %v, want it unchanged", got, name, err)
+	}
+	if names, want := appPasswordNames(t, "user"), []string{"laptop"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ListAppPasswords() after RevokeAppPassword() = %v, want %v", names, want)
+	}
+
+	if err := RevokeAppPasswords("user"); err != nil {
+		t.Fatalf("RevokeAppPasswords() = %v", err)
+	}
+	if names := appPasswordNames(t, "user"); len(names) != 0 {
+		t.Errorf("ListAppPasswords() after RevokeAppPasswords() = %v, want none", names)
+	}
+	if err := RevokeAppPasswords("other"); err != nil {
+		t.Errorf("RevokeAppPasswords() for a user without app passwords = %v", err)
+	}
+}
+
+func TestManagerAuthAppPassword(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	secretKey, bridgePassword, err := GeneratePassword()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := EncryptAndSave(&CachedAuth{}, "user", secretKey); err != nil {
+		t.Fatalf("EncryptAndSave() = %v", err)
+	}
+	appPassword, err := AddAppPassword("user", bridgePassword, "phone")
+	if err != nil {
+		t.Fatalf("AddAppPassword() = %v", err)
+	}
+	if err := RevokeAppPassword("user", "phone"); err != nil {
+		t.Fatalf("RevokeAppPassword() = %v", err)
+	}
+
+	// Revoked app passwords aren't bridge passwords either
+	m := NewManager(func() *protonmail.Client { return nil })
+	if _, _, err := m.Auth("user", appPassword); err != ErrUnauthorized {
+		t.Errorf("Manager.Auth() with a revoked app password = %v, want %v", err, ErrUnauthorized)
+	}
+}
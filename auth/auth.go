@@ -2,16 +2,22 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/rsa"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/big"
 	"os"
+	"path/filepath"
+	"sync"
 
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/crypto/nacl/secretbox"
 	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
 
 	"github.com/emersion/hydroxide/config"
 	"github.com/emersion/hydroxide/protonmail"
@@ -25,24 +31,27 @@ type CachedAuth struct {
 	protonmail.Auth
 	LoginPassword   string
 	MailboxPassword string
+	TOTPSecret      string `json:",omitempty"`
 	// TODO: add padding
 }
 
+// authFileLocker serializes updates of the auth file, which are done by
+// reading the whole file and writing it back.
+var authFileLocker sync.Mutex
+
 func readCachedAuths() (map[string]string, error) {
-	p, err := authFilePath()
-	if err != nil {
+	b, err := readAuthFile()
+	if err != nil || b == nil {
 		return nil, err
 	}
-	f, err := os.Open(p)
-	if os.IsNotExist(err) {
-		return nil, nil
-	} else if err != nil {
+
+	b, err = decryptAuthFile(b)
+	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
 
 	auths := make(map[string]string)
-	err = json.NewDecoder(f).Decode(&auths)
+	err = json.Unmarshal(b, &auths)
 	return auths, err
 }
 
@@ -51,13 +60,43 @@ func saveAuths(auths map[string]string) error {
 	if err != nil {
 		return err
 	}
-	f, err := os.Create(p)
+
+	b, err := json.Marshal(auths)
+	if err != nil {
+		return err
+	}
+	if master != nil {
+		// Never write plaintext credentials once a master password is set
+		if b, err = master.encrypt(b); err != nil {
+			return err
+		}
+	}
+
+	return writeFileAtomic(p, b)
+}
+
+// writeFileAtomic replaces the file at p with b. The file is never left
+// truncated, even if hydroxide is interrupted.
+func writeFileAtomic(p string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(p), filepath.Base(p)+".tmp")
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	defer os.Remove(f.Name())
 
-	return json.NewEncoder(f).Encode(auths)
+	// TempFile already creates the file with mode 0600
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
 }
 
 func encrypt(msg []byte, secretKey *[32]byte) (string, error) {
@@ -96,6 +135,9 @@ func EncryptAndSave(auth *CachedAuth, username string, secretKey *[32]byte) erro
 		return err
 	}
 
+	authFileLocker.Lock()
+	defer authFileLocker.Unlock()
+
 	auths, err := readCachedAuths()
 	if err != nil {
 		return err
@@ -109,21 +151,44 @@ func EncryptAndSave(auth *CachedAuth, username string, secretKey *[32]byte) erro
 	return saveAuths(auths)
 }
 
+var (
+	// ErrSessionRevoked is returned when the session has been revoked and
+	// the saved credentials don't allow to log in again.
+	ErrSessionRevoked = errors.New("session revoked, please log in again with `hydroxide auth`")
+	// ErrPasswordChanged is returned when the saved password doesn't unlock
+	// the keys anymore, usually because it has been changed.
+	ErrPasswordChanged = errors.New("cannot unlock keys, the password has probably been changed: please run `hydroxide reauth`")
+)
+
+func isInvalidRefreshToken(err error) bool {
+	apiErr, ok := err.(*protonmail.APIError)
+	return ok && apiErr.Code == 10013
+}
+
+func isInvalidPassword(err error) bool {
+	return err == protonmail.ErrInvalidPassphrase || err == protonmail.ErrInvalidMailboxPassword
+}
+
 func authenticate(c *protonmail.Client, cachedAuth *CachedAuth, username string) (openpgp.EntityList, error) {
 	auth, err := c.AuthRefresh(&cachedAuth.Auth)
-	if apiErr, ok := err.(*protonmail.APIError); ok && apiErr.Code == 10013 {
+	if isInvalidRefreshToken(err) {
 		// Invalid refresh token, re-authenticate
 		authInfo, err := c.AuthInfo(username)
 		if err != nil {
 			return nil, fmt.Errorf("cannot re-authenticate: failed to get auth info: %v", err)
 		}
 
-		if authInfo.TwoFactor == 1 {
-			return nil, fmt.Errorf("cannot re-authenticate: two factor authentication enabled, please login manually")
+		if authInfo.TwoFactor != 0 {
+			if authInfo.TwoFactor&protonmail.TwoFactorTOTP == 0 || cachedAuth.TOTPSecret == "" {
+				return nil, ErrSessionRevoked
+			}
+			auth, err = c.AuthTOTP(username, cachedAuth.LoginPassword, cachedAuth.TOTPSecret, authInfo)
+		} else {
+			auth, err = c.Auth(username, cachedAuth.LoginPassword, "", authInfo)
 		}
-
-		auth, err = c.Auth(username, cachedAuth.LoginPassword, "", authInfo)
-		if err != nil {
+		if errors.Is(err, protonmail.ErrInvalidCredentials) {
+			return nil, ErrSessionRevoked
+		} else if err != nil {
 			return nil, fmt.Errorf("cannot re-authenticate: %v", err)
 		}
 	} else if err != nil {
@@ -131,7 +196,67 @@ func authenticate(c *protonmail.Client, cachedAuth *CachedAuth, username string)
 	}
 	cachedAuth.Auth = *auth
 
-	return c.Unlock(auth, cachedAuth.MailboxPassword)
+	privateKeys, err := c.UnlockWithMailboxPassword(auth, []byte(cachedAuth.LoginPassword), []byte(cachedAuth.MailboxPassword))
+	if isInvalidPassword(err) {
+		return nil, ErrPasswordChanged
+	}
+	return privateKeys, err
+}
+
+// Reauth unlocks the keys of a user with a new password, after it has been
+// changed. The session is refreshed instead of being replaced.
+//
+// newPassword is called to get the new password: the login password in
+// one-password mode, the mailbox password in two-password mode. retry is true
+// if the previous password was wrong.
+func Reauth(c *protonmail.Client, username, bridgePassword string, newPassword func(mode protonmail.PasswordMode, retry bool) (string, error)) error {
+	secretKey, err := parseBridgePassword(bridgePassword)
+	if err != nil {
+		return err
+	}
+
+	cachedAuth, err := readCachedAuth(username, secretKey)
+	if err != nil {
+		return err
+	}
+
+	auth, err := c.AuthRefresh(&cachedAuth.Auth)
+	if isInvalidRefreshToken(err) {
+		return ErrSessionRevoked
+	} else if err != nil {
+		return err
+	}
+	cachedAuth.Auth = *auth
+
+	// The previous refresh token isn't valid anymore
+	if err := EncryptAndSave(cachedAuth, username, secretKey); err != nil {
+		return err
+	}
+
+	for attempts := 3; ; attempts-- {
+		pass, err := newPassword(auth.PasswordMode, attempts < 3)
+		if err != nil {
+			return err
+		}
+
+		loginPassword, mailboxPassword := cachedAuth.LoginPassword, cachedAuth.MailboxPassword
+		if auth.PasswordMode == protonmail.PasswordTwo {
+			mailboxPassword = pass
+		} else {
+			loginPassword = pass
+		}
+
+		_, err = c.UnlockWithMailboxPassword(auth, []byte(loginPassword), []byte(mailboxPassword))
+		if isInvalidPassword(err) && attempts > 1 {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		cachedAuth.LoginPassword = loginPassword
+		cachedAuth.MailboxPassword = mailboxPassword
+		return EncryptAndSave(cachedAuth, username, secretKey)
+	}
 }
 
 func ListUsernames() ([]string, error) {
@@ -165,80 +290,221 @@ type session struct {
 
 var ErrUnauthorized = errors.New("Invalid username or password")
 
+// Manager keeps track of the sessions of all users. Sessions are independent
+// from each other.
 type Manager struct {
 	newClient func() *protonmail.Client
-	sessions  map[string]*session
+
+	locker   sync.Mutex
+	sessions map[string]*session
 }
 
-func (m *Manager) Auth(username, password string) (*protonmail.Client, openpgp.EntityList, error) {
+func parseBridgePassword(password string) (*[32]byte, error) {
 	var secretKey [32]byte
 	passwordBytes, err := base64.StdEncoding.DecodeString(password)
 	if err != nil || len(passwordBytes) != len(secretKey) {
-		return nil, nil, ErrUnauthorized
+		return nil, ErrUnauthorized
 	}
 	copy(secretKey[:], passwordBytes)
+	return &secretKey, nil
+}
+
+// readCachedAuth reads and decrypts the credentials of a user. It returns
+// ErrUnauthorized if secretKey isn't the user's current bridge password.
+func readCachedAuth(username string, secretKey *[32]byte) (*CachedAuth, error) {
+	auths, err := readCachedAuths()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	encrypted, ok := auths[username]
+	if !ok {
+		return nil, ErrUnauthorized
+	}
+
+	decrypted, err := decrypt(encrypted, secretKey)
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
 
+	var cachedAuth CachedAuth
+	if err := json.Unmarshal(decrypted, &cachedAuth); err != nil {
+		return nil, err
+	}
+	return &cachedAuth, nil
+}
+
+// ChangeBridgePassword replaces the bridge password of a user with a new
+// random one, which is returned. The current bridge password stops working
+// right away, including in running servers. App passwords keep working.
+func ChangeBridgePassword(username, password string) (string, error) {
+	secretKey, err := parseBridgePassword(password)
+	if err != nil {
+		return "", err
+	}
+
+	cachedAuth, err := readCachedAuth(username, secretKey)
+	if err != nil {
+		return "", err
+	}
+
+	newSecretKey, newPassword, err := GeneratePassword()
+	if err != nil {
+		return "", err
+	}
+
+	if err := EncryptAndSave(cachedAuth, username, newSecretKey); err != nil {
+		return "", err
+	}
+	if err := rewrapAppPasswords(username, secretKey, newSecretKey); err != nil {
+		return "", fmt.Errorf("cannot update app passwords: %v", err)
+	}
+	return newPassword, nil
+}
+
+// Auth returns the session of a user. password is either the bridge password
+// or an app password.
+func (m *Manager) Auth(username, password string) (*protonmail.Client, openpgp.EntityList, error) {
+	password, _, err := ResolveAppPassword(username, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	secretKey, err := parseBridgePassword(password)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m.locker.Lock()
 	s, ok := m.sessions[username]
-	if ok {
-		err := bcrypt.CompareHashAndPassword(s.hashedSecretKey, secretKey[:])
-		if err != nil {
-			return nil, nil, ErrUnauthorized
-		}
-	} else {
-		auths, err := readCachedAuths()
-		if err != nil && !os.IsNotExist(err) {
+	m.locker.Unlock()
+	if ok && bcrypt.CompareHashAndPassword(s.hashedSecretKey, secretKey[:]) == nil {
+		// The bridge password may have been changed since the session has
+		// been opened
+		if _, err := readCachedAuth(username, secretKey); err != nil {
+			if err == ErrUnauthorized {
+				m.locker.Lock()
+				if m.sessions[username] == s {
+					delete(m.sessions, username)
+				}
+				m.locker.Unlock()
+			}
 			return nil, nil, err
 		}
+		return s.c, s.privateKeys, nil
+	}
 
-		encrypted, ok := auths[username]
-		if !ok {
-			return nil, nil, ErrUnauthorized
-		}
+	cachedAuth, err := readCachedAuth(username, secretKey)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		decrypted, err := decrypt(encrypted, &secretKey)
+	c := m.newClient()
+	c.ReAuth = func() error {
+		// Pick up the credentials saved in the meantime, e.g. by reauth
+		latest, err := readCachedAuth(username, secretKey)
 		if err != nil {
-			return nil, nil, ErrUnauthorized
+			return err
 		}
+		cachedAuth = latest
 
-		var cachedAuth CachedAuth
-		if err := json.Unmarshal(decrypted, &cachedAuth); err != nil {
-			return nil, nil, err
+		// Keys are already unlocked, try to only refresh the access token
+		if auth, err := c.RefreshAuth(&cachedAuth.Auth); err == nil {
+			cachedAuth.Auth = *auth
+		} else if _, err := authenticate(c, cachedAuth, username); err != nil {
+			return err
 		}
-
-		c := m.newClient()
-		c.ReAuth = func() error {
-			if _, err := authenticate(c, &cachedAuth, username); err != nil {
-				return err
-			}
-			return EncryptAndSave(&cachedAuth, username, &secretKey)
+		// Don't overwrite the credentials if the bridge password has been
+		// changed
+		if _, err := readCachedAuth(username, secretKey); err != nil {
+			return err
 		}
+		// Save the new refresh token
+		return EncryptAndSave(cachedAuth, username, secretKey)
+	}
 
-		// authenticate updates cachedAuth with the new refresh token
-		privateKeys, err := authenticate(c, &cachedAuth, username)
-		if err != nil {
-			return nil, nil, err
-		}
+	// authenticate updates cachedAuth with the new refresh token
+	privateKeys, err := authenticate(c, cachedAuth, username)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		if err := EncryptAndSave(&cachedAuth, username, &secretKey); err != nil {
-			return nil, nil, err
-		}
+	if err := EncryptAndSave(cachedAuth, username, secretKey); err != nil {
+		return nil, nil, err
+	}
 
-		hashed, err := bcrypt.GenerateFromPassword(secretKey[:], bcrypt.DefaultCost)
-		if err != nil {
-			return nil, nil, err
-		}
+	hashed, err := bcrypt.GenerateFromPassword(secretKey[:], bcrypt.DefaultCost)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		s = &session{
-			c:               c,
-			privateKeys:     privateKeys,
-			hashedSecretKey: hashed,
-		}
-		m.sessions[username] = s
+	s = &session{
+		c:               c,
+		privateKeys:     privateKeys,
+		hashedSecretKey: hashed,
 	}
+	m.locker.Lock()
+	m.sessions[username] = s
+	m.locker.Unlock()
 
 	return s.c, s.privateKeys, nil
 }
 
+// Clients returns the clients of all users who have logged in, indexed by
+// username.
+func (m *Manager) Clients() map[string]*protonmail.Client {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	clients := make(map[string]*protonmail.Client, len(m.sessions))
+	for username, s := range m.sessions {
+		clients[username] = s.c
+	}
+	return clients
+}
+
+// Close forgets all sessions. Unlocked private keys are zeroed in memory, so
+// clients must not be used afterwards.
+func (m *Manager) Close() {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	for username, s := range m.sessions {
+		for _, e := range s.privateKeys {
+			zeroPrivateKey(e.PrivateKey)
+			for _, subkey := range e.Subkeys {
+				zeroPrivateKey(subkey.PrivateKey)
+			}
+		}
+		delete(m.sessions, username)
+	}
+}
+
+func zeroBigInt(i *big.Int) {
+	if i == nil {
+		return
+	}
+	words := i.Bits()
+	for j := range words {
+		words[j] = 0
+	}
+	i.SetInt64(0)
+}
+
+func zeroPrivateKey(k *packet.PrivateKey) {
+	if k == nil {
+		return
+	}
+	if priv, ok := k.PrivateKey.(*rsa.PrivateKey); ok {
+		zeroBigInt(priv.D)
+		for _, p := range priv.Primes {
+			zeroBigInt(p)
+		}
+		zeroBigInt(priv.Precomputed.Dp)
+		zeroBigInt(priv.Precomputed.Dq)
+		zeroBigInt(priv.Precomputed.Qinv)
+	}
+}
+
 func NewManager(newClient func() *protonmail.Client) *Manager {
 	return &Manager{
 		newClient: newClient,
@@ -0,0 +1,235 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func newTestClient(t *testing.T, h http.HandlerFunc) *protonmail.Client {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return &protonmail.Client{RootURL: srv.URL, HTTPClient: srv.Client(), MaxRetries: -1}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// newTestKey generates a key, and returns it along with the armored private
+// key encrypted with passphrase.
+func newTestKey(t *testing.T, passphrase string) (*openpgp.Entity, string) {
+	var armored string
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/addresses/addr":
+			writeJSON(w, http.StatusOK, map[string]interface{}{"Code": 1000, "Address": map[string]interface{}{"Email": "user@example.org"}})
+		case "/keys":
+			var req protonmail.CreateKeyReq
+			json.NewDecoder(r.Body).Decode(&req)
+			armored = req.PrivateKey
+			writeJSON(w, http.StatusOK, map[string]interface{}{"Code": 1000, "Key": map[string]interface{}{}})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	_, e, err := c.GenerateAddressKey("addr", []byte(passphrase))
+	if err != nil {
+		t.Fatalf("GenerateAddressKey() = %v", err)
+	}
+	return e, armored
+}
+
+func encryptArmored(t *testing.T, e *openpgp.Entity, s string) string {
+	var b bytes.Buffer
+	aw, err := armor.Encode(&b, "PGP MESSAGE", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := openpgp.Encrypt(aw, openpgp.EntityList{e}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(s))
+	w.Close()
+	aw.Close()
+	return b.String()
+}
+
+// testAuthServer refreshes sessions, returning a private key encrypted with
+// "password".
+type testAuthServer struct {
+	privateKey  string
+	accessToken string
+	revoked     bool
+	twoFactor   protonmail.TwoFactorMethod
+}
+
+func newTestAuthServer(t *testing.T) *testAuthServer {
+	e, privateKey := newTestKey(t, "password")
+	return &testAuthServer{privateKey: privateKey, accessToken: encryptArmored(t, e, "token")}
+}
+
+func (s *testAuthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/auth/refresh":
+		if s.revoked {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{"Code": 10013, "Error": "Invalid refresh token"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"Code":         1000,
+			"Uid":          "uid",
+			"RefreshToken": "refresh2",
+			"AccessToken":  s.accessToken,
+			"PrivateKey":   s.privateKey,
+		})
+	case "/auth/info":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"Code": 1000, "TwoFactor": s.twoFactor})
+	case "/addresses":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"Code": 1000, "Addresses": []interface{}{}})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestIsInvalidPassword(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{protonmail.ErrInvalidPassphrase, true},
+		{protonmail.ErrInvalidMailboxPassword, true},
+		{ErrUnauthorized, false},
+	}
+	for _, tc := range tests {
+		if got := isInvalidPassword(tc.err); got != tc.want {
+			t.Errorf("isInvalidPassword(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	s := newTestAuthServer(t)
+	tests := []struct {
+		name      string
+		password  string
+		revoked   bool
+		twoFactor protonmail.TwoFactorMethod
+		wantErr   error
+	}{
+		{name: "valid", password: "password"},
+		{name: "password changed", password: "old", wantErr: ErrPasswordChanged},
+		{name: "two-factor without secret", password: "password", revoked: true, twoFactor: protonmail.TwoFactorTOTP, wantErr: ErrSessionRevoked},
+	}
+	for _, tc := range tests {
+		s.revoked = tc.revoked
+		s.twoFactor = tc.twoFactor
+		c := newTestClient(t, s.ServeHTTP)
+
+		cachedAuth := &CachedAuth{
+			Auth:          protonmail.Auth{UID: "uid", RefreshToken: "refresh"},
+			LoginPassword: tc.password,
+		}
+		keys, err := authenticate(c, cachedAuth, "user")
+		if err != tc.wantErr {
+			t.Errorf("%v: authenticate() = %v, want %v", tc.name, err, tc.wantErr)
+		} else if err == nil && len(keys) != 1 {
+			t.Errorf("%v: authenticate() returned %v keys, want 1", tc.name, len(keys))
+		}
+	}
+}
+
+func TestReauth(t *testing.T) {
+	tests := []struct {
+		name      string
+		passwords []string
+		revoked   bool
+		wantRetry []bool
+		wantErr   error
+		wantSaved string
+	}{
+		{name: "new password", passwords: []string{"password"}, wantRetry: []bool{false}, wantSaved: "password"},
+		{name: "retry", passwords: []string{"wrong", "password"}, wantRetry: []bool{false, true}, wantSaved: "password"},
+		{name: "too many attempts", passwords: []string{"a", "b", "c"}, wantRetry: []bool{false, true, true}, wantErr: protonmail.ErrInvalidPassphrase, wantSaved: "old"},
+		{name: "revoked", revoked: true, wantErr: ErrSessionRevoked, wantSaved: "old"},
+	}
+	s := newTestAuthServer(t)
+	for _, tc := range tests {
+		t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+		secretKey, bridgePassword, err := GeneratePassword()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cachedAuth := &CachedAuth{
+			Auth:          protonmail.Auth{UID: "uid", RefreshToken: "refresh"},
+			LoginPassword: "old",
+		}
+		if err := EncryptAndSave(cachedAuth, "user", secretKey); err != nil {
+			t.Fatalf("EncryptAndSave() = %v", err)
+		}
+
+		s.revoked = tc.revoked
+		c := newTestClient(t, s.ServeHTTP)
+		var retries []bool
+		err = Reauth(c, "user", bridgePassword, func(mode protonmail.PasswordMode, retry bool) (string, error) {
+			retries = append(retries, retry)
+			return tc.passwords[len(retries)-1], nil
+		})
+		if err != tc.wantErr {
+			t.Errorf("%v: Reauth() = %v, want %v", tc.name, err, tc.wantErr)
+		}
+		if len(retries) != len(tc.wantRetry) {
+			t.Errorf("%v: Reauth() asked for %v passwords, want %v", tc.name, len(retries), len(tc.wantRetry))
+		} else {
+			for i := range retries {
+				if retries[i] != tc.wantRetry[i] {
+					t.Errorf("%v: Reauth() password %v has retry = %v, want %v", tc.name, i, retries[i], tc.wantRetry[i])
+				}
+			}
+		}
+
+		saved, err := readCachedAuth("user", secretKey)
+		if err != nil {
+			t.Fatalf("%v: readCachedAuth() = %v", tc.name, err)
+		}
+		if saved.LoginPassword != tc.wantSaved {
+			t.Errorf("%v: saved password = %q, want %q", tc.name, saved.LoginPassword, tc.wantSaved)
+		}
+		if wantToken := "refresh2"; !tc.revoked && saved.RefreshToken != wantToken {
+			t.Errorf("%v: saved refresh token = %q, want %q", tc.name, saved.RefreshToken, wantToken)
+		}
+	}
+}
+
+func TestManagerClose(t *testing.T) {
+	e, _ := newTestKey(t, "password")
+	m := NewManager(nil)
+	m.sessions["user"] = &session{privateKeys: openpgp.EntityList{e}}
+
+	m.Close()
+	if len(m.sessions) != 0 {
+		t.Errorf("Close() kept %v sessions, want 0", len(m.sessions))
+	}
+
+	keys := []*rsa.PrivateKey{e.PrivateKey.PrivateKey.(*rsa.PrivateKey)}
+	for _, subkey := range e.Subkeys {
+		keys = append(keys, subkey.PrivateKey.PrivateKey.(*rsa.PrivateKey))
+	}
+	for _, k := range keys {
+		if k.D.Sign() != 0 || k.Primes[0].Sign() != 0 || k.Precomputed.Dp.Sign() != 0 {
+			t.Errorf("Close() didn't zero a private key")
+		}
+	}
+}
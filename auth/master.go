@@ -0,0 +1,264 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// The auth file can optionally be encrypted with a master password. The key
+// is derived with scrypt and the file is encrypted with AES-GCM.
+
+var ErrLocked = errors.New("auth file is encrypted, a master password is required")
+
+var ErrInvalidMasterPassword = errors.New("invalid master password")
+
+const encryptedAuthsMagic = "hydroxide-encrypted-auth\n"
+
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+type encryptedAuths struct {
+	Salt       []byte
+	N, R, P    int
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+type masterKey struct {
+	salt    []byte
+	n, r, p int
+	key     []byte
+}
+
+// master is set once the auth file has been unlocked with a master password.
+// The auth file is then always saved encrypted.
+var master *masterKey
+
+func deriveMasterKey(password, salt []byte, n, r, p int) (*masterKey, error) {
+	key, err := scrypt.Key(password, salt, n, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &masterKey{salt: salt, n: n, r: r, p: p, key: key}, nil
+}
+
+func newMasterKey(password []byte) (*masterKey, error) {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	return deriveMasterKey(password, salt, scryptN, scryptR, scryptP)
+}
+
+func (mk *masterKey) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(mk.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (mk *masterKey) encrypt(plaintext []byte) ([]byte, error) {
+	aead, err := mk.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(&encryptedAuths{
+		Salt:       mk.salt,
+		N:          mk.n,
+		R:          mk.r,
+		P:          mk.p,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plaintext, []byte(encryptedAuthsMagic)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(encryptedAuthsMagic), b...), nil
+}
+
+func (mk *masterKey) decrypt(ea *encryptedAuths) ([]byte, error) {
+	aead, err := mk.aead()
+	if err != nil {
+		return nil, err
+	}
+	if len(ea.Nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce size in encrypted auth file")
+	}
+
+	plaintext, err := aead.Open(nil, ea.Nonce, ea.Ciphertext, []byte(encryptedAuthsMagic))
+	if err != nil {
+		return nil, ErrInvalidMasterPassword
+	}
+	return plaintext, nil
+}
+
+func parseEncryptedAuths(b []byte) (*encryptedAuths, error) {
+	if !bytes.HasPrefix(b, []byte(encryptedAuthsMagic)) {
+		return nil, nil
+	}
+
+	var ea encryptedAuths
+	if err := json.Unmarshal(b[len(encryptedAuthsMagic):], &ea); err != nil {
+		return nil, err
+	}
+	return &ea, nil
+}
+
+func readAuthFile() ([]byte, error) {
+	p, err := authFilePath()
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return b, err
+}
+
+// decryptAuthFile returns the plaintext contents of the auth file.
+func decryptAuthFile(b []byte) ([]byte, error) {
+	ea, err := parseEncryptedAuths(b)
+	if err != nil {
+		return nil, err
+	} else if ea == nil {
+		return b, nil
+	}
+
+	if master == nil {
+		return nil, ErrLocked
+	}
+	return master.decrypt(ea)
+}
+
+// IsEncrypted checks whether the auth file is encrypted with a master
+// password.
+func IsEncrypted() (bool, error) {
+	b, err := readAuthFile()
+	if err != nil {
+		return false, err
+	}
+	ea, err := parseEncryptedAuths(b)
+	return ea != nil, err
+}
+
+// Unlock decrypts the auth file with a master password. Decrypted credentials
+// are only kept in memory.
+func Unlock(password []byte) error {
+	b, err := readAuthFile()
+	if err != nil {
+		return err
+	}
+	ea, err := parseEncryptedAuths(b)
+	if err != nil {
+		return err
+	} else if ea == nil {
+		return errors.New("auth file is not encrypted")
+	}
+
+	mk, err := deriveMasterKey(password, ea.Salt, ea.N, ea.R, ea.P)
+	if err != nil {
+		return err
+	}
+	if _, err := mk.decrypt(ea); err != nil {
+		return err
+	}
+
+	master = mk
+	return nil
+}
+
+// EncryptWithMasterPassword encrypts an existing auth file with a master
+// password, in place. If the file is already encrypted, it must have been
+// unlocked and the master password is changed.
+func EncryptWithMasterPassword(password []byte) error {
+	authFileLocker.Lock()
+	defer authFileLocker.Unlock()
+
+	auths, err := readCachedAuths()
+	if err != nil {
+		return err
+	}
+
+	mk, err := newMasterKey(password)
+	if err != nil {
+		return err
+	}
+	master = mk
+
+	if auths == nil {
+		auths = make(map[string]string)
+	}
+	return saveAuths(auths)
+}
+
+// masterKeySecret is the name of the master key in secret stores.
+const masterKeySecret = "master-key"
+
+// UnlockWithStore decrypts the auth file with the master key saved in a secret
+// store by SaveMasterKey. ErrSecretNotFound is returned if there is none.
+func UnlockWithStore(store SecretStore) error {
+	key, err := store.Get(masterKeySecret)
+	if err != nil {
+		return err
+	}
+
+	b, err := readAuthFile()
+	if err != nil {
+		return err
+	}
+	ea, err := parseEncryptedAuths(b)
+	if err != nil {
+		return err
+	} else if ea == nil {
+		return errors.New("auth file is not encrypted")
+	}
+
+	mk := &masterKey{salt: ea.Salt, n: ea.N, r: ea.R, p: ea.P, key: key}
+	if _, err := mk.decrypt(ea); err != nil {
+		return err
+	}
+
+	master = mk
+	return nil
+}
+
+// SaveMasterKey saves the key derived from the master password in a secret
+// store, so that the auth file can be unlocked without the master password.
+// The auth file must have been unlocked.
+func SaveMasterKey(store SecretStore) error {
+	if master == nil {
+		return ErrLocked
+	}
+	return store.Set(masterKeySecret, master.key)
+}
+
+// Lock forgets the master key. The key is zeroed in memory.
+func Lock() {
+	if master == nil {
+		return
+	}
+	for i := range master.key {
+		master.key[i] = 0
+	}
+	master = nil
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"testing"
+)
+
+// testSecretStore keeps secrets in memory.
+type testSecretStore map[string][]byte
+
+func (s testSecretStore) Get(name string) ([]byte, error) {
+	secret, ok := s[name]
+	if !ok {
+		return nil, ErrSecretNotFound
+	}
+	return append([]byte(nil), secret...), nil
+}
+
+func (s testSecretStore) Set(name string, secret []byte) error {
+	s[name] = append([]byte(nil), secret...)
+	return nil
+}
+
+func (s testSecretStore) Delete(name string) error {
+	delete(s, name)
+	return nil
+}
+
+func TestUnlockWithStore(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	defer Lock()
+
+	secretKey, _, err := GeneratePassword()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := EncryptAndSave(&CachedAuth{}, "user", secretKey); err != nil {
+		t.Fatalf("EncryptAndSave() = %v", err)
+	}
+
+	store := make(testSecretStore)
+	if err := SaveMasterKey(store); err != ErrLocked {
+		t.Errorf("SaveMasterKey() without a master key = %v, want %v", err, ErrLocked)
+	}
+	if err := UnlockWithStore(store); err != ErrSecretNotFound {
+		t.Errorf("UnlockWithStore() with an empty store = %v, want %v", err, ErrSecretNotFound)
+	}
+
+	if err := EncryptWithMasterPassword([]byte("master")); err != nil {
+		t.Fatalf("EncryptWithMasterPassword() = %v", err)
+	}
+	if err := SaveMasterKey(store); err != nil {
+		t.Fatalf("SaveMasterKey() = %v", err)
+	}
+
+	key := master.key
+	Lock()
+	if master != nil {
+		t.Fatalf("Lock() didn't forget the master key")
+	}
+	for _, b := range key {
+		if b != 0 {
+			t.Errorf("Lock() didn't zero the master key")
+			break
+		}
+	}
+	if _, err := ListUsernames(); err != ErrLocked {
+		t.Errorf("ListUsernames() after Lock() = %v, want %v", err, ErrLocked)
+	}
+
+	if err := UnlockWithStore(store); err != nil {
+		t.Fatalf("UnlockWithStore() = %v", err)
+	}
+	if usernames, err := ListUsernames(); err != nil || len(usernames) != 1 || usernames[0] != "user" {
+		t.Errorf("ListUsernames() after UnlockWithStore() = %v, %v, want [user]", usernames, err)
+	}
+
+	Lock()
+	store[masterKeySecret] = make([]byte, 32)
+	if err := UnlockWithStore(store); err != ErrInvalidMasterPassword {
+		t.Errorf("UnlockWithStore() with a wrong key = %v, want %v", err, ErrInvalidMasterPassword)
+	}
+	if master != nil {
+		t.Errorf("UnlockWithStore() with a wrong key set the master key")
+	}
+}
@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+)
+
+// SASL mechanisms all check a username and a bridge password. CRAM-MD5 isn't
+// supported: it requires the server to know the password, but bridge
+// passwords are never stored.
+
+// SASLAuthenticator checks the bridge password of a user.
+type SASLAuthenticator func(username, password string) error
+
+// SASLServerFactory creates a SASL server, which authenticates users with
+// authenticate.
+type SASLServerFactory func(authenticate SASLAuthenticator) sasl.Server
+
+// SASLMechanisms returns the supported SASL mechanisms, indexed by name.
+func SASLMechanisms() map[string]SASLServerFactory {
+	return map[string]SASLServerFactory{
+		sasl.Plain:   newPlainServer,
+		sasl.Login:   newLoginServer,
+		sasl.Xoauth2: newXoauth2Server,
+	}
+}
+
+var errIdentityNotSupported = errors.New("Identities not supported")
+
+func newPlainServer(authenticate SASLAuthenticator) sasl.Server {
+	return sasl.NewPlainServer(func(identity, username, password string) error {
+		if identity != "" && identity != username {
+			return errIdentityNotSupported
+		}
+		return authenticate(username, password)
+	})
+}
+
+func newLoginServer(authenticate SASLAuthenticator) sasl.Server {
+	return sasl.NewLoginServer(sasl.LoginAuthenticator(authenticate))
+}
+
+// parseXoauth2Response parses an XOAUTH2 initial client response, as
+// described in https://developers.google.com/gmail/imap/xoauth2-protocol.
+func parseXoauth2Response(response []byte) (username, token string, err error) {
+	for _, kv := range bytes.Split(response, []byte("\x01")) {
+		if len(kv) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(string(kv), "=", 2)
+		if len(parts) != 2 {
+			return "", "", errors.New("Invalid response")
+		}
+		switch parts[0] {
+		case "user":
+			username = parts[1]
+		case "auth":
+			scheme := strings.SplitN(parts[1], " ", 2)
+			if len(scheme) != 2 || !strings.EqualFold(scheme[0], "Bearer") {
+				return "", "", errors.New("Unsupported authorization scheme")
+			}
+			token = scheme[1]
+		}
+	}
+	if username == "" || token == "" {
+		return "", "", errors.New("Invalid response")
+	}
+	return username, token, nil
+}
+
+// xoauth2Server implements the XOAUTH2 mechanism. The token is the bridge
+// password of the user.
+type xoauth2Server struct {
+	authenticate SASLAuthenticator
+	started      bool
+	err          error
+}
+
+func newXoauth2Server(authenticate SASLAuthenticator) sasl.Server {
+	return &xoauth2Server{authenticate: authenticate}
+}
+
+func (s *xoauth2Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	if s.err != nil {
+		// The client acknowledged the error
+		return nil, true, s.err
+	}
+	if s.started {
+		return nil, true, sasl.ErrUnexpectedClientResponse
+	}
+
+	// No initial response, send an empty challenge
+	if response == nil {
+		return []byte{}, false, nil
+	}
+	s.started = true
+
+	username, token, err := parseXoauth2Response(response)
+	if err != nil {
+		return nil, true, err
+	}
+	if err := s.authenticate(username, token); err != nil {
+		// Send an error challenge, the client replies with an empty response
+		s.err = err
+		challenge, _ := json.Marshal(&sasl.Xoauth2Error{
+			Status:  "401",
+			Schemes: "bearer",
+		})
+		return challenge, false, nil
+	}
+	return nil, true, nil
+}
@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+)
+
+func TestParseXoauth2Response(t *testing.T) {
+	tests := []struct {
+		response        string
+		username, token string
+		wantErr         bool
+	}{
+		{response: "user=alice\x01auth=Bearer secret\x01\x01", username: "alice", token: "secret"},
+		{response: "auth=bearer secret\x01user=alice", username: "alice", token: "secret"},
+		{response: "user=alice\x01auth=Bearer a b\x01host=example.org\x01\x01", username: "alice", token: "a b"},
+		{response: "user=alice\x01\x01", wantErr: true},
+		{response: "auth=Bearer secret\x01\x01", wantErr: true},
+		{response: "user=alice\x01auth=Basic secret\x01\x01", wantErr: true},
+		{response: "user=alice\x01auth=Bearer\x01\x01", wantErr: true},
+		{response: "user=alice\x01invalid\x01\x01", wantErr: true},
+		{response: "", wantErr: true},
+	}
+	for _, tc := range tests {
+		username, token, err := parseXoauth2Response([]byte(tc.response))
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseXoauth2Response(%q) = nil, want an error", tc.response)
+			}
+		} else if err != nil {
+			t.Errorf("parseXoauth2Response(%q) = %v", tc.response, err)
+		} else if username != tc.username || token != tc.token {
+			t.Errorf("parseXoauth2Response(%q) = %q, %q, want %q, %q", tc.response, username, token, tc.username, tc.token)
+		}
+	}
+}
+
+var errTestCredentials = errors.New("invalid credentials")
+
+// testAuthenticate accepts the password "secret" for the user "alice".
+func testAuthenticate(username, password string) error {
+	if username != "alice" || password != "secret" {
+		return errTestCredentials
+	}
+	return nil
+}
+
+func TestSASLMechanisms(t *testing.T) {
+	xoauth2Err, _ := json.Marshal(&sasl.Xoauth2Error{Status: "401", Schemes: "bearer"})
+
+	tests := []struct {
+		name string
+		mech string
+		// noInitial is set if the client doesn't send an initial response
+		noInitial bool
+		responses []string
+		// challenges are the challenges sent before the exchange is done
+		challenges []string
+		wantErr    error
+	}{
+		{
+			name:      "plain",
+			mech:      sasl.Plain,
+			responses: []string{"\x00alice\x00secret"},
+		},
+		{
+			name:      "plain with identity",
+			mech:      sasl.Plain,
+			responses: []string{"alice\x00alice\x00secret"},
+		},
+		{
+			name:      "plain with another identity",
+			mech:      sasl.Plain,
+			responses: []string{"bob\x00alice\x00secret"},
+			wantErr:   errIdentityNotSupported,
+		},
+		{
+			name:      "plain wrong password",
+			mech:      sasl.Plain,
+			responses: []string{"\x00alice\x00wrong"},
+			wantErr:   errTestCredentials,
+		},
+		{
+			name:       "login",
+			mech:       sasl.Login,
+			responses:  []string{"", "alice", "secret"},
+			challenges: []string{"Username:", "Password:"},
+		},
+		{
+			name:       "login wrong password",
+			mech:       sasl.Login,
+			responses:  []string{"", "alice", "wrong"},
+			challenges: []string{"Username:", "Password:"},
+			wantErr:    errTestCredentials,
+		},
+		{
+			name:      "xoauth2",
+			mech:      sasl.Xoauth2,
+			responses: []string{"user=alice\x01auth=Bearer secret\x01\x01"},
+		},
+		{
+			name:       "xoauth2 without initial response",
+			mech:       sasl.Xoauth2,
+			noInitial:  true,
+			responses:  []string{"user=alice\x01auth=Bearer secret\x01\x01"},
+			challenges: []string{""},
+		},
+		{
+			name:       "xoauth2 wrong token",
+			mech:       sasl.Xoauth2,
+			responses:  []string{"user=alice\x01auth=Bearer wrong\x01\x01", ""},
+			challenges: []string{string(xoauth2Err)},
+			wantErr:    errTestCredentials,
+		},
+	}
+	for _, tc := range tests {
+		newServer, ok := SASLMechanisms()[tc.mech]
+		if !ok {
+			t.Errorf("%v: SASLMechanisms() doesn't contain %v", tc.name, tc.mech)
+			continue
+		}
+		s := newServer(testAuthenticate)
+
+		var responses [][]byte
+		if tc.noInitial {
+			responses = append(responses, nil)
+		}
+		for _, resp := range tc.responses {
+			responses = append(responses, []byte(resp))
+		}
+
+		var challenges []string
+		var err error
+		done := false
+		for i, resp := range responses {
+			var challenge []byte
+			challenge, done, err = s.Next(resp)
+			if done || err != nil {
+				if i != len(responses)-1 {
+					t.Errorf("%v: exchange done after %v responses, want %v", tc.name, i+1, len(responses))
+				}
+				break
+			}
+			challenges = append(challenges, string(challenge))
+		}
+
+		if !done && err == nil {
+			t.Errorf("%v: exchange not done", tc.name)
+		}
+		if err != tc.wantErr {
+			t.Errorf("%v: Next() = %v, want %v", tc.name, err, tc.wantErr)
+		}
+		if len(challenges) != len(tc.challenges) {
+			t.Errorf("%v: challenges = %q, want %q", tc.name, challenges, tc.challenges)
+			continue
+		}
+		for i := range challenges {
+			if challenges[i] != tc.challenges[i] {
+				t.Errorf("%v: challenges = %q, want %q", tc.name, challenges, tc.challenges)
+				break
+			}
+		}
+	}
+}
+
+func TestXoauth2ServerUnexpectedResponse(t *testing.T) {
+	s := newXoauth2Server(testAuthenticate)
+	if _, done, err := s.Next([]byte("user=alice\x01auth=Bearer secret\x01\x01")); !done || err != nil {
+		t.Fatalf("Next() = %v, %v, want done", done, err)
+	}
+	if _, _, err := s.Next([]byte("more")); err != sasl.ErrUnexpectedClientResponse {
+		t.Errorf("Next() after done = %v, want %v", err, sasl.ErrUnexpectedClientResponse)
+	}
+}
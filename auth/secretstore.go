@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/emersion/hydroxide/config"
+)
+
+// ErrSecretNotFound is returned by SecretStore.Get when there is no secret
+// with the requested name.
+var ErrSecretNotFound = errors.New("secret not found")
+
+// SecretStore stores secrets outside of the configuration directory, e.g. in
+// the OS keyring.
+type SecretStore interface {
+	Get(name string) ([]byte, error)
+	Set(name string, secret []byte) error
+	Delete(name string) error
+}
+
+// NewSecretStore returns the secret store with the given name. Only
+// "secret-service", the freedesktop.org Secret Service implemented by GNOME
+// Keyring and KWallet, is supported.
+func NewSecretStore(name string) (SecretStore, error) {
+	switch name {
+	case "secret-service":
+		return &secretServiceStore{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported secret store %q", name)
+	}
+}
+
+// secretServiceStore stores secrets with libsecret's secret-tool. Secrets are
+// passed on the standard input, never on the command line.
+type secretServiceStore struct{}
+
+func (s *secretServiceStore) attrs(name string) ([]string, error) {
+	// Instances with a different configuration directory don't share secrets
+	dir, err := config.Dir()
+	if err != nil {
+		return nil, err
+	}
+	return []string{"service", "hydroxide", "config", dir, "name", name}, nil
+}
+
+func (s *secretServiceStore) run(stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command("secret-tool", args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if msg := strings.TrimSpace(stderr.String()); err != nil && msg != "" {
+		return nil, fmt.Errorf("secret-tool: %v", msg)
+	}
+	return out, err
+}
+
+func (s *secretServiceStore) Get(name string) ([]byte, error) {
+	attrs, err := s.attrs(name)
+	if err != nil {
+		return nil, err
+	}
+	out, err := s.run(nil, append([]string{"lookup"}, attrs...)...)
+	if _, ok := err.(*exec.ExitError); ok || (err == nil && len(out) == 0) {
+		// secret-tool fails silently when the secret doesn't exist
+		return nil, ErrSecretNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("secret-tool: %v", err)
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+}
+
+func (s *secretServiceStore) Set(name string, secret []byte) error {
+	attrs, err := s.attrs(name)
+	if err != nil {
+		return err
+	}
+	args := append([]string{"store", "--label=hydroxide " + name}, attrs...)
+	if _, err := s.run([]byte(base64.StdEncoding.EncodeToString(secret)), args...); err != nil {
+		return fmt.Errorf("cannot store secret: %v", err)
+	}
+	return nil
+}
+
+func (s *secretServiceStore) Delete(name string) error {
+	attrs, err := s.attrs(name)
+	if err != nil {
+		return err
+	}
+	if _, err := s.run(nil, append([]string{"clear"}, attrs...)...); err != nil {
+		return fmt.Errorf("cannot delete secret: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeSecretTool emulates secret-tool, storing each secret in a file named
+// after the value of the last attribute. Arguments are logged to args.
+const fakeSecretTool = `#!/bin/sh
+dir=$(dirname "$0")
+echo "$@" >> "$dir/args"
+for last; do :; done
+case "$1" in
+lookup) [ -f "$dir/secret-$last" ] || exit 1; cat "$dir/secret-$last" ;;
+store) cat > "$dir/secret-$last" ;;
+clear) rm -f "$dir/secret-$last" ;;
+*) echo "unknown command" >&2; exit 2 ;;
+esac
+`
+
+func TestNewSecretStore(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"secret-service", false},
+		{"keychain", true},
+		{"", true},
+	}
+	for _, tc := range tests {
+		_, err := NewSecretStore(tc.name)
+		if tc.wantErr && err == nil {
+			t.Errorf("NewSecretStore(%q) = nil, want an error", tc.name)
+		} else if !tc.wantErr && err != nil {
+			t.Errorf("NewSecretStore(%q) = %v", tc.name, err)
+		}
+	}
+}
+
+func TestSecretServiceStore(t *testing.T) {
+	bin := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(bin, "secret-tool"), []byte(fakeSecretTool), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	configHome := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", configHome)
+
+	s, err := NewSecretStore("secret-service")
+	if err != nil {
+		t.Fatalf("NewSecretStore() = %v", err)
+	}
+
+	if _, err := s.Get("key"); err != ErrSecretNotFound {
+		t.Errorf("Get() before Set() = %v, want %v", err, ErrSecretNotFound)
+	}
+
+	secret := []byte{0, 1, 2, '\n', 0xff}
+	if err := s.Set("key", secret); err != nil {
+		t.Fatalf("Set() = %v", err)
+	}
+	if got, err := s.Get("key"); err != nil {
+		t.Errorf("Get() = %v", err)
+	} else if string(got) != string(secret) {
+		t.Errorf("Get() = %v, want %v", got, secret)
+	}
+
+	if err := s.Delete("key"); err != nil {
+		t.Fatalf("Delete() = %v", err)
+	}
+	if _, err := s.Get("key"); err != ErrSecretNotFound {
+		t.Errorf("Get() after Delete() = %v, want %v", err, ErrSecretNotFound)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(bin, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantAttrs := "service hydroxide config " + filepath.Join(configHome, "hydroxide") + " name key"
+	for _, l := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		if !strings.HasSuffix(l, wantAttrs) {
+			t.Errorf("secret-tool called with %q, want attributes %q", l, wantAttrs)
+		}
+		if strings.Contains(l, "AAEC") {
+			t.Errorf("secret-tool called with the secret on the command line: %q", l)
+		}
+	}
+}
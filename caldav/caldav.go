@@ -0,0 +1,591 @@
+// Package caldav serves ProtonMail calendars over CalDAV, as defined in
+// RFC 4791. Calendars are read-only.
+package caldav
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/hydroxide/protonmail"
+	"golang.org/x/crypto/openpgp"
+)
+
+// The principal is at the root. Calendars are exposed as collections under
+// calendarsPath, which is the calendar home set, and events are exposed as
+// objects named after their ID.
+
+const calendarsPath = "/calendars"
+
+const eventExt = ".ics"
+
+const calendarMIMEType = "text/calendar"
+
+// eventsPageSize is the number of events requested per page.
+const eventsPageSize = 100
+
+var errNotFound = errors.New("hydroxide/caldav: not found")
+
+// The time window used when all events of a calendar are listed.
+var (
+	allEventsStart = time.Date(1970, time.January, 1, 0, 0, 0, 0, time.UTC)
+	allEventsEnd   = time.Date(2100, time.January, 1, 0, 0, 0, 0, time.UTC)
+)
+
+const (
+	nsDAV    = "DAV:"
+	nsCalDAV = "urn:ietf:params:xml:ns:caldav"
+)
+
+var (
+	getetagName        = xml.Name{Space: nsDAV, Local: "getetag"}
+	getcontenttypeName = xml.Name{Space: nsDAV, Local: "getcontenttype"}
+	calendarDataName   = xml.Name{Space: nsCalDAV, Local: "calendar-data"}
+)
+
+// splitPath splits a path under calendarsPath into a calendar ID and an event
+// ID. Both are empty for the home set. ok is false if p isn't under
+// calendarsPath.
+func splitPath(p string) (cal, event string, ok bool) {
+	if p != calendarsPath && !strings.HasPrefix(p, calendarsPath+"/") {
+		return "", "", false
+	}
+	p = strings.Trim(strings.TrimPrefix(p, calendarsPath), "/")
+	parts := strings.SplitN(p, "/", 2)
+	cal = parts[0]
+	if len(parts) == 2 {
+		event = strings.TrimSuffix(parts[1], eventExt)
+	}
+	return cal, event, true
+}
+
+// home is the calendar home set of a user. Calendar key rings are cached,
+// events are always fetched from ProtonMail.
+type home struct {
+	c           *protonmail.Client
+	privateKeys openpgp.EntityList
+
+	locker    sync.Mutex
+	calendars map[string]*protonmail.Calendar
+	keyRings  map[string]openpgp.EntityList
+}
+
+func (h *home) listCalendars() ([]*protonmail.Calendar, error) {
+	calendars, err := h.c.ListCalendars()
+	if err != nil {
+		return nil, err
+	}
+
+	h.locker.Lock()
+	defer h.locker.Unlock()
+	h.calendars = make(map[string]*protonmail.Calendar, len(calendars))
+	for _, cal := range calendars {
+		h.calendars[cal.ID] = cal
+	}
+	return calendars, nil
+}
+
+func (h *home) calendar(id string) (*protonmail.Calendar, error) {
+	h.locker.Lock()
+	cal, ok := h.calendars[id]
+	h.locker.Unlock()
+	if ok {
+		return cal, nil
+	}
+
+	// The calendar may have been created since the list has been fetched
+	if _, err := h.listCalendars(); err != nil {
+		return nil, err
+	}
+
+	h.locker.Lock()
+	defer h.locker.Unlock()
+	if cal, ok := h.calendars[id]; ok {
+		return cal, nil
+	}
+	return nil, errNotFound
+}
+
+func (h *home) keyRing(calendarID string) (openpgp.EntityList, error) {
+	h.locker.Lock()
+	keyRing, ok := h.keyRings[calendarID]
+	h.locker.Unlock()
+	if ok {
+		return keyRing, nil
+	}
+
+	keyRing, err := h.c.UnlockCalendarKeys(calendarID, h.privateKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	h.locker.Lock()
+	h.keyRings[calendarID] = keyRing
+	h.locker.Unlock()
+	return keyRing, nil
+}
+
+// listEvents returns the events of a calendar between start and end,
+// including recurring events starting before start.
+func (h *home) listEvents(calendarID string, start, end time.Time) ([]*protonmail.CalendarEvent, error) {
+	types := []protonmail.CalendarEventType{
+		protonmail.CalendarEventPartDayInsideWindow,
+		protonmail.CalendarEventPartDayBeforeWindow,
+		protonmail.CalendarEventFullDayInsideWindow,
+		protonmail.CalendarEventFullDayBeforeWindow,
+	}
+
+	var events []*protonmail.CalendarEvent
+	seen := make(map[string]bool)
+	for _, t := range types {
+		filter := &protonmail.CalendarEventFilter{
+			Start:    start,
+			End:      end,
+			Timezone: "UTC",
+			Type:     t,
+			PageSize: eventsPageSize,
+		}
+		for {
+			page, err := h.c.ListCalendarEvents(calendarID, filter)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, event := range page {
+				event.CalendarID = calendarID
+				if !seen[event.ID] {
+					seen[event.ID] = true
+					events = append(events, event)
+				}
+			}
+
+			if len(page) < eventsPageSize {
+				break
+			}
+			filter.Page++
+		}
+	}
+	return events, nil
+}
+
+func (h *home) getEvent(calendarID, eventID string) (*protonmail.CalendarEvent, error) {
+	event, err := h.c.GetCalendarEvent(calendarID, eventID)
+	if apiErr, ok := err.(*protonmail.APIError); ok && apiErr.HTTPStatus == http.StatusNotFound {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	event.CalendarID = calendarID
+	return event, nil
+}
+
+// eventData decrypts an event and formats it as an iCalendar object.
+func (h *home) eventData(event *protonmail.CalendarEvent) ([]byte, error) {
+	keyRing, err := h.keyRing(event.CalendarID)
+	if err != nil {
+		return nil, err
+	}
+
+	cards, keyPackets, err := event.Cards()
+	if err != nil {
+		return nil, err
+	}
+
+	readers := make([]io.Reader, len(cards))
+	for i, card := range cards {
+		if readers[i], err = card.Read(keyPackets[i], keyRing); err != nil {
+			return nil, err
+		}
+	}
+	return mergeCards(readers)
+}
+
+func fsError(err error) error {
+	if err == errNotFound {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+// fileSystem contains the principal, the calendar home set, the calendars and
+// their events.
+type fileSystem struct {
+	h *home
+}
+
+// lookup returns the calendar and the event designated by name. Both are nil
+// for the calendar home set. ok is false for the principal.
+func (fs *fileSystem) lookup(name string) (cal *protonmail.Calendar, event *protonmail.CalendarEvent, ok bool, err error) {
+	calID, eventID, ok := splitPath(name)
+	if !ok {
+		if name != "/" {
+			return nil, nil, false, errNotFound
+		}
+		return nil, nil, false, nil
+	} else if calID == "" {
+		return nil, nil, true, nil
+	}
+
+	cal, err = fs.h.calendar(calID)
+	if err != nil || eventID == "" {
+		return cal, nil, true, err
+	}
+
+	event, err = fs.h.getEvent(calID, eventID)
+	return cal, event, true, err
+}
+
+func (fs *fileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (fs *fileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE) != 0 {
+		return nil, os.ErrPermission
+	}
+
+	cal, event, ok, err := fs.lookup(name)
+	if err != nil {
+		return nil, fsError(err)
+	}
+
+	if !ok {
+		return &principalFile{}, nil
+	} else if cal == nil {
+		return &homeFile{h: fs.h}, nil
+	} else if event == nil {
+		return &calendarFile{h: fs.h, cal: cal}, nil
+	}
+	return &eventFile{h: fs.h, event: event}, nil
+}
+
+func (fs *fileSystem) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+func (fs *fileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+func (fs *fileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	cal, event, ok, err := fs.lookup(name)
+	if err != nil {
+		return nil, fsError(err)
+	}
+
+	if !ok {
+		return collectionFileInfo{"/"}, nil
+	} else if cal == nil {
+		return collectionFileInfo{strings.TrimPrefix(calendarsPath, "/")}, nil
+	} else if event == nil {
+		return collectionFileInfo{cal.ID}, nil
+	}
+	return eventFileInfo{event}, nil
+}
+
+type collectionFileInfo struct {
+	name string
+}
+
+func (fi collectionFileInfo) Name() string       { return fi.name }
+func (fi collectionFileInfo) Size() int64        { return 0 }
+func (fi collectionFileInfo) Mode() os.FileMode  { return os.ModeDir | 0555 }
+func (fi collectionFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi collectionFileInfo) IsDir() bool        { return true }
+func (fi collectionFileInfo) Sys() interface{}   { return nil }
+
+type eventFileInfo struct {
+	event *protonmail.CalendarEvent
+}
+
+func (fi eventFileInfo) Name() string       { return fi.event.ID + eventExt }
+func (fi eventFileInfo) Size() int64        { return 0 }
+func (fi eventFileInfo) Mode() os.FileMode  { return 0444 }
+func (fi eventFileInfo) ModTime() time.Time { return time.Unix(fi.event.LastEditTime, 0) }
+func (fi eventFileInfo) IsDir() bool        { return false }
+func (fi eventFileInfo) Sys() interface{}   { return nil }
+
+func deadProps(props []webdav.Property) map[xml.Name]webdav.Property {
+	m := make(map[xml.Name]webdav.Property, len(props))
+	for _, prop := range props {
+		m[prop.XMLName] = prop
+	}
+	return m
+}
+
+func escapeText(s string) []byte {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.Bytes()
+}
+
+var (
+	principalProp = webdav.Property{
+		XMLName:  xml.Name{Space: nsDAV, Local: "current-user-principal"},
+		InnerXML: []byte(`<href xmlns="DAV:">/</href>`),
+	}
+	homeSetProp = webdav.Property{
+		XMLName:  xml.Name{Space: nsCalDAV, Local: "calendar-home-set"},
+		InnerXML: []byte(`<href xmlns="DAV:">` + calendarsPath + `/</href>`),
+	}
+	readPrivilegeProp = webdav.Property{
+		XMLName:  xml.Name{Space: nsDAV, Local: "current-user-privilege-set"},
+		InnerXML: []byte(`<privilege xmlns="DAV:"><read/></privilege>`),
+	}
+)
+
+// dirFile implements the methods of webdav.File which are invalid for
+// collections.
+type dirFile struct{}
+
+func (dirFile) Close() error {
+	return nil
+}
+
+func (dirFile) Read(b []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (dirFile) Write(b []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (dirFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (dirFile) Patch([]webdav.Proppatch) ([]webdav.Propstat, error) {
+	return nil, os.ErrPermission
+}
+
+type principalFile struct {
+	dirFile
+}
+
+func (f *principalFile) Readdir(count int) ([]os.FileInfo, error) {
+	return []os.FileInfo{collectionFileInfo{strings.TrimPrefix(calendarsPath, "/")}}, nil
+}
+
+func (f *principalFile) Stat() (os.FileInfo, error) {
+	return collectionFileInfo{"/"}, nil
+}
+
+func (f *principalFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return deadProps([]webdav.Property{
+		{
+			XMLName:  xml.Name{Space: nsDAV, Local: "resourcetype"},
+			InnerXML: []byte(`<collection xmlns="DAV:"/><principal xmlns="DAV:"/>`),
+		},
+		principalProp,
+		homeSetProp,
+		readPrivilegeProp,
+	}), nil
+}
+
+type homeFile struct {
+	dirFile
+	h *home
+}
+
+func (f *homeFile) Readdir(count int) ([]os.FileInfo, error) {
+	calendars, err := f.h.listCalendars()
+	if err != nil {
+		return nil, err
+	}
+
+	fis := make([]os.FileInfo, len(calendars))
+	for i, cal := range calendars {
+		fis[i] = collectionFileInfo{cal.ID}
+	}
+	return fis, nil
+}
+
+func (f *homeFile) Stat() (os.FileInfo, error) {
+	return collectionFileInfo{strings.TrimPrefix(calendarsPath, "/")}, nil
+}
+
+func (f *homeFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return deadProps([]webdav.Property{
+		{
+			XMLName:  xml.Name{Space: nsDAV, Local: "displayname"},
+			InnerXML: []byte("Calendars"),
+		},
+		principalProp,
+		homeSetProp,
+		readPrivilegeProp,
+	}), nil
+}
+
+type calendarFile struct {
+	dirFile
+	h   *home
+	cal *protonmail.Calendar
+}
+
+func (f *calendarFile) Readdir(count int) ([]os.FileInfo, error) {
+	events, err := f.h.listEvents(f.cal.ID, allEventsStart, allEventsEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	fis := make([]os.FileInfo, len(events))
+	for i, event := range events {
+		fis[i] = eventFileInfo{event}
+	}
+	return fis, nil
+}
+
+func (f *calendarFile) Stat() (os.FileInfo, error) {
+	return collectionFileInfo{f.cal.ID}, nil
+}
+
+func (f *calendarFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return deadProps([]webdav.Property{
+		{
+			XMLName:  xml.Name{Space: nsDAV, Local: "resourcetype"},
+			InnerXML: []byte(`<collection xmlns="DAV:"/><calendar xmlns="urn:ietf:params:xml:ns:caldav"/>`),
+		},
+		{
+			XMLName:  xml.Name{Space: nsDAV, Local: "displayname"},
+			InnerXML: escapeText(f.cal.Name),
+		},
+		{
+			XMLName:  xml.Name{Space: nsCalDAV, Local: "calendar-description"},
+			InnerXML: escapeText(f.cal.Description),
+		},
+		{
+			XMLName:  xml.Name{Space: "http://apple.com/ns/ical/", Local: "calendar-color"},
+			InnerXML: escapeText(f.cal.Color),
+		},
+		{
+			XMLName:  xml.Name{Space: nsCalDAV, Local: "supported-calendar-component-set"},
+			InnerXML: []byte(`<comp xmlns="urn:ietf:params:xml:ns:caldav" name="VEVENT"/>`),
+		},
+		{
+			XMLName:  xml.Name{Space: nsCalDAV, Local: "supported-calendar-data"},
+			InnerXML: []byte(`<calendar-data xmlns="urn:ietf:params:xml:ns:caldav" content-type="text/calendar" version="2.0"/>`),
+		},
+		{
+			XMLName: xml.Name{Space: nsDAV, Local: "supported-report-set"},
+			InnerXML: []byte(`<supported-report xmlns="DAV:"><report><calendar-query xmlns="urn:ietf:params:xml:ns:caldav"/></report></supported-report>` +
+				`<supported-report xmlns="DAV:"><report><calendar-multiget xmlns="urn:ietf:params:xml:ns:caldav"/></report></supported-report>`),
+		},
+		readPrivilegeProp,
+	}), nil
+}
+
+// eventFile is a read-only event. It's decrypted when it's first read.
+type eventFile struct {
+	h     *home
+	event *protonmail.CalendarEvent
+	r     *bytes.Reader
+}
+
+func (f *eventFile) Close() error {
+	return nil
+}
+
+func (f *eventFile) reader() (*bytes.Reader, error) {
+	if f.r != nil {
+		return f.r, nil
+	}
+
+	b, err := f.h.eventData(f.event)
+	if err != nil {
+		return nil, err
+	}
+	f.r = bytes.NewReader(b)
+	return f.r, nil
+}
+
+func (f *eventFile) Read(b []byte) (int, error) {
+	r, err := f.reader()
+	if err != nil {
+		return 0, err
+	}
+	return r.Read(b)
+}
+
+func (f *eventFile) Write(b []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *eventFile) Seek(offset int64, whence int) (int64, error) {
+	r, err := f.reader()
+	if err != nil {
+		return 0, err
+	}
+	return r.Seek(offset, whence)
+}
+
+func (f *eventFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (f *eventFile) Stat() (os.FileInfo, error) {
+	return eventFileInfo{f.event}, nil
+}
+
+func (f *eventFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return deadProps([]webdav.Property{
+		{XMLName: getcontenttypeName, InnerXML: []byte(calendarMIMEType)},
+	}), nil
+}
+
+func (f *eventFile) Patch([]webdav.Proppatch) ([]webdav.Propstat, error) {
+	return nil, os.ErrPermission
+}
+
+type handler struct {
+	h      *home
+	webdav *webdav.Handler
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+		if r.URL.Path == "/.well-known/caldav" {
+			http.Redirect(w, r, "/", http.StatusMovedPermanently)
+			return
+		}
+	case "OPTIONS":
+		w.Header().Add("DAV", "calendar-access")
+		w.Header().Add("Allow", "REPORT")
+	case "PROPFIND":
+	case "REPORT":
+		h.serveReport(w, r)
+		return
+	default:
+		http.Error(w, "calendars are read-only", http.StatusForbidden)
+		return
+	}
+
+	h.webdav.ServeHTTP(w, r)
+}
+
+// NewHandler returns an HTTP handler serving the calendars of a user.
+// privateKeys are the unlocked keys of the user, used to decrypt the
+// calendar keys.
+func NewHandler(c *protonmail.Client, privateKeys openpgp.EntityList) http.Handler {
+	if len(privateKeys) == 0 {
+		panic("hydroxide/caldav: no private key available")
+	}
+
+	h := &home{
+		c:           c,
+		privateKeys: privateKeys,
+		keyRings:    make(map[string]openpgp.EntityList),
+	}
+	return &handler{
+		h:      h,
+		webdav: &webdav.Handler{FileSystem: &fileSystem{h}},
+	}
+}
@@ -0,0 +1,142 @@
+package caldav
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// ProtonMail splits events in several cards, each one containing a VCALENDAR
+// with a single VEVENT holding some of the properties. The properties
+// identifying the event are repeated in each card.
+var identityProps = map[string]bool{
+	"UID":           true,
+	"DTSTAMP":       true,
+	"RECURRENCE-ID": true,
+	"SEQUENCE":      true,
+}
+
+// maxLineLen is the maximum length of a content line, in bytes, excluding the
+// line break.
+const maxLineLen = 75
+
+func propName(line string) string {
+	if i := strings.IndexAny(line, ":;"); i >= 0 {
+		line = line[:i]
+	}
+	return strings.ToUpper(line)
+}
+
+// readLines reads the unfolded content lines of an iCalendar object.
+func readLines(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// eventLines returns the content lines of the VEVENT component of a card,
+// including its sub-components but not its BEGIN and END lines.
+func eventLines(lines []string) []string {
+	var event []string
+	var stack []string
+	for _, line := range lines {
+		name := propName(line)
+		switch name {
+		case "BEGIN":
+			var v string
+			if len(line) > len(name) {
+				v = strings.ToUpper(line[len(name)+1:])
+			}
+			stack = append(stack, v)
+			if len(stack) == 2 && v == "VEVENT" {
+				continue
+			}
+		case "END":
+			n := len(stack)
+			if n > 0 {
+				stack = stack[:n-1]
+			}
+			if n == 2 && stack[0] == "VCALENDAR" {
+				continue
+			}
+		}
+
+		if len(stack) >= 2 && stack[0] == "VCALENDAR" && stack[1] == "VEVENT" {
+			event = append(event, line)
+		}
+	}
+	return event
+}
+
+func writeLine(w *bytes.Buffer, line string) {
+	for len(line) > maxLineLen {
+		n := maxLineLen
+		for n > 0 && !utf8.RuneStart(line[n]) {
+			n--
+		}
+		w.WriteString(line[:n] + "\r\n ")
+		line = line[n:]
+	}
+	w.WriteString(line + "\r\n")
+}
+
+// mergeCards merges the cards of an event into a single iCalendar object.
+func mergeCards(cards []io.Reader) ([]byte, error) {
+	var event []string
+	seen := make(map[string]bool)
+	for _, r := range cards {
+		lines, err := readLines(r)
+		if err != nil {
+			return nil, err
+		}
+
+		depth := 0
+		for _, line := range eventLines(lines) {
+			switch propName(line) {
+			case "BEGIN":
+				depth++
+			case "END":
+				depth--
+			default:
+				name := propName(line)
+				if depth == 0 && identityProps[name] {
+					if seen[name] {
+						continue
+					}
+					seen[name] = true
+				}
+			}
+			event = append(event, line)
+		}
+	}
+	if len(event) == 0 {
+		return nil, errors.New("hydroxide/caldav: event has no VEVENT component")
+	}
+
+	var b bytes.Buffer
+	writeLine(&b, "BEGIN:VCALENDAR")
+	writeLine(&b, "VERSION:2.0")
+	writeLine(&b, "PRODID:-//emersion//hydroxide//EN")
+	writeLine(&b, "BEGIN:VEVENT")
+	for _, line := range event {
+		writeLine(&b, line)
+	}
+	writeLine(&b, "END:VEVENT")
+	writeLine(&b, "END:VCALENDAR")
+	return b.Bytes(), nil
+}
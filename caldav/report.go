@@ -0,0 +1,262 @@
+package caldav
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// go-webdav doesn't support CalDAV reports, calendar-query and
+// calendar-multiget are handled here. Time ranges are passed to ProtonMail,
+// which returns the events overlapping with them. Other filters aren't
+// supported.
+
+// timeRangeLayout is the layout of UTC date-times in time ranges.
+const timeRangeLayout = "20060102T150405Z"
+
+// https://tools.ietf.org/html/rfc4791#section-9.9
+type timeRange struct {
+	Start string `xml:"start,attr"`
+	End   string `xml:"end,attr"`
+}
+
+// https://tools.ietf.org/html/rfc4791#section-9.7.1
+type compFilter struct {
+	Name        string       `xml:"name,attr"`
+	TimeRange   *timeRange   `xml:"urn:ietf:params:xml:ns:caldav time-range"`
+	CompFilters []compFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+}
+
+// https://tools.ietf.org/html/rfc4791#section-9.5
+type calendarQuery struct {
+	XMLName xml.Name             `xml:"urn:ietf:params:xml:ns:caldav calendar-query"`
+	Allprop *struct{}            `xml:"DAV: allprop"`
+	Prop    webdav.PropfindProps `xml:"DAV: prop"`
+	Filter  compFilter           `xml:"urn:ietf:params:xml:ns:caldav filter>comp-filter"`
+}
+
+// https://tools.ietf.org/html/rfc4791#section-9.10
+type calendarMultiget struct {
+	XMLName xml.Name             `xml:"urn:ietf:params:xml:ns:caldav calendar-multiget"`
+	Allprop *struct{}            `xml:"DAV: allprop"`
+	Prop    webdav.PropfindProps `xml:"DAV: prop"`
+	Href    []string             `xml:"DAV: href"`
+}
+
+type propstat struct {
+	Prop   []webdav.Property `xml:"DAV: prop>_ignored_"`
+	Status string            `xml:"DAV: status"`
+}
+
+type response struct {
+	XMLName  xml.Name   `xml:"DAV: response"`
+	Href     string     `xml:"DAV: href"`
+	Propstat []propstat `xml:"DAV: propstat,omitempty"`
+	Status   string     `xml:"DAV: status,omitempty"`
+}
+
+type multistatus struct {
+	XMLName   xml.Name    `xml:"DAV: multistatus"`
+	Responses []*response `xml:"DAV: response"`
+}
+
+func statusLine(code int) string {
+	return fmt.Sprintf("HTTP/1.1 %d %s", code, webdav.StatusText(code))
+}
+
+func parseTimeRange(tr *timeRange) (start, end time.Time, err error) {
+	start, end = allEventsStart, allEventsEnd
+	if tr == nil {
+		return start, end, nil
+	}
+	if tr.Start != "" {
+		if start, err = time.Parse(timeRangeLayout, tr.Start); err != nil {
+			return start, end, err
+		}
+	}
+	if tr.End != "" {
+		if end, err = time.Parse(timeRangeLayout, tr.End); err != nil {
+			return start, end, err
+		}
+	}
+	return start, end, nil
+}
+
+// eventFilter returns the time range of a calendar-query filter. ok is false
+// if the filter doesn't match any event.
+func eventFilter(f *compFilter) (tr *timeRange, ok bool) {
+	if f.Name != "VCALENDAR" {
+		return nil, false
+	}
+	for i := range f.CompFilters {
+		cf := &f.CompFilters[i]
+		if cf.Name != "VEVENT" {
+			return nil, false
+		}
+		tr = cf.TimeRange
+	}
+	return tr, true
+}
+
+// etag returns the ETag of an event, computed the same way as go-webdav does.
+func etag(event *protonmail.CalendarEvent) string {
+	return fmt.Sprintf(`"%x%x"`, time.Unix(event.LastEditTime, 0).UnixNano(), 0)
+}
+
+func (h *handler) eventPropstats(event *protonmail.CalendarEvent, pnames []xml.Name) ([]propstat, error) {
+	var found, notFound []webdav.Property
+	for _, pname := range pnames {
+		prop := webdav.Property{XMLName: pname}
+		switch pname {
+		case getetagName:
+			prop.InnerXML = []byte(etag(event))
+		case getcontenttypeName:
+			prop.InnerXML = []byte(calendarMIMEType)
+		case calendarDataName:
+			b, err := h.h.eventData(event)
+			if err != nil {
+				return nil, err
+			}
+			prop.InnerXML = escapeText(string(b))
+		default:
+			notFound = append(notFound, prop)
+			continue
+		}
+		found = append(found, prop)
+	}
+
+	var pstats []propstat
+	if len(found) > 0 {
+		pstats = append(pstats, propstat{found, statusLine(http.StatusOK)})
+	}
+	if len(notFound) > 0 {
+		pstats = append(pstats, propstat{notFound, statusLine(http.StatusNotFound)})
+	}
+	return pstats, nil
+}
+
+func (h *handler) serveReport(w http.ResponseWriter, r *http.Request) {
+	calID, eventID, ok := splitPath(r.URL.Path)
+	if !ok || calID == "" || eventID != "" {
+		http.Error(w, "reports are only supported on calendars", http.StatusBadRequest)
+		return
+	}
+	cal, err := h.h.calendar(calID)
+	if err == errNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var ms *multistatus
+	var cq calendarQuery
+	var mg calendarMultiget
+	if err := xml.Unmarshal(body, &cq); err == nil {
+		ms, err = h.handleQuery(&cq, cal)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else if err := xml.Unmarshal(body, &mg); err == nil {
+		ms, err = h.handleMultiget(&mg, cal)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		http.Error(w, "unsupported report", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(webdav.StatusMulti)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(ms)
+}
+
+func reportProps(allprop *struct{}, prop webdav.PropfindProps) []xml.Name {
+	if allprop != nil {
+		return []xml.Name{getetagName, getcontenttypeName, calendarDataName}
+	}
+	return []xml.Name(prop)
+}
+
+func (h *handler) handleQuery(cq *calendarQuery, cal *protonmail.Calendar) (*multistatus, error) {
+	var ms multistatus
+	tr, ok := eventFilter(&cq.Filter)
+	if !ok {
+		return &ms, nil
+	}
+	start, end, err := parseTimeRange(tr)
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := h.h.listEvents(cal.ID, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	pnames := reportProps(cq.Allprop, cq.Prop)
+	for _, event := range events {
+		resp := &response{
+			Href: (&url.URL{Path: path.Join(calendarsPath, cal.ID, event.ID+eventExt)}).EscapedPath(),
+		}
+		if resp.Propstat, err = h.eventPropstats(event, pnames); err != nil {
+			return nil, err
+		}
+		if len(resp.Propstat) == 0 {
+			resp.Status = statusLine(http.StatusOK)
+		}
+		ms.Responses = append(ms.Responses, resp)
+	}
+	return &ms, nil
+}
+
+func (h *handler) handleMultiget(mg *calendarMultiget, cal *protonmail.Calendar) (*multistatus, error) {
+	var ms multistatus
+	pnames := reportProps(mg.Allprop, mg.Prop)
+	for _, href := range mg.Href {
+		resp := &response{Href: href}
+
+		var event *protonmail.CalendarEvent
+		err := errNotFound
+		if u, perr := url.Parse(href); perr == nil {
+			if calID, eventID, ok := splitPath(u.Path); ok && calID == cal.ID && eventID != "" {
+				event, err = h.h.getEvent(cal.ID, eventID)
+			}
+		}
+
+		if err == errNotFound {
+			resp.Status = statusLine(http.StatusNotFound)
+		} else if err != nil {
+			return nil, err
+		} else {
+			if resp.Propstat, err = h.eventPropstats(event, pnames); err != nil {
+				return nil, err
+			}
+			if len(resp.Propstat) == 0 {
+				resp.Status = statusLine(http.StatusOK)
+			}
+		}
+
+		ms.Responses = append(ms.Responses, resp)
+	}
+	return &ms, nil
+}
@@ -0,0 +1,305 @@
+package caldav
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestParseTimeRange(t *testing.T) {
+	date := func(day int) time.Time {
+		return time.Date(2024, time.January, day, 0, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		tr         *timeRange
+		start, end time.Time
+		wantErr    bool
+	}{
+		{tr: nil, start: allEventsStart, end: allEventsEnd},
+		{tr: &timeRange{Start: "20240101T000000Z", End: "20240102T000000Z"}, start: date(1), end: date(2)},
+		{tr: &timeRange{Start: "20240101T000000Z"}, start: date(1), end: allEventsEnd},
+		{tr: &timeRange{End: "20240102T000000Z"}, start: allEventsStart, end: date(2)},
+		{tr: &timeRange{Start: "2024-01-01T00:00:00Z"}, wantErr: true},
+		{tr: &timeRange{End: "20240102"}, wantErr: true},
+		// Only UTC date-times are allowed
+		{tr: &timeRange{Start: "20240101T000000"}, wantErr: true},
+	}
+	for _, tc := range tests {
+		start, end, err := parseTimeRange(tc.tr)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseTimeRange(%+v) = nil, want an error", tc.tr)
+			}
+		} else if err != nil {
+			t.Errorf("parseTimeRange(%+v) = %v", tc.tr, err)
+		} else if !start.Equal(tc.start) || !end.Equal(tc.end) {
+			t.Errorf("parseTimeRange(%+v) = %v, %v, want %v, %v", tc.tr, start, end, tc.start, tc.end)
+		}
+	}
+}
+
+func TestEventFilter(t *testing.T) {
+	tr := &timeRange{Start: "20240101T000000Z"}
+
+	tests := []struct {
+		name   string
+		filter compFilter
+		want   *timeRange
+		wantOK bool
+	}{
+		{
+			name:   "all components",
+			filter: compFilter{Name: "VCALENDAR"},
+			wantOK: true,
+		},
+		{
+			name:   "all events",
+			filter: compFilter{Name: "VCALENDAR", CompFilters: []compFilter{{Name: "VEVENT"}}},
+			wantOK: true,
+		},
+		{
+			name:   "nested VEVENT",
+			filter: compFilter{Name: "VCALENDAR", CompFilters: []compFilter{{Name: "VEVENT", TimeRange: tr}}},
+			want:   tr,
+			wantOK: true,
+		},
+		{
+			name:   "VTODO",
+			filter: compFilter{Name: "VCALENDAR", CompFilters: []compFilter{{Name: "VTODO"}}},
+		},
+		{
+			name:   "VEVENT and VTODO",
+			filter: compFilter{Name: "VCALENDAR", CompFilters: []compFilter{{Name: "VEVENT", TimeRange: tr}, {Name: "VTODO"}}},
+		},
+		{
+			name:   "top-level VEVENT",
+			filter: compFilter{Name: "VEVENT", TimeRange: tr},
+		},
+	}
+	for _, tc := range tests {
+		got, ok := eventFilter(&tc.filter)
+		if ok != tc.wantOK || (ok && got != tc.want) {
+			t.Errorf("%v: eventFilter() = %+v, %v, want %+v, %v", tc.name, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
+
+func testEventCard(uid, summary string) *protonmail.CalendarEventCard {
+	return &protonmail.CalendarEventCard{
+		Type: protonmail.CalendarEventCardCleartext,
+		Data: "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:" + uid + "\r\nSUMMARY:" + summary + "\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n",
+	}
+}
+
+// testCalendarAPI serves the calendar "cal", containing events.
+type testCalendarAPI struct {
+	events []*protonmail.CalendarEvent
+}
+
+func (api *testCalendarAPI) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (api *testCalendarAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/calendar/v1":
+		api.writeJSON(w, http.StatusOK, map[string]interface{}{"Code": 1000, "Calendars": []*protonmail.Calendar{{ID: "cal"}}})
+	case r.URL.Path == "/calendar/v1/cal/events":
+		q := r.URL.Query()
+		start, _ := strconv.ParseInt(q.Get("Start"), 10, 64)
+		end, _ := strconv.ParseInt(q.Get("End"), 10, 64)
+		var events []*protonmail.CalendarEvent
+		for _, event := range api.events {
+			var match bool
+			switch q.Get("Type") {
+			case strconv.Itoa(int(protonmail.CalendarEventPartDayInsideWindow)):
+				match = event.StartTime >= start && event.StartTime < end
+			case strconv.Itoa(int(protonmail.CalendarEventPartDayBeforeWindow)):
+				match = event.StartTime < start && event.EndTime > start
+			}
+			if match {
+				events = append(events, event)
+			}
+		}
+		api.writeJSON(w, http.StatusOK, map[string]interface{}{"Code": 1000, "Events": events})
+	case strings.HasPrefix(r.URL.Path, "/calendar/v1/cal/events/"):
+		id := strings.TrimPrefix(r.URL.Path, "/calendar/v1/cal/events/")
+		for _, event := range api.events {
+			if event.ID == id {
+				api.writeJSON(w, http.StatusOK, map[string]interface{}{"Code": 1000, "Event": event})
+				return
+			}
+		}
+		api.writeJSON(w, http.StatusNotFound, map[string]interface{}{"Code": 2501, "Error": "Event does not exist"})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestHandler(t *testing.T, api http.Handler) *handler {
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+	c := &protonmail.Client{RootURL: srv.URL, HTTPClient: srv.Client(), MaxRetries: -1}
+
+	h := NewHandler(c, openpgp.EntityList{&openpgp.Entity{}}).(*handler)
+	// Events are in cleartext, no calendar key is needed
+	h.h.keyRings["cal"] = openpgp.EntityList{}
+	return h
+}
+
+type testMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Status   string `xml:"DAV: status"`
+		Propstat []struct {
+			Prop struct {
+				Getetag      string    `xml:"DAV: getetag"`
+				CalendarData string    `xml:"urn:ietf:params:xml:ns:caldav calendar-data"`
+				Displayname  *struct{} `xml:"DAV: displayname"`
+			} `xml:"DAV: prop"`
+			Status string `xml:"DAV: status"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+func report(t *testing.T, h http.Handler, path, body string) (int, *testMultistatus) {
+	req := httptest.NewRequest("REPORT", path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMultiStatus {
+		return rec.Code, nil
+	}
+	var ms testMultistatus
+	if err := xml.Unmarshal(rec.Body.Bytes(), &ms); err != nil {
+		t.Fatalf("invalid multistatus: %v", err)
+	}
+	return rec.Code, &ms
+}
+
+func TestCalendarQuery(t *testing.T) {
+	at := func(day, hour int) int64 {
+		return time.Date(2024, time.January, day, hour, 0, 0, 0, time.UTC).Unix()
+	}
+	api := &testCalendarAPI{events: []*protonmail.CalendarEvent{
+		{ID: "before", StartTime: at(1, 10), EndTime: at(1, 11), LastEditTime: 1, CalendarEvents: []*protonmail.CalendarEventCard{testEventCard("before", "Before")}},
+		{ID: "overlapping", StartTime: at(1, 23), EndTime: at(2, 1), LastEditTime: 2, CalendarEvents: []*protonmail.CalendarEventCard{testEventCard("overlapping", "Overlapping")}},
+		{ID: "inside", StartTime: at(2, 10), EndTime: at(2, 11), LastEditTime: 3, CalendarEvents: []*protonmail.CalendarEventCard{testEventCard("inside", "Inside")}},
+		{ID: "after", StartTime: at(3, 10), EndTime: at(3, 11), LastEditTime: 4, CalendarEvents: []*protonmail.CalendarEventCard{testEventCard("after", "After")}},
+	}}
+	h := newTestHandler(t, api)
+
+	query := func(filter string) string {
+		return `<C:calendar-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">` +
+			`<D:prop><D:getetag/><C:calendar-data/><D:displayname/></D:prop>` +
+			`<C:filter>` + filter + `</C:filter></C:calendar-query>`
+	}
+
+	tests := []struct {
+		name   string
+		filter string
+		want   []string
+	}{
+		{
+			name:   "time range",
+			filter: `<C:comp-filter name="VCALENDAR"><C:comp-filter name="VEVENT"><C:time-range start="20240102T000000Z" end="20240103T000000Z"/></C:comp-filter></C:comp-filter>`,
+			want:   []string{"inside", "overlapping"},
+		},
+		{
+			name:   "open end",
+			filter: `<C:comp-filter name="VCALENDAR"><C:comp-filter name="VEVENT"><C:time-range start="20240102T120000Z"/></C:comp-filter></C:comp-filter>`,
+			want:   []string{"after"},
+		},
+		{
+			name:   "VTODO",
+			filter: `<C:comp-filter name="VCALENDAR"><C:comp-filter name="VTODO"/></C:comp-filter>`,
+		},
+	}
+	for _, tc := range tests {
+		code, ms := report(t, h, "/calendars/cal/", query(tc.filter))
+		if ms == nil {
+			t.Errorf("%v: REPORT status = %v, want %v", tc.name, code, http.StatusMultiStatus)
+			continue
+		}
+
+		var got []string
+		for _, resp := range ms.Responses {
+			id := strings.TrimSuffix(strings.TrimPrefix(resp.Href, "/calendars/cal/"), eventExt)
+			got = append(got, id)
+
+			var event *protonmail.CalendarEvent
+			for _, e := range api.events {
+				if e.ID == id {
+					event = e
+				}
+			}
+			if event == nil || len(resp.Propstat) != 2 {
+				t.Errorf("%v: unexpected response %+v", tc.name, resp)
+				continue
+			}
+			ok, notFound := resp.Propstat[0], resp.Propstat[1]
+			if ok.Status != "HTTP/1.1 200 OK" || notFound.Status != "HTTP/1.1 404 Not Found" {
+				t.Errorf("%v: %v: propstat statuses = %q, %q", tc.name, id, ok.Status, notFound.Status)
+			}
+			if ok.Prop.Getetag != etag(event) {
+				t.Errorf("%v: %v: getetag = %q, want %q", tc.name, id, ok.Prop.Getetag, etag(event))
+			}
+			if !strings.Contains(ok.Prop.CalendarData, "\r\nUID:"+id+"\r\n") {
+				t.Errorf("%v: %v: calendar-data = %q, want the event", tc.name, id, ok.Prop.CalendarData)
+			}
+			if notFound.Prop.Displayname == nil {
+				t.Errorf("%v: %v: displayname isn't reported as not found", tc.name, id)
+			}
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: REPORT returned events %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	bad := query(`<C:comp-filter name="VCALENDAR"><C:comp-filter name="VEVENT"><C:time-range start="2024-01-02"/></C:comp-filter></C:comp-filter>`)
+	if code, _ := report(t, h, "/calendars/cal/", bad); code != http.StatusInternalServerError {
+		t.Errorf("REPORT with an invalid time range: status = %v, want %v", code, http.StatusInternalServerError)
+	}
+	if code, _ := report(t, h, "/calendars/unknown/", query("")); code != http.StatusNotFound {
+		t.Errorf("REPORT on an unknown calendar: status = %v, want %v", code, http.StatusNotFound)
+	}
+}
+
+func TestCalendarMultiget(t *testing.T) {
+	api := &testCalendarAPI{events: []*protonmail.CalendarEvent{
+		{ID: "event", LastEditTime: 1, CalendarEvents: []*protonmail.CalendarEventCard{testEventCard("event", "Event")}},
+	}}
+	h := newTestHandler(t, api)
+
+	body := `<C:calendar-multiget xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">` +
+		`<D:prop><D:getetag/></D:prop>` +
+		`<D:href>/calendars/cal/event.ics</D:href><D:href>/calendars/cal/missing.ics</D:href><D:href>/calendars/other/event.ics</D:href>` +
+		`</C:calendar-multiget>`
+	_, ms := report(t, h, "/calendars/cal/", body)
+	if ms == nil || len(ms.Responses) != 3 {
+		t.Fatalf("REPORT = %+v, want 3 responses", ms)
+	}
+
+	if resp := ms.Responses[0]; len(resp.Propstat) != 1 || resp.Propstat[0].Prop.Getetag != etag(api.events[0]) {
+		t.Errorf("response for an event = %+v, want its ETag", resp)
+	}
+	for _, resp := range ms.Responses[1:] {
+		if resp.Status != "HTTP/1.1 404 Not Found" {
+			t.Errorf("response for %v has status %q, want 404", resp.Href, resp.Status)
+		}
+	}
+}
@@ -8,11 +8,14 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/emersion/go-vcard"
+	"github.com/emersion/go-webdav"
 	"github.com/emersion/go-webdav/carddav"
+	"github.com/emersion/hydroxide/events"
 	"github.com/emersion/hydroxide/protonmail"
 	"golang.org/x/crypto/openpgp"
 )
@@ -21,12 +24,54 @@ type contextKey string
 
 const ClientContextKey = contextKey("client")
 
+// ProtonMail splits contacts in up to three cards: a cleartext one, a signed
+// one with the properties needed to send messages, and an encrypted and signed
+// one with all other properties.
 var (
-	cleartextCardProps = []string{vcard.FieldVersion, vcard.FieldProductID, "X-PM-LABEL", "X-PM-GROUP"}
-	signedCardProps    = []string{vcard.FieldVersion, vcard.FieldProductID, vcard.FieldFormattedName, vcard.FieldUID, vcard.FieldEmail}
+	cleartextCardProps = []string{vcard.FieldVersion, "X-PM-LABEL", "X-PM-GROUP"}
+	signedCardProps    = []string{
+		vcard.FieldVersion,
+		vcard.FieldProductID,
+		vcard.FieldFormattedName,
+		vcard.FieldUID,
+		vcard.FieldEmail,
+		vcard.FieldKey,
+		"X-PM-ENCRYPT",
+		"X-PM-SIGN",
+		"X-PM-SCHEME",
+		"X-PM-MIMETYPE",
+	}
 )
 
+// extractCardProps moves the properties props from card to a new card. The
+// version is kept in card.
+func extractCardProps(card vcard.Card, props []string) vcard.Card {
+	extracted := make(vcard.Card)
+	for _, k := range props {
+		if fields, ok := card[k]; ok {
+			extracted[k] = fields
+			if k != vcard.FieldVersion {
+				delete(card, k)
+			}
+		}
+	}
+	return extracted
+}
+
+// hasCardProps returns true if card has properties other than the version.
+func hasCardProps(card vcard.Card) bool {
+	for k := range card {
+		if k != vcard.FieldVersion {
+			return true
+		}
+	}
+	return false
+}
+
 func formatCard(card vcard.Card, privateKey *openpgp.Entity) (*protonmail.ContactImport, error) {
+	if err := normalizePhotos(card); err != nil {
+		return nil, err
+	}
 	vcard.ToV4(card)
 
 	// Add groups to emails
@@ -39,19 +84,23 @@ func formatCard(card vcard.Card, privateKey *openpgp.Entity) (*protonmail.Contac
 	}
 
 	toEncrypt := card
-	toSign := make(vcard.Card)
-	for _, k := range signedCardProps {
-		if fields, ok := toEncrypt[k]; ok {
-			toSign[k] = fields
-			if k != vcard.FieldVersion {
-				delete(toEncrypt, k)
-			}
-		}
-	}
+	toSign := extractCardProps(toEncrypt, signedCardProps)
+	cleartext := extractCardProps(toEncrypt, cleartextCardProps)
 
 	var contactImport protonmail.ContactImport
 	var b bytes.Buffer
 
+	if hasCardProps(cleartext) {
+		if err := vcard.NewEncoder(&b).Encode(cleartext); err != nil {
+			return nil, err
+		}
+		contactImport.Cards = append(contactImport.Cards, &protonmail.ContactCard{
+			Type: protonmail.ContactCardCleartext,
+			Data: b.String(),
+		})
+		b.Reset()
+	}
+
 	if len(toSign) > 0 {
 		if err := vcard.NewEncoder(&b).Encode(toSign); err != nil {
 			return nil, err
@@ -64,7 +113,7 @@ func formatCard(card vcard.Card, privateKey *openpgp.Entity) (*protonmail.Contac
 		b.Reset()
 	}
 
-	if len(toEncrypt) > 0 {
+	if hasCardProps(toEncrypt) {
 		if err := vcard.NewEncoder(&b).Encode(toEncrypt); err != nil {
 			return nil, err
 		}
@@ -149,10 +198,27 @@ func (ao *addressObject) Card() (vcard.Card, error) {
 		}
 	}
 
+	// Photos imported from vCard 3 may still use the binary encoding
+	for _, f := range card[vcard.FieldPhoto] {
+		normalizePhoto(f)
+	}
+
+	delete(card, vcard.FieldCategories)
+	categories, err := ao.ab.contactGroupNames(contactLabelIDs(ao.contact))
+	if err != nil {
+		return nil, err
+	}
+	if len(categories) > 0 {
+		card.SetCategories(categories)
+	}
+
 	return card, nil
 }
 
 func (ao *addressObject) SetCard(card vcard.Card) error {
+	categories := cardCategories(card)
+	delete(card, vcard.FieldCategories)
+
 	contactImport, err := formatCard(card, ao.ab.privateKeys[0])
 	if err != nil {
 		return err
@@ -164,6 +230,10 @@ func (ao *addressObject) SetCard(card vcard.Card) error {
 	}
 	contact.Cards = contactImport.Cards // Not returned by the server
 
+	if err := ao.ab.setContactGroups(contact, categories); err != nil {
+		return err
+	}
+
 	ao.contact = contact
 	return nil
 }
@@ -185,12 +255,14 @@ type addressBook struct {
 	cache       map[string]*addressObject
 	locker      sync.Mutex
 	total       int
+	groups      map[string]*protonmail.Label
 	privateKeys openpgp.EntityList
+	syncLog     []*syncLogEntry
 }
 
 func (ab *addressBook) Info() (*carddav.AddressBookInfo, error) {
 	return &carddav.AddressBookInfo{
-		Name:            "ProtonMail",
+		Name:            "All Contacts",
 		Description:     "ProtonMail contacts",
 		MaxResourceSize: 100 * 1024,
 	}, nil
@@ -218,14 +290,13 @@ func (ab *addressBook) cacheAddressObject(ao *addressObject) {
 func (ab *addressBook) ListAddressObjects() ([]carddav.AddressObject, error) {
 	if ab.cacheComplete() {
 		ab.locker.Lock()
-		defer ab.locker.Unlock()
-
 		aos := make([]carddav.AddressObject, 0, len(ab.cache))
 		for _, ao := range ab.cache {
 			aos = append(aos, ao)
 		}
+		ab.locker.Unlock()
 
-		return aos, nil
+		return ab.appendGroupObjects(aos)
 	}
 
 	// Get a list of all contacts
@@ -280,10 +351,22 @@ func (ab *addressBook) ListAddressObjects() ([]carddav.AddressObject, error) {
 		page++
 	}
 
-	return aos, nil
+	return ab.appendGroupObjects(aos)
+}
+
+func (ab *addressBook) appendGroupObjects(aos []carddav.AddressObject) ([]carddav.AddressObject, error) {
+	groups, err := ab.listGroupObjects()
+	if err != nil {
+		return nil, err
+	}
+	return append(aos, groups...), nil
 }
 
 func (ab *addressBook) GetAddressObject(id string) (carddav.AddressObject, error) {
+	if strings.HasPrefix(id, groupObjectPrefix) {
+		return ab.getGroupObject(id)
+	}
+
 	if ao, ok := ab.addressObject(id); ok {
 		return ao, nil
 	} else if ab.cacheComplete() {
@@ -305,6 +388,13 @@ func (ab *addressBook) GetAddressObject(id string) (carddav.AddressObject, error
 }
 
 func (ab *addressBook) CreateAddressObject(card vcard.Card) (carddav.AddressObject, error) {
+	if isGroupCard(card) {
+		return ab.createGroupObject(card)
+	}
+
+	categories := cardCategories(card)
+	delete(card, vcard.FieldCategories)
+
 	contactImport, err := formatCard(card, ab.privateKeys[0])
 	if err != nil {
 		return nil, err
@@ -324,6 +414,12 @@ func (ab *addressBook) CreateAddressObject(card vcard.Card) (carddav.AddressObje
 	contact := resp.Response.Contact
 	contact.Cards = contactImport.Cards // Not returned by the server
 
+	if len(categories) > 0 {
+		if err := ab.setContactGroups(contact, categories); err != nil {
+			return nil, err
+		}
+	}
+
 	ao := &addressObject{
 		ab:      ab,
 		contact: contact,
@@ -332,29 +428,52 @@ func (ab *addressBook) CreateAddressObject(card vcard.Card) (carddav.AddressObje
 	return ao, nil
 }
 
-func (ab *addressBook) receiveEvents(events <-chan *protonmail.Event) {
-	for event := range events {
-		ab.locker.Lock()
-		if event.Refresh&protonmail.EventRefreshContacts != 0 {
+func (ab *addressBook) receiveEvents(ch <-chan *protonmail.Event) {
+	// changes contains the objects changed by the current event
+	var changes map[string]bool
+	refreshed := false
+
+	var d events.Dispatcher
+	d.OnRefresh(func(refresh protonmail.EventRefresh) {
+		if refresh&protonmail.EventRefreshContacts != 0 {
 			ab.cache = make(map[string]*addressObject)
 			ab.total = -1
-		} else if len(event.Contacts) > 0 {
-			for _, eventContact := range event.Contacts {
-				switch eventContact.Action {
-				case protonmail.EventCreate:
-					ab.total++
-					fallthrough
-				case protonmail.EventUpdate:
-					ab.cache[eventContact.ID] = &addressObject{
-						ab:      ab,
-						contact: eventContact.Contact,
-					}
-				case protonmail.EventDelete:
-					delete(ab.cache, eventContact.ID)
-					ab.total--
-				}
+			ab.groups = nil
+			refreshed = true
+		}
+	})
+	d.OnContact(func(eventContact *protonmail.EventContact) {
+		switch eventContact.Action {
+		case protonmail.EventCreate:
+			ab.total++
+			fallthrough
+		case protonmail.EventUpdate:
+			ab.cache[eventContact.ID] = &addressObject{
+				ab:      ab,
+				contact: eventContact.Contact,
 			}
+		case protonmail.EventDelete:
+			delete(ab.cache, eventContact.ID)
+			ab.total--
 		}
+		changes[eventContact.ID] = eventContact.Action == protonmail.EventDelete
+	})
+	d.OnLabel(func(eventLabel *protonmail.EventLabel) {
+		// Contact groups are labels
+		if eventLabel.Label != nil && eventLabel.Label.Type != protonmail.LabelContact {
+			return
+		}
+		ab.groups = nil
+		changes[groupObjectPrefix+eventLabel.ID] = eventLabel.Action == protonmail.EventDelete
+	})
+
+	for event := range ch {
+		changes = make(map[string]bool)
+		refreshed = false
+
+		ab.locker.Lock()
+		d.Dispatch(event)
+		ab.logSyncChanges(event.ID, changes, refreshed)
 		ab.locker.Unlock()
 	}
 }
@@ -375,5 +494,9 @@ func NewHandler(c *protonmail.Client, privateKeys openpgp.EntityList, events <-c
 		go ab.receiveEvents(events)
 	}
 
-	return carddav.NewHandler(ab)
+	return &handler{
+		ab:          ab,
+		carddav:     carddav.NewHandler(ab),
+		collections: &webdav.Handler{FileSystem: &collectionsFileSystem{ab}},
+	}
 }
@@ -0,0 +1,117 @@
+package carddav
+
+import (
+	_ "crypto/sha256"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-vcard"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+	_ "golang.org/x/crypto/ripemd160"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func newTestEntity(t *testing.T) *openpgp.Entity {
+	e, err := openpgp.NewEntity("Test", "", "test@example.org", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatalf("openpgp.NewEntity() = %v", err)
+	}
+	return e
+}
+
+// cardProps returns the sorted property names of a contact card, without the
+// version.
+func cardProps(t *testing.T, card *protonmail.ContactCard, keyRing openpgp.KeyRing) []string {
+	md, err := card.Read(keyRing)
+	if err != nil {
+		t.Fatalf("ContactCard.Read() = %v", err)
+	}
+	b, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.IsSigned && (md.SignatureError != nil || md.SignedBy == nil) {
+		t.Errorf("invalid card signature: %v", md.SignatureError)
+	}
+
+	decoded, err := vcard.NewDecoder(strings.NewReader(string(b))).Decode()
+	if err != nil {
+		t.Fatalf("vcard.Decoder.Decode() = %v", err)
+	}
+	var props []string
+	for k := range decoded {
+		if k != vcard.FieldVersion {
+			props = append(props, k)
+		}
+	}
+	sort.Strings(props)
+	return props
+}
+
+func TestFormatCard(t *testing.T) {
+	e := newTestEntity(t)
+
+	field := func(v string) []*vcard.Field {
+		return []*vcard.Field{{Value: v}}
+	}
+	tests := []struct {
+		name string
+		card vcard.Card
+		want map[protonmail.ContactCardType][]string
+	}{
+		{
+			name: "all cards",
+			card: vcard.Card{
+				vcard.FieldFormattedName: field("Alice"),
+				vcard.FieldEmail:         field("alice@example.org"),
+				vcard.FieldKey:           field("data:application/pgp-keys;base64,AAAA"),
+				"X-PM-ENCRYPT":           field("true"),
+				"X-PM-LABEL":             field("label"),
+				vcard.FieldTelephone:     field("+1234"),
+				vcard.FieldNote:          field("Hello"),
+			},
+			want: map[protonmail.ContactCardType][]string{
+				protonmail.ContactCardCleartext:          {"X-PM-LABEL"},
+				protonmail.ContactCardSigned:             {vcard.FieldEmail, vcard.FieldFormattedName, vcard.FieldKey, "X-PM-ENCRYPT"},
+				protonmail.ContactCardEncryptedAndSigned: {vcard.FieldNote, vcard.FieldTelephone},
+			},
+		},
+		{
+			name: "signed only",
+			card: vcard.Card{
+				vcard.FieldFormattedName: field("Bob"),
+				vcard.FieldEmail:         field("bob@example.org"),
+			},
+			want: map[protonmail.ContactCardType][]string{
+				protonmail.ContactCardSigned: {vcard.FieldEmail, vcard.FieldFormattedName},
+			},
+		},
+	}
+	for _, tc := range tests {
+		contactImport, err := formatCard(tc.card, e)
+		if err != nil {
+			t.Errorf("%v: formatCard() = %v", tc.name, err)
+			continue
+		}
+
+		got := make(map[protonmail.ContactCardType][]string)
+		for _, card := range contactImport.Cards {
+			if _, ok := got[card.Type]; ok {
+				t.Errorf("%v: formatCard() returned two cards of type %v", tc.name, card.Type)
+			}
+			got[card.Type] = cardProps(t, card, openpgp.EntityList{e})
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%v: formatCard() returned %v cards, want %v", tc.name, len(got), len(tc.want))
+		}
+		for typ, want := range tc.want {
+			if strings.Join(got[typ], ",") != strings.Join(want, ",") {
+				t.Errorf("%v: card of type %v has properties %v, want %v", tc.name, typ, got[typ], want)
+			}
+		}
+	}
+}
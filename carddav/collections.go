@@ -0,0 +1,554 @@
+package carddav
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-vcard"
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/carddav"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// Address books are exposed as collections under addressBooksPath, which is
+// the address book home set: one with all contacts, and one per contact
+// group. A contact appears in the collections of all its groups, with the
+// same ID and ETag. The root collection still contains all contacts.
+//
+// go-webdav only supports a single address book at the root, so these
+// collections are served with a file system of our own.
+
+const addressBooksPath = "/addressbooks"
+
+const allContactsCollection = "all"
+
+// splitCollectionPath splits a path under addressBooksPath into a collection
+// name and an address object ID. Both are empty for the home set. ok is false
+// if p isn't under addressBooksPath.
+func splitCollectionPath(p string) (coll, id string, ok bool) {
+	if p != addressBooksPath && !strings.HasPrefix(p, addressBooksPath+"/") {
+		return "", "", false
+	}
+	p = strings.Trim(strings.TrimPrefix(p, addressBooksPath), "/")
+	parts := strings.SplitN(p, "/", 2)
+	coll = parts[0]
+	if len(parts) == 2 {
+		id = parts[1]
+	}
+	return coll, id, true
+}
+
+func addCategory(card vcard.Card, name string) {
+	categories := cardCategories(card)
+	for _, c := range categories {
+		if c == name {
+			return
+		}
+	}
+	card.SetCategories(append(categories, name))
+}
+
+// collection is an address book containing either all contacts, or only the
+// members of a contact group.
+type collection struct {
+	ab    *addressBook
+	label *protonmail.Label // nil for all contacts
+}
+
+func (c *collection) name() string {
+	if c.label == nil {
+		return allContactsCollection
+	}
+	return c.label.ID
+}
+
+func (c *collection) Info() (*carddav.AddressBookInfo, error) {
+	info, err := c.ab.Info()
+	if err != nil || c.label == nil {
+		return info, err
+	}
+	return &carddav.AddressBookInfo{
+		Name:            c.label.Name,
+		Description:     "ProtonMail contact group",
+		MaxResourceSize: info.MaxResourceSize,
+	}, nil
+}
+
+// hasMember returns true if the contact belongs to the collection. Group
+// membership is the same as the one exposed as vCard CATEGORIES.
+func (c *collection) hasMember(ao *addressObject) bool {
+	return hasLabel(contactLabelIDs(ao.contact), c.label.ID)
+}
+
+func (c *collection) ListAddressObjects() ([]carddav.AddressObject, error) {
+	aos, err := c.ab.ListAddressObjects()
+	if err != nil || c.label == nil {
+		return aos, err
+	}
+
+	var members []carddav.AddressObject
+	for _, ao := range aos {
+		if ao, ok := ao.(*addressObject); ok && c.hasMember(ao) {
+			members = append(members, &memberObject{ao, c.label})
+		}
+	}
+	return members, nil
+}
+
+func (c *collection) GetAddressObject(id string) (carddav.AddressObject, error) {
+	ao, err := c.ab.GetAddressObject(id)
+	if err != nil || c.label == nil {
+		return ao, err
+	}
+
+	if ao, ok := ao.(*addressObject); ok && c.hasMember(ao) {
+		return &memberObject{ao, c.label}, nil
+	}
+	return nil, carddav.ErrNotFound
+}
+
+// CreateAddressObject creates a contact. Contacts created in a group
+// collection are added to the group.
+func (c *collection) CreateAddressObject(card vcard.Card) (carddav.AddressObject, error) {
+	if c.label == nil {
+		return c.ab.CreateAddressObject(card)
+	}
+
+	if isGroupCard(card) {
+		return nil, errors.New("hydroxide/carddav: contact groups can only be created in the address book with all contacts")
+	}
+	addCategory(card, c.label.Name)
+
+	ao, err := c.ab.CreateAddressObject(card)
+	if err != nil {
+		return nil, err
+	}
+	return &memberObject{ao.(*addressObject), c.label}, nil
+}
+
+// memberObject is a contact in a group collection.
+type memberObject struct {
+	*addressObject
+	label *protonmail.Label
+}
+
+func (mo *memberObject) SetCard(card vcard.Card) error {
+	addCategory(card, mo.label.Name)
+	return mo.addressObject.SetCard(card)
+}
+
+// Remove removes the contact from the group. It's left in the other
+// collections.
+func (mo *memberObject) Remove() error {
+	contact := mo.contact
+	if err := mo.ab.fetchContactEmails(contact); err != nil {
+		return err
+	}
+	if err := mo.ab.setEmailGroup(mo.label.ID, contact.ContactEmails, false); err != nil {
+		return err
+	}
+
+	labelIDs := contact.LabelIDs[:0]
+	for _, id := range contact.LabelIDs {
+		if id != mo.label.ID {
+			labelIDs = append(labelIDs, id)
+		}
+	}
+	contact.LabelIDs = labelIDs
+	return nil
+}
+
+func (ab *addressBook) collection(name string) (*collection, error) {
+	if name == allContactsCollection {
+		return &collection{ab: ab}, nil
+	}
+
+	groups, err := ab.contactGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	ab.locker.Lock()
+	defer ab.locker.Unlock()
+	label, ok := groups[name]
+	if !ok {
+		return nil, carddav.ErrNotFound
+	}
+	return &collection{ab: ab, label: label}, nil
+}
+
+// collections returns the collection with all contacts followed by the group
+// collections, sorted by name.
+func (ab *addressBook) collections() ([]*collection, error) {
+	groups, err := ab.contactGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	ab.locker.Lock()
+	l := make([]*collection, 0, len(groups)+1)
+	for _, label := range groups {
+		l = append(l, &collection{ab: ab, label: label})
+	}
+	ab.locker.Unlock()
+
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].label.Name < l[j].label.Name
+	})
+	return append([]*collection{{ab: ab}}, l...), nil
+}
+
+func fsError(err error) error {
+	if err == carddav.ErrNotFound {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+// collectionsFileSystem contains the address book home set, the collections
+// and their address objects.
+type collectionsFileSystem struct {
+	ab *addressBook
+}
+
+// lookup returns the collection and the address object designated by name.
+// Both are nil for the home set.
+func (fs *collectionsFileSystem) lookup(name string) (*collection, carddav.AddressObject, error) {
+	coll, id, ok := splitCollectionPath(name)
+	if !ok {
+		return nil, nil, carddav.ErrNotFound
+	} else if coll == "" {
+		return nil, nil, nil
+	}
+
+	c, err := fs.ab.collection(coll)
+	if err != nil || id == "" {
+		return c, nil, err
+	}
+
+	ao, err := c.GetAddressObject(id)
+	return c, ao, err
+}
+
+func (fs *collectionsFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (fs *collectionsFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&os.O_CREATE != 0 {
+		// Objects are only reported as missing once all contacts are cached
+		if _, err := fs.ab.ListAddressObjects(); err != nil {
+			return nil, err
+		}
+	}
+
+	c, ao, err := fs.lookup(name)
+	if err == carddav.ErrNotFound && c != nil && flag&os.O_CREATE != 0 {
+		return &objectFile{c: c}, nil
+	} else if err != nil {
+		return nil, fsError(err)
+	}
+
+	if c == nil {
+		return &homeFile{fs.ab}, nil
+	} else if ao == nil {
+		return &collectionFile{c}, nil
+	}
+	return &objectFile{c: c, ao: ao}, nil
+}
+
+func (fs *collectionsFileSystem) RemoveAll(ctx context.Context, name string) error {
+	_, ao, err := fs.lookup(name)
+	if err != nil {
+		return fsError(err)
+	} else if ao == nil {
+		return os.ErrPermission
+	}
+	return ao.Remove()
+}
+
+func (fs *collectionsFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+func (fs *collectionsFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	c, ao, err := fs.lookup(name)
+	if err != nil {
+		return nil, fsError(err)
+	}
+
+	if c == nil {
+		return collectionFileInfo{strings.TrimPrefix(addressBooksPath, "/")}, nil
+	} else if ao == nil {
+		return collectionFileInfo{c.name()}, nil
+	}
+	return addressObjectFileInfo(ao)
+}
+
+// objectFileInfo is used for address objects which don't provide their own
+// file information.
+type objectFileInfo struct {
+	id string
+}
+
+func (fi objectFileInfo) Name() string       { return fi.id }
+func (fi objectFileInfo) Size() int64        { return 0 }
+func (fi objectFileInfo) Mode() os.FileMode  { return os.ModePerm }
+func (fi objectFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi objectFileInfo) IsDir() bool        { return false }
+func (fi objectFileInfo) Sys() interface{}   { return nil }
+
+func addressObjectFileInfo(ao carddav.AddressObject) (os.FileInfo, error) {
+	fi, err := ao.Stat()
+	if fi != nil || err != nil {
+		return fi, err
+	}
+	return objectFileInfo{ao.ID()}, nil
+}
+
+type homeFile struct {
+	ab *addressBook
+}
+
+func (f *homeFile) Close() error {
+	return nil
+}
+
+func (f *homeFile) Read(b []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *homeFile) Write(b []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *homeFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *homeFile) Readdir(count int) ([]os.FileInfo, error) {
+	l, err := f.ab.collections()
+	if err != nil {
+		return nil, err
+	}
+
+	fis := make([]os.FileInfo, len(l))
+	for i, c := range l {
+		fis[i] = collectionFileInfo{c.name()}
+	}
+	return fis, nil
+}
+
+func (f *homeFile) Stat() (os.FileInfo, error) {
+	return collectionFileInfo{strings.TrimPrefix(addressBooksPath, "/")}, nil
+}
+
+func (f *homeFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	prop := webdav.Property{
+		XMLName:  xml.Name{Space: nsDAV, Local: "displayname"},
+		InnerXML: []byte("Address books"),
+	}
+	return map[xml.Name]webdav.Property{prop.XMLName: prop}, nil
+}
+
+func (f *homeFile) Patch([]webdav.Proppatch) ([]webdav.Propstat, error) {
+	return nil, os.ErrPermission
+}
+
+// objectFile is an address object. A card written to the file is saved when
+// it's closed, creating the object if it doesn't exist yet.
+type objectFile struct {
+	c  *collection
+	ao carddav.AddressObject
+	r  *bytes.Reader
+	w  *bytes.Buffer
+}
+
+func (f *objectFile) Close() error {
+	f.r = nil
+	if f.w == nil {
+		return nil
+	}
+	defer func() {
+		f.w = nil
+	}()
+
+	card, err := vcard.NewDecoder(f.w).Decode()
+	if err != nil {
+		return err
+	}
+
+	if f.ao != nil {
+		return f.ao.SetCard(card)
+	}
+	ao, err := f.c.CreateAddressObject(card)
+	if err != nil {
+		return err
+	}
+	f.ao = ao
+	return nil
+}
+
+func (f *objectFile) reader() (*bytes.Reader, error) {
+	if f.r != nil {
+		return f.r, nil
+	} else if f.ao == nil {
+		return nil, os.ErrInvalid
+	}
+
+	card, err := f.ao.Card()
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	if err := vcard.NewEncoder(&b).Encode(card); err != nil {
+		return nil, err
+	}
+	f.r = bytes.NewReader(b.Bytes())
+	return f.r, nil
+}
+
+func (f *objectFile) Read(b []byte) (int, error) {
+	r, err := f.reader()
+	if err != nil {
+		return 0, err
+	}
+	return r.Read(b)
+}
+
+func (f *objectFile) Write(b []byte) (int, error) {
+	if f.w == nil {
+		f.w = new(bytes.Buffer)
+	}
+	return f.w.Write(b)
+}
+
+func (f *objectFile) Seek(offset int64, whence int) (int64, error) {
+	r, err := f.reader()
+	if err != nil {
+		return 0, err
+	}
+	return r.Seek(offset, whence)
+}
+
+func (f *objectFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+// Stat is only available for new objects once the file has been closed.
+func (f *objectFile) Stat() (os.FileInfo, error) {
+	if f.ao == nil {
+		return nil, os.ErrNotExist
+	}
+	return addressObjectFileInfo(f.ao)
+}
+
+func (f *objectFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	prop := webdav.Property{XMLName: getcontenttypeName, InnerXML: []byte(vcard.MIMEType)}
+	return map[xml.Name]webdav.Property{prop.XMLName: prop}, nil
+}
+
+func (f *objectFile) Patch([]webdav.Proppatch) ([]webdav.Propstat, error) {
+	return nil, os.ErrPermission
+}
+
+// https://tools.ietf.org/html/rfc6352#section-8.7
+type addressbookMultiget struct {
+	XMLName xml.Name             `xml:"urn:ietf:params:xml:ns:carddav addressbook-multiget"`
+	Allprop *struct{}            `xml:"DAV: allprop"`
+	Prop    webdav.PropfindProps `xml:"DAV: prop"`
+	Href    []string             `xml:"DAV: href"`
+}
+
+func (h *handler) serveCollections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "REPORT" {
+		h.collections.ServeHTTP(w, r)
+		return
+	}
+
+	coll, _, _ := splitCollectionPath(r.URL.Path)
+	c, err := h.ab.collection(coll)
+	if err == carddav.ErrNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var sc syncCollection
+	var mg addressbookMultiget
+	if err := xml.Unmarshal(body, &sc); err == nil {
+		h.handleSyncCollection(w, r, &sc, c)
+	} else if err := xml.Unmarshal(body, &mg); err == nil {
+		h.handleMultiget(w, r, &mg, c)
+	} else {
+		http.Error(w, "unsupported report", http.StatusBadRequest)
+	}
+}
+
+// hrefObject returns the address object of c designated by href.
+func hrefObject(c *collection, href string) (carddav.AddressObject, error) {
+	u, err := url.Parse(href)
+	if err != nil {
+		return nil, carddav.ErrNotFound
+	}
+	coll, id, ok := splitCollectionPath(u.Path)
+	if !ok || coll != c.name() || id == "" {
+		return nil, carddav.ErrNotFound
+	}
+	return c.GetAddressObject(id)
+}
+
+func (h *handler) handleMultiget(w http.ResponseWriter, r *http.Request, mg *addressbookMultiget, c *collection) {
+	pnames := []xml.Name(mg.Prop)
+	if mg.Allprop != nil {
+		pnames = []xml.Name{getetagName, getcontenttypeName, addressDataName}
+	}
+
+	var ms syncMultistatus
+	for _, href := range mg.Href {
+		resp := &syncResponse{Href: href}
+
+		ao, err := hrefObject(c, href)
+		if err == carddav.ErrNotFound {
+			resp.Status = statusLine(http.StatusNotFound)
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else {
+			resp.Propstat, err = addressObjectPropstats(ao, pnames)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if len(resp.Propstat) == 0 {
+				resp.Status = statusLine(http.StatusOK)
+			}
+		}
+
+		ms.Responses = append(ms.Responses, resp)
+	}
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(webdav.StatusMulti)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(&ms)
+}
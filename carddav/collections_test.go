@@ -0,0 +1,206 @@
+package carddav
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-vcard"
+	"github.com/emersion/go-webdav/carddav"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// testGroupsAPI serves contact groups, and records the contact email label
+// requests it receives.
+type testGroupsAPI struct {
+	labels []*protonmail.Label
+
+	locker   sync.Mutex
+	requests []string
+}
+
+func (api *testGroupsAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/labels":
+		json.NewEncoder(w).Encode(map[string]interface{}{"Code": 1000, "Labels": api.labels})
+	case "/contacts/emails/label", "/contacts/emails/unlabel":
+		var body struct {
+			LabelID         string
+			ContactEmailIDs []string
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		api.locker.Lock()
+		for _, id := range body.ContactEmailIDs {
+			api.requests = append(api.requests, r.URL.Path+" "+body.LabelID+" "+id)
+		}
+		api.locker.Unlock()
+		w.Write([]byte(`{"Code":1000}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestAddressBook(t *testing.T, api http.Handler) *addressBook {
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+	return &addressBook{
+		c:     &protonmail.Client{RootURL: srv.URL, HTTPClient: srv.Client(), MaxRetries: -1},
+		cache: make(map[string]*addressObject),
+		total: -1,
+	}
+}
+
+func TestSplitCollectionPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		coll, id string
+		ok       bool
+	}{
+		{"/addressbooks", "", "", true},
+		{"/addressbooks/", "", "", true},
+		{"/addressbooks/all", "all", "", true},
+		{"/addressbooks/all/", "all", "", true},
+		{"/addressbooks/group/contact", "group", "contact", true},
+		{"/addressbooksx", "", "", false},
+		{"/", "", "", false},
+		{"/contact", "", "", false},
+	}
+	for _, tc := range tests {
+		coll, id, ok := splitCollectionPath(tc.path)
+		if coll != tc.coll || id != tc.id || ok != tc.ok {
+			t.Errorf("splitCollectionPath(%q) = %q, %q, %v, want %q, %q, %v", tc.path, coll, id, ok, tc.coll, tc.id, tc.ok)
+		}
+	}
+}
+
+func TestAddCategory(t *testing.T) {
+	tests := []struct {
+		categories []string
+		name       string
+		want       []string
+	}{
+		{nil, "Friends", []string{"Friends"}},
+		{[]string{"Work"}, "Friends", []string{"Work", "Friends"}},
+		{[]string{"Friends", "Work"}, "Friends", []string{"Friends", "Work"}},
+	}
+	for _, tc := range tests {
+		card := make(vcard.Card)
+		if tc.categories != nil {
+			card.SetCategories(tc.categories)
+		}
+		addCategory(card, tc.name)
+		if got := cardCategories(card); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("addCategory(%v, %q) = %v, want %v", tc.categories, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCollections(t *testing.T) {
+	ab := newTestAddressBook(t, &testGroupsAPI{labels: []*protonmail.Label{
+		{ID: "work", Name: "Work"},
+		{ID: "family", Name: "Family"},
+	}})
+
+	colls, err := ab.collections()
+	if err != nil {
+		t.Fatalf("collections() = %v", err)
+	}
+	var names []string
+	for _, c := range colls {
+		names = append(names, c.name())
+	}
+	if want := []string{allContactsCollection, "family", "work"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("collections() = %v, want %v", names, want)
+	}
+
+	tests := []struct {
+		name     string
+		wantName string
+		wantErr  error
+	}{
+		{allContactsCollection, "All Contacts", nil},
+		{"work", "Work", nil},
+		{"unknown", "", carddav.ErrNotFound},
+	}
+	for _, tc := range tests {
+		c, err := ab.collection(tc.name)
+		if err != tc.wantErr {
+			t.Errorf("collection(%q) = %v, want %v", tc.name, err, tc.wantErr)
+			continue
+		} else if err != nil {
+			continue
+		}
+		info, err := c.Info()
+		if err != nil {
+			t.Errorf("collection(%q).Info() = %v", tc.name, err)
+		} else if info.Name != tc.wantName {
+			t.Errorf("collection(%q).Info() returned name %q, want %q", tc.name, info.Name, tc.wantName)
+		}
+	}
+}
+
+func TestCollectionMembers(t *testing.T) {
+	ab := newTestAddressBook(t, &testGroupsAPI{labels: []*protonmail.Label{{ID: "work", Name: "Work"}}})
+	contacts := []*protonmail.Contact{
+		{ID: "contact", LabelIDs: []string{"work"}},
+		{ID: "email", ContactEmails: []*protonmail.ContactEmail{{ID: "email1", LabelIDs: []string{"work"}}}},
+		{ID: "other"},
+	}
+	for _, contact := range contacts {
+		ab.cacheAddressObject(&addressObject{ab: ab, contact: contact})
+	}
+	ab.total = len(contacts)
+
+	c, err := ab.collection("work")
+	if err != nil {
+		t.Fatalf("collection() = %v", err)
+	}
+	tests := []struct {
+		id      string
+		wantErr error
+	}{
+		{"contact", nil},
+		{"email", nil},
+		{"other", carddav.ErrNotFound},
+		{"unknown", carddav.ErrNotFound},
+	}
+	for _, tc := range tests {
+		ao, err := c.GetAddressObject(tc.id)
+		if err != tc.wantErr {
+			t.Errorf("GetAddressObject(%q) = %v, want %v", tc.id, err, tc.wantErr)
+		} else if err == nil {
+			if _, ok := ao.(*memberObject); !ok {
+				t.Errorf("GetAddressObject(%q) = %T, want a *memberObject", tc.id, ao)
+			}
+		}
+	}
+}
+
+func TestMemberObjectRemove(t *testing.T) {
+	api := &testGroupsAPI{labels: []*protonmail.Label{{ID: "work", Name: "Work"}}}
+	ab := newTestAddressBook(t, api)
+	contact := &protonmail.Contact{
+		ID:       "contact",
+		LabelIDs: []string{"work", "family"},
+		ContactEmails: []*protonmail.ContactEmail{
+			{ID: "email1", LabelIDs: []string{"work"}},
+			{ID: "email2", LabelIDs: []string{"family"}},
+		},
+	}
+	mo := &memberObject{&addressObject{ab: ab, contact: contact}, api.labels[0]}
+
+	if err := mo.Remove(); err != nil {
+		t.Fatalf("memberObject.Remove() = %v", err)
+	}
+	if want := []string{"/contacts/emails/unlabel work email1"}; !reflect.DeepEqual(api.requests, want) {
+		t.Errorf("memberObject.Remove() sent %v, want %v", api.requests, want)
+	}
+	if want := []string{"family"}; !reflect.DeepEqual(contactLabelIDs(contact), want) {
+		t.Errorf("contactLabelIDs() = %v, want %v", contactLabelIDs(contact), want)
+	}
+}
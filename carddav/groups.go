@@ -0,0 +1,415 @@
+package carddav
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-vcard"
+	"github.com/emersion/go-webdav/carddav"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// Contact groups are ProtonMail labels applied to contact emails. They are
+// exposed as vCard CATEGORIES on contacts and as KIND:group vCards.
+
+const groupObjectPrefix = "group-"
+
+const uuidURNPrefix = "urn:uuid:"
+
+func cardCategories(card vcard.Card) []string {
+	var categories []string
+	for _, c := range card.Categories() {
+		if c = strings.TrimSpace(c); c != "" {
+			categories = append(categories, c)
+		}
+	}
+	return categories
+}
+
+func isGroupCard(card vcard.Card) bool {
+	if card.Kind() == vcard.KindGroup {
+		return true
+	}
+	return strings.EqualFold(card.Value("X-ADDRESSBOOKSERVER-KIND"), "group")
+}
+
+func groupCardMembers(card vcard.Card) []string {
+	var members []string
+	for _, k := range []string{vcard.FieldMember, "X-ADDRESSBOOKSERVER-MEMBER"} {
+		for _, f := range card[k] {
+			members = append(members, strings.TrimPrefix(f.Value, uuidURNPrefix))
+		}
+	}
+	return members
+}
+
+func hasLabel(labelIDs []string, id string) bool {
+	for _, labelID := range labelIDs {
+		if labelID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func contactLabelIDs(contact *protonmail.Contact) []string {
+	labelIDs := append([]string(nil), contact.LabelIDs...)
+	for _, email := range contact.ContactEmails {
+		for _, labelID := range email.LabelIDs {
+			if !hasLabel(labelIDs, labelID) {
+				labelIDs = append(labelIDs, labelID)
+			}
+		}
+	}
+	return labelIDs
+}
+
+func (ab *addressBook) contactGroups() (map[string]*protonmail.Label, error) {
+	ab.locker.Lock()
+	groups := ab.groups
+	ab.locker.Unlock()
+	if groups != nil {
+		return groups, nil
+	}
+
+	labels, err := ab.c.ListLabels(protonmail.LabelContact)
+	if err != nil {
+		return nil, err
+	}
+
+	groups = make(map[string]*protonmail.Label, len(labels))
+	for _, label := range labels {
+		groups[label.ID] = label
+	}
+
+	ab.locker.Lock()
+	ab.groups = groups
+	ab.locker.Unlock()
+	return groups, nil
+}
+
+func (ab *addressBook) cacheContactGroup(label *protonmail.Label) {
+	ab.locker.Lock()
+	defer ab.locker.Unlock()
+	if ab.groups != nil {
+		ab.groups[label.ID] = label
+	}
+}
+
+func (ab *addressBook) uncacheContactGroup(id string) {
+	ab.locker.Lock()
+	defer ab.locker.Unlock()
+	delete(ab.groups, id)
+}
+
+func (ab *addressBook) contactGroupNames(labelIDs []string) ([]string, error) {
+	groups, err := ab.contactGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	ab.locker.Lock()
+	defer ab.locker.Unlock()
+	var names []string
+	for _, labelID := range labelIDs {
+		if label, ok := groups[labelID]; ok {
+			names = append(names, label.Name)
+		}
+	}
+	return names, nil
+}
+
+// contactGroupByName returns the contact group with the provided name,
+// creating it if it doesn't exist.
+func (ab *addressBook) contactGroupByName(name string) (*protonmail.Label, error) {
+	groups, err := ab.contactGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	ab.locker.Lock()
+	for _, label := range groups {
+		if label.Name == name {
+			ab.locker.Unlock()
+			return label, nil
+		}
+	}
+	ab.locker.Unlock()
+
+	label, err := ab.c.CreateLabel(&protonmail.Label{
+		Name: name,
+		Type: protonmail.LabelContact,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ab.cacheContactGroup(label)
+	return label, nil
+}
+
+func (ab *addressBook) setEmailGroup(labelID string, emails []*protonmail.ContactEmail, member bool) error {
+	var ids []string
+	for _, email := range emails {
+		if hasLabel(email.LabelIDs, labelID) != member {
+			ids = append(ids, email.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var err error
+	if member {
+		err = ab.c.LabelContactsEmails(labelID, ids)
+	} else {
+		err = ab.c.UnlabelContactsEmails(labelID, ids)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, email := range emails {
+		if member && !hasLabel(email.LabelIDs, labelID) {
+			email.LabelIDs = append(email.LabelIDs, labelID)
+		} else if !member {
+			labelIDs := email.LabelIDs[:0]
+			for _, id := range email.LabelIDs {
+				if id != labelID {
+					labelIDs = append(labelIDs, id)
+				}
+			}
+			email.LabelIDs = labelIDs
+		}
+	}
+	return nil
+}
+
+// fetchContactEmails populates the emails of a contact, which aren't returned
+// when listing contacts.
+func (ab *addressBook) fetchContactEmails(contact *protonmail.Contact) error {
+	if contact.ContactEmails != nil {
+		return nil
+	}
+	full, err := ab.c.GetContact(contact.ID)
+	if err != nil {
+		return err
+	}
+	contact.ContactEmails = full.ContactEmails
+	return nil
+}
+
+// setContactGroups updates the groups of a contact's emails to match the
+// provided category names. Groups are never deleted, even if they end up with
+// no members.
+func (ab *addressBook) setContactGroups(contact *protonmail.Contact, categories []string) error {
+	if err := ab.fetchContactEmails(contact); err != nil {
+		return err
+	}
+
+	var want []string
+	for _, name := range categories {
+		label, err := ab.contactGroupByName(name)
+		if err != nil {
+			return err
+		}
+		want = append(want, label.ID)
+	}
+
+	for _, labelID := range want {
+		if err := ab.setEmailGroup(labelID, contact.ContactEmails, true); err != nil {
+			return err
+		}
+	}
+
+	for _, labelID := range contactLabelIDs(contact) {
+		if hasLabel(want, labelID) {
+			continue
+		}
+		if err := ab.setEmailGroup(labelID, contact.ContactEmails, false); err != nil {
+			return err
+		}
+	}
+
+	contact.LabelIDs = want
+	return nil
+}
+
+func (ab *addressBook) listAllContactsEmails() ([]*protonmail.ContactEmail, error) {
+	var emails []*protonmail.ContactEmail
+	page := 0
+	for {
+		total, l, err := ab.c.ListContactsEmails(page, 0)
+		if err != nil {
+			return nil, err
+		}
+		emails = append(emails, l...)
+
+		if len(emails) >= total || len(l) == 0 {
+			break
+		}
+		page++
+	}
+	return emails, nil
+}
+
+type groupObject struct {
+	ab    *addressBook
+	label *protonmail.Label
+}
+
+func (g *groupObject) ID() string {
+	return groupObjectPrefix + g.label.ID
+}
+
+func (g *groupObject) Stat() (os.FileInfo, error) {
+	return nil, nil
+}
+
+func (g *groupObject) Card() (vcard.Card, error) {
+	if _, err := g.ab.ListAddressObjects(); err != nil {
+		return nil, err
+	}
+
+	emails, err := g.ab.listAllContactsEmails()
+	if err != nil {
+		return nil, err
+	}
+
+	members := make(map[string]struct{})
+	for _, email := range emails {
+		if hasLabel(email.LabelIDs, g.label.ID) {
+			members[email.ContactID] = struct{}{}
+		}
+	}
+
+	card := make(vcard.Card)
+	card.SetValue(vcard.FieldVersion, "4.0")
+	card.SetKind(vcard.KindGroup)
+	card.SetValue(vcard.FieldUID, uuidURNPrefix+g.ID())
+	card.SetValue(vcard.FieldFormattedName, g.label.Name)
+
+	g.ab.locker.Lock()
+	defer g.ab.locker.Unlock()
+	for id := range members {
+		if ao, ok := g.ab.cache[id]; ok && ao.contact.UID != "" {
+			uid := ao.contact.UID
+			if !strings.HasPrefix(uid, uuidURNPrefix) {
+				uid = uuidURNPrefix + uid
+			}
+			card.AddValue(vcard.FieldMember, uid)
+		}
+	}
+
+	return card, nil
+}
+
+func (g *groupObject) SetCard(card vcard.Card) error {
+	if name := card.Value(vcard.FieldFormattedName); name != "" && name != g.label.Name {
+		label := *g.label
+		label.Name = name
+		updated, err := g.ab.c.UpdateLabel(&label)
+		if err != nil {
+			return err
+		}
+		g.label = updated
+		g.ab.cacheContactGroup(updated)
+	}
+
+	return g.ab.setGroupMembers(g.label.ID, groupCardMembers(card))
+}
+
+// Remove deletes the group. Contacts belonging to the group are left
+// untouched.
+func (g *groupObject) Remove() error {
+	if err := g.ab.c.DeleteLabel(g.label.ID); err != nil {
+		return err
+	}
+	g.ab.uncacheContactGroup(g.label.ID)
+	return nil
+}
+
+func (ab *addressBook) setGroupMembers(labelID string, members []string) error {
+	if _, err := ab.ListAddressObjects(); err != nil {
+		return err
+	}
+
+	emails, err := ab.listAllContactsEmails()
+	if err != nil {
+		return err
+	}
+
+	isMember := make(map[string]bool)
+	ab.locker.Lock()
+	for _, ao := range ab.cache {
+		uid := strings.TrimPrefix(ao.contact.UID, uuidURNPrefix)
+		for _, member := range members {
+			if uid != "" && uid == member {
+				isMember[ao.contact.ID] = true
+				break
+			}
+		}
+	}
+	ab.locker.Unlock()
+
+	var add, remove []*protonmail.ContactEmail
+	for _, email := range emails {
+		if isMember[email.ContactID] {
+			add = append(add, email)
+		} else {
+			remove = append(remove, email)
+		}
+	}
+
+	if err := ab.setEmailGroup(labelID, add, true); err != nil {
+		return err
+	}
+	return ab.setEmailGroup(labelID, remove, false)
+}
+
+func (ab *addressBook) listGroupObjects() ([]carddav.AddressObject, error) {
+	groups, err := ab.contactGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	ab.locker.Lock()
+	defer ab.locker.Unlock()
+	aos := make([]carddav.AddressObject, 0, len(groups))
+	for _, label := range groups {
+		aos = append(aos, &groupObject{ab: ab, label: label})
+	}
+	return aos, nil
+}
+
+func (ab *addressBook) getGroupObject(id string) (carddav.AddressObject, error) {
+	groups, err := ab.contactGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	ab.locker.Lock()
+	defer ab.locker.Unlock()
+	label, ok := groups[strings.TrimPrefix(id, groupObjectPrefix)]
+	if !ok {
+		return nil, carddav.ErrNotFound
+	}
+	return &groupObject{ab: ab, label: label}, nil
+}
+
+func (ab *addressBook) createGroupObject(card vcard.Card) (carddav.AddressObject, error) {
+	name := card.Value(vcard.FieldFormattedName)
+	if name == "" {
+		return nil, errors.New("hydroxide/carddav: contact group has no name")
+	}
+
+	label, err := ab.contactGroupByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ab.setGroupMembers(label.ID, groupCardMembers(card)); err != nil {
+		return nil, err
+	}
+	return &groupObject{ab: ab, label: label}, nil
+}
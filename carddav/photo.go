@@ -0,0 +1,105 @@
+package carddav
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/emersion/go-vcard"
+)
+
+// Contact photos are stored in the encrypted card. vCard 3 clients embed them
+// with ENCODING=b, which isn't valid in vCard 4: these are converted to data
+// URIs.
+
+// maxPhotoSize is the maximum size of a contact photo, in bytes.
+const maxPhotoSize = 64 * 1024
+
+var errPhotoTooLarge = fmt.Errorf("hydroxide/carddav: contact photo larger than %v KiB", maxPhotoSize/1024)
+
+const dataURIPrefix = "data:"
+
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, s)
+	return base64.StdEncoding.DecodeString(s)
+}
+
+// photoMediaType returns the media type of a vCard 3 photo.
+func photoMediaType(f *vcard.Field, data []byte) string {
+	t := f.Params.Get(vcard.ParamMediaType)
+	if t == "" {
+		t = f.Params.Get(vcard.ParamType)
+	}
+	if t == "" {
+		return http.DetectContentType(data)
+	}
+	if !strings.Contains(t, "/") {
+		t = "image/" + t
+	}
+	return strings.ToLower(t)
+}
+
+// normalizePhoto converts a photo embedded with the vCard 3 binary encoding to
+// a data URI. It returns the photo data, or nil if the photo is an external
+// URI.
+func normalizePhoto(f *vcard.Field) ([]byte, error) {
+	switch strings.ToLower(f.Params.Get("ENCODING")) {
+	case "b", "base64":
+		data, err := decodeBase64(f.Value)
+		if err != nil {
+			return nil, fmt.Errorf("hydroxide/carddav: invalid contact photo: %v", err)
+		}
+
+		mediaType := photoMediaType(f, data)
+		delete(f.Params, "ENCODING")
+		delete(f.Params, vcard.ParamType)
+		delete(f.Params, vcard.ParamMediaType)
+		delete(f.Params, vcard.ParamValue)
+		f.Value = dataURIPrefix + mediaType + ";base64," + base64.StdEncoding.EncodeToString(data)
+		return data, nil
+	case "":
+		// Already a URI
+	default:
+		return nil, errors.New("hydroxide/carddav: unsupported contact photo encoding")
+	}
+
+	if !strings.HasPrefix(strings.ToLower(f.Value), dataURIPrefix) {
+		return nil, nil
+	}
+
+	i := strings.IndexByte(f.Value, ',')
+	if i < 0 {
+		return nil, errors.New("hydroxide/carddav: invalid contact photo data URI")
+	}
+	if strings.HasSuffix(strings.ToLower(f.Value[:i]), ";base64") {
+		data, err := decodeBase64(f.Value[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("hydroxide/carddav: invalid contact photo: %v", err)
+		}
+		return data, nil
+	}
+	return []byte(f.Value[i+1:]), nil
+}
+
+// normalizePhotos normalizes the photos of a card sent by a client, and
+// checks their size.
+func normalizePhotos(card vcard.Card) error {
+	for _, f := range card[vcard.FieldPhoto] {
+		data, err := normalizePhoto(f)
+		if err != nil {
+			return err
+		}
+		if len(data) > maxPhotoSize {
+			return errPhotoTooLarge
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package carddav
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	"github.com/emersion/go-vcard"
+)
+
+func TestNormalizePhoto(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	encoded := base64.StdEncoding.EncodeToString(png)
+
+	tests := []struct {
+		name      string
+		field     *vcard.Field
+		wantValue string
+		wantData  []byte
+		wantErr   bool
+	}{
+		{
+			name:      "vCard 3 with type",
+			field:     &vcard.Field{Value: encoded, Params: vcard.Params{"ENCODING": {"b"}, vcard.ParamType: {"JPEG"}}},
+			wantValue: "data:image/jpeg;base64," + encoded,
+			wantData:  png,
+		},
+		{
+			name:      "vCard 3 with media type",
+			field:     &vcard.Field{Value: encoded, Params: vcard.Params{"ENCODING": {"BASE64"}, vcard.ParamMediaType: {"image/png"}}},
+			wantValue: "data:image/png;base64," + encoded,
+			wantData:  png,
+		},
+		{
+			name:      "vCard 3 with folded data",
+			field:     &vcard.Field{Value: encoded[:4] + "\r\n " + encoded[4:], Params: vcard.Params{"ENCODING": {"b"}}},
+			wantValue: "data:image/png;base64," + encoded,
+			wantData:  png,
+		},
+		{
+			name:      "data URI",
+			field:     &vcard.Field{Value: "data:image/png;base64," + encoded},
+			wantValue: "data:image/png;base64," + encoded,
+			wantData:  png,
+		},
+		{
+			name:      "plain data URI",
+			field:     &vcard.Field{Value: "data:text/plain,hello"},
+			wantValue: "data:text/plain,hello",
+			wantData:  []byte("hello"),
+		},
+		{
+			name:      "external URI",
+			field:     &vcard.Field{Value: "https://example.org/photo.png"},
+			wantValue: "https://example.org/photo.png",
+		},
+		{name: "invalid base64", field: &vcard.Field{Value: "!!!", Params: vcard.Params{"ENCODING": {"b"}}}, wantErr: true},
+		{name: "unknown encoding", field: &vcard.Field{Value: "abc", Params: vcard.Params{"ENCODING": {"quoted-printable"}}}, wantErr: true},
+		{name: "data URI without data", field: &vcard.Field{Value: "data:image/png"}, wantErr: true},
+	}
+	for _, tc := range tests {
+		data, err := normalizePhoto(tc.field)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%v: normalizePhoto() = nil, want an error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: normalizePhoto() = %v", tc.name, err)
+			continue
+		}
+		if !bytes.Equal(data, tc.wantData) {
+			t.Errorf("%v: normalizePhoto() = %q, want %q", tc.name, data, tc.wantData)
+		}
+		if tc.field.Value != tc.wantValue {
+			t.Errorf("%v: value = %q, want %q", tc.name, tc.field.Value, tc.wantValue)
+		}
+		if len(tc.field.Params) > 0 {
+			t.Errorf("%v: params = %v, want none", tc.name, tc.field.Params)
+		}
+	}
+}
+
+func TestNormalizePhotos(t *testing.T) {
+	small := vcard.Card{vcard.FieldPhoto: {{Value: "data:image/png;base64,AAAA"}}}
+	if err := normalizePhotos(small); err != nil {
+		t.Errorf("normalizePhotos() = %v", err)
+	}
+
+	big := base64.StdEncoding.EncodeToString(make([]byte, maxPhotoSize+1))
+	large := vcard.Card{vcard.FieldPhoto: {{Value: big, Params: vcard.Params{"ENCODING": {"b"}}}}}
+	if err := normalizePhotos(large); err != errPhotoTooLarge {
+		t.Errorf("normalizePhotos() with a large photo = %v, want %v", err, errPhotoTooLarge)
+	}
+
+	if err := normalizePhotos(vcard.Card{}); err != nil {
+		t.Errorf("normalizePhotos() without photos = %v", err)
+	}
+}
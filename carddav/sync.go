@@ -0,0 +1,499 @@
+package carddav
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-vcard"
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/carddav"
+)
+
+// Collection synchronization, defined in RFC 6578. Sync tokens contain the ID
+// of a ProtonMail event, and the address book keeps a log of the objects
+// changed by the latest events. Tokens older than the log, or issued before a
+// contacts refresh, are rejected and clients perform a full synchronization.
+//
+// go-webdav doesn't support REPORT requests other than addressbook-multiget
+// nor custom collection properties, so sync-collection reports and depth 0
+// PROPFIND requests on the address book are handled here.
+
+const syncTokenPrefix = "data:,"
+
+// maxSyncLogSize is the maximum number of events kept in the sync log.
+const maxSyncLogSize = 1000
+
+const nsDAV = "DAV:"
+
+var (
+	getetagName            = xml.Name{Space: nsDAV, Local: "getetag"}
+	getcontenttypeName     = xml.Name{Space: nsDAV, Local: "getcontenttype"}
+	syncTokenName          = xml.Name{Space: nsDAV, Local: "sync-token"}
+	supportedReportSetName = xml.Name{Space: nsDAV, Local: "supported-report-set"}
+	getctagName            = xml.Name{Space: "http://calendarserver.org/ns/", Local: "getctag"}
+	addressDataName        = xml.Name{Space: "urn:ietf:params:xml:ns:carddav", Local: "address-data"}
+)
+
+type syncLogEntry struct {
+	eventID string
+	// changes maps object IDs to true if the object has been deleted
+	changes map[string]bool
+}
+
+// logSyncChanges records the objects changed by an event. The address book
+// must be locked.
+func (ab *addressBook) logSyncChanges(eventID string, changes map[string]bool, refreshed bool) {
+	if refreshed {
+		// We don't know what has changed, invalidate all tokens
+		ab.syncLog = nil
+	}
+
+	if n := len(ab.syncLog); n > 0 && ab.syncLog[n-1].eventID == eventID {
+		for id, deleted := range changes {
+			ab.syncLog[n-1].changes[id] = deleted
+		}
+		return
+	}
+
+	ab.syncLog = append(ab.syncLog, &syncLogEntry{eventID, changes})
+	if len(ab.syncLog) > maxSyncLogSize {
+		ab.syncLog = ab.syncLog[len(ab.syncLog)-maxSyncLogSize:]
+	}
+}
+
+// syncToken returns the current sync token, or an empty string if no event
+// has been received yet.
+func (ab *addressBook) syncToken() string {
+	ab.locker.Lock()
+	defer ab.locker.Unlock()
+
+	if len(ab.syncLog) == 0 {
+		return ""
+	}
+	return syncTokenPrefix + ab.syncLog[len(ab.syncLog)-1].eventID
+}
+
+// syncChanges returns the objects changed since token was issued, and the
+// current sync token. ok is false if the token is invalid or too old.
+func (ab *addressBook) syncChanges(token string) (changes map[string]bool, current string, ok bool) {
+	ab.locker.Lock()
+	defer ab.locker.Unlock()
+
+	if len(ab.syncLog) == 0 || len(token) <= len(syncTokenPrefix) || token[:len(syncTokenPrefix)] != syncTokenPrefix {
+		return nil, "", false
+	}
+	eventID := token[len(syncTokenPrefix):]
+
+	for i, entry := range ab.syncLog {
+		if entry.eventID != eventID {
+			continue
+		}
+
+		changes = make(map[string]bool)
+		for _, entry := range ab.syncLog[i+1:] {
+			for id, deleted := range entry.changes {
+				changes[id] = deleted
+			}
+		}
+		current = syncTokenPrefix + ab.syncLog[len(ab.syncLog)-1].eventID
+		return changes, current, true
+	}
+	return nil, "", false
+}
+
+// https://tools.ietf.org/html/rfc6578#section-6.1
+type syncCollection struct {
+	XMLName   xml.Name             `xml:"DAV: sync-collection"`
+	SyncToken string               `xml:"DAV: sync-token"`
+	SyncLevel string               `xml:"DAV: sync-level"`
+	Prop      webdav.PropfindProps `xml:"DAV: prop"`
+}
+
+type syncPropstat struct {
+	Prop   []webdav.Property `xml:"DAV: prop>_ignored_"`
+	Status string            `xml:"DAV: status"`
+}
+
+type syncResponse struct {
+	XMLName  xml.Name       `xml:"DAV: response"`
+	Href     string         `xml:"DAV: href"`
+	Propstat []syncPropstat `xml:"DAV: propstat,omitempty"`
+	Status   string         `xml:"DAV: status,omitempty"`
+}
+
+type syncMultistatus struct {
+	XMLName   xml.Name        `xml:"DAV: multistatus"`
+	Responses []*syncResponse `xml:"DAV: response"`
+	SyncToken string          `xml:"DAV: sync-token,omitempty"`
+}
+
+// https://tools.ietf.org/html/rfc4918#section-14.20
+type propfind struct {
+	XMLName  xml.Name             `xml:"DAV: propfind"`
+	Allprop  *struct{}            `xml:"DAV: allprop"`
+	Propname *struct{}            `xml:"DAV: propname"`
+	Prop     webdav.PropfindProps `xml:"DAV: prop"`
+	Include  webdav.PropfindProps `xml:"DAV: include"`
+}
+
+func statusLine(code int) string {
+	return fmt.Sprintf("HTTP/1.1 %d %s", code, webdav.StatusText(code))
+}
+
+// etag returns the ETag of an address object, computed the same way as
+// go-webdav does.
+func etag(ao carddav.AddressObject) (string, error) {
+	var modTime time.Time
+	var size int64
+	if fi, err := ao.Stat(); err != nil {
+		return "", err
+	} else if fi != nil {
+		modTime, size = fi.ModTime(), fi.Size()
+	}
+	return fmt.Sprintf(`"%x%x"`, modTime.UnixNano(), size), nil
+}
+
+func addressObjectPropstats(ao carddav.AddressObject, pnames []xml.Name) ([]syncPropstat, error) {
+	var found, notFound []webdav.Property
+	for _, pname := range pnames {
+		prop := webdav.Property{XMLName: pname}
+		switch pname {
+		case getetagName:
+			etag, err := etag(ao)
+			if err != nil {
+				return nil, err
+			}
+			prop.InnerXML = []byte(etag)
+		case getcontenttypeName:
+			prop.InnerXML = []byte(vcard.MIMEType)
+		case addressDataName:
+			card, err := ao.Card()
+			if err != nil {
+				return nil, err
+			}
+
+			var b, escaped bytes.Buffer
+			if err := vcard.NewEncoder(&b).Encode(card); err != nil {
+				return nil, err
+			}
+			if err := xml.EscapeText(&escaped, b.Bytes()); err != nil {
+				return nil, err
+			}
+			prop.InnerXML = escaped.Bytes()
+		default:
+			notFound = append(notFound, prop)
+			continue
+		}
+		found = append(found, prop)
+	}
+
+	var pstats []syncPropstat
+	if len(found) > 0 {
+		pstats = append(pstats, syncPropstat{found, statusLine(http.StatusOK)})
+	}
+	if len(notFound) > 0 {
+		pstats = append(pstats, syncPropstat{notFound, statusLine(http.StatusNotFound)})
+	}
+	return pstats, nil
+}
+
+type handler struct {
+	ab          *addressBook
+	carddav     http.Handler
+	collections http.Handler
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, _, ok := splitCollectionPath(r.URL.Path); ok {
+		h.serveCollections(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "REPORT":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var sc syncCollection
+		if err := xml.Unmarshal(body, &sc); err == nil {
+			h.handleSyncCollection(w, r, &sc, &collection{ab: h.ab})
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	case "PROPFIND":
+		if r.URL.Path != "/" || r.Header.Get("Depth") != "0" {
+			break
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var pf propfind
+		if len(bytes.TrimSpace(body)) == 0 {
+			pf.Allprop = &struct{}{}
+		} else if err := xml.Unmarshal(body, &pf); err != nil || pf.Propname != nil {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			break
+		}
+		h.handlePropfind(w, r, &pf)
+		return
+	}
+
+	h.carddav.ServeHTTP(w, r)
+}
+
+func (h *handler) handleSyncCollection(w http.ResponseWriter, r *http.Request, sc *syncCollection, c *collection) {
+	if sc.SyncLevel != "1" && sc.SyncLevel != "infinite" {
+		http.Error(w, "unsupported sync level", http.StatusBadRequest)
+		return
+	}
+
+	var changes map[string]bool
+	var token string
+	if sc.SyncToken == "" {
+		// Initial synchronization, send all objects
+		token = h.ab.syncToken()
+		if token == "" {
+			http.Error(w, "address book not synchronized yet", http.StatusServiceUnavailable)
+			return
+		}
+
+		aos, err := c.ListAddressObjects()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		changes = make(map[string]bool, len(aos))
+		for _, ao := range aos {
+			changes[ao.ID()] = false
+		}
+	} else {
+		var ok bool
+		changes, token, ok = h.ab.syncChanges(sc.SyncToken)
+		if !ok {
+			w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, xml.Header+`<D:error xmlns:D="DAV:"><D:valid-sync-token/></D:error>`)
+			return
+		}
+	}
+
+	ms := syncMultistatus{SyncToken: token}
+	for id, deleted := range changes {
+		resp := &syncResponse{
+			Href: (&url.URL{Path: path.Join(r.URL.Path, id)}).EscapedPath(),
+		}
+
+		var ao carddav.AddressObject
+		var err error
+		if !deleted {
+			ao, err = c.GetAddressObject(id)
+			if err == carddav.ErrNotFound {
+				deleted = true
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if deleted {
+			resp.Status = statusLine(http.StatusNotFound)
+		} else {
+			resp.Propstat, err = addressObjectPropstats(ao, []xml.Name(sc.Prop))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if len(resp.Propstat) == 0 {
+				resp.Status = statusLine(http.StatusOK)
+			}
+		}
+
+		ms.Responses = append(ms.Responses, resp)
+	}
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(webdav.StatusMulti)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(&ms)
+}
+
+func (h *handler) handlePropfind(w http.ResponseWriter, r *http.Request, pf *propfind) {
+	fs := &collectionFileSystem{h.ab}
+
+	var pstats []webdav.Propstat
+	var err error
+	if pf.Allprop != nil {
+		pstats, err = webdav.Allprop(r.Context(), fs, nil, "/", []xml.Name(pf.Include))
+	} else {
+		pstats, err = webdav.Props(r.Context(), fs, nil, "/", []xml.Name(pf.Prop))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	mw := webdav.NewMultistatusWriter(w)
+	resp := &webdav.Response{
+		Href:     []string{(&url.URL{Path: r.URL.Path}).EscapedPath()},
+		Propstat: pstats,
+	}
+	if err := mw.Write(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mw.Close()
+}
+
+// collectionFileSystem only contains the address book collection, with the
+// same properties as go-webdav's plus the sync-related ones.
+type collectionFileSystem struct {
+	ab *addressBook
+}
+
+func (fs *collectionFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (fs *collectionFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if name != "/" {
+		return nil, os.ErrNotExist
+	}
+	return &collectionFile{&collection{ab: fs.ab}}, nil
+}
+
+func (fs *collectionFileSystem) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+func (fs *collectionFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+func (fs *collectionFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if name != "/" {
+		return nil, os.ErrNotExist
+	}
+	return collectionFileInfo{"/"}, nil
+}
+
+type collectionFileInfo struct {
+	name string
+}
+
+func (fi collectionFileInfo) Name() string       { return fi.name }
+func (fi collectionFileInfo) Size() int64        { return 0 }
+func (fi collectionFileInfo) Mode() os.FileMode  { return os.ModeDir | os.ModePerm }
+func (fi collectionFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi collectionFileInfo) IsDir() bool        { return true }
+func (fi collectionFileInfo) Sys() interface{}   { return nil }
+
+type collectionFile struct {
+	c *collection
+}
+
+func (f *collectionFile) Close() error {
+	return nil
+}
+
+func (f *collectionFile) Read(b []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *collectionFile) Write(b []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *collectionFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *collectionFile) Readdir(count int) ([]os.FileInfo, error) {
+	aos, err := f.c.ListAddressObjects()
+	if err != nil {
+		return nil, err
+	}
+
+	fis := make([]os.FileInfo, len(aos))
+	for i, ao := range aos {
+		if fis[i], err = addressObjectFileInfo(ao); err != nil {
+			return nil, err
+		}
+	}
+	return fis, nil
+}
+
+func (f *collectionFile) Stat() (os.FileInfo, error) {
+	return collectionFileInfo{f.c.name()}, nil
+}
+
+func (f *collectionFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	info, err := f.c.Info()
+	if err != nil {
+		return nil, err
+	}
+
+	props := []webdav.Property{
+		{
+			XMLName:  xml.Name{Space: nsDAV, Local: "resourcetype"},
+			InnerXML: []byte(`<collection xmlns="DAV:"/><addressbook xmlns="urn:ietf:params:xml:ns:carddav"/>`),
+		},
+		{
+			XMLName:  xml.Name{Space: nsDAV, Local: "displayname"},
+			InnerXML: []byte(info.Name),
+		},
+		{
+			XMLName:  xml.Name{Space: addressDataName.Space, Local: "addressbook-description"},
+			InnerXML: []byte(info.Description),
+		},
+		{
+			XMLName: xml.Name{Space: addressDataName.Space, Local: "supported-address-data"},
+			InnerXML: []byte(`<address-data-type xmlns="urn:ietf:params:xml:ns:carddav" content-type="text/vcard" version="3.0"/>` +
+				`<address-data-type xmlns="urn:ietf:params:xml:ns:carddav" content-type="text/vcard" version="4.0"/>`),
+		},
+		{
+			XMLName:  xml.Name{Space: addressDataName.Space, Local: "max-resource-size"},
+			InnerXML: []byte(strconv.Itoa(info.MaxResourceSize)),
+		},
+		{
+			XMLName:  xml.Name{Space: addressDataName.Space, Local: "addressbook-home-set"},
+			InnerXML: []byte(`<href xmlns="DAV:">` + addressBooksPath + `/</href>`),
+		},
+		{
+			XMLName: supportedReportSetName,
+			InnerXML: []byte(`<supported-report xmlns="DAV:"><report><addressbook-multiget xmlns="urn:ietf:params:xml:ns:carddav"/></report></supported-report>` +
+				`<supported-report xmlns="DAV:"><report><sync-collection/></report></supported-report>`),
+		},
+	}
+	if token := f.c.ab.syncToken(); token != "" {
+		props = append(props, webdav.Property{XMLName: syncTokenName, InnerXML: []byte(token)})
+		props = append(props, webdav.Property{XMLName: getctagName, InnerXML: []byte(token)})
+	}
+
+	m := make(map[xml.Name]webdav.Property, len(props))
+	for _, prop := range props {
+		m[prop.XMLName] = prop
+	}
+	return m, nil
+}
+
+func (f *collectionFile) Patch([]webdav.Proppatch) ([]webdav.Propstat, error) {
+	return nil, os.ErrPermission
+}
@@ -0,0 +1,115 @@
+// Package charset converts the text of incoming messages to UTF-8.
+package charset
+
+import (
+	"fmt"
+	"mime"
+	"net/mail"
+	"unicode/utf8"
+
+	gocharset "github.com/emersion/go-message/charset"
+	gomail "github.com/emersion/go-message/mail"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// DefaultFallback is the default fallback charset.
+const DefaultFallback = "windows-1252"
+
+// extraCharsets are decoded in addition to the charsets supported by
+// go-message.
+var extraCharsets = []string{
+	"big5-hkscs",
+	"cp866",
+	"euc-kr",
+	"hz-gb-2312",
+	"ibm866",
+	"iso-8859-5",
+	"iso-8859-6",
+	"iso-8859-7",
+	"iso-8859-8",
+	"iso-8859-8-i",
+	"koi8-u",
+	"ks_c_5601-1987",
+	"macintosh",
+	"utf-16",
+	"utf-16be",
+	"utf-16le",
+	"windows-31j",
+	"windows-874",
+	"windows-1253",
+	"windows-1254",
+	"windows-1255",
+	"windows-1256",
+	"windows-1257",
+	"windows-1258",
+	"x-gbk",
+	"x-sjis",
+}
+
+func init() {
+	for _, name := range extraCharsets {
+		if enc, err := htmlindex.Get(name); err == nil {
+			gocharset.RegisterEncoding(name, enc)
+		}
+	}
+}
+
+var fallback encoding.Encoding
+
+// SetFallback sets the charset used to decode text which isn't valid UTF-8
+// because its charset is missing or unknown. An empty name disables the
+// fallback.
+func SetFallback(name string) error {
+	if name == "" {
+		fallback = nil
+		return nil
+	}
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return fmt.Errorf("unknown charset %q", name)
+	}
+	fallback = enc
+	return nil
+}
+
+// Fallback converts text which isn't valid UTF-8 with the fallback charset.
+// Text is returned unchanged if it's valid UTF-8.
+func Fallback(b []byte) []byte {
+	if fallback == nil || utf8.Valid(b) {
+		return b
+	}
+	if dec, err := fallback.NewDecoder().Bytes(b); err == nil {
+		return dec
+	}
+	return b
+}
+
+// DecodeHeader decodes an internationalized header field.
+func DecodeHeader(s string) string {
+	s, _ = gocharset.DecodeHeader(s)
+	return string(Fallback([]byte(s)))
+}
+
+var addressParser = &mail.AddressParser{
+	WordDecoder: &mime.WordDecoder{CharsetReader: gocharset.Reader},
+}
+
+// AddressList parses an address list header field. Unlike
+// mail.Header.AddressList, names can use any supported charset.
+func AddressList(h gomail.Header, key string) ([]*gomail.Address, error) {
+	v := h.Get(key)
+	if v == "" {
+		return nil, nil
+	}
+
+	list, err := addressParser.ParseList(string(Fallback([]byte(v))))
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]*gomail.Address, len(list))
+	for i, a := range list {
+		addrs[i] = (*gomail.Address)(a)
+	}
+	return addrs, nil
+}
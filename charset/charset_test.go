@@ -0,0 +1,158 @@
+package charset
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/emersion/go-message"
+	gocharset "github.com/emersion/go-message/charset"
+	gomail "github.com/emersion/go-message/mail"
+)
+
+func setTestFallback(t *testing.T, name string) {
+	if err := SetFallback(name); err != nil {
+		t.Fatalf("SetFallback(%q) = %v", name, err)
+	}
+	t.Cleanup(func() { SetFallback("") })
+}
+
+func TestExtraCharsets(t *testing.T) {
+	tests := []struct {
+		charset string
+		b       string
+		want    string
+	}{
+		{"koi8-u", "\xf0\xd2\xc9\xd7\xc5\xd4", "Привет"},
+		{"cp866", "\x8f\xe0\xa8\xa2\xa5\xe2", "Привет"},
+		{"iso-8859-7", "\xc3\xe5\xe9\xdc", "Γειά"},
+		{"windows-1253", "\xc3\xe5\xe9\xdc", "Γειά"},
+		{"utf-16le", "h\x00i\x00", "hi"},
+		{"x-sjis", "\x82\xa0", "あ"},
+		{"euc-kr", "\xc7\xd1", "한"},
+	}
+	for _, tc := range tests {
+		r, err := gocharset.Reader(tc.charset, bytes.NewReader([]byte(tc.b)))
+		if err != nil {
+			t.Errorf("Reader(%q) = %v", tc.charset, err)
+			continue
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("%v: cannot decode: %v", tc.charset, err)
+		} else if string(b) != tc.want {
+			t.Errorf("%v: decoded %q, want %q", tc.charset, b, tc.want)
+		}
+	}
+
+	for _, name := range extraCharsets {
+		if _, err := gocharset.Reader(name, bytes.NewReader(nil)); err != nil {
+			t.Errorf("Reader(%q) = %v", name, err)
+		}
+	}
+}
+
+func TestSetFallback(t *testing.T) {
+	if err := SetFallback("unknown"); err == nil {
+		t.Errorf("SetFallback(%q) = nil, want an error", "unknown")
+	}
+	setTestFallback(t, DefaultFallback)
+	if err := SetFallback(""); err != nil {
+		t.Errorf("SetFallback(%q) = %v", "", err)
+	}
+	if got := Fallback([]byte("caf\xe9")); string(got) != "caf\xe9" {
+		t.Errorf("Fallback() with fallback disabled = %q, want the input", got)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	setTestFallback(t, DefaultFallback)
+
+	tests := []struct {
+		in, want string
+	}{
+		{"hello", "hello"},
+		{"café", "café"},
+		{"caf\xe9", "café"},
+		{"\x80", "€"},
+	}
+	for _, tc := range tests {
+		if got := Fallback([]byte(tc.in)); string(got) != tc.want {
+			t.Errorf("Fallback(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestDecodeHeader(t *testing.T) {
+	setTestFallback(t, DefaultFallback)
+
+	tests := []struct {
+		in, want string
+	}{
+		{"Hello", "Hello"},
+		{"=?utf-8?q?caf=C3=A9?=", "café"},
+		{"=?iso-8859-7?b?w+Xp3A==?=", "Γειά"},
+		{"=?koi8-u?q?=F0=D2=C9=D7=C5=D4?= world", "Привет world"},
+		{"caf\xe9", "café"},
+	}
+	for _, tc := range tests {
+		if got := DecodeHeader(tc.in); got != tc.want {
+			t.Errorf("DecodeHeader(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestAddressList(t *testing.T) {
+	setTestFallback(t, DefaultFallback)
+
+	tests := []struct {
+		v       string
+		want    []gomail.Address
+		wantErr bool
+	}{
+		{
+			v:    "Alice <alice@example.org>, bob@example.org",
+			want: []gomail.Address{{Name: "Alice", Address: "alice@example.org"}, {Address: "bob@example.org"}},
+		},
+		{
+			v:    "=?koi8-u?q?=F0=D2=C9=D7=C5=D4?= <alice@example.org>",
+			want: []gomail.Address{{Name: "Привет", Address: "alice@example.org"}},
+		},
+		{
+			v:    "=?iso-8859-7?b?w+Xp3A==?= <alice@example.org>",
+			want: []gomail.Address{{Name: "Γειά", Address: "alice@example.org"}},
+		},
+		{
+			v:    "\"Ren\xe9\" <rene@example.org>",
+			want: []gomail.Address{{Name: "René", Address: "rene@example.org"}},
+		},
+		{v: ""},
+		{v: "not an address", wantErr: true},
+	}
+	for _, tc := range tests {
+		h := gomail.Header{Header: make(message.Header)}
+		if tc.v != "" {
+			h.Set("To", tc.v)
+		}
+
+		addrs, err := AddressList(h, "To")
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("AddressList(%q) = nil, want an error", tc.v)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("AddressList(%q) = %v", tc.v, err)
+			continue
+		}
+		if len(addrs) != len(tc.want) {
+			t.Errorf("AddressList(%q) = %v, want %v", tc.v, addrs, tc.want)
+			continue
+		}
+		for i, addr := range addrs {
+			if *addr != tc.want[i] {
+				t.Errorf("AddressList(%q)[%v] = %v, want %v", tc.v, i, *addr, tc.want[i])
+			}
+		}
+	}
+}
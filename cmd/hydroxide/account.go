@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// accountInfo is the output of the account-info command. Keys are never
+// included.
+type accountInfo struct {
+	Username    string
+	DisplayName string
+	UsedSpace   int
+	MaxSpace    int
+	Addresses   []string
+	Subscribed  []string
+	TwoFactor   []string
+}
+
+func serviceNames(services protonmail.UserService) []string {
+	names := []string{}
+	if services&protonmail.ServiceMail != 0 {
+		names = append(names, "mail")
+	}
+	if services&protonmail.ServiceVPN != 0 {
+		names = append(names, "vpn")
+	}
+	return names
+}
+
+func twoFactorNames(methods protonmail.TwoFactorMethod) []string {
+	names := []string{}
+	if methods&protonmail.TwoFactorTOTP != 0 {
+		names = append(names, "totp")
+	}
+	if methods&protonmail.TwoFactorU2F != 0 {
+		names = append(names, "u2f")
+	}
+	return names
+}
+
+func getAccountInfo(c *protonmail.Client) (*accountInfo, error) {
+	u, err := c.GetCurrentUser()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get user: %v", err)
+	}
+	settings, err := c.GetSettings()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get settings: %v", err)
+	}
+	addrs, err := c.ListAddresses()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list addresses: %v", err)
+	}
+
+	info := &accountInfo{
+		Username:    u.Name,
+		DisplayName: u.DisplayName,
+		UsedSpace:   u.UsedSpace,
+		MaxSpace:    u.MaxSpace,
+		Addresses:   make([]string, 0, len(addrs)),
+		Subscribed:  serviceNames(u.Subscribed),
+		TwoFactor:   twoFactorNames(settings.TwoFactor.Enabled),
+	}
+	for _, addr := range addrs {
+		info.Addresses = append(info.Addresses, addr.Email)
+	}
+	return info, nil
+}
+
+func formatSize(n int) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%v B", n)
+	}
+	div, exp := unit, 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func formatList(l []string) string {
+	if len(l) == 0 {
+		return "none"
+	}
+	return strings.Join(l, ", ")
+}
+
+func writeAccountInfo(w io.Writer, info *accountInfo, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	}
+
+	_, err := fmt.Fprintf(w, "Username: %v\nDisplay name: %v\nStorage: %v / %v\nAddresses (%v): %v\nSubscribed to: %v\nTwo-factor authentication: %v\n",
+		info.Username,
+		info.DisplayName,
+		formatSize(info.UsedSpace),
+		formatSize(info.MaxSpace),
+		len(info.Addresses),
+		formatList(info.Addresses),
+		formatList(info.Subscribed),
+		formatList(info.TwoFactor))
+	return err
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/emersion/hydroxide/auth"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+const (
+	// Probes are expected to run every 10 seconds or so: checks against the
+	// API are cached for a bit less long.
+	readinessCacheDuration = 5 * time.Second
+	readinessTimeout       = 10 * time.Second
+)
+
+type readiness struct {
+	Ready     bool              `json:"ready"`
+	Unhealthy map[string]string `json:"unhealthy,omitempty"`
+}
+
+// healthChecker checks whether the sessions of logged in users can still reach
+// the API.
+type healthChecker struct {
+	sessions *auth.Manager
+
+	locker  sync.Mutex
+	last    *readiness
+	checked time.Time
+}
+
+func checkClient(c *protonmail.Client) error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.ListLabels(protonmail.LabelMessage)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(readinessTimeout):
+		return errors.New("timeout")
+	}
+}
+
+func (hc *healthChecker) check() *readiness {
+	hc.locker.Lock()
+	defer hc.locker.Unlock()
+
+	if hc.last != nil && time.Since(hc.checked) < readinessCacheDuration {
+		return hc.last
+	}
+
+	clients := hc.sessions.Clients()
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	r := &readiness{Ready: true}
+	for username, c := range clients {
+		wg.Add(1)
+		go func(username string, c *protonmail.Client) {
+			defer wg.Done()
+			if err := checkClient(c); err != nil {
+				mutex.Lock()
+				if r.Unhealthy == nil {
+					r.Unhealthy = make(map[string]string)
+				}
+				r.Unhealthy[username] = err.Error()
+				r.Ready = false
+				mutex.Unlock()
+			}
+		}(username, c)
+	}
+	wg.Wait()
+
+	hc.last = r
+	hc.checked = time.Now()
+	return r
+}
+
+func (hc *healthChecker) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/healthz":
+		resp.Write([]byte("ok\n"))
+	case "/readyz":
+		r := hc.check()
+		resp.Header().Set("Content-Type", "application/json")
+		if !r.Ready {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(resp).Encode(r)
+	default:
+		http.NotFound(resp, req)
+	}
+}
+
+// serveHealth serves health checks on addr. It does nothing if addr is empty.
+func serveHealth(addr string, sessions *auth.Manager) {
+	if addr == "" {
+		return
+	}
+	log.Println("Serving health checks at", addr)
+	log.Fatal(http.ListenAndServe(addr, &healthChecker{sessions: sessions}))
+}
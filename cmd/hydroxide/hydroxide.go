@@ -2,37 +2,49 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/emersion/go-imap"
 	imapmove "github.com/emersion/go-imap-move"
 	imapspacialuse "github.com/emersion/go-imap-specialuse"
 	imapserver "github.com/emersion/go-imap/server"
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 	"github.com/howeyc/gopass"
+	"golang.org/x/crypto/openpgp"
 
 	"github.com/emersion/hydroxide/auth"
+	"github.com/emersion/hydroxide/caldav"
 	"github.com/emersion/hydroxide/carddav"
+	"github.com/emersion/hydroxide/charset"
+	"github.com/emersion/hydroxide/config"
 	"github.com/emersion/hydroxide/events"
+	"github.com/emersion/hydroxide/exports"
 	imapbackend "github.com/emersion/hydroxide/imap"
+	"github.com/emersion/hydroxide/imap/cache"
+	"github.com/emersion/hydroxide/imports"
+	"github.com/emersion/hydroxide/metrics"
 	"github.com/emersion/hydroxide/protonmail"
 	smtpbackend "github.com/emersion/hydroxide/smtp"
 )
 
-func newClient() *protonmail.Client {
-	return &protonmail.Client{
-		RootURL:      "https://dev.protonmail.com/api",
-		AppVersion:   "Web_3.15.23",
-		ClientID:     "Web",
-		ClientSecret: "4957cc9a2e0a2a49d02475c9d013478d",
-	}
-}
-
 func receiveEvents(c *protonmail.Client, ch chan<- *protonmail.Event) {
 	t := time.NewTicker(time.Minute)
 	defer t.Stop()
@@ -54,14 +66,387 @@ func receiveEvents(c *protonmail.Client, ch chan<- *protonmail.Event) {
 	}
 }
 
+func portFromEnv(defaultPort string) string {
+	if port := os.Getenv("PORT"); port != "" {
+		return port
+	}
+	return defaultPort
+}
+
+// listenAddr returns addr, or a local address with defaultPort if addr is
+// empty.
+func listenAddr(addr, defaultPort string) string {
+	if addr != "" {
+		return addr
+	}
+	return "127.0.0.1:" + defaultPort
+}
+
+func newSMTPServer(be smtp.Backend, tlsConfig *tls.Config, tlsPolicy *starttlsPolicy, addr string, limits *connLimits) *smtp.Server {
+	s := smtp.NewServer(be)
+	s.Addr = addr
+	// Idle clients are sent a 421 reply
+	s.ReadTimeout = limits.smtpTimeout
+	s.WriteTimeout = limits.smtpTimeout
+	s.Domain = "localhost" // TODO: make this configurable
+	s.MaxMessageBytes = smtpbackend.DefaultMaxMessageBytes
+	s.TLSConfig = tlsConfig
+	// Require STARTTLS before authenticating when a certificate is configured
+	s.AllowInsecureAuth = tlsConfig == nil || tlsPolicy.allowInsecureAuth()
+	//s.Debug = os.Stdout
+	for name, newServer := range auth.SASLMechanisms() {
+		newServer := newServer
+		s.EnableAuth(name, func(conn *smtp.Conn) sasl.Server {
+			return newServer(func(username, password string) error {
+				state := conn.State()
+				session, err := be.Login(&state, username, password)
+				if err != nil {
+					return err
+				}
+				conn.SetSession(session)
+				return nil
+			})
+		})
+	}
+	return s
+}
+
+func newEventsManager(minInterval, maxInterval time.Duration, mailHook *events.MailHook) *events.Manager {
+	m := events.NewManager(minInterval, maxInterval)
+	m.MailHook = mailHook
+	return m
+}
+
+// openMessageCache opens the on-disk message cache. It returns nil if the
+// cache is disabled.
+func openMessageCache(dir string, sizeMiB int) (*cache.Cache, error) {
+	if sizeMiB <= 0 {
+		return nil, nil
+	}
+
+	if dir == "" {
+		cacheHome, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(cacheHome, "hydroxide", "messages")
+	}
+
+	return cache.Open(dir, int64(sizeMiB)*1024*1024)
+}
+
+func newIMAPServer(sessions *auth.Manager, eventsManager *events.Manager, tlsConfig *tls.Config, tlsPolicy *starttlsPolicy, addr string, threads bool, messageCache *cache.Cache, expungeDelete, matchDrafts bool, limits *connLimits) *imapserver.Server {
+	be := imapbackend.New(sessions, eventsManager, messageCache, expungeDelete, matchDrafts)
+	s := imapserver.New(be)
+	s.Addr = addr
+	s.TLSConfig = tlsConfig
+	// Require STARTTLS before authenticating when a certificate is configured
+	s.AllowInsecureAuth = tlsConfig == nil || tlsPolicy.allowInsecureAuth()
+	//s.Debug = os.Stdout
+	for name, newServer := range auth.SASLMechanisms() {
+		newServer := newServer
+		s.EnableAuth(name, func(conn imapserver.Conn) sasl.Server {
+			return newServer(func(username, password string) error {
+				user, err := be.Login(username, password)
+				if err != nil {
+					return err
+				}
+				ctx := conn.Context()
+				ctx.State = imap.AuthenticatedState
+				ctx.User = user
+				return nil
+			})
+		})
+	}
+	s.Enable(imapspacialuse.NewExtension())
+	s.Enable(imapbackend.NewUTF8Extension())
+	s.Enable(imapmove.NewExtension())
+	s.Enable(imapbackend.NewTimeoutExtension(limits.imapTimeout, limits.imapIdleTimeout, limits.handshakeTimeout))
+	s.Enable(imapbackend.NewIdleExtension())
+	s.Enable(imapbackend.NewCondStoreExtension())
+	s.Enable(imapbackend.NewUIDPlusExtension())
+	s.Enable(imapbackend.NewListExtension())
+	s.Enable(imapbackend.NewNotifyExtension())
+	s.Enable(imapbackend.NewBinaryExtension())
+	s.Enable(imapbackend.NewQuotaExtension())
+	s.Enable(imapbackend.NewCompressExtension())
+	s.Enable(imapbackend.NewMetadataExtension())
+	s.Enable(imapbackend.NewSortExtension())
+	s.Enable(imapbackend.NewLanguageExtension())
+	if threads {
+		s.Enable(imapbackend.NewThreadExtension())
+	}
+	return s
+}
+
+// davHandler is the handler of a user's session. done is closed when the
+// session is replaced.
+type davHandler struct {
+	c    *protonmail.Client
+	h    http.Handler
+	done chan struct{}
+}
+
+// newDAVServer returns an HTTP server authenticating users with their bridge
+// password. newHandler is called the first time a user is authenticated, and
+// each time the session is replaced, e.g. after the bridge password has been
+// changed.
+func newDAVServer(sessions *auth.Manager, tlsConfig *tls.Config, addr string, limits *connLimits, newHandler func(username string, c *protonmail.Client, privateKeys openpgp.EntityList, done <-chan struct{}) http.Handler) *http.Server {
+	var locker sync.Mutex
+	handlers := make(map[string]*davHandler)
+
+	return &http.Server{
+		Addr:      addr,
+		TLSConfig: tlsConfig,
+		// Also bounds the TLS handshake
+		ReadHeaderTimeout: limits.handshakeTimeout,
+		IdleTimeout:       limits.davTimeout,
+		Handler: http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			resp.Header().Set("WWW-Authenticate", "Basic")
+
+			username, password, ok := req.BasicAuth()
+			if !ok {
+				resp.WriteHeader(http.StatusUnauthorized)
+				io.WriteString(resp, "Credentials are required")
+				return
+			}
+
+			c, privateKeys, err := sessions.Auth(username, password)
+			if err != nil {
+				if err == auth.ErrUnauthorized {
+					resp.WriteHeader(http.StatusUnauthorized)
+				} else {
+					resp.WriteHeader(http.StatusInternalServerError)
+				}
+				io.WriteString(resp, err.Error())
+				return
+			}
+
+			locker.Lock()
+			h, ok := handlers[username]
+			if !ok || h.c != c {
+				if ok {
+					close(h.done)
+				}
+				done := make(chan struct{})
+				h = &davHandler{
+					c:    c,
+					h:    newHandler(username, c, privateKeys, done),
+					done: done,
+				}
+				handlers[username] = h
+			}
+			locker.Unlock()
+
+			h.h.ServeHTTP(resp, req)
+		}),
+	}
+}
+
+func newCardDAVServer(sessions *auth.Manager, eventsManager *events.Manager, tlsConfig *tls.Config, addr string, limits *connLimits) *http.Server {
+	return newDAVServer(sessions, tlsConfig, addr, limits, func(username string, c *protonmail.Client, privateKeys openpgp.EntityList, done <-chan struct{}) http.Handler {
+		ch := make(chan *protonmail.Event)
+		eventsManager.Register(c, username, ch, done)
+		return carddav.NewHandler(c, privateKeys, ch)
+	})
+}
+
+func newCalDAVServer(sessions *auth.Manager, tlsConfig *tls.Config, addr string, limits *connLimits) *http.Server {
+	return newDAVServer(sessions, tlsConfig, addr, limits, func(username string, c *protonmail.Client, privateKeys openpgp.EntityList, done <-chan struct{}) http.Handler {
+		return caldav.NewHandler(c, privateKeys)
+	})
+}
+
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	log.Println("Serving metrics at", addr)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
+
+func serveDAV(s *http.Server, l net.Listener) error {
+	if s.TLSConfig != nil {
+		return s.ServeTLS(l, "", "")
+	}
+	return s.Serve(l)
+}
+
 func main() {
+	totpSecret := flag.String("totp-secret", "", "TOTP secret used to generate two-factor codes (base32)")
+	authVerbose := flag.Bool("verbose", false, "Print each step of auth as it succeeds")
+	authDryRun := flag.Bool("dry-run", false, "Log in and unlock the keys with auth, but don't save the credentials")
+	smtpPlaintext := flag.String("smtp-plaintext", "", "Comma-separated list of addresses to which messages are never sent encrypted")
+	smtpSendDelay := flag.Duration("send-delay", 0, "Delay before sending messages, during which sending can be cancelled by deleting the draft")
+	smtpAutocrypt := flag.String("smtp-autocrypt", "", "Add an Autocrypt header to messages sent in plaintext, with this prefer-encrypt value (mutual or nopreference)")
+	smtpGenerateKeys := flag.Bool("smtp-generate-keys", false, "Generate a key for sender addresses which don't have one, e.g. new aliases")
+	exportFormat := flag.String("format", string(exports.FormatMaildir), "Format used to export messages (maildir or mbox)")
+	exportSince := flag.String("since", "", "Only export messages received after this date (YYYY-MM-DD)")
+	importLabel := flag.String("label", "", "Label messages are imported to (defaults to Inbox)")
+	importMapping := flag.String("label-mapping", "", "File mapping source folders to labels, one \"folder = label\" per line")
+	tlsCert := flag.String("tls-cert", "", "Path to the PEM-encoded TLS certificate")
+	tlsKey := flag.String("tls-key", "", "Path to the PEM-encoded TLS private key")
+	secretStoreName := flag.String("secret-store", "", "Save the master password key in this secret store, so that it isn't asked again on restart (secret-service)")
+	passphraseFD := flag.Int("passphrase-fd", -1, "Read the master password, and the new password with reauth, from this file descriptor instead of prompting for them")
+	logLevel := flag.String("log-level", "info", "Minimum level of logged messages (debug, info, warn or error)")
+	logJSON := flag.Bool("log-json", false, "Log messages in the JSON format")
+	metricsAddr := flag.String("metrics-addr", "", "Serve Prometheus metrics on this address, e.g. 127.0.0.1:9090")
+	healthAddr := flag.String("health-addr", "", "Serve health checks (/healthz and /readyz) on this address")
+	imapThreads := flag.Bool("imap-threads", false, "Group messages by conversation in IMAP THREAD responses")
+	imapMatchDrafts := flag.Bool("imap-match-drafts", false, "Replace the draft with the same subject and recipients when a draft without a known Message-Id is saved over IMAP")
+	imapExpungeDelete := flag.Bool("imap-expunge-delete", false, "Permanently delete messages expunged over IMAP instead of moving them to the trash")
+	configDir := flag.String("config-dir", "", "Directory of the credentials and state files (defaults to $XDG_CONFIG_HOME/hydroxide)")
+	cacheDir := flag.String("cache-dir", "", "Directory of the IMAP message cache (defaults to the cache subdirectory of -config-dir if set, or to the user cache directory)")
+	cacheSize := flag.Int("cache-size", 0, "Maximum size of the IMAP message cache, in MiB (0 disables the cache)")
+	smtpAddr := flag.String("smtp-addr", "", "SMTP listening address, host:port or unix:/path/to.sock (defaults to 127.0.0.1:1025)")
+	imapAddr := flag.String("imap-addr", "", "IMAP listening address, host:port or unix:/path/to.sock (defaults to 127.0.0.1:1143)")
+	caldavAddr := flag.String("caldav-addr", "", "CalDAV listening address, host:port or unix:/path/to.sock (defaults to 127.0.0.1:8082)")
+	carddavAddr := flag.String("carddav-addr", "", "CardDAV listening address, host:port or unix:/path/to.sock (defaults to 127.0.0.1:8080)")
+	maxConns := flag.Int("max-connections", 100, "Maximum number of simultaneous connections to each server (0 for no limit)")
+	smtpTimeout := flag.Duration("smtp-timeout", 5*time.Minute, "Close SMTP connections idle for this duration (0 to disable)")
+	imapTimeout := flag.Duration("imap-timeout", 30*time.Minute, "Log out IMAP clients idle for this duration (0 to disable)")
+	imapIdleTimeout := flag.Duration("imap-idle-timeout", time.Hour, "Log out IMAP clients in IDLE for this duration (0 to disable)")
+	davTimeout := flag.Duration("dav-timeout", 2*time.Minute, "Close idle CardDAV and CalDAV keep-alive connections after this duration (0 to disable)")
+	tlsHandshakeTimeout := flag.Duration("tls-handshake-timeout", 10*time.Second, "Maximum duration of TLS handshakes, and of reading CardDAV and CalDAV request headers (0 to disable)")
+	onNewMail := flag.String("on-new-mail", "", "Webhook URL receiving a JSON POST request when new messages are received")
+	onNewMailExec := flag.String("on-new-mail-exec", "", "Shell command run with a JSON payload on its standard input when new messages are received")
+	onNewMailDetails := flag.Bool("on-new-mail-details", false, "Include the subject and sender of new messages in -on-new-mail payloads")
+	pollMinInterval := flag.Duration("poll-min-interval", events.DefaultMinPollInterval, "Interval between two polls of ProtonMail events after activity or while IMAP clients are idling")
+	pollMaxInterval := flag.Duration("poll-max-interval", events.DefaultMaxPollInterval, "Maximum interval between two polls of ProtonMail events while nothing happens")
+	fallbackCharset := flag.String("fallback-charset", charset.DefaultFallback, "Charset of incoming text with a missing or unknown charset (empty to disable)")
+	jsonOutput := flag.Bool("json", false, "Print account-info output in the JSON format")
+	apiEndpoint := flag.String("api-endpoint", defaultAPIEndpoint, "ProtonMail API endpoint")
+	proxy := flag.String("proxy", "", "Proxy used to reach the ProtonMail API, e.g. socks5://127.0.0.1:9050 (defaults to the HTTP_PROXY and HTTPS_PROXY environment variables)")
+	requireStartTLS := flag.Bool("require-starttls", false, "Reject SMTP and IMAP commands other than STARTTLS before TLS is negotiated (requires -tls-cert)")
+	startTLSExemptLoopback := flag.Bool("starttls-exempt-loopback", false, "Exempt local clients from -require-starttls and allow them to authenticate without TLS")
+	insecureSkipVerify := flag.Bool("insecure-skip-verify", false, "Don't verify the TLS certificate of the ProtonMail API (insecure, for testing only)")
+	apiRate := flag.Float64("api-rate", 0, "Maximum average number of ProtonMail API requests per second and per account, requests over the limit are delayed (0 disables the limit)")
+	apiBurst := flag.Int("api-burst", 10, "Maximum number of ProtonMail API requests sent in a burst when -api-rate is set")
+	modulusKeyPath := flag.String("modulus-key", "", "Path to the armored public key verifying SRP moduli, for testing against another API endpoint (defaults to ProtonMail's key)")
 	flag.Parse()
 
+	if err := setupLogger(*logLevel, *logJSON); err != nil {
+		log.Fatal(err)
+	}
+
+	config.SetDir(*configDir)
+	if *configDir != "" && *cacheDir == "" {
+		*cacheDir = filepath.Join(*configDir, "cache")
+	}
+
+	if err := charset.SetFallback(*fallbackCharset); err != nil {
+		log.Fatal(err)
+	}
+
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr)
+	}
+
+	httpClient, err := newHTTPClient(*proxy, *insecureSkipVerify)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var modulusKey string
+	if *modulusKeyPath != "" {
+		b, err := ioutil.ReadFile(*modulusKeyPath)
+		if err != nil {
+			log.Fatal("cannot read modulus key:", err)
+		}
+		modulusKey = string(b)
+	}
+	newClient := newClientFactory(*apiEndpoint, modulusKey, httpClient, *apiRate, *apiBurst)
+
+	var mailHook *events.MailHook
+	if *onNewMail != "" || *onNewMailExec != "" {
+		mailHook = &events.MailHook{
+			URL:     *onNewMail,
+			Command: *onNewMailExec,
+			Details: *onNewMailDetails,
+		}
+	}
+
+	tlsConfig, err := newTLSConfig(*tlsCert, *tlsKey)
+	if err != nil {
+		log.Fatal("cannot load TLS certificate:", err)
+	}
+
+	var tlsPolicy *starttlsPolicy
+	if *requireStartTLS {
+		if tlsConfig == nil {
+			log.Fatal("-require-starttls requires -tls-cert and -tls-key")
+		}
+		tlsPolicy = &starttlsPolicy{exemptLoopback: *startTLSExemptLoopback}
+	} else if *startTLSExemptLoopback {
+		log.Fatal("-starttls-exempt-loopback requires -require-starttls")
+	}
+
+	limits := &connLimits{
+		maxConns:         *maxConns,
+		smtpTimeout:      *smtpTimeout,
+		imapTimeout:      *imapTimeout,
+		imapIdleTimeout:  *imapIdleTimeout,
+		davTimeout:       *davTimeout,
+		handshakeTimeout: *tlsHandshakeTimeout,
+	}
+
+	var secretStore auth.SecretStore
+	if *secretStoreName != "" {
+		secretStore, err = auth.NewSecretStore(*secretStoreName)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if encrypted, err := auth.IsEncrypted(); err != nil {
+		log.Fatal(err)
+	} else if encrypted && flag.Arg(0) != "" {
+		unlocked := false
+		if secretStore != nil {
+			if err := auth.UnlockWithStore(secretStore); err == nil {
+				unlocked = true
+			} else if err != auth.ErrSecretNotFound {
+				log.Println("Cannot unlock credentials with the secret store:", err)
+			}
+		}
+
+		if !unlocked {
+			pass, err := readPassphrase(*passphraseFD, "Master password")
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := auth.Unlock(pass); err != nil {
+				log.Fatal(err)
+			}
+			if secretStore != nil {
+				if err := auth.SaveMasterKey(secretStore); err != nil {
+					log.Println("Cannot save master password key:", err)
+				}
+			}
+		}
+	}
+
+	switch *smtpAutocrypt {
+	case "", smtpbackend.AutocryptMutual, smtpbackend.AutocryptNoPreference:
+	default:
+		log.Fatalf("invalid -smtp-autocrypt value %q, must be mutual or nopreference", *smtpAutocrypt)
+	}
+
+	var plaintextRecipients []string
+	if *smtpPlaintext != "" {
+		for _, addr := range strings.Split(*smtpPlaintext, ",") {
+			plaintextRecipients = append(plaintextRecipients, strings.TrimSpace(addr))
+		}
+	}
+
 	switch flag.Arg(0) {
 	case "auth":
 		username := flag.Arg(1)
 
 		c := newClient()
+		if *authVerbose {
+			c.AuthStage = func(stage string) {
+				fmt.Fprintln(os.Stderr, stage)
+			}
+		}
 
 		var a *protonmail.Auth
 		/*if cachedAuth, ok := auths[username]; ok {
@@ -84,43 +469,99 @@ func main() {
 
 			authInfo, err := c.AuthInfo(username)
 			if err != nil {
-				log.Fatal(err)
+				log.Fatalf("login failed: cannot fetch auth info: %v", err)
 			}
 
 			var twoFactorCode string
-			if authInfo.TwoFactor == 1 {
+			if authInfo.TwoFactor&protonmail.TwoFactorTOTP != 0 {
 				scanner := bufio.NewScanner(os.Stdin)
-				fmt.Printf("2FA code: ")
+				if *totpSecret != "" {
+					fmt.Printf("2FA code (leave empty to use the TOTP secret): ")
+				} else {
+					fmt.Printf("2FA code: ")
+				}
 				scanner.Scan()
 				twoFactorCode = scanner.Text()
 			}
 
-			a, err = c.Auth(username, loginPassword, twoFactorCode, authInfo)
+			for {
+				if authInfo.TwoFactor&protonmail.TwoFactorTOTP != 0 && twoFactorCode == "" && *totpSecret != "" {
+					a, err = c.AuthTOTP(username, loginPassword, *totpSecret, authInfo)
+				} else {
+					a, err = c.Auth(username, loginPassword, twoFactorCode, authInfo)
+				}
+
+				var hvErr *protonmail.HumanVerificationError
+				if !errors.As(err, &hvErr) || c.HumanVerification != nil {
+					break
+				}
+				if err := completeHumanVerification(c, hvErr); err != nil {
+					log.Fatalf("login failed: %v", err)
+				}
+				// Each SRP session can only be used once
+				if authInfo, err = c.AuthInfo(username); err != nil {
+					log.Fatalf("login failed: cannot fetch auth info: %v", err)
+				}
+			}
+			if err != nil {
+				log.Fatalf("login failed: %v", err)
+			}
+		}
+
+		if a.U2F != nil {
+			// Only a security key is enrolled, let an external signer handle
+			// it. The second factor is needed before the keys can be fetched.
+			challenge, err := json.Marshal(a.U2F)
 			if err != nil {
 				log.Fatal(err)
 			}
+			fmt.Printf("U2F challenge: %s\n", challenge)
+
+			scanner := bufio.NewScanner(os.Stdin)
+			fmt.Printf("U2F assertion: ")
+			if !scanner.Scan() {
+				if err := scanner.Err(); err != nil {
+					log.Fatalf("cannot read U2F assertion: %v", err)
+				}
+				log.Fatal("cannot read U2F assertion: unexpected end of input")
+			}
+			if err := c.AuthU2F(a.UID, scanner.Bytes()); err != nil {
+				log.Fatal(err)
+			}
+			a.U2F = nil
 		}
 
+		// Check the mailbox password before saving it, so that servers don't
+		// fail to unlock the keys later on
 		var mailboxPassword string
-		if a.PasswordMode == protonmail.PasswordSingle {
-			mailboxPassword = loginPassword
-		}
-		if mailboxPassword == "" {
+		for attempts := 3; ; attempts-- {
 			if a.PasswordMode == protonmail.PasswordTwo {
 				fmt.Printf("Mailbox password: ")
-			} else {
-				fmt.Printf("Password: ")
+				if pass, err := gopass.GetPasswd(); err != nil {
+					log.Fatal(err)
+				} else {
+					mailboxPassword = string(pass)
+				}
 			}
-			if pass, err := gopass.GetPasswd(); err != nil {
-				log.Fatal(err)
-			} else {
-				mailboxPassword = string(pass)
+
+			_, err := c.UnlockWithMailboxPassword(a, []byte(loginPassword), []byte(mailboxPassword))
+			if err == protonmail.ErrInvalidMailboxPassword && attempts > 1 {
+				fmt.Println("Wrong mailbox password, please try again")
+				continue
+			} else if err == protonmail.ErrInvalidMailboxPassword {
+				log.Fatal("wrong mailbox password")
+			} else if err != nil {
+				log.Fatalf("cannot unlock keys: %v", err)
 			}
+			break
 		}
 
-		_, err := c.Unlock(a, mailboxPassword)
-		if err != nil {
-			log.Fatal(err)
+		if *authDryRun {
+			if err := c.Logout(); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println("Login succeeded, credentials not saved (dry run)")
+			break
 		}
 
 		secretKey, bridgePassword, err := auth.GeneratePassword()
@@ -129,15 +570,126 @@ func main() {
 		}
 
 		err = auth.EncryptAndSave(&auth.CachedAuth{
-			*a,
-			loginPassword,
-			mailboxPassword,
+			Auth:            *a,
+			LoginPassword:   loginPassword,
+			MailboxPassword: mailboxPassword,
+			TOTPSecret:      *totpSecret,
 		}, username, secretKey)
 		if err != nil {
 			log.Fatal(err)
 		}
+		// App passwords unlock the previous bridge password
+		if err := auth.RevokeAppPasswords(username); err != nil {
+			log.Fatal(err)
+		}
 
 		fmt.Println("Bridge password:", bridgePassword)
+	case "reauth":
+		username := flag.Arg(1)
+		if username == "" {
+			log.Fatal("usage: hydroxide reauth <username>")
+		}
+
+		fmt.Printf("Bridge password: ")
+		bridgePassword, err := gopass.GetPasswd()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = auth.Reauth(newClient(), username, string(bridgePassword), func(mode protonmail.PasswordMode, retry bool) (string, error) {
+			if retry {
+				fmt.Println("Wrong password, please try again")
+			}
+			prompt := "New password"
+			if mode == protonmail.PasswordTwo {
+				prompt = "New mailbox password"
+			}
+			pass, err := readPassphrase(*passphraseFD, prompt)
+			return string(pass), err
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Println("Keys unlocked with the new password")
+	case "encrypt-auth":
+		pass, err := readNewPassphrase(*passphraseFD, "New master password")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := auth.EncryptWithMasterPassword(pass); err != nil {
+			log.Fatal(err)
+		}
+		if secretStore != nil {
+			if err := auth.SaveMasterKey(secretStore); err != nil {
+				log.Fatal(err)
+			}
+		}
+		fmt.Println("Credentials encrypted with the master password")
+	case "change-bridge-password":
+		username := flag.Arg(1)
+		if username == "" {
+			log.Fatal("usage: hydroxide change-bridge-password <username>")
+		}
+
+		fmt.Printf("Current bridge password: ")
+		pass, err := gopass.GetPasswd()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		bridgePassword, err := auth.ChangeBridgePassword(username, string(pass))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Println("New bridge password:", bridgePassword)
+	case "add-app-password":
+		username := flag.Arg(1)
+		name := flag.Arg(2)
+		if username == "" || name == "" {
+			log.Fatal("usage: hydroxide add-app-password <username> <name>")
+		}
+
+		fmt.Printf("Bridge password: ")
+		pass, err := gopass.GetPasswd()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		appPassword, err := auth.AddAppPassword(username, string(pass), name)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Println("App password:", appPassword)
+	case "list-app-passwords":
+		username := flag.Arg(1)
+		if username == "" {
+			log.Fatal("usage: hydroxide list-app-passwords <username>")
+		}
+
+		l, err := auth.ListAppPasswords(username)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if len(l) == 0 {
+			fmt.Printf("No app password.\n")
+		}
+		for _, appPassword := range l {
+			fmt.Printf("- %v (created %v)\n", appPassword.Name, appPassword.Created.Format("2006-01-02"))
+		}
+	case "revoke-app-password":
+		username := flag.Arg(1)
+		name := flag.Arg(2)
+		if username == "" || name == "" {
+			log.Fatal("usage: hydroxide revoke-app-password <username> <name>")
+		}
+
+		if err := auth.RevokeAppPassword(username, name); err != nil {
+			log.Fatal(err)
+		}
 	case "status":
 		usernames, err := auth.ListUsernames()
 		if err != nil {
@@ -152,93 +704,361 @@ func main() {
 				fmt.Printf("- %v\n", u)
 			}
 		}
-	case "smtp":
-		port := os.Getenv("PORT")
-		if port == "" {
-			port = "1025"
+	case "account-info":
+		username := flag.Arg(1)
+		if username == "" {
+			log.Fatal("usage: hydroxide account-info <username>")
 		}
 
-		sessions := auth.NewManager(newClient)
+		var bridgePassword string
+		fmt.Fprintf(os.Stderr, "Bridge password: ")
+		if pass, err := gopass.GetPasswd(); err != nil {
+			log.Fatal(err)
+		} else {
+			bridgePassword = string(pass)
+		}
 
-		be := smtpbackend.New(sessions)
-		s := smtp.NewServer(be)
-		s.Addr = "127.0.0.1:" + port
-		s.Domain = "localhost"     // TODO: make this configurable
-		s.AllowInsecureAuth = true // TODO: remove this
-		//s.Debug = os.Stdout
+		c, _, err := auth.NewManager(newClient).Auth(username, bridgePassword)
+		if err != nil {
+			log.Fatal(err)
+		}
 
-		log.Println("Starting SMTP server at", s.Addr)
-		log.Fatal(s.ListenAndServe())
-	case "imap":
-		port := os.Getenv("PORT")
-		if port == "" {
-			port = "1143"
+		info, err := getAccountInfo(c)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := writeAccountInfo(os.Stdout, info, *jsonOutput); err != nil {
+			log.Fatal(err)
+		}
+	case "set-poll-intervals":
+		username := flag.Arg(1)
+		if username == "" || flag.Arg(2) == "" || flag.Arg(3) == "" {
+			log.Fatal("usage: hydroxide set-poll-intervals <username> <min> <max>")
+		}
+
+		min, err := time.ParseDuration(flag.Arg(2))
+		if err != nil {
+			log.Fatal("invalid minimum interval: ", err)
+		}
+		max, err := time.ParseDuration(flag.Arg(3))
+		if err != nil {
+			log.Fatal("invalid maximum interval: ", err)
+		}
+		if err := events.SetPollIntervals(username, min, max); err != nil {
+			log.Fatal(err)
+		}
+	case "pin-key":
+		addr := flag.Arg(1)
+		fingerprint := flag.Arg(2)
+		if addr == "" || fingerprint == "" {
+			log.Fatal("usage: hydroxide pin-key <address> <fingerprint>")
+		}
+		if err := smtpbackend.PinKey(addr, fingerprint); err != nil {
+			log.Fatal(err)
+		}
+	case "unpin-key":
+		addr := flag.Arg(1)
+		if addr == "" {
+			log.Fatal("usage: hydroxide unpin-key <address>")
 		}
+		if err := smtpbackend.UnpinKey(addr); err != nil {
+			log.Fatal(err)
+		}
+	case "smtp":
+		sessions := auth.NewManager(newClient)
+		go serveHealth(*healthAddr, sessions)
+		be := smtpbackend.New(sessions, plaintextRecipients, *smtpGenerateKeys, *smtpSendDelay, *smtpAutocrypt)
+		s := newSMTPServer(be, tlsConfig, tlsPolicy, listenAddr(*smtpAddr, portFromEnv("1025")), limits)
 
+		activated, err := systemdListeners()
+		if err != nil {
+			log.Fatal(err)
+		}
+		l, err := listen(activated, "smtp", s.Addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Starting SMTP server at", l.Addr())
+		log.Fatal(s.Serve(tlsPolicy.listener(limits.listener(l, smtpTooManyConns), smtpStartTLS)))
+	case "imap":
 		sessions := auth.NewManager(newClient)
-		eventsManager := events.NewManager()
-
-		be := imapbackend.New(sessions, eventsManager)
-		s := imapserver.New(be)
-		s.Addr = "127.0.0.1:" + port
-		s.AllowInsecureAuth = true // TODO: remove this
-		//s.Debug = os.Stdout
-		s.Enable(imapspacialuse.NewExtension())
-		s.Enable(imapmove.NewExtension())
-
-		log.Println("Starting IMAP server at", s.Addr)
-		log.Fatal(s.ListenAndServe())
+		go serveHealth(*healthAddr, sessions)
+		eventsManager := newEventsManager(*pollMinInterval, *pollMaxInterval, mailHook)
+		go handleResyncSignal(eventsManager)
+		messageCache, err := openMessageCache(*cacheDir, *cacheSize)
+		if err != nil {
+			log.Fatal("cannot open message cache:", err)
+		}
+		s := newIMAPServer(sessions, eventsManager, tlsConfig, tlsPolicy, listenAddr(*imapAddr, portFromEnv("1143")), *imapThreads, messageCache, *imapExpungeDelete, *imapMatchDrafts, limits)
+
+		activated, err := systemdListeners()
+		if err != nil {
+			log.Fatal(err)
+		}
+		l, err := listen(activated, "imap", s.Addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Starting IMAP server at", l.Addr())
+		log.Fatal(s.Serve(tlsPolicy.listener(limits.listener(l, imapTooManyConns), imapStartTLS)))
 	case "carddav":
-		port := os.Getenv("PORT")
-		if port == "" {
-			port = "8080"
+		sessions := auth.NewManager(newClient)
+		go serveHealth(*healthAddr, sessions)
+		eventsManager := newEventsManager(*pollMinInterval, *pollMaxInterval, mailHook)
+		go handleResyncSignal(eventsManager)
+		s := newCardDAVServer(sessions, eventsManager, tlsConfig, listenAddr(*carddavAddr, portFromEnv("8080")), limits)
+
+		activated, err := systemdListeners()
+		if err != nil {
+			log.Fatal(err)
+		}
+		l, err := listen(activated, "carddav", s.Addr)
+		if err != nil {
+			log.Fatal(err)
 		}
+		log.Println("Starting CardDAV server at", l.Addr())
+		log.Fatal(serveDAV(s, limits.davListener(l, tlsConfig)))
+	case "caldav":
+		sessions := auth.NewManager(newClient)
+		go serveHealth(*healthAddr, sessions)
+		s := newCalDAVServer(sessions, tlsConfig, listenAddr(*caldavAddr, portFromEnv("8082")), limits)
 
+		activated, err := systemdListeners()
+		if err != nil {
+			log.Fatal(err)
+		}
+		l, err := listen(activated, "caldav", s.Addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Starting CalDAV server at", l.Addr())
+		log.Fatal(serveDAV(s, limits.davListener(l, tlsConfig)))
+	case "serve":
+		// All accounts share the same sessions and event receivers
 		sessions := auth.NewManager(newClient)
-		eventsManager := events.NewManager()
-		handlers := make(map[string]http.Handler)
+		go serveHealth(*healthAddr, sessions)
+		eventsManager := newEventsManager(*pollMinInterval, *pollMaxInterval, mailHook)
+		go handleResyncSignal(eventsManager)
 
-		s := &http.Server{
-			Addr: "127.0.0.1:" + port,
-			Handler: http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
-				resp.Header().Set("WWW-Authenticate", "Basic")
+		done := make(chan error, 3)
 
-				username, password, ok := req.BasicAuth()
-				if !ok {
-					resp.WriteHeader(http.StatusUnauthorized)
-					io.WriteString(resp, "Credentials are required")
-					return
-				}
+		activated, err := systemdListeners()
+		if err != nil {
+			log.Fatal(err)
+		}
 
-				c, privateKeys, err := sessions.Auth(username, password)
-				if err != nil {
-					if err == auth.ErrUnauthorized {
-						resp.WriteHeader(http.StatusUnauthorized)
-					} else {
-						resp.WriteHeader(http.StatusInternalServerError)
-					}
-					io.WriteString(resp, err.Error())
-					return
-				}
+		smtpBackend := smtpbackend.New(sessions, plaintextRecipients, *smtpGenerateKeys, *smtpSendDelay, *smtpAutocrypt)
+		smtpServer := newSMTPServer(smtpBackend, tlsConfig, tlsPolicy, listenAddr(*smtpAddr, "1025"), limits)
+		l, err := listen(activated, "smtp", smtpServer.Addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		smtpListener := newStoppableListener(tlsPolicy.listener(limits.listener(l, smtpTooManyConns), smtpStartTLS))
+		log.Println("Starting SMTP server at", l.Addr())
+		go func() {
+			done <- smtpServer.Serve(smtpListener)
+		}()
 
-				h, ok := handlers[username]
-				if !ok {
-					ch := make(chan *protonmail.Event)
-					eventsManager.Register(c, username, ch, nil)
-					h = carddav.NewHandler(c, privateKeys, ch)
+		messageCache, err := openMessageCache(*cacheDir, *cacheSize)
+		if err != nil {
+			log.Fatal("cannot open message cache:", err)
+		}
+		imapServer := newIMAPServer(sessions, eventsManager, tlsConfig, tlsPolicy, listenAddr(*imapAddr, "1143"), *imapThreads, messageCache, *imapExpungeDelete, *imapMatchDrafts, limits)
+		imapListener, err := listen(activated, "imap", imapServer.Addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Starting IMAP server at", imapListener.Addr())
+		go func() {
+			done <- imapServer.Serve(tlsPolicy.listener(limits.listener(imapListener, imapTooManyConns), imapStartTLS))
+		}()
 
-					handlers[username] = h
-				}
+		carddavServer := newCardDAVServer(sessions, eventsManager, tlsConfig, listenAddr(*carddavAddr, "8080"), limits)
+		carddavListener, err := listen(activated, "carddav", carddavServer.Addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Starting CardDAV server at", carddavListener.Addr())
+		go func() {
+			done <- serveDAV(carddavServer, limits.davListener(carddavListener, tlsConfig))
+		}()
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		select {
+		case err := <-done:
+			log.Fatal(err)
+		case sig := <-sigs:
+			log.Printf("Received %v, shutting down", sig)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		shutdown(ctx, &servers{
+			smtp:         smtpServer,
+			smtpListener: smtpListener,
+			smtpBackend:  smtpBackend,
+			imap:         imapServer,
+			imapListener: imapListener,
+			carddav:      carddavServer,
+		})
+		sessions.Close()
+		auth.Lock()
+	case "export-messages":
+		username := flag.Arg(1)
+		dir := flag.Arg(2)
+		if username == "" || dir == "" {
+			log.Fatal("usage: hydroxide export-messages <username> <directory>")
+		}
+
+		options := &exports.ExportOptions{Format: exports.Format(*exportFormat)}
+		if *exportSince != "" {
+			since, err := time.Parse("2006-01-02", *exportSince)
+			if err != nil {
+				log.Fatal("invalid -since date:", err)
+			}
+			options.Since = since
+		}
+
+		var bridgePassword string
+		fmt.Printf("Bridge password: ")
+		if pass, err := gopass.GetPasswd(); err != nil {
+			log.Fatal(err)
+		} else {
+			bridgePassword = string(pass)
+		}
+
+		c, privateKeys, err := auth.NewManager(newClient).Auth(username, bridgePassword)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := exports.ExportMessages(c, privateKeys, dir, options); err != nil {
+			log.Fatal(err)
+		}
+	case "import-messages":
+		username := flag.Arg(1)
+		path := flag.Arg(2)
+		if username == "" || path == "" {
+			log.Fatal("usage: hydroxide import-messages <username> <maildir or mbox>")
+		}
+
+		options := &imports.ImportOptions{Label: *importLabel}
+		if *importMapping != "" {
+			f, err := os.Open(*importMapping)
+			if err != nil {
+				log.Fatal(err)
+			}
+			options.Mapping, err = imports.ReadMapping(f)
+			f.Close()
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		var bridgePassword string
+		fmt.Printf("Bridge password: ")
+		if pass, err := gopass.GetPasswd(); err != nil {
+			log.Fatal(err)
+		} else {
+			bridgePassword = string(pass)
+		}
 
-				h.ServeHTTP(resp, req)
-			}),
+		c, privateKeys, err := auth.NewManager(newClient).Auth(username, bridgePassword)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		imported, skipped, err := imports.ImportMessages(c, privateKeys, path, options)
+		log.Printf("%v messages imported, %v skipped", imported, skipped)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "export-filters":
+		username := flag.Arg(1)
+		path := flag.Arg(2)
+		if username == "" || path == "" {
+			log.Fatal("usage: hydroxide export-filters <username> <file>")
+		}
+
+		var bridgePassword string
+		fmt.Printf("Bridge password: ")
+		if pass, err := gopass.GetPasswd(); err != nil {
+			log.Fatal(err)
+		} else {
+			bridgePassword = string(pass)
+		}
+
+		c, _, err := auth.NewManager(newClient).Auth(username, bridgePassword)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		f, err := os.Create(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := exports.ExportFilters(c, f); err != nil {
+			f.Close()
+			log.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatal(err)
+		}
+	case "import-filters":
+		username := flag.Arg(1)
+		path := flag.Arg(2)
+		if username == "" || path == "" {
+			log.Fatal("usage: hydroxide import-filters <username> <file>")
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		filters, err := imports.ReadFilters(f)
+		f.Close()
+		if err != nil {
+			log.Fatal(err)
 		}
 
-		log.Println("Starting CardDAV server at", s.Addr)
-		log.Fatal(s.ListenAndServe())
+		var bridgePassword string
+		fmt.Printf("Bridge password: ")
+		if pass, err := gopass.GetPasswd(); err != nil {
+			log.Fatal(err)
+		} else {
+			bridgePassword = string(pass)
+		}
+
+		c, _, err := auth.NewManager(newClient).Auth(username, bridgePassword)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		created, updated, err := imports.ImportFilters(c, filters)
+		log.Printf("%v filters created, %v updated", created, updated)
+		if err != nil {
+			log.Fatal(err)
+		}
 	default:
+		log.Fatal("usage: hydroxide serve")
+		log.Fatal("usage: hydroxide encrypt-auth")
+		log.Fatal("usage: hydroxide change-bridge-password <username>")
+		log.Fatal("usage: hydroxide add-app-password <username> <name>")
+		log.Fatal("usage: hydroxide list-app-passwords <username>")
+		log.Fatal("usage: hydroxide revoke-app-password <username> <name>")
+		log.Fatal("usage: hydroxide account-info <username>")
+		log.Fatal("usage: hydroxide set-poll-intervals <username> <min> <max>")
+		log.Fatal("usage: hydroxide import-messages <username> <maildir or mbox>")
+		log.Fatal("usage: hydroxide export-messages <username> <directory>")
+		log.Fatal("usage: hydroxide import-filters <username> <file>")
+		log.Fatal("usage: hydroxide export-filters <username> <file>")
 		log.Fatal("usage: hydroxide carddav")
+		log.Fatal("usage: hydroxide caldav")
 		log.Fatal("usage: hydroxide smtp")
+		log.Fatal("usage: hydroxide pin-key <address> <fingerprint>")
+		log.Fatal("usage: hydroxide unpin-key <address>")
 		log.Fatal("usage: hydroxide auth <username>")
+		log.Fatal("usage: hydroxide reauth <username>")
 	}
 }
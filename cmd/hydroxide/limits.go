@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Replies sent to clients rejected because too many connections are open.
+const (
+	smtpTooManyConns = "421 4.7.0 Too many connections, try again later\r\n"
+	imapTooManyConns = "* BYE Too many connections, try again later\r\n"
+	httpTooManyConns = "HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"
+)
+
+// rejectWriteTimeout bounds the time spent sending the reply to rejected
+// clients. It's short because connections are accepted one at a time: the
+// reply usually fits in the socket buffer, and is dropped otherwise.
+const rejectWriteTimeout = 100 * time.Millisecond
+
+// limitListener wraps l so that at most max connections are open at the same
+// time. Connections exceeding the limit are sent reject, if not empty, and
+// closed. If max is zero, l is returned unchanged.
+func limitListener(l net.Listener, max int, reject string) net.Listener {
+	if max <= 0 {
+		return l
+	}
+	return &connLimitListener{Listener: l, sem: make(chan struct{}, max), reject: reject}
+}
+
+type connLimitListener struct {
+	net.Listener
+	sem    chan struct{}
+	reject string
+}
+
+func (l *connLimitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case l.sem <- struct{}{}:
+			return &limitedConn{Conn: c, release: func() { <-l.sem }}, nil
+		default:
+		}
+
+		log.Printf("Rejecting connection from %v: too many connections", c.RemoteAddr())
+		if l.reject != "" {
+			c.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+			io.WriteString(c, l.reject)
+		}
+		c.Close()
+	}
+}
+
+// limitedConn releases its slot in the listener when closed.
+type limitedConn struct {
+	net.Conn
+	release   func()
+	closeOnce sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.closeOnce.Do(c.release)
+	return c.Conn.Close()
+}
+
+// connLimits bounds the resources used by the clients of the servers.
+type connLimits struct {
+	maxConns         int
+	smtpTimeout      time.Duration
+	imapTimeout      time.Duration
+	imapIdleTimeout  time.Duration
+	davTimeout       time.Duration
+	handshakeTimeout time.Duration
+}
+
+func (lim *connLimits) listener(l net.Listener, reject string) net.Listener {
+	return limitListener(l, lim.maxConns, reject)
+}
+
+// davListener is like listener, for DAV servers. Rejected clients aren't sent
+// any reply when TLS is enabled, since the handshake hasn't been performed.
+func (lim *connLimits) davListener(l net.Listener, tlsConfig *tls.Config) net.Listener {
+	reject := httpTooManyConns
+	if tlsConfig != nil {
+		reject = ""
+	}
+	return lim.listener(l, reject)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimitListenerUnlimited(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() = %v", err)
+	}
+	defer l.Close()
+
+	if got := limitListener(l, 0, smtpTooManyConns); got != l {
+		t.Errorf("limitListener(l, 0) = %v, want l", got)
+	}
+}
+
+func TestLimitListener(t *testing.T) {
+	tests := []struct {
+		name   string
+		reject string
+	}{
+		{"SMTP", smtpTooManyConns},
+		{"IMAP", imapTooManyConns},
+		{"HTTP", httpTooManyConns},
+		{"TLS", ""},
+	}
+	for _, tc := range tests {
+		testLimitListener(t, tc.name, tc.reject)
+	}
+}
+
+func testLimitListener(t *testing.T, name, reject string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() = %v", err)
+	}
+	l := limitListener(ln, 1, reject)
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("%v: net.Dial() = %v", name, err)
+		}
+		return c
+	}
+
+	first := dial()
+	defer first.Close()
+	serverConn := <-accepted
+
+	// The second connection exceeds the limit
+	second := dial()
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := ioutil.ReadAll(second)
+	if err != nil {
+		t.Errorf("%v: reading rejected connection: %v", name, err)
+	} else if string(b) != reject {
+		t.Errorf("%v: rejected connection received %q, want %q", name, b, reject)
+	}
+
+	// Closing the first connection frees its slot, closing twice only frees
+	// it once
+	serverConn.Close()
+	serverConn.Close()
+	third := dial()
+	defer third.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(5 * time.Second):
+		t.Errorf("%v: connection not accepted after a slot has been freed", name)
+	}
+}
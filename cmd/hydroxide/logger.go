@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// setupLogger configures the default logger, which is also used by the log
+// package.
+func setupLogger(level string, json bool) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q", level)
+	}
+
+	if json {
+		h := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: l})
+		slog.SetDefault(slog.New(h))
+	} else {
+		// Keep the human-readable output of the log package
+		slog.SetLogLoggerLevel(l)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/howeyc/gopass"
+)
+
+var passphraseReader *bufio.Reader
+
+// readPassphrase reads a passphrase from the provided file descriptor, one per
+// line, or prompts for it if fd is negative.
+func readPassphrase(fd int, prompt string) ([]byte, error) {
+	if fd < 0 {
+		fmt.Printf("%v: ", prompt)
+		return gopass.GetPasswd()
+	}
+
+	if passphraseReader == nil {
+		passphraseReader = bufio.NewReader(os.NewFile(uintptr(fd), "passphrase"))
+	}
+	l, err := passphraseReader.ReadString('\n')
+	if err != nil && l == "" {
+		return nil, fmt.Errorf("cannot read passphrase from file descriptor %v: %v", fd, err)
+	}
+	return []byte(strings.TrimRight(l, "\r\n")), nil
+}
+
+// readNewPassphrase reads a new passphrase. It is asked twice when prompting.
+func readNewPassphrase(fd int, prompt string) ([]byte, error) {
+	pass, err := readPassphrase(fd, prompt)
+	if err != nil {
+		return nil, err
+	}
+	if len(pass) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	if fd >= 0 {
+		return pass, nil
+	}
+
+	confirm, err := readPassphrase(fd, "Confirm "+strings.ToLower(prompt))
+	if err != nil {
+		return nil, err
+	}
+	if string(confirm) != string(pass) {
+		return nil, errors.New("passphrases don't match")
+	}
+	return pass, nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/emersion/hydroxide/events"
+)
+
+// handleResyncSignal resynchronizes all accounts when SIGUSR1 is received.
+func handleResyncSignal(eventsManager *events.Manager) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	for range sigs {
+		log.Println("Received SIGUSR1, resynchronizing all accounts")
+		eventsManager.Resync()
+	}
+}
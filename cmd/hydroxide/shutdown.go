@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/emersion/go-smtp"
+
+	smtpbackend "github.com/emersion/hydroxide/smtp"
+)
+
+// shutdownTimeout is the maximum time given to in-flight operations to
+// complete when shutting down.
+const shutdownTimeout = 30 * time.Second
+
+// stoppableListener is a listener which can stop accepting connections without
+// making Accept fail until it's closed. go-smtp's Server.Serve closes all
+// connections as soon as Accept fails, which would interrupt messages being
+// sent.
+type stoppableListener struct {
+	net.Listener
+	stopped   chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newStoppableListener(l net.Listener) *stoppableListener {
+	return &stoppableListener{
+		Listener: l,
+		stopped:  make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (l *stoppableListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		select {
+		case <-l.stopped:
+			<-l.closed
+		default:
+		}
+	}
+	return c, err
+}
+
+// Stop stops accepting connections. It must be called only once.
+func (l *stoppableListener) Stop() {
+	close(l.stopped)
+	l.Listener.Close()
+}
+
+func (l *stoppableListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return l.Listener.Close()
+}
+
+type servers struct {
+	smtp         *smtp.Server
+	smtpListener *stoppableListener
+	smtpBackend  smtpbackend.Backend
+	imap         *imapserver.Server
+	imapListener net.Listener
+	carddav      *http.Server
+}
+
+// shutdown stops the servers gracefully: new connections are refused and
+// messages being sent are given until ctx is done to complete. Remaining
+// connections are then closed.
+func shutdown(ctx context.Context, s *servers) {
+	s.smtpListener.Stop()
+	s.imapListener.Close()
+
+	if err := s.carddav.Shutdown(ctx); err != nil {
+		log.Println("Cannot shut down CardDAV server:", err)
+	}
+
+	if err := s.smtpBackend.Shutdown(ctx); err != nil {
+		log.Println("Gave up waiting for messages being sent:", err)
+	}
+
+	var smtpConns, imapConns int
+	s.smtp.ForEachConn(func(*smtp.Conn) {
+		smtpConns++
+	})
+	s.smtp.Close()
+	s.imap.ForEachConn(func(imapserver.Conn) {
+		imapConns++
+	})
+	// Closing IMAP connections logs users out, which closes their database
+	s.imap.Close()
+
+	log.Printf("Shutdown complete: closed %v SMTP and %v IMAP connections", smtpConns, imapConns)
+}
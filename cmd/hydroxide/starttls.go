@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+)
+
+// starttlsMaxLineLength is the maximum length of a command line accepted
+// before STARTTLS.
+const starttlsMaxLineLength = 4096
+
+// starttlsProtocol describes the commands of a protocol which are accepted
+// before STARTTLS.
+type starttlsProtocol struct {
+	allowed map[string]bool
+	// parse returns the name of the command sent in line, and the reply sent
+	// to the client if the command is rejected
+	parse func(line string) (cmd, reject string)
+}
+
+var smtpStartTLS = &starttlsProtocol{
+	allowed: map[string]bool{
+		"EHLO":     true,
+		"HELO":     true,
+		"LHLO":     true,
+		"NOOP":     true,
+		"RSET":     true,
+		"QUIT":     true,
+		"STARTTLS": true,
+	},
+	parse: func(line string) (cmd, reject string) {
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			cmd = strings.ToUpper(fields[0])
+		}
+		// As defined in RFC 3207 section 4
+		return cmd, "530 5.7.0 Must issue a STARTTLS command first\r\n"
+	},
+}
+
+var imapStartTLS = &starttlsProtocol{
+	allowed: map[string]bool{
+		"CAPABILITY": true,
+		"NOOP":       true,
+		"LOGOUT":     true,
+		"STARTTLS":   true,
+	},
+	parse: func(line string) (cmd, reject string) {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			// Let the server reply to invalid commands
+			return "", ""
+		}
+		// PRIVACYREQUIRED is defined in RFC 5530
+		return strings.ToUpper(fields[1]), fields[0] + " BAD [PRIVACYREQUIRED] Must issue a STARTTLS command first\r\n"
+	},
+}
+
+// starttlsPolicy requires clients to issue STARTTLS before any other
+// command. A nil policy doesn't restrict anything.
+type starttlsPolicy struct {
+	// exemptLoopback lifts the restrictions for clients connecting from a
+	// loopback address or a Unix socket
+	exemptLoopback bool
+}
+
+func isLoopback(addr net.Addr) bool {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP.IsLoopback()
+	case *net.UnixAddr:
+		return true
+	}
+	return false
+}
+
+// allowInsecureAuth returns whether servers can accept authentication before
+// STARTTLS. Commands of clients which aren't exempt are then rejected by the
+// policy.
+func (p *starttlsPolicy) allowInsecureAuth() bool {
+	return p != nil && p.exemptLoopback
+}
+
+// listener wraps l so that connections are subject to the policy.
+func (p *starttlsPolicy) listener(l net.Listener, proto *starttlsProtocol) net.Listener {
+	if p == nil {
+		return l
+	}
+	return &starttlsListener{Listener: l, policy: p, proto: proto}
+}
+
+type starttlsListener struct {
+	net.Listener
+	policy *starttlsPolicy
+	proto  *starttlsProtocol
+}
+
+func (l *starttlsListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if l.policy.exemptLoopback && isLoopback(c.RemoteAddr()) {
+		return c, nil
+	}
+	return &starttlsConn{
+		Conn:  c,
+		r:     bufio.NewReaderSize(c, starttlsMaxLineLength),
+		proto: l.proto,
+	}, nil
+}
+
+// starttlsConn reads commands sent before STARTTLS, and replies to the
+// commands which aren't allowed without passing them to the server.
+type starttlsConn struct {
+	net.Conn
+	r     *bufio.Reader
+	proto *starttlsProtocol
+
+	pending []byte
+	started bool
+}
+
+func (c *starttlsConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.started {
+			return c.r.Read(b)
+		}
+
+		line, err := c.r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return 0, errors.New("command line too long")
+		} else if len(line) == 0 {
+			return 0, err
+		}
+
+		cmd, reject := c.proto.parse(string(line))
+		if cmd != "" && !c.proto.allowed[cmd] {
+			if _, err := io.WriteString(c.Conn, reject); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		c.pending = append([]byte(nil), line...)
+		c.started = cmd == "STARTTLS"
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
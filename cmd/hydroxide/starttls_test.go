@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+// testConn is a connection reading from r and writing to w.
+type testConn struct {
+	net.Conn
+	r *strings.Reader
+	w bytes.Buffer
+}
+
+func (c *testConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *testConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func TestStarttlsConn(t *testing.T) {
+	tests := []struct {
+		name  string
+		proto *starttlsProtocol
+		in    string
+		// want is what the server reads, and wantReply what's replied by
+		// the connection
+		want, wantReply string
+		wantErr         bool
+	}{
+		{
+			name:  "smtp allowed",
+			proto: smtpStartTLS,
+			in:    "EHLO localhost\r\nnoop\r\nSTARTTLS\r\n",
+			want:  "EHLO localhost\r\nnoop\r\nSTARTTLS\r\n",
+		},
+		{
+			name:      "smtp rejected",
+			proto:     smtpStartTLS,
+			in:        "EHLO localhost\r\nAUTH PLAIN AGFsaWNlAHNlY3JldA==\r\nMAIL FROM:<a@example.org>\r\nQUIT\r\n",
+			want:      "EHLO localhost\r\nQUIT\r\n",
+			wantReply: strings.Repeat("530 5.7.0 Must issue a STARTTLS command first\r\n", 2),
+		},
+		{
+			name:  "smtp after starttls",
+			proto: smtpStartTLS,
+			in:    "STARTTLS\r\n\x16\x03\x01AUTH PLAIN\r\n",
+			want:  "STARTTLS\r\n\x16\x03\x01AUTH PLAIN\r\n",
+		},
+		{
+			name:  "imap allowed",
+			proto: imapStartTLS,
+			in:    "a1 CAPABILITY\r\na2 starttls\r\n",
+			want:  "a1 CAPABILITY\r\na2 starttls\r\n",
+		},
+		{
+			name:      "imap rejected",
+			proto:     imapStartTLS,
+			in:        "a1 LOGIN alice secret\r\na2 NOOP\r\n",
+			want:      "a2 NOOP\r\n",
+			wantReply: "a1 BAD [PRIVACYREQUIRED] Must issue a STARTTLS command first\r\n",
+		},
+		{
+			name:  "imap invalid command",
+			proto: imapStartTLS,
+			in:    "a1\r\n",
+			want:  "a1\r\n",
+		},
+		{
+			name:    "line too long",
+			proto:   smtpStartTLS,
+			in:      strings.Repeat("a", starttlsMaxLineLength+1) + "\r\n",
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		raw := &testConn{r: strings.NewReader(tc.in)}
+		c := &starttlsConn{
+			Conn:  raw,
+			r:     bufio.NewReaderSize(raw, starttlsMaxLineLength),
+			proto: tc.proto,
+		}
+
+		b, err := ioutil.ReadAll(c)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%v: Read() = nil, want an error", tc.name)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%v: Read() = %v", tc.name, err)
+			continue
+		}
+		if string(b) != tc.want {
+			t.Errorf("%v: server read %q, want %q", tc.name, b, tc.want)
+		}
+		if reply := raw.w.String(); reply != tc.wantReply {
+			t.Errorf("%v: replied %q, want %q", tc.name, reply, tc.wantReply)
+		}
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("::1")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, false},
+		{&net.UnixAddr{Name: "/run/hydroxide.sock", Net: "unix"}, true},
+		{&net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, false},
+	}
+	for _, tc := range tests {
+		if got := isLoopback(tc.addr); got != tc.want {
+			t.Errorf("isLoopback(%v) = %v, want %v", tc.addr, got, tc.want)
+		}
+	}
+}
+
+func TestStarttlsPolicy(t *testing.T) {
+	tests := []struct {
+		name          string
+		policy        *starttlsPolicy
+		wantInsecure  bool
+		wantWrapped   bool
+		wantWrapConns bool
+	}{
+		{name: "nil", policy: nil},
+		{name: "strict", policy: &starttlsPolicy{}, wantWrapped: true, wantWrapConns: true},
+		{name: "exempt loopback", policy: &starttlsPolicy{exemptLoopback: true}, wantInsecure: true, wantWrapped: true},
+	}
+	for _, tc := range tests {
+		if got := tc.policy.allowInsecureAuth(); got != tc.wantInsecure {
+			t.Errorf("%v: allowInsecureAuth() = %v, want %v", tc.name, got, tc.wantInsecure)
+		}
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("net.Listen() = %v", err)
+		}
+		l := tc.policy.listener(ln, smtpStartTLS)
+		if _, wrapped := l.(*starttlsListener); wrapped != tc.wantWrapped {
+			t.Errorf("%v: listener wrapped = %v, want %v", tc.name, wrapped, tc.wantWrapped)
+		}
+
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("net.Dial() = %v", err)
+		}
+		c, err := l.Accept()
+		if err != nil {
+			t.Fatalf("Accept() = %v", err)
+		}
+		if _, wrapped := c.(*starttlsConn); wrapped != tc.wantWrapConns {
+			t.Errorf("%v: loopback connection wrapped = %v, want %v", tc.name, wrapped, tc.wantWrapConns)
+		}
+		c.Close()
+		client.Close()
+		l.Close()
+	}
+}
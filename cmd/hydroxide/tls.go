@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader loads a TLS certificate and reloads it when the files are
+// modified, so that renewed certificates are used without a restart.
+type certReloader struct {
+	certPath, keyPath string
+
+	locker  sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (r *certReloader) lastModified() (time.Time, error) {
+	var t time.Time
+	for _, p := range []string{r.certPath, r.keyPath} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return t, err
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t, nil
+}
+
+func (r *certReloader) load() (*tls.Certificate, error) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	modTime, err := r.lastModified()
+	if err != nil {
+		if r.cert != nil {
+			// Files may be temporarily missing while being renewed
+			return r.cert, nil
+		}
+		return nil, err
+	}
+	if r.cert != nil && !modTime.After(r.modTime) {
+		return r.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		if r.cert != nil {
+			return r.cert, nil
+		}
+		return nil, err
+	}
+
+	r.cert = &cert
+	r.modTime = modTime
+	return r.cert, nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.load()
+}
+
+// newTLSConfig returns a TLS configuration using the provided certificate and
+// key files, or nil if they aren't set.
+func newTLSConfig(certPath, keyPath string) (*tls.Config, error) {
+	if certPath == "" && keyPath == "" {
+		return nil, nil
+	}
+
+	r := &certReloader{certPath: certPath, keyPath: keyPath}
+	if _, err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{GetCertificate: r.GetCertificate}, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+const defaultAPIEndpoint = "https://dev.protonmail.com/api"
+
+// newHTTPClient creates the HTTP client used to reach the ProtonMail API. If
+// proxy is empty, the proxy is read from the environment. Supported proxy
+// schemes are http, https and socks5.
+func newHTTPClient(proxy string, insecureSkipVerify bool) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %v", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+
+	if insecureSkipVerify {
+		log.Println("Warning: TLS certificates of the API server aren't verified, connections can be intercepted")
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// newClientFactory returns a function creating API clients. If rate is
+// positive, each client gets its own rate limiter: there's one client per
+// account.
+func newClientFactory(rootURL, modulusKey string, httpClient *http.Client, rate float64, burst int) func() *protonmail.Client {
+	return func() *protonmail.Client {
+		var limiter *protonmail.RateLimiter
+		if rate > 0 {
+			limiter = protonmail.NewRateLimiter(rate, burst)
+		}
+		return &protonmail.Client{
+			RootURL:      rootURL,
+			AppVersion:   "Web_3.15.23",
+			ClientID:     "Web",
+			ClientSecret: "4957cc9a2e0a2a49d02475c9d013478d",
+			HTTPClient:   httpClient,
+			ModulusKey:   modulusKey,
+			RateLimiter:  limiter,
+		}
+	}
+}
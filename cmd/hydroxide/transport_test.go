@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewHTTPClientProxy(t *testing.T) {
+	tests := []struct {
+		proxy   string
+		want    string
+		wantErr bool
+	}{
+		{proxy: "http://127.0.0.1:3128", want: "http://127.0.0.1:3128"},
+		{proxy: "https://proxy.example.org", want: "https://proxy.example.org"},
+		{proxy: "socks5://127.0.0.1:9050", want: "socks5://127.0.0.1:9050"},
+		{proxy: "ftp://proxy.example.org", wantErr: true},
+		{proxy: "127.0.0.1:9050", wantErr: true},
+		{proxy: "http://[::1", wantErr: true},
+	}
+	for _, tc := range tests {
+		c, err := newHTTPClient(tc.proxy, false)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("newHTTPClient(%q) = nil, want an error", tc.proxy)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("newHTTPClient(%q) = %v", tc.proxy, err)
+			continue
+		}
+
+		req, _ := http.NewRequest(http.MethodGet, "https://api.example.org", nil)
+		u, err := c.Transport.(*http.Transport).Proxy(req)
+		if err != nil {
+			t.Errorf("newHTTPClient(%q): Proxy() = %v", tc.proxy, err)
+		} else if u == nil || u.String() != tc.want {
+			t.Errorf("newHTTPClient(%q): Proxy() = %v, want %v", tc.proxy, u, tc.want)
+		}
+	}
+}
+
+func TestNewHTTPClientThroughProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.Write([]byte("Hello"))
+	}))
+	defer proxy.Close()
+
+	c, err := newHTTPClient(proxy.URL, false)
+	if err != nil {
+		t.Fatalf("newHTTPClient() = %v", err)
+	}
+	resp, err := c.Get("http://api.example.org/tests/ping")
+	if err != nil {
+		t.Fatalf("GET = %v", err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "Hello" || proxied != "http://api.example.org/tests/ping" {
+		t.Errorf("proxy received %q and replied %q, want the API URL and %q", proxied, b, "Hello")
+	}
+}
+
+func TestNewHTTPClientInsecureSkipVerify(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello"))
+	}))
+	defer srv.Close()
+
+	for _, insecure := range []bool{false, true} {
+		c, err := newHTTPClient("", insecure)
+		if err != nil {
+			t.Fatalf("newHTTPClient() = %v", err)
+		}
+		resp, err := c.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if insecure && err != nil {
+			t.Errorf("GET with insecureSkipVerify = %v", err)
+		} else if !insecure && err == nil {
+			t.Errorf("GET to a server with a self-signed certificate = nil, want an error")
+		}
+	}
+}
+
+func TestNewClientFactory(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	tests := []struct {
+		rate        float64
+		wantLimiter bool
+	}{
+		{0, false},
+		{2, true},
+	}
+	for _, tc := range tests {
+		newClient := newClientFactory(srv.URL, "key", srv.Client(), tc.rate, 1)
+		a, b := newClient(), newClient()
+		if a == b {
+			t.Errorf("rate %v: newClient() returned the same client twice", tc.rate)
+		}
+		if a.RootURL != srv.URL || a.HTTPClient != srv.Client() || a.ModulusKey != "key" {
+			t.Errorf("rate %v: newClient() = %+v, want the factory parameters", tc.rate, a)
+		}
+		if (a.RateLimiter != nil) != tc.wantLimiter {
+			t.Errorf("rate %v: rate limiter = %v, want limiter = %v", tc.rate, a.RateLimiter, tc.wantLimiter)
+		}
+		if tc.wantLimiter && a.RateLimiter == b.RateLimiter {
+			t.Errorf("rate %v: clients share a rate limiter", tc.rate)
+		}
+	}
+}
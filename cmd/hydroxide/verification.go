@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// completeHumanVerification asks the user to solve a human verification
+// challenge, and sets c.HumanVerification so that the request can be retried.
+// E-mail and SMS codes are requested by hydroxide, CAPTCHAs have to be solved
+// in a web browser.
+func completeHumanVerification(c *protonmail.Client, hvErr *protonmail.HumanVerificationError) error {
+	scanner := bufio.NewScanner(os.Stdin)
+	readLine := func(prompt string) string {
+		fmt.Print(prompt)
+		scanner.Scan()
+		return strings.TrimSpace(scanner.Text())
+	}
+
+	var methods []protonmail.HumanVerificationMethod
+	for _, m := range hvErr.Methods {
+		switch m {
+		case protonmail.HumanVerificationCaptcha, protonmail.HumanVerificationEmail, protonmail.HumanVerificationSMS:
+			methods = append(methods, m)
+		}
+	}
+	if len(methods) == 0 {
+		return fmt.Errorf("human verification required, but no supported method is available (%v)", hvErr.Methods)
+	}
+
+	fmt.Println("Human verification required")
+	method := methods[0]
+	if len(methods) > 1 {
+		for i, m := range methods {
+			fmt.Printf("%v. %v\n", i+1, m)
+		}
+		choice := readLine("Verification method: ")
+		for i, m := range methods {
+			if choice == fmt.Sprint(i+1) || choice == string(m) {
+				method = m
+			}
+		}
+	}
+
+	var token string
+	switch method {
+	case protonmail.HumanVerificationCaptcha:
+		fmt.Println("Open this page in a web browser and solve the CAPTCHA:")
+		fmt.Println(hvErr.CaptchaURL(c.RootURL))
+		token = readLine("CAPTCHA token (leave empty once solved to use the challenge token): ")
+		if token == "" {
+			token = hvErr.Token
+		}
+	case protonmail.HumanVerificationEmail, protonmail.HumanVerificationSMS:
+		var dest protonmail.VerificationDestination
+		if method == protonmail.HumanVerificationEmail {
+			dest.Address = readLine("E-mail address: ")
+		} else {
+			dest.Phone = readLine("Phone number: ")
+		}
+		if err := c.SendVerificationCode(method, &dest); err != nil {
+			return fmt.Errorf("cannot send verification code: %v", err)
+		}
+		token = readLine("Verification code: ")
+	}
+	if token == "" {
+		return errors.New("missing human verification token")
+	}
+
+	c.HumanVerification = &protonmail.HumanVerification{
+		Method: method,
+		Token:  token,
+	}
+	return nil
+}
@@ -6,7 +6,21 @@ import (
 	"path/filepath"
 )
 
-func Path(filename string) (string, error) {
+var dir string
+
+// SetDir changes the directory where configuration files are stored. If empty,
+// $XDG_CONFIG_HOME/hydroxide is used, with $XDG_CONFIG_HOME defaulting to
+// ~/.config. It must be called before any file is opened.
+func SetDir(d string) {
+	dir = d
+}
+
+// Dir returns the directory where configuration files are stored.
+func Dir() (string, error) {
+	if dir != "" {
+		return dir, nil
+	}
+
 	configHome := os.Getenv("XDG_CONFIG_HOME")
 	if configHome == "" {
 		home := os.Getenv("HOME")
@@ -15,8 +29,18 @@ func Path(filename string) (string, error) {
 		}
 		configHome = filepath.Join(home, ".config")
 	}
+	return filepath.Join(configHome, "hydroxide"), nil
+}
+
+// Path returns the path of a configuration file, creating its parent
+// directories if necessary.
+func Path(filename string) (string, error) {
+	d, err := Dir()
+	if err != nil {
+		return "", err
+	}
 
-	p := filepath.Join(configHome, "hydroxide", filename)
+	p := filepath.Join(d, filename)
 
 	dirname, _ := filepath.Split(p)
 	if err := os.MkdirAll(dirname, 0700); err != nil {
@@ -0,0 +1,60 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDir(t *testing.T) {
+	tests := []struct {
+		name       string
+		dir        string
+		configHome string
+		home       string
+		want       string
+		wantErr    bool
+	}{
+		{name: "config dir", dir: "/etc/hydroxide", configHome: "/xdg", home: "/home/user", want: "/etc/hydroxide"},
+		{name: "XDG_CONFIG_HOME", configHome: "/xdg", home: "/home/user", want: "/xdg/hydroxide"},
+		{name: "HOME", home: "/home/user", want: "/home/user/.config/hydroxide"},
+		{name: "nothing set", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Setenv("XDG_CONFIG_HOME", tc.configHome)
+		t.Setenv("HOME", tc.home)
+		SetDir(tc.dir)
+
+		got, err := Dir()
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%v: Dir() = %q, want an error", tc.name, got)
+			}
+		} else if err != nil {
+			t.Errorf("%v: Dir() = %v", tc.name, err)
+		} else if got != tc.want {
+			t.Errorf("%v: Dir() = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+	SetDir("")
+}
+
+func TestPath(t *testing.T) {
+	d := filepath.Join(t.TempDir(), "config")
+	SetDir(d)
+	defer SetDir("")
+
+	p, err := Path("sub/file.json")
+	if err != nil {
+		t.Fatalf("Path() = %v", err)
+	}
+	if want := filepath.Join(d, "sub", "file.json"); p != want {
+		t.Errorf("Path() = %q, want %q", p, want)
+	}
+	fi, err := os.Stat(filepath.Join(d, "sub"))
+	if err != nil {
+		t.Fatalf("Path() didn't create the parent directory: %v", err)
+	} else if mode := fi.Mode().Perm(); mode != 0700 {
+		t.Errorf("parent directory mode = %v, want %v", mode, os.FileMode(0700))
+	}
+}
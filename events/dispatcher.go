@@ -0,0 +1,64 @@
+package events
+
+import (
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// Dispatcher dispatches the changes contained in events to the handlers
+// registered for each kind of entity. Handlers must be registered before
+// Dispatch is called.
+type Dispatcher struct {
+	refresh  []func(protonmail.EventRefresh)
+	messages []func(*protonmail.EventMessage)
+	labels   []func(*protonmail.EventLabel)
+	contacts []func(*protonmail.EventContact)
+}
+
+// OnRefresh registers a handler called when the client needs to discard its
+// state and resynchronize everything covered by refresh.
+func (d *Dispatcher) OnRefresh(f func(refresh protonmail.EventRefresh)) {
+	d.refresh = append(d.refresh, f)
+}
+
+func (d *Dispatcher) OnMessage(f func(*protonmail.EventMessage)) {
+	d.messages = append(d.messages, f)
+}
+
+func (d *Dispatcher) OnLabel(f func(*protonmail.EventLabel)) {
+	d.labels = append(d.labels, f)
+}
+
+func (d *Dispatcher) OnContact(f func(*protonmail.EventContact)) {
+	d.contacts = append(d.contacts, f)
+}
+
+// Dispatch calls the handlers for each change in event. Changes to entities
+// which need to be refreshed are not dispatched individually.
+func (d *Dispatcher) Dispatch(event *protonmail.Event) {
+	if event.Refresh != 0 {
+		for _, f := range d.refresh {
+			f(event.Refresh)
+		}
+	}
+
+	if event.Refresh&protonmail.EventRefreshMail == 0 {
+		for _, em := range event.Messages {
+			for _, f := range d.messages {
+				f(em)
+			}
+		}
+		for _, el := range event.Labels {
+			for _, f := range d.labels {
+				f(el)
+			}
+		}
+	}
+
+	if event.Refresh&protonmail.EventRefreshContacts == 0 {
+		for _, ec := range event.Contacts {
+			for _, f := range d.contacts {
+				f(ec)
+			}
+		}
+	}
+}
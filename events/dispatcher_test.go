@@ -0,0 +1,69 @@
+package events
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestDispatcher(t *testing.T) {
+	event := &protonmail.Event{
+		Messages: []*protonmail.EventMessage{{ID: "msg1"}, {ID: "msg2"}},
+		Labels:   []*protonmail.EventLabel{{ID: "label1"}},
+		Contacts: []*protonmail.EventContact{{ID: "contact1"}},
+	}
+
+	tests := []struct {
+		name    string
+		refresh protonmail.EventRefresh
+		want    []string
+	}{
+		{
+			name: "no refresh",
+			want: []string{"a:msg1", "b:msg1", "a:msg2", "b:msg2", "label1", "contact1"},
+		},
+		{
+			name:    "mail refresh",
+			refresh: protonmail.EventRefreshMail,
+			want:    []string{"refresh:1", "contact1"},
+		},
+		{
+			name:    "contacts refresh",
+			refresh: protonmail.EventRefreshContacts,
+			want:    []string{"refresh:2", "a:msg1", "b:msg1", "a:msg2", "b:msg2", "label1"},
+		},
+		{
+			name:    "full refresh",
+			refresh: protonmail.EventRefreshMail | protonmail.EventRefreshContacts,
+			want:    []string{"refresh:3"},
+		},
+	}
+	for _, tc := range tests {
+		var got []string
+		var d Dispatcher
+		d.OnRefresh(func(refresh protonmail.EventRefresh) {
+			got = append(got, fmt.Sprintf("refresh:%v", int(refresh)))
+		})
+		d.OnMessage(func(em *protonmail.EventMessage) {
+			got = append(got, "a:"+em.ID)
+		})
+		d.OnMessage(func(em *protonmail.EventMessage) {
+			got = append(got, "b:"+em.ID)
+		})
+		d.OnLabel(func(el *protonmail.EventLabel) {
+			got = append(got, el.ID)
+		})
+		d.OnContact(func(ec *protonmail.EventContact) {
+			got = append(got, ec.ID)
+		})
+
+		e := *event
+		e.Refresh = tc.refresh
+		d.Dispatch(&e)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: Dispatch() called %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
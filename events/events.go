@@ -1,70 +1,225 @@
 package events
 
 import (
-	"log"
+	"log/slog"
 	"sync"
 	"time"
 
 	"github.com/emersion/hydroxide/protonmail"
 )
 
-const pollInterval = 30 * time.Second
+const (
+	DefaultMinPollInterval = 30 * time.Second
+	DefaultMaxPollInterval = 5 * time.Minute
+)
+
+// pollBackoff computes the interval between two polls. It doubles each time
+// an empty event is received, up to max, and goes back to min as soon as
+// something happens.
+type pollBackoff struct {
+	min, max time.Duration
+	cur      time.Duration
+}
+
+func (b *pollBackoff) next(active bool) time.Duration {
+	if active || b.cur < b.min {
+		b.cur = b.min
+	} else if b.cur *= 2; b.cur > b.max {
+		b.cur = b.max
+	}
+	return b.cur
+}
+
+func isEmptyEvent(event *protonmail.Event) bool {
+	return event.Refresh == 0 && len(event.Messages) == 0 && len(event.Contacts) == 0 && len(event.Labels) == 0
+}
 
 type Receiver struct {
-	c *protonmail.Client
+	log      *slog.Logger
+	username string
+	ids      *eventIDStore
 
-	locker   sync.Mutex
+	locker sync.Mutex
+	// c is the client of the latest registered session
+	c        *protonmail.Client
 	channels []chan<- *protonmail.Event
+	idling   int
+	// manualResync is set when a resync has been requested with Resync
+	manualResync bool
 
-	poll chan struct{}
+	backoff pollBackoff
+	poll    chan struct{}
+	hook    *MailHook
 }
 
-func (r *Receiver) receiveEvents() {
-	t := time.NewTicker(pollInterval)
+func (r *Receiver) wait(d time.Duration) {
+	t := time.NewTimer(d)
 	defer t.Stop()
 
-	var last string
+	select {
+	case <-t.C:
+	case <-r.poll:
+	}
+}
+
+func (r *Receiver) receiveEvents() {
+	last, err := r.ids.load(r.username)
+	if err != nil {
+		r.log.Warn("cannot load last event ID", "err", err)
+	} else if last != "" {
+		r.log.Debug("resuming events", "event", last)
+	}
+
+	// Set when the last event ID has been rejected: changes since then are
+	// lost, everything needs to be resynchronized
+	resync := false
 	for {
-		event, err := r.c.GetEvent(last)
-		if err != nil {
-			log.Println("cannot receive event:", err)
+		r.locker.Lock()
+		c := r.c
+		r.locker.Unlock()
+
+		event, err := c.GetEvent(last)
+		if last != "" && protonmail.IsInvalidEvent(err) {
+			r.log.Info("last event ID rejected, resynchronizing", "event", last, "err", err)
+			last = ""
+			resync = true
+			continue
+		} else if err != nil {
+			// Retry from the same event ID, but don't hammer the API, e.g. when
+			// rate-limited
+			r.log.Warn("cannot receive event", "err", err)
+			r.wait(r.backoff.next(false))
 			continue
 		}
+		r.locker.Lock()
+		manual := r.manualResync
+		r.manualResync = false
+		r.locker.Unlock()
+		if manual {
+			r.log.Info("manual resync", "event", event.ID, "messages", len(event.Messages), "labels", len(event.Labels), "contacts", len(event.Contacts))
+		}
+		if resync || manual {
+			event.Refresh |= protonmail.EventRefreshMail | protonmail.EventRefreshContacts
+			resync = false
+		}
+		active := last != "" && event.ID != last && !isEmptyEvent(event)
+		if r.hook != nil && last != "" && event.ID != last {
+			r.hook.notify(r.username, event)
+		}
 		last = event.ID
+		r.log.Debug("received event", "event", event.ID, "refresh", event.Refresh, "messages", len(event.Messages))
 
 		r.locker.Lock()
 		n := len(r.channels)
 		for _, ch := range r.channels {
 			ch <- event
 		}
+		// Clients waiting for pushes shouldn't wait for the backoff
+		idling := r.idling > 0
 		r.locker.Unlock()
 
+		if err := r.ids.save(r.username, last); err != nil {
+			r.log.Warn("cannot save last event ID", "err", err)
+		}
+
 		if n == 0 {
 			break
 		}
 
-		select {
-		case <-t.C:
-		case <-r.poll:
-		}
+		r.wait(r.backoff.next(active || idling))
 	}
 }
 
+// Poll requests new events right away. Requests made while events are being
+// fetched are coalesced.
 func (r *Receiver) Poll() {
-	r.poll <- struct{}{}
+	select {
+	case r.poll <- struct{}{}:
+	default:
+	}
+}
+
+// Resync requests new events right away, and makes handlers discard their
+// state and resynchronize everything.
+func (r *Receiver) Resync() {
+	r.locker.Lock()
+	r.manualResync = true
+	r.locker.Unlock()
+	r.Poll()
+}
+
+// Idle makes the receiver poll at the minimum interval, until the returned
+// function is called.
+func (r *Receiver) Idle() (stop func()) {
+	r.locker.Lock()
+	r.idling++
+	first := r.idling == 1
+	r.locker.Unlock()
+
+	if first {
+		// The receiver may be waiting for the maximum interval
+		r.Poll()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.locker.Lock()
+			r.idling--
+			r.locker.Unlock()
+		})
+	}
 }
 
 type Manager struct {
+	// MailHook, if set, is called when new messages are received. It must be
+	// set before any receiver is registered.
+	MailHook *MailHook
+
 	receivers map[string]*Receiver
 	locker    sync.Mutex
+	ids       eventIDStore
+
+	minInterval, maxInterval time.Duration
 }
 
-func NewManager() *Manager {
+// NewManager creates a new events manager. Events are polled every
+// minInterval, backing off up to maxInterval while nothing happens. Zero
+// values select the defaults.
+func NewManager(minInterval, maxInterval time.Duration) *Manager {
+	if minInterval <= 0 {
+		minInterval = DefaultMinPollInterval
+	}
+	if maxInterval < minInterval {
+		maxInterval = DefaultMaxPollInterval
+		if maxInterval < minInterval {
+			maxInterval = minInterval
+		}
+	}
+
 	return &Manager{
-		receivers: make(map[string]*Receiver),
+		receivers:   make(map[string]*Receiver),
+		minInterval: minInterval,
+		maxInterval: maxInterval,
+	}
+}
+
+// Resync resynchronizes all the accounts with a registered receiver.
+func (m *Manager) Resync() {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	for _, r := range m.receivers {
+		r.Resync()
 	}
 }
 
+// LastEventID returns the ID of the last event received for a user, which
+// receivers resume from.
+func (m *Manager) LastEventID(username string) (string, error) {
+	return m.ids.load(username)
+}
+
 func (m *Manager) Register(c *protonmail.Client, username string, ch chan<- *protonmail.Event, done <-chan struct{}) *Receiver {
 	m.locker.Lock()
 	defer m.locker.Unlock()
@@ -72,13 +227,36 @@ func (m *Manager) Register(c *protonmail.Client, username string, ch chan<- *pro
 	r, ok := m.receivers[username]
 	if ok {
 		r.locker.Lock()
+		// Previous sessions may have been replaced, e.g. after the bridge
+		// password has been changed
+		r.c = c
 		r.channels = append(r.channels, ch)
 		r.locker.Unlock()
 	} else {
+		backoff := pollBackoff{min: m.minInterval, max: m.maxInterval}
+		if min, max, err := accountPollIntervals(username); err != nil {
+			slog.Warn("cannot load poll intervals", "user", username, "err", err)
+		} else {
+			if min > 0 {
+				backoff.min = min
+			}
+			if max > 0 {
+				backoff.max = max
+			}
+			if backoff.max < backoff.min {
+				backoff.max = backoff.min
+			}
+		}
+
 		r = &Receiver{
 			c:        c,
+			log:      slog.Default().With("user", username),
+			username: username,
+			ids:      &m.ids,
 			channels: []chan<- *protonmail.Event{ch},
-			poll:     make(chan struct{}),
+			backoff:  backoff,
+			poll:     make(chan struct{}, 1),
+			hook:     m.MailHook,
 		}
 
 		go func() {
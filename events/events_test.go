@@ -0,0 +1,224 @@
+package events
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestPollBackoff(t *testing.T) {
+	b := pollBackoff{min: time.Second, max: 5 * time.Second}
+	tests := []struct {
+		active bool
+		want   time.Duration
+	}{
+		{false, time.Second},
+		{false, 2 * time.Second},
+		{false, 4 * time.Second},
+		{false, 5 * time.Second},
+		{false, 5 * time.Second},
+		{true, time.Second},
+		{false, 2 * time.Second},
+		{true, time.Second},
+		{true, time.Second},
+	}
+	for i, tc := range tests {
+		if got := b.next(tc.active); got != tc.want {
+			t.Errorf("#%v: next(%v) = %v, want %v", i, tc.active, got, tc.want)
+		}
+	}
+}
+
+func TestIsEmptyEvent(t *testing.T) {
+	tests := []struct {
+		name  string
+		event protonmail.Event
+		want  bool
+	}{
+		{"empty", protonmail.Event{ID: "event"}, true},
+		{"counts only", protonmail.Event{MessageCounts: []*protonmail.MessageCount{{}}}, true},
+		{"refresh", protonmail.Event{Refresh: protonmail.EventRefreshMail}, false},
+		{"message", protonmail.Event{Messages: []*protonmail.EventMessage{{ID: "msg"}}}, false},
+		{"contact", protonmail.Event{Contacts: []*protonmail.EventContact{{ID: "contact"}}}, false},
+		{"label", protonmail.Event{Labels: []*protonmail.EventLabel{{ID: "label"}}}, false},
+	}
+	for _, tc := range tests {
+		if got := isEmptyEvent(&tc.event); got != tc.want {
+			t.Errorf("%v: isEmptyEvent() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestNewManager(t *testing.T) {
+	tests := []struct {
+		min, max         time.Duration
+		wantMin, wantMax time.Duration
+	}{
+		{0, 0, DefaultMinPollInterval, DefaultMaxPollInterval},
+		{time.Second, time.Minute, time.Second, time.Minute},
+		{time.Minute, time.Second, time.Minute, DefaultMaxPollInterval},
+		{time.Hour, 0, time.Hour, time.Hour},
+		{-time.Second, time.Minute, DefaultMinPollInterval, time.Minute},
+	}
+	for _, tc := range tests {
+		m := NewManager(tc.min, tc.max)
+		if m.minInterval != tc.wantMin || m.maxInterval != tc.wantMax {
+			t.Errorf("NewManager(%v, %v) intervals = %v, %v, want %v, %v", tc.min, tc.max, m.minInterval, m.maxInterval, tc.wantMin, tc.wantMax)
+		}
+	}
+}
+
+func TestAccountPollIntervals(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	if err := SetPollIntervals("alice", time.Second, time.Minute); err != nil {
+		t.Fatalf("SetPollIntervals() = %v", err)
+	}
+	if err := SetPollIntervals("bob", 0, time.Hour); err != nil {
+		t.Fatalf("SetPollIntervals() = %v", err)
+	}
+	if err := SetPollIntervals("carol", time.Second, 0); err != nil {
+		t.Fatalf("SetPollIntervals() = %v", err)
+	}
+	// Resetting both intervals forgets the account
+	if err := SetPollIntervals("carol", 0, 0); err != nil {
+		t.Fatalf("SetPollIntervals() = %v", err)
+	}
+
+	tests := []struct {
+		username string
+		min, max time.Duration
+	}{
+		{"alice", time.Second, time.Minute},
+		{"bob", 0, time.Hour},
+		{"carol", 0, 0},
+		{"dave", 0, 0},
+	}
+	for _, tc := range tests {
+		min, max, err := accountPollIntervals(tc.username)
+		if err != nil {
+			t.Errorf("accountPollIntervals(%q) = %v", tc.username, err)
+		} else if min != tc.min || max != tc.max {
+			t.Errorf("accountPollIntervals(%q) = %v, %v, want %v, %v", tc.username, min, max, tc.min, tc.max)
+		}
+	}
+
+	m := NewManager(time.Hour, 2*time.Hour)
+	tests = []struct {
+		username string
+		min, max time.Duration
+	}{
+		{"alice", time.Second, time.Minute},
+		{"bob", time.Hour, time.Hour},
+		{"dave", time.Hour, 2 * time.Hour},
+	}
+	for _, tc := range tests {
+		ch := make(chan *protonmail.Event, 1)
+		done := make(chan struct{})
+		defer close(done)
+		r := m.Register(newTestClient(t), tc.username, ch, done)
+		if r.backoff.min != tc.min || r.backoff.max != tc.max {
+			t.Errorf("Register(%q) intervals = %v, %v, want %v, %v", tc.username, r.backoff.min, r.backoff.max, tc.min, tc.max)
+		}
+	}
+}
+
+// newTestClient returns a client whose events are numbered, starting from 1.
+// An event with a message is returned every other time. The event ID "bad"
+// is rejected.
+func newTestClient(t *testing.T) *protonmail.Client {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n int
+		switch last := r.URL.Path[len("/events/"):]; last {
+		case "latest":
+		case "bad":
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"Code":18002,"Error":"Invalid event ID"}`))
+			return
+		default:
+			fmt.Sscanf(last, "%d", &n)
+		}
+		n++
+
+		messages := "[]"
+		if n%2 == 0 {
+			messages = `[{"ID":"msg"}]`
+		}
+		fmt.Fprintf(w, `{"Code":1000,"EventID":"%v","Messages":%v}`, n, messages)
+	}))
+	t.Cleanup(srv.Close)
+	return &protonmail.Client{RootURL: srv.URL, HTTPClient: srv.Client(), MaxRetries: -1}
+}
+
+func receiveEvent(t *testing.T, ch <-chan *protonmail.Event) *protonmail.Event {
+	select {
+	case event := <-ch:
+		return event
+	case <-time.After(10 * time.Second):
+		t.Fatal("no event received")
+		return nil
+	}
+}
+
+func TestReceiver(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	m := NewManager(time.Hour, time.Hour)
+	ch := make(chan *protonmail.Event)
+	done := make(chan struct{})
+	defer close(done)
+	r := m.Register(newTestClient(t), "alice", ch, done)
+
+	if event := receiveEvent(t, ch); event.ID != "1" {
+		t.Fatalf("first event ID = %q, want %q", event.ID, "1")
+	}
+
+	// Events are fetched right away when polling
+	r.Poll()
+	if event := receiveEvent(t, ch); event.ID != "2" || len(event.Messages) != 1 {
+		t.Errorf("polled event = %+v, want event 2 with a message", event)
+	}
+
+	last, err := m.LastEventID("alice")
+	if err != nil {
+		t.Fatalf("LastEventID() = %v", err)
+	} else if last != "2" {
+		t.Errorf("LastEventID() = %q, want %q", last, "2")
+	}
+
+	r.Resync()
+	if event := receiveEvent(t, ch); event.Refresh&protonmail.EventRefreshMail == 0 {
+		t.Errorf("event after Resync() = %+v, want mail refresh", event)
+	}
+	r.Poll()
+	if event := receiveEvent(t, ch); event.Refresh != 0 {
+		t.Errorf("event after resync = %+v, want no refresh", event)
+	}
+}
+
+func TestReceiverInvalidEvent(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	var ids eventIDStore
+	if err := ids.save("alice", "bad"); err != nil {
+		t.Fatalf("eventIDStore.save() = %v", err)
+	}
+
+	m := NewManager(time.Hour, time.Hour)
+	ch := make(chan *protonmail.Event)
+	done := make(chan struct{})
+	defer close(done)
+	m.Register(newTestClient(t), "alice", ch, done)
+
+	event := receiveEvent(t, ch)
+	if event.ID != "1" {
+		t.Errorf("event ID = %q, want %q", event.ID, "1")
+	}
+	if want := protonmail.EventRefreshMail | protonmail.EventRefreshContacts; event.Refresh&want != want {
+		t.Errorf("event refresh = %v, want %v", event.Refresh, want)
+	}
+}
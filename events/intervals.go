@@ -0,0 +1,70 @@
+package events
+
+import (
+	"time"
+)
+
+const pollIntervalsFile = "poll.json"
+
+// PollIntervals overrides the poll intervals of an account. Durations are
+// formatted as accepted by time.ParseDuration. Empty values select the
+// intervals of the manager.
+type PollIntervals struct {
+	Min string `json:",omitempty"`
+	Max string `json:",omitempty"`
+}
+
+func parseInterval(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func formatInterval(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return d.String()
+}
+
+// accountPollIntervals returns the poll intervals configured for an account.
+// Zero values select the intervals of the manager.
+func accountPollIntervals(username string) (min, max time.Duration, err error) {
+	intervals := make(map[string]*PollIntervals)
+	if err := readConfigFile(pollIntervalsFile, &intervals); err != nil {
+		return 0, 0, err
+	}
+
+	account, ok := intervals[username]
+	if !ok {
+		return 0, 0, nil
+	}
+	if min, err = parseInterval(account.Min); err != nil {
+		return 0, 0, err
+	}
+	if max, err = parseInterval(account.Max); err != nil {
+		return 0, 0, err
+	}
+	return min, max, nil
+}
+
+// SetPollIntervals saves the poll intervals of an account. They're used by
+// receivers registered afterwards. Zero values select the intervals of the
+// manager.
+func SetPollIntervals(username string, min, max time.Duration) error {
+	intervals := make(map[string]*PollIntervals)
+	if err := readConfigFile(pollIntervalsFile, &intervals); err != nil {
+		return err
+	}
+
+	if min <= 0 && max <= 0 {
+		delete(intervals, username)
+	} else {
+		intervals[username] = &PollIntervals{
+			Min: formatInterval(min),
+			Max: formatInterval(max),
+		}
+	}
+	return writeConfigFile(pollIntervalsFile, intervals)
+}
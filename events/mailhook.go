@@ -0,0 +1,179 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// mailHookDelay is the time new messages are collected for before the hook is
+// called, so that a burst of messages results in a single call.
+const mailHookDelay = 5 * time.Second
+
+// mailHookRetries is the number of times a failed webhook request is retried.
+const mailHookRetries = 3
+
+// mailHookRetryDelay is the delay before the first retry of a webhook request.
+var mailHookRetryDelay = time.Second
+
+// MailHookMessage describes a new message in a mail hook payload.
+type MailHookMessage struct {
+	ID       string
+	LabelIDs []string
+	// Only populated if details are enabled
+	Subject string `json:",omitempty"`
+	Sender  string `json:",omitempty"`
+}
+
+// MailHookPayload is the JSON payload sent to mail hooks.
+type MailHookPayload struct {
+	Account  string
+	Messages []*MailHookMessage
+}
+
+// MailHook is called when new messages are received. It either performs an
+// HTTP POST request to a URL, or runs a shell command with the payload on its
+// standard input, or both.
+type MailHook struct {
+	// URL is the webhook URL. If empty, no request is sent.
+	URL string
+	// Command is a shell command. If empty, no command is run.
+	Command string
+	// Details adds the subject and sender of messages to the payload. By
+	// default, only IDs are included.
+	Details bool
+
+	HTTPClient *http.Client
+
+	locker  sync.Mutex
+	pending map[string][]*MailHookMessage
+}
+
+func (h *MailHook) messages(event *protonmail.Event) []*MailHookMessage {
+	if event.Refresh&protonmail.EventRefreshMail != 0 {
+		// All messages are listed again
+		return nil
+	}
+
+	var l []*MailHookMessage
+	for _, eventMessage := range event.Messages {
+		msg := eventMessage.Created
+		if eventMessage.Action != protonmail.EventCreate || msg == nil {
+			continue
+		}
+		// Drafts and sent messages aren't new mail
+		if msg.Type != protonmail.MessageInbox && msg.Type != protonmail.MessageInboxAndSent {
+			continue
+		}
+
+		m := &MailHookMessage{ID: msg.ID, LabelIDs: msg.LabelIDs}
+		if h.Details {
+			m.Subject = msg.Subject
+			if msg.Sender != nil {
+				m.Sender = msg.Sender.Address
+			}
+		}
+		l = append(l, m)
+	}
+	return l
+}
+
+// notify queues the new messages of an event.
+func (h *MailHook) notify(username string, event *protonmail.Event) {
+	l := h.messages(event)
+	if len(l) == 0 {
+		return
+	}
+
+	h.locker.Lock()
+	defer h.locker.Unlock()
+
+	if h.pending == nil {
+		h.pending = make(map[string][]*MailHookMessage)
+	}
+	first := len(h.pending[username]) == 0
+	h.pending[username] = append(h.pending[username], l...)
+	if first {
+		time.AfterFunc(mailHookDelay, func() {
+			h.flush(username)
+		})
+	}
+}
+
+func (h *MailHook) flush(username string) {
+	h.locker.Lock()
+	l := h.pending[username]
+	delete(h.pending, username)
+	h.locker.Unlock()
+
+	payload := &MailHookPayload{Account: username, Messages: l}
+	log := slog.Default().With("user", username)
+	if err := h.call(payload); err != nil {
+		log.Warn("cannot call new mail hook", "messages", len(l), "err", err)
+	} else {
+		log.Debug("called new mail hook", "messages", len(l))
+	}
+}
+
+func (h *MailHook) call(payload *MailHookPayload) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	if h.URL != "" {
+		if err := h.post(b); err != nil {
+			return err
+		}
+	}
+
+	if h.Command != "" {
+		cmd := exec.Command("/bin/sh", "-c", h.Command)
+		cmd.Stdin = bytes.NewReader(b)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("command failed: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// post sends the payload to the webhook URL. Network errors and server errors
+// are retried with an exponential backoff.
+func (h *MailHook) post(b []byte) error {
+	httpClient := h.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	delay := mailHookRetryDelay
+	for attempt := 0; ; attempt++ {
+		resp, err := httpClient.Post(h.URL, "application/json", bytes.NewReader(b))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 == 2 {
+				return nil
+			}
+			err = fmt.Errorf("HTTP %v", resp.Status)
+			if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode/100 != 5 {
+				return err
+			}
+		}
+		if attempt >= mailHookRetries {
+			return err
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
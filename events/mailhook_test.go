@@ -0,0 +1,161 @@
+package events
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestMailHookMessages(t *testing.T) {
+	inbox := &protonmail.Message{
+		ID:       "msg1",
+		Type:     protonmail.MessageInbox,
+		Subject:  "Hello",
+		Sender:   &protonmail.MessageAddress{Address: "alice@example.org"},
+		LabelIDs: []string{protonmail.LabelInbox},
+	}
+	toSelf := &protonmail.Message{ID: "msg2", Type: protonmail.MessageInboxAndSent}
+	draft := &protonmail.Message{ID: "draft", Type: protonmail.MessageDraft}
+	sent := &protonmail.Message{ID: "sent", Type: protonmail.MessageSent}
+	event := &protonmail.Event{Messages: []*protonmail.EventMessage{
+		{ID: "msg1", Action: protonmail.EventCreate, Created: inbox},
+		{ID: "msg2", Action: protonmail.EventCreate, Created: toSelf},
+		{ID: "draft", Action: protonmail.EventCreate, Created: draft},
+		{ID: "sent", Action: protonmail.EventCreate, Created: sent},
+		{ID: "msg3", Action: protonmail.EventUpdateFlags},
+		{ID: "msg4", Action: protonmail.EventDelete},
+	}}
+
+	tests := []struct {
+		name    string
+		details bool
+		event   *protonmail.Event
+		want    []*MailHookMessage
+	}{
+		{
+			name:  "IDs",
+			event: event,
+			want:  []*MailHookMessage{{ID: "msg1", LabelIDs: []string{protonmail.LabelInbox}}, {ID: "msg2"}},
+		},
+		{
+			name:    "details",
+			details: true,
+			event:   event,
+			want:    []*MailHookMessage{{ID: "msg1", LabelIDs: []string{protonmail.LabelInbox}, Subject: "Hello", Sender: "alice@example.org"}, {ID: "msg2"}},
+		},
+		{
+			name:  "refresh",
+			event: &protonmail.Event{Refresh: protonmail.EventRefreshMail, Messages: event.Messages},
+		},
+	}
+	for _, tc := range tests {
+		h := &MailHook{Details: tc.details}
+		if got := h.messages(tc.event); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: messages() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMailHookNotify(t *testing.T) {
+	h := new(MailHook)
+	event := &protonmail.Event{Messages: []*protonmail.EventMessage{
+		{ID: "msg1", Action: protonmail.EventCreate, Created: &protonmail.Message{ID: "msg1", Type: protonmail.MessageInbox}},
+	}}
+	h.notify("user", event)
+	h.notify("user", event)
+	h.notify("user", &protonmail.Event{})
+
+	h.locker.Lock()
+	n := len(h.pending["user"])
+	h.locker.Unlock()
+	if n != 2 {
+		t.Errorf("%v pending messages, want 2", n)
+	}
+
+	h.flush("user")
+	h.locker.Lock()
+	_, ok := h.pending["user"]
+	h.locker.Unlock()
+	if ok {
+		t.Errorf("flush() left pending messages")
+	}
+}
+
+func TestMailHookCall(t *testing.T) {
+	payload := &MailHookPayload{Account: "user", Messages: []*MailHookMessage{{ID: "msg1"}}}
+	want, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var posted []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", ct)
+		}
+		posted, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	out := filepath.Join(t.TempDir(), "payload.json")
+	h := &MailHook{URL: srv.URL, Command: "cat > " + out, HTTPClient: srv.Client()}
+	if err := h.call(payload); err != nil {
+		t.Fatalf("call() = %v", err)
+	}
+	if string(posted) != string(want) {
+		t.Errorf("posted payload = %s, want %s", posted, want)
+	}
+	if b, err := ioutil.ReadFile(out); err != nil {
+		t.Errorf("command didn't run: %v", err)
+	} else if string(b) != string(want) {
+		t.Errorf("command payload = %s, want %s", b, want)
+	}
+
+	h = &MailHook{Command: "exit 1"}
+	if err := h.call(payload); err == nil {
+		t.Errorf("call() with a failing command = nil, want an error")
+	}
+}
+
+func TestMailHookPost(t *testing.T) {
+	mailHookRetryDelay = time.Millisecond
+	defer func() { mailHookRetryDelay = time.Second }()
+
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantRequests int
+		wantErr      bool
+	}{
+		{name: "success", statuses: []int{200}, wantRequests: 1},
+		{name: "server error", statuses: []int{503, 502, 204}, wantRequests: 3},
+		{name: "rate-limited", statuses: []int{429, 200}, wantRequests: 2},
+		{name: "client error", statuses: []int{404}, wantRequests: 1, wantErr: true},
+		{name: "too many retries", statuses: []int{500, 500, 500, 500, 200}, wantRequests: mailHookRetries + 1, wantErr: true},
+	}
+	for _, tc := range tests {
+		requests := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.statuses[requests])
+			requests++
+		}))
+		h := &MailHook{URL: srv.URL, HTTPClient: srv.Client()}
+		err := h.post([]byte("{}"))
+		srv.Close()
+		if tc.wantErr && err == nil {
+			t.Errorf("%v: post() = nil, want an error", tc.name)
+		} else if !tc.wantErr && err != nil {
+			t.Errorf("%v: post() = %v", tc.name, err)
+		}
+		if requests != tc.wantRequests {
+			t.Errorf("%v: post() sent %v requests, want %v", tc.name, requests, tc.wantRequests)
+		}
+	}
+}
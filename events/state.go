@@ -0,0 +1,80 @@
+package events
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/emersion/hydroxide/config"
+)
+
+// readConfigFile decodes a JSON file from the config directory into v. It's a
+// no-op if the file doesn't exist.
+func readConfigFile(filename string, v interface{}) error {
+	p, err := config.Path(filename)
+	if err != nil {
+		return err
+	}
+
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func writeConfigFile(filename string, v interface{}) error {
+	p, err := config.Path(filename)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+const eventIDsFile = "events.json"
+
+// eventIDStore persists the ID of the last event received for each user, so
+// that receivers resume from it after a restart instead of missing the
+// changes made in the meantime.
+type eventIDStore struct {
+	locker sync.Mutex
+}
+
+func (s *eventIDStore) load(username string) (string, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	ids := make(map[string]string)
+	if err := readConfigFile(eventIDsFile, &ids); err != nil {
+		return "", err
+	}
+	return ids[username], nil
+}
+
+func (s *eventIDStore) save(username, id string) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	ids := make(map[string]string)
+	if err := readConfigFile(eventIDsFile, &ids); err != nil {
+		return err
+	}
+	if ids[username] == id {
+		return nil
+	}
+	ids[username] = id
+	return writeConfigFile(eventIDsFile, ids)
+}
@@ -0,0 +1,84 @@
+package events
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestEventIDStore(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+
+	var ids eventIDStore
+	if id, err := ids.load("alice"); err != nil || id != "" {
+		t.Errorf("load() before save = %q, %v, want an empty ID", id, err)
+	}
+	if err := ids.save("alice", "event1"); err != nil {
+		t.Fatalf("save() = %v", err)
+	}
+	if err := ids.save("bob", "event2"); err != nil {
+		t.Fatalf("save() = %v", err)
+	}
+	if err := ids.save("alice", "event3"); err != nil {
+		t.Fatalf("save() = %v", err)
+	}
+
+	// IDs are persisted, another store reads them
+	var other eventIDStore
+	tests := []struct {
+		username, want string
+	}{
+		{"alice", "event3"},
+		{"bob", "event2"},
+		{"carol", ""},
+	}
+	for _, tc := range tests {
+		if id, err := other.load(tc.username); err != nil {
+			t.Errorf("load(%q) = %v", tc.username, err)
+		} else if id != tc.want {
+			t.Errorf("load(%q) = %q, want %q", tc.username, id, tc.want)
+		}
+	}
+
+	p := filepath.Join(dir, "hydroxide", eventIDsFile)
+	if fi, err := os.Stat(p); err != nil {
+		t.Errorf("cannot stat %v: %v", eventIDsFile, err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("%v mode = %v, want %v", eventIDsFile, fi.Mode().Perm(), os.FileMode(0600))
+	}
+
+	if err := ioutil.WriteFile(p, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.load("alice"); err == nil {
+		t.Errorf("load() with an invalid file = nil, want an error")
+	}
+}
+
+func TestReceiverResume(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	var ids eventIDStore
+	if err := ids.save("alice", "5"); err != nil {
+		t.Fatalf("save() = %v", err)
+	}
+
+	m := NewManager(time.Hour, time.Hour)
+	ch := make(chan *protonmail.Event)
+	done := make(chan struct{})
+	defer close(done)
+	m.Register(newTestClient(t), "alice", ch, done)
+
+	event := receiveEvent(t, ch)
+	if event.ID != "6" {
+		t.Errorf("first event ID = %q, want %q", event.ID, "6")
+	}
+	if event.Refresh != 0 {
+		t.Errorf("first event refresh = %v, want none", event.Refresh)
+	}
+}
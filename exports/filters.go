@@ -0,0 +1,33 @@
+package exports
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// ExportFilters writes all filters to w in the JSON format, ordered by
+// priority. The result can be imported back with imports.ImportFilters.
+func ExportFilters(c *protonmail.Client, w io.Writer) error {
+	filters, err := c.ListFilters()
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(filters, func(i, j int) bool {
+		return filters[i].Priority < filters[j].Priority
+	})
+
+	// IDs and priorities are specific to an account, the order is kept by
+	// the list itself
+	for _, f := range filters {
+		f.ID = ""
+		f.Priority = 0
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(filters)
+}
@@ -0,0 +1,125 @@
+package exports
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// maildirFlags returns the flags of a message in the Maildir format.
+func maildirFlags(msg *protonmail.Message) string {
+	var flags string
+	if msg.Type == protonmail.MessageDraft {
+		flags += "D"
+	}
+	for _, labelID := range msg.LabelIDs {
+		if labelID == protonmail.LabelStarred {
+			flags += "F"
+			break
+		}
+	}
+	if msg.IsReplied != 0 || msg.IsRepliedAll != 0 {
+		flags += "R"
+	}
+	if msg.Unread == 0 {
+		flags += "S"
+	}
+	return flags
+}
+
+// maildirStore writes messages to a Maildir per folder. The ProtonMail message
+// ID is stored in the filename.
+type maildirStore struct {
+	dir string
+	ids map[string]map[string]struct{}
+}
+
+func newMaildirStore(dir string) *maildirStore {
+	return &maildirStore{
+		dir: dir,
+		ids: make(map[string]map[string]struct{}),
+	}
+}
+
+func (s *maildirStore) open(folder string) (map[string]struct{}, error) {
+	if ids, ok := s.ids[folder]; ok {
+		return ids, nil
+	}
+
+	ids := make(map[string]struct{})
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		dir := filepath.Join(s.dir, folder, sub)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		if sub == "tmp" {
+			continue
+		}
+
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range files {
+			// Filenames are formatted as <time>.<id>.hydroxide:2,<flags>
+			parts := strings.SplitN(fi.Name(), ".", 3)
+			if len(parts) == 3 && strings.HasPrefix(parts[2], "hydroxide") {
+				ids[parts[1]] = struct{}{}
+			}
+		}
+	}
+
+	s.ids[folder] = ids
+	return ids, nil
+}
+
+func (s *maildirStore) Has(folder, id string) (bool, error) {
+	ids, err := s.open(folder)
+	if err != nil {
+		return false, err
+	}
+	_, ok := ids[id]
+	return ok, nil
+}
+
+func (s *maildirStore) Write(folder string, msg *protonmail.Message, write func(w io.Writer) error) error {
+	ids, err := s.open(folder)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%v.%v.hydroxide", msg.Time, msg.ID)
+	tmp := filepath.Join(s.dir, folder, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Messages are moved to cur only once complete
+	cur := filepath.Join(s.dir, folder, "cur", name+":2,"+maildirFlags(msg))
+	if err := os.Rename(tmp, cur); err != nil {
+		return err
+	}
+
+	ids[msg.ID] = struct{}{}
+	return nil
+}
+
+func (s *maildirStore) Close() error {
+	return nil
+}
@@ -0,0 +1,149 @@
+package exports
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// mboxIDHeader is the header field used to store the ProtonMail message ID.
+const mboxIDHeader = "X-Hydroxide-Message-Id"
+
+// writeMboxBody converts a RFC 822 message to the mboxrd format: lines end with
+// LF and lines starting with "From " (optionally quoted) are quoted.
+func writeMboxBody(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		l, err := br.ReadString('\n')
+		if l != "" {
+			l = strings.TrimSuffix(strings.TrimSuffix(l, "\n"), "\r")
+			if strings.HasPrefix(strings.TrimLeft(l, ">"), "From ") {
+				l = ">" + l
+			}
+			if _, err := io.WriteString(w, l+"\n"); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// mboxStore writes messages to a mbox file per folder. The ProtonMail message
+// ID is stored in a header field.
+type mboxStore struct {
+	dir   string
+	files map[string]*os.File
+	ids   map[string]map[string]struct{}
+}
+
+func newMboxStore(dir string) *mboxStore {
+	return &mboxStore{
+		dir:   dir,
+		files: make(map[string]*os.File),
+		ids:   make(map[string]map[string]struct{}),
+	}
+}
+
+func (s *mboxStore) open(folder string) (*os.File, error) {
+	if f, ok := s.files[folder]; ok {
+		return f, nil
+	}
+
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(s.dir, folder+".mbox")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]struct{})
+	prefix := mboxIDHeader + ": "
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if l := scanner.Text(); strings.HasPrefix(l, prefix) {
+			ids[strings.TrimPrefix(l, prefix)] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	s.files[folder] = f
+	s.ids[folder] = ids
+	return f, nil
+}
+
+func (s *mboxStore) Has(folder, id string) (bool, error) {
+	if _, err := s.open(folder); err != nil {
+		return false, err
+	}
+	_, ok := s.ids[folder][id]
+	return ok, nil
+}
+
+func (s *mboxStore) Write(folder string, msg *protonmail.Message, write func(w io.Writer) error) error {
+	f, err := s.open(folder)
+	if err != nil {
+		return err
+	}
+
+	// Buffer the whole message, so that an interrupted export doesn't leave
+	// a partial message behind
+	var raw bytes.Buffer
+	if err := write(&raw); err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	date := time.Unix(msg.Time, 0).UTC().Format(time.ANSIC)
+	fmt.Fprintf(&b, "From MAILER-DAEMON %v\n", date)
+	fmt.Fprintf(&b, "%v: %v\n", mboxIDHeader, msg.ID)
+	if msg.Unread == 0 {
+		b.WriteString("Status: RO\n")
+	} else {
+		b.WriteString("Status: O\n")
+	}
+	for _, labelID := range msg.LabelIDs {
+		if labelID == protonmail.LabelStarred {
+			b.WriteString("X-Status: F\n")
+			break
+		}
+	}
+	if err := writeMboxBody(&b, &raw); err != nil {
+		return err
+	}
+	b.WriteString("\n")
+
+	if _, err := f.Write(b.Bytes()); err != nil {
+		return err
+	}
+
+	s.ids[folder][msg.ID] = struct{}{}
+	return nil
+}
+
+func (s *mboxStore) Close() error {
+	var err error
+	for folder, f := range s.files {
+		if closeErr := f.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		delete(s.files, folder)
+	}
+	return err
+}
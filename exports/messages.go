@@ -0,0 +1,287 @@
+// Package exports writes ProtonMail messages to local mail stores.
+package exports
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+type Format string
+
+const (
+	FormatMaildir Format = "maildir"
+	FormatMbox    Format = "mbox"
+)
+
+var systemLabels = []struct {
+	name string
+	id   string
+}{
+	{"Inbox", protonmail.LabelInbox},
+	{"Archive", protonmail.LabelArchive},
+	{"Drafts", protonmail.LabelDraft},
+	{"Sent", protonmail.LabelSent},
+	{"Starred", protonmail.LabelStarred},
+	{"Spam", protonmail.LabelSpam},
+	{"Trash", protonmail.LabelTrash},
+}
+
+func messageHeader(msg *protonmail.Message) message.Header {
+	if msg.Header != "" {
+		r := textproto.NewReader(bufio.NewReader(strings.NewReader(msg.Header + "\r\n")))
+		if h, err := r.ReadMIMEHeader(); err == nil {
+			h := message.Header(h)
+			h.Del("Content-Transfer-Encoding")
+			h.SetContentType("multipart/mixed", nil)
+			return h
+		}
+	}
+
+	h := mail.NewHeader()
+	h.SetContentType("multipart/mixed", nil)
+	h.SetDate(time.Unix(msg.Time, 0))
+	h.SetSubject(msg.Subject)
+	if msg.Sender != nil {
+		h.Set("From", msg.Sender.String())
+	}
+	if len(msg.ToList) > 0 {
+		h.Set("To", protonmail.FormatAddressList(msg.ToList))
+	}
+	if len(msg.CCList) > 0 {
+		h.Set("Cc", protonmail.FormatAddressList(msg.CCList))
+	}
+	return h.Header
+}
+
+func inlineHeader(msg *protonmail.Message) message.Header {
+	h := mail.NewTextHeader()
+	if msg.MIMEType != "" {
+		// Bodies are always stored in UTF-8
+		h.SetContentType(msg.MIMEType, map[string]string{"charset": "utf-8"})
+	}
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+	return h.Header
+}
+
+func attachmentHeader(att *protonmail.Attachment) message.Header {
+	h := mail.NewAttachmentHeader()
+	h.SetContentType(att.MIMEType, nil)
+	h.Set("Content-Transfer-Encoding", "base64")
+	disp := "attachment"
+	if att.IsInline() {
+		disp = "inline"
+	}
+	h.SetContentDisposition(disp, map[string]string{"filename": att.Name})
+	if att.ContentID != "" {
+		id := att.ContentID
+		if !strings.HasPrefix(id, "<") {
+			id = "<" + id + ">"
+		}
+		h.Set("Content-Id", id)
+	}
+	return h.Header
+}
+
+func writeAttachment(c *protonmail.Client, privateKeys openpgp.EntityList, mw *message.Writer, att *protonmail.Attachment) error {
+	pw, err := mw.CreatePart(attachmentHeader(att))
+	if err != nil {
+		return err
+	}
+
+	rc, err := c.GetAttachment(att, privateKeys)
+	if err != nil {
+		return fmt.Errorf("cannot get attachment %q: %v", att.Name, err)
+	}
+	_, err = io.Copy(pw, rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+
+	return pw.Close()
+}
+
+// WriteMessage writes a message in the RFC 822 format. msg must have been
+// retrieved with Client.GetMessage.
+func WriteMessage(c *protonmail.Client, privateKeys openpgp.EntityList, w io.Writer, msg *protonmail.Message) error {
+	mw, err := message.CreateWriter(w, messageHeader(msg))
+	if err != nil {
+		return err
+	}
+
+	md, err := msg.Read(privateKeys, nil)
+	if err != nil {
+		return fmt.Errorf("cannot decrypt message body: %v", err)
+	}
+
+	// Inline attachments of HTML messages are grouped with the body, so that
+	// cid: URLs can be resolved
+	var inline, regular []*protonmail.Attachment
+	for _, att := range msg.Attachments {
+		if att.IsInline() && msg.MIMEType == "text/html" {
+			inline = append(inline, att)
+		} else {
+			regular = append(regular, att)
+		}
+	}
+
+	bodyWriter := mw
+	if len(inline) > 0 {
+		h := make(message.Header)
+		h.SetContentType("multipart/related", map[string]string{"type": msg.MIMEType})
+		if bodyWriter, err = mw.CreatePart(h); err != nil {
+			return err
+		}
+	}
+
+	pw, err := bodyWriter.CreatePart(inlineHeader(msg))
+	if err != nil {
+		return err
+	}
+	// TODO: check signature
+	if _, err := io.Copy(pw, md.UnverifiedBody); err != nil {
+		return err
+	}
+	if err := pw.Close(); err != nil {
+		return err
+	}
+
+	if len(inline) > 0 {
+		for _, att := range inline {
+			if err := writeAttachment(c, privateKeys, bodyWriter, att); err != nil {
+				return err
+			}
+		}
+		if err := bodyWriter.Close(); err != nil {
+			return err
+		}
+	}
+
+	for _, att := range regular {
+		if err := writeAttachment(c, privateKeys, mw, att); err != nil {
+			return err
+		}
+	}
+
+	return mw.Close()
+}
+
+// store is a local mail store messages can be exported to.
+type store interface {
+	// Has checks whether a message has already been exported to a folder.
+	Has(folder, id string) (bool, error)
+	// Write exports a message to a folder.
+	Write(folder string, msg *protonmail.Message, write func(w io.Writer) error) error
+	Close() error
+}
+
+type ExportOptions struct {
+	Format Format
+	// If non-zero, only messages received after this date are exported.
+	Since time.Time
+}
+
+func listFolders(c *protonmail.Client) (map[string]string, error) {
+	folders := make(map[string]string)
+	for _, l := range systemLabels {
+		folders[l.id] = l.name
+	}
+
+	labels, err := c.ListLabels(protonmail.LabelMessage)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range labels {
+		folders[l.ID] = strings.Replace(l.Name, "/", "_", -1)
+	}
+
+	return folders, nil
+}
+
+func exportLabel(c *protonmail.Client, privateKeys openpgp.EntityList, s store, labelID, folder string, options *ExportOptions) (exported, skipped int, err error) {
+	filter := &protonmail.MessageFilter{
+		PageSize: 150,
+		Label:    labelID,
+		Sort:     "ID",
+		Asc:      true,
+	}
+	if !options.Since.IsZero() {
+		filter.Begin = options.Since.Unix()
+	}
+
+	c.IterMessages(filter)(func(msg *protonmail.Message, iterErr error) bool {
+		if iterErr != nil {
+			err = iterErr
+			return false
+		}
+
+		if ok, hasErr := s.Has(folder, msg.ID); hasErr != nil {
+			err = hasErr
+			return false
+		} else if ok {
+			skipped++
+			return true
+		}
+
+		full, getErr := c.GetMessage(msg.ID)
+		if getErr != nil {
+			err = fmt.Errorf("cannot get message %v: %v", msg.ID, getErr)
+			return false
+		}
+
+		writeErr := s.Write(folder, full, func(w io.Writer) error {
+			return WriteMessage(c, privateKeys, w, full)
+		})
+		if writeErr != nil {
+			err = fmt.Errorf("cannot export message %v: %v", msg.ID, writeErr)
+			return false
+		}
+		exported++
+		return true
+	})
+	return exported, skipped, err
+}
+
+// ExportMessages exports all messages to dir, with one folder per label.
+// Messages already present in dir are skipped, so that an interrupted export
+// can be resumed.
+func ExportMessages(c *protonmail.Client, privateKeys openpgp.EntityList, dir string, options *ExportOptions) error {
+	var s store
+	switch options.Format {
+	case FormatMaildir, "":
+		s = newMaildirStore(dir)
+	case FormatMbox:
+		s = newMboxStore(dir)
+	default:
+		return errors.New("unknown export format")
+	}
+	defer s.Close()
+
+	folders, err := listFolders(c)
+	if err != nil {
+		return err
+	}
+
+	for labelID, folder := range folders {
+		log.Printf("Exporting %v...", folder)
+		exported, skipped, err := exportLabel(c, privateKeys, s, labelID, folder, options)
+		if err != nil {
+			return err
+		}
+		log.Printf("Exporting %v: done, %v exported, %v skipped", folder, exported, skipped)
+	}
+
+	return s.Close()
+}
@@ -0,0 +1,314 @@
+package exports
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// entityTree describes the MIME tree of e: multipart parts are written as
+// "multipart/subtype(children)", other parts as "type/subtype:body".
+func entityTree(t *testing.T, e *message.Entity) string {
+	mediaType, _, err := e.Header.ContentType()
+	if err != nil {
+		t.Fatalf("cannot parse Content-Type: %v", err)
+	}
+
+	mr := e.MultipartReader()
+	if mr == nil {
+		b, err := ioutil.ReadAll(e.Body)
+		if err != nil {
+			t.Fatalf("cannot read part body: %v", err)
+		}
+		return mediaType + ":" + string(b)
+	}
+
+	var children []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("cannot read part: %v", err)
+		}
+		children = append(children, entityTree(t, p))
+	}
+	return mediaType + "(" + strings.Join(children, " ") + ")"
+}
+
+func TestWriteMessage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.TrimPrefix(r.URL.Path, "/attachments/")))
+	}))
+	defer srv.Close()
+	c := &protonmail.Client{RootURL: srv.URL, HTTPClient: srv.Client(), MaxRetries: -1}
+
+	inline := &protonmail.Attachment{
+		ID:        "image",
+		Name:      "image.png",
+		MIMEType:  "image/png",
+		ContentID: "image@example.org",
+		Headers:   protonmail.AttachmentHeaders{"content-disposition": "inline"},
+	}
+	regular := &protonmail.Attachment{
+		ID:       "document",
+		Name:     "document.pdf",
+		MIMEType: "application/pdf",
+	}
+
+	tests := []struct {
+		name     string
+		mimeType string
+		atts     []*protonmail.Attachment
+		want     string
+	}{
+		{
+			name:     "no attachment",
+			mimeType: "text/plain",
+			want:     "multipart/mixed(text/plain:Hello)",
+		},
+		{
+			name:     "html with inline attachment",
+			mimeType: "text/html",
+			atts:     []*protonmail.Attachment{inline, regular},
+			want:     "multipart/mixed(multipart/related(text/html:Hello image/png:image) application/pdf:document)",
+		},
+		{
+			name:     "plain text with inline attachment",
+			mimeType: "text/plain",
+			atts:     []*protonmail.Attachment{inline, regular},
+			want:     "multipart/mixed(text/plain:Hello image/png:image application/pdf:document)",
+		},
+	}
+	for _, tc := range tests {
+		msg := &protonmail.Message{
+			Subject:     "Test",
+			MIMEType:    tc.mimeType,
+			Body:        "Hello",
+			IsEncrypted: protonmail.MessageUnencrypted,
+			Attachments: tc.atts,
+		}
+
+		var b bytes.Buffer
+		if err := WriteMessage(c, nil, &b, msg); err != nil {
+			t.Errorf("%v: WriteMessage() = %v", tc.name, err)
+			continue
+		}
+		e, err := message.Read(&b)
+		if err != nil {
+			t.Errorf("%v: cannot read written message: %v", tc.name, err)
+			continue
+		}
+		if got := entityTree(t, e); got != tc.want {
+			t.Errorf("%v: WriteMessage() wrote %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAttachmentHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		att      *protonmail.Attachment
+		wantDisp string
+		wantID   string
+	}{
+		{
+			name:     "attachment",
+			att:      &protonmail.Attachment{Name: "a.pdf", MIMEType: "application/pdf"},
+			wantDisp: "attachment",
+		},
+		{
+			name: "inline",
+			att: &protonmail.Attachment{
+				Name:      "a.png",
+				MIMEType:  "image/png",
+				ContentID: "id@example.org",
+				Headers:   protonmail.AttachmentHeaders{"content-disposition": "inline"},
+			},
+			wantDisp: "inline",
+			wantID:   "<id@example.org>",
+		},
+		{
+			name:     "content ID with brackets",
+			att:      &protonmail.Attachment{Name: "a.png", MIMEType: "image/png", ContentID: "<id@example.org>"},
+			wantDisp: "attachment",
+			wantID:   "<id@example.org>",
+		},
+	}
+	for _, tc := range tests {
+		h := attachmentHeader(tc.att)
+		disp, params, err := h.ContentDisposition()
+		if err != nil {
+			t.Errorf("%v: cannot parse Content-Disposition: %v", tc.name, err)
+			continue
+		}
+		if disp != tc.wantDisp || params["filename"] != tc.att.Name {
+			t.Errorf("%v: Content-Disposition = %v %v, want %v with filename %q", tc.name, disp, params, tc.wantDisp, tc.att.Name)
+		}
+		if id := h.Get("Content-Id"); id != tc.wantID {
+			t.Errorf("%v: Content-Id = %q, want %q", tc.name, id, tc.wantID)
+		}
+	}
+}
+
+func TestMessageHeader(t *testing.T) {
+	msg := &protonmail.Message{
+		Sender: &protonmail.MessageAddress{Address: "alice@example.org", Name: "Alice"},
+		ToList: []*protonmail.MessageAddress{
+			{Address: "bob@example.org", Group: "Friends"},
+			{Address: "carol@example.org", Group: "Friends"},
+		},
+		CCList: []*protonmail.MessageAddress{{Address: "dave@example.org", Name: "dave@example.org"}},
+	}
+	h := messageHeader(msg)
+	tests := []struct {
+		k, want string
+	}{
+		{"From", `"Alice" <alice@example.org>`},
+		{"To", "Friends: <bob@example.org>, <carol@example.org>;"},
+		{"Cc", "<dave@example.org>"},
+	}
+	for _, tc := range tests {
+		if got := h.Get(tc.k); got != tc.want {
+			t.Errorf("messageHeader() %v = %q, want %q", tc.k, got, tc.want)
+		}
+	}
+
+	// The original header is used if available
+	msg.Header = "From: Original <alice@example.org>\r\n"
+	if got, want := messageHeader(msg).Get("From"), "Original <alice@example.org>"; got != want {
+		t.Errorf("messageHeader() with an original header: From = %q, want %q", got, want)
+	}
+}
+
+// testStore keeps exported messages in memory.
+type testStore struct {
+	messages map[string]string
+}
+
+func (s *testStore) Has(folder, id string) (bool, error) {
+	_, ok := s.messages[folder+"/"+id]
+	return ok, nil
+}
+
+func (s *testStore) Write(folder string, msg *protonmail.Message, write func(w io.Writer) error) error {
+	var b bytes.Buffer
+	if err := write(&b); err != nil {
+		return err
+	}
+	s.messages[folder+"/"+msg.ID] = b.String()
+	return nil
+}
+
+func (s *testStore) Close() error {
+	return nil
+}
+
+func TestExportLabel(t *testing.T) {
+	// More messages than fit in a page
+	var msgs []*protonmail.Message
+	for i := 0; i < 200; i++ {
+		msgs = append(msgs, &protonmail.Message{
+			ID:          fmt.Sprintf("msg%03d", i),
+			LabelIDs:    []string{protonmail.LabelInbox},
+			Time:        int64(i),
+			Subject:     "Test",
+			MIMEType:    "text/plain",
+			Body:        "Hello",
+			IsEncrypted: protonmail.MessageUnencrypted,
+		})
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if id := strings.TrimPrefix(r.URL.Path, "/messages/"); id != r.URL.Path {
+			if id == "msg100" {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				w.Write([]byte(`{"Code":2501,"Error":"Message does not exist"}`))
+				return
+			}
+			for _, msg := range msgs {
+				if msg.ID == id {
+					json.NewEncoder(w).Encode(map[string]interface{}{"Code": 1000, "Message": msg})
+					return
+				}
+			}
+			http.NotFound(w, r)
+			return
+		}
+
+		q := r.URL.Query()
+		page, _ := strconv.Atoi(q.Get("Page"))
+		pageSize, _ := strconv.Atoi(q.Get("PageSize"))
+		begin, _ := strconv.ParseInt(q.Get("Begin"), 10, 64)
+		var matched []*protonmail.Message
+		for _, msg := range msgs {
+			if msg.Time >= begin && msg.LabelIDs[0] == q.Get("Label") {
+				matched = append(matched, msg)
+			}
+		}
+		total := len(matched)
+		if page*pageSize < len(matched) {
+			matched = matched[page*pageSize:]
+		} else {
+			matched = nil
+		}
+		if len(matched) > pageSize {
+			matched = matched[:pageSize]
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Code": 1000, "Total": total, "Messages": matched})
+	}))
+	defer srv.Close()
+	c := &protonmail.Client{RootURL: srv.URL, HTTPClient: srv.Client(), MaxRetries: -1}
+
+	tests := []struct {
+		name         string
+		label        string
+		since        int64
+		existing     []string
+		wantExported int
+		wantSkipped  int
+		wantErr      bool
+	}{
+		{name: "empty label", label: protonmail.LabelArchive},
+		{name: "since", label: protonmail.LabelInbox, since: 150, wantExported: 50},
+		{name: "already exported", label: protonmail.LabelInbox, since: 150, existing: []string{"msg150", "msg199"}, wantExported: 48, wantSkipped: 2},
+		{name: "error", label: protonmail.LabelInbox, existing: []string{"msg000"}, wantExported: 99, wantSkipped: 1, wantErr: true},
+	}
+	for _, tc := range tests {
+		s := &testStore{messages: make(map[string]string)}
+		for _, id := range tc.existing {
+			s.messages["folder/"+id] = ""
+		}
+		options := &ExportOptions{}
+		if tc.since != 0 {
+			options.Since = time.Unix(tc.since, 0)
+		}
+
+		exported, skipped, err := exportLabel(c, nil, s, tc.label, "folder", options)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%v: exportLabel() = %v, want error: %v", tc.name, err, tc.wantErr)
+		}
+		if exported != tc.wantExported || skipped != tc.wantSkipped {
+			t.Errorf("%v: exportLabel() = %v exported, %v skipped, want %v, %v", tc.name, exported, skipped, tc.wantExported, tc.wantSkipped)
+		}
+		if len(s.messages) != len(tc.existing)+exported {
+			t.Errorf("%v: store has %v messages, want %v", tc.name, len(s.messages), len(tc.existing)+exported)
+		}
+		if b, ok := s.messages["folder/msg198"]; ok && !strings.Contains(b, "Hello") {
+			t.Errorf("%v: exported message = %q, want the body", tc.name, b)
+		}
+	}
+}
@@ -7,6 +7,8 @@ import (
 
 	"github.com/emersion/hydroxide/auth"
 	"github.com/emersion/hydroxide/events"
+	"github.com/emersion/hydroxide/imap/cache"
+	"github.com/emersion/hydroxide/protonmail"
 )
 
 var errNotYetImplemented = errors.New("not yet implemented")
@@ -15,31 +17,61 @@ type backend struct {
 	sessions      *auth.Manager
 	eventsManager *events.Manager
 	updates       chan imapbackend.Update
+	recent        *recentMessages
+	cache         *cache.Cache
+	offline       *offlineState
+	expungeDelete bool
+	matchDrafts   bool
 }
 
 func (be *backend) Login(username, password string) (imapbackend.User, error) {
+	password, appPassword, err := auth.ResolveAppPassword(username, password)
+	if err != nil {
+		return nil, err
+	}
 	c, privateKeys, err := be.sessions.Auth(username, password)
 	if err != nil {
 		return nil, err
 	}
 
 	u, err := c.GetCurrentUser()
-	if err != nil {
+	var addrs []*protonmail.Address
+	if err == nil {
+		addrs, err = c.ListAddresses()
+	}
+	if account := be.offline.account(username); protonmail.IsUnreachable(err) && account != nil {
+		// Serve the local data until the API is reachable again
+		u, addrs = account.u, account.addrs
+	} else if err != nil {
 		return nil, err
+	} else {
+		be.offline.setAccount(username, &knownAccount{u: u, addrs: addrs})
 	}
 
-	addrs, err := c.ListAddresses()
+	var cacheKey *[32]byte
+	if be.cache != nil {
+		cacheKey = cache.Key(username, password)
+	}
+
+	uu, err := newUser(be, c, u, privateKeys, addrs, cacheKey)
 	if err != nil {
 		return nil, err
 	}
-
-	return newUser(be, c, u, privateKeys, addrs)
+	if appPassword != "" {
+		uu.log.Info("logged in with app password", "app-password", appPassword)
+	}
+	return uu, nil
 }
 
 func (be *backend) Updates() <-chan imapbackend.Update {
 	return be.updates
 }
 
-func New(sessions *auth.Manager, eventsManager *events.Manager) imapbackend.Backend {
-	return &backend{sessions, eventsManager, make(chan imapbackend.Update, 50)}
+// New creates a new IMAP backend. If messageCache isn't nil, decrypted
+// messages are stored in it. If expungeDelete is true, expunged messages are
+// permanently deleted instead of being moved to the trash. If matchDrafts is
+// true, drafts appended without the Message-Id of the draft they replace are
+// matched by subject and recipients.
+func New(sessions *auth.Manager, eventsManager *events.Manager, messageCache *cache.Cache, expungeDelete, matchDrafts bool) imapbackend.Backend {
+	return &backend{sessions, eventsManager, make(chan imapbackend.Update, 50), newRecentMessages(), messageCache, newOfflineState(), expungeDelete, matchDrafts}
 }
@@ -0,0 +1,208 @@
+package imap
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	stdlog "log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	imapbackend "github.com/emersion/go-imap/backend"
+	imapserver "github.com/emersion/go-imap/server"
+
+	"github.com/emersion/hydroxide/events"
+	"github.com/emersion/hydroxide/imap/database"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// apiRequest is a bulk message request received by a test API.
+type apiRequest struct {
+	path    string
+	labelID string
+	ids     []string
+}
+
+// testAPI records the bulk message requests it receives, and replies with
+// success.
+type testAPI struct {
+	locker   sync.Mutex
+	requests []apiRequest
+}
+
+func (api *testAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		LabelID string
+		IDs     []string
+	}
+	if r.Body != nil {
+		b, _ := ioutil.ReadAll(r.Body)
+		if len(b) > 0 {
+			json.Unmarshal(b, &body)
+		}
+	}
+
+	api.locker.Lock()
+	api.requests = append(api.requests, apiRequest{r.URL.Path, body.LabelID, body.IDs})
+	api.locker.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"Code":1000}`))
+}
+
+// reset returns the requests received so far and forgets them.
+func (api *testAPI) reset() []apiRequest {
+	api.locker.Lock()
+	defer api.locker.Unlock()
+	l := api.requests
+	api.requests = nil
+	return l
+}
+
+// newTestUser returns a user whose client sends requests to handler. Its
+// system mailboxes have all been scanned and are empty. Polling doesn't wait
+// for events.
+func newTestUser(t *testing.T, handler http.Handler) *user {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	db, err := database.Open(filepath.Join(t.TempDir(), "user.db"))
+	if err != nil {
+		t.Fatalf("database.Open() = %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	eventSent := make(chan struct{})
+	close(eventSent)
+	u := &user{
+		c:              &protonmail.Client{RootURL: srv.URL, HTTPClient: srv.Client(), MaxRetries: -1},
+		u:              &protonmail.User{ID: "user", Name: "user"},
+		db:             db,
+		eventsReceiver: &events.Receiver{},
+		mailboxes:      make(map[string]*mailbox),
+		keywords:       make(map[string]string),
+		labelKeywords:  make(map[string]string),
+		recent:         newRecentMessages(),
+		offlineState:   newOfflineState(),
+		eventSent:      eventSent,
+		log:            slog.New(slog.NewTextHandler(ioutil.Discard, nil)),
+	}
+
+	for _, data := range systemMailboxes {
+		mboxDB, err := db.Mailbox(data.label)
+		if err != nil {
+			t.Fatalf("database.User.Mailbox() = %v", err)
+		}
+		u.mailboxes[data.label] = &mailbox{
+			name:        data.name,
+			label:       data.label,
+			flags:       data.flags,
+			u:           u,
+			db:          mboxDB,
+			initialized: true,
+			deleted:     make(map[string]struct{}),
+		}
+	}
+	return u
+}
+
+// addTestMessages adds messages to the local database of u.
+func addTestMessages(t *testing.T, u *user, msgs ...*protonmail.Message) {
+	for _, msg := range msgs {
+		if _, err := u.db.CreateMessage(msg); err != nil {
+			t.Fatalf("database.User.CreateMessage() = %v", err)
+		}
+	}
+}
+
+type testBackend struct {
+	u *user
+}
+
+func (be *testBackend) Login(username, password string) (imapbackend.User, error) {
+	return be.u, nil
+}
+
+// testConn is a connection to a test IMAP server, authenticated as a test
+// user.
+type testConn struct {
+	t   *testing.T
+	c   net.Conn
+	r   *bufio.Reader
+	tag int
+}
+
+// newTestConn starts an IMAP server for u with the extensions exts, and logs
+// in. The user is logged out when the test completes.
+func newTestConn(t *testing.T, u *user, exts ...imapserver.Extension) *testConn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := imapserver.New(&testBackend{u})
+	s.AllowInsecureAuth = true
+	s.ErrorLog = stdlog.New(ioutil.Discard, "", 0)
+	for _, ext := range exts {
+		s.Enable(ext)
+	}
+	go s.Serve(l)
+
+	done := make(chan struct{})
+	u.done = done
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// Wait for the user to be logged out
+		c.Close()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Error("user not logged out")
+		}
+	})
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+
+	tc := &testConn{t: t, c: c, r: bufio.NewReader(c)}
+	if _, err := tc.r.ReadString('\n'); err != nil {
+		t.Fatalf("cannot read greeting: %v", err)
+	}
+	if resp := tc.run("LOGIN user password"); !strings.HasPrefix(resp[len(resp)-1], "OK") {
+		t.Fatalf("LOGIN failed: %v", resp)
+	}
+	return tc
+}
+
+// run sends a command and returns the lines of the response, untagged
+// responses first and the tagged status last, without the tag.
+func (tc *testConn) run(cmd string) []string {
+	tc.tag++
+	tag := fmt.Sprintf("a%v", tc.tag)
+	if _, err := io.WriteString(tc.c, tag+" "+cmd+"\r\n"); err != nil {
+		tc.t.Fatalf("cannot write command: %v", err)
+	}
+
+	var lines []string
+	for {
+		line, err := tc.r.ReadString('\n')
+		if err != nil {
+			tc.t.Fatalf("cannot read response to %q: %v", cmd, err)
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		if strings.HasPrefix(line, tag+" ") {
+			return append(lines, strings.TrimPrefix(line, tag+" "))
+		}
+		lines = append(lines, line)
+	}
+}
@@ -0,0 +1,333 @@
+package imap
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/emersion/go-message"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// BINARY extension, defined in RFC 3516.
+
+const binaryCapability = "BINARY"
+
+const codeUnknownCTE imap.StatusRespCode = "UNKNOWN-CTE"
+
+// binaryItem is the value of a BINARY or BINARY.SIZE fetch item. These items
+// are written by fetchResponse, because go-imap can't format their names nor
+// literal8 values.
+type binaryItem struct {
+	name string
+	// literal is nil for BINARY.SIZE
+	literal  imap.Literal
+	literal8 bool
+	size     uint32
+}
+
+// parseBinaryItem parses a BINARY, BINARY.PEEK or BINARY.SIZE fetch item. ok
+// is false if item isn't one of these.
+func parseBinaryItem(item imap.FetchItem) (section *imap.BodySectionName, size bool, ok bool, err error) {
+	s := string(item)
+	var prefix string
+	for _, p := range []string{"BINARY.SIZE", "BINARY.PEEK", "BINARY"} {
+		if strings.HasPrefix(s, p+"[") {
+			prefix = p
+			break
+		}
+	}
+	if prefix == "" {
+		return nil, false, false, nil
+	}
+
+	// The syntax is the same as BODY, but only part numbers are allowed
+	section, err = imap.ParseBodySectionName(imap.FetchItem("BODY" + s[len(prefix):]))
+	if err != nil {
+		return nil, false, true, err
+	}
+	if section.Specifier != imap.EntireSpecifier {
+		return nil, false, true, errors.New("invalid BINARY section")
+	}
+
+	size = prefix == "BINARY.SIZE"
+	if size && len(section.Partial) > 0 {
+		return nil, false, true, errors.New("BINARY.SIZE doesn't accept a partial range")
+	}
+	return section, size, true, nil
+}
+
+func binaryItemName(section *imap.BodySectionName, size bool) string {
+	path := make([]string, len(section.Path))
+	for i, part := range section.Path {
+		path[i] = strconv.Itoa(part)
+	}
+
+	name := "BINARY"
+	if size {
+		name = "BINARY.SIZE"
+	}
+	name += "[" + strings.Join(path, ".") + "]"
+	if len(section.Partial) > 0 {
+		name += "<" + strconv.Itoa(section.Partial[0]) + ">"
+	}
+	return name
+}
+
+// writeEntityPart writes the decoded content of the part of e at path.
+func writeEntityPart(w io.Writer, e *message.Entity, path []int) error {
+	for _, n := range path {
+		mr := e.MultipartReader()
+		if mr == nil {
+			// The body of a non-multipart entity is its part 1
+			if n == 1 {
+				continue
+			}
+			return errors.New("invalid body section path")
+		}
+
+		for i := 1; ; i++ {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return errors.New("invalid body section path")
+			} else if err != nil && !message.IsUnknownEncoding(err) {
+				return err
+			}
+			if i != n {
+				continue
+			}
+
+			if err != nil {
+				return imapserver.ErrStatusResp(&imap.StatusResp{
+					Type: imap.StatusRespNo,
+					Code: codeUnknownCTE,
+					Info: err.Error(),
+				})
+			}
+			e = p
+			break
+		}
+	}
+
+	_, err := io.Copy(w, e.Body)
+	return err
+}
+
+// writeBinarySection writes the decoded content of a part of a message.
+func (mbox *mailbox) writeBinarySection(w io.Writer, msg *protonmail.Message, path []int) error {
+	if e, err := mbox.cachedMessage(msg, true); err != nil {
+		return err
+	} else if e != nil {
+		return writeEntityPart(w, e, path)
+	}
+
+	if isPGPMessage(msg) {
+		if e, err := mbox.decryptPGPMessage(msg); err != nil {
+			return err
+		} else if e != nil {
+			return writeEntityPart(w, e, path)
+		}
+	}
+
+	msg, err := mbox.u.c.GetMessage(msg.ID)
+	if err != nil {
+		return err
+	}
+
+	p := messageTree(msg).lookup(path)
+	if p == nil || p.isMultipart() {
+		return errors.New("invalid body section path")
+	}
+
+	if p.att == nil {
+		r, err := mbox.inlineBody(msg)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, r)
+		return err
+	}
+
+	rc, err := mbox.attachmentBody(p.att)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(w, rc)
+	return err
+}
+
+// nulDetector checks whether data written to it contains NUL bytes.
+type nulDetector bool
+
+func (d *nulDetector) Write(p []byte) (int, error) {
+	if bytes.IndexByte(p, 0) >= 0 {
+		*d = true
+	}
+	return len(p), nil
+}
+
+type countWriter uint32
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	*c += countWriter(len(p))
+	return len(p), nil
+}
+
+func (mbox *mailbox) fetchBinary(msg *protonmail.Message, section *imap.BodySectionName, size bool) (*binaryItem, error) {
+	item := &binaryItem{name: binaryItemName(section, size)}
+
+	// The whole message doesn't have a content transfer encoding
+	if len(section.Path) == 0 {
+		l, err := mbox.fetchBodySection(msg, &imap.BodySectionName{Partial: section.Partial})
+		if err != nil {
+			return nil, err
+		}
+		if size {
+			item.size = uint32(l.Len())
+			_, err = io.Copy(ioutil.Discard, l)
+			return item, err
+		}
+		item.literal = l
+		return item, nil
+	}
+
+	if size {
+		var n countWriter
+		if err := mbox.writeBinarySection(&n, msg, section.Path); err != nil {
+			return nil, err
+		}
+		item.size = uint32(n)
+		return item, nil
+	}
+
+	// Text parts are sent as regular literals unless they contain NUL bytes,
+	// which are only allowed in literal8
+	b := new(literalBuffer)
+	var hasNUL nulDetector
+	if err := mbox.writeBinarySection(io.MultiWriter(b, &hasNUL), msg, section.Path); err != nil {
+		b.Close()
+		return nil, err
+	}
+	item.literal = b.Literal(section)
+	item.literal8 = bool(hasNUL)
+	return item, nil
+}
+
+// trimWriter forwards everything written to it, except the last n bytes.
+type trimWriter struct {
+	w    io.Writer
+	n    int
+	tail []byte
+}
+
+func (tw *trimWriter) Write(p []byte) (int, error) {
+	buf := append(tw.tail, p...)
+	if len(buf) <= tw.n {
+		tw.tail = buf
+		return len(p), nil
+	}
+
+	k := len(buf) - tw.n
+	if _, err := tw.w.Write(buf[:k]); err != nil {
+		return 0, err
+	}
+	tw.tail = append([]byte(nil), buf[k:]...)
+	return len(p), nil
+}
+
+// fetchResponse is a FETCH response which can contain BINARY items.
+type fetchResponse struct {
+	Messages chan *imap.Message
+}
+
+func (r *fetchResponse) WriteTo(w *imap.Writer) error {
+	for msg := range r.Messages {
+		var items []*binaryItem
+		for k, v := range msg.Items {
+			if item, ok := v.(*binaryItem); ok {
+				items = append(items, item)
+				delete(msg.Items, k)
+			}
+		}
+		sort.Slice(items, func(i, j int) bool {
+			return items[i].name < items[j].name
+		})
+
+		fields := msg.Format()
+		resp := imap.NewUntaggedResp([]interface{}{msg.SeqNum, "FETCH", fields})
+		if len(items) == 0 {
+			if err := resp.WriteTo(w); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Write the regular items without the closing parenthesis and CRLF,
+		// then append the BINARY items
+		tw := &trimWriter{w: w.Writer, n: len(")\r\n")}
+		if err := resp.WriteTo(imap.NewWriter(tw)); err != nil {
+			return err
+		}
+		for i, item := range items {
+			if err := writeBinaryItem(w, item, i > 0 || len(fields) > 0); err != nil {
+				return err
+			}
+		}
+		if _, err := io.WriteString(w, ")\r\n"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeBinaryItem(w io.Writer, item *binaryItem, sep bool) error {
+	s := item.name + " "
+	if sep {
+		s = " " + s
+	}
+
+	if item.literal == nil {
+		_, err := io.WriteString(w, s+strconv.FormatUint(uint64(item.size), 10))
+		return err
+	}
+
+	if item.literal8 {
+		s += "~"
+	}
+	s += "{" + strconv.Itoa(item.literal.Len()) + "}\r\n"
+	if _, err := io.WriteString(w, s); err != nil {
+		return err
+	}
+	_, err := io.Copy(w, item.literal)
+	return err
+}
+
+type binaryExtension struct{}
+
+func (ext *binaryExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{binaryCapability}
+	}
+	return nil
+}
+
+func (ext *binaryExtension) Command(name string) imapserver.HandlerFactory {
+	// FETCH is handled by the CONDSTORE extension
+	// TODO: accept literal8 in APPEND
+	return nil
+}
+
+// NewBinaryExtension returns an IMAP server extension advertising BINARY. The
+// CONDSTORE extension must be enabled too.
+func NewBinaryExtension() imapserver.Extension {
+	return &binaryExtension{}
+}
@@ -0,0 +1,148 @@
+package imap
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+)
+
+func TestParseBinaryItem(t *testing.T) {
+	tests := []struct {
+		item     imap.FetchItem
+		ok       bool
+		wantErr  bool
+		path     []int
+		partial  []int
+		size     bool
+		wantName string
+	}{
+		{item: "BODY[]", ok: false},
+		{item: "BINARY[]", ok: true, wantName: "BINARY[]"},
+		{item: "BINARY[1.2]", ok: true, path: []int{1, 2}, wantName: "BINARY[1.2]"},
+		{item: "BINARY.PEEK[1]<10.20>", ok: true, path: []int{1}, partial: []int{10, 20}, wantName: "BINARY[1]<10>"},
+		{item: "BINARY.SIZE[2]", ok: true, path: []int{2}, size: true, wantName: "BINARY.SIZE[2]"},
+		{item: "BINARY.SIZE[2]<0.10>", ok: true, wantErr: true},
+		{item: "BINARY[1.HEADER]", ok: true, wantErr: true},
+		{item: "BINARY[TEXT]", ok: true, wantErr: true},
+	}
+	for _, tc := range tests {
+		section, size, ok, err := parseBinaryItem(tc.item)
+		if ok != tc.ok {
+			t.Errorf("parseBinaryItem(%v) ok = %v, want %v", tc.item, ok, tc.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseBinaryItem(%v) = nil, want an error", tc.item)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseBinaryItem(%v) = %v", tc.item, err)
+			continue
+		}
+		if !equalInts(section.Path, tc.path) || !equalInts(section.Partial, tc.partial) || size != tc.size {
+			t.Errorf("parseBinaryItem(%v) = %v %v %v, want %v %v %v", tc.item, section.Path, section.Partial, size, tc.path, tc.partial, tc.size)
+		}
+		if name := binaryItemName(section, size); name != tc.wantName {
+			t.Errorf("binaryItemName(%v) = %v, want %v", tc.item, name, tc.wantName)
+		}
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+const testMultipartMessage = "Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"caf=C3=A9\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"AAEC\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Transfer-Encoding: x-unknown\r\n" +
+	"\r\n" +
+	"???\r\n" +
+	"--outer--\r\n"
+
+func TestWriteEntityPart(t *testing.T) {
+	tests := []struct {
+		msg     string
+		path    []int
+		want    string
+		wantErr bool
+	}{
+		{msg: testMultipartMessage, path: []int{1}, want: "café"},
+		{msg: testMultipartMessage, path: []int{2}, want: "\x00\x01\x02"},
+		{msg: testMultipartMessage, path: []int{3}, wantErr: true},
+		{msg: testMultipartMessage, path: []int{4}, wantErr: true},
+		{msg: "Content-Transfer-Encoding: base64\r\n\r\nSGVsbG8=\r\n", path: []int{1}, want: "Hello"},
+		{msg: "Content-Type: text/plain\r\n\r\nHello", path: []int{2}, wantErr: true},
+	}
+	for _, tc := range tests {
+		e, err := message.Read(strings.NewReader(tc.msg))
+		if err != nil {
+			t.Fatalf("message.Read() = %v", err)
+		}
+
+		var b bytes.Buffer
+		err = writeEntityPart(&b, e, tc.path)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("writeEntityPart(%v) = nil, want an error", tc.path)
+			}
+		} else if err != nil {
+			t.Errorf("writeEntityPart(%v) = %v", tc.path, err)
+		} else if b.String() != tc.want {
+			t.Errorf("writeEntityPart(%v) wrote %q, want %q", tc.path, b.String(), tc.want)
+		}
+	}
+}
+
+func TestFetchResponse(t *testing.T) {
+	msg := imap.NewMessage(1, []imap.FetchItem{imap.FetchUid})
+	msg.Uid = 42
+	msg.Items["BINARY.SIZE[1]"] = &binaryItem{name: "BINARY.SIZE[1]", size: 5}
+	msg.Items["BINARY[2]"] = &binaryItem{name: "BINARY[2]", literal: bytes.NewReader([]byte("a\x00b")), literal8: true}
+	msg.Items["BINARY[1]"] = &binaryItem{name: "BINARY[1]", literal: bytes.NewReader([]byte("Hello"))}
+
+	plain := imap.NewMessage(2, []imap.FetchItem{imap.FetchUid})
+	plain.Uid = 43
+
+	ch := make(chan *imap.Message, 2)
+	ch <- msg
+	ch <- plain
+	close(ch)
+
+	var b bytes.Buffer
+	if err := (&fetchResponse{Messages: ch}).WriteTo(imap.NewWriter(&b)); err != nil {
+		t.Fatalf("WriteTo() = %v", err)
+	}
+	want := "* 1 FETCH (UID 42 BINARY.SIZE[1] 5 BINARY[1] {5}\r\nHello BINARY[2] ~{3}\r\na\x00b)\r\n" +
+		"* 2 FETCH (UID 43)\r\n"
+	if b.String() != want {
+		t.Errorf("WriteTo() wrote %q, want %q", b.String(), want)
+	}
+}
@@ -0,0 +1,90 @@
+package imap
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// cacheFormat is bumped when the way messages are written changes.
+const cacheFormat = 2
+
+// cacheVersion identifies the content of a message. ProtonMail doesn't
+// version messages, but only drafts can change and these fields change with
+// them.
+func cacheVersion(msg *protonmail.Message) string {
+	return fmt.Sprintf("%v.%v.%v.%v", cacheFormat, msg.Time, msg.Size, msg.NumAttachments)
+}
+
+// writeMessage writes a whole message, decrypted. The original source is
+// written if it's available.
+func (mbox *mailbox) writeMessage(w io.Writer, msg *protonmail.Message) error {
+	if isPGPMessage(msg) {
+		var b bytes.Buffer
+		if ok, err := mbox.writePGPMessage(&b, msg); err != nil {
+			return err
+		} else if ok {
+			_, err := io.Copy(w, &b)
+			return err
+		}
+	} else {
+		full, err := mbox.u.c.GetMessage(msg.ID)
+		if err != nil {
+			return err
+		}
+		if ok, err := mbox.writeRawMessage(w, full); err != nil || ok {
+			return err
+		}
+		msg = full
+	}
+
+	lb := new(literalBuffer)
+	section := &imap.BodySectionName{}
+	if err := mbox.writeBodySection(lb, msg, section); err != nil {
+		lb.Close()
+		return err
+	}
+	_, err := io.Copy(w, lb.Literal(section))
+	return err
+}
+
+// cachedMessage returns a message from the on-disk cache. If fetch is true and
+// the message isn't cached yet, it's fetched and stored. It returns nil if the
+// cache is disabled or if the message isn't cached and fetch is false.
+func (mbox *mailbox) cachedMessage(msg *protonmail.Message, fetch bool) (*message.Entity, error) {
+	b, err := mbox.cachedMessageBytes(msg, fetch)
+	if err != nil || b == nil {
+		return nil, err
+	}
+	return message.Read(bytes.NewReader(b))
+}
+
+// cachedMessageBytes is like cachedMessage, but returns the message as
+// written by writeMessage.
+func (mbox *mailbox) cachedMessageBytes(msg *protonmail.Message, fetch bool) ([]byte, error) {
+	c := mbox.u.cache
+	if c == nil {
+		return nil, nil
+	}
+
+	version := cacheVersion(msg)
+	if b, ok := c.Get(mbox.u.cacheKey, msg.ID, version); ok {
+		return b, nil
+	} else if !fetch {
+		return nil, nil
+	}
+
+	var b bytes.Buffer
+	if err := mbox.writeMessage(&b, msg); err != nil {
+		return nil, err
+	}
+	if err := c.Put(mbox.u.cacheKey, msg.ID, version, b.Bytes()); err != nil {
+		mbox.u.log.Warn("cannot store message in cache", "message", msg.ID, "err", err)
+	}
+	return b.Bytes(), nil
+}
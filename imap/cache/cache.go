@@ -0,0 +1,216 @@
+// Package cache implements an on-disk cache of decrypted messages.
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const tempPrefix = ".tmp-"
+
+type entry struct {
+	name string
+	size int64
+}
+
+// Cache stores decrypted messages in a directory. Entries are encrypted, and
+// the least recently used ones are evicted when the total size exceeds the
+// limit.
+type Cache struct {
+	dir     string
+	maxSize int64
+
+	locker  sync.Mutex
+	size    int64
+	lru     *list.List // front is the most recently used entry
+	entries map[string]*list.Element
+}
+
+// Open opens a cache directory, creating it if necessary. The total size of
+// the entries is kept under maxSize bytes.
+func Open(dir string, maxSize int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+
+	c := &Cache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+	for _, fi := range infos {
+		if strings.HasPrefix(fi.Name(), tempPrefix) {
+			// Left behind by an interrupted Put
+			os.Remove(filepath.Join(dir, fi.Name()))
+			continue
+		}
+		if fi.IsDir() {
+			continue
+		}
+		c.entries[fi.Name()] = c.lru.PushFront(&entry{fi.Name(), fi.Size()})
+		c.size += fi.Size()
+	}
+
+	c.locker.Lock()
+	c.evict()
+	c.locker.Unlock()
+
+	return c, nil
+}
+
+// Key derives the key used to encrypt the entries of a user from their bridge
+// credentials.
+func Key(username, password string) *[32]byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	io.WriteString(mac, "hydroxide message cache\x00"+username)
+
+	var key [32]byte
+	copy(key[:], mac.Sum(nil))
+	return &key
+}
+
+func entryName(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// evict removes the least recently used entries until the cache is small
+// enough. The caller must hold the lock.
+func (c *Cache) evict() {
+	for c.size > c.maxSize {
+		el := c.lru.Back()
+		if el == nil {
+			break
+		}
+		c.removeElement(el)
+	}
+}
+
+func (c *Cache) removeElement(el *list.Element) {
+	e := c.lru.Remove(el).(*entry)
+	delete(c.entries, e.name)
+	c.size -= e.size
+	os.Remove(filepath.Join(c.dir, e.name))
+}
+
+// Get returns the decrypted message with the specified ID and version. ok is
+// false if the message isn't cached, has changed or cannot be decrypted with
+// key.
+func (c *Cache) Get(key *[32]byte, id, version string) (b []byte, ok bool) {
+	name := entryName(id)
+
+	c.locker.Lock()
+	el, ok := c.entries[name]
+	if ok {
+		c.lru.MoveToFront(el)
+	}
+	c.locker.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	p := filepath.Join(c.dir, name)
+	encrypted, err := ioutil.ReadFile(p)
+	if err == nil && len(encrypted) > 24 {
+		var nonce [24]byte
+		copy(nonce[:], encrypted)
+		b, ok = secretbox.Open(nil, encrypted[24:], &nonce, key)
+	} else {
+		ok = false
+	}
+
+	prefix := []byte(version + "\x00")
+	if !ok || !bytes.HasPrefix(b, prefix) {
+		// Stale entry, or the bridge password has changed
+		c.Remove(id)
+		return nil, false
+	}
+
+	// Keep the LRU order across restarts
+	now := time.Now()
+	os.Chtimes(p, now, now)
+
+	return b[len(prefix):], true
+}
+
+// Put stores a decrypted message. Messages bigger than the cache aren't
+// stored.
+func (c *Cache) Put(key *[32]byte, id, version string, b []byte) error {
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return err
+	}
+	plaintext := append([]byte(version+"\x00"), b...)
+	encrypted := secretbox.Seal(nonce[:], plaintext, &nonce, key)
+
+	size := int64(len(encrypted))
+	if size > c.maxSize {
+		return nil
+	}
+
+	f, err := ioutil.TempFile(c.dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(encrypted); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	name := entryName(id)
+
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	if err := os.Rename(f.Name(), filepath.Join(c.dir, name)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	if el, ok := c.entries[name]; ok {
+		c.size -= el.Value.(*entry).size
+		c.lru.Remove(el)
+	}
+	c.entries[name] = c.lru.PushFront(&entry{name, size})
+	c.size += size
+	c.evict()
+	return nil
+}
+
+// Remove deletes a message from the cache, if present.
+func (c *Cache) Remove(id string) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	if el, ok := c.entries[entryName(id)]; ok {
+		c.removeElement(el)
+	}
+}
@@ -0,0 +1,200 @@
+package imap
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// CATENATE extension, defined in RFC 4469. Messages appended with CATENATE
+// are assembled from literals and from parts of messages of the user's
+// mailboxes, referenced by IMAP URLs as defined in RFC 5092. Only URLs of the
+// form "/<mailbox>[;UIDVALIDITY=<n>]/;UID=<n>[/;SECTION=<section>]" are
+// supported, optionally prefixed with the server.
+
+const catenateCapability = "CATENATE"
+
+const codeBadURL imap.StatusRespCode = "BADURL"
+
+// catenatePart is either a literal or an URL.
+type catenatePart struct {
+	text imap.Literal
+	url  string
+}
+
+func parseCatenate(fields []interface{}) ([]catenatePart, error) {
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		return nil, errors.New("CATENATE expects a list of parts")
+	}
+
+	parts := make([]catenatePart, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		kind, ok := fields[i].(string)
+		if !ok {
+			return nil, errors.New("invalid CATENATE part")
+		}
+		switch strings.ToUpper(kind) {
+		case "TEXT":
+			lit, ok := fields[i+1].(imap.Literal)
+			if !ok {
+				return nil, errors.New("CATENATE TEXT expects a literal")
+			}
+			parts = append(parts, catenatePart{text: lit})
+		case "URL":
+			s, err := imap.ParseString(fields[i+1])
+			if err != nil {
+				return nil, errors.New("CATENATE URL expects a string")
+			}
+			parts = append(parts, catenatePart{url: s})
+		default:
+			return nil, errors.New("unsupported CATENATE part: " + kind)
+		}
+	}
+	return parts, nil
+}
+
+func badURL(rawURL string, info string) error {
+	return imapserver.ErrStatusResp(&imap.StatusResp{
+		Type:      imap.StatusRespNo,
+		Code:      codeBadURL,
+		Arguments: []interface{}{rawURL},
+		Info:      info,
+	})
+}
+
+// cutURLParam splits s at the first occurrence of the URL parameter name,
+// e.g. "/;UID=". The name is matched case-insensitively.
+func cutURLParam(s, name string) (before, after string, ok bool) {
+	i := strings.Index(strings.ToUpper(s), name)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(name):], true
+}
+
+// ownsURLUser checks whether the user part of an IMAP URL designates the
+// logged in user.
+func (u *user) ownsURLUser(name string) bool {
+	if strings.EqualFold(name, u.u.Name) {
+		return true
+	}
+	for _, addr := range u.addrs {
+		if strings.EqualFold(name, addr.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchURL returns the data referenced by an IMAP URL. Relative URLs without a
+// mailbox refer to the selected mailbox.
+func (u *user) fetchURL(rawURL string, selected *mailbox) (imap.Literal, error) {
+	s := rawURL
+	if strings.HasPrefix(strings.ToLower(s), "imap://") {
+		s = s[len("imap://"):]
+		i := strings.IndexByte(s, '/')
+		if i < 0 {
+			return nil, badURL(rawURL, "missing message in URL")
+		}
+		server := s[:i]
+		s = s[i:]
+
+		// Only the user's own mailboxes can be referenced
+		if at := strings.LastIndexByte(server, '@'); at >= 0 {
+			name := server[:at]
+			if j := strings.IndexByte(name, ';'); j >= 0 {
+				name = name[:j]
+			}
+			name, err := url.PathUnescape(name)
+			if err != nil || !u.ownsURLUser(name) {
+				return nil, badURL(rawURL, "URL refers to another user")
+			}
+		}
+	}
+
+	mboxPart, rest, ok := cutURLParam(s, ";UID=")
+	if !ok {
+		return nil, badURL(rawURL, "missing UID in URL")
+	}
+	mboxPart = strings.TrimSuffix(mboxPart, "/")
+	uidPart, section, _ := cutURLParam(rest, "/;SECTION=")
+	if strings.Contains(uidPart, ";") || strings.Contains(section, ";") {
+		return nil, badURL(rawURL, "unsupported URL parameter")
+	}
+
+	mbox := selected
+	var uidValidity string
+	if mboxPart != "" {
+		name, validity, _ := cutURLParam(mboxPart, ";UIDVALIDITY=")
+		name, err := url.PathUnescape(strings.TrimPrefix(name, "/"))
+		if err != nil {
+			return nil, badURL(rawURL, "invalid mailbox in URL")
+		}
+		mbox = u.getMailbox(imap.CanonicalMailboxName(name))
+		uidValidity = validity
+	}
+	if mbox == nil {
+		return nil, badURL(rawURL, "no such mailbox")
+	}
+	if err := mbox.init(); err != nil {
+		return nil, err
+	}
+
+	if uidValidity != "" {
+		v, err := mbox.db.UidValidity()
+		if err != nil {
+			return nil, err
+		}
+		if uidValidity != strconv.FormatUint(uint64(v), 10) {
+			return nil, badURL(rawURL, "UIDVALIDITY mismatch")
+		}
+	}
+
+	uid, err := strconv.ParseUint(uidPart, 10, 32)
+	if err != nil || uid == 0 {
+		return nil, badURL(rawURL, "invalid UID in URL")
+	}
+	apiID, err := mbox.db.FromUid(uint32(uid))
+	if err != nil {
+		return nil, badURL(rawURL, "no such message")
+	}
+	msg, err := u.db.Message(apiID)
+	if err != nil {
+		return nil, err
+	}
+
+	section, err = url.PathUnescape(section)
+	if err != nil {
+		return nil, badURL(rawURL, "invalid section in URL")
+	}
+	bs, err := imap.ParseBodySectionName(imap.FetchItem("BODY.PEEK[" + section + "]"))
+	if err != nil {
+		return nil, badURL(rawURL, "invalid section in URL")
+	}
+	return mbox.fetchBodySection(msg, bs)
+}
+
+// catenate assembles a message from CATENATE parts.
+func (u *user) catenate(parts []catenatePart, selected *mailbox) (imap.Literal, error) {
+	b := new(literalBuffer)
+	for _, p := range parts {
+		r := p.text
+		if r == nil {
+			var err error
+			if r, err = u.fetchURL(p.url, selected); err != nil {
+				b.Close()
+				return nil, err
+			}
+		}
+		if _, err := io.Copy(b, r); err != nil {
+			b.Close()
+			return nil, err
+		}
+	}
+	return b.Literal(&imap.BodySectionName{}), nil
+}
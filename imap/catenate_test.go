@@ -0,0 +1,196 @@
+package imap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestParseCatenate(t *testing.T) {
+	lit := bytes.NewBufferString("Hello")
+	tests := []struct {
+		name    string
+		fields  []interface{}
+		want    []catenatePart
+		wantErr bool
+	}{
+		{
+			name:   "text and URL",
+			fields: []interface{}{"TEXT", lit, "url", "/INBOX/;UID=1"},
+			want:   []catenatePart{{text: lit}, {url: "/INBOX/;UID=1"}},
+		},
+		{name: "empty", fields: []interface{}{}, wantErr: true},
+		{name: "missing value", fields: []interface{}{"TEXT"}, wantErr: true},
+		{name: "text not a literal", fields: []interface{}{"TEXT", "Hello"}, wantErr: true},
+		{name: "unknown part", fields: []interface{}{"FILE", "/etc/passwd"}, wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := parseCatenate(tc.fields)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%v: parseCatenate() = %v, want an error", tc.name, got)
+			}
+		} else if err != nil {
+			t.Errorf("%v: parseCatenate() = %v", tc.name, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: parseCatenate() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCutURLParam(t *testing.T) {
+	tests := []struct {
+		s, name       string
+		before, after string
+		ok            bool
+	}{
+		{"/INBOX/;UID=1", ";UID=", "/INBOX/", "1", true},
+		{"/INBOX/;uid=1", ";UID=", "/INBOX/", "1", true},
+		{"/INBOX", ";UID=", "/INBOX", "", false},
+	}
+	for _, tc := range tests {
+		before, after, ok := cutURLParam(tc.s, tc.name)
+		if before != tc.before || after != tc.after || ok != tc.ok {
+			t.Errorf("cutURLParam(%q, %q) = %q, %q, %v, want %q, %q, %v", tc.s, tc.name, before, after, ok, tc.before, tc.after, tc.ok)
+		}
+	}
+}
+
+// newCatenateTestUser returns a user with a raw message in the inbox.
+func newCatenateTestUser(t *testing.T, raw string) *user {
+	header, body, _ := strings.Cut(raw, "\r\n\r\n")
+	u := newTestUser(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/messages/msg1" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Code": 1000,
+			"Message": &protonmail.Message{
+				ID:       "msg1",
+				MIMEType: rawMIMEType,
+				Header:   header + "\r\n",
+				Body:     body,
+				LabelIDs: []string{protonmail.LabelInbox},
+			},
+		})
+	}))
+	u.addrs = []*protonmail.Address{{Email: "user@example.org"}}
+	addTestMessages(t, u, &protonmail.Message{ID: "msg1", MIMEType: rawMIMEType, LabelIDs: []string{protonmail.LabelInbox}})
+	return u
+}
+
+func TestFetchURL(t *testing.T) {
+	const raw = "Subject: Hi\r\nContent-Type: multipart/mixed; boundary=abc\r\n\r\n--abc\r\n\r\nHello\r\n--abc--\r\n"
+	u := newCatenateTestUser(t, raw)
+	inbox := u.getMailboxByLabel(protonmail.LabelInbox)
+	uidValidity, err := inbox.db.UidValidity()
+	if err != nil {
+		t.Fatalf("UidValidity() = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		url      string
+		selected *mailbox
+		want     string
+		wantErr  bool
+	}{
+		{name: "message", url: "/INBOX/;UID=1", want: raw},
+		{name: "UIDVALIDITY", url: fmt.Sprintf("/INBOX;UIDVALIDITY=%v/;UID=1", uidValidity), want: raw},
+		{name: "escaped mailbox", url: "/%49NBOX/;UID=1", want: raw},
+		{name: "server", url: "imap://user@imap.example.org/INBOX/;UID=1", want: raw},
+		{name: "address", url: "imap://user%40example.org;AUTH=*@imap.example.org/INBOX/;UID=1", want: raw},
+		{name: "selected mailbox", url: "/;UID=1", selected: inbox, want: raw},
+		{name: "other user", url: "imap://other@imap.example.org/INBOX/;UID=1", wantErr: true},
+		{name: "UIDVALIDITY mismatch", url: fmt.Sprintf("/INBOX;UIDVALIDITY=%v/;UID=1", uidValidity+1), wantErr: true},
+		{name: "no selected mailbox", url: "/;UID=1", wantErr: true},
+		{name: "unknown mailbox", url: "/Unknown/;UID=1", wantErr: true},
+		{name: "unknown UID", url: "/INBOX/;UID=2", wantErr: true},
+		{name: "missing UID", url: "/INBOX", wantErr: true},
+		{name: "partial", url: "/INBOX/;UID=1/;PARTIAL=0.5", wantErr: true},
+		{name: "invalid section", url: "/INBOX/;UID=1/;SECTION=NOPE", wantErr: true},
+	}
+	for _, tc := range tests {
+		lit, err := u.fetchURL(tc.url, tc.selected)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%v: fetchURL(%q) = nil, want an error", tc.name, tc.url)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%v: fetchURL(%q) = %v", tc.name, tc.url, err)
+			continue
+		}
+		if b, _ := ioutil.ReadAll(lit); string(b) != tc.want {
+			t.Errorf("%v: fetchURL(%q) = %q, want %q", tc.name, tc.url, b, tc.want)
+		}
+	}
+}
+
+func TestCatenate(t *testing.T) {
+	const raw = "Subject: Hi\r\nContent-Type: multipart/mixed; boundary=abc\r\n\r\n--abc\r\n\r\nHello\r\n--abc--\r\n"
+	u := newCatenateTestUser(t, raw)
+
+	parts := []catenatePart{
+		{text: bytes.NewBufferString("X-Forwarded: yes\r\n")},
+		{url: "/INBOX/;UID=1"},
+	}
+	lit, err := u.catenate(parts, nil)
+	if err != nil {
+		t.Fatalf("catenate() = %v", err)
+	}
+	want := "X-Forwarded: yes\r\n" + raw
+	if lit.Len() != len(want) {
+		t.Errorf("catenate() literal length = %v, want %v", lit.Len(), len(want))
+	}
+	if b, _ := ioutil.ReadAll(lit); string(b) != want {
+		t.Errorf("catenate() = %q, want %q", b, want)
+	}
+
+	if _, err := u.catenate([]catenatePart{{url: "/INBOX/;UID=2"}}, nil); err == nil {
+		t.Errorf("catenate() with an unknown message = nil, want an error")
+	}
+}
+
+func TestAppendHandlerParse(t *testing.T) {
+	lit := bytes.NewBufferString("Hello")
+	tests := []struct {
+		name         string
+		fields       []interface{}
+		wantCatenate int
+		wantErr      bool
+	}{
+		{name: "literal", fields: []interface{}{"INBOX", []interface{}{imap.SeenFlag}, lit}},
+		{name: "catenate", fields: []interface{}{"INBOX", "CATENATE", []interface{}{"TEXT", lit, "URL", "/INBOX/;UID=1"}}, wantCatenate: 2},
+		{name: "catenate with flags", fields: []interface{}{"INBOX", []interface{}{imap.SeenFlag}, "catenate", []interface{}{"TEXT", lit}}, wantCatenate: 1},
+		{name: "catenate without list", fields: []interface{}{"INBOX", "CATENATE", "TEXT"}, wantErr: true},
+		{name: "invalid catenate", fields: []interface{}{"INBOX", "CATENATE", []interface{}{"TEXT"}}, wantErr: true},
+	}
+	for _, tc := range tests {
+		var h appendHandler
+		err := h.Parse(tc.fields)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%v: Parse() = nil, want an error", tc.name)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%v: Parse() = %v", tc.name, err)
+			continue
+		}
+		if h.Mailbox != "INBOX" || len(h.catenate) != tc.wantCatenate {
+			t.Errorf("%v: Parse() = mailbox %q with %v parts, want INBOX with %v parts", tc.name, h.Mailbox, len(h.catenate), tc.wantCatenate)
+		}
+	}
+}
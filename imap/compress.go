@@ -0,0 +1,150 @@
+package imap
+
+import (
+	"compress/flate"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// COMPRESS extension, defined in RFC 4978. Compression can only be enabled
+// once authenticated, so it's always applied on top of TLS: STARTTLS isn't
+// accepted anymore at this point.
+
+const (
+	compressCapability = "COMPRESS"
+	compressDeflate    = "DEFLATE"
+)
+
+const codeCompressionActive imap.StatusRespCode = "COMPRESSIONACTIVE"
+
+// deflateConn compresses the data sent and received on a connection. Data is
+// flushed after each write, so that responses aren't left in the compressor.
+type deflateConn struct {
+	net.Conn
+	r io.Reader
+	w *flate.Writer
+}
+
+func (c *deflateConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *deflateConn) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+type compressHandler struct {
+	ext       *compressExtension
+	mechanism string
+}
+
+func (h *compressHandler) Parse(fields []interface{}) error {
+	if len(fields) != 1 {
+		return errors.New("no enough arguments")
+	}
+	mechanism, err := imap.ParseString(fields[0])
+	if err != nil {
+		return err
+	}
+	h.mechanism = strings.ToUpper(mechanism)
+	return nil
+}
+
+func (h *compressHandler) Handle(conn imapserver.Conn) error {
+	if conn.Context().State&imap.AuthenticatedState == 0 {
+		return imapserver.ErrNotAuthenticated
+	}
+	if h.mechanism != compressDeflate {
+		return errors.New("Unsupported compression mechanism")
+	}
+	if h.ext.enabled(conn) {
+		return imapserver.ErrStatusResp(&imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: codeCompressionActive,
+			Info: "Compression already enabled",
+		})
+	}
+
+	return imapserver.ErrStatusResp(&imap.StatusResp{
+		Type: imap.StatusRespOk,
+		Info: "DEFLATE active",
+	})
+}
+
+func (h *compressHandler) Upgrade(conn imapserver.Conn) error {
+	err := conn.Upgrade(func(c net.Conn) (net.Conn, error) {
+		w, err := flate.NewWriter(c, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		return &deflateConn{Conn: c, r: flate.NewReader(c), w: w}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	h.ext.enable(conn)
+	return nil
+}
+
+// compressExtension keeps track of the connections with compression enabled.
+// Capabilities are queried with the connection unwrapped by other extensions,
+// so they're identified by their context.
+type compressExtension struct {
+	locker     sync.Mutex
+	compressed map[*imapserver.Context]struct{}
+}
+
+func (ext *compressExtension) enabled(conn imapserver.Conn) bool {
+	ext.locker.Lock()
+	defer ext.locker.Unlock()
+	_, ok := ext.compressed[conn.Context()]
+	return ok
+}
+
+func (ext *compressExtension) enable(conn imapserver.Conn) {
+	ctx := conn.Context()
+	ext.locker.Lock()
+	ext.compressed[ctx] = struct{}{}
+	ext.locker.Unlock()
+
+	go func() {
+		<-ctx.LoggedOut
+		ext.locker.Lock()
+		delete(ext.compressed, ctx)
+		ext.locker.Unlock()
+	}()
+}
+
+func (ext *compressExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 && !ext.enabled(c) {
+		return []string{compressCapability + "=" + compressDeflate}
+	}
+	return nil
+}
+
+func (ext *compressExtension) Command(name string) imapserver.HandlerFactory {
+	if name != compressCapability {
+		return nil
+	}
+
+	return func() imapserver.Handler {
+		return &compressHandler{ext: ext}
+	}
+}
+
+// NewCompressExtension returns an IMAP server extension implementing
+// COMPRESS=DEFLATE.
+func NewCompressExtension() imapserver.Extension {
+	return &compressExtension{compressed: make(map[*imapserver.Context]struct{})}
+}
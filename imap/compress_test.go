@@ -0,0 +1,93 @@
+package imap
+
+import (
+	"bufio"
+	"compress/flate"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompressHandlerParse(t *testing.T) {
+	tests := []struct {
+		fields  []interface{}
+		want    string
+		wantErr bool
+	}{
+		{[]interface{}{"DEFLATE"}, "DEFLATE", false},
+		{[]interface{}{"deflate"}, "DEFLATE", false},
+		{[]interface{}{}, "", true},
+		{[]interface{}{"DEFLATE", "DEFLATE"}, "", true},
+	}
+	for _, tc := range tests {
+		var h compressHandler
+		err := h.Parse(tc.fields)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("Parse(%v) = nil, want an error", tc.fields)
+			}
+		} else if err != nil {
+			t.Errorf("Parse(%v) = %v", tc.fields, err)
+		} else if h.mechanism != tc.want {
+			t.Errorf("Parse(%v) returned mechanism %q, want %q", tc.fields, h.mechanism, tc.want)
+		}
+	}
+}
+
+func newDeflateConn(t *testing.T, c net.Conn) *deflateConn {
+	w, err := flate.NewWriter(c, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &deflateConn{Conn: c, r: flate.NewReader(c), w: w}
+}
+
+func TestDeflateConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	ca, cb := newDeflateConn(t, a), newDeflateConn(t, b)
+
+	const msg = "* OK hello\r\n"
+	go ca.Write([]byte(msg))
+
+	// Writes are flushed, no need to close the writer
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(cb, buf); err != nil {
+		t.Fatalf("Read() = %v", err)
+	} else if string(buf) != msg {
+		t.Errorf("Read() = %q, want %q", buf, msg)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	u := newTestUser(t, new(testAPI))
+	tc := newTestConn(t, u, NewCompressExtension())
+
+	resp := tc.run("CAPABILITY")
+	if !strings.Contains(resp[0], " COMPRESS=DEFLATE") {
+		t.Errorf("CAPABILITY response = %q, want COMPRESS=DEFLATE", resp)
+	}
+
+	if resp := tc.run("COMPRESS LZ"); !strings.HasPrefix(resp[len(resp)-1], "NO") && !strings.HasPrefix(resp[len(resp)-1], "BAD") {
+		t.Errorf("COMPRESS LZ response = %q, want an error", resp)
+	}
+
+	if resp := tc.run("COMPRESS DEFLATE"); !reflect.DeepEqual(resp, []string{"OK DEFLATE active"}) {
+		t.Fatalf("COMPRESS response = %q, want %q", resp, "OK DEFLATE active")
+	}
+	dc := newDeflateConn(t, tc.c)
+	tc.c, tc.r = dc, bufio.NewReader(dc)
+
+	resp = tc.run("CAPABILITY")
+	if strings.Contains(resp[0], "COMPRESS") {
+		t.Errorf("CAPABILITY response = %q, want no COMPRESS", resp)
+	}
+
+	resp = tc.run("COMPRESS DEFLATE")
+	if !strings.HasPrefix(resp[len(resp)-1], "NO [COMPRESSIONACTIVE]") {
+		t.Errorf("COMPRESS response = %q, want NO [COMPRESSIONACTIVE]", resp)
+	}
+}
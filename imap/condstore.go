@@ -0,0 +1,536 @@
+package imap
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// CONDSTORE and QRESYNC extensions, defined in RFC 7162.
+
+const (
+	condStoreCapability = "CONDSTORE"
+	qresyncCapability   = "QRESYNC"
+	enableCapability    = "ENABLE"
+)
+
+const (
+	fetchModSeq         imap.FetchItem  = "MODSEQ"
+	statusHighestModSeq imap.StatusItem = "HIGHESTMODSEQ"
+)
+
+const (
+	codeHighestModSeq imap.StatusRespCode = "HIGHESTMODSEQ"
+	codeModified      imap.StatusRespCode = "MODIFIED"
+)
+
+func formatModSeq(modSeq uint64) imap.Atom {
+	return imap.Atom(strconv.FormatUint(modSeq, 10))
+}
+
+func parseModSeq(f interface{}) (uint64, error) {
+	s, ok := f.(string)
+	if !ok {
+		return 0, errors.New("mod-sequence must be a number")
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// condStoreConn keeps track of the extensions enabled by the client.
+type condStoreConn struct {
+	imapserver.Conn
+
+	condStore  bool
+	qresync    bool
+	utf8Accept bool
+}
+
+func enabledCondStore(conn imapserver.Conn) *condStoreConn {
+	if c, ok := conn.(*condStoreConn); ok {
+		return c
+	}
+	// Not wrapped, don't remember anything
+	return &condStoreConn{Conn: conn}
+}
+
+func writeVanished(conn imapserver.Conn, uids *imap.SeqSet) error {
+	if uids.Empty() {
+		return nil
+	}
+	return conn.WriteResp(imap.NewUntaggedResp([]interface{}{
+		imap.Atom("VANISHED"), []interface{}{imap.Atom("EARLIER")}, uids,
+	}))
+}
+
+func writeChangedSince(conn imapserver.Conn, mbox *mailbox, uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, changedSince uint64) error {
+	ch := make(chan *imap.Message)
+	res := &fetchResponse{Messages: ch}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.WriteResp(res)
+	}()
+
+	if err := mbox.listMessages(uid, seqSet, items, changedSince, ch); err != nil {
+		return err
+	}
+	return <-done
+}
+
+type enableHandler struct {
+	caps []string
+}
+
+func (h *enableHandler) Parse(fields []interface{}) error {
+	if len(fields) == 0 {
+		return errors.New("no capability specified")
+	}
+	for _, f := range fields {
+		s, ok := f.(string)
+		if !ok {
+			return errors.New("capability must be an atom")
+		}
+		h.caps = append(h.caps, strings.ToUpper(s))
+	}
+	return nil
+}
+
+func (h *enableHandler) Handle(conn imapserver.Conn) error {
+	if conn.Context().User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	c := enabledCondStore(conn)
+	enabled := []interface{}{imap.Atom("ENABLED")}
+	for _, cap := range h.caps {
+		switch cap {
+		case condStoreCapability:
+			c.condStore = true
+		case qresyncCapability:
+			c.condStore = true
+			c.qresync = true
+		case utf8AcceptCapability:
+			c.utf8Accept = true
+		default:
+			continue
+		}
+		enabled = append(enabled, imap.Atom(cap))
+	}
+
+	return conn.WriteResp(imap.NewUntaggedResp(enabled))
+}
+
+type qresyncParams struct {
+	uidValidity uint32
+	modSeq      uint64
+	knownUIDs   *imap.SeqSet
+}
+
+func (p *qresyncParams) parse(fields []interface{}) error {
+	if len(fields) < 2 {
+		return errors.New("QRESYNC requires a UIDVALIDITY and a mod-sequence")
+	}
+
+	var err error
+	if p.uidValidity, err = imap.ParseNumber(fields[0]); err != nil {
+		return err
+	}
+	if p.modSeq, err = parseModSeq(fields[1]); err != nil {
+		return err
+	}
+	if len(fields) > 2 {
+		// TODO: sequence match data
+		s, ok := fields[2].(string)
+		if !ok {
+			return errors.New("known UIDs must be a sequence set")
+		}
+		if p.knownUIDs, err = imap.ParseSeqSet(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type selectHandler struct {
+	imapserver.Select
+
+	condStore bool
+	qresync   *qresyncParams
+}
+
+func (h *selectHandler) Parse(fields []interface{}) error {
+	if len(fields) > 0 {
+		fields[0] = utf8MailboxArg(fields[0])
+	}
+	if err := h.Select.Parse(fields); err != nil {
+		return err
+	}
+	if len(fields) < 2 {
+		return nil
+	}
+
+	params, ok := fields[1].([]interface{})
+	if !ok {
+		return errors.New("SELECT parameters must be a list")
+	}
+	for i := 0; i < len(params); i++ {
+		name, _ := params[i].(string)
+		switch strings.ToUpper(name) {
+		case condStoreCapability:
+			h.condStore = true
+		case qresyncCapability:
+			if i+1 >= len(params) {
+				return errors.New("missing QRESYNC parameters")
+			}
+			i++
+			l, ok := params[i].([]interface{})
+			if !ok {
+				return errors.New("QRESYNC parameters must be a list")
+			}
+			h.qresync = new(qresyncParams)
+			if err := h.qresync.parse(l); err != nil {
+				return err
+			}
+		default:
+			return errors.New("unknown SELECT parameter")
+		}
+	}
+	return nil
+}
+
+func (h *selectHandler) Handle(conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	c := enabledCondStore(conn)
+	if h.qresync != nil && !c.qresync {
+		return errors.New("QRESYNC must be enabled first")
+	}
+	if h.condStore {
+		c.condStore = true
+	}
+
+	mbox, err := ctx.User.GetMailbox(h.Mailbox)
+	if err != nil {
+		return err
+	}
+
+	if mbox, ok := mbox.(*mailbox); ok {
+		mbox.u.selectMailbox(mbox, h.ReadOnly)
+	}
+
+	items := []imap.StatusItem{
+		imap.StatusMessages, imap.StatusRecent, imap.StatusUnseen,
+		imap.StatusUidNext, imap.StatusUidValidity,
+	}
+
+	status, err := mbox.Status(items)
+	if err != nil {
+		return err
+	}
+
+	ctx.Mailbox = mbox
+	ctx.MailboxReadOnly = h.ReadOnly || status.ReadOnly
+
+	if err := conn.WriteResp(&responses.Select{Mailbox: status}); err != nil {
+		return err
+	}
+
+	if mbox, ok := mbox.(*mailbox); ok {
+		if err := mbox.init(); err != nil {
+			return err
+		}
+		if mbox.u.isOffline() {
+			ctx.MailboxReadOnly = true
+		}
+
+		highestModSeq, err := mbox.db.HighestModSeq()
+		if err != nil {
+			return err
+		}
+		err = conn.WriteResp(&imap.StatusResp{
+			Type:      imap.StatusRespOk,
+			Code:      codeHighestModSeq,
+			Arguments: []interface{}{formatModSeq(highestModSeq)},
+			Info:      "Highest",
+		})
+		if err != nil {
+			return err
+		}
+
+		// If UIDVALIDITY doesn't match, the client needs to do a full resync
+		if p := h.qresync; p != nil && p.uidValidity == status.UidValidity {
+			vanished, err := mbox.vanished(p.modSeq, p.knownUIDs)
+			if err != nil {
+				return err
+			}
+			if err := writeVanished(conn, vanished); err != nil {
+				return err
+			}
+
+			seqSet, _ := imap.ParseSeqSet("1:*")
+			items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, fetchModSeq}
+			if err := writeChangedSince(conn, mbox, true, seqSet, items, p.modSeq); err != nil {
+				return err
+			}
+		}
+	}
+
+	var code imap.StatusRespCode = imap.CodeReadWrite
+	if ctx.MailboxReadOnly {
+		code = imap.CodeReadOnly
+	}
+	return imapserver.ErrStatusResp(&imap.StatusResp{
+		Type: imap.StatusRespOk,
+		Code: code,
+	})
+}
+
+type fetchHandler struct {
+	imapserver.Fetch
+
+	changedSince uint64
+	vanished     bool
+}
+
+func (h *fetchHandler) Parse(fields []interface{}) error {
+	if err := h.Fetch.Parse(fields); err != nil {
+		return err
+	}
+	if len(fields) < 3 {
+		return nil
+	}
+
+	modifiers, ok := fields[2].([]interface{})
+	if !ok {
+		return errors.New("FETCH modifiers must be a list")
+	}
+	for i := 0; i < len(modifiers); i++ {
+		name, _ := modifiers[i].(string)
+		switch strings.ToUpper(name) {
+		case "CHANGEDSINCE":
+			if i+1 >= len(modifiers) {
+				return errors.New("missing CHANGEDSINCE mod-sequence")
+			}
+			i++
+			var err error
+			if h.changedSince, err = parseModSeq(modifiers[i]); err != nil {
+				return err
+			}
+		case "VANISHED":
+			h.vanished = true
+		default:
+			return errors.New("unknown FETCH modifier")
+		}
+	}
+	return nil
+}
+
+func (h *fetchHandler) handle(uid bool, conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+
+	mbox, ok := ctx.Mailbox.(*mailbox)
+	if !ok {
+		if uid {
+			return h.Fetch.UidHandle(conn)
+		}
+		return h.Fetch.Handle(conn)
+	}
+
+	c := enabledCondStore(conn)
+	if h.vanished {
+		if !uid || h.changedSince == 0 {
+			return errors.New("VANISHED requires UID FETCH with CHANGEDSINCE")
+		}
+		if !c.qresync {
+			return errors.New("QRESYNC must be enabled first")
+		}
+	}
+
+	hasModSeq := false
+	for _, item := range h.Items {
+		if item == fetchModSeq {
+			hasModSeq = true
+			break
+		}
+	}
+	if h.changedSince > 0 && !hasModSeq {
+		h.Items = append(h.Items, fetchModSeq)
+		hasModSeq = true
+	}
+	if hasModSeq {
+		c.condStore = true
+	}
+
+	if h.vanished {
+		vanished, err := mbox.vanished(h.changedSince, h.SeqSet)
+		if err != nil {
+			return err
+		}
+		if err := writeVanished(conn, vanished); err != nil {
+			return err
+		}
+	}
+
+	return writeChangedSince(conn, mbox, uid, h.SeqSet, h.Items, h.changedSince)
+}
+
+func (h *fetchHandler) Handle(conn imapserver.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *fetchHandler) UidHandle(conn imapserver.Conn) error {
+	hasUid := false
+	for _, item := range h.Items {
+		if item == imap.FetchUid {
+			hasUid = true
+			break
+		}
+	}
+	if !hasUid {
+		h.Items = append(h.Items, imap.FetchUid)
+	}
+
+	return h.handle(true, conn)
+}
+
+type storeHandler struct {
+	imapserver.Store
+
+	unchangedSince    uint64
+	hasUnchangedSince bool
+}
+
+func (h *storeHandler) Parse(fields []interface{}) error {
+	if len(fields) > 3 {
+		if modifiers, ok := fields[1].([]interface{}); ok {
+			if len(modifiers) != 2 {
+				return errors.New("invalid STORE modifiers")
+			}
+			if name, _ := modifiers[0].(string); strings.ToUpper(name) != "UNCHANGEDSINCE" {
+				return errors.New("unknown STORE modifier")
+			}
+
+			var err error
+			if h.unchangedSince, err = parseModSeq(modifiers[1]); err != nil {
+				return err
+			}
+			h.hasUnchangedSince = true
+
+			fields = append([]interface{}{fields[0]}, fields[2:]...)
+		}
+	}
+
+	return h.Store.Parse(fields)
+}
+
+func (h *storeHandler) handle(uid bool, conn imapserver.Conn) error {
+	store := h.Store.Handle
+	if uid {
+		store = h.Store.UidHandle
+	}
+
+	ctx := conn.Context()
+	mbox, ok := ctx.Mailbox.(*mailbox)
+	if !h.hasUnchangedSince || !ok {
+		return store(conn)
+	}
+	if ctx.MailboxReadOnly {
+		return imapserver.ErrMailboxReadOnly
+	}
+
+	enabledCondStore(conn).condStore = true
+
+	if err := mbox.init(); err != nil {
+		return err
+	}
+
+	unchanged, modified, err := mbox.unchangedSince(uid, h.SeqSet, h.unchangedSince)
+	if err != nil {
+		return err
+	}
+
+	if !unchanged.Empty() {
+		h.SeqSet = unchanged
+		if err := store(conn); err != nil {
+			return err
+		}
+	}
+
+	if modified.Empty() {
+		return nil
+	}
+	return imapserver.ErrStatusResp(&imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      codeModified,
+		Arguments: []interface{}{modified},
+		Info:      "Conditional STORE failed",
+	})
+}
+
+func (h *storeHandler) Handle(conn imapserver.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *storeHandler) UidHandle(conn imapserver.Conn) error {
+	return h.handle(true, conn)
+}
+
+type condStoreExtension struct{}
+
+func (ext *condStoreExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{condStoreCapability, qresyncCapability, enableCapability}
+	}
+	return nil
+}
+
+func (ext *condStoreExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case enableCapability:
+		return func() imapserver.Handler {
+			return &enableHandler{}
+		}
+	case "SELECT":
+		return func() imapserver.Handler {
+			return &selectHandler{}
+		}
+	case "EXAMINE":
+		return func() imapserver.Handler {
+			h := &selectHandler{}
+			h.ReadOnly = true
+			return h
+		}
+	case "FETCH":
+		return func() imapserver.Handler {
+			return &fetchHandler{}
+		}
+	case "STORE":
+		return func() imapserver.Handler {
+			return &storeHandler{}
+		}
+	}
+	return nil
+}
+
+func (ext *condStoreExtension) NewConn(c imapserver.Conn) imapserver.Conn {
+	return &condStoreConn{Conn: c}
+}
+
+// NewCondStoreExtension returns an IMAP server extension implementing
+// CONDSTORE and QRESYNC.
+//
+// TODO: send VANISHED instead of EXPUNGE responses when QRESYNC is enabled,
+// and MODSEQ in unsolicited FETCH responses when CONDSTORE is enabled.
+func NewCondStoreExtension() imapserver.Extension {
+	return &condStoreExtension{}
+}
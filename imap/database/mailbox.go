@@ -6,8 +6,6 @@ import (
 	"errors"
 
 	"github.com/boltdb/bolt"
-
-	"github.com/emersion/hydroxide/protonmail"
 )
 
 func serializeUID(uid uint32) []byte {
@@ -36,12 +34,15 @@ func mailboxCreateMessage(b *bolt.Bucket, apiID string) (seqNum uint32, err erro
 	return n, b.Put(serializeUID(uid), want)
 }
 
-func mailboxDeleteMessage(b *bolt.Bucket, apiID string) (seqNum uint32, err error) {
+func mailboxDeleteMessage(b *bolt.Bucket, labelID, apiID string) (seqNum uint32, err error) {
 	want := []byte(apiID)
 	c := b.Cursor()
 	var n uint32 = 1
 	for k, v := c.First(); k != nil; k, v = c.Next() {
 		if bytes.Equal(v, want) {
+			if err := mailboxVanish(b.Tx(), labelID, unserializeUID(k)); err != nil {
+				return 0, err
+			}
 			return n, b.Delete(k)
 		}
 		n++
@@ -66,23 +67,6 @@ func (mbox *Mailbox) bucket(tx *bolt.Tx) (*bolt.Bucket, error) {
 	return b, nil
 }
 
-func (mbox *Mailbox) Sync(messages []*protonmail.Message) error {
-	return mbox.u.db.Update(func(tx *bolt.Tx) error {
-		b, err := mbox.bucket(tx)
-		if err != nil {
-			return err
-		}
-
-		for _, msg := range messages {
-			if _, err := mailboxCreateMessage(b, msg.ID); err != nil {
-				return err
-			}
-		}
-
-		return userSync(tx, messages)
-	})
-}
-
 func (mbox *Mailbox) UidNext() (uint32, error) {
 	var uid uint32
 	err := mbox.u.db.View(func(tx *bolt.Tx) error {
@@ -191,7 +175,16 @@ func (mbox *Mailbox) Reset() error {
 		if err := b.DeleteBucket(k); err != nil {
 			return err
 		}
-		_, err := b.CreateBucket(k)
-		return err
+		if _, err := b.CreateBucket(k); err != nil {
+			return err
+		}
+		if err := mailboxResetVanished(tx, mbox.labelID); err != nil {
+			return err
+		}
+		if err := mailboxResetScan(tx, mbox.labelID); err != nil {
+			return err
+		}
+		// UIDs will be reassigned
+		return mailboxBumpUIDValidity(tx, mbox.labelID)
 	})
 }
@@ -0,0 +1,102 @@
+package database
+
+import (
+	"errors"
+
+	"github.com/boltdb/bolt"
+)
+
+// Metadata entries set by clients are stored locally, in a bucket per
+// mailbox. Server entries are stored in their own bucket, and designated by
+// an empty label ID.
+
+var (
+	metadataBucket       = []byte("metadata")
+	serverMetadataBucket = []byte("servermetadata")
+)
+
+var ErrTooManyMetadata = errors.New("too many metadata entries")
+
+func metadataEntries(tx *bolt.Tx, labelID string) *bolt.Bucket {
+	if labelID == "" {
+		return tx.Bucket(serverMetadataBucket)
+	}
+	b := tx.Bucket(metadataBucket)
+	if b == nil {
+		return nil
+	}
+	return b.Bucket([]byte(labelID))
+}
+
+func createMetadataEntries(tx *bolt.Tx, labelID string) (*bolt.Bucket, error) {
+	if labelID == "" {
+		return tx.CreateBucketIfNotExists(serverMetadataBucket)
+	}
+	b, err := tx.CreateBucketIfNotExists(metadataBucket)
+	if err != nil {
+		return nil, err
+	}
+	return b.CreateBucketIfNotExists([]byte(labelID))
+}
+
+// Metadata returns the metadata entries of a mailbox.
+func (u *User) Metadata(labelID string) (map[string][]byte, error) {
+	entries := make(map[string][]byte)
+	err := u.db.View(func(tx *bolt.Tx) error {
+		b := metadataEntries(tx, labelID)
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			entries[string(k)] = append([]byte(nil), v...)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// SetMetadata sets metadata entries of a mailbox. Entries with a nil value are
+// removed. If the mailbox would have more than max entries, no entry is
+// changed and ErrTooManyMetadata is returned.
+func (u *User) SetMetadata(labelID string, entries map[string][]byte, max int) error {
+	return u.db.Update(func(tx *bolt.Tx) error {
+		b, err := createMetadataEntries(tx, labelID)
+		if err != nil {
+			return err
+		}
+
+		for k, v := range entries {
+			if v == nil {
+				err = b.Delete([]byte(k))
+			} else {
+				err = b.Put([]byte(k), v)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		n := 0
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			n++
+		}
+		if n > max {
+			return ErrTooManyMetadata
+		}
+		return nil
+	})
+}
+
+// ResetMetadata removes all metadata entries of a mailbox. Server entries are
+// kept.
+func (u *User) ResetMetadata(labelID string) error {
+	return u.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(metadataBucket)
+		if b == nil || b.Bucket([]byte(labelID)) == nil {
+			return nil
+		}
+		return b.DeleteBucket([]byte(labelID))
+	})
+}
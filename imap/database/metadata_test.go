@@ -0,0 +1,56 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMetadata(t *testing.T) {
+	u := openTestUser(t)
+
+	if entries, err := u.Metadata("label"); err != nil || len(entries) != 0 {
+		t.Errorf("Metadata() = %v, %v, want no entry", entries, err)
+	}
+
+	set := map[string][]byte{"/private/a": []byte("a"), "/private/b": []byte("b")}
+	if err := u.SetMetadata("label", set, 2); err != nil {
+		t.Fatalf("SetMetadata() = %v", err)
+	}
+	if err := u.SetMetadata("", map[string][]byte{"/shared/comment": []byte("server")}, 2); err != nil {
+		t.Fatalf("SetMetadata() for the server = %v", err)
+	}
+
+	// Changes exceeding the limit aren't applied
+	err := u.SetMetadata("label", map[string][]byte{"/private/a": nil, "/private/c": []byte("c"), "/private/d": []byte("d")}, 2)
+	if err != ErrTooManyMetadata {
+		t.Errorf("SetMetadata() over the limit = %v, want ErrTooManyMetadata", err)
+	}
+	if entries, err := u.Metadata("label"); err != nil {
+		t.Fatalf("Metadata() = %v", err)
+	} else if !reflect.DeepEqual(entries, set) {
+		t.Errorf("Metadata() = %v, want %v", entries, set)
+	}
+
+	if err := u.SetMetadata("label", map[string][]byte{"/private/a": nil, "/private/c": []byte("c")}, 2); err != nil {
+		t.Fatalf("SetMetadata() = %v", err)
+	}
+	want := map[string][]byte{"/private/b": []byte("b"), "/private/c": []byte("c")}
+	if entries, err := u.Metadata("label"); err != nil {
+		t.Fatalf("Metadata() = %v", err)
+	} else if !reflect.DeepEqual(entries, want) {
+		t.Errorf("Metadata() = %v, want %v", entries, want)
+	}
+
+	if err := u.ResetMetadata("label"); err != nil {
+		t.Fatalf("ResetMetadata() = %v", err)
+	}
+	if entries, err := u.Metadata("label"); err != nil || len(entries) != 0 {
+		t.Errorf("Metadata() after ResetMetadata() = %v, %v, want no entry", entries, err)
+	}
+	want = map[string][]byte{"/shared/comment": []byte("server")}
+	if entries, err := u.Metadata(""); err != nil {
+		t.Fatalf("Metadata() for the server = %v", err)
+	} else if !reflect.DeepEqual(entries, want) {
+		t.Errorf("Metadata() for the server = %v, want %v", entries, want)
+	}
+}
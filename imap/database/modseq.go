@@ -0,0 +1,168 @@
+package database
+
+import (
+	"encoding/binary"
+
+	"github.com/boltdb/bolt"
+)
+
+// Modification sequences are per-user: each change to a message in the local
+// database increments the user's counter.
+
+var (
+	modSeqsBucket  = []byte("modseqs")
+	vanishedBucket = []byte("vanished")
+)
+
+func serializeModSeq(modSeq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, modSeq)
+	return b
+}
+
+func unserializeModSeq(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
+
+func nextModSeq(tx *bolt.Tx) (uint64, error) {
+	b, err := tx.CreateBucketIfNotExists(modSeqsBucket)
+	if err != nil {
+		return 0, err
+	}
+	return b.NextSequence()
+}
+
+func userTouchMessage(tx *bolt.Tx, apiID string) error {
+	modSeq, err := nextModSeq(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(modSeqsBucket).Put([]byte(apiID), serializeModSeq(modSeq))
+}
+
+func userModSeq(tx *bolt.Tx, apiID string) uint64 {
+	b := tx.Bucket(modSeqsBucket)
+	if b == nil {
+		return 0
+	}
+	v := b.Get([]byte(apiID))
+	if v == nil {
+		return 0
+	}
+	return unserializeModSeq(v)
+}
+
+func userDeleteModSeq(tx *bolt.Tx, apiID string) error {
+	b := tx.Bucket(modSeqsBucket)
+	if b == nil {
+		return nil
+	}
+	return b.Delete([]byte(apiID))
+}
+
+// mailboxVanish records that a message has been removed from a mailbox.
+func mailboxVanish(tx *bolt.Tx, labelID string, uid uint32) error {
+	modSeq, err := nextModSeq(tx)
+	if err != nil {
+		return err
+	}
+
+	b, err := tx.CreateBucketIfNotExists(vanishedBucket)
+	if err != nil {
+		return err
+	}
+	b, err = b.CreateBucketIfNotExists([]byte(labelID))
+	if err != nil {
+		return err
+	}
+	return b.Put(serializeUID(uid), serializeModSeq(modSeq))
+}
+
+func mailboxResetVanished(tx *bolt.Tx, labelID string) error {
+	b := tx.Bucket(vanishedBucket)
+	if b == nil || b.Bucket([]byte(labelID)) == nil {
+		return nil
+	}
+	return b.DeleteBucket([]byte(labelID))
+}
+
+// ModSeq returns the modification sequence of a message.
+func (u *User) ModSeq(apiID string) (uint64, error) {
+	var modSeq uint64
+	err := u.db.View(func(tx *bolt.Tx) error {
+		modSeq = userModSeq(tx, apiID)
+		return nil
+	})
+	return modSeq, err
+}
+
+// TouchMessages increments the modification sequence of messages whose flags
+// have been changed outside of the local database.
+func (u *User) TouchMessages(apiIDs []string) error {
+	return u.db.Update(func(tx *bolt.Tx) error {
+		for _, apiID := range apiIDs {
+			if err := userTouchMessage(tx, apiID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// HighestModSeq returns the highest modification sequence of all messages in
+// the mailbox, including removed ones.
+func (mbox *Mailbox) HighestModSeq() (uint64, error) {
+	var highest uint64 = 1
+	err := mbox.u.db.View(func(tx *bolt.Tx) error {
+		b, err := mbox.bucket(tx)
+		if err != nil {
+			return err
+		}
+
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if modSeq := userModSeq(tx, string(v)); modSeq > highest {
+				highest = modSeq
+			}
+		}
+
+		if b := tx.Bucket(vanishedBucket); b != nil {
+			if b := b.Bucket([]byte(mbox.labelID)); b != nil {
+				c := b.Cursor()
+				for k, v := c.First(); k != nil; k, v = c.Next() {
+					if modSeq := unserializeModSeq(v); modSeq > highest {
+						highest = modSeq
+					}
+				}
+			}
+		}
+
+		return nil
+	})
+	return highest, err
+}
+
+// Vanished returns the UIDs of messages removed from the mailbox after the
+// provided modification sequence.
+func (mbox *Mailbox) Vanished(since uint64) ([]uint32, error) {
+	var uids []uint32
+	err := mbox.u.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(vanishedBucket)
+		if b == nil {
+			return nil
+		}
+		b = b.Bucket([]byte(mbox.labelID))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if unserializeModSeq(v) > since {
+				uids = append(uids, unserializeUID(k))
+			}
+		}
+		return nil
+	})
+	return uids, err
+}
@@ -0,0 +1,198 @@
+package database
+
+import (
+	"github.com/boltdb/bolt"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// Mailboxes are scanned by listing all of their messages, page by page. A scan
+// in progress has a bucket in scansBucket, containing the IDs of the messages
+// listed so far, with the next page to list as sequence. Complete scans are
+// recorded in scannedBucket. They stay valid as long as the database receives
+// all events, which is checked with the ID of the last event received.
+
+var (
+	scansBucket   = []byte("scans")
+	scannedBucket = []byte("scanned")
+	eventBucket   = []byte("event")
+)
+
+var eventIDKey = []byte("id")
+
+func mailboxCount(b *bolt.Bucket) uint32 {
+	var n uint32
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		n++
+	}
+	return n
+}
+
+func mailboxResetScan(tx *bolt.Tx, labelID string) error {
+	k := []byte(labelID)
+	if b := tx.Bucket(scansBucket); b != nil && b.Bucket(k) != nil {
+		if err := b.DeleteBucket(k); err != nil {
+			return err
+		}
+	}
+	if b := tx.Bucket(scannedBucket); b != nil {
+		return b.Delete(k)
+	}
+	return nil
+}
+
+// ScanState returns the next page to list to resume the scan of the mailbox,
+// and whether the scan is already complete.
+func (mbox *Mailbox) ScanState() (page int, done bool, err error) {
+	err = mbox.u.db.View(func(tx *bolt.Tx) error {
+		k := []byte(mbox.labelID)
+		if b := tx.Bucket(scannedBucket); b != nil && b.Get(k) != nil {
+			done = true
+			return nil
+		}
+		if b := tx.Bucket(scansBucket); b != nil {
+			if b = b.Bucket(k); b != nil {
+				page = int(b.Sequence())
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// SyncScan saves a page of messages listed by a scan. It returns the number of
+// messages in the mailbox.
+func (mbox *Mailbox) SyncScan(messages []*protonmail.Message, page int) (n uint32, err error) {
+	err = mbox.u.db.Update(func(tx *bolt.Tx) error {
+		b, err := mbox.bucket(tx)
+		if err != nil {
+			return err
+		}
+
+		scans, err := tx.CreateBucketIfNotExists(scansBucket)
+		if err != nil {
+			return err
+		}
+		scan, err := scans.CreateBucketIfNotExists([]byte(mbox.labelID))
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range messages {
+			if _, err := mailboxCreateMessage(b, msg.ID); err != nil {
+				return err
+			}
+			if err := scan.Put([]byte(msg.ID), []byte{1}); err != nil {
+				return err
+			}
+		}
+		if err := scan.SetSequence(uint64(page + 1)); err != nil {
+			return err
+		}
+
+		if err := userSync(tx, messages); err != nil {
+			return err
+		}
+
+		n = mailboxCount(b)
+		return nil
+	})
+	return
+}
+
+// EndScan removes the messages which haven't been listed by the scan, and
+// marks it complete. It returns the sequence numbers of the removed messages,
+// in the order they have been removed.
+func (mbox *Mailbox) EndScan() (seqNums []uint32, err error) {
+	err = mbox.u.db.Update(func(tx *bolt.Tx) error {
+		b, err := mbox.bucket(tx)
+		if err != nil {
+			return err
+		}
+
+		var scan *bolt.Bucket
+		if scans := tx.Bucket(scansBucket); scans != nil {
+			scan = scans.Bucket([]byte(mbox.labelID))
+		}
+
+		var removed []string
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if scan == nil || scan.Get(v) == nil {
+				removed = append(removed, string(v))
+			}
+		}
+
+		for _, apiID := range removed {
+			seqNum, err := mailboxDeleteMessage(b, mbox.labelID, apiID)
+			if err != nil {
+				return err
+			}
+			seqNums = append(seqNums, seqNum)
+		}
+
+		if err := mailboxResetScan(tx, mbox.labelID); err != nil {
+			return err
+		}
+		scanned, err := tx.CreateBucketIfNotExists(scannedBucket)
+		if err != nil {
+			return err
+		}
+		return scanned.Put([]byte(mbox.labelID), []byte{1})
+	})
+	return
+}
+
+// Count returns the number of messages in the mailbox.
+func (mbox *Mailbox) Count() (uint32, error) {
+	var n uint32
+	err := mbox.u.db.View(func(tx *bolt.Tx) error {
+		b, err := mbox.bucket(tx)
+		if err != nil {
+			return err
+		}
+
+		n = mailboxCount(b)
+		return nil
+	})
+	return n, err
+}
+
+// EventID returns the ID of the last event applied to the database.
+func (u *User) EventID() (string, error) {
+	var id string
+	err := u.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(eventBucket); b != nil {
+			id = string(b.Get(eventIDKey))
+		}
+		return nil
+	})
+	return id, err
+}
+
+func (u *User) SetEventID(id string) error {
+	return u.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(eventBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put(eventIDKey, []byte(id))
+	})
+}
+
+// ResetScans discards all scans, complete or not. Messages are kept, but all
+// mailboxes will be scanned again from the beginning.
+func (u *User) ResetScans() error {
+	return u.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{scansBucket, scannedBucket} {
+			if tx.Bucket(name) == nil {
+				continue
+			}
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
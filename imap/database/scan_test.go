@@ -0,0 +1,116 @@
+package database
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func openTestUser(t *testing.T) *User {
+	u, err := Open(filepath.Join(t.TempDir(), "user.db"))
+	if err != nil {
+		t.Fatalf("Open() = %v", err)
+	}
+	t.Cleanup(func() { u.Close() })
+	return u
+}
+
+func testMessages(ids ...string) []*protonmail.Message {
+	var l []*protonmail.Message
+	for _, id := range ids {
+		l = append(l, &protonmail.Message{ID: id, LabelIDs: []string{protonmail.LabelInbox}})
+	}
+	return l
+}
+
+func mailboxIDs(t *testing.T, mbox *Mailbox) []string {
+	var ids []string
+	err := mbox.ForEach(func(seqNum, uid uint32, apiID string) error {
+		ids = append(ids, apiID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Mailbox.ForEach() = %v", err)
+	}
+	return ids
+}
+
+func checkScanState(t *testing.T, mbox *Mailbox, wantPage int, wantDone bool) {
+	t.Helper()
+	page, done, err := mbox.ScanState()
+	if err != nil {
+		t.Fatalf("ScanState() = %v", err)
+	} else if page != wantPage || done != wantDone {
+		t.Errorf("ScanState() = %v, %v, want %v, %v", page, done, wantPage, wantDone)
+	}
+}
+
+func TestScan(t *testing.T) {
+	u := openTestUser(t)
+	mbox, err := u.Mailbox(protonmail.LabelInbox)
+	if err != nil {
+		t.Fatalf("Mailbox() = %v", err)
+	}
+
+	// Left over from a previous scan, removed by this one
+	if _, err := u.CreateMessage(testMessages("old")[0]); err != nil {
+		t.Fatalf("CreateMessage() = %v", err)
+	}
+	checkScanState(t, mbox, 0, false)
+
+	pages := [][]string{{"msg1", "msg2"}, {"msg3"}}
+	for i, ids := range pages {
+		n, err := mbox.SyncScan(testMessages(ids...), i)
+		if err != nil {
+			t.Fatalf("SyncScan(%v) = %v", i, err)
+		}
+		if want := uint32(1 + 2 + i); n != want {
+			t.Errorf("SyncScan(%v) = %v, want %v", i, n, want)
+		}
+		checkScanState(t, mbox, i+1, false)
+	}
+
+	seqNums, err := mbox.EndScan()
+	if err != nil {
+		t.Fatalf("EndScan() = %v", err)
+	}
+	if want := []uint32{1}; !reflect.DeepEqual(seqNums, want) {
+		t.Errorf("EndScan() = %v, want %v", seqNums, want)
+	}
+	if ids, want := mailboxIDs(t, mbox), []string{"msg1", "msg2", "msg3"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("mailbox messages = %v, want %v", ids, want)
+	}
+	checkScanState(t, mbox, 0, true)
+
+	// Other mailboxes aren't affected
+	other, err := u.Mailbox(protonmail.LabelArchive)
+	if err != nil {
+		t.Fatalf("Mailbox() = %v", err)
+	}
+	checkScanState(t, other, 0, false)
+
+	if err := u.ResetScans(); err != nil {
+		t.Fatalf("ResetScans() = %v", err)
+	}
+	checkScanState(t, mbox, 0, false)
+	if n, err := mbox.Count(); err != nil {
+		t.Fatalf("Count() = %v", err)
+	} else if n != 3 {
+		t.Errorf("Count() after ResetScans() = %v, want 3", n)
+	}
+}
+
+func TestEventID(t *testing.T) {
+	u := openTestUser(t)
+	if id, err := u.EventID(); err != nil || id != "" {
+		t.Errorf("EventID() = %q, %v, want an empty ID", id, err)
+	}
+	if err := u.SetEventID("event"); err != nil {
+		t.Fatalf("SetEventID() = %v", err)
+	}
+	if id, err := u.EventID(); err != nil || id != "event" {
+		t.Errorf("EventID() = %q, %v, want %q", id, err, "event")
+	}
+}
@@ -0,0 +1,57 @@
+package database
+
+import (
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// UIDs are stable as long as the mailbox isn't reset. Each mailbox has its
+// own UIDVALIDITY, which changes only when UIDs are reassigned.
+
+var uidValidityBucket = []byte("uidvalidity")
+
+// mailboxInitUIDValidity sets the UIDVALIDITY value of a mailbox if it doesn't
+// have one yet.
+func mailboxInitUIDValidity(tx *bolt.Tx, labelID string) error {
+	b, err := tx.CreateBucketIfNotExists(uidValidityBucket)
+	if err != nil {
+		return err
+	}
+	if b.Get([]byte(labelID)) != nil {
+		return nil
+	}
+	return b.Put([]byte(labelID), serializeUID(uint32(time.Now().Unix())))
+}
+
+// mailboxBumpUIDValidity changes the UIDVALIDITY value of a mailbox. The new
+// value is always greater than the previous one.
+func mailboxBumpUIDValidity(tx *bolt.Tx, labelID string) error {
+	b, err := tx.CreateBucketIfNotExists(uidValidityBucket)
+	if err != nil {
+		return err
+	}
+
+	uidValidity := uint32(time.Now().Unix())
+	if v := b.Get([]byte(labelID)); v != nil {
+		if prev := unserializeUID(v); prev >= uidValidity {
+			uidValidity = prev + 1
+		}
+	}
+	return b.Put([]byte(labelID), serializeUID(uidValidity))
+}
+
+func (mbox *Mailbox) UidValidity() (uint32, error) {
+	var uidValidity uint32 = 1
+	err := mbox.u.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(uidValidityBucket)
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte(mbox.labelID)); v != nil {
+			uidValidity = unserializeUID(v)
+		}
+		return nil
+	})
+	return uidValidity, err
+}
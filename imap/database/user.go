@@ -1,8 +1,10 @@
 package database
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"sync"
 
 	"github.com/boltdb/bolt"
 
@@ -35,7 +37,13 @@ func userCreateMessage(b *bolt.Bucket, msg *protonmail.Message) error {
 	if err != nil {
 		return err
 	}
-	return b.Put(k, v)
+	if bytes.Equal(b.Get(k), v) {
+		return nil
+	}
+	if err := b.Put(k, v); err != nil {
+		return err
+	}
+	return userTouchMessage(b.Tx(), msg.ID)
 }
 
 func userSync(tx *bolt.Tx, messages []*protonmail.Message) error {
@@ -53,8 +61,17 @@ func userSync(tx *bolt.Tx, messages []*protonmail.Message) error {
 	return nil
 }
 
+// Databases are shared between all sessions of a user, since a bolt database
+// can only be opened once.
+var (
+	openedLock sync.Mutex
+	opened     = make(map[string]*User)
+)
+
 type User struct {
-	db *bolt.DB
+	db   *bolt.DB
+	path string
+	refs int
 }
 
 func (u *User) Mailbox(labelID string) (*Mailbox, error) {
@@ -63,8 +80,10 @@ func (u *User) Mailbox(labelID string) (*Mailbox, error) {
 		if err != nil {
 			return err
 		}
-		_, err = b.CreateBucketIfNotExists([]byte(labelID))
-		return err
+		if _, err := b.CreateBucketIfNotExists([]byte(labelID)); err != nil {
+			return err
+		}
+		return mailboxInitUIDValidity(tx, labelID)
 	})
 	if err != nil {
 		return nil, err
@@ -166,7 +185,7 @@ func (u *User) UpdateMessage(apiID string, update *protonmail.EventMessageUpdate
 				continue
 			}
 
-			seqNum, err := mailboxDeleteMessage(mbox, apiID)
+			seqNum, err := mailboxDeleteMessage(mbox, labelID, apiID)
 			if err != nil {
 				return err
 			}
@@ -197,6 +216,9 @@ func (u *User) DeleteMessage(apiID string) (seqNums map[string]uint32, err error
 		if err := messages.Delete([]byte(apiID)); err != nil {
 			return err
 		}
+		if err := userDeleteModSeq(tx, apiID); err != nil {
+			return err
+		}
 
 		mailboxes := tx.Bucket(mailboxesBucket)
 		if mailboxes == nil {
@@ -208,7 +230,7 @@ func (u *User) DeleteMessage(apiID string) (seqNums map[string]uint32, err error
 				continue
 			}
 
-			seqNum, err := mailboxDeleteMessage(mbox, msg.ID)
+			seqNum, err := mailboxDeleteMessage(mbox, labelID, msg.ID)
 			if err != nil {
 				return err
 			}
@@ -221,6 +243,14 @@ func (u *User) DeleteMessage(apiID string) (seqNums map[string]uint32, err error
 }
 
 func (u *User) Close() error {
+	openedLock.Lock()
+	defer openedLock.Unlock()
+
+	u.refs--
+	if u.refs > 0 {
+		return nil
+	}
+	delete(opened, u.path)
 	return u.db.Close()
 }
 
@@ -230,10 +260,20 @@ func Open(filename string) (*User, error) {
 		return nil, err
 	}
 
-	db, err := bolt.Open(p, 0700, nil)
+	openedLock.Lock()
+	defer openedLock.Unlock()
+
+	if u, ok := opened[p]; ok {
+		u.refs++
+		return u, nil
+	}
+
+	db, err := bolt.Open(p, 0600, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	return &User{db}, nil
+	u := &User{db: db, path: p, refs: 1}
+	opened[p] = u
+	return u, nil
 }
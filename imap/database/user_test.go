@@ -0,0 +1,40 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/emersion/hydroxide/config"
+)
+
+func TestOpen(t *testing.T) {
+	d := t.TempDir()
+	config.SetDir(d)
+	defer config.SetDir("")
+
+	u, err := Open("user.db")
+	if err != nil {
+		t.Fatalf("Open() = %v", err)
+	}
+	defer u.Close()
+
+	fi, err := os.Stat(filepath.Join(d, "user.db"))
+	if err != nil {
+		t.Fatalf("Open() didn't create the database in the config directory: %v", err)
+	} else if mode := fi.Mode().Perm(); mode != 0600 {
+		t.Errorf("database mode = %v, want %v", mode, os.FileMode(0600))
+	}
+
+	// Databases already opened are shared
+	other, err := Open("user.db")
+	if err != nil {
+		t.Fatalf("Open() = %v", err)
+	}
+	if other != u {
+		t.Errorf("Open() returned a new database while it's already opened")
+	}
+	if err := other.Close(); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package imap
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// IDLE extension, defined in RFC 2177.
+
+const idleCapability = "IDLE"
+
+const idleDoneLine = "DONE"
+
+type idleHandler struct {
+	// timeouts, if set, applies the IDLE timeout while idling
+	timeouts *timeoutExtension
+}
+
+func (h *idleHandler) Parse(fields []interface{}) error {
+	return nil
+}
+
+func (h *idleHandler) Handle(conn imapserver.Conn) error {
+	// Poll events often while idling, so that updates are pushed quickly
+	if u, ok := conn.Context().User.(*user); ok {
+		stop := u.eventsReceiver.Idle()
+		defer stop()
+	}
+
+	if h.timeouts != nil {
+		restore := h.timeouts.idle(conn.Context())
+		defer restore()
+	}
+
+	cont := &imap.ContinuationReq{Info: "idling"}
+	if err := conn.WriteResp(cont); err != nil {
+		return err
+	}
+
+	// Updates are sent to the client by the server while waiting for DONE. If
+	// the connection is closed, the user is logged out and its events
+	// subscription is released.
+	scanner := bufio.NewScanner(conn)
+	scanner.Scan()
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if strings.ToUpper(scanner.Text()) != idleDoneLine {
+		return errors.New("expected DONE")
+	}
+	return nil
+}
+
+type idleExtension struct{}
+
+func (ext *idleExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{idleCapability}
+	}
+	return nil
+}
+
+func (ext *idleExtension) Command(name string) imapserver.HandlerFactory {
+	if name != idleCapability {
+		return nil
+	}
+
+	return func() imapserver.Handler {
+		return &idleHandler{}
+	}
+}
+
+// NewIdleExtension returns an IMAP server extension implementing IDLE.
+func NewIdleExtension() imapserver.Extension {
+	return &idleExtension{}
+}
@@ -0,0 +1,78 @@
+package imap
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// Labels which aren't folders are also exposed as keywords, so that clients
+// can see and edit all the labels of a message from any mailbox.
+const labelKeywordPrefix = "$Label_"
+
+// labelKeyword returns the keyword of a label. Characters which aren't allowed
+// in flags are replaced.
+func labelKeyword(label *protonmail.Label) string {
+	return labelKeywordPrefix + strings.Map(func(r rune) rune {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune(`(){%*"\]`, r) {
+			return '_'
+		}
+		return r
+	}, label.Name)
+}
+
+// setKeywords updates keywords from labels. The user must be locked.
+func (u *user) setKeywords(list []*protonmail.Label) {
+	u.keywords = make(map[string]string)
+	u.labelKeywords = make(map[string]string)
+	for _, label := range list {
+		if label.Exclusive != 0 {
+			continue
+		}
+
+		keyword := labelKeyword(label)
+		// Flags are case-insensitive
+		k := strings.ToLower(keyword)
+		if _, ok := u.keywords[k]; ok {
+			continue
+		}
+		u.keywords[k] = label.ID
+		u.labelKeywords[label.ID] = keyword
+	}
+}
+
+// listKeywords returns all the keywords, sorted.
+func (u *user) listKeywords() []string {
+	u.locker.Lock()
+	defer u.locker.Unlock()
+
+	l := make([]string, 0, len(u.labelKeywords))
+	for _, keyword := range u.labelKeywords {
+		l = append(l, keyword)
+	}
+	sort.Strings(l)
+	return l
+}
+
+func (u *user) messageKeywords(msg *protonmail.Message) []string {
+	u.locker.Lock()
+	defer u.locker.Unlock()
+
+	var l []string
+	for _, labelID := range msg.LabelIDs {
+		if keyword, ok := u.labelKeywords[labelID]; ok {
+			l = append(l, keyword)
+		}
+	}
+	return l
+}
+
+// keywordLabel returns the ID of the label exposed as keyword.
+func (u *user) keywordLabel(keyword string) (string, bool) {
+	u.locker.Lock()
+	defer u.locker.Unlock()
+
+	labelID, ok := u.keywords[strings.ToLower(keyword)]
+	return labelID, ok
+}
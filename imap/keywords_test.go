@@ -0,0 +1,92 @@
+package imap
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestLabelKeyword(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"Work", "$Label_Work"},
+		{"To do", "$Label_To_do"},
+		{"a(b)c{d}%*\"\\]", "$Label_a_b_c_d}_____"},
+		{"Café", "$Label_Caf_"},
+		{"tab\there", "$Label_tab_here"},
+	}
+	for _, tc := range tests {
+		if got := labelKeyword(&protonmail.Label{Name: tc.name}); got != tc.want {
+			t.Errorf("labelKeyword(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSetKeywords(t *testing.T) {
+	u := &user{}
+	u.setKeywords([]*protonmail.Label{
+		{ID: "work", Name: "Work"},
+		{ID: "folder", Name: "Folder", Exclusive: 1},
+		{ID: "home", Name: "Home"},
+		{ID: "work2", Name: "WORK"},
+	})
+
+	if got, want := u.listKeywords(), []string{"$Label_Home", "$Label_Work"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("listKeywords() = %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		keyword string
+		want    string
+		ok      bool
+	}{
+		{"$Label_Work", "work", true},
+		{"$label_work", "work", true},
+		{"$LABEL_HOME", "home", true},
+		{"$Label_Folder", "", false},
+		{"Work", "", false},
+	}
+	for _, tc := range tests {
+		if got, ok := u.keywordLabel(tc.keyword); got != tc.want || ok != tc.ok {
+			t.Errorf("keywordLabel(%q) = %q, %v, want %q, %v", tc.keyword, got, ok, tc.want, tc.ok)
+		}
+	}
+
+	msg := &protonmail.Message{LabelIDs: []string{protonmail.LabelInbox, "folder", "home", "work2"}}
+	if got, want := u.messageKeywords(msg), []string{"$Label_Home"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("messageKeywords() = %v, want %v", got, want)
+	}
+}
+
+func TestKeywordFlags(t *testing.T) {
+	u := newTestUser(t, new(testAPI))
+	u.setKeywords([]*protonmail.Label{{ID: "work", Name: "Work"}})
+	addTestMessages(t, u, &protonmail.Message{
+		ID:       "msg1",
+		Unread:   1,
+		LabelIDs: []string{protonmail.LabelInbox, "work"},
+	})
+	u.getMailboxByLabel(protonmail.LabelInbox).total = 1
+	tc := newTestConn(t, u)
+
+	resp := tc.run("SELECT INBOX")
+	if !strings.HasPrefix(resp[len(resp)-1], "OK") {
+		t.Fatalf("SELECT failed: %v", resp)
+	}
+	var flags, permanentFlags bool
+	for _, line := range resp {
+		flags = flags || (strings.HasPrefix(line, "* FLAGS (") && strings.Contains(line, "$Label_Work"))
+		permanentFlags = permanentFlags || (strings.Contains(line, "[PERMANENTFLAGS (") && strings.Contains(line, "$Label_Work"))
+	}
+	if !flags || !permanentFlags {
+		t.Errorf("SELECT response = %q, want $Label_Work in FLAGS and PERMANENTFLAGS", resp)
+	}
+
+	resp = tc.run("FETCH 1 FLAGS")
+	if want := []string{"* 1 FETCH (FLAGS ($Label_Work))", "OK FETCH completed"}; !reflect.DeepEqual(resp, want) {
+		t.Errorf("FETCH response = %q, want %q", resp, want)
+	}
+}
@@ -0,0 +1,270 @@
+package imap
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// Custom labels are exposed in two hierarchies: folders (exclusive labels,
+// which can be nested) and labels (which can overlap, and can't be nested).
+const (
+	foldersMailbox = "Folders"
+	labelsMailbox  = "Labels"
+)
+
+const hasChildrenAttr = "\\HasChildren"
+
+var errNotCustomMailbox = errors.New("only mailboxes under " + foldersMailbox + " and " + labelsMailbox + " can be modified")
+
+// labelPath returns the path of a label, with parent folders separated by the
+// delimiter.
+func labelPath(label *protonmail.Label, labels map[string]*protonmail.Label) string {
+	path := label.Name
+	seen := map[string]bool{label.ID: true}
+	for parentID := label.ParentID; parentID != ""; {
+		parent, ok := labels[parentID]
+		if !ok || seen[parentID] {
+			break
+		}
+		seen[parentID] = true
+		path = parent.Name + delimiter + path
+		parentID = parent.ParentID
+	}
+	return path
+}
+
+func labelMailboxName(label *protonmail.Label, labels map[string]*protonmail.Label) string {
+	if label.Exclusive != 0 {
+		return foldersMailbox + delimiter + labelPath(label, labels)
+	}
+	// Labels are flat, don't interpret delimiters in their name
+	return labelsMailbox + delimiter + strings.Replace(label.Name, delimiter, "_", -1)
+}
+
+// setLabels synchronizes custom mailboxes with labels. The user must be
+// locked.
+func (u *user) setLabels(list []*protonmail.Label) error {
+	labels := make(map[string]*protonmail.Label, len(list))
+	hasChildren := make(map[string]bool)
+	for _, label := range list {
+		labels[label.ID] = label
+		if label.ParentID != "" {
+			hasChildren[label.ParentID] = true
+		}
+	}
+
+	for labelID, mbox := range u.mailboxes {
+		if _, ok := labels[labelID]; mbox.custom && !ok {
+			delete(u.mailboxes, labelID)
+			if err := u.db.ResetMetadata(labelID); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, label := range list {
+		var attrs []string
+		if label.Exclusive == 0 {
+			attrs = []string{imap.NoInferiorsAttr}
+		} else if hasChildren[label.ID] {
+			attrs = []string{hasChildrenAttr}
+		} else {
+			attrs = []string{hasNoChildrenAttr}
+		}
+
+		name := labelMailboxName(label, labels)
+		if mbox, ok := u.mailboxes[label.ID]; ok {
+			mbox.name = name
+			mbox.attrs = attrs
+			continue
+		}
+
+		mboxDB, err := u.db.Mailbox(label.ID)
+		if err != nil {
+			return err
+		}
+
+		u.mailboxes[label.ID] = &mailbox{
+			name:    name,
+			label:   label.ID,
+			attrs:   attrs,
+			custom:  true,
+			u:       u,
+			db:      mboxDB,
+			deleted: make(map[string]struct{}),
+		}
+	}
+
+	u.labels = labels
+	u.setKeywords(list)
+	return nil
+}
+
+func (u *user) refreshLabels() error {
+	labels, err := u.c.ListLabels(protonmail.LabelMessage)
+	if err != nil {
+		return err
+	}
+	u.offlineState.setLabels(u.u.Name, labels)
+
+	u.locker.Lock()
+	defer u.locker.Unlock()
+	return u.setLabels(labels)
+}
+
+// listContainers returns the mailboxes containing custom mailboxes. They
+// can't be selected.
+func (u *user) listContainers() []imapbackend.Mailbox {
+	return []imapbackend.Mailbox{
+		&mailbox{name: foldersMailbox, attrs: []string{imap.NoSelectAttr, hasChildrenAttr}},
+		&mailbox{name: labelsMailbox, attrs: []string{imap.NoSelectAttr, hasChildrenAttr}},
+	}
+}
+
+// parseCustomMailboxName splits a custom mailbox name into its hierarchy
+// (Folders or Labels), its parent folder and its name.
+func (u *user) parseCustomMailboxName(name string) (exclusive bool, parent *mailbox, leaf string, err error) {
+	parts := strings.Split(name, delimiter)
+	if len(parts) < 2 || parts[len(parts)-1] == "" {
+		return false, nil, "", errNotCustomMailbox
+	}
+
+	switch parts[0] {
+	case foldersMailbox:
+		exclusive = true
+	case labelsMailbox:
+		if len(parts) > 2 {
+			return false, nil, "", errors.New("labels can't be nested, use " + foldersMailbox + " instead")
+		}
+	default:
+		return false, nil, "", errNotCustomMailbox
+	}
+
+	leaf = parts[len(parts)-1]
+	if len(parts) > 2 {
+		parentName := strings.Join(parts[:len(parts)-1], delimiter)
+		parent = u.getMailbox(parentName)
+		if parent == nil {
+			return false, nil, "", errors.New("parent folder doesn't exist: " + parentName)
+		}
+	}
+	return exclusive, parent, leaf, nil
+}
+
+func (u *user) CreateMailbox(name string) error {
+	if u.getMailbox(name) != nil {
+		return errors.New("mailbox already exists")
+	}
+
+	exclusive, parent, leaf, err := u.parseCustomMailboxName(name)
+	if err != nil {
+		return err
+	}
+
+	label := &protonmail.Label{
+		Name: leaf,
+		Type: protonmail.LabelMessage,
+	}
+	if exclusive {
+		label.Exclusive = 1
+	}
+	if parent != nil {
+		label.ParentID = parent.label
+	}
+
+	if _, err := u.c.CreateLabel(label); err != nil {
+		return err
+	}
+	return u.refreshLabels()
+}
+
+// customMailbox returns the custom mailbox with the provided name and its
+// label.
+func (u *user) customMailbox(name string) (*mailbox, *protonmail.Label, error) {
+	mbox := u.getMailbox(name)
+	if mbox == nil {
+		return nil, nil, imapbackend.ErrNoSuchMailbox
+	}
+	if !mbox.custom {
+		return nil, nil, errNotCustomMailbox
+	}
+
+	u.locker.Lock()
+	label, ok := u.labels[mbox.label]
+	u.locker.Unlock()
+	if !ok {
+		return nil, nil, imapbackend.ErrNoSuchMailbox
+	}
+	return mbox, label, nil
+}
+
+func (u *user) DeleteMailbox(name string) error {
+	_, label, err := u.customMailbox(name)
+	if err != nil {
+		return err
+	}
+
+	// Delete children first, deepest ones first
+	var children []*mailbox
+	u.locker.Lock()
+	for _, mbox := range u.mailboxes {
+		if mbox.custom && strings.HasPrefix(mbox.name, name+delimiter) {
+			children = append(children, mbox)
+		}
+	}
+	u.locker.Unlock()
+	sort.Slice(children, func(i, j int) bool {
+		return len(children[i].name) > len(children[j].name)
+	})
+
+	for _, child := range children {
+		if err := u.c.DeleteLabel(child.label); err != nil {
+			return err
+		}
+	}
+	if err := u.c.DeleteLabel(label.ID); err != nil {
+		return err
+	}
+	return u.refreshLabels()
+}
+
+func (u *user) RenameMailbox(existingName, newName string) error {
+	_, label, err := u.customMailbox(existingName)
+	if err != nil {
+		return err
+	}
+	if u.getMailbox(newName) != nil {
+		return errors.New("mailbox already exists")
+	}
+
+	exclusive, parent, leaf, err := u.parseCustomMailboxName(newName)
+	if err != nil {
+		return err
+	}
+	if exclusive != (label.Exclusive != 0) {
+		return errors.New("cannot move mailboxes between " + foldersMailbox + " and " + labelsMailbox)
+	}
+	if parent != nil && (parent.name == existingName || strings.HasPrefix(parent.name, existingName+delimiter)) {
+		return errors.New("cannot move a folder into itself")
+	}
+
+	updated := *label
+	updated.Name = leaf
+	updated.ParentID = ""
+	if parent != nil {
+		updated.ParentID = parent.label
+	}
+	updated.Path = ""
+
+	// Children keep their parent, their names are updated by refreshLabels
+	if _, err := u.c.UpdateLabel(&updated); err != nil {
+		return err
+	}
+	return u.refreshLabels()
+}
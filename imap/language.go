@@ -0,0 +1,99 @@
+package imap
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// LANGUAGE and I18NLEVEL=1 extensions, defined in RFC 5255. Responses are only
+// available in English. Searches already compare strings case-insensitively,
+// as I18NLEVEL=1 requires.
+
+const (
+	languageCapability  = "LANGUAGE"
+	i18nLevelCapability = "I18NLEVEL=1"
+)
+
+// languages lists the supported language tags.
+var languages = []string{"i-default", "en"}
+
+// matchLanguage checks whether a language range, as defined in RFC 4647,
+// matches a supported language. Ranges are matched leniently: any English
+// variant selects English.
+func matchLanguage(r string) (string, bool) {
+	r = strings.ToLower(r)
+	switch {
+	case r == "*", r == "en", strings.HasPrefix(r, "en-"):
+		return "en", true
+	case r == "i-default":
+		return "i-default", true
+	}
+	return "", false
+}
+
+type languageResponse struct {
+	languages []string
+}
+
+func (r *languageResponse) WriteTo(w *imap.Writer) error {
+	l := make([]interface{}, len(r.languages))
+	for i, lang := range r.languages {
+		l[i] = imap.Atom(lang)
+	}
+	return imap.NewUntaggedResp([]interface{}{languageCapability, l}).WriteTo(w)
+}
+
+type languageHandler struct {
+	ranges []string
+}
+
+func (h *languageHandler) Parse(fields []interface{}) error {
+	var err error
+	h.ranges, err = imap.ParseStringList(fields)
+	return err
+}
+
+func (h *languageHandler) Handle(conn imapserver.Conn) error {
+	if len(h.ranges) == 0 {
+		return conn.WriteResp(&languageResponse{languages})
+	}
+
+	// The first supported range is selected
+	for _, r := range h.ranges {
+		if lang, ok := matchLanguage(r); ok {
+			if err := conn.WriteResp(&languageResponse{[]string{lang}}); err != nil {
+				return err
+			}
+			return imapserver.ErrStatusResp(&imap.StatusResp{
+				Type: imap.StatusRespOk,
+				Info: "Using " + lang,
+			})
+		}
+	}
+	return errors.New("Unsupported languages, only English is available")
+}
+
+type languageExtension struct{}
+
+func (ext *languageExtension) Capabilities(c imapserver.Conn) []string {
+	return []string{languageCapability, i18nLevelCapability}
+}
+
+func (ext *languageExtension) Command(name string) imapserver.HandlerFactory {
+	if name != languageCapability {
+		return nil
+	}
+
+	return func() imapserver.Handler {
+		return &languageHandler{}
+	}
+}
+
+// NewLanguageExtension returns an IMAP server extension implementing LANGUAGE
+// and I18NLEVEL=1.
+func NewLanguageExtension() imapserver.Extension {
+	return &languageExtension{}
+}
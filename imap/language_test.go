@@ -0,0 +1,55 @@
+package imap
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatchLanguage(t *testing.T) {
+	tests := []struct {
+		r    string
+		want string
+		ok   bool
+	}{
+		{"en", "en", true},
+		{"EN-us", "en", true},
+		{"*", "en", true},
+		{"i-default", "i-default", true},
+		{"fr", "", false},
+		{"eng", "", false},
+	}
+	for _, tc := range tests {
+		if got, ok := matchLanguage(tc.r); got != tc.want || ok != tc.ok {
+			t.Errorf("matchLanguage(%q) = %q, %v, want %q, %v", tc.r, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestLanguage(t *testing.T) {
+	u := newTestUser(t, new(testAPI))
+	tc := newTestConn(t, u, NewLanguageExtension())
+
+	resp := tc.run("CAPABILITY")
+	if !strings.Contains(resp[0], " LANGUAGE") || !strings.Contains(resp[0], " I18NLEVEL=1") {
+		t.Errorf("CAPABILITY response = %q, want LANGUAGE and I18NLEVEL=1", resp)
+	}
+
+	tests := []struct {
+		cmd  string
+		want []string
+	}{
+		{"LANGUAGE", []string{"* LANGUAGE (i-default en)", "OK LANGUAGE completed"}},
+		{"LANGUAGE fr en-GB", []string{"* LANGUAGE (en)", "OK Using en"}},
+		{"LANGUAGE i-default", []string{"* LANGUAGE (i-default)", "OK Using i-default"}},
+	}
+	for _, test := range tests {
+		if resp := tc.run(test.cmd); !reflect.DeepEqual(resp, test.want) {
+			t.Errorf("%v: response = %q, want %q", test.cmd, resp, test.want)
+		}
+	}
+
+	if resp := tc.run("LANGUAGE fr de"); !strings.HasPrefix(resp[len(resp)-1], "NO") {
+		t.Errorf("LANGUAGE with unsupported languages = %q, want NO", resp)
+	}
+}
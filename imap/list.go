@@ -0,0 +1,332 @@
+package imap
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap-specialuse"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// LIST-EXTENDED extension, defined in RFC 5258, with the SPECIAL-USE options
+// defined in RFC 6154 and the STATUS return option defined in RFC 5819.
+
+const (
+	listExtendedCapability = "LIST-EXTENDED"
+	listStatusCapability   = "LIST-STATUS"
+)
+
+const (
+	listOptionSubscribed     = "SUBSCRIBED"
+	listOptionRemote         = "REMOTE"
+	listOptionRecursiveMatch = "RECURSIVEMATCH"
+	listOptionSpecialUse     = "SPECIAL-USE"
+	listOptionChildren       = "CHILDREN"
+	listOptionStatus         = "STATUS"
+	listReturnOptionsKeyword = "RETURN"
+)
+
+const (
+	hasNoChildrenAttr = "\\HasNoChildren"
+	subscribedAttr    = "\\Subscribed"
+)
+
+var specialUseAttrs = map[string]bool{
+	specialuse.All:     true,
+	specialuse.Archive: true,
+	specialuse.Drafts:  true,
+	specialuse.Flagged: true,
+	specialuse.Junk:    true,
+	specialuse.Sent:    true,
+	specialuse.Trash:   true,
+}
+
+func parseListOptions(f interface{}) ([]string, error) {
+	l, ok := f.([]interface{})
+	if !ok {
+		return nil, errors.New("LIST options must be a list")
+	}
+
+	opts := make([]string, len(l))
+	for i, f := range l {
+		s, ok := f.(string)
+		if !ok {
+			return nil, errors.New("LIST option must be an atom")
+		}
+		opts[i] = strings.ToUpper(s)
+	}
+	return opts, nil
+}
+
+var listStatusItems = map[imap.StatusItem]bool{
+	imap.StatusMessages:    true,
+	imap.StatusRecent:      true,
+	imap.StatusUidNext:     true,
+	imap.StatusUidValidity: true,
+	imap.StatusUnseen:      true,
+	statusHighestModSeq:    true,
+}
+
+func parseStatusItems(f interface{}) ([]imap.StatusItem, error) {
+	l, ok := f.([]interface{})
+	if !ok || len(l) == 0 {
+		return nil, errors.New("STATUS return option expects a list of status items")
+	}
+
+	items := make([]imap.StatusItem, len(l))
+	for i, f := range l {
+		s, ok := f.(string)
+		if !ok {
+			return nil, errors.New("status item must be an atom")
+		}
+		items[i] = imap.StatusItem(strings.ToUpper(s))
+		if !listStatusItems[items[i]] {
+			return nil, errors.New("unknown status item")
+		}
+	}
+	return items, nil
+}
+
+func parseMailboxPattern(f interface{}) (string, error) {
+	s, err := imap.ParseString(f)
+	if err != nil {
+		return "", err
+	}
+	s, err = decodeMailboxName(s)
+	if err != nil {
+		return "", err
+	}
+	return imap.CanonicalMailboxName(s), nil
+}
+
+type listHandler struct {
+	imapserver.List
+
+	extended bool
+	patterns []string
+
+	selectSubscribed bool
+	selectSpecialUse bool
+
+	returnSubscribed bool
+	returnChildren   bool
+	returnStatus     []imap.StatusItem
+}
+
+func (h *listHandler) Parse(fields []interface{}) error {
+	if len(fields) == 0 {
+		return errors.New("no enough arguments")
+	}
+
+	if f, ok := fields[0].([]interface{}); ok {
+		opts, err := parseListOptions(f)
+		if err != nil {
+			return err
+		}
+
+		recursiveMatch := false
+		for _, opt := range opts {
+			switch opt {
+			case listOptionSubscribed:
+				h.selectSubscribed = true
+			case listOptionSpecialUse:
+				h.selectSpecialUse = true
+			case listOptionRecursiveMatch:
+				recursiveMatch = true
+			case listOptionRemote:
+			default:
+				return errors.New("unknown LIST selection option")
+			}
+		}
+		if recursiveMatch && !h.selectSubscribed && !h.selectSpecialUse {
+			return errors.New("RECURSIVEMATCH requires another selection option")
+		}
+
+		h.extended = true
+		fields = fields[1:]
+	}
+
+	if len(fields) < 2 {
+		return errors.New("no enough arguments")
+	}
+
+	var err error
+	if h.Reference, err = parseMailboxPattern(fields[0]); err != nil {
+		return err
+	}
+
+	if l, ok := fields[1].([]interface{}); ok {
+		h.extended = true
+		for _, f := range l {
+			pattern, err := parseMailboxPattern(f)
+			if err != nil {
+				return err
+			}
+			h.patterns = append(h.patterns, pattern)
+		}
+	} else {
+		if h.Mailbox, err = parseMailboxPattern(fields[1]); err != nil {
+			return err
+		}
+		h.patterns = []string{h.Mailbox}
+	}
+	fields = fields[2:]
+
+	if len(fields) == 0 {
+		return nil
+	}
+	if len(fields) != 2 {
+		return errors.New("invalid LIST return options")
+	}
+	if kw, _ := fields[0].(string); strings.ToUpper(kw) != listReturnOptionsKeyword {
+		return errors.New("invalid LIST return options")
+	}
+	opts, ok := fields[1].([]interface{})
+	if !ok {
+		return errors.New("LIST options must be a list")
+	}
+	for i := 0; i < len(opts); i++ {
+		opt, ok := opts[i].(string)
+		if !ok {
+			return errors.New("LIST option must be an atom")
+		}
+		switch strings.ToUpper(opt) {
+		case listOptionSubscribed:
+			h.returnSubscribed = true
+		case listOptionChildren:
+			h.returnChildren = true
+		case listOptionSpecialUse:
+			// Special-use attributes are always returned
+		case listOptionStatus:
+			if i+1 >= len(opts) {
+				return errors.New("STATUS return option expects a list of status items")
+			}
+			i++
+			if h.returnStatus, err = parseStatusItems(opts[i]); err != nil {
+				return err
+			}
+		default:
+			return errors.New("unknown LIST return option")
+		}
+	}
+	h.extended = true
+	return nil
+}
+
+func hasSpecialUse(info *imap.MailboxInfo) bool {
+	for _, attr := range info.Attributes {
+		if specialUseAttrs[attr] {
+			return true
+		}
+	}
+	return false
+}
+
+func hasChildrenInfo(info *imap.MailboxInfo) bool {
+	for _, attr := range info.Attributes {
+		if attr == hasChildrenAttr || attr == hasNoChildrenAttr {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *listHandler) Handle(conn imapserver.Conn) error {
+	utf8Accept := utf8Enabled(conn)
+	if !h.extended && !utf8Accept {
+		return h.List.Handle(conn)
+	}
+
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	mailboxes, err := ctx.User.ListMailboxes(false)
+	if err != nil {
+		return err
+	}
+
+	for _, mbox := range mailboxes {
+		info, err := mbox.Info()
+		if err != nil {
+			return err
+		}
+
+		if h.selectSpecialUse && !hasSpecialUse(info) {
+			continue
+		}
+
+		matched := false
+		for _, pattern := range h.patterns {
+			if info.Match(h.Reference, pattern) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		// Subscriptions aren't supported, all mailboxes are subscribed
+		if h.selectSubscribed || h.returnSubscribed {
+			info.Attributes = append(info.Attributes, subscribedAttr)
+		}
+		if h.returnChildren && !hasChildrenInfo(info) {
+			info.Attributes = append(info.Attributes, hasNoChildrenAttr)
+		}
+
+		if err := conn.WriteResp(&listResp{info: info, utf8Accept: utf8Accept}); err != nil {
+			return err
+		}
+
+		if h.returnStatus == nil || isNoSelect(info) {
+			continue
+		}
+		// Counts are kept up to date by events, no request is needed
+		status, err := mbox.Status(h.returnStatus)
+		if err != nil {
+			return err
+		}
+		if err := conn.WriteResp(&statusResp{status: status, utf8Accept: utf8Accept}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func isNoSelect(info *imap.MailboxInfo) bool {
+	for _, attr := range info.Attributes {
+		if attr == imap.NoSelectAttr {
+			return true
+		}
+	}
+	return false
+}
+
+type listExtension struct{}
+
+func (ext *listExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{listExtendedCapability, listStatusCapability}
+	}
+	return nil
+}
+
+func (ext *listExtension) Command(name string) imapserver.HandlerFactory {
+	if name != "LIST" {
+		return nil
+	}
+
+	return func() imapserver.Handler {
+		return &listHandler{}
+	}
+}
+
+// NewListExtension returns an IMAP server extension implementing
+// LIST-EXTENDED and LIST-STATUS.
+func NewListExtension() imapserver.Extension {
+	return &listExtension{}
+}
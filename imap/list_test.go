@@ -0,0 +1,127 @@
+package imap
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestListHandlerParse(t *testing.T) {
+	l := func(fields ...interface{}) []interface{} { return fields }
+	tests := []struct {
+		name    string
+		fields  []interface{}
+		want    listHandler
+		wantErr bool
+	}{
+		{
+			name:   "basic",
+			fields: l("", "*"),
+			want:   listHandler{patterns: []string{"*"}},
+		},
+		{
+			name:   "selection options",
+			fields: l(l("subscribed", "RECURSIVEMATCH"), "", "*"),
+			want:   listHandler{extended: true, selectSubscribed: true, patterns: []string{"*"}},
+		},
+		{
+			name:   "pattern list",
+			fields: l("", l("INBOX", "Folders/*")),
+			want:   listHandler{extended: true, patterns: []string{"INBOX", "Folders/*"}},
+		},
+		{
+			name:   "return options",
+			fields: l("", "*", "RETURN", l("SUBSCRIBED", "children", "SPECIAL-USE")),
+			want:   listHandler{extended: true, patterns: []string{"*"}, returnSubscribed: true, returnChildren: true},
+		},
+		{
+			name:   "return status",
+			fields: l("", "*", "return", l("STATUS", l("messages", "UNSEEN", "HIGHESTMODSEQ"))),
+			want: listHandler{
+				extended:     true,
+				patterns:     []string{"*"},
+				returnStatus: []imap.StatusItem{imap.StatusMessages, imap.StatusUnseen, statusHighestModSeq},
+			},
+		},
+		{name: "no arguments", fields: l(), wantErr: true},
+		{name: "no pattern", fields: l(l("SPECIAL-USE"), ""), wantErr: true},
+		{name: "unknown selection option", fields: l(l("UNKNOWN"), "", "*"), wantErr: true},
+		{name: "recursive match alone", fields: l(l("RECURSIVEMATCH"), "", "*"), wantErr: true},
+		{name: "missing return keyword", fields: l("", "*", l("CHILDREN")), wantErr: true},
+		{name: "invalid return keyword", fields: l("", "*", "RETURNS", l("CHILDREN")), wantErr: true},
+		{name: "unknown return option", fields: l("", "*", "RETURN", l("UNKNOWN")), wantErr: true},
+		{name: "status without items", fields: l("", "*", "RETURN", l("STATUS")), wantErr: true},
+		{name: "status with empty items", fields: l("", "*", "RETURN", l("STATUS", l())), wantErr: true},
+		{name: "unknown status item", fields: l("", "*", "RETURN", l("STATUS", l("SIZE"))), wantErr: true},
+	}
+	for _, tc := range tests {
+		var h listHandler
+		err := h.Parse(tc.fields)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%v: Parse() = nil, want an error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: Parse() = %v", tc.name, err)
+			continue
+		}
+		// The embedded command is checked by patterns
+		h.List = imapserver.List{}
+		if !reflect.DeepEqual(h, tc.want) {
+			t.Errorf("%v: Parse() = %+v, want %+v", tc.name, h, tc.want)
+		}
+	}
+}
+
+func TestListStatus(t *testing.T) {
+	u := newTestUser(t, new(testAPI))
+	u.getMailboxByLabel(protonmail.LabelInbox).total = 3
+	tc := newTestConn(t, u, NewListExtension())
+
+	tests := []struct {
+		cmd  string
+		want []string
+	}{
+		{
+			cmd: `LIST "" INBOX RETURN (STATUS (MESSAGES))`,
+			want: []string{
+				`* LIST () "/" INBOX`,
+				`* STATUS INBOX (MESSAGES 3)`,
+			},
+		},
+		{
+			cmd: `LIST (SPECIAL-USE) "" (INBOX Drafts) RETURN (CHILDREN)`,
+			want: []string{
+				`* LIST (\Drafts \HasNoChildren) "/" Drafts`,
+			},
+		},
+		{
+			cmd: `LIST "" (INBOX) RETURN (SUBSCRIBED)`,
+			want: []string{
+				`* LIST (\Subscribed) "/" INBOX`,
+			},
+		},
+	}
+	for _, test := range tests {
+		resp := tc.run(test.cmd)
+		if status := resp[len(resp)-1]; !strings.HasPrefix(status, "OK") {
+			t.Errorf("%v: status = %v, want OK", test.cmd, status)
+			continue
+		}
+		resp = resp[:len(resp)-1]
+		if !reflect.DeepEqual(resp, test.want) {
+			t.Errorf("%v: response = %q, want %q", test.cmd, resp, test.want)
+		}
+	}
+
+	if resp := tc.run(`LIST "" "*" RETURN (STATUS (SIZE))`); !strings.HasPrefix(resp[len(resp)-1], "BAD") {
+		t.Errorf("LIST with an unknown status item = %v, want BAD", resp[len(resp)-1])
+	}
+}
@@ -0,0 +1,127 @@
+package imap
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/emersion/go-imap"
+)
+
+// literalMemoryLimit is the maximum size of a literal kept in memory. Bigger
+// literals are spooled to a temporary file.
+const literalMemoryLimit = 1024 * 1024
+
+// literalBuffer is a buffer used to build literals whose size isn't known in
+// advance, e.g. messages with big attachments.
+type literalBuffer struct {
+	buf  bytes.Buffer
+	f    *os.File
+	size int64
+}
+
+func (lb *literalBuffer) Write(p []byte) (int, error) {
+	if lb.f == nil && lb.buf.Len()+len(p) > literalMemoryLimit {
+		f, err := ioutil.TempFile("", "hydroxide-literal-")
+		if err != nil {
+			return 0, err
+		}
+		// The file will be deleted when closed
+		os.Remove(f.Name())
+
+		if _, err := f.Write(lb.buf.Bytes()); err != nil {
+			f.Close()
+			return 0, err
+		}
+		lb.buf = bytes.Buffer{}
+		lb.f = f
+	}
+
+	var n int
+	var err error
+	if lb.f != nil {
+		n, err = lb.f.Write(p)
+	} else {
+		n, err = lb.buf.Write(p)
+	}
+	lb.size += int64(n)
+	return n, err
+}
+
+// Reset discards all data written so far.
+func (lb *literalBuffer) Reset() error {
+	lb.size = 0
+	if lb.f == nil {
+		lb.buf.Reset()
+		return nil
+	}
+	if err := lb.f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := lb.f.Seek(0, io.SeekStart)
+	return err
+}
+
+// Reader returns a reader for the data written so far. The buffer must not be
+// written to while the reader is in use.
+func (lb *literalBuffer) Reader() io.Reader {
+	if lb.f == nil {
+		return bytes.NewReader(lb.buf.Bytes())
+	}
+	return io.NewSectionReader(lb.f, 0, lb.size)
+}
+
+// Close discards the buffer. It must be called if Literal isn't.
+func (lb *literalBuffer) Close() error {
+	if lb.f != nil {
+		return lb.f.Close()
+	}
+	return nil
+}
+
+// Literal returns a literal containing the data written so far, optionally
+// restricted to the partial range of section. The buffer must not be used
+// afterwards.
+func (lb *literalBuffer) Literal(section *imap.BodySectionName) imap.Literal {
+	if lb.f == nil {
+		return bytes.NewReader(section.ExtractPartial(lb.buf.Bytes()))
+	}
+
+	from, to := int64(0), lb.size
+	if len(section.Partial) == 2 {
+		from = int64(section.Partial[0])
+		if from > lb.size {
+			from = lb.size
+		}
+		if end := from + int64(section.Partial[1]); end < to {
+			to = end
+		}
+	}
+
+	return &fileLiteral{
+		r: io.NewSectionReader(lb.f, from, to-from),
+		f: lb.f,
+		n: int(to - from),
+	}
+}
+
+// fileLiteral is a literal backed by a temporary file. The file is closed once
+// the literal has been read.
+type fileLiteral struct {
+	r io.Reader
+	f *os.File
+	n int
+}
+
+func (l *fileLiteral) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if err != nil {
+		l.f.Close()
+	}
+	return n, err
+}
+
+func (l *fileLiteral) Len() int {
+	return l.n
+}
@@ -0,0 +1,78 @@
+package imap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestLiteralBuffer(t *testing.T) {
+	small := []byte("Hello world")
+	big := bytes.Repeat([]byte("0123456789abcdef"), literalMemoryLimit/16+1)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		partial []int
+		want    []byte
+	}{
+		{name: "small", data: small, want: small},
+		{name: "small partial", data: small, partial: []int{6, 3}, want: small[6:9]},
+		{name: "small partial past end", data: small, partial: []int{6, 100}, want: small[6:]},
+		{name: "big", data: big, want: big},
+		{name: "big partial", data: big, partial: []int{literalMemoryLimit, 10}, want: big[literalMemoryLimit : literalMemoryLimit+10]},
+		{name: "big partial past end", data: big, partial: []int{len(big) - 5, 100}, want: big[len(big)-5:]},
+		{name: "big partial after end", data: big, partial: []int{len(big) + 5, 100}, want: []byte{}},
+	}
+	for _, tc := range tests {
+		var lb literalBuffer
+		// Write in several chunks to cross the memory limit
+		for b := tc.data; len(b) > 0; {
+			n := 4096
+			if n > len(b) {
+				n = len(b)
+			}
+			if _, err := lb.Write(b[:n]); err != nil {
+				t.Fatalf("%v: Write() = %v", tc.name, err)
+			}
+			b = b[n:]
+		}
+		if spooled := lb.f != nil; spooled != (len(tc.data) > literalMemoryLimit) {
+			t.Errorf("%v: spooled = %v for %v bytes", tc.name, spooled, len(tc.data))
+		}
+
+		section := &imap.BodySectionName{Partial: tc.partial}
+		l := lb.Literal(section)
+		if l.Len() != len(tc.want) {
+			t.Errorf("%v: Len() = %v, want %v", tc.name, l.Len(), len(tc.want))
+		}
+		b, err := ioutil.ReadAll(l)
+		if err != nil {
+			t.Errorf("%v: reading literal = %v", tc.name, err)
+		} else if !bytes.Equal(b, tc.want) {
+			t.Errorf("%v: literal has %v bytes, want %v", tc.name, len(b), len(tc.want))
+		}
+		lb.Close()
+	}
+}
+
+func TestLiteralBufferReset(t *testing.T) {
+	for _, n := range []int{10, literalMemoryLimit + 1} {
+		var lb literalBuffer
+		lb.Write(make([]byte, n))
+		if err := lb.Reset(); err != nil {
+			t.Fatalf("Reset() after %v bytes = %v", n, err)
+		}
+		lb.Write([]byte("Hello"))
+
+		b, err := ioutil.ReadAll(lb.Literal(&imap.BodySectionName{}))
+		if err != nil {
+			t.Errorf("reading literal after %v bytes = %v", n, err)
+		} else if string(b) != "Hello" {
+			t.Errorf("literal after %v bytes and Reset() = %q, want %q", n, b, "Hello")
+		}
+		lb.Close()
+	}
+}
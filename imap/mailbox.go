@@ -1,15 +1,21 @@
 package imap
 
 import (
+	"bytes"
+	"context"
 	"errors"
-	"log"
+	"io/ioutil"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/emersion/go-imap"
 	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
 
+	"github.com/emersion/hydroxide/charset"
 	"github.com/emersion/hydroxide/imap/database"
 	"github.com/emersion/hydroxide/protonmail"
 )
@@ -20,12 +26,18 @@ type mailbox struct {
 	name  string
 	label string
 	flags []string
+	attrs []string
+	// custom is set for mailboxes backed by a user-defined label
+	custom bool
 
 	u  *user
 	db *database.Mailbox
 
 	initialized     bool
 	initializedLock sync.Mutex
+	// scanCancel is set while the mailbox is being scanned
+	scanCancel context.CancelFunc
+	scanLock   sync.Mutex
 
 	total, unread int
 	deleted       map[string]struct{}
@@ -36,8 +48,11 @@ func (mbox *mailbox) Name() string {
 }
 
 func (mbox *mailbox) Info() (*imap.MailboxInfo, error) {
+	attrs := make([]string, 0, len(mbox.flags)+len(mbox.attrs))
+	attrs = append(attrs, mbox.flags...)
+	attrs = append(attrs, mbox.attrs...)
 	return &imap.MailboxInfo{
-		Attributes: append(mbox.flags, imap.NoInferiorsAttr),
+		Attributes: attrs,
 		Delimiter:  delimiter,
 		Name:       mbox.name,
 	}, nil
@@ -45,14 +60,25 @@ func (mbox *mailbox) Info() (*imap.MailboxInfo, error) {
 
 func (mbox *mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
 	status := imap.NewMailboxStatus(mbox.name, items)
-	status.Flags = mbox.flags
-	status.PermanentFlags = []string{imap.SeenFlag, imap.FlaggedFlag, imap.DeletedFlag}
+	keywords := mbox.u.listKeywords()
+	status.Flags = append(append([]string(nil), mbox.flags...), keywords...)
+	status.PermanentFlags = append([]string{imap.SeenFlag, imap.FlaggedFlag, imap.DeletedFlag}, keywords...)
 	status.UnseenSeqNum = 0 // TODO
+	// Changes can't be made while the API is unreachable
+	status.ReadOnly = mbox.u.isOffline()
 
 	for _, name := range items {
 		switch name {
 		case imap.StatusMessages:
 			status.Messages = uint32(mbox.total)
+			if mbox.isScanning() {
+				// Only the messages listed so far can be fetched
+				n, err := mbox.db.Count()
+				if err != nil {
+					return nil, err
+				}
+				status.Messages = n
+			}
 		case imap.StatusUidNext:
 			uidNext, err := mbox.db.UidNext()
 			if err != nil {
@@ -60,11 +86,21 @@ func (mbox *mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error
 			}
 			status.UidNext = uidNext
 		case imap.StatusUidValidity:
-			status.UidValidity = 1
+			uidValidity, err := mbox.db.UidValidity()
+			if err != nil {
+				return nil, err
+			}
+			status.UidValidity = uidValidity
 		case imap.StatusRecent:
-			status.Recent = 0
+			status.Recent = uint32(mbox.u.recent.count(mbox))
 		case imap.StatusUnseen:
 			status.Unseen = uint32(mbox.unread)
+		case statusHighestModSeq:
+			highestModSeq, err := mbox.db.HighestModSeq()
+			if err != nil {
+				return nil, err
+			}
+			status.Items[name] = formatModSeq(highestModSeq)
 		}
 	}
 
@@ -79,97 +115,96 @@ func (mbox *mailbox) Check() error {
 	return nil
 }
 
-func (mbox *mailbox) sync() error {
-	log.Printf("Synchronizing mailbox %v...", mbox.name)
-
-	// TODO: don't do this without incrementing UIDVALIDITY
-	if err := mbox.db.Reset(); err != nil {
-		return err
-	}
-
-	filter := &protonmail.MessageFilter{
-		PageSize: 150,
-		Label:    mbox.label,
-		Sort:     "ID",
-		Asc:      true,
-	}
-
-	total := -1
-	for {
-		offset := filter.PageSize * filter.Page
-		if total >= 0 && offset > total {
-			break
-		}
-
-		var page []*protonmail.Message
-		var err error
-		total, page, err = mbox.u.c.ListMessages(filter)
-		if err != nil {
-			return err
-		}
-
-		if err := mbox.db.Sync(page); err != nil {
-			return err
-		}
-
-		filter.Page++
-	}
-
-	log.Printf("Synchronizing mailbox %v: done.", mbox.name)
-
-	return nil
-}
-
-func (mbox *mailbox) init() error {
-	mbox.initializedLock.Lock()
-	defer mbox.initializedLock.Unlock()
-
-	if mbox.initialized {
-		return nil
-	}
-
-	// TODO: sync only the first time
-	if err := mbox.sync(); err != nil {
-		return err
-	}
-
-	mbox.initialized = true
-	return nil
-}
-
 func (mbox *mailbox) reset() error {
 	mbox.initializedLock.Lock()
 	defer mbox.initializedLock.Unlock()
 
 	mbox.initialized = false
+	mbox.cancelScan()
 
 	return mbox.db.Reset()
 }
 
 func (mbox *mailbox) fetchFlags(msg *protonmail.Message) []string {
-	flags := fetchFlags(msg)
+	flags := append(fetchFlags(msg), mbox.u.messageKeywords(msg)...)
 	if _, ok := mbox.deleted[msg.ID]; ok {
 		flags = append(flags, imap.DeletedFlag)
 	}
+	if mbox.u.recent.isRecent(mbox, msg.ID) {
+		flags = append(flags, imap.RecentFlag)
+	}
 	return flags
 }
 
-func (mbox *mailbox) fetchMessage(isUid bool, id uint32, items []imap.FetchItem) (*imap.Message, error) {
-	var apiID string
-	var err error
-	if isUid {
-		apiID, err = mbox.db.FromUid(id)
-	} else {
-		apiID, err = mbox.db.FromSeqNum(id)
+// messageRef designates a message of the mailbox.
+type messageRef struct {
+	seqNum, uid uint32
+	apiID       string
+}
+
+// seqContains checks whether a sequence contains id. max is the value of "*".
+func seqContains(seq imap.Seq, id, max uint32) bool {
+	start, stop := seq.Start, seq.Stop
+	if start == 0 {
+		start = max
 	}
-	if err != nil {
+	if stop == 0 {
+		stop = max
+	}
+	if start > stop {
+		start, stop = stop, start
+	}
+	return start <= id && id <= stop
+}
+
+// matchMessages returns the messages in seqSet, in ascending order. The
+// mailbox is read in a single pass, instead of looking up each number of the
+// set.
+func (mbox *mailbox) matchMessages(uid bool, seqSet *imap.SeqSet) ([]messageRef, error) {
+	var all []messageRef
+	err := mbox.db.ForEach(func(seqNum, uid uint32, apiID string) error {
+		all = append(all, messageRef{seqNum, uid, apiID})
+		return nil
+	})
+	if err != nil || len(all) == 0 {
 		return nil, err
 	}
 
-	seqNum, uid, err := mbox.db.FromApiID(apiID)
+	max := all[len(all)-1].seqNum
+	if uid {
+		max = all[len(all)-1].uid
+	}
+
+	var refs []messageRef
+	for _, ref := range all {
+		id := ref.seqNum
+		if uid {
+			id = ref.uid
+		}
+		for _, seq := range seqSet.Set {
+			if seqContains(seq, id, max) {
+				refs = append(refs, ref)
+				break
+			}
+		}
+	}
+	return refs, nil
+}
+
+// fetchMessage returns nil if the message hasn't been modified after
+// changedSince. Only body sections, and body structures of messages with
+// attachments, need the message to be downloaded: other items are built from
+// the metadata stored in the local database.
+func (mbox *mailbox) fetchMessage(ref messageRef, items []imap.FetchItem, changedSince uint64) (*imap.Message, error) {
+	apiID, seqNum, uid := ref.apiID, ref.seqNum, ref.uid
+
+	modSeq, err := mbox.u.db.ModSeq(apiID)
 	if err != nil {
 		return nil, err
 	}
+	if changedSince > 0 && modSeq <= changedSince {
+		return nil, nil
+	}
 
 	msg, err := mbox.u.db.Message(apiID)
 	if err != nil {
@@ -195,7 +230,20 @@ func (mbox *mailbox) fetchMessage(isUid bool, id uint32, items []imap.FetchItem)
 			fetched.Size = uint32(msg.Size)
 		case imap.FetchUid:
 			fetched.Uid = uid
+		case fetchModSeq:
+			fetched.Items[fetchModSeq] = []interface{}{formatModSeq(modSeq)}
 		default:
+			if section, size, ok, err := parseBinaryItem(item); err != nil {
+				return nil, err
+			} else if ok {
+				bi, err := mbox.fetchBinary(msg, section, size)
+				if err != nil {
+					return nil, err
+				}
+				fetched.Items[item] = bi
+				break
+			}
+
 			section, err := imap.ParseBodySectionName(item)
 			if err != nil {
 				break
@@ -213,41 +261,30 @@ func (mbox *mailbox) fetchMessage(isUid bool, id uint32, items []imap.FetchItem)
 }
 
 func (mbox *mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	return mbox.listMessages(uid, seqSet, items, 0, ch)
+}
+
+func (mbox *mailbox) listMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, changedSince uint64, ch chan<- *imap.Message) error {
 	defer close(ch)
 
 	if err := mbox.init(); err != nil {
 		return err
 	}
 
-	for _, seq := range seqSet.Set {
-		start := seq.Start
-		if start == 0 {
-			start = 1
-		}
+	refs, err := mbox.matchMessages(uid, seqSet)
+	if err != nil {
+		return err
+	}
 
-		stop := seq.Stop
-		if stop == 0 {
-			if uid {
-				uidNext, err := mbox.db.UidNext()
-				if err != nil {
-					return err
-				}
-				stop = uidNext - 1
-			} else {
-				stop = uint32(mbox.total)
-			}
+	for _, ref := range refs {
+		msg, err := mbox.fetchMessage(ref, items, changedSince)
+		if err == database.ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
 		}
-
-		for i := start; i <= stop; i++ {
-			msg, err := mbox.fetchMessage(uid, i, items)
-			if err == database.ErrNotFound {
-				continue
-			} else if err != nil {
-				return err
-			}
-			if msg != nil {
-				ch <- msg
-			}
+		if msg != nil {
+			ch <- msg
 		}
 	}
 
@@ -258,6 +295,105 @@ func matchString(s, substr string) bool {
 	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
 }
 
+// searchHeader returns the value searched for in the header field k. The API
+// only accepts one value per field, so it returns an empty string if there are
+// several: these are only matched locally.
+func searchHeader(c *imap.SearchCriteria, k string) string {
+	if values := c.Header[k]; len(values) == 1 {
+		return values[0]
+	}
+	return ""
+}
+
+// searchFilter translates the search criteria supported by the API into a
+// message filter. It returns nil if there are none.
+func (mbox *mailbox) searchFilter(c *imap.SearchCriteria) *protonmail.MessageFilter {
+	filter := &protonmail.MessageFilter{Label: mbox.label}
+	ok := false
+	if v := searchHeader(c, "Subject"); v != "" {
+		filter.Subject = v
+		ok = true
+	}
+	if v := searchHeader(c, "From"); v != "" {
+		filter.From = v
+		ok = true
+	}
+	if v := searchHeader(c, "To"); v != "" {
+		filter.To = v
+		ok = true
+	}
+	// IMAP's SINCE is inclusive and BEFORE is exclusive, the API's Begin and End
+	// are both inclusive
+	if !c.Since.IsZero() {
+		filter.Begin = c.Since.Unix()
+		ok = true
+	}
+	if !c.Before.IsZero() {
+		filter.End = c.Before.Unix() - 1
+		ok = true
+	}
+	if !ok {
+		return nil
+	}
+	return filter
+}
+
+func (mbox *mailbox) searchFilterIDs(filter *protonmail.MessageFilter, ids map[string]struct{}) error {
+	var err error
+	mbox.u.c.IterMessages(filter)(func(msg *protonmail.Message, iterErr error) bool {
+		if iterErr != nil {
+			err = iterErr
+			return false
+		}
+		ids[msg.ID] = struct{}{}
+		return true
+	})
+	return err
+}
+
+// searchRemote asks the API for the messages matching the criteria it
+// supports. It returns a nil set if all messages need to be matched locally.
+func (mbox *mailbox) searchRemote(c *imap.SearchCriteria) (map[string]struct{}, error) {
+	filter := mbox.searchFilter(c)
+
+	var keywords []string
+	keywords = append(keywords, c.Body...)
+	keywords = append(keywords, c.Text...)
+	if len(keywords) == 0 {
+		if filter == nil {
+			return nil, nil
+		}
+		ids := make(map[string]struct{})
+		return ids, mbox.searchFilterIDs(filter, ids)
+	}
+	if filter == nil {
+		filter = &protonmail.MessageFilter{Label: mbox.label}
+	}
+
+	// The API only supports one keyword per request, intersect results
+	var results map[string]struct{}
+	for _, keyword := range keywords {
+		f := *filter
+		f.Keyword = keyword
+
+		ids := make(map[string]struct{})
+		if err := mbox.searchFilterIDs(&f, ids); err != nil {
+			return nil, err
+		}
+
+		if results != nil {
+			for id := range results {
+				if _, ok := ids[id]; !ok {
+					delete(results, id)
+				}
+			}
+		} else {
+			results = ids
+		}
+	}
+	return results, nil
+}
+
 func (mbox *mailbox) SearchMessages(isUID bool, c *imap.SearchCriteria) ([]uint32, error) {
 	if err := mbox.init(); err != nil {
 		return nil, err
@@ -268,14 +404,24 @@ func (mbox *mailbox) SearchMessages(isUID bool, c *imap.SearchCriteria) ([]uint3
 		return nil, errors.New("search queries with NOT or OR clauses or not yet implemented")
 	}
 
+	remoteIDs, err := mbox.searchRemote(c)
+	if err != nil {
+		return nil, err
+	}
+
 	var results []uint32
-	err := mbox.db.ForEach(func(seqNum, uid uint32, apiID string) error {
+	err = mbox.db.ForEach(func(seqNum, uid uint32, apiID string) error {
 		if c.SeqNum != nil && !c.SeqNum.Contains(seqNum) {
 			return nil
 		}
 		if c.Uid != nil && !c.Uid.Contains(uid) {
 			return nil
 		}
+		if remoteIDs != nil {
+			if _, ok := remoteIDs[apiID]; !ok {
+				return nil
+			}
+		}
 
 		// TODO: fetch message from local DB only if needed
 		msg, err := mbox.u.db.Message(apiID)
@@ -335,7 +481,7 @@ func (mbox *mailbox) SearchMessages(isUID bool, c *imap.SearchCriteria) ([]uint3
 			}
 		}
 
-		// TODO: c.Body, c.Text
+		// c.Body and c.Text are handled by searchRemote
 
 		if c.Larger > 0 && uint32(msg.Size) < c.Larger {
 			return nil
@@ -357,21 +503,130 @@ func (mbox *mailbox) SearchMessages(isUID bool, c *imap.SearchCriteria) ([]uint3
 	return results, nil
 }
 
+// previousDraft returns the draft an appended message replaces, if any.
+// Clients saving a draft again keep its Message-Id. If u.matchDrafts is set,
+// the only draft with the same subject and recipients is returned otherwise.
+func (mbox *mailbox) previousDraft(h mail.Header) (*protonmail.Message, error) {
+	id := strings.Trim(h.Get("Message-Id"), " <>")
+	subject := charset.DecodeHeader(h.Get("Subject"))
+	toList, _ := charset.AddressList(h, "To")
+
+	var prev *protonmail.Message
+	var matches []*protonmail.Message
+	err := mbox.db.ForEach(func(seqNum, uid uint32, apiID string) error {
+		msg, err := mbox.u.db.Message(apiID)
+		if err != nil {
+			return err
+		}
+		if id != "" && messageID(msg) == id {
+			prev = msg
+		} else if mbox.u.matchDrafts && sameDraft(msg, subject, toList) {
+			matches = append(matches, msg)
+		}
+		return nil
+	})
+	if prev == nil && len(matches) == 1 {
+		prev = matches[0]
+	}
+	return prev, err
+}
+
+// sameDraft checks whether a draft has the given subject and recipients.
+func sameDraft(msg *protonmail.Message, subject string, toList []*mail.Address) bool {
+	if msg.Subject != subject || len(msg.ToList) != len(toList) {
+		return false
+	}
+	for i, addr := range toList {
+		if !strings.EqualFold(msg.ToList[i].Address, addr.Address) {
+			return false
+		}
+	}
+	return true
+}
+
 func (mbox *mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
-	if mbox.label != protonmail.LabelDraft {
-		return errors.New("cannot create messages outside the Drafts mailbox")
+	_, err := mbox.createMessage(flags, date, body)
+	return err
+}
+
+// createMessage appends a message to the mailbox and returns its UID. The UID
+// is zero if the message isn't in the local database yet.
+func (mbox *mailbox) createMessage(flags []string, date time.Time, body imap.Literal) (uint32, error) {
+	if mbox.label != protonmail.LabelDraft && mbox.label != protonmail.LabelSent {
+		return 0, errors.New("cannot create messages outside the Drafts and Sent mailboxes")
 	}
 
 	if err := mbox.init(); err != nil {
-		return err
+		return 0, err
 	}
 
-	_, err := createMessage(mbox.u.c, mbox.u.u, mbox.u.privateKeys, mbox.u.addrs, body)
+	b, err := ioutil.ReadAll(body)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return mbox.Poll()
+	if mbox.label == protonmail.LabelSent {
+		meta := &protonmail.ImportMessageMetadata{
+			Unread:   1,
+			Type:     protonmail.MessageSent,
+			LabelIDs: []string{mbox.label},
+		}
+		for _, flag := range flags {
+			if flag == imap.SeenFlag {
+				meta.Unread = 0
+			}
+		}
+		if !date.IsZero() {
+			meta.Time = date.Unix()
+		}
+
+		apiID, err := importMessage(mbox.u.c, mbox.u.privateKeys, mbox.u.addrs, meta, b)
+		if err != nil {
+			return 0, err
+		}
+		return mbox.polledUID(apiID)
+	}
+
+	e, err := message.Read(bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	prev, err := mbox.previousDraft(mail.Header{Header: e.Header})
+	if err != nil {
+		return 0, err
+	}
+
+	// TODO: the API doesn't allow to set the date of drafts
+	msg, err := createMessage(mbox.u.c, mbox.u.u, mbox.u.privateKeys, mbox.u.addrs, bytes.NewReader(b), prev)
+	if err != nil {
+		return 0, err
+	}
+
+	if prev != nil {
+		// Clients delete the copy they've replaced, give the updated draft a
+		// new UID so that it isn't deleted along with it
+		if len(msg.LabelIDs) == 0 {
+			msg.LabelIDs = prev.LabelIDs
+		}
+		if err := mbox.u.renewMessage(msg); err != nil {
+			return 0, err
+		}
+	}
+
+	return mbox.polledUID(msg.ID)
+}
+
+// polledUID polls updates and returns the UID of a message created remotely.
+func (mbox *mailbox) polledUID(apiID string) (uint32, error) {
+	if err := mbox.Poll(); err != nil {
+		return 0, err
+	}
+
+	_, uid, err := mbox.db.FromApiID(apiID)
+	if err == database.ErrNotFound {
+		return 0, nil
+	}
+	return uid, err
 }
 
 func (mbox *mailbox) fromSeqSet(isUID bool, seqSet *imap.SeqSet) ([]string, error) {
@@ -402,24 +657,122 @@ func (mbox *mailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.
 		return err
 	}
 
-	// TODO: imap.SetFlags should remove currently set flags
+	// Check all messages before changing anything, and collect the messages
+	// each flag needs to be removed from
+	removed := make(map[string][]string)
+	for _, apiID := range apiIDs {
+		msg, err := mbox.u.db.Message(apiID)
+		if err != nil {
+			return err
+		}
 
+		l, err := removedFlags(mbox.fetchFlags(msg), op, flags)
+		if err != nil {
+			return err
+		}
+		for _, flag := range l {
+			removed[flag] = append(removed[flag], apiID)
+		}
+	}
+
+	removedList := make([]string, 0, len(removed))
+	for flag := range removed {
+		removedList = append(removedList, flag)
+	}
+	sort.Strings(removedList)
+	for _, flag := range removedList {
+		if err := mbox.storeFlags(removed[flag], imap.RemoveFlags, []string{flag}); err != nil {
+			return mbox.pollOnError(err)
+		}
+	}
+
+	if op != imap.RemoveFlags {
+		for _, flag := range flags {
+			if flag == imap.DeletedFlag {
+				if err := mbox.checkDelete(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if err := mbox.storeFlags(apiIDs, op, flags); err != nil {
+		return mbox.pollOnError(err)
+	}
+
+	return mbox.Poll()
+}
+
+// readOnlyFlags are flags which ProtonMail doesn't allow to change.
+var readOnlyFlags = []string{imap.AnsweredFlag, imap.DraftFlag}
+
+var errReadOnlyFlag = errors.New("\\Answered and \\Draft flags cannot be changed")
+
+// removedFlags returns the flags to remove from a message which has the
+// current flags when storing flags with op. Only STORE FLAGS removes flags.
+// errReadOnlyFlag is returned if a read-only flag would be changed.
+func removedFlags(current []string, op imap.FlagsOp, flags []string) ([]string, error) {
+	for _, flag := range readOnlyFlags {
+		has := hasFlag(current, flag)
+		want := has
+		switch op {
+		case imap.SetFlags:
+			want = hasFlag(flags, flag)
+		case imap.AddFlags:
+			want = has || hasFlag(flags, flag)
+		case imap.RemoveFlags:
+			want = has && !hasFlag(flags, flag)
+		}
+		if has != want {
+			return nil, errReadOnlyFlag
+		}
+	}
+
+	if op != imap.SetFlags {
+		return nil, nil
+	}
+	var removed []string
+	for _, flag := range current {
+		// \Recent can't be changed by clients
+		if flag == imap.RecentFlag || hasFlag(readOnlyFlags, flag) || hasFlag(flags, flag) {
+			continue
+		}
+		removed = append(removed, flag)
+	}
+	return removed, nil
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+func (mbox *mailbox) storeFlags(apiIDs []string, op imap.FlagsOp, flags []string) error {
 	for _, flag := range flags {
 		var err error
+		var apply func(c *protonmail.Client, apiIDs []string) error
 		switch flag {
 		case imap.SeenFlag:
 			switch op {
 			case imap.SetFlags, imap.AddFlags:
-				err = mbox.u.c.MarkMessagesRead(apiIDs)
+				apply = (*protonmail.Client).MarkMessagesRead
 			case imap.RemoveFlags:
-				err = mbox.u.c.MarkMessagesUnread(apiIDs)
+				apply = (*protonmail.Client).MarkMessagesUnread
 			}
 		case imap.FlaggedFlag:
 			switch op {
 			case imap.SetFlags, imap.AddFlags:
-				err = mbox.u.c.LabelMessages(protonmail.LabelStarred, apiIDs)
+				apply = func(c *protonmail.Client, apiIDs []string) error {
+					return c.LabelMessages(protonmail.LabelStarred, apiIDs)
+				}
 			case imap.RemoveFlags:
-				err = mbox.u.c.UnlabelMessages(protonmail.LabelStarred, apiIDs)
+				apply = func(c *protonmail.Client, apiIDs []string) error {
+					return c.UnlabelMessages(protonmail.LabelStarred, apiIDs)
+				}
 			}
 		case imap.DeletedFlag:
 			// TODO: send updates
@@ -433,34 +786,144 @@ func (mbox *mailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.
 					delete(mbox.deleted, apiID)
 				}
 			}
+			err = mbox.u.db.TouchMessages(apiIDs)
+		default:
+			labelID, ok := mbox.u.keywordLabel(flag)
+			if !ok {
+				break
+			}
+			switch op {
+			case imap.SetFlags, imap.AddFlags:
+				apply = func(c *protonmail.Client, apiIDs []string) error {
+					return c.LabelMessages(labelID, apiIDs)
+				}
+			case imap.RemoveFlags:
+				apply = func(c *protonmail.Client, apiIDs []string) error {
+					return c.UnlabelMessages(labelID, apiIDs)
+				}
+			}
+		}
+		if apply != nil {
+			if err = apply(mbox.u.c, apiIDs); err != nil {
+				err = mbox.u.queueOffline(err, "store "+flag, apiIDs, apply)
+			}
 		}
 		if err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
-	return mbox.Poll()
+// unchangedSince splits a set into messages that haven't been modified after
+// modSeq and messages that have. The returned sets contain UIDs if uid is set,
+// sequence numbers otherwise.
+func (mbox *mailbox) unchangedSince(uid bool, seqSet *imap.SeqSet, modSeq uint64) (unchanged, modified *imap.SeqSet, err error) {
+	unchanged = new(imap.SeqSet)
+	modified = new(imap.SeqSet)
+	err = mbox.db.ForEach(func(seqNum, u uint32, apiID string) error {
+		id := seqNum
+		if uid {
+			id = u
+		}
+		if !seqSet.Contains(id) {
+			return nil
+		}
+
+		msgModSeq, err := mbox.u.db.ModSeq(apiID)
+		if err != nil {
+			return err
+		}
+		if msgModSeq > modSeq {
+			modified.AddNum(id)
+		} else {
+			unchanged.AddNum(id)
+		}
+		return nil
+	})
+	return
+}
+
+// vanished returns the UIDs in uids of messages removed from the mailbox after
+// modSeq. If uids is nil, all removed messages are returned.
+func (mbox *mailbox) vanished(modSeq uint64, uids *imap.SeqSet) (*imap.SeqSet, error) {
+	l, err := mbox.db.Vanished(modSeq)
+	if err != nil {
+		return nil, err
+	}
+
+	set := new(imap.SeqSet)
+	for _, uid := range l {
+		if uids == nil || uids.Contains(uid) {
+			set.AddNum(uid)
+		}
+	}
+	return set, nil
 }
 
 func (mbox *mailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
+	_, _, err := mbox.copyMessages(uid, seqSet, destName)
+	return err
+}
+
+// copyMessages copies messages to another mailbox. It returns the UIDs of the
+// copied messages in the source and destination mailboxes, in the same order.
+// Messages not yet in the destination's local database are omitted.
+func (mbox *mailbox) copyMessages(uid bool, seqSet *imap.SeqSet, destName string) (srcUIDs, destUIDs []uint32, err error) {
 	if err := mbox.init(); err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	apiIDs, err := mbox.fromSeqSet(uid, seqSet)
+	dest := mbox.u.getMailbox(destName)
+	if dest == nil {
+		return nil, nil, imapbackend.ErrNoSuchMailbox
+	}
+	if err := dest.checkInsert(); err != nil {
+		return nil, nil, err
+	}
+	if err := dest.init(); err != nil {
+		return nil, nil, err
+	}
+
+	var apiIDs []string
+	srcUIDsByID := make(map[string]uint32)
+	err = mbox.db.ForEach(func(seqNum, u uint32, apiID string) error {
+		id := seqNum
+		if uid {
+			id = u
+		}
+		if seqSet.Contains(id) {
+			apiIDs = append(apiIDs, apiID)
+			srcUIDsByID[apiID] = u
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	dest := mbox.u.getMailbox(destName)
-	if dest == nil {
-		return imapbackend.ErrNoSuchMailbox
+	label := func(c *protonmail.Client, apiIDs []string) error {
+		return c.LabelMessages(dest.label, apiIDs)
+	}
+	if err := label(mbox.u.c, apiIDs); err != nil {
+		// Queued copies have no UIDs yet
+		return nil, nil, mbox.pollOnError(mbox.u.queueOffline(err, "copy", apiIDs, label))
+	}
+	if err := mbox.Poll(); err != nil {
+		return nil, nil, err
 	}
 
-	if err := mbox.u.c.LabelMessages(dest.label, apiIDs); err != nil {
-		return err
+	for _, apiID := range apiIDs {
+		_, destUID, err := dest.db.FromApiID(apiID)
+		if err == database.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		srcUIDs = append(srcUIDs, srcUIDsByID[apiID])
+		destUIDs = append(destUIDs, destUID)
 	}
-	return mbox.Poll()
+	return srcUIDs, destUIDs, nil
 }
 
 func (mbox *mailbox) MoveMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
@@ -477,28 +940,88 @@ func (mbox *mailbox) MoveMessages(uid bool, seqSet *imap.SeqSet, destName string
 	if dest == nil {
 		return imapbackend.ErrNoSuchMailbox
 	}
-
-	if err := mbox.u.c.LabelMessages(dest.label, apiIDs); err != nil {
-		return err
+	if dest == mbox {
+		// Unlabeling would remove the messages from the mailbox
+		return nil
 	}
-	if err := mbox.u.c.UnlabelMessages(mbox.label, apiIDs); err != nil {
+	if err := dest.checkInsert(); err != nil {
 		return err
 	}
+
+	move := func(c *protonmail.Client, apiIDs []string) error {
+		if err := c.LabelMessages(dest.label, apiIDs); err != nil {
+			return err
+		}
+		// All Mail contains all messages, it can't be removed from them
+		if mbox.label != protonmail.LabelAllMail {
+			return c.UnlabelMessages(mbox.label, apiIDs)
+		}
+		return nil
+	}
+	if err := move(mbox.u.c, apiIDs); err != nil {
+		return mbox.pollOnError(mbox.u.queueOffline(err, "move", apiIDs, move))
+	}
+	// Polling sends the resulting expunge updates before the command completes
 	return mbox.Poll()
 }
 
 func (mbox *mailbox) Expunge() error {
+	return mbox.expunge(nil)
+}
+
+// expunge removes messages marked as deleted. They're moved to the trash,
+// except in the trash itself where they're permanently deleted. If uids isn't
+// nil, only messages whose UID is in the set are removed.
+func (mbox *mailbox) expunge(uids *imap.SeqSet) error {
+	if err := mbox.checkDelete(); err != nil {
+		return err
+	}
 	if err := mbox.init(); err != nil {
 		return err
 	}
 
 	apiIDs := make([]string, 0, len(mbox.deleted))
 	for apiID := range mbox.deleted {
+		if uids != nil {
+			_, uid, err := mbox.db.FromApiID(apiID)
+			if err == database.ErrNotFound || (err == nil && !uids.Contains(uid)) {
+				continue
+			} else if err != nil {
+				return err
+			}
+		}
 		apiIDs = append(apiIDs, apiID)
 	}
+	if len(apiIDs) == 0 {
+		return mbox.Poll()
+	}
 
-	if err := mbox.u.c.DeleteMessages(apiIDs); err != nil {
-		return err
+	switch {
+	case mbox.permissions().expungeToTrash:
+		// Messages stay in the mailbox once trashed
+		if err := mbox.u.c.LabelMessages(protonmail.LabelTrash, apiIDs); err != nil {
+			return mbox.pollOnError(err)
+		}
+		for _, apiID := range apiIDs {
+			delete(mbox.deleted, apiID)
+		}
+		if err := mbox.u.db.TouchMessages(apiIDs); err != nil {
+			return err
+		}
+	case mbox.label == protonmail.LabelTrash || mbox.u.expungeDelete:
+		if err := mbox.u.c.DeleteMessages(apiIDs); err != nil {
+			return mbox.pollOnError(err)
+		}
+	default:
+		if err := mbox.u.c.LabelMessages(protonmail.LabelTrash, apiIDs); err != nil {
+			return mbox.pollOnError(err)
+		}
+		// Trashed messages keep their labels, remove them from the mailbox
+		if mbox.custom {
+			if err := mbox.u.c.UnlabelMessages(mbox.label, apiIDs); err != nil {
+				return mbox.pollOnError(err)
+			}
+		}
 	}
 
 	return mbox.Poll()
@@ -508,3 +1031,12 @@ func (mbox *mailbox) Poll() error {
 	mbox.u.poll()
 	return nil
 }
+
+// pollOnError polls if err isn't nil, and returns err. Bulk requests may have
+// been partially applied before failing.
+func (mbox *mailbox) pollOnError(err error) error {
+	if err != nil {
+		mbox.Poll()
+	}
+	return err
+}
@@ -0,0 +1,554 @@
+package imap
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestFetchFlags(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  protonmail.Message
+		want []string
+	}{
+		{"unread", protonmail.Message{Unread: 1}, nil},
+		{"read", protonmail.Message{}, []string{imap.SeenFlag}},
+		{"replied", protonmail.Message{Unread: 1, IsReplied: 1}, []string{imap.AnsweredFlag}},
+		{"replied all", protonmail.Message{Unread: 1, IsRepliedAll: 1}, []string{imap.AnsweredFlag}},
+		{"forwarded", protonmail.Message{Unread: 1, IsForwarded: 1}, []string{imap.AnsweredFlag}},
+		{"starred", protonmail.Message{Unread: 1, LabelIDs: []string{protonmail.LabelInbox, protonmail.LabelStarred}}, []string{imap.FlaggedFlag}},
+		{"draft", protonmail.Message{LabelIDs: []string{protonmail.LabelDraft}}, []string{imap.SeenFlag, imap.DraftFlag}},
+	}
+	for _, tc := range tests {
+		if got := fetchFlags(&tc.msg); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: fetchFlags() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRemovedFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		current []string
+		op      imap.FlagsOp
+		flags   []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "set removes system flags",
+			current: []string{imap.SeenFlag, imap.FlaggedFlag, imap.DeletedFlag},
+			op:      imap.SetFlags,
+			flags:   []string{imap.SeenFlag},
+			want:    []string{imap.FlaggedFlag, imap.DeletedFlag},
+		},
+		{
+			name:    "set removes keywords",
+			current: []string{imap.SeenFlag, "$Label_Work", "$Label_Home"},
+			op:      imap.SetFlags,
+			flags:   []string{imap.SeenFlag, "$label_home"},
+			want:    []string{"$Label_Work"},
+		},
+		{
+			name:    "set keeps read-only and recent flags",
+			current: []string{imap.AnsweredFlag, imap.RecentFlag},
+			op:      imap.SetFlags,
+			flags:   []string{imap.AnsweredFlag},
+		},
+		{
+			name:    "set clears answered",
+			current: []string{imap.AnsweredFlag},
+			op:      imap.SetFlags,
+			wantErr: true,
+		},
+		{
+			name:    "set adds draft",
+			op:      imap.SetFlags,
+			flags:   []string{imap.DraftFlag},
+			wantErr: true,
+		},
+		{
+			name:    "add answered already set",
+			current: []string{imap.AnsweredFlag},
+			op:      imap.AddFlags,
+			flags:   []string{imap.AnsweredFlag, imap.SeenFlag},
+		},
+		{
+			name:    "add answered",
+			op:      imap.AddFlags,
+			flags:   []string{imap.AnsweredFlag},
+			wantErr: true,
+		},
+		{
+			name:    "add doesn't remove",
+			current: []string{imap.FlaggedFlag},
+			op:      imap.AddFlags,
+			flags:   []string{imap.SeenFlag},
+		},
+		{
+			name:    "remove draft",
+			current: []string{imap.DraftFlag},
+			op:      imap.RemoveFlags,
+			flags:   []string{imap.DraftFlag},
+			wantErr: true,
+		},
+		{
+			name:  "remove draft not set",
+			op:    imap.RemoveFlags,
+			flags: []string{imap.DraftFlag, imap.SeenFlag},
+		},
+	}
+	for _, tc := range tests {
+		got, err := removedFlags(tc.current, tc.op, tc.flags)
+		if tc.wantErr {
+			if err != errReadOnlyFlag {
+				t.Errorf("%v: removedFlags() = %v, want errReadOnlyFlag", tc.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: removedFlags() = %v", tc.name, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: removedFlags() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestStoreFlags(t *testing.T) {
+	api := new(testAPI)
+	u := newTestUser(t, api)
+	u.keywords["$label_work"] = "work"
+	u.labelKeywords["work"] = "$Label_Work"
+
+	ids := []string{"msg1", "msg2"}
+	tests := []struct {
+		flag    string
+		op      imap.FlagsOp
+		want    []apiRequest
+		deleted bool
+	}{
+		{flag: imap.SeenFlag, op: imap.AddFlags, want: []apiRequest{{"/messages/read", "", ids}}},
+		{flag: imap.SeenFlag, op: imap.SetFlags, want: []apiRequest{{"/messages/read", "", ids}}},
+		{flag: imap.SeenFlag, op: imap.RemoveFlags, want: []apiRequest{{"/messages/unread", "", ids}}},
+		{flag: imap.FlaggedFlag, op: imap.AddFlags, want: []apiRequest{{"/messages/label", protonmail.LabelStarred, ids}}},
+		{flag: imap.FlaggedFlag, op: imap.RemoveFlags, want: []apiRequest{{"/messages/unlabel", protonmail.LabelStarred, ids}}},
+		{flag: "$Label_Work", op: imap.AddFlags, want: []apiRequest{{"/messages/label", "work", ids}}},
+		{flag: "$LABEL_WORK", op: imap.RemoveFlags, want: []apiRequest{{"/messages/unlabel", "work", ids}}},
+		{flag: "$Label_Unknown", op: imap.AddFlags},
+		{flag: imap.AnsweredFlag, op: imap.AddFlags},
+		{flag: imap.DraftFlag, op: imap.AddFlags},
+		{flag: imap.DeletedFlag, op: imap.AddFlags, deleted: true},
+		{flag: imap.DeletedFlag, op: imap.RemoveFlags},
+	}
+	for _, tc := range tests {
+		mbox := &mailbox{u: u, deleted: make(map[string]struct{})}
+		if tc.op == imap.RemoveFlags {
+			for _, id := range ids {
+				mbox.deleted[id] = struct{}{}
+			}
+		}
+
+		if err := mbox.storeFlags(ids, tc.op, []string{tc.flag}); err != nil {
+			t.Errorf("%v %v: storeFlags() = %v", tc.op, tc.flag, err)
+			continue
+		}
+		if requests := api.reset(); !reflect.DeepEqual(requests, tc.want) {
+			t.Errorf("%v %v: requests = %v, want %v", tc.op, tc.flag, requests, tc.want)
+		}
+		if tc.flag == imap.DeletedFlag {
+			if _, deleted := mbox.deleted[ids[0]]; deleted != tc.deleted {
+				t.Errorf("%v %v: deleted = %v, want %v", tc.op, tc.flag, deleted, tc.deleted)
+			}
+		}
+	}
+}
+
+func TestMoveMessages(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		dest     string
+		want     []apiRequest
+		wantErr  error
+		wantFail bool
+	}{
+		{
+			name: "inbox to archive",
+			src:  protonmail.LabelInbox,
+			dest: "Archive",
+			want: []apiRequest{
+				{"/messages/label", protonmail.LabelArchive, []string{"msg1"}},
+				{"/messages/unlabel", protonmail.LabelInbox, []string{"msg1"}},
+			},
+		},
+		{
+			name: "all mail to archive",
+			src:  protonmail.LabelAllMail,
+			dest: "Archive",
+			want: []apiRequest{{"/messages/label", protonmail.LabelArchive, []string{"msg1"}}},
+		},
+		{name: "same mailbox", src: protonmail.LabelInbox, dest: "INBOX"},
+		{name: "to starred", src: protonmail.LabelInbox, dest: "Starred", wantFail: true},
+		{name: "to all mail", src: protonmail.LabelInbox, dest: "All Mail", wantFail: true},
+		{name: "unknown mailbox", src: protonmail.LabelInbox, dest: "Unknown", wantErr: imapbackend.ErrNoSuchMailbox},
+	}
+	for _, tc := range tests {
+		api := new(testAPI)
+		u := newTestUser(t, api)
+		addTestMessages(t, u, &protonmail.Message{
+			ID:       "msg1",
+			LabelIDs: []string{protonmail.LabelInbox, protonmail.LabelAllMail},
+		})
+
+		seqSet, _ := imap.ParseSeqSet("1")
+		err := u.getMailboxByLabel(tc.src).MoveMessages(false, seqSet, tc.dest)
+		switch {
+		case tc.wantErr != nil:
+			if err != tc.wantErr {
+				t.Errorf("%v: MoveMessages() = %v, want %v", tc.name, err, tc.wantErr)
+			}
+		case tc.wantFail:
+			if err == nil {
+				t.Errorf("%v: MoveMessages() = nil, want an error", tc.name)
+			}
+		case err != nil:
+			t.Errorf("%v: MoveMessages() = %v", tc.name, err)
+		}
+		if requests := api.reset(); !reflect.DeepEqual(requests, tc.want) {
+			t.Errorf("%v: requests = %v, want %v", tc.name, requests, tc.want)
+		}
+	}
+}
+
+func TestExpungeToTrash(t *testing.T) {
+	ids := []string{"msg1"}
+	tests := []struct {
+		name          string
+		label         string
+		expungeDelete bool
+		want          []apiRequest
+	}{
+		{
+			name:  "inbox",
+			label: protonmail.LabelInbox,
+			want:  []apiRequest{{"/messages/label", protonmail.LabelTrash, ids}},
+		},
+		{
+			name:  "custom",
+			label: "custom",
+			want: []apiRequest{
+				{"/messages/label", protonmail.LabelTrash, ids},
+				{"/messages/unlabel", "custom", ids},
+			},
+		},
+		{
+			name:          "inbox with expungeDelete",
+			label:         protonmail.LabelInbox,
+			expungeDelete: true,
+			want:          []apiRequest{{"/messages/delete", "", ids}},
+		},
+		{
+			name:          "custom with expungeDelete",
+			label:         "custom",
+			expungeDelete: true,
+			want:          []apiRequest{{"/messages/delete", "", ids}},
+		},
+		{
+			name:          "all mail with expungeDelete",
+			label:         protonmail.LabelAllMail,
+			expungeDelete: true,
+			want:          []apiRequest{{"/messages/label", protonmail.LabelTrash, ids}},
+		},
+	}
+	for _, tc := range tests {
+		api := new(testAPI)
+		u := newTestUser(t, api)
+		u.expungeDelete = tc.expungeDelete
+		mboxDB, err := u.db.Mailbox("custom")
+		if err != nil {
+			t.Fatalf("database.User.Mailbox() = %v", err)
+		}
+		u.mailboxes["custom"] = &mailbox{
+			name:        "Custom",
+			label:       "custom",
+			custom:      true,
+			u:           u,
+			db:          mboxDB,
+			initialized: true,
+			deleted:     make(map[string]struct{}),
+		}
+		addTestMessages(t, u, &protonmail.Message{
+			ID:       "msg1",
+			LabelIDs: []string{tc.label},
+		})
+		mbox := u.getMailboxByLabel(tc.label)
+		mbox.deleted["msg1"] = struct{}{}
+
+		if err := mbox.Expunge(); err != nil {
+			t.Errorf("%v: Expunge() = %v", tc.name, err)
+		}
+		if requests := api.reset(); !reflect.DeepEqual(requests, tc.want) {
+			t.Errorf("%v: requests = %v, want %v", tc.name, requests, tc.want)
+		}
+	}
+}
+
+func TestSeqContains(t *testing.T) {
+	tests := []struct {
+		seq  string
+		id   uint32
+		want bool
+	}{
+		{"2", 2, true},
+		{"2", 3, false},
+		{"2:4", 3, true},
+		{"4:2", 3, true},
+		{"2:4", 5, false},
+		{"*", 10, true},
+		{"*", 9, false},
+		{"5:*", 7, true},
+		{"5:*", 4, false},
+		{"20:*", 10, true},
+	}
+	for _, tc := range tests {
+		seqSet, err := imap.ParseSeqSet(tc.seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := seqContains(seqSet.Set[0], tc.id, 10); got != tc.want {
+			t.Errorf("seqContains(%v, %v, 10) = %v, want %v", tc.seq, tc.id, got, tc.want)
+		}
+	}
+}
+
+func TestMatchMessages(t *testing.T) {
+	u := newTestUser(t, new(testAPI))
+	for _, id := range []string{"msg1", "msg2", "msg3", "msg4"} {
+		addTestMessages(t, u, &protonmail.Message{ID: id, LabelIDs: []string{protonmail.LabelInbox}})
+	}
+	// UIDs are now 1, 3 and 4
+	if _, err := u.db.DeleteMessage("msg2"); err != nil {
+		t.Fatalf("database.User.DeleteMessage() = %v", err)
+	}
+	mbox := u.getMailboxByLabel(protonmail.LabelInbox)
+
+	tests := []struct {
+		uid  bool
+		set  string
+		want []string
+	}{
+		{false, "1:*", []string{"msg1", "msg3", "msg4"}},
+		{false, "*", []string{"msg4"}},
+		{false, "3,1", []string{"msg1", "msg4"}},
+		{false, "2:1,2", []string{"msg1", "msg3"}},
+		{false, "5", nil},
+		{true, "2", nil},
+		{true, "2:3", []string{"msg3"}},
+		{true, "*", []string{"msg4"}},
+		{true, "10:*", []string{"msg4"}},
+	}
+	for _, tc := range tests {
+		seqSet, err := imap.ParseSeqSet(tc.set)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs, err := mbox.matchMessages(tc.uid, seqSet)
+		if err != nil {
+			t.Errorf("matchMessages(%v, %v) = %v", tc.uid, tc.set, err)
+			continue
+		}
+		var got []string
+		for _, ref := range refs {
+			got = append(got, ref.apiID)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("matchMessages(%v, %v) = %v, want %v", tc.uid, tc.set, got, tc.want)
+		}
+	}
+}
+
+func TestSearchFilter(t *testing.T) {
+	mbox := &mailbox{label: protonmail.LabelInbox}
+
+	tests := []struct {
+		name   string
+		header [][2]string
+		want   *protonmail.MessageFilter
+	}{
+		{name: "none"},
+		{
+			name:   "subject",
+			header: [][2]string{{"Subject", "hello"}},
+			want:   &protonmail.MessageFilter{Label: protonmail.LabelInbox, Subject: "hello"},
+		},
+		{
+			name:   "from and to",
+			header: [][2]string{{"From", "alice"}, {"To", "bob"}},
+			want:   &protonmail.MessageFilter{Label: protonmail.LabelInbox, From: "alice", To: "bob"},
+		},
+		{
+			name:   "two subjects",
+			header: [][2]string{{"Subject", "hello"}, {"Subject", "world"}},
+		},
+		{
+			name:   "two subjects and from",
+			header: [][2]string{{"Subject", "hello"}, {"Subject", "world"}, {"From", "alice"}},
+			want:   &protonmail.MessageFilter{Label: protonmail.LabelInbox, From: "alice"},
+		},
+		{
+			name:   "other header",
+			header: [][2]string{{"Message-Id", "<id@example.org>"}},
+		},
+	}
+	for _, tc := range tests {
+		c := imap.NewSearchCriteria()
+		for _, kv := range tc.header {
+			c.Header.Add(kv[0], kv[1])
+		}
+		if got := mbox.searchFilter(c); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: searchFilter() = %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSameDraft(t *testing.T) {
+	msg := &protonmail.Message{
+		Subject: "Hello",
+		ToList:  []*protonmail.MessageAddress{{Address: "alice@example.org"}, {Address: "bob@example.org"}},
+	}
+	tests := []struct {
+		name    string
+		subject string
+		toList  []*mail.Address
+		want    bool
+	}{
+		{"same", "Hello", []*mail.Address{{Address: "Alice@example.org"}, {Address: "bob@example.org"}}, true},
+		{"other subject", "Hi", []*mail.Address{{Address: "alice@example.org"}, {Address: "bob@example.org"}}, false},
+		{"fewer recipients", "Hello", []*mail.Address{{Address: "alice@example.org"}}, false},
+		{"other order", "Hello", []*mail.Address{{Address: "bob@example.org"}, {Address: "alice@example.org"}}, false},
+	}
+	for _, tc := range tests {
+		if got := sameDraft(msg, tc.subject, tc.toList); got != tc.want {
+			t.Errorf("%v: sameDraft() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestPreviousDraft(t *testing.T) {
+	alice := []*protonmail.MessageAddress{{Address: "alice@example.org"}}
+	bob := []*protonmail.MessageAddress{{Address: "bob@example.org"}}
+
+	tests := []struct {
+		name        string
+		messageID   string
+		subject     string
+		to          string
+		matchDrafts bool
+		want        string
+	}{
+		{name: "message ID", messageID: "<draft1@protonmail.com>", subject: "Other", want: "draft1"},
+		{name: "external ID", messageID: "<external@example.org>", want: "draft2"},
+		{name: "unknown message ID", messageID: "<unknown@example.org>", subject: "Hello", to: "bob@example.org"},
+		{name: "no match", subject: "Hello", to: "bob@example.org"},
+		{name: "match", subject: "Hello", to: "bob@example.org", matchDrafts: true, want: "draft3"},
+		{name: "ambiguous match", subject: "Hello", to: "alice@example.org", matchDrafts: true},
+		{name: "message ID first", messageID: "<draft1@protonmail.com>", subject: "Hello", to: "bob@example.org", matchDrafts: true, want: "draft1"},
+	}
+	for _, tc := range tests {
+		u := newTestUser(t, new(testAPI))
+		u.matchDrafts = tc.matchDrafts
+		drafts := []string{protonmail.LabelDraft}
+		addTestMessages(t, u,
+			&protonmail.Message{ID: "draft1", Subject: "Hello", ToList: alice, LabelIDs: drafts},
+			&protonmail.Message{ID: "draft2", ExternalID: "external@example.org", Subject: "Hello", ToList: alice, LabelIDs: drafts},
+			&protonmail.Message{ID: "draft3", Subject: "Hello", ToList: bob, LabelIDs: drafts},
+			&protonmail.Message{ID: "inbox", Subject: "Hello", ToList: bob, LabelIDs: []string{protonmail.LabelInbox}},
+		)
+		mbox := u.getMailboxByLabel(protonmail.LabelDraft)
+
+		h := mail.Header{Header: make(message.Header)}
+		for k, v := range map[string]string{"Message-Id": tc.messageID, "Subject": tc.subject, "To": tc.to} {
+			if v != "" {
+				h.Set(k, v)
+			}
+		}
+		prev, err := mbox.previousDraft(h)
+		if err != nil {
+			t.Errorf("%v: previousDraft() = %v", tc.name, err)
+		} else if tc.want == "" && prev != nil {
+			t.Errorf("%v: previousDraft() = %v, want none", tc.name, prev.ID)
+		} else if tc.want != "" && (prev == nil || prev.ID != tc.want) {
+			t.Errorf("%v: previousDraft() = %v, want %v", tc.name, prev, tc.want)
+		}
+	}
+}
+
+func TestUpdateMessagesFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		op      imap.FlagsOp
+		seqNum  uint32
+		flags   []string
+		want    []apiRequest
+		wantErr bool
+	}{
+		{
+			name:   "set removes starred",
+			op:     imap.SetFlags,
+			seqNum: 1,
+			flags:  []string{imap.SeenFlag},
+			want:   []apiRequest{{"/messages/unlabel", protonmail.LabelStarred, []string{"msg1"}}, {"/messages/read", "", []string{"msg1"}}},
+		},
+		{
+			name:   "set keeps forwarded",
+			op:     imap.SetFlags,
+			seqNum: 2,
+			flags:  []string{imap.AnsweredFlag},
+			want:   []apiRequest{{"/messages/unread", "", []string{"msg2"}}},
+		},
+		{
+			name:    "add answered",
+			op:      imap.AddFlags,
+			seqNum:  1,
+			flags:   []string{imap.AnsweredFlag},
+			wantErr: true,
+		},
+		{
+			name:   "remove flagged",
+			op:     imap.RemoveFlags,
+			seqNum: 1,
+			flags:  []string{imap.FlaggedFlag},
+			want:   []apiRequest{{"/messages/unlabel", protonmail.LabelStarred, []string{"msg1"}}},
+		},
+	}
+	for _, tc := range tests {
+		api := new(testAPI)
+		u := newTestUser(t, api)
+		addTestMessages(t, u,
+			&protonmail.Message{ID: "msg1", Unread: 1, LabelIDs: []string{protonmail.LabelInbox, protonmail.LabelStarred}},
+			&protonmail.Message{ID: "msg2", IsForwarded: 1, LabelIDs: []string{protonmail.LabelInbox}},
+		)
+		mbox := u.getMailboxByLabel(protonmail.LabelInbox)
+
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(tc.seqNum)
+		err := mbox.UpdateMessagesFlags(false, seqSet, tc.op, tc.flags)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%v: UpdateMessagesFlags() = nil, want an error", tc.name)
+			}
+		} else if err != nil {
+			t.Errorf("%v: UpdateMessagesFlags() = %v", tc.name, err)
+		}
+		if requests := api.reset(); !reflect.DeepEqual(requests, tc.want) {
+			t.Errorf("%v: requests = %v, want %v", tc.name, requests, tc.want)
+		}
+	}
+}
@@ -2,18 +2,22 @@ package imap
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
+	"log/slog"
 	"strings"
 	"time"
 
 	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/backendutil"
 	"github.com/emersion/go-message"
 	"github.com/emersion/go-message/mail"
 	"golang.org/x/crypto/openpgp"
 
+	"github.com/emersion/hydroxide/charset"
 	"github.com/emersion/hydroxide/protonmail"
 )
 
@@ -53,16 +57,29 @@ func imapAddress(addr *protonmail.MessageAddress) *imap.Address {
 	}
 
 	return &imap.Address{
-		PersonalName: addr.Name,
+		PersonalName: addr.DisplayName(),
 		MailboxName:  parts[0],
 		HostName:     parts[1],
 	}
 }
 
+// imapAddressList converts addresses to an envelope address list. Groups are
+// delimited with addresses without a host name, as defined in RFC 3501.
 func imapAddressList(addresses []*protonmail.MessageAddress) []*imap.Address {
-	l := make([]*imap.Address, len(addresses))
-	for i, addr := range addresses {
-		l[i] = imapAddress(addr)
+	l := make([]*imap.Address, 0, len(addresses))
+	for i := 0; i < len(addresses); {
+		group := addresses[i].Group
+		if group == "" {
+			l = append(l, imapAddress(addresses[i]))
+			i++
+			continue
+		}
+
+		l = append(l, &imap.Address{MailboxName: group})
+		for ; i < len(addresses) && addresses[i].Group == group; i++ {
+			l = append(l, imapAddress(addresses[i]))
+		}
+		l = append(l, &imap.Address{})
 	}
 	return l
 }
@@ -75,7 +92,7 @@ func fetchEnvelope(msg *protonmail.Message) *imap.Envelope {
 
 	return &imap.Envelope{
 		Date:    time.Unix(msg.Time, 0),
-		Subject: msg.Subject,
+		Subject: charset.DecodeHeader(msg.Subject),
 		From:    []*imap.Address{imapAddress(msg.Sender)},
 		// TODO: Sender
 		ReplyTo: replyTo,
@@ -96,13 +113,17 @@ func hasLabel(msg *protonmail.Message, labelID string) bool {
 	return false
 }
 
+// fetchFlags returns the system flags of a message. \Answered and \Draft are
+// read-only: ProtonMail sets them when a reply or a forward is sent and when a
+// draft is saved.
+//
 // Doesn't support imap.DeletedFlag.
 func fetchFlags(msg *protonmail.Message) []string {
 	var flags []string
 	if msg.Unread != 1 {
 		flags = append(flags, imap.SeenFlag)
 	}
-	if msg.IsReplied != 0 || msg.IsRepliedAll != 0 {
+	if msg.IsReplied != 0 || msg.IsRepliedAll != 0 || msg.IsForwarded != 0 {
 		flags = append(flags, imap.AnsweredFlag)
 	}
 	for _, label := range msg.LabelIDs {
@@ -125,6 +146,22 @@ func splitMIMEType(t string) (string, string) {
 }
 
 func (mbox *mailbox) fetchBodyStructure(msg *protonmail.Message, extended bool) (*imap.BodyStructure, error) {
+	// Messages without attachments don't need to be fetched
+	fetch := isPGPMessage(msg) || msg.NumAttachments > 0
+	if e, err := mbox.cachedMessage(msg, fetch); err != nil {
+		return nil, err
+	} else if e != nil {
+		return backendutil.FetchBodyStructure(e, extended)
+	}
+
+	if isPGPMessage(msg) {
+		if e, err := mbox.decryptPGPMessage(msg); err != nil {
+			return nil, err
+		} else if e != nil {
+			return backendutil.FetchBodyStructure(e, extended)
+		}
+	}
+
 	if msg.NumAttachments > 0 {
 		var err error
 		msg, err = mbox.u.c.GetMessage(msg.ID)
@@ -133,43 +170,56 @@ func (mbox *mailbox) fetchBodyStructure(msg *protonmail.Message, extended bool)
 		}
 	}
 
-	inlineType, inlineSubType := splitMIMEType(msg.MIMEType)
-	parts := []*imap.BodyStructure{
-		&imap.BodyStructure{
+	return partBodyStructure(msg, messageTree(msg), extended), nil
+}
+
+func partBodyStructure(msg *protonmail.Message, p *messagePart, extended bool) *imap.BodyStructure {
+	if p.isMultipart() {
+		parts := make([]*imap.BodyStructure, len(p.children))
+		for i, child := range p.children {
+			parts[i] = partBodyStructure(msg, child, extended)
+		}
+		return &imap.BodyStructure{
+			MIMEType:    "multipart",
+			MIMESubType: p.subType,
+			// TODO: Params: map[string]string{"boundary": ...},
+			// TODO: Size
+			Parts:    parts,
+			Extended: extended,
+		}
+	}
+
+	if p.att == nil {
+		inlineType, inlineSubType := splitMIMEType(msg.MIMEType)
+		return &imap.BodyStructure{
 			MIMEType:    inlineType,
 			MIMESubType: inlineSubType,
 			Encoding:    "quoted-printable",
 			Size:        uint32(len(msg.Body)),
 			Extended:    extended,
 			Disposition: "inline",
-		},
-	}
-
-	for _, att := range msg.Attachments {
-		attType, attSubType := splitMIMEType(att.MIMEType)
-		parts = append(parts, &imap.BodyStructure{
-			MIMEType:          attType,
-			MIMESubType:       attSubType,
-			Id:                att.ContentID,
-			Encoding:          "base64",
-			Size:              uint32(att.Size),
-			Extended:          extended,
-			Disposition:       "attachment",
-			DispositionParams: map[string]string{"filename": att.Name},
-		})
+		}
 	}
 
+	att := p.att
+	attType, attSubType := splitMIMEType(att.MIMEType)
 	return &imap.BodyStructure{
-		MIMEType:    "multipart",
-		MIMESubType: "mixed",
-		// TODO: Params: map[string]string{"boundary": ...},
-		// TODO: Size
-		Parts:    parts,
-		Extended: extended,
-	}, nil
+		MIMEType:          attType,
+		MIMESubType:       attSubType,
+		Id:                formatContentID(att.ContentID),
+		Encoding:          "base64",
+		Size:              uint32(att.Size),
+		Extended:          extended,
+		Disposition:       attachmentDisposition(att),
+		DispositionParams: map[string]string{"filename": att.Name},
+	}
 }
 
 func (mbox *mailbox) inlineBody(msg *protonmail.Message) (io.Reader, error) {
+	if msg.IsEncrypted == protonmail.MessageEncryptedOutside {
+		return mbox.outsideBody(msg), nil
+	}
+
 	md, err := msg.Read(mbox.u.privateKeys, nil)
 	if err != nil {
 		return nil, err
@@ -179,221 +229,380 @@ func (mbox *mailbox) inlineBody(msg *protonmail.Message) (io.Reader, error) {
 	return md.UnverifiedBody, nil
 }
 
-func (mbox *mailbox) attachmentBody(att *protonmail.Attachment) (io.Reader, error) {
-	rc, err := mbox.u.c.GetAttachment(att.ID)
-	if err != nil {
-		return nil, err
-	}
-
-	md, err := att.Read(rc, mbox.u.privateKeys, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	// TODO: check signature
-	return md.UnverifiedBody, nil
+func (mbox *mailbox) attachmentBody(att *protonmail.Attachment) (io.ReadCloser, error) {
+	return mbox.u.c.GetAttachment(att, mbox.u.privateKeys)
 }
 
 func inlineHeader(msg *protonmail.Message) message.Header {
 	h := mail.NewTextHeader()
 	if msg.MIMEType != "" {
-		h.SetContentType(msg.MIMEType, nil)
+		// Bodies are always stored in UTF-8
+		h.SetContentType(msg.MIMEType, map[string]string{"charset": "utf-8"})
 	} else {
-		log.Println("Sending an inline header without its proper MIME type")
+		slog.Warn("sending an inline header without its proper MIME type")
 	}
 	h.Set("Content-Transfer-Encoding", "quoted-printable")
 	return h.Header
 }
 
+func attachmentDisposition(att *protonmail.Attachment) string {
+	if att.IsInline() {
+		return "inline"
+	}
+	return "attachment"
+}
+
 func attachmentHeader(att *protonmail.Attachment) message.Header {
 	h := mail.NewAttachmentHeader()
 	h.SetContentType(att.MIMEType, nil)
 	h.Set("Content-Transfer-Encoding", "base64")
-	h.SetFilename(att.Name)
+	h.SetContentDisposition(attachmentDisposition(att), map[string]string{"filename": att.Name})
 	if att.ContentID != "" {
-		h.Set("Content-Id", att.ContentID)
+		h.Set("Content-Id", formatContentID(att.ContentID))
 	}
 	return h.Header
 }
 
-func mailAddress(addr *protonmail.MessageAddress) *mail.Address {
-	return &mail.Address{
-		Name:    addr.Name,
-		Address: addr.Address,
+// formatContentID adds angle brackets to a Content-ID if needed.
+func formatContentID(id string) string {
+	if id == "" || strings.HasPrefix(id, "<") {
+		return id
 	}
+	return "<" + id + ">"
 }
 
-func mailAddressList(addresses []*protonmail.MessageAddress) []*mail.Address {
-	l := make([]*mail.Address, len(addresses))
-	for i, addr := range addresses {
-		l[i] = mailAddress(addr)
+func multipartHeader(p *messagePart, msg *protonmail.Message) message.Header {
+	h := make(message.Header)
+	var params map[string]string
+	if p.subType == "related" {
+		params = map[string]string{"type": msg.MIMEType}
 	}
-	return l
+	h.SetContentType("multipart/"+p.subType, params)
+	return h
 }
 
 func messageHeader(msg *protonmail.Message) message.Header {
 	h := mail.NewHeader()
 	h.SetContentType("multipart/mixed", nil)
 	h.SetDate(time.Unix(msg.Time, 0))
-	h.SetSubject(msg.Subject)
-	h.SetAddressList("From", []*mail.Address{mailAddress(msg.Sender)})
+	h.SetSubject(charset.DecodeHeader(msg.Subject))
+	h.Set("From", msg.Sender.String())
 	if msg.ReplyTo != nil {
-		h.SetAddressList("Reply-To", []*mail.Address{mailAddress(msg.ReplyTo)})
+		h.Set("Reply-To", msg.ReplyTo.String())
 	}
 	if len(msg.ToList) > 0 {
-		h.SetAddressList("To", mailAddressList(msg.ToList))
+		h.Set("To", protonmail.FormatAddressList(msg.ToList))
 	}
 	if len(msg.CCList) > 0 {
-		h.SetAddressList("Cc", mailAddressList(msg.CCList))
+		h.Set("Cc", protonmail.FormatAddressList(msg.CCList))
 	}
 	if len(msg.BCCList) > 0 {
-		h.SetAddressList("Bcc", mailAddressList(msg.BCCList))
+		h.Set("Bcc", protonmail.FormatAddressList(msg.BCCList))
 	}
 	// TODO: In-Reply-To
 	h.Set("Message-Id", messageID(msg))
 	return h.Header
 }
 
+// attachmentSpool holds an attachment downloaded ahead of being written.
+type attachmentSpool struct {
+	b     literalBuffer
+	err   error
+	ready chan struct{}
+
+	acquired bool // the spool holds a slot of the prefetcher
+	released bool
+}
+
+// attachmentPrefetcher downloads attachments concurrently, in the order they
+// are written. Each attachment is spooled to a literalBuffer. Slots are only
+// freed once an attachment has been written, so at most AttachmentParallelism
+// attachments are buffered at once and memory usage stays bounded.
+type attachmentPrefetcher struct {
+	spools map[*protonmail.Attachment]*attachmentSpool
+	slots  chan struct{}
+	cancel context.CancelFunc
+}
+
+func (mbox *mailbox) prefetchAttachments(atts []*protonmail.Attachment) *attachmentPrefetcher {
+	n := mbox.u.c.AttachmentParallelism
+	if n <= 0 {
+		n = protonmail.DefaultAttachmentParallelism
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pf := &attachmentPrefetcher{
+		spools: make(map[*protonmail.Attachment]*attachmentSpool, len(atts)),
+		slots:  make(chan struct{}, n),
+		cancel: cancel,
+	}
+	spools := make([]*attachmentSpool, len(atts))
+	for i, att := range atts {
+		spools[i] = &attachmentSpool{ready: make(chan struct{})}
+		pf.spools[att] = spools[i]
+	}
+
+	go func() {
+		for i, att := range atts {
+			s := spools[i]
+			select {
+			case pf.slots <- struct{}{}:
+				s.acquired = true
+			case <-ctx.Done():
+				s.err = ctx.Err()
+				close(s.ready)
+				continue
+			}
+
+			go func(att *protonmail.Attachment) {
+				s.err = mbox.spoolAttachment(ctx, &s.b, att)
+				close(s.ready)
+			}(att)
+		}
+	}()
+
+	return pf
+}
+
+func (mbox *mailbox) spoolAttachment(ctx context.Context, b *literalBuffer, att *protonmail.Attachment) error {
+	rc, err := mbox.u.c.GetAttachmentContext(ctx, att, mbox.u.privateKeys)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	_, err = io.Copy(b, rc)
+	return err
+}
+
+// wait waits for an attachment to be downloaded.
+func (pf *attachmentPrefetcher) wait(att *protonmail.Attachment) (io.Reader, error) {
+	s := pf.spools[att]
+	<-s.ready
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.b.Reader(), nil
+}
+
+// release discards an attachment once written, and lets the next one be
+// downloaded.
+func (pf *attachmentPrefetcher) release(att *protonmail.Attachment) {
+	s := pf.spools[att]
+	if s.released {
+		return
+	}
+	<-s.ready
+	s.b.Close()
+	s.released = true
+	if s.acquired {
+		<-pf.slots
+	}
+}
+
+// Close aborts the downloads in progress and discards the attachments which
+// haven't been released.
+func (pf *attachmentPrefetcher) Close() {
+	pf.cancel()
+	for att := range pf.spools {
+		pf.release(att)
+	}
+}
+
+// writeParts writes the children of a multipart part of a message. inline is
+// the message body.
+func (mbox *mailbox) writeParts(w *message.Writer, msg *protonmail.Message, p *messagePart, inline io.Reader) error {
+	pf := mbox.prefetchAttachments(p.attachments())
+	defer pf.Close()
+
+	return mbox.writeChildren(w, msg, p, inline, pf)
+}
+
+func (mbox *mailbox) writeChildren(w *message.Writer, msg *protonmail.Message, p *messagePart, inline io.Reader, pf *attachmentPrefetcher) error {
+	for _, child := range p.children {
+		if child.isMultipart() {
+			pw, err := w.CreatePart(multipartHeader(child, msg))
+			if err != nil {
+				return err
+			}
+			if err := mbox.writeChildren(pw, msg, child, inline, pf); err != nil {
+				return err
+			}
+			pw.Close()
+			continue
+		}
+
+		var h message.Header
+		var body io.Reader
+		if att := child.att; att == nil {
+			h = inlineHeader(msg)
+			body = inline
+		} else if r, err := pf.wait(att); err != nil {
+			// Return a partial message rather than failing
+			mbox.u.log.Warn("cannot fetch attachment", "message", msg.ID, "attachment", att.Name, "err", err)
+			h = attachmentHeader(att)
+			h.SetContentType("text/plain", nil)
+			body = strings.NewReader(fmt.Sprintf("Cannot fetch attachment %q: %v\r\n", att.Name, err))
+		} else {
+			h = attachmentHeader(att)
+			body = r
+		}
+
+		pw, err := w.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(pw, body); err != nil {
+			return err
+		}
+		pw.Close()
+		if child.att != nil {
+			pf.release(child.att)
+		}
+	}
+	return nil
+}
+
 func (mbox *mailbox) fetchBodySection(msg *protonmail.Message, section *imap.BodySectionName) (imap.Literal, error) {
 	// TODO: section.Peek
 
-	b := new(bytes.Buffer)
+	if len(section.Path) == 0 && section.Specifier == imap.EntireSpecifier {
+		return mbox.fetchWholeMessage(msg, section)
+	}
+
+	// The header of the whole message doesn't need to be fetched
+	headerOnly := len(section.Path) == 0 && section.Specifier != imap.EntireSpecifier && section.Specifier != imap.TextSpecifier
+	if e, err := mbox.cachedMessage(msg, isPGPMessage(msg) || !headerOnly); err != nil {
+		return nil, err
+	} else if e != nil {
+		return backendutil.FetchBodySection(e, section)
+	}
+
+	if isPGPMessage(msg) {
+		if e, err := mbox.decryptPGPMessage(msg); err != nil {
+			return nil, err
+		} else if e != nil {
+			return backendutil.FetchBodySection(e, section)
+		}
+	}
+
+	b := new(literalBuffer)
+	if err := mbox.writeBodySection(b, msg, section); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b.Literal(section), nil
+}
 
+func (mbox *mailbox) writeBodySection(b *literalBuffer, msg *protonmail.Message, section *imap.BodySectionName) error {
 	if len(section.Path) == 0 {
 		w, err := message.CreateWriter(b, messageHeader(msg))
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		if section.Specifier == imap.TextSpecifier {
-			b.Reset()
+			if err := b.Reset(); err != nil {
+				return err
+			}
 		}
 
 		switch section.Specifier {
 		case imap.EntireSpecifier, imap.TextSpecifier:
-			msg, err := mbox.u.c.GetMessage(msg.ID)
-			if err != nil {
-				return nil, err
+			if msg.Body == "" {
+				if msg, err = mbox.u.c.GetMessage(msg.ID); err != nil {
+					return err
+				}
 			}
 
-			pw, err := w.CreatePart(inlineHeader(msg))
-			if err != nil {
-				return nil, err
-			}
 			pr, err := mbox.inlineBody(msg)
 			if err != nil {
-				return nil, err
-			}
-			if _, err := io.Copy(pw, pr); err != nil {
-				return nil, err
+				return err
 			}
-			pw.Close()
-
-			for _, att := range msg.Attachments {
-				pw, err := w.CreatePart(attachmentHeader(att))
-				if err != nil {
-					return nil, err
-				}
-				pr, err := mbox.attachmentBody(att)
-				if err != nil {
-					return nil, err
-				}
-				if _, err := io.Copy(pw, pr); err != nil {
-					return nil, err
-				}
-				pw.Close()
+			if err := mbox.writeParts(w, msg, messageTree(msg), pr); err != nil {
+				return err
 			}
 		}
 
 		w.Close()
 	} else {
-		if len(section.Path) > 1 {
-			return nil, errors.New("invalid body section path length")
+		// TODO: only fetch the message if the body is needed
+		// For now we fetch it in all cases because the MIME type is not included
+		// in the cached message, and inlineHeader needs it
+		msg, err := mbox.u.c.GetMessage(msg.ID)
+		if err != nil {
+			return err
 		}
 
-		var h message.Header
-		var getBody func() (io.Reader, error)
-		if part := section.Path[0]; part == 1 {
-			// TODO: only fetch the message if the body is needed
-			// For now we fetch it in all cases because the MIME type is not included
-			// in the cached message, and inlineHeader needs it
-			msg, err := mbox.u.c.GetMessage(msg.ID)
-			if err != nil {
-				return nil, err
-			}
+		p := messageTree(msg).lookup(section.Path)
+		if p == nil {
+			return errors.New("invalid body section path")
+		}
 
-			h = inlineHeader(msg)
-			getBody = func() (io.Reader, error) {
-				return mbox.inlineBody(msg)
+		var h message.Header
+		var writeBody func(w *message.Writer) error
+		if p.isMultipart() {
+			h = multipartHeader(p, msg)
+			writeBody = func(w *message.Writer) error {
+				r, err := mbox.inlineBody(msg)
+				if err != nil {
+					return err
+				}
+				return mbox.writeParts(w, msg, p, r)
 			}
 		} else {
-			i := part - 2
-			if i >= msg.NumAttachments {
-				return nil, errors.New("invalid attachment section path")
-			}
-
-			msg, err := mbox.u.c.GetMessage(msg.ID)
-			if err != nil {
-				return nil, err
+			var getBody func() (io.ReadCloser, error)
+			if att := p.att; att == nil {
+				h = inlineHeader(msg)
+				getBody = func() (io.ReadCloser, error) {
+					r, err := mbox.inlineBody(msg)
+					return ioutil.NopCloser(r), err
+				}
+			} else {
+				h = attachmentHeader(att)
+				getBody = func() (io.ReadCloser, error) {
+					return mbox.attachmentBody(att)
+				}
 			}
-
-			att := msg.Attachments[i]
-			h = attachmentHeader(att)
-			getBody = func() (io.Reader, error) {
-				return mbox.attachmentBody(att)
+			writeBody = func(w *message.Writer) error {
+				r, err := getBody()
+				if err != nil {
+					return err
+				}
+				defer r.Close()
+				_, err = io.Copy(w, r)
+				return err
 			}
 		}
 
 		w, err := message.CreateWriter(b, h)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		if section.Specifier == imap.TextSpecifier {
-			b.Reset()
+			if err := b.Reset(); err != nil {
+				return err
+			}
 		}
 
 		switch section.Specifier {
 		case imap.EntireSpecifier, imap.TextSpecifier:
-			r, err := getBody()
-			if err != nil {
-				return nil, err
-			}
-
-			if _, err := io.Copy(w, r); err != nil {
-				return nil, err
+			if err := writeBody(w); err != nil {
+				return err
 			}
 		}
 
 		w.Close()
 	}
 
-	var l imap.Literal = b
-	if section.Partial != nil {
-		l = bytes.NewReader(section.ExtractPartial(b.Bytes()))
-	}
-
-	return l, nil
+	return nil
 }
 
-func createMessage(c *protonmail.Client, u *protonmail.User, privateKeys openpgp.EntityList, addrs []*protonmail.Address, r io.Reader) (*protonmail.Message, error) {
-	// Parse the incoming MIME message header
-	mr, err := mail.CreateReader(r)
-	if err != nil {
-		return nil, err
-	}
-
-	subject, _ := mr.Header.Subject()
-	fromList, _ := mr.Header.AddressList("From")
-	toList, _ := mr.Header.AddressList("To")
-	ccList, _ := mr.Header.AddressList("Cc")
-	bccList, _ := mr.Header.AddressList("Bcc")
-
+func senderAddress(addrs []*protonmail.Address, privateKeys openpgp.EntityList, h mail.Header) (*protonmail.Address, *openpgp.Entity, error) {
+	fromList, _ := charset.AddressList(h, "From")
 	if len(fromList) != 1 {
-		return nil, errors.New("the From field must contain exactly one address")
-	}
-	if len(toList) == 0 && len(ccList) == 0 && len(bccList) == 0 {
-		return nil, errors.New("no recipient specified")
+		return nil, nil, errors.New("the From field must contain exactly one address")
 	}
 
 	fromAddrStr := fromList[0].Address
@@ -405,16 +614,16 @@ func createMessage(c *protonmail.Client, u *protonmail.User, privateKeys openpgp
 		}
 	}
 	if fromAddr == nil {
-		return nil, errors.New("unknown sender address")
+		return nil, nil, errors.New("unknown sender address")
 	}
 	if len(fromAddr.Keys) == 0 {
-		return nil, errors.New("sender address has no private key")
+		return nil, nil, errors.New("sender address has no private key")
 	}
 
 	// TODO: get appropriate private key
 	encryptedPrivateKey, err := fromAddr.Keys[0].Entity()
 	if err != nil {
-		return nil, fmt.Errorf("cannot parse sender private key: %v", err)
+		return nil, nil, fmt.Errorf("cannot parse sender private key: %v", err)
 	}
 
 	var privateKey *openpgp.Entity
@@ -425,7 +634,57 @@ func createMessage(c *protonmail.Client, u *protonmail.User, privateKeys openpgp
 		}
 	}
 	if privateKey == nil {
-		return nil, errors.New("sender address key hasn't been decrypted")
+		return nil, nil, errors.New("sender address key hasn't been decrypted")
+	}
+
+	return fromAddr, privateKey, nil
+}
+
+// importMessage stores a message without sending it. If meta.Time is zero, the
+// message's Date header field is used.
+func importMessage(c *protonmail.Client, privateKeys openpgp.EntityList, addrs []*protonmail.Address, meta *protonmail.ImportMessageMetadata, b []byte) (string, error) {
+	e, err := message.Read(bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+	h := mail.Header{Header: e.Header}
+
+	fromAddr, privateKey, err := senderAddress(addrs, privateKeys, h)
+	if err != nil {
+		return "", err
+	}
+	meta.AddressID = fromAddr.ID
+
+	if meta.Time == 0 {
+		if date, err := h.Date(); err == nil {
+			meta.Time = date.Unix()
+		}
+	}
+
+	return c.ImportMessage(meta, bytes.NewReader(b), privateKey)
+}
+
+// createMessage creates a draft from a MIME message. If draft isn't nil, it's
+// updated instead and its attachments are replaced.
+func createMessage(c *protonmail.Client, u *protonmail.User, privateKeys openpgp.EntityList, addrs []*protonmail.Address, r io.Reader, draft *protonmail.Message) (*protonmail.Message, error) {
+	// Parse the incoming MIME message header
+	mr, err := mail.CreateReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	subject := charset.DecodeHeader(mr.Header.Get("Subject"))
+	toList, _ := charset.AddressList(mr.Header, "To")
+	ccList, _ := charset.AddressList(mr.Header, "Cc")
+	bccList, _ := charset.AddressList(mr.Header, "Bcc")
+
+	if len(toList) == 0 && len(ccList) == 0 && len(bccList) == 0 {
+		return nil, errors.New("no recipient specified")
+	}
+
+	fromAddr, privateKey, err := senderAddress(addrs, privateKeys, mr.Header)
+	if err != nil {
+		return nil, err
 	}
 
 	msg := &protonmail.Message{
@@ -437,19 +696,33 @@ func createMessage(c *protonmail.Client, u *protonmail.User, privateKeys openpgp
 		AddressID: fromAddr.ID,
 	}
 
-	// Create an empty draft
-	plaintext, err := msg.Encrypt([]*openpgp.Entity{privateKey}, privateKey)
-	if err != nil {
-		return nil, err
-	}
-	if err := plaintext.Close(); err != nil {
-		return nil, err
-	}
+	if draft != nil {
+		// The attachments are uploaded again below
+		prev, err := c.GetMessage(draft.ID)
+		if err != nil {
+			return nil, fmt.Errorf("cannot fetch draft message: %v", err)
+		}
+		for _, att := range prev.Attachments {
+			if err := c.DeleteAttachment(att.ID); err != nil {
+				return nil, fmt.Errorf("cannot delete draft attachment: %v", err)
+			}
+		}
+		msg.ID = draft.ID
+	} else {
+		// Create an empty draft
+		plaintext, err := msg.Encrypt([]*openpgp.Entity{privateKey}, privateKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := plaintext.Close(); err != nil {
+			return nil, err
+		}
 
-	// TODO: parentID from In-Reply-To
-	msg, err = c.CreateDraftMessage(msg, "")
-	if err != nil {
-		return nil, fmt.Errorf("cannot create draft message: %v", err)
+		// TODO: parentID from In-Reply-To
+		msg, err = c.CreateDraftMessage(msg, "")
+		if err != nil {
+			return nil, fmt.Errorf("cannot create draft message: %v", err)
+		}
 	}
 
 	var body *bytes.Buffer
@@ -459,7 +732,7 @@ func createMessage(c *protonmail.Client, u *protonmail.User, privateKeys openpgp
 		p, err := mr.NextPart()
 		if err == io.EOF {
 			break
-		} else if err != nil {
+		} else if err != nil && !message.IsUnknownEncoding(err) {
 			return nil, err
 		}
 
@@ -474,11 +747,13 @@ func createMessage(c *protonmail.Client, u *protonmail.User, privateKeys openpgp
 				break
 			}
 
-			body = &bytes.Buffer{}
-			bodyType = t
-			if _, err := io.Copy(body, p.Body); err != nil {
+			b, err := ioutil.ReadAll(p.Body)
+			if err != nil {
 				return nil, err
 			}
+			// Parts with a missing or unknown charset aren't converted
+			body = bytes.NewBuffer(charset.Fallback(b))
+			bodyType = t
 		case mail.AttachmentHeader:
 			t, _, err := h.ContentType()
 			if err != nil {
@@ -533,7 +808,7 @@ func createMessage(c *protonmail.Client, u *protonmail.User, privateKeys openpgp
 
 	// Encrypt the body and update the draft
 	msg.MIMEType = bodyType
-	plaintext, err = msg.Encrypt([]*openpgp.Entity{privateKey}, privateKey)
+	plaintext, err := msg.Encrypt([]*openpgp.Entity{privateKey}, privateKey)
 	if err != nil {
 		return nil, err
 	}
@@ -544,9 +819,12 @@ func createMessage(c *protonmail.Client, u *protonmail.User, privateKeys openpgp
 		return nil, err
 	}
 
-	if _, err := c.UpdateDraftMessage(msg); err != nil {
+	updated, err := c.UpdateDraftMessage(msg)
+	if err != nil {
 		return nil, fmt.Errorf("cannot update draft message: %v", err)
 	}
-
-	return msg, nil
+	if updated == nil {
+		return msg, nil
+	}
+	return updated, nil
 }
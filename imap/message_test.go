@@ -0,0 +1,332 @@
+package imap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+	_ "golang.org/x/crypto/ripemd160"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestImapAddressList(t *testing.T) {
+	alice := &protonmail.MessageAddress{Address: "alice@example.org", Name: "Alice"}
+	bob := &protonmail.MessageAddress{Address: "bob@example.org", Name: "bob@example.org", Group: "Friends"}
+	carol := &protonmail.MessageAddress{Address: "carol@example.org", Group: "Friends"}
+
+	aliceAddr := &imap.Address{PersonalName: "Alice", MailboxName: "alice", HostName: "example.org"}
+	bobAddr := &imap.Address{MailboxName: "bob", HostName: "example.org"}
+	carolAddr := &imap.Address{MailboxName: "carol", HostName: "example.org"}
+	tests := []struct {
+		name string
+		l    []*protonmail.MessageAddress
+		want []*imap.Address
+	}{
+		{"empty", nil, []*imap.Address{}},
+		{"no group", []*protonmail.MessageAddress{alice}, []*imap.Address{aliceAddr}},
+		{
+			name: "group",
+			l:    []*protonmail.MessageAddress{alice, bob, carol},
+			want: []*imap.Address{aliceAddr, {MailboxName: "Friends"}, bobAddr, carolAddr, {}},
+		},
+		{
+			name: "split group",
+			l:    []*protonmail.MessageAddress{bob, alice, carol},
+			want: []*imap.Address{{MailboxName: "Friends"}, bobAddr, {}, aliceAddr, {MailboxName: "Friends"}, carolAddr, {}},
+		},
+	}
+	for _, tc := range tests {
+		if got := imapAddressList(tc.l); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: imapAddressList() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMessageHeaderAddresses(t *testing.T) {
+	msg := &protonmail.Message{
+		Sender: &protonmail.MessageAddress{Address: "alice@example.org", Name: "=?utf-8?q?Al=C3=AFce?="},
+		ToList: []*protonmail.MessageAddress{
+			{Address: "bob@example.org", Group: "Friends"},
+			{Address: "carol@example.org", Name: "Carol", Group: "Friends"},
+		},
+		CCList: []*protonmail.MessageAddress{{Address: "dave@example.org", Name: "dave@example.org"}},
+	}
+	h := messageHeader(msg)
+	tests := []struct {
+		k, want string
+	}{
+		{"From", "=?utf-8?q?Al=C3=AFce?= <alice@example.org>"},
+		{"To", `Friends: <bob@example.org>, "Carol" <carol@example.org>;`},
+		{"Cc", "<dave@example.org>"},
+	}
+	for _, tc := range tests {
+		if got := h.Get(tc.k); got != tc.want {
+			t.Errorf("messageHeader() %v = %q, want %q", tc.k, got, tc.want)
+		}
+	}
+}
+
+// newTestSender returns a private key and a sender address using it.
+func newTestSender(t *testing.T) (*openpgp.Entity, *protonmail.Address) {
+	e, err := openpgp.NewEntity("Test", "", "user@example.org", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatalf("openpgp.NewEntity() = %v", err)
+	}
+	var b bytes.Buffer
+	aw, err := armor.Encode(&b, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Serialize(aw); err != nil {
+		t.Fatal(err)
+	}
+	aw.Close()
+
+	// Only the key ID of the address key is used, to find the private key
+	addr := &protonmail.Address{ID: "addr", Email: "user@example.org", Keys: []*protonmail.PrivateKey{{PrivateKey: b.String()}}}
+	return e, addr
+}
+
+// testDraftsAPI records the draft requests it receives. The draft "draft" has
+// one attachment.
+type testDraftsAPI struct {
+	locker   sync.Mutex
+	requests []string
+}
+
+func (api *testDraftsAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.locker.Lock()
+	api.requests = append(api.requests, r.Method+" "+r.URL.Path)
+	api.locker.Unlock()
+
+	var msg *protonmail.Message
+	switch r.Method + " " + r.URL.Path {
+	case "GET /messages/draft":
+		msg = &protonmail.Message{ID: "draft", Attachments: []*protonmail.Attachment{{ID: "att"}}}
+	case "POST /messages", "PUT /messages/new", "PUT /messages/draft":
+		var body struct{ Message *protonmail.Message }
+		json.NewDecoder(r.Body).Decode(&body)
+		msg = body.Message
+		if msg.ID == "" {
+			msg.ID = "new"
+		}
+		msg.LabelIDs = []string{protonmail.LabelDraft}
+	case "DELETE /attachments/att":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"Code": 1000, "Message": msg})
+}
+
+func TestCreateMessage(t *testing.T) {
+	e, addr := newTestSender(t)
+	const raw = "From: user@example.org\r\n" +
+		"To: alice@example.org\r\n" +
+		"Subject: Hello\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hi!\r\n"
+
+	tests := []struct {
+		name         string
+		draft        *protonmail.Message
+		wantID       string
+		wantRequests []string
+	}{
+		{
+			name:         "new",
+			wantID:       "new",
+			wantRequests: []string{"POST /messages", "PUT /messages/new"},
+		},
+		{
+			name:         "update",
+			draft:        &protonmail.Message{ID: "draft"},
+			wantID:       "draft",
+			wantRequests: []string{"GET /messages/draft", "DELETE /attachments/att", "PUT /messages/draft"},
+		},
+	}
+	for _, tc := range tests {
+		api := new(testDraftsAPI)
+		u := newTestUser(t, api)
+		msg, err := createMessage(u.c, u.u, openpgp.EntityList{e}, []*protonmail.Address{addr}, strings.NewReader(raw), tc.draft)
+		if err != nil {
+			t.Errorf("%v: createMessage() = %v", tc.name, err)
+			continue
+		}
+		if msg.ID != tc.wantID || msg.Subject != "Hello" || !reflect.DeepEqual(msg.LabelIDs, []string{protonmail.LabelDraft}) {
+			t.Errorf("%v: createMessage() = %+v, want the updated draft %v", tc.name, msg, tc.wantID)
+		}
+		if !reflect.DeepEqual(api.requests, tc.wantRequests) {
+			t.Errorf("%v: createMessage() sent %q, want %q", tc.name, api.requests, tc.wantRequests)
+		}
+	}
+}
+
+// testAttachmentsAPI serves plaintext attachments, whose content is their ID.
+// The attachment "bad" can't be downloaded. Requests for the attachment
+// "slow" block until unblock is closed.
+type testAttachmentsAPI struct {
+	unblock chan struct{}
+
+	locker   sync.Mutex
+	requests []string
+}
+
+func (api *testAttachmentsAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/attachments/")
+	api.locker.Lock()
+	api.requests = append(api.requests, id)
+	api.locker.Unlock()
+
+	switch id {
+	case "bad":
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`{"Code":2501,"Error":"Attachment does not exist"}`))
+		return
+	case "slow":
+		<-api.unblock
+	}
+	w.Write([]byte(id))
+}
+
+func (api *testAttachmentsAPI) numRequests() int {
+	api.locker.Lock()
+	defer api.locker.Unlock()
+	return len(api.requests)
+}
+
+func TestWriteParts(t *testing.T) {
+	api := &testAttachmentsAPI{unblock: make(chan struct{})}
+	u := newTestUser(t, api)
+	u.c.AttachmentParallelism = 2
+	mbox := u.getMailboxByLabel(protonmail.LabelInbox)
+
+	ids := []string{"slow", "att1", "bad", "att2", "att3"}
+	msg := &protonmail.Message{ID: "msg1", MIMEType: "text/plain", Sender: &protonmail.MessageAddress{Address: "alice@example.org"}}
+	for _, id := range ids {
+		msg.Attachments = append(msg.Attachments, &protonmail.Attachment{ID: id, Name: id + ".txt", MIMEType: "text/plain"})
+	}
+
+	done := make(chan error, 1)
+	var b bytes.Buffer
+	go func() {
+		w, err := message.CreateWriter(&b, messageHeader(msg))
+		if err == nil {
+			err = mbox.writeParts(w, msg, messageTree(msg), strings.NewReader("body"))
+			w.Close()
+		}
+		done <- err
+	}()
+
+	// Attachments downloaded ahead of being written hold a slot
+	for api.numRequests() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := api.numRequests(); n != 2 {
+		t.Errorf("%v attachments downloaded while the first one is pending, want 2", n)
+	}
+	close(api.unblock)
+	if err := <-done; err != nil {
+		t.Fatalf("writeParts() = %v", err)
+	}
+
+	e, err := message.Read(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := e.MultipartReader()
+	var got []string
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		body, _ := ioutil.ReadAll(p.Body)
+		if prefix := fmt.Sprintf("Cannot fetch attachment %q: ", "bad.txt"); strings.HasPrefix(string(body), prefix) {
+			body = []byte("placeholder")
+		}
+		got = append(got, string(body))
+	}
+	want := []string{"body", "slow", "att1", "placeholder", "att2", "att3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("writeParts() wrote parts %q, want %q", got, want)
+	}
+}
+
+func TestWriteBodySectionLargeAttachment(t *testing.T) {
+	const size = 3 * literalMemoryLimit
+	payload := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+
+	e, _ := newTestSender(t)
+	att := &protonmail.Attachment{ID: "att", Name: "big.bin", MIMEType: "application/octet-stream", Size: size}
+	if _, err := att.GenerateKey([]*openpgp.Entity{e}); err != nil {
+		t.Fatalf("GenerateKey() = %v", err)
+	}
+	var ciphertext bytes.Buffer
+	w, err := att.Encrypt(&ciphertext, nil)
+	if err != nil {
+		t.Fatalf("Encrypt() = %v", err)
+	}
+	w.Write(payload)
+	w.Close()
+
+	u := newTestUser(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/attachments/att" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(ciphertext.Bytes())
+	}))
+	u.privateKeys = openpgp.EntityList{e}
+	mbox := u.getMailboxByLabel(protonmail.LabelInbox)
+
+	msg := &protonmail.Message{
+		ID:          "msg1",
+		MIMEType:    "text/plain",
+		Body:        "body",
+		Sender:      &protonmail.MessageAddress{Address: "alice@example.org"},
+		Attachments: []*protonmail.Attachment{att},
+	}
+	b := new(literalBuffer)
+	defer b.Close()
+	if err := mbox.writeBodySection(b, msg, &imap.BodySectionName{}); err != nil {
+		t.Fatalf("writeBodySection() = %v", err)
+	}
+	if b.f == nil {
+		t.Errorf("literal of %v bytes kept in memory, want it spooled to disk", b.size)
+	}
+
+	e2, err := message.Read(b.Reader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := e2.MultipartReader()
+	var got []byte
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		got, _ = ioutil.ReadAll(p.Body)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("attachment part has %v bytes, want the %v-byte payload", len(got), len(payload))
+	}
+}
@@ -0,0 +1,361 @@
+package imap
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	imapserver "github.com/emersion/go-imap/server"
+
+	"github.com/emersion/hydroxide/imap/database"
+)
+
+// METADATA extension, defined in RFC 5464. Entries are local scratch space for
+// clients, they aren't synchronized with ProtonMail. Private and shared
+// entries are stored in the same way, since accounts have a single user.
+
+const metadataCapability = "METADATA"
+
+const codeMetadata imap.StatusRespCode = "METADATA"
+
+const (
+	// metadataMaxSize is the maximum size of an entry value, in bytes
+	metadataMaxSize = 64 * 1024
+	// metadataMaxEntries is the maximum number of entries per mailbox
+	metadataMaxEntries = 256
+)
+
+const (
+	metadataDepth0 = iota
+	metadataDepth1
+	metadataDepthInfinity
+)
+
+func errMetadata(args ...interface{}) error {
+	return imapserver.ErrStatusResp(&imap.StatusResp{
+		Type:      imap.StatusRespNo,
+		Code:      codeMetadata,
+		Arguments: args,
+		Info:      "Cannot set metadata",
+	})
+}
+
+// parseMetadataEntry checks an entry name. Entry names are case-insensitive.
+func parseMetadataEntry(f interface{}) (string, error) {
+	entry, err := imap.ParseString(f)
+	if err != nil {
+		return "", err
+	}
+	entry = strings.ToLower(entry)
+
+	if !strings.HasPrefix(entry, "/private/") && !strings.HasPrefix(entry, "/shared/") {
+		return "", errors.New("metadata entries must start with /private/ or /shared/")
+	}
+	if strings.HasSuffix(entry, "/") || strings.Contains(entry, "//") || strings.ContainsAny(entry, "*%") {
+		return "", errors.New("invalid metadata entry")
+	}
+	for _, r := range entry {
+		if r < ' ' || r == 0x7f {
+			return "", errors.New("invalid metadata entry")
+		}
+	}
+	return entry, nil
+}
+
+// parseMetadataMailbox decodes a mailbox name. An empty name designates the
+// server.
+func parseMetadataMailbox(name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	name, err := decodeMailboxName(name)
+	if err != nil {
+		return "", err
+	}
+	return imap.CanonicalMailboxName(name), nil
+}
+
+// metadataLabel returns the label ID metadata of a mailbox is stored with, or
+// an empty string for server metadata.
+func (u *user) metadataLabel(name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	mbox := u.getMailbox(name)
+	if mbox == nil {
+		return "", imapbackend.ErrNoSuchMailbox
+	}
+	return mbox.label, nil
+}
+
+// metadataValue formats a value, using a literal if it can't be sent as a
+// quoted string.
+func metadataValue(v []byte) interface{} {
+	for _, c := range v {
+		if c < ' ' || c >= 0x7f {
+			return bytes.NewBuffer(v)
+		}
+	}
+	return string(v)
+}
+
+type getMetadataHandler struct {
+	// name is the mailbox name as sent by the client
+	name    string
+	mailbox string
+	entries []string
+	maxSize uint32
+	depth   int
+}
+
+func (h *getMetadataHandler) parseOptions(fields []interface{}) error {
+	if len(fields)%2 != 0 {
+		return errors.New("invalid GETMETADATA options")
+	}
+
+	for i := 0; i < len(fields); i += 2 {
+		name, err := imap.ParseString(fields[i])
+		if err != nil {
+			return err
+		}
+
+		switch strings.ToUpper(name) {
+		case "MAXSIZE":
+			if h.maxSize, err = imap.ParseNumber(fields[i+1]); err != nil {
+				return err
+			}
+		case "DEPTH":
+			depth, err := imap.ParseString(fields[i+1])
+			if err != nil {
+				return err
+			}
+			switch strings.ToLower(depth) {
+			case "0":
+				h.depth = metadataDepth0
+			case "1":
+				h.depth = metadataDepth1
+			case "infinity":
+				h.depth = metadataDepthInfinity
+			default:
+				return errors.New("invalid GETMETADATA depth")
+			}
+		default:
+			return errors.New("unknown GETMETADATA option")
+		}
+	}
+	return nil
+}
+
+func (h *getMetadataHandler) Parse(fields []interface{}) error {
+	if len(fields) > 0 {
+		if opts, ok := fields[0].([]interface{}); ok {
+			if err := h.parseOptions(opts); err != nil {
+				return err
+			}
+			fields = fields[1:]
+		}
+	}
+	if len(fields) != 2 {
+		return errors.New("GETMETADATA expects a mailbox and entries")
+	}
+
+	var err error
+	if h.name, err = imap.ParseString(fields[0]); err != nil {
+		return err
+	}
+	if h.mailbox, err = parseMetadataMailbox(h.name); err != nil {
+		return err
+	}
+
+	entries, ok := fields[1].([]interface{})
+	if !ok {
+		entries = []interface{}{fields[1]}
+	}
+	for _, f := range entries {
+		entry, err := parseMetadataEntry(f)
+		if err != nil {
+			return err
+		}
+		h.entries = append(h.entries, entry)
+	}
+	return nil
+}
+
+// matches checks whether a stored entry is requested, taking the depth into
+// account.
+func (h *getMetadataHandler) matches(entry string) bool {
+	for _, want := range h.entries {
+		if entry == want {
+			return true
+		}
+		if h.depth == metadataDepth0 || !strings.HasPrefix(entry, want+"/") {
+			continue
+		}
+		if h.depth == metadataDepthInfinity || !strings.Contains(entry[len(want)+1:], "/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *getMetadataHandler) Handle(conn imapserver.Conn) error {
+	u, ok := conn.Context().User.(*user)
+	if !ok {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	labelID, err := u.metadataLabel(h.mailbox)
+	if err != nil {
+		return err
+	}
+	stored, err := u.db.Metadata(labelID)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(stored))
+	for entry := range stored {
+		if h.matches(entry) {
+			names = append(names, entry)
+		}
+	}
+	// Requested entries which don't exist are returned with a NIL value
+	for _, entry := range h.entries {
+		if _, ok := stored[entry]; !ok {
+			names = append(names, entry)
+		}
+	}
+	sort.Strings(names)
+
+	var fields []interface{}
+	var longest uint32
+	for _, entry := range names {
+		v, ok := stored[entry]
+		if !ok {
+			fields = append(fields, entry, nil)
+			continue
+		}
+		if h.maxSize > 0 && uint32(len(v)) > h.maxSize {
+			if uint32(len(v)) > longest {
+				longest = uint32(len(v))
+			}
+			continue
+		}
+		fields = append(fields, entry, metadataValue(v))
+	}
+
+	if len(fields) > 0 {
+		resp := imap.NewUntaggedResp([]interface{}{"METADATA", h.name, fields})
+		if err := conn.WriteResp(resp); err != nil {
+			return err
+		}
+	}
+
+	if longest > 0 {
+		return imapserver.ErrStatusResp(&imap.StatusResp{
+			Type:      imap.StatusRespOk,
+			Code:      codeMetadata,
+			Arguments: []interface{}{"LONGENTRIES", longest},
+			Info:      "GETMETADATA completed",
+		})
+	}
+	return nil
+}
+
+type setMetadataHandler struct {
+	mailbox string
+	entries map[string][]byte
+}
+
+func (h *setMetadataHandler) Parse(fields []interface{}) error {
+	if len(fields) != 2 {
+		return errors.New("SETMETADATA expects a mailbox and entries")
+	}
+
+	name, err := imap.ParseString(fields[0])
+	if err != nil {
+		return err
+	}
+	if h.mailbox, err = parseMetadataMailbox(name); err != nil {
+		return err
+	}
+
+	list, ok := fields[1].([]interface{})
+	if !ok || len(list) == 0 || len(list)%2 != 0 {
+		return errors.New("SETMETADATA expects a list of entries and values")
+	}
+
+	h.entries = make(map[string][]byte, len(list)/2)
+	for i := 0; i < len(list); i += 2 {
+		entry, err := parseMetadataEntry(list[i])
+		if err != nil {
+			return err
+		}
+
+		if list[i+1] == nil {
+			h.entries[entry] = nil
+			continue
+		}
+		v, err := imap.ParseString(list[i+1])
+		if err != nil {
+			return err
+		}
+		h.entries[entry] = append(make([]byte, 0, len(v)), v...)
+	}
+	return nil
+}
+
+func (h *setMetadataHandler) Handle(conn imapserver.Conn) error {
+	u, ok := conn.Context().User.(*user)
+	if !ok {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	for _, v := range h.entries {
+		if len(v) > metadataMaxSize {
+			return errMetadata("MAXSIZE", uint32(metadataMaxSize))
+		}
+	}
+
+	labelID, err := u.metadataLabel(h.mailbox)
+	if err != nil {
+		return err
+	}
+	err = u.db.SetMetadata(labelID, h.entries, metadataMaxEntries)
+	if err == database.ErrTooManyMetadata {
+		return errMetadata("TOOMANY")
+	}
+	return err
+}
+
+type metadataExtension struct{}
+
+func (ext *metadataExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{metadataCapability}
+	}
+	return nil
+}
+
+func (ext *metadataExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "GETMETADATA":
+		return func() imapserver.Handler {
+			return &getMetadataHandler{}
+		}
+	case "SETMETADATA":
+		return func() imapserver.Handler {
+			return &setMetadataHandler{}
+		}
+	}
+	return nil
+}
+
+// NewMetadataExtension returns an IMAP server extension implementing
+// METADATA. Entries are stored in the local database.
+func NewMetadataExtension() imapserver.Extension {
+	return &metadataExtension{}
+}
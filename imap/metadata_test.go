@@ -0,0 +1,99 @@
+package imap
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMetadataEntry(t *testing.T) {
+	tests := []struct {
+		entry   string
+		want    string
+		wantErr bool
+	}{
+		{entry: "/private/comment", want: "/private/comment"},
+		{entry: "/Shared/Vendor/Foo", want: "/shared/vendor/foo"},
+		{entry: "/comment", wantErr: true},
+		{entry: "/private/", wantErr: true},
+		{entry: "/private//comment", wantErr: true},
+		{entry: "/private/*", wantErr: true},
+		{entry: "/private/a%b", wantErr: true},
+		{entry: "/private/a\tb", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := parseMetadataEntry(tc.entry)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseMetadataEntry(%q) = %q, want an error", tc.entry, got)
+			}
+		} else if err != nil {
+			t.Errorf("parseMetadataEntry(%q) = %v", tc.entry, err)
+		} else if got != tc.want {
+			t.Errorf("parseMetadataEntry(%q) = %q, want %q", tc.entry, got, tc.want)
+		}
+	}
+}
+
+func TestGetMetadataMatches(t *testing.T) {
+	tests := []struct {
+		depth int
+		entry string
+		want  bool
+	}{
+		{metadataDepth0, "/private/vendor", true},
+		{metadataDepth0, "/private/vendor/a", false},
+		{metadataDepth1, "/private/vendor/a", true},
+		{metadataDepth1, "/private/vendor/a/b", false},
+		{metadataDepthInfinity, "/private/vendor/a/b", true},
+		{metadataDepthInfinity, "/private/vendorx", false},
+		{metadataDepthInfinity, "/private/other", false},
+	}
+	for _, tc := range tests {
+		h := &getMetadataHandler{entries: []string{"/private/vendor"}, depth: tc.depth}
+		if got := h.matches(tc.entry); got != tc.want {
+			t.Errorf("matches(%q) with depth %v = %v, want %v", tc.entry, tc.depth, got, tc.want)
+		}
+	}
+}
+
+func TestMetadataValue(t *testing.T) {
+	if v := metadataValue([]byte("hello")); v != "hello" {
+		t.Errorf("metadataValue(%q) = %#v, want a string", "hello", v)
+	}
+	if v, ok := metadataValue([]byte("a\r\nb")).(*bytes.Buffer); !ok || v.String() != "a\r\nb" {
+		t.Errorf("metadataValue(%q) = %#v, want a literal", "a\r\nb", v)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	u := newTestUser(t, new(testAPI))
+	tc := newTestConn(t, u, NewMetadataExtension())
+
+	tests := []struct {
+		cmd  string
+		want []string
+	}{
+		{`SETMETADATA "" (/private/comment "server")`, []string{"OK SETMETADATA completed"}},
+		{`SETMETADATA INBOX (/private/comment "inbox" /private/vendor/a "a" /private/vendor/a/b "b")`, []string{"OK SETMETADATA completed"}},
+		{`GETMETADATA "" /private/comment`, []string{`* METADATA "" (/private/comment server)`, "OK GETMETADATA completed"}},
+		{`GETMETADATA INBOX (/PRIVATE/COMMENT /private/missing)`, []string{`* METADATA INBOX (/private/comment inbox /private/missing NIL)`, "OK GETMETADATA completed"}},
+		{`GETMETADATA (DEPTH 1) INBOX /private/vendor`, []string{`* METADATA INBOX (/private/vendor NIL /private/vendor/a a)`, "OK GETMETADATA completed"}},
+		{`GETMETADATA (MAXSIZE 3) INBOX (/private/comment /private/vendor/a)`, []string{`* METADATA INBOX (/private/vendor/a a)`, "OK [METADATA LONGENTRIES 5] GETMETADATA completed"}},
+		{`SETMETADATA INBOX (/private/comment NIL)`, []string{"OK SETMETADATA completed"}},
+		{`GETMETADATA INBOX /private/comment`, []string{`* METADATA INBOX (/private/comment NIL)`, "OK GETMETADATA completed"}},
+	}
+	for _, test := range tests {
+		if resp := tc.run(test.cmd); !reflect.DeepEqual(resp, test.want) {
+			t.Errorf("%v: response = %q, want %q", test.cmd, resp, test.want)
+		}
+	}
+
+	if resp := tc.run(`SETMETADATA Unknown (/private/comment "x")`); !strings.HasPrefix(resp[len(resp)-1], "NO") {
+		t.Errorf("SETMETADATA on an unknown mailbox = %q, want NO", resp)
+	}
+	if resp := tc.run(`SETMETADATA INBOX (/comment "x")`); !strings.HasPrefix(resp[len(resp)-1], "BAD") {
+		t.Errorf("SETMETADATA with an invalid entry = %q, want BAD", resp)
+	}
+}
@@ -0,0 +1,267 @@
+package imap
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// NOTIFY extension, defined in RFC 5465. Changes to watched mailboxes which
+// aren't selected are reported with STATUS responses. Changes to the selected
+// mailbox are still reported with EXISTS, EXPUNGE and FETCH responses, as
+// with SELECTED-DELAYED.
+
+const notifyCapability = "NOTIFY"
+
+var notifyStatusItems = []imap.StatusItem{imap.StatusMessages, imap.StatusUidNext, imap.StatusUidValidity, imap.StatusUnseen}
+
+// notifyRegistration contains the mailboxes watched by a connection.
+type notifyRegistration struct {
+	filters    []func(name string) bool
+	ctx        *imapserver.Context
+	utf8Accept bool
+}
+
+func (r *notifyRegistration) watches(name string) bool {
+	for _, f := range r.filters {
+		if f(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *notifyRegistration) selected() string {
+	if r.ctx.Mailbox == nil {
+		return ""
+	}
+	return r.ctx.Mailbox.Name()
+}
+
+func parseNotifyMailboxes(f interface{}) ([]string, error) {
+	l, ok := f.([]interface{})
+	if !ok {
+		l = []interface{}{f}
+	}
+
+	names := make([]string, len(l))
+	for i, f := range l {
+		name, err := parseMailboxPattern(f)
+		if err != nil {
+			return nil, err
+		}
+		names[i] = name
+	}
+	return names, nil
+}
+
+// parseNotifyFilter parses a filter-mailboxes. It returns nil if the filter
+// only applies to the selected mailbox.
+func parseNotifyFilter(fields []interface{}) (func(name string) bool, error) {
+	kind, ok := fields[0].(string)
+	if !ok {
+		return nil, errors.New("NOTIFY filter must be an atom")
+	}
+
+	switch strings.ToUpper(kind) {
+	case "SELECTED", "SELECTED-DELAYED":
+		return nil, nil
+	case "INBOXES":
+		return func(name string) bool {
+			return name == imap.InboxName
+		}, nil
+	case "PERSONAL", "SUBSCRIBED":
+		// Subscriptions aren't supported, all mailboxes are subscribed
+		return func(name string) bool {
+			return true
+		}, nil
+	case "SUBTREE", "MAILBOXES":
+		if len(fields) < 2 {
+			return nil, errors.New("NOTIFY filter is missing mailboxes")
+		}
+		names, err := parseNotifyMailboxes(fields[1])
+		if err != nil {
+			return nil, err
+		}
+
+		subtree := strings.ToUpper(kind) == "SUBTREE"
+		return func(name string) bool {
+			for _, n := range names {
+				if name == n || (subtree && strings.HasPrefix(name, n+"/")) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	default:
+		return nil, errors.New("unknown NOTIFY filter")
+	}
+}
+
+type notifyHandler struct {
+	none    bool
+	status  bool
+	filters []func(name string) bool
+}
+
+func (h *notifyHandler) Parse(fields []interface{}) error {
+	if len(fields) == 0 {
+		return errors.New("NOTIFY expects NONE or SET")
+	}
+
+	switch s, _ := fields[0].(string); strings.ToUpper(s) {
+	case "NONE":
+		h.none = true
+		return nil
+	case "SET":
+	default:
+		return errors.New("NOTIFY expects NONE or SET")
+	}
+	fields = fields[1:]
+
+	if len(fields) > 0 {
+		if s, ok := fields[0].(string); ok && strings.ToUpper(s) == "STATUS" {
+			h.status = true
+			fields = fields[1:]
+		}
+	}
+
+	for _, f := range fields {
+		group, ok := f.([]interface{})
+		if !ok || len(group) < 2 {
+			return errors.New("NOTIFY event group must be a list")
+		}
+
+		filter, err := parseNotifyFilter(group[:len(group)-1])
+		if err != nil {
+			return err
+		}
+
+		// All message events are reported with the same STATUS response
+		if s, ok := group[len(group)-1].(string); ok && strings.ToUpper(s) == "NONE" {
+			continue
+		}
+		if filter != nil {
+			h.filters = append(h.filters, filter)
+		}
+	}
+
+	return nil
+}
+
+func (h *notifyHandler) Handle(conn imapserver.Conn) error {
+	u, ok := conn.Context().User.(*user)
+	if !ok {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	if h.none {
+		u.setNotify(nil)
+		return nil
+	}
+
+	reg := &notifyRegistration{
+		filters:    h.filters,
+		ctx:        conn.Context(),
+		utf8Accept: utf8Enabled(conn),
+	}
+	u.setNotify(reg)
+
+	if !h.status {
+		return nil
+	}
+
+	u.locker.Lock()
+	var mailboxes []*mailbox
+	for _, mbox := range u.mailboxes {
+		if mbox.name != reg.selected() && reg.watches(mbox.name) {
+			mailboxes = append(mailboxes, mbox)
+		}
+	}
+	u.locker.Unlock()
+
+	for _, mbox := range mailboxes {
+		status, err := mbox.Status(notifyStatusItems)
+		if err != nil {
+			return err
+		}
+		if err := conn.WriteResp(&statusResp{status: status, utf8Accept: reg.utf8Accept}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (u *user) setNotify(reg *notifyRegistration) {
+	u.locker.Lock()
+	u.notify = reg
+	u.locker.Unlock()
+}
+
+// notifyStatus sends STATUS responses for the watched mailboxes affected by
+// updates, except the selected one.
+func (u *user) notifyStatus(updates []imapbackend.Update) {
+	u.locker.Lock()
+	reg := u.notify
+	u.locker.Unlock()
+	if reg == nil {
+		return
+	}
+
+	changed := make(map[string]bool)
+	for _, update := range updates {
+		changed[update.Mailbox()] = true
+	}
+
+	selected := reg.selected()
+	for name := range changed {
+		if name == selected || !reg.watches(name) {
+			continue
+		}
+		mbox := u.getMailbox(name)
+		if mbox == nil {
+			continue
+		}
+
+		status, err := mbox.Status(notifyStatusItems)
+		if err != nil {
+			u.log.Warn("cannot get mailbox status for NOTIFY", "mailbox", name, "err", err)
+			continue
+		}
+
+		go func() {
+			select {
+			case reg.ctx.Responses <- &statusResp{status: status, utf8Accept: reg.utf8Accept}:
+			case <-reg.ctx.LoggedOut:
+			}
+		}()
+	}
+}
+
+type notifyExtension struct{}
+
+func (ext *notifyExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{notifyCapability}
+	}
+	return nil
+}
+
+func (ext *notifyExtension) Command(name string) imapserver.HandlerFactory {
+	if name != notifyCapability {
+		return nil
+	}
+
+	return func() imapserver.Handler {
+		return &notifyHandler{}
+	}
+}
+
+// NewNotifyExtension returns an IMAP server extension implementing NOTIFY.
+func NewNotifyExtension() imapserver.Extension {
+	return &notifyExtension{}
+}
@@ -0,0 +1,200 @@
+package imap
+
+import (
+	"sync"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// When the ProtonMail API is unreachable, sessions switch to a degraded mode:
+// mailboxes are served from the local database and the message cache, and
+// are selected read-only. Flag changes and moves requested by clients which
+// selected a mailbox before the outage are queued, and replayed once events
+// are received again. Queued operations are dropped for messages which have
+// been modified in the meantime.
+
+// knownAccount is the last account information fetched from the API, used
+// when logging in while the API is unreachable.
+type knownAccount struct {
+	u      *protonmail.User
+	addrs  []*protonmail.Address
+	labels []*protonmail.Label
+}
+
+// offlineOp is an operation queued while the API is unreachable.
+type offlineOp struct {
+	name string
+	// modSeqs contains the mod-sequences of the messages when the operation
+	// has been queued
+	modSeqs map[string]uint64
+	apply   func(c *protonmail.Client, apiIDs []string) error
+}
+
+// offlineState is shared by all sessions.
+type offlineState struct {
+	locker   sync.Mutex
+	accounts map[string]*knownAccount
+	ops      map[string][]*offlineOp
+}
+
+func newOfflineState() *offlineState {
+	return &offlineState{
+		accounts: make(map[string]*knownAccount),
+		ops:      make(map[string][]*offlineOp),
+	}
+}
+
+func (s *offlineState) account(username string) *knownAccount {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	return s.accounts[username]
+}
+
+func (s *offlineState) setAccount(username string, account *knownAccount) {
+	s.locker.Lock()
+	s.accounts[username] = account
+	s.locker.Unlock()
+}
+
+func (s *offlineState) setLabels(username string, labels []*protonmail.Label) {
+	s.locker.Lock()
+	if account, ok := s.accounts[username]; ok {
+		account.labels = labels
+	}
+	s.locker.Unlock()
+}
+
+func (s *offlineState) push(username string, op *offlineOp) {
+	s.locker.Lock()
+	s.ops[username] = append(s.ops[username], op)
+	s.locker.Unlock()
+}
+
+// takeAll removes and returns the queued operations of a user.
+func (s *offlineState) takeAll(username string) []*offlineOp {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	ops := s.ops[username]
+	delete(s.ops, username)
+	return ops
+}
+
+// requeue queues again operations which couldn't be replayed, before the
+// ones queued in the meantime.
+func (s *offlineState) requeue(username string, ops []*offlineOp) {
+	s.locker.Lock()
+	s.ops[username] = append(ops, s.ops[username]...)
+	s.locker.Unlock()
+}
+
+func (u *user) isOffline() bool {
+	u.locker.Lock()
+	defer u.locker.Unlock()
+	return u.offline
+}
+
+// checkOffline switches to the degraded mode if err has been caused by the
+// API being unreachable.
+func (u *user) checkOffline(err error) bool {
+	if !protonmail.IsUnreachable(err) {
+		return false
+	}
+
+	u.locker.Lock()
+	u.setOffline(err)
+	u.locker.Unlock()
+	return true
+}
+
+// setOffline switches to the degraded mode. The user must be locked.
+func (u *user) setOffline(err error) {
+	if !u.offline {
+		u.log.Warn("API unreachable, switching to read-only mode", "err", err)
+	}
+	u.offline = true
+}
+
+// countLocal returns the number of messages of the mailbox in the local
+// database.
+func (mbox *mailbox) countLocal() (int, error) {
+	n := 0
+	err := mbox.db.ForEach(func(seqNum, uid uint32, apiID string) error {
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// queueOffline queues an operation which failed with err if the API is
+// unreachable. Otherwise, err is returned.
+func (u *user) queueOffline(err error, name string, apiIDs []string, apply func(c *protonmail.Client, apiIDs []string) error) error {
+	if !u.checkOffline(err) {
+		return err
+	}
+
+	op := &offlineOp{
+		name:    name,
+		modSeqs: make(map[string]uint64, len(apiIDs)),
+		apply:   apply,
+	}
+	for _, apiID := range apiIDs {
+		modSeq, err := u.db.ModSeq(apiID)
+		if err != nil {
+			return err
+		}
+		op.modSeqs[apiID] = modSeq
+	}
+
+	u.offlineState.push(u.u.Name, op)
+	u.log.Info("queued operation until the API is reachable", "operation", name, "messages", len(apiIDs))
+	return nil
+}
+
+// setOnline is called when an event has been received. Queued operations are
+// replayed.
+func (u *user) setOnline() {
+	u.locker.Lock()
+	wasOffline := u.offline
+	u.offline = false
+	u.locker.Unlock()
+
+	if wasOffline {
+		u.log.Info("API reachable again")
+
+		// Custom mailboxes may be missing if the session started offline
+		if err := u.refreshLabels(); err != nil {
+			u.log.Warn("cannot refresh labels", "err", err)
+		}
+	}
+
+	u.replayOffline()
+}
+
+func (u *user) replayOffline() {
+	ops := u.offlineState.takeAll(u.u.Name)
+	for i, op := range ops {
+		var apiIDs []string
+		for apiID, modSeq := range op.modSeqs {
+			// The message has been changed or deleted in the meantime
+			if cur, err := u.db.ModSeq(apiID); err != nil || cur != modSeq {
+				continue
+			}
+			apiIDs = append(apiIDs, apiID)
+		}
+		if dropped := len(op.modSeqs) - len(apiIDs); dropped > 0 {
+			u.log.Warn("dropping queued operation on conflicting messages", "operation", op.name, "messages", dropped)
+		}
+		if len(apiIDs) == 0 {
+			continue
+		}
+
+		if err := op.apply(u.c, apiIDs); u.checkOffline(err) {
+			u.offlineState.requeue(u.u.Name, ops[i:])
+			return
+		} else if err != nil {
+			u.log.Warn("cannot replay queued operation", "operation", op.name, "err", err)
+			continue
+		}
+		u.log.Info("replayed queued operation", "operation", op.name, "messages", len(apiIDs))
+	}
+}
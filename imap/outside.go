@@ -0,0 +1,65 @@
+package imap
+
+import (
+	"html"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// Messages encrypted to outside recipients are protected with a password.
+// When they have also been encrypted with the account's keys, e.g. for
+// messages sent by the user or replies sent from the secure link page, they
+// are decrypted as usual. Otherwise, a readable stub with the links found in
+// the message is presented instead.
+
+const outsideStubText = "This message is password-protected and cannot be decrypted by hydroxide. Open it in the ProtonMail web app to read it."
+
+var outsideLinkRegexp = regexp.MustCompile(`https?://[^\s"'<>\\]+`)
+
+// outsideLinks returns the links to the secure message page found in the body
+// of a message encrypted to outside recipients.
+func outsideLinks(body string) []string {
+	var links []string
+	seen := make(map[string]bool)
+	for _, link := range outsideLinkRegexp.FindAllString(body, -1) {
+		if !seen[link] {
+			seen[link] = true
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// outsideStub formats the stub of a message encrypted to outside recipients
+// that cannot be decrypted, in the MIME type of the message body.
+func outsideStub(msg *protonmail.Message) string {
+	links := outsideLinks(msg.Body)
+	if msg.MIMEType != "text/html" {
+		s := outsideStubText + "\r\n"
+		for _, link := range links {
+			s += "\r\n" + link + "\r\n"
+		}
+		return s
+	}
+
+	s := "<p>" + html.EscapeString(outsideStubText) + "</p>\r\n"
+	for _, link := range links {
+		link = html.EscapeString(link)
+		s += "<p><a href=\"" + link + "\">" + link + "</a></p>\r\n"
+	}
+	return s
+}
+
+// outsideBody returns the body of a message encrypted to outside recipients,
+// falling back to a stub if it cannot be decrypted.
+func (mbox *mailbox) outsideBody(msg *protonmail.Message) io.Reader {
+	md, err := msg.Read(mbox.u.privateKeys, nil)
+	if err != nil {
+		mbox.u.log.Debug("cannot decrypt message encrypted to outside, presenting a stub", "message", msg.ID, "err", err)
+		return strings.NewReader(outsideStub(msg))
+	}
+	return md.UnverifiedBody
+}
@@ -0,0 +1,103 @@
+package imap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestOutsideLinks(t *testing.T) {
+	tests := []struct {
+		body string
+		want []string
+	}{
+		{"no links", nil},
+		{"Read it at https://mail.example.org/eo/abc\n", []string{"https://mail.example.org/eo/abc"}},
+		{`<a href="https://mail.example.org/eo/abc">https://mail.example.org/eo/abc</a>`, []string{"https://mail.example.org/eo/abc"}},
+		{"http://a.example.org 'https://b.example.org/x'", []string{"http://a.example.org", "https://b.example.org/x"}},
+	}
+	for _, tc := range tests {
+		if got := outsideLinks(tc.body); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("outsideLinks(%q) = %q, want %q", tc.body, got, tc.want)
+		}
+	}
+}
+
+func TestOutsideStub(t *testing.T) {
+	tests := []struct {
+		msg  *protonmail.Message
+		want string
+	}{
+		{
+			msg:  &protonmail.Message{MIMEType: "text/plain", Body: "no links"},
+			want: outsideStubText + "\r\n",
+		},
+		{
+			msg:  &protonmail.Message{MIMEType: "text/plain", Body: "https://mail.example.org/eo/abc"},
+			want: outsideStubText + "\r\n\r\nhttps://mail.example.org/eo/abc\r\n",
+		},
+		{
+			msg:  &protonmail.Message{MIMEType: "text/html", Body: `<a href="https://mail.example.org/eo?a=1&b=2">link</a>`},
+			want: "<p>" + outsideStubText + "</p>\r\n" + `<p><a href="https://mail.example.org/eo?a=1&amp;b=2">https://mail.example.org/eo?a=1&amp;b=2</a></p>` + "\r\n",
+		},
+	}
+	for _, tc := range tests {
+		if got := outsideStub(tc.msg); got != tc.want {
+			t.Errorf("outsideStub(%q) = %q, want %q", tc.msg.Body, got, tc.want)
+		}
+	}
+}
+
+func encryptTestBody(t *testing.T, e *openpgp.Entity, s string) string {
+	var b bytes.Buffer
+	aw, err := armor.Encode(&b, "PGP MESSAGE", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := openpgp.Encrypt(aw, openpgp.EntityList{e}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(s))
+	w.Close()
+	aw.Close()
+	return b.String()
+}
+
+func TestOutsideBody(t *testing.T) {
+	e, _ := newTestSender(t)
+	other, _ := newTestSender(t)
+	u := newTestUser(t, new(testAPI))
+	u.privateKeys = openpgp.EntityList{e}
+	mbox := u.getMailboxByLabel(protonmail.LabelInbox)
+
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"decryptable", encryptTestBody(t, e, "hello"), "hello"},
+		{"other key", encryptTestBody(t, other, "hello"), outsideStubText + "\r\n"},
+		{"not armored", "https://mail.example.org/eo/abc", outsideStubText + "\r\n\r\nhttps://mail.example.org/eo/abc\r\n"},
+	}
+	for _, tc := range tests {
+		msg := &protonmail.Message{ID: "msg1", MIMEType: "text/plain", IsEncrypted: protonmail.MessageEncryptedOutside, Body: tc.body}
+		r, err := mbox.inlineBody(msg)
+		if err != nil {
+			t.Errorf("%v: inlineBody() = %v", tc.name, err)
+			continue
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("%v: reading body: %v", tc.name, err)
+		} else if string(b) != tc.want {
+			t.Errorf("%v: body = %q, want %q", tc.name, b, tc.want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package imap
+
+import (
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// messagePart is a part of the MIME tree of a message built from the API
+// metadata. The root is a multipart/mixed part containing the body and the
+// attachments. Inline attachments of HTML messages are grouped with the body
+// in a multipart/related part, so that clients can resolve cid: URLs.
+type messagePart struct {
+	// subType is set for multipart parts
+	subType  string
+	children []*messagePart
+
+	// For leaf parts, att is nil for the message body
+	att *protonmail.Attachment
+}
+
+func (p *messagePart) isMultipart() bool {
+	return p.subType != ""
+}
+
+func messageTree(msg *protonmail.Message) *messagePart {
+	body := &messagePart{}
+
+	var inline, regular []*messagePart
+	for _, att := range msg.Attachments {
+		p := &messagePart{att: att}
+		if att.IsInline() && msg.MIMEType == "text/html" {
+			inline = append(inline, p)
+		} else {
+			regular = append(regular, p)
+		}
+	}
+
+	first := body
+	if len(inline) > 0 {
+		first = &messagePart{
+			subType:  "related",
+			children: append([]*messagePart{body}, inline...),
+		}
+	}
+
+	return &messagePart{
+		subType:  "mixed",
+		children: append([]*messagePart{first}, regular...),
+	}
+}
+
+// lookup returns the part at path, or nil if it doesn't exist.
+func (p *messagePart) lookup(path []int) *messagePart {
+	for _, n := range path {
+		if n < 1 || n > len(p.children) {
+			return nil
+		}
+		p = p.children[n-1]
+	}
+	return p
+}
+
+// attachments returns the attachments contained in the part.
+func (p *messagePart) attachments() []*protonmail.Attachment {
+	if p.att != nil {
+		return []*protonmail.Attachment{p.att}
+	}
+	var l []*protonmail.Attachment
+	for _, child := range p.children {
+		l = append(l, child.attachments()...)
+	}
+	return l
+}
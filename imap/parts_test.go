@@ -0,0 +1,155 @@
+package imap
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// partTypes returns the MIME types of the parts of a message tree: multipart
+// parts are written as "multipart/subtype(children)", the body as "body" and
+// attachments by name.
+func partTypes(p *messagePart) string {
+	if p.isMultipart() {
+		s := "multipart/" + p.subType + "("
+		for i, child := range p.children {
+			if i > 0 {
+				s += " "
+			}
+			s += partTypes(child)
+		}
+		return s + ")"
+	}
+	if p.att == nil {
+		return "body"
+	}
+	return p.att.Name
+}
+
+func TestMessageTree(t *testing.T) {
+	inline := &protonmail.Attachment{
+		Name:    "inline.png",
+		Headers: protonmail.AttachmentHeaders{"content-disposition": "inline"},
+	}
+	regular := &protonmail.Attachment{Name: "regular.pdf"}
+
+	tests := []struct {
+		name     string
+		mimeType string
+		atts     []*protonmail.Attachment
+		want     string
+	}{
+		{
+			name:     "no attachment",
+			mimeType: "text/html",
+			want:     "multipart/mixed(body)",
+		},
+		{
+			name:     "regular",
+			mimeType: "text/html",
+			atts:     []*protonmail.Attachment{regular},
+			want:     "multipart/mixed(body regular.pdf)",
+		},
+		{
+			name:     "inline in html",
+			mimeType: "text/html",
+			atts:     []*protonmail.Attachment{inline, regular},
+			want:     "multipart/mixed(multipart/related(body inline.png) regular.pdf)",
+		},
+		{
+			name:     "inline in plain text",
+			mimeType: "text/plain",
+			atts:     []*protonmail.Attachment{inline, regular},
+			want:     "multipart/mixed(body inline.png regular.pdf)",
+		},
+	}
+	for _, tc := range tests {
+		msg := &protonmail.Message{MIMEType: tc.mimeType, Attachments: tc.atts}
+		if got := partTypes(messageTree(msg)); got != tc.want {
+			t.Errorf("%v: messageTree() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMessagePartLookup(t *testing.T) {
+	inline := &protonmail.Attachment{
+		Name:    "inline.png",
+		Headers: protonmail.AttachmentHeaders{"content-disposition": "inline"},
+	}
+	regular := &protonmail.Attachment{Name: "regular.pdf"}
+	msg := &protonmail.Message{
+		MIMEType:    "text/html",
+		Attachments: []*protonmail.Attachment{inline, regular},
+	}
+	root := messageTree(msg)
+
+	tests := []struct {
+		path []int
+		want string
+		atts []*protonmail.Attachment
+	}{
+		{nil, "multipart/mixed(multipart/related(body inline.png) regular.pdf)", []*protonmail.Attachment{inline, regular}},
+		{[]int{1}, "multipart/related(body inline.png)", []*protonmail.Attachment{inline}},
+		{[]int{1, 1}, "body", nil},
+		{[]int{1, 2}, "inline.png", []*protonmail.Attachment{inline}},
+		{[]int{2}, "regular.pdf", []*protonmail.Attachment{regular}},
+		{[]int{3}, "", nil},
+		{[]int{0}, "", nil},
+		{[]int{2, 1}, "", nil},
+	}
+	for _, tc := range tests {
+		p := root.lookup(tc.path)
+		if tc.want == "" {
+			if p != nil {
+				t.Errorf("lookup(%v) = %v, want nil", tc.path, partTypes(p))
+			}
+			continue
+		}
+		if p == nil {
+			t.Errorf("lookup(%v) = nil, want %v", tc.path, tc.want)
+			continue
+		}
+		if got := partTypes(p); got != tc.want {
+			t.Errorf("lookup(%v) = %v, want %v", tc.path, got, tc.want)
+		}
+		if got := p.attachments(); !reflect.DeepEqual(got, tc.atts) {
+			t.Errorf("lookup(%v).attachments() = %v, want %v", tc.path, got, tc.atts)
+		}
+	}
+}
+
+func TestPartBodyStructure(t *testing.T) {
+	inline := &protonmail.Attachment{
+		Name:      "inline.png",
+		MIMEType:  "image/png",
+		ContentID: "image@example.org",
+		Headers:   protonmail.AttachmentHeaders{"content-disposition": "inline"},
+	}
+	msg := &protonmail.Message{
+		MIMEType:    "text/html",
+		Attachments: []*protonmail.Attachment{inline},
+	}
+
+	bs := partBodyStructure(msg, messageTree(msg), false)
+	if bs.MIMEType != "multipart" || bs.MIMESubType != "mixed" || len(bs.Parts) != 1 {
+		t.Fatalf("root = %v/%v with %v parts, want multipart/mixed with 1 part", bs.MIMEType, bs.MIMESubType, len(bs.Parts))
+	}
+	related := bs.Parts[0]
+	if related.MIMEType != "multipart" || related.MIMESubType != "related" || len(related.Parts) != 2 {
+		t.Fatalf("first part = %v/%v with %v parts, want multipart/related with 2 parts", related.MIMEType, related.MIMESubType, len(related.Parts))
+	}
+	if body := related.Parts[0]; body.MIMEType != "text" || body.MIMESubType != "html" {
+		t.Errorf("body = %v/%v, want text/html", body.MIMEType, body.MIMESubType)
+	}
+	att := related.Parts[1]
+	if att.MIMEType != "image" || att.MIMESubType != "png" {
+		t.Errorf("attachment = %v/%v, want image/png", att.MIMEType, att.MIMESubType)
+	}
+	if att.Id != "<image@example.org>" {
+		t.Errorf("attachment ID = %q, want %q", att.Id, "<image@example.org>")
+	}
+	if att.Disposition != "inline" {
+		t.Errorf("attachment disposition = %q, want %q", att.Disposition, "inline")
+	}
+}
@@ -0,0 +1,66 @@
+package imap
+
+import (
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// codeCannot is returned when an operation can never succeed in a mailbox,
+// as defined in RFC 5530.
+const codeCannot imap.StatusRespCode = "CANNOT"
+
+// mailboxPermissions lists the operations a mailbox supports.
+type mailboxPermissions struct {
+	// Messages can be copied and moved into the mailbox
+	insert bool
+	// Messages can be marked as \Deleted and expunged
+	delete bool
+	// Expunged messages are moved to the trash but stay in the mailbox, even
+	// if permanent deletion is enabled
+	expungeToTrash bool
+}
+
+var defaultPermissions = mailboxPermissions{insert: true, delete: true}
+
+// systemPermissions lists the permissions of system mailboxes which are views
+// rather than labels that can be added or removed:
+//
+//   - All Mail contains all messages, so messages can't be added to it. Since
+//     they can't be removed from it either, expunging moves them to the trash.
+//   - Starred contains messages with the \Flagged flag, which has to be used
+//     instead to add or remove messages.
+var systemPermissions = map[string]mailboxPermissions{
+	protonmail.LabelAllMail: {delete: true, expungeToTrash: true},
+	protonmail.LabelStarred: {},
+}
+
+func (mbox *mailbox) permissions() mailboxPermissions {
+	if perms, ok := systemPermissions[mbox.label]; ok {
+		return perms
+	}
+	return defaultPermissions
+}
+
+func errCannot(info string) error {
+	return imapserver.ErrStatusResp(&imap.StatusResp{
+		Type: imap.StatusRespNo,
+		Code: codeCannot,
+		Info: info,
+	})
+}
+
+func (mbox *mailbox) checkInsert() error {
+	if !mbox.permissions().insert {
+		return errCannot("messages can't be copied or moved to " + mbox.name)
+	}
+	return nil
+}
+
+func (mbox *mailbox) checkDelete() error {
+	if !mbox.permissions().delete {
+		return errCannot("messages can't be deleted from " + mbox.name)
+	}
+	return nil
+}
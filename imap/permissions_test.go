@@ -0,0 +1,102 @@
+package imap
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestMailboxPermissions(t *testing.T) {
+	tests := []struct {
+		label              string
+		insert, delete     bool
+		wantExpungeToTrash bool
+	}{
+		{protonmail.LabelInbox, true, true, false},
+		{protonmail.LabelTrash, true, true, false},
+		{protonmail.LabelAllMail, false, true, true},
+		{protonmail.LabelStarred, false, false, false},
+		{"custom", true, true, false},
+	}
+	for _, tc := range tests {
+		mbox := &mailbox{name: "Mailbox", label: tc.label}
+		if err := mbox.checkInsert(); (err == nil) != tc.insert {
+			t.Errorf("%v: checkInsert() = %v, want allowed = %v", tc.label, err, tc.insert)
+		}
+		if err := mbox.checkDelete(); (err == nil) != tc.delete {
+			t.Errorf("%v: checkDelete() = %v, want allowed = %v", tc.label, err, tc.delete)
+		}
+		if got := mbox.permissions().expungeToTrash; got != tc.wantExpungeToTrash {
+			t.Errorf("%v: expungeToTrash = %v, want %v", tc.label, got, tc.wantExpungeToTrash)
+		}
+	}
+}
+
+func TestExpungePermissions(t *testing.T) {
+	ids := []string{"msg1"}
+	tests := []struct {
+		label   string
+		want    []apiRequest
+		wantErr bool
+	}{
+		{label: protonmail.LabelInbox, want: []apiRequest{{"/messages/label", protonmail.LabelTrash, ids}}},
+		{label: protonmail.LabelTrash, want: []apiRequest{{"/messages/delete", "", ids}}},
+		{label: protonmail.LabelAllMail, want: []apiRequest{{"/messages/label", protonmail.LabelTrash, ids}}},
+		{label: protonmail.LabelStarred, wantErr: true},
+	}
+	for _, tc := range tests {
+		api := new(testAPI)
+		u := newTestUser(t, api)
+		addTestMessages(t, u, &protonmail.Message{
+			ID:       "msg1",
+			LabelIDs: []string{tc.label},
+		})
+		mbox := u.getMailboxByLabel(tc.label)
+		mbox.deleted["msg1"] = struct{}{}
+
+		err := mbox.Expunge()
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%v: Expunge() = nil, want an error", tc.label)
+			}
+		} else if err != nil {
+			t.Errorf("%v: Expunge() = %v", tc.label, err)
+		}
+		if requests := api.reset(); !reflect.DeepEqual(requests, tc.want) {
+			t.Errorf("%v: requests = %v, want %v", tc.label, requests, tc.want)
+		}
+	}
+}
+
+func TestCannotResponse(t *testing.T) {
+	u := newTestUser(t, new(testAPI))
+	addTestMessages(t, u, &protonmail.Message{
+		ID:       "msg1",
+		LabelIDs: []string{protonmail.LabelInbox, protonmail.LabelAllMail, protonmail.LabelStarred},
+	})
+	for _, label := range []string{protonmail.LabelInbox, protonmail.LabelAllMail, protonmail.LabelStarred} {
+		u.getMailboxByLabel(label).total = 1
+	}
+	tc := newTestConn(t, u)
+
+	tests := []struct {
+		mailbox string
+		cmd     string
+	}{
+		{"INBOX", `COPY 1 "All Mail"`},
+		{"INBOX", `COPY 1 Starred`},
+		{"Starred", `STORE 1 +FLAGS (\Deleted)`},
+		{"Starred", `EXPUNGE`},
+	}
+	for _, test := range tests {
+		if resp := tc.run("SELECT " + test.mailbox); !strings.HasPrefix(resp[len(resp)-1], "OK") {
+			t.Fatalf("SELECT %v failed: %v", test.mailbox, resp)
+		}
+		resp := tc.run(test.cmd)
+		if status := resp[len(resp)-1]; !strings.HasPrefix(status, "NO [CANNOT]") {
+			t.Errorf("%v in %v: status = %v, want NO [CANNOT]", test.cmd, test.mailbox, status)
+		}
+	}
+}
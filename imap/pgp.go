@@ -0,0 +1,229 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+const decryptedHeader = "X-Pm-Decrypted"
+
+var (
+	armoredMessageBegin = []byte("-----BEGIN PGP MESSAGE-----")
+	armoredMessageEnd   = []byte("-----END PGP MESSAGE-----")
+)
+
+// isPGPMessage checks whether a message has been end-to-end encrypted by its
+// sender, on top of the ProtonMail encryption.
+func isPGPMessage(msg *protonmail.Message) bool {
+	return msg.IsEncrypted == protonmail.MessageEncryptedInlinePGP || msg.IsEncrypted == protonmail.MessageEncryptedPGPMIME
+}
+
+// findArmoredMessage returns the bounds of the first armored PGP message in b,
+// or -1 if there is none.
+func findArmoredMessage(b []byte) (start, end int) {
+	start = bytes.Index(b, armoredMessageBegin)
+	if start < 0 {
+		return -1, -1
+	}
+	i := bytes.Index(b[start:], armoredMessageEnd)
+	if i < 0 {
+		return -1, -1
+	}
+	return start, start + i + len(armoredMessageEnd)
+}
+
+// authenticationResults formats an Authentication-Results header field value
+// (RFC 8601) describing the signature of a message.
+func authenticationResults(msg *protonmail.Message) string {
+	v := "hydroxide; pgp=" + msg.SignatureStatus.String()
+	if msg.SignatureFingerprint != "" {
+		v += " header.fingerprint=" + msg.SignatureFingerprint
+	}
+	return v
+}
+
+// decryptPGP decrypts an armored PGP message and checks its signature, whose
+// status is stored in msg. keyring must contain the keys needed to decrypt the
+// message and the keys used to verify its signature.
+func decryptPGP(msg *protonmail.Message, ciphertext []byte, keyring openpgp.KeyRing) ([]byte, error) {
+	block, err := armor.Decode(bytes.NewReader(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+
+	md, err := openpgp.ReadMessage(block.Body, keyring, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// The signature is only checked once the whole body has been read
+	plaintext, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return nil, err
+	}
+
+	msg.CheckSignature(md)
+	return plaintext, nil
+}
+
+// pgpKeyring returns the keys used to decrypt and verify a message: the user's
+// private keys and the sender's public keys.
+func (mbox *mailbox) pgpKeyring(msg *protonmail.Message) openpgp.EntityList {
+	keyring := append(openpgp.EntityList(nil), mbox.u.privateKeys...)
+	if msg.Sender == nil {
+		return keyring
+	}
+
+	resp, err := mbox.u.c.GetPublicKeys(msg.Sender.Address)
+	if err != nil {
+		mbox.u.log.Warn("cannot get public keys", "address", msg.Sender.Address, "err", err)
+		return keyring
+	}
+	for _, pub := range resp.Keys {
+		if e, err := pub.Entity(); err == nil {
+			keyring = append(keyring, e)
+		}
+	}
+	return keyring
+}
+
+// pgpMIMEAttachment returns the attachment containing the encrypted part of a
+// PGP/MIME message.
+func pgpMIMEAttachment(msg *protonmail.Message) *protonmail.Attachment {
+	for _, att := range msg.Attachments {
+		if att.MIMEType == "application/pgp-encrypted" {
+			continue
+		}
+		return att
+	}
+	return nil
+}
+
+func (mbox *mailbox) writeInlinePGPMessage(w io.Writer, msg *protonmail.Message, body []byte, keyring openpgp.KeyRing) (bool, error) {
+	start, end := findArmoredMessage(body)
+	if start < 0 {
+		return false, nil
+	}
+
+	plaintext, err := decryptPGP(msg, body[start:end], keyring)
+	if err != nil {
+		mbox.u.log.Info("cannot decrypt inline PGP message", "message", msg.ID, "err", err)
+		return false, nil
+	}
+
+	h := messageHeader(msg)
+	h.Set(decryptedHeader, "true")
+	h.Set("Authentication-Results", authenticationResults(msg))
+
+	mw, err := message.CreateWriter(w, h)
+	if err != nil {
+		return false, err
+	}
+
+	// TODO: decrypt attachments encrypted separately (.pgp files)
+	inline := io.MultiReader(bytes.NewReader(body[:start]), bytes.NewReader(plaintext), bytes.NewReader(body[end:]))
+	if err := mbox.writeParts(mw, msg, messageTree(msg), inline); err != nil {
+		return false, err
+	}
+
+	return true, mw.Close()
+}
+
+func (mbox *mailbox) writePGPMIMEMessage(w io.Writer, msg *protonmail.Message, body []byte, keyring openpgp.KeyRing) (bool, error) {
+	var ciphertext []byte
+	if start, end := findArmoredMessage(body); start >= 0 {
+		ciphertext = body[start:end]
+	} else if att := pgpMIMEAttachment(msg); att != nil {
+		rc, err := mbox.attachmentBody(att)
+		if err != nil {
+			return false, err
+		}
+		ciphertext, err = ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return false, err
+		}
+	} else {
+		return false, nil
+	}
+
+	plaintext, err := decryptPGP(msg, ciphertext, keyring)
+	if err != nil {
+		mbox.u.log.Info("cannot decrypt PGP/MIME message", "message", msg.ID, "err", err)
+		return false, nil
+	}
+
+	// The decrypted data is a MIME entity, whose header describes the content
+	br := bufio.NewReader(bytes.NewReader(plaintext))
+	partHeader, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil {
+		mbox.u.log.Warn("cannot parse decrypted PGP/MIME message", "message", msg.ID, "err", err)
+		return false, nil
+	}
+
+	h := messageHeader(msg)
+	for k, v := range partHeader {
+		h[k] = v
+	}
+	h.Set(decryptedHeader, "true")
+	h.Set("Authentication-Results", authenticationResults(msg))
+
+	if _, err := io.WriteString(w, formatHeader(mail.Header{Header: h})+"\r\n"); err != nil {
+		return false, err
+	}
+	// Copy the body as is, it's already encoded
+	_, err = io.Copy(w, br)
+	return true, err
+}
+
+// writePGPMessage writes a message that has been end-to-end encrypted by its
+// sender, with its content decrypted. It returns false if the message cannot be
+// decrypted, in which case it should be presented as is.
+func (mbox *mailbox) writePGPMessage(w io.Writer, msg *protonmail.Message) (bool, error) {
+	msg, err := mbox.u.c.GetMessage(msg.ID)
+	if err != nil {
+		return false, err
+	}
+
+	r, err := mbox.inlineBody(msg)
+	if err != nil {
+		return false, err
+	}
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return false, err
+	}
+
+	keyring := mbox.pgpKeyring(msg)
+
+	switch msg.IsEncrypted {
+	case protonmail.MessageEncryptedInlinePGP:
+		return mbox.writeInlinePGPMessage(w, msg, body, keyring)
+	case protonmail.MessageEncryptedPGPMIME:
+		return mbox.writePGPMIMEMessage(w, msg, body, keyring)
+	default:
+		return false, errors.New("message isn't end-to-end encrypted")
+	}
+}
+
+// decryptPGPMessage returns the entity of a message that has been end-to-end
+// encrypted by its sender, with its content decrypted. It returns nil if the
+// message cannot be decrypted, in which case it should be presented as is.
+func (mbox *mailbox) decryptPGPMessage(msg *protonmail.Message) (*message.Entity, error) {
+	var b bytes.Buffer
+	if ok, err := mbox.writePGPMessage(&b, msg); err != nil || !ok {
+		return nil, err
+	}
+	return message.Read(&b)
+}
@@ -0,0 +1,45 @@
+package imap
+
+import (
+	"testing"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestFindArmoredMessage(t *testing.T) {
+	msg := "-----BEGIN PGP MESSAGE-----\n\nabc\n-----END PGP MESSAGE-----"
+	tests := []struct {
+		body       string
+		start, end int
+	}{
+		{msg, 0, len(msg)},
+		{"Hi\n\n" + msg + "\n\nBye", 4, 4 + len(msg)},
+		{"Hello", -1, -1},
+		{"-----BEGIN PGP MESSAGE-----\n\nabc", -1, -1},
+	}
+	for _, tc := range tests {
+		start, end := findArmoredMessage([]byte(tc.body))
+		if start != tc.start || end != tc.end {
+			t.Errorf("findArmoredMessage(%q) = %v, %v, want %v, %v", tc.body, start, end, tc.start, tc.end)
+		}
+	}
+}
+
+func TestAuthenticationResults(t *testing.T) {
+	tests := []struct {
+		status      protonmail.SignatureStatus
+		fingerprint string
+		want        string
+	}{
+		{protonmail.SignatureNone, "", "hydroxide; pgp=none"},
+		{protonmail.SignatureValid, "0123ABCD", "hydroxide; pgp=valid header.fingerprint=0123ABCD"},
+		{protonmail.SignatureInvalid, "", "hydroxide; pgp=invalid"},
+		{protonmail.SignatureUnknownKey, "", "hydroxide; pgp=unknown-key"},
+	}
+	for _, tc := range tests {
+		msg := &protonmail.Message{SignatureStatus: tc.status, SignatureFingerprint: tc.fingerprint}
+		if got := authenticationResults(msg); got != tc.want {
+			t.Errorf("authenticationResults(%v) = %q, want %q", tc.status, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package imap
+
+import (
+	"errors"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// QUOTA extension, defined in RFC 9208. ProtonMail storage is account-wide,
+// so all mailboxes share the same quota root.
+
+const (
+	quotaCapability        = "QUOTA"
+	quotaStorageCapability = "QUOTA=RES-STORAGE"
+)
+
+// quotaRoot is the name of the only quota root.
+const quotaRoot = ""
+
+// quotaRefreshInterval is the maximum age of the storage usage reported to
+// clients.
+const quotaRefreshInterval = 5 * time.Minute
+
+// userQuota is the storage usage of an account, in bytes.
+type userQuota struct {
+	used, max int
+	updated   time.Time
+}
+
+// getQuota returns the storage usage of the account, fetching the user info
+// again if it's outdated.
+func (u *user) getQuota() (userQuota, error) {
+	u.locker.Lock()
+	q := u.quota
+	u.locker.Unlock()
+
+	if time.Since(q.updated) < quotaRefreshInterval {
+		return q, nil
+	}
+
+	pu, err := u.c.GetCurrentUser()
+	if err != nil {
+		return q, err
+	}
+	q = userQuota{used: pu.UsedSpace, max: pu.MaxSpace, updated: time.Now()}
+
+	u.locker.Lock()
+	u.quota = q
+	u.locker.Unlock()
+	return q, nil
+}
+
+type quotaResponse struct {
+	quota userQuota
+}
+
+func (r *quotaResponse) WriteTo(w *imap.Writer) error {
+	// STORAGE is in units of 1024 octets
+	used := uint32((r.quota.used + 1023) / 1024)
+	max := uint32(r.quota.max / 1024)
+
+	fields := []interface{}{"QUOTA", quotaRoot, []interface{}{"STORAGE", used, max}}
+	return imap.NewUntaggedResp(fields).WriteTo(w)
+}
+
+type getQuotaHandler struct {
+	root string
+}
+
+func (h *getQuotaHandler) Parse(fields []interface{}) error {
+	if len(fields) != 1 {
+		return errors.New("GETQUOTA expects a quota root")
+	}
+
+	var err error
+	h.root, err = imap.ParseString(fields[0])
+	return err
+}
+
+func (h *getQuotaHandler) Handle(conn imapserver.Conn) error {
+	u, ok := conn.Context().User.(*user)
+	if !ok {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	if h.root != quotaRoot {
+		return errors.New("no such quota root")
+	}
+
+	q, err := u.getQuota()
+	if err != nil {
+		return err
+	}
+	return conn.WriteResp(&quotaResponse{q})
+}
+
+type getQuotaRootHandler struct {
+	// name is the mailbox name as sent by the client
+	name    string
+	mailbox string
+}
+
+func (h *getQuotaRootHandler) Parse(fields []interface{}) error {
+	if len(fields) != 1 {
+		return errors.New("GETQUOTAROOT expects a mailbox")
+	}
+
+	var err error
+	if h.name, err = imap.ParseString(fields[0]); err != nil {
+		return err
+	}
+	h.mailbox, err = parseMailboxPattern(fields[0])
+	return err
+}
+
+func (h *getQuotaRootHandler) Handle(conn imapserver.Conn) error {
+	u, ok := conn.Context().User.(*user)
+	if !ok {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	if _, err := u.GetMailbox(h.mailbox); err != nil {
+		return err
+	}
+
+	q, err := u.getQuota()
+	if err != nil {
+		return err
+	}
+
+	resp := imap.NewUntaggedResp([]interface{}{"QUOTAROOT", h.name, quotaRoot})
+	if err := conn.WriteResp(resp); err != nil {
+		return err
+	}
+	return conn.WriteResp(&quotaResponse{q})
+}
+
+type setQuotaHandler struct{}
+
+func (h *setQuotaHandler) Parse(fields []interface{}) error {
+	return nil
+}
+
+func (h *setQuotaHandler) Handle(conn imapserver.Conn) error {
+	return errors.New("storage quota can't be changed")
+}
+
+type quotaExtension struct{}
+
+func (ext *quotaExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{quotaCapability, quotaStorageCapability}
+	}
+	return nil
+}
+
+func (ext *quotaExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "GETQUOTA":
+		return func() imapserver.Handler {
+			return &getQuotaHandler{}
+		}
+	case "GETQUOTAROOT":
+		return func() imapserver.Handler {
+			return &getQuotaRootHandler{}
+		}
+	case "SETQUOTA":
+		return func() imapserver.Handler {
+			return &setQuotaHandler{}
+		}
+	}
+	return nil
+}
+
+// NewQuotaExtension returns an IMAP server extension implementing QUOTA, with
+// the STORAGE resource.
+func NewQuotaExtension() imapserver.Extension {
+	return &quotaExtension{}
+}
@@ -0,0 +1,61 @@
+package imap
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestQuotaResponse(t *testing.T) {
+	tests := []struct {
+		used, max int
+		want      string
+	}{
+		{0, 0, `* QUOTA "" (STORAGE 0 0)` + "\r\n"},
+		{1, 1024 * 1024, `* QUOTA "" (STORAGE 1 1024)` + "\r\n"},
+		{2048, 1023, `* QUOTA "" (STORAGE 2 0)` + "\r\n"},
+		{5 * 1024 * 1024 * 1024, 10 * 1024 * 1024 * 1024, `* QUOTA "" (STORAGE 5242880 10485760)` + "\r\n"},
+	}
+	for _, tc := range tests {
+		var b bytes.Buffer
+		r := &quotaResponse{userQuota{used: tc.used, max: tc.max}}
+		if err := r.WriteTo(imap.NewWriter(&b)); err != nil {
+			t.Errorf("WriteTo(%v, %v) = %v", tc.used, tc.max, err)
+		} else if b.String() != tc.want {
+			t.Errorf("WriteTo(%v, %v) wrote %q, want %q", tc.used, tc.max, b.String(), tc.want)
+		}
+	}
+}
+
+func TestGetQuota(t *testing.T) {
+	requests := 0
+	u := newTestUser(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"Code":1000,"User":{"UsedSpace":100,"MaxSpace":1000}}`))
+	}))
+
+	for i, wantRequests := range []int{1, 1} {
+		q, err := u.getQuota()
+		if err != nil {
+			t.Fatalf("getQuota() = %v", err)
+		}
+		if q.used != 100 || q.max != 1000 {
+			t.Errorf("getQuota() = %+v, want 100/1000", q)
+		}
+		if requests != wantRequests {
+			t.Errorf("call %v: %v requests, want %v", i, requests, wantRequests)
+		}
+	}
+
+	// Outdated usage is fetched again
+	u.quota.updated = time.Now().Add(-quotaRefreshInterval)
+	if _, err := u.getQuota(); err != nil {
+		t.Fatalf("getQuota() = %v", err)
+	}
+	if requests != 2 {
+		t.Errorf("%v requests after the refresh interval, want 2", requests)
+	}
+}
@@ -0,0 +1,66 @@
+package imap
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// ProtonMail keeps the MIME body of messages received with a multipart
+// structure, along with their original header. These messages are written as
+// is instead of being reassembled from their metadata, so that signatures
+// covering the raw message, e.g. DKIM, can still be checked.
+
+const rawMIMEType = "multipart/mixed"
+
+// writeRawMessage writes the original source of a message, which must be
+// fully fetched. It returns false if the source isn't available.
+func (mbox *mailbox) writeRawMessage(w io.Writer, msg *protonmail.Message) (bool, error) {
+	if msg.MIMEType != rawMIMEType || msg.Header == "" {
+		return false, nil
+	}
+
+	body, err := mbox.inlineBody(msg)
+	if err != nil {
+		return false, err
+	}
+
+	header := msg.Header
+	switch {
+	case strings.HasSuffix(header, "\r\n\r\n"), strings.HasSuffix(header, "\n\n"):
+	case strings.HasSuffix(header, "\r\n"):
+		header += "\r\n"
+	case strings.HasSuffix(header, "\n"):
+		header += "\n"
+	default:
+		header += "\r\n\r\n"
+	}
+
+	if _, err := io.WriteString(w, header); err != nil {
+		return false, err
+	}
+	_, err = io.Copy(w, body)
+	return true, err
+}
+
+// fetchWholeMessage returns a whole message, as written by writeMessage. It
+// isn't parsed and formatted again, so that the original source is returned
+// unmodified.
+func (mbox *mailbox) fetchWholeMessage(msg *protonmail.Message, section *imap.BodySectionName) (imap.Literal, error) {
+	if b, err := mbox.cachedMessageBytes(msg, true); err != nil {
+		return nil, err
+	} else if b != nil {
+		return bytes.NewReader(section.ExtractPartial(b)), nil
+	}
+
+	b := new(literalBuffer)
+	if err := mbox.writeMessage(b, msg); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b.Literal(section), nil
+}
@@ -0,0 +1,104 @@
+package imap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestWriteRawMessage(t *testing.T) {
+	const body = "--abc\r\n\r\nHello\r\n--abc--\r\n"
+	tests := []struct {
+		name     string
+		mimeType string
+		header   string
+		want     string
+		wantOK   bool
+	}{
+		{"header with blank line", rawMIMEType, "Subject: Hi\r\n\r\n", "Subject: Hi\r\n\r\n" + body, true},
+		{"header with LF blank line", rawMIMEType, "Subject: Hi\n\n", "Subject: Hi\n\n" + body, true},
+		{"header with CRLF", rawMIMEType, "Subject: Hi\r\n", "Subject: Hi\r\n\r\n" + body, true},
+		{"header with LF", rawMIMEType, "Subject: Hi\n", "Subject: Hi\n\n" + body, true},
+		{"header without line ending", rawMIMEType, "Subject: Hi", "Subject: Hi\r\n\r\n" + body, true},
+		{"no header", rawMIMEType, "", "", false},
+		{"not multipart", "text/plain", "Subject: Hi\r\n", "", false},
+	}
+	u := newTestUser(t, new(testAPI))
+	mbox := u.getMailboxByLabel(protonmail.LabelInbox)
+	for _, tc := range tests {
+		msg := &protonmail.Message{
+			ID:       "msg1",
+			MIMEType: tc.mimeType,
+			Header:   tc.header,
+			Body:     body,
+		}
+		var b bytes.Buffer
+		ok, err := mbox.writeRawMessage(&b, msg)
+		if err != nil {
+			t.Errorf("%v: writeRawMessage() = %v", tc.name, err)
+		} else if ok != tc.wantOK || b.String() != tc.want {
+			t.Errorf("%v: writeRawMessage() = %v, %q, want %v, %q", tc.name, ok, b.String(), tc.wantOK, tc.want)
+		}
+	}
+}
+
+func TestCacheVersion(t *testing.T) {
+	msg := &protonmail.Message{Time: 1, Size: 2, NumAttachments: 3}
+	if got, want := cacheVersion(msg), fmt.Sprintf("%v.1.2.3", cacheFormat); got != want {
+		t.Errorf("cacheVersion() = %q, want %q", got, want)
+	}
+}
+
+func TestFetchRawMessage(t *testing.T) {
+	const raw = "DKIM-Signature: v=1\r\nSubject:   Unfolded\r\nContent-Type: multipart/mixed; boundary=abc\r\n\r\n--abc\r\n\r\nHello\r\n--abc--\r\n"
+	header, body, _ := strings.Cut(raw, "\r\n\r\n")
+
+	u := newTestUser(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/messages/msg1" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Code": 1000,
+			"Message": &protonmail.Message{
+				ID:       "msg1",
+				MIMEType: rawMIMEType,
+				Header:   header + "\r\n",
+				Body:     body,
+				LabelIDs: []string{protonmail.LabelInbox},
+			},
+		})
+	}))
+	addTestMessages(t, u, &protonmail.Message{
+		ID:       "msg1",
+		MIMEType: rawMIMEType,
+		LabelIDs: []string{protonmail.LabelInbox},
+	})
+	u.getMailboxByLabel(protonmail.LabelInbox).total = 1
+	tc := newTestConn(t, u)
+
+	if resp := tc.run("SELECT INBOX"); !strings.HasPrefix(resp[len(resp)-1], "OK") {
+		t.Fatalf("SELECT failed: %v", resp)
+	}
+
+	resp := tc.run("FETCH 1 BODY.PEEK[]")
+	want := []string{fmt.Sprintf("* 1 FETCH (BODY[] {%v}", len(raw))}
+	want = append(want, strings.Split(strings.TrimSuffix(raw, "\r\n"), "\r\n")...)
+	want = append(want, ")", "OK FETCH completed")
+	if !reflect.DeepEqual(resp, want) {
+		t.Errorf("FETCH response = %q, want %q", resp, want)
+	}
+
+	resp = tc.run("FETCH 1 BODY.PEEK[]<0.14>")
+	want = []string{"* 1 FETCH (BODY[]<0> {14}", "DKIM-Signature)", "OK FETCH completed"}
+	if !reflect.DeepEqual(resp, want) {
+		t.Errorf("partial FETCH response = %q, want %q", resp, want)
+	}
+}
@@ -0,0 +1,114 @@
+package imap
+
+import (
+	"sync"
+)
+
+// reported is the owner of recent messages which have been reported to a
+// session that has since selected the mailbox again or logged out. These
+// messages aren't recent anymore, but are kept so that they don't become
+// recent again if the same event is received by another session.
+var reported = new(mailbox)
+
+// recentMessages keeps track of the messages which have arrived in mailboxes
+// since they've been last selected, in all sessions. As defined in RFC 3501
+// section 2.3.2, a message is recent in exactly one session: the first one to
+// select its mailbox after it has arrived.
+type recentMessages struct {
+	locker sync.Mutex
+	// messages maps a mailbox to the IDs of its recent messages. The value is
+	// the session mailbox the message is recent in, or nil if no session has
+	// been notified about it yet.
+	messages map[string]map[string]*mailbox
+}
+
+func newRecentMessages() *recentMessages {
+	return &recentMessages{messages: make(map[string]map[string]*mailbox)}
+}
+
+func recentKey(mbox *mailbox) string {
+	return mbox.u.u.ID + "/" + mbox.label
+}
+
+// add marks a message which has just arrived in a mailbox as recent. If
+// selected is true, the message is reported to the session right away.
+func (r *recentMessages) add(mbox *mailbox, id string, selected bool) {
+	k := recentKey(mbox)
+
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	m, ok := r.messages[k]
+	if !ok {
+		m = make(map[string]*mailbox)
+		r.messages[k] = m
+	}
+
+	owner, ok := m[id]
+	if !ok || (owner == nil && selected) {
+		if selected {
+			owner = mbox
+		}
+		m[id] = owner
+	}
+}
+
+// remove forgets about a message which isn't in a mailbox anymore.
+func (r *recentMessages) remove(mbox *mailbox, id string) {
+	r.locker.Lock()
+	delete(r.messages[recentKey(mbox)], id)
+	r.locker.Unlock()
+}
+
+// report is called when a session selects a mailbox. Messages previously
+// reported to the session aren't recent anymore, and pending messages become
+// recent in this session.
+func (r *recentMessages) report(mbox *mailbox) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	m := r.messages[recentKey(mbox)]
+	for id, owner := range m {
+		if owner == mbox {
+			m[id] = reported
+		} else if owner == nil {
+			m[id] = mbox
+		}
+	}
+}
+
+// release is called when a session is closed.
+func (r *recentMessages) release(mbox *mailbox) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	m := r.messages[recentKey(mbox)]
+	for id, owner := range m {
+		if owner == mbox {
+			m[id] = reported
+		}
+	}
+}
+
+// isRecent checks whether a message is recent in the session.
+func (r *recentMessages) isRecent(mbox *mailbox, id string) bool {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	return r.messages[recentKey(mbox)][id] == mbox
+}
+
+// count returns the number of recent messages in a mailbox, from the point of
+// view of the session: messages recent in this session and messages which
+// haven't been reported yet.
+func (r *recentMessages) count(mbox *mailbox) int {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	n := 0
+	for _, owner := range r.messages[recentKey(mbox)] {
+		if owner == nil || owner == mbox {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,83 @@
+package imap
+
+import (
+	"testing"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestRecentMessages(t *testing.T) {
+	u := &user{u: &protonmail.User{ID: "user"}}
+	// Two sessions with the inbox mailbox
+	a := &mailbox{u: u, label: protonmail.LabelInbox}
+	b := &mailbox{u: u, label: protonmail.LabelInbox}
+	other := &mailbox{u: u, label: protonmail.LabelArchive}
+
+	r := newRecentMessages()
+	type state struct {
+		recentA, recentB bool
+		countA, countB   int
+	}
+	check := func(step, id string, want state) {
+		got := state{r.isRecent(a, id), r.isRecent(b, id), r.count(a), r.count(b)}
+		if got != want {
+			t.Errorf("%v: state of %v = %+v, want %+v", step, id, got, want)
+		}
+	}
+
+	// A message arriving while no session is selected is pending
+	r.add(a, "msg1", false)
+	check("arrived", "msg1", state{false, false, 1, 1})
+	if n := r.count(other); n != 0 {
+		t.Errorf("recent messages in another mailbox = %v, want 0", n)
+	}
+
+	// The first session selecting the mailbox gets it
+	r.report(b)
+	check("reported to b", "msg1", state{false, true, 0, 1})
+	r.report(a)
+	check("reported to a", "msg1", state{false, true, 0, 1})
+
+	// A message arriving while a session is selected is recent right away,
+	// and the same event received by another session doesn't change it
+	r.add(a, "msg2", true)
+	r.add(b, "msg2", true)
+	check("arrived while selected", "msg2", state{true, false, 1, 1})
+
+	// Selecting the mailbox again clears recent messages
+	r.report(b)
+	check("b selected again", "msg1", state{false, false, 1, 0})
+	r.add(b, "msg1", false)
+	check("event received again", "msg1", state{false, false, 1, 0})
+
+	// Closed sessions release their messages, which aren't recent anymore
+	r.release(a)
+	check("a released", "msg2", state{false, false, 0, 0})
+
+	r.add(a, "msg3", false)
+	r.remove(a, "msg3")
+	check("removed", "msg3", state{false, false, 0, 0})
+}
+
+func TestCreateEventRecent(t *testing.T) {
+	u := newTestUser(t, new(testAPI))
+	inbox := u.getMailboxByLabel(protonmail.LabelInbox)
+	u.selectMailbox(inbox, false)
+
+	u.messageEventUpdates(&protonmail.EventMessage{
+		ID:      "msg1",
+		Action:  protonmail.EventCreate,
+		Created: &protonmail.Message{ID: "msg1", LabelIDs: []string{protonmail.LabelInbox, protonmail.LabelAllMail}},
+	})
+	if !u.recent.isRecent(inbox, "msg1") {
+		t.Errorf("created message isn't recent in the selected mailbox")
+	}
+	if n := u.recent.count(u.getMailboxByLabel(protonmail.LabelAllMail)); n != 1 {
+		t.Errorf("recent messages in another mailbox = %v, want 1", n)
+	}
+
+	u.messageEventUpdates(&protonmail.EventMessage{ID: "msg1", Action: protonmail.EventDelete})
+	if n := u.recent.count(inbox); n != 0 {
+		t.Errorf("recent messages after deletion = %v, want 0", n)
+	}
+}
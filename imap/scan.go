@@ -0,0 +1,235 @@
+package imap
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+
+	"github.com/emersion/hydroxide/events"
+	"github.com/emersion/hydroxide/imap/database"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// Mailboxes are scanned the first time they're used: all of their messages
+// are listed and stored in the local database. Pages are fetched
+// concurrently, but written in order, so that UIDs are assigned in ascending
+// ID order. The mailbox can be used as soon as the first page has been
+// written, the rest of the scan continues in the background and new messages
+// are announced to clients as they're written.
+//
+// The scan progress is stored in the local database: an interrupted scan is
+// resumed, and a complete scan is reused by later sessions as long as the
+// database hasn't missed any event.
+
+const (
+	scanPageSize = 150
+	// scanParallelism is the maximum number of pages fetched concurrently
+	scanParallelism = 4
+)
+
+type scanPage struct {
+	messages []*protonmail.Message
+	err      error
+}
+
+func isRateLimited(err error) bool {
+	return errors.Is(err, protonmail.ErrRateLimited)
+}
+
+// checkScans discards complete scans if the database has missed events, e.g.
+// because they have been received while no IMAP session was open.
+func checkScans(db *database.User, eventsManager *events.Manager, username string) error {
+	last, err := eventsManager.LastEventID(username)
+	if err != nil {
+		return err
+	}
+	applied, err := db.EventID()
+	if err != nil {
+		return err
+	}
+	if last == applied {
+		return nil
+	}
+	return db.ResetScans()
+}
+
+func (mbox *mailbox) init() error {
+	mbox.initializedLock.Lock()
+	defer mbox.initializedLock.Unlock()
+
+	if mbox.initialized || mbox.isScanning() {
+		return nil
+	}
+
+	page, done, err := mbox.db.ScanState()
+	if err != nil {
+		return err
+	} else if done {
+		mbox.initialized = true
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	mbox.scanLock.Lock()
+	mbox.scanCancel = cancel
+	mbox.scanLock.Unlock()
+
+	ready := make(chan error, 1)
+	mbox.u.scans.Add(1)
+	go func() {
+		defer mbox.u.scans.Done()
+		var once sync.Once
+		err := mbox.scan(ctx, page, func() {
+			once.Do(func() { ready <- nil })
+		})
+		once.Do(func() { ready <- err })
+		mbox.endScan(ctx, err)
+	}()
+
+	if err := <-ready; mbox.u.checkOffline(err) {
+		// Use the local database, the mailbox will be synchronized later
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	mbox.initialized = true
+	return nil
+}
+
+func (mbox *mailbox) isScanning() bool {
+	mbox.scanLock.Lock()
+	defer mbox.scanLock.Unlock()
+	return mbox.scanCancel != nil
+}
+
+func (mbox *mailbox) cancelScan() {
+	mbox.scanLock.Lock()
+	defer mbox.scanLock.Unlock()
+	if mbox.scanCancel != nil {
+		mbox.scanCancel()
+	}
+}
+
+// endScan is called when a scan has stopped. If it's incomplete, it's resumed
+// the next time the mailbox is used.
+func (mbox *mailbox) endScan(ctx context.Context, err error) {
+	// The scan is canceled when the mailbox is reset or the user logs out
+	canceled := ctx.Err() != nil
+
+	mbox.scanLock.Lock()
+	mbox.scanCancel()
+	mbox.scanCancel = nil
+	mbox.scanLock.Unlock()
+
+	if err == nil || canceled {
+		return
+	}
+
+	mbox.initializedLock.Lock()
+	mbox.initialized = false
+	mbox.initializedLock.Unlock()
+
+	if !mbox.u.checkOffline(err) {
+		mbox.u.log.Warn("cannot synchronize mailbox", "mailbox", mbox.name, "err", err)
+	}
+}
+
+// scan lists the messages of the mailbox, starting from page. ready is called
+// once the first page has been written.
+func (mbox *mailbox) scan(ctx context.Context, page int, ready func()) error {
+	mbox.u.log.Info("synchronizing mailbox", "mailbox", mbox.name, "page", page)
+
+	c := mbox.u.c
+	list := func(page int) (int, []*protonmail.Message, error) {
+		return c.ListMessagesContext(ctx, &protonmail.MessageFilter{
+			Page:     page,
+			PageSize: scanPageSize,
+			Label:    mbox.label,
+			Sort:     "ID",
+			Asc:      true,
+		})
+	}
+
+	// Messages already in the local database keep their UID
+	write := func(page int, msgs []*protonmail.Message) error {
+		n, err := mbox.db.SyncScan(msgs, page)
+		if err != nil {
+			return err
+		}
+
+		update := new(imapbackend.MailboxUpdate)
+		update.Update = imapbackend.NewUpdate(mbox.u.u.Name, mbox.name)
+		update.MailboxStatus = imap.NewMailboxStatus(mbox.name, []imap.StatusItem{imap.StatusMessages})
+		update.MailboxStatus.Messages = n
+		mbox.u.updates <- update
+		return nil
+	}
+
+	// Pages may have shifted if messages have been deleted since the scan
+	// has been interrupted
+	if page > 0 {
+		page--
+	}
+
+	total, msgs, err := list(page)
+	if err != nil {
+		return err
+	}
+	if err := write(page, msgs); err != nil {
+		return err
+	}
+	ready()
+
+	pages := (total + scanPageSize - 1) / scanPageSize
+	results := make(map[int]chan scanPage)
+	fetch := func(page int) {
+		ch := make(chan scanPage, 1)
+		results[page] = ch
+		go func() {
+			_, msgs, err := list(page)
+			ch <- scanPage{msgs, err}
+		}()
+	}
+
+	parallelism := scanParallelism
+	next := page + 1
+	for page++; page < pages; page++ {
+		for ; next < pages && next < page+parallelism; next++ {
+			fetch(next)
+		}
+
+		res := <-results[page]
+		delete(results, page)
+		if isRateLimited(res.err) {
+			// Fetch the remaining pages one at a time
+			mbox.u.log.Warn("rate-limited while synchronizing mailbox", "mailbox", mbox.name, "page", page)
+			parallelism = 1
+			_, res.messages, res.err = list(page)
+		}
+		if res.err != nil {
+			return res.err
+		}
+
+		if err := write(page, res.messages); err != nil {
+			return err
+		}
+	}
+
+	seqNums, err := mbox.db.EndScan()
+	if err != nil {
+		return err
+	}
+	for _, seqNum := range seqNums {
+		update := new(imapbackend.ExpungeUpdate)
+		update.Update = imapbackend.NewUpdate(mbox.u.u.Name, mbox.name)
+		update.SeqNum = seqNum
+		mbox.u.updates <- update
+	}
+
+	mbox.u.log.Info("synchronized mailbox", "mailbox", mbox.name)
+	return nil
+}
@@ -0,0 +1,151 @@
+package imap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	imapbackend "github.com/emersion/go-imap/backend"
+
+	"github.com/emersion/hydroxide/events"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// testMessagesAPI lists messages, page by page. The pages in rateLimited fail
+// once with a rate limit error.
+type testMessagesAPI struct {
+	ids         []string
+	rateLimited map[int]bool
+
+	locker sync.Mutex
+	pages  []int
+}
+
+func (api *testMessagesAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/messages" {
+		http.NotFound(w, r)
+		return
+	}
+	page, _ := strconv.Atoi(r.URL.Query().Get("Page"))
+	pageSize, _ := strconv.Atoi(r.URL.Query().Get("PageSize"))
+
+	api.locker.Lock()
+	api.pages = append(api.pages, page)
+	limited := api.rateLimited[page]
+	delete(api.rateLimited, page)
+	api.locker.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if limited {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"Code":2028,"Error":"Too many requests"}`))
+		return
+	}
+
+	var msgs []*protonmail.Message
+	for i := page * pageSize; i < len(api.ids) && i < (page+1)*pageSize; i++ {
+		msgs = append(msgs, &protonmail.Message{ID: api.ids[i], LabelIDs: []string{protonmail.LabelInbox}})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"Code": 1000, "Total": len(api.ids), "Messages": msgs})
+}
+
+func TestScan(t *testing.T) {
+	var ids []string
+	for i := 0; i < 3*scanPageSize+10; i++ {
+		ids = append(ids, fmt.Sprintf("msg%04d", i))
+	}
+
+	tests := []struct {
+		name        string
+		page        int
+		rateLimited map[int]bool
+		wantPages   []int
+		wantUpdates int
+	}{
+		{name: "from the beginning", wantPages: []int{0, 1, 2, 3}, wantUpdates: 4},
+		{name: "resumed", page: 2, wantPages: []int{1, 2, 3}, wantUpdates: 3},
+		{name: "rate-limited", rateLimited: map[int]bool{2: true}, wantPages: []int{0, 1, 2, 2, 3}, wantUpdates: 4},
+	}
+	for _, tc := range tests {
+		api := &testMessagesAPI{ids: ids, rateLimited: tc.rateLimited}
+		u := newTestUser(t, api)
+		updates := make(chan imapbackend.Update, 10)
+		u.updates = updates
+		mbox := u.getMailboxByLabel(protonmail.LabelInbox)
+
+		ready := false
+		err := mbox.scan(context.Background(), tc.page, func() { ready = true })
+		if err != nil {
+			t.Errorf("%v: scan() = %v", tc.name, err)
+			continue
+		} else if !ready {
+			t.Errorf("%v: scan() didn't call ready", tc.name)
+		}
+
+		sort.Ints(api.pages)
+		if !reflect.DeepEqual(api.pages, tc.wantPages) {
+			t.Errorf("%v: listed pages %v, want %v", tc.name, api.pages, tc.wantPages)
+		}
+
+		var got []string
+		mbox.db.ForEach(func(seqNum, uid uint32, apiID string) error {
+			got = append(got, apiID)
+			return nil
+		})
+		wantIDs := ids
+		if tc.page > 0 {
+			wantIDs = ids[(tc.page-1)*scanPageSize:]
+		}
+		if !reflect.DeepEqual(got, wantIDs) {
+			t.Errorf("%v: scan() stored %v messages, want %v in order", tc.name, len(got), len(wantIDs))
+		}
+		if _, done, err := mbox.db.ScanState(); err != nil || !done {
+			t.Errorf("%v: ScanState() = %v, %v, want a complete scan", tc.name, done, err)
+		}
+		if n := len(updates); n != tc.wantUpdates {
+			t.Errorf("%v: scan() sent %v updates, want %v", tc.name, n, tc.wantUpdates)
+		}
+	}
+}
+
+func TestCheckScans(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	eventsManager := events.NewManager(time.Minute, time.Minute)
+
+	tests := []struct {
+		eventID   string
+		wantReset bool
+	}{
+		{"", false},
+		{"missed", true},
+	}
+	for _, tc := range tests {
+		u := newTestUser(t, new(testAPI))
+		mbox := u.getMailboxByLabel(protonmail.LabelInbox)
+		if _, err := mbox.db.SyncScan(nil, 0); err != nil {
+			t.Fatalf("SyncScan() = %v", err)
+		}
+		if _, err := mbox.db.EndScan(); err != nil {
+			t.Fatalf("EndScan() = %v", err)
+		}
+		if err := u.db.SetEventID(tc.eventID); err != nil {
+			t.Fatalf("SetEventID() = %v", err)
+		}
+
+		if err := checkScans(u.db, eventsManager, "user"); err != nil {
+			t.Errorf("checkScans() with event ID %q = %v", tc.eventID, err)
+		}
+		if _, done, err := mbox.db.ScanState(); err != nil {
+			t.Fatalf("ScanState() = %v", err)
+		} else if done == tc.wantReset {
+			t.Errorf("checkScans() with event ID %q: scan done = %v, want %v", tc.eventID, done, !tc.wantReset)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package imap
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	imapserver "github.com/emersion/go-imap/server"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// SORT extension, defined in RFC 5256. Sort keys are computed from the
+// messages stored in the local database, no message is downloaded. ProtonMail
+// doesn't distinguish the arrival date from the sent date, so ARRIVAL and DATE
+// are the same.
+
+const sortCommand = "SORT"
+
+type sortKey int
+
+const (
+	sortArrival sortKey = iota
+	sortCc
+	sortDate
+	sortFrom
+	sortSize
+	sortSubject
+	sortTo
+)
+
+var sortKeys = map[string]sortKey{
+	"ARRIVAL": sortArrival,
+	"CC":      sortCc,
+	"DATE":    sortDate,
+	"FROM":    sortFrom,
+	"SIZE":    sortSize,
+	"SUBJECT": sortSubject,
+	"TO":      sortTo,
+}
+
+type sortCriterion struct {
+	key     sortKey
+	reverse bool
+}
+
+func parseSortCriteria(fields []interface{}) ([]sortCriterion, error) {
+	var criteria []sortCriterion
+	reverse := false
+	for _, f := range fields {
+		name, ok := f.(string)
+		if !ok {
+			return nil, errors.New("invalid sort criterion")
+		}
+		name = strings.ToUpper(name)
+		if name == "REVERSE" {
+			if reverse {
+				return nil, errors.New("duplicate REVERSE sort criterion")
+			}
+			reverse = true
+			continue
+		}
+
+		key, ok := sortKeys[name]
+		if !ok {
+			return nil, errors.New("unsupported sort criterion: " + name)
+		}
+		criteria = append(criteria, sortCriterion{key, reverse})
+		reverse = false
+	}
+	if reverse || len(criteria) == 0 {
+		return nil, errors.New("missing sort criterion")
+	}
+	return criteria, nil
+}
+
+type sortHandler struct {
+	commands.Search
+
+	criteria []sortCriterion
+}
+
+func (h *sortHandler) Parse(fields []interface{}) error {
+	if len(fields) < 3 {
+		return errors.New("SORT expects sort criteria, a charset and search criteria")
+	}
+
+	l, ok := fields[0].([]interface{})
+	if !ok {
+		return errors.New("SORT criteria must be a list")
+	}
+	var err error
+	if h.criteria, err = parseSortCriteria(l); err != nil {
+		return err
+	}
+
+	// The charset is mandatory, unlike with SEARCH
+	return h.Search.Parse(append([]interface{}{"CHARSET"}, fields[1:]...))
+}
+
+// addrSortKey returns the mailbox part of the first address of a list, as
+// defined in RFC 5256 section 3.
+func addrSortKey(l []*protonmail.MessageAddress) string {
+	if len(l) == 0 {
+		return ""
+	}
+	addr := l[0].Address
+	if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+		addr = addr[:i]
+	}
+	return strings.ToLower(addr)
+}
+
+// baseSubject extracts the base subject of a message, as defined in RFC 5256
+// section 2.1.
+func baseSubject(s string) string {
+	s = strings.ToLower(strings.Join(strings.Fields(s), " "))
+
+	for {
+		prev := s
+
+		// Trailers
+		for {
+			t := strings.TrimSpace(strings.TrimSuffix(s, "(fwd)"))
+			if t == s {
+				break
+			}
+			s = t
+		}
+
+		// Leaders, e.g. "[list] Re: "
+		for {
+			t := trimSubjectLeader(s)
+			if t == s {
+				break
+			}
+			s = t
+		}
+
+		// "[fwd: subject]"
+		if strings.HasPrefix(s, "[fwd:") && strings.HasSuffix(s, "]") {
+			s = strings.TrimSpace(s[len("[fwd:") : len(s)-1])
+		}
+
+		if s == prev {
+			return s
+		}
+	}
+}
+
+func trimSubjectBlob(s string) (string, bool) {
+	if !strings.HasPrefix(s, "[") {
+		return s, false
+	}
+	i := strings.IndexByte(s, ']')
+	if i < 0 || strings.ContainsAny(s[1:i], "[") {
+		return s, false
+	}
+	return strings.TrimLeft(s[i+1:], " "), true
+}
+
+func trimSubjectLeader(s string) string {
+	t := s
+	for _, prefix := range []string{"re", "fwd", "fw"} {
+		if strings.HasPrefix(t, prefix) {
+			t = strings.TrimLeft(t[len(prefix):], " ")
+			t, _ = trimSubjectBlob(t)
+			if strings.HasPrefix(t, ":") {
+				return strings.TrimLeft(t[1:], " ")
+			}
+			break
+		}
+	}
+
+	// A blob is only removed if it isn't the whole subject
+	if t, ok := trimSubjectBlob(s); ok && t != "" {
+		return t
+	}
+	return s
+}
+
+func compareSortKey(key sortKey, a, b *protonmail.Message) int {
+	cmpInt := func(a, b int64) int {
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	}
+
+	switch key {
+	case sortArrival, sortDate:
+		return cmpInt(a.Time, b.Time)
+	case sortCc:
+		return strings.Compare(addrSortKey(a.CCList), addrSortKey(b.CCList))
+	case sortFrom:
+		var fromA, fromB []*protonmail.MessageAddress
+		if a.Sender != nil {
+			fromA = []*protonmail.MessageAddress{a.Sender}
+		}
+		if b.Sender != nil {
+			fromB = []*protonmail.MessageAddress{b.Sender}
+		}
+		return strings.Compare(addrSortKey(fromA), addrSortKey(fromB))
+	case sortSize:
+		return cmpInt(a.Size, b.Size)
+	case sortSubject:
+		return strings.Compare(baseSubject(a.Subject), baseSubject(b.Subject))
+	case sortTo:
+		return strings.Compare(addrSortKey(a.ToList), addrSortKey(b.ToList))
+	}
+	return 0
+}
+
+// sortMessages sorts messages. Messages which compare equal are kept in
+// sequence number order, as RFC 5256 requires.
+func (mbox *mailbox) sortMessages(uid bool, ids []uint32, criteria []sortCriterion) ([]uint32, error) {
+	type sortMessage struct {
+		id  uint32
+		msg *protonmail.Message
+	}
+
+	// Messages are in sequence number order
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(ids...)
+	refs, err := mbox.matchMessages(uid, seqSet)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]sortMessage, 0, len(refs))
+	for _, ref := range refs {
+		msg, err := mbox.u.db.Message(ref.apiID)
+		if err != nil {
+			return nil, err
+		}
+		id := ref.seqNum
+		if uid {
+			id = ref.uid
+		}
+		msgs = append(msgs, sortMessage{id, msg})
+	}
+
+	sort.SliceStable(msgs, func(i, j int) bool {
+		for _, c := range criteria {
+			cmp := compareSortKey(c.key, msgs[i].msg, msgs[j].msg)
+			if c.reverse {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return false
+	})
+
+	sorted := make([]uint32, len(msgs))
+	for i, msg := range msgs {
+		sorted[i] = msg.id
+	}
+	return sorted, nil
+}
+
+type sortResponse struct {
+	ids []uint32
+}
+
+func (r *sortResponse) WriteTo(w *imap.Writer) error {
+	s := "* " + sortCommand
+	for _, id := range r.ids {
+		s += " " + strconv.FormatUint(uint64(id), 10)
+	}
+	_, err := io.WriteString(w, s+"\r\n")
+	return err
+}
+
+func (h *sortHandler) handle(uid bool, conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+	mbox, ok := ctx.Mailbox.(*mailbox)
+	if !ok {
+		return errors.New("SORT isn't supported in this mailbox")
+	}
+
+	ids, err := mbox.SearchMessages(uid, h.Criteria)
+	if err != nil {
+		return err
+	}
+
+	sorted, err := mbox.sortMessages(uid, ids, h.criteria)
+	if err != nil {
+		return err
+	}
+
+	return conn.WriteResp(&sortResponse{sorted})
+}
+
+func (h *sortHandler) Handle(conn imapserver.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *sortHandler) UidHandle(conn imapserver.Conn) error {
+	return h.handle(true, conn)
+}
+
+type sortExtension struct{}
+
+func (ext *sortExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{sortCommand}
+	}
+	return nil
+}
+
+func (ext *sortExtension) Command(name string) imapserver.HandlerFactory {
+	if name != sortCommand {
+		return nil
+	}
+
+	return func() imapserver.Handler {
+		return &sortHandler{}
+	}
+}
+
+// NewSortExtension returns an IMAP server extension implementing SORT.
+func NewSortExtension() imapserver.Extension {
+	return &sortExtension{}
+}
@@ -0,0 +1,150 @@
+package imap
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestParseSortCriteria(t *testing.T) {
+	tests := []struct {
+		fields  []interface{}
+		want    []sortCriterion
+		wantErr bool
+	}{
+		{fields: []interface{}{"DATE"}, want: []sortCriterion{{sortDate, false}}},
+		{fields: []interface{}{"reverse", "size", "Subject"}, want: []sortCriterion{{sortSize, true}, {sortSubject, false}}},
+		{fields: []interface{}{"FROM", "REVERSE", "TO"}, want: []sortCriterion{{sortFrom, false}, {sortTo, true}}},
+		{fields: []interface{}{}, wantErr: true},
+		{fields: []interface{}{"REVERSE"}, wantErr: true},
+		{fields: []interface{}{"REVERSE", "REVERSE", "DATE"}, wantErr: true},
+		{fields: []interface{}{"DISPLAYFROM"}, wantErr: true},
+		{fields: []interface{}{[]interface{}{"DATE"}}, wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := parseSortCriteria(tc.fields)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseSortCriteria(%v) = %v, want an error", tc.fields, got)
+			}
+		} else if err != nil {
+			t.Errorf("parseSortCriteria(%v) = %v", tc.fields, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseSortCriteria(%v) = %v, want %v", tc.fields, got, tc.want)
+		}
+	}
+}
+
+func TestBaseSubject(t *testing.T) {
+	tests := []struct {
+		s, want string
+	}{
+		{"Hello", "hello"},
+		{"  Hello   world ", "hello world"},
+		{"Re: Hello", "hello"},
+		{"RE: re:  Hello", "hello"},
+		{"Fwd: Re: Hello", "hello"},
+		{"Fw: Hello", "hello"},
+		{"Re[2]: Hello", "hello"},
+		{"[list] Re: Hello", "hello"},
+		{"Hello (fwd)", "hello"},
+		{"Hello (fwd) (FWD)", "hello"},
+		{"[Fwd: Re: Hello]", "hello"},
+		{"[list]", "[list]"},
+		{"Remove", "remove"},
+		{"", ""},
+	}
+	for _, tc := range tests {
+		if got := baseSubject(tc.s); got != tc.want {
+			t.Errorf("baseSubject(%q) = %q, want %q", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestAddrSortKey(t *testing.T) {
+	tests := []struct {
+		l    []*protonmail.MessageAddress
+		want string
+	}{
+		{nil, ""},
+		{[]*protonmail.MessageAddress{{Address: "Alice@example.org", Name: "Zoe"}}, "alice"},
+		{[]*protonmail.MessageAddress{{Address: "bob@example.org"}, {Address: "alice@example.org"}}, "bob"},
+		{[]*protonmail.MessageAddress{{Address: "local"}}, "local"},
+	}
+	for _, tc := range tests {
+		if got := addrSortKey(tc.l); got != tc.want {
+			t.Errorf("addrSortKey(%v) = %q, want %q", tc.l, got, tc.want)
+		}
+	}
+}
+
+func TestSortMessages(t *testing.T) {
+	u := newTestUser(t, new(testAPI))
+	addTestMessages(t, u,
+		&protonmail.Message{ID: "msg1", Time: 3, Size: 100, Subject: "Re: Banana", LabelIDs: []string{protonmail.LabelInbox}},
+		&protonmail.Message{ID: "msg2", Time: 1, Size: 300, Subject: "apple", LabelIDs: []string{protonmail.LabelInbox}},
+		&protonmail.Message{ID: "msg3", Time: 2, Size: 100, Subject: "Cherry", LabelIDs: []string{protonmail.LabelInbox}},
+		&protonmail.Message{ID: "msg4", Time: 4, Size: 200, Subject: "Fwd: apple", LabelIDs: []string{protonmail.LabelInbox}},
+	)
+	mbox := u.getMailboxByLabel(protonmail.LabelInbox)
+
+	tests := []struct {
+		name     string
+		ids      []uint32
+		criteria []sortCriterion
+		want     []uint32
+	}{
+		{"date", []uint32{1, 2, 3, 4}, []sortCriterion{{sortDate, false}}, []uint32{2, 3, 1, 4}},
+		{"reverse arrival", []uint32{1, 2, 3, 4}, []sortCriterion{{sortArrival, true}}, []uint32{4, 1, 3, 2}},
+		{"size keeps order", []uint32{1, 2, 3, 4}, []sortCriterion{{sortSize, false}}, []uint32{1, 3, 4, 2}},
+		{"subject then date", []uint32{1, 2, 3, 4}, []sortCriterion{{sortSubject, false}, {sortDate, true}}, []uint32{4, 2, 1, 3}},
+		{"subset", []uint32{3, 1}, []sortCriterion{{sortDate, false}}, []uint32{3, 1}},
+	}
+	for _, tc := range tests {
+		got, err := mbox.sortMessages(false, tc.ids, tc.criteria)
+		if err != nil {
+			t.Errorf("%v: sortMessages() = %v", tc.name, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: sortMessages() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSort(t *testing.T) {
+	u := newTestUser(t, new(testAPI))
+	sender := &protonmail.MessageAddress{Address: "alice@example.org"}
+	addTestMessages(t, u,
+		&protonmail.Message{ID: "msg1", Sender: sender, Size: 100, LabelIDs: []string{protonmail.LabelInbox}},
+		&protonmail.Message{ID: "msg2", Sender: sender, Size: 300, LabelIDs: []string{protonmail.LabelInbox}},
+		&protonmail.Message{ID: "msg3", Sender: sender, Size: 200, LabelIDs: []string{protonmail.LabelInbox}},
+	)
+	u.getMailboxByLabel(protonmail.LabelInbox).total = 3
+	tc := newTestConn(t, u, NewSortExtension())
+
+	resp := tc.run("SORT (SIZE) UTF-8 ALL")
+	if status := resp[len(resp)-1]; !strings.HasPrefix(status, "NO") && !strings.HasPrefix(status, "BAD") {
+		t.Errorf("SORT without a selected mailbox = %q, want an error", resp)
+	}
+	if resp := tc.run("SELECT INBOX"); !strings.HasPrefix(resp[len(resp)-1], "OK") {
+		t.Fatalf("SELECT failed: %v", resp)
+	}
+
+	tests := []struct {
+		cmd  string
+		want []string
+	}{
+		{"SORT (REVERSE SIZE) UTF-8 ALL", []string{"* SORT 2 3 1", "OK SORT completed"}},
+		{"UID SORT (SIZE) UTF-8 ALL", []string{"* SORT 1 3 2", "OK UID SORT completed"}},
+		{"SORT (SIZE) UTF-8 2:3", []string{"* SORT 3 2", "OK SORT completed"}},
+	}
+	for _, test := range tests {
+		if resp := tc.run(test.cmd); !reflect.DeepEqual(resp, test.want) {
+			t.Errorf("%v: response = %q, want %q", test.cmd, resp, test.want)
+		}
+	}
+	if resp := tc.run("SORT (DISPLAYFROM) UTF-8 ALL"); !strings.HasPrefix(resp[len(resp)-1], "BAD") {
+		t.Errorf("SORT with an unsupported criterion = %q, want BAD", resp)
+	}
+}
@@ -0,0 +1,175 @@
+package imap
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// THREAD extension, defined in RFC 5256. ProtonMail already groups messages
+// into conversations, so these are used as threads. Messages in a
+// conversation are returned as a chain ordered by date.
+
+const (
+	threadCommand    = "THREAD"
+	threadReferences = "REFERENCES"
+)
+
+type threadHandler struct {
+	commands.Search
+}
+
+func (h *threadHandler) Parse(fields []interface{}) error {
+	if len(fields) < 3 {
+		return errors.New("THREAD expects an algorithm, a charset and search criteria")
+	}
+
+	if algo, _ := fields[0].(string); !strings.EqualFold(algo, threadReferences) {
+		return errors.New("unsupported THREAD algorithm")
+	}
+
+	// The charset is mandatory, unlike with SEARCH
+	return h.Search.Parse(append([]interface{}{"CHARSET"}, fields[1:]...))
+}
+
+// threads groups messages by conversation. Threads are sorted by the date of
+// their first message.
+func (mbox *mailbox) threads(uid bool, ids []uint32) ([][]uint32, error) {
+	type threadMessage struct {
+		id   uint32
+		time int64
+	}
+
+	var order []string
+	byConversation := make(map[string][]threadMessage)
+	for _, id := range ids {
+		var apiID string
+		var err error
+		if uid {
+			apiID, err = mbox.db.FromUid(id)
+		} else {
+			apiID, err = mbox.db.FromSeqNum(id)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		msg, err := mbox.u.db.Message(apiID)
+		if err != nil {
+			return nil, err
+		}
+
+		// Messages cached before conversation IDs were stored are alone in
+		// their thread
+		conv := msg.ConversationID
+		if conv == "" {
+			conv = msg.ID
+		}
+
+		if _, ok := byConversation[conv]; !ok {
+			order = append(order, conv)
+		}
+		byConversation[conv] = append(byConversation[conv], threadMessage{id, msg.Time})
+	}
+
+	for _, l := range byConversation {
+		sort.SliceStable(l, func(i, j int) bool {
+			return l[i].time < l[j].time
+		})
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return byConversation[order[i]][0].time < byConversation[order[j]][0].time
+	})
+
+	threads := make([][]uint32, len(order))
+	for i, conv := range order {
+		for _, msg := range byConversation[conv] {
+			threads[i] = append(threads[i], msg.id)
+		}
+	}
+	return threads, nil
+}
+
+type threadResponse struct {
+	threads [][]uint32
+}
+
+func (r *threadResponse) WriteTo(w *imap.Writer) error {
+	// Thread lists aren't separated by spaces, so they can't be written as
+	// regular fields
+	s := "* " + threadCommand
+	if len(r.threads) > 0 {
+		s += " "
+	}
+	for _, thread := range r.threads {
+		ids := make([]string, len(thread))
+		for i, id := range thread {
+			ids[i] = strconv.FormatUint(uint64(id), 10)
+		}
+		s += "(" + strings.Join(ids, " ") + ")"
+	}
+	_, err := io.WriteString(w, s+"\r\n")
+	return err
+}
+
+func (h *threadHandler) handle(uid bool, conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+	mbox, ok := ctx.Mailbox.(*mailbox)
+	if !ok {
+		return errors.New("THREAD isn't supported in this mailbox")
+	}
+
+	ids, err := mbox.SearchMessages(uid, h.Criteria)
+	if err != nil {
+		return err
+	}
+
+	threads, err := mbox.threads(uid, ids)
+	if err != nil {
+		return err
+	}
+
+	return conn.WriteResp(&threadResponse{threads})
+}
+
+func (h *threadHandler) Handle(conn imapserver.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *threadHandler) UidHandle(conn imapserver.Conn) error {
+	return h.handle(true, conn)
+}
+
+type threadExtension struct{}
+
+func (ext *threadExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{threadCommand + "=" + threadReferences}
+	}
+	return nil
+}
+
+func (ext *threadExtension) Command(name string) imapserver.HandlerFactory {
+	if name != threadCommand {
+		return nil
+	}
+
+	return func() imapserver.Handler {
+		return &threadHandler{}
+	}
+}
+
+// NewThreadExtension returns an IMAP server extension implementing THREAD,
+// with the REFERENCES algorithm.
+func NewThreadExtension() imapserver.Extension {
+	return &threadExtension{}
+}
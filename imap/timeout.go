@@ -0,0 +1,197 @@
+package imap
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// Idle connections are logged out after a timeout, as allowed by RFC 3501
+// section 5.4. Clients in IDLE get a longer timeout, RFC 2177 recommends
+// re-issuing IDLE at least every 29 minutes.
+
+// byeWriteTimeout is the time given to the client to receive the BYE response
+// sent before closing an idle connection.
+const byeWriteTimeout = 10 * time.Second
+
+// activityConn resets a timer each time data is read from the connection.
+type activityConn struct {
+	net.Conn
+	timer *time.Timer
+
+	locker  sync.Mutex
+	timeout time.Duration
+}
+
+func (c *activityConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.locker.Lock()
+		if c.timeout > 0 {
+			c.timer.Reset(c.timeout)
+		}
+		c.locker.Unlock()
+	}
+	return n, err
+}
+
+// setTimeout changes the timeout and restarts the timer. A zero timeout stops
+// it.
+func (c *activityConn) setTimeout(timeout time.Duration) {
+	c.locker.Lock()
+	c.timeout = timeout
+	if timeout > 0 {
+		c.timer.Reset(timeout)
+	} else {
+		c.timer.Stop()
+	}
+	c.locker.Unlock()
+}
+
+// noopResp is a response which doesn't write anything. Since responses are
+// written in order, writing it waits for the previous ones to be flushed.
+type noopResp struct{}
+
+func (noopResp) WriteTo(w *imap.Writer) error {
+	return nil
+}
+
+type timeoutExtension struct {
+	timeout          time.Duration
+	idleTimeout      time.Duration
+	handshakeTimeout time.Duration
+
+	locker sync.Mutex
+	conns  map[*imapserver.Context]*activityConn
+}
+
+func (ext *timeoutExtension) conn(ctx *imapserver.Context) *activityConn {
+	ext.locker.Lock()
+	defer ext.locker.Unlock()
+	return ext.conns[ctx]
+}
+
+func (ext *timeoutExtension) Capabilities(c imapserver.Conn) []string {
+	return nil
+}
+
+func (ext *timeoutExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case idleCapability:
+		if ext.timeout <= 0 {
+			return nil
+		}
+		return func() imapserver.Handler {
+			return &idleHandler{timeouts: ext}
+		}
+	case "STARTTLS":
+		if ext.handshakeTimeout <= 0 {
+			return nil
+		}
+		return func() imapserver.Handler {
+			return &startTLSHandler{timeouts: ext}
+		}
+	}
+	return nil
+}
+
+func (ext *timeoutExtension) NewConn(c imapserver.Conn) imapserver.Conn {
+	if ext.timeout <= 0 && ext.handshakeTimeout <= 0 {
+		return c
+	}
+
+	ac := &activityConn{timeout: ext.timeout}
+	ac.timer = time.AfterFunc(ext.timeout, func() {
+		ext.logout(c, ac)
+	})
+	if ext.timeout <= 0 {
+		ac.timer.Stop()
+	}
+	// Connections aren't read from before being served, so the underlying
+	// connection can be wrapped right away
+	err := c.Upgrade(func(conn net.Conn) (net.Conn, error) {
+		ac.Conn = conn
+		return ac, nil
+	})
+	if err != nil {
+		ac.timer.Stop()
+		return c
+	}
+
+	ctx := c.Context()
+	ext.locker.Lock()
+	ext.conns[ctx] = ac
+	ext.locker.Unlock()
+
+	go func() {
+		<-ctx.LoggedOut
+		ac.timer.Stop()
+		ext.locker.Lock()
+		delete(ext.conns, ctx)
+		ext.locker.Unlock()
+	}()
+
+	return c
+}
+
+// logout sends a BYE response to an idle connection and stops reading from
+// it, which makes the server close it.
+func (ext *timeoutExtension) logout(c imapserver.Conn, ac *activityConn) {
+	ac.SetWriteDeadline(time.Now().Add(byeWriteTimeout))
+	c.WriteResp(&imap.StatusResp{
+		Type: imap.StatusRespBye,
+		Info: "Idle timeout, closing connection",
+	})
+	c.WriteResp(noopResp{})
+	ac.SetReadDeadline(time.Now())
+}
+
+// idle switches a connection to the IDLE timeout. The returned function
+// switches it back to the regular timeout.
+func (ext *timeoutExtension) idle(ctx *imapserver.Context) func() {
+	ac := ext.conn(ctx)
+	if ac == nil {
+		return func() {}
+	}
+	ac.setTimeout(ext.idleTimeout)
+	return func() {
+		ac.setTimeout(ext.timeout)
+	}
+}
+
+// startTLSHandler bounds the duration of the TLS handshake.
+type startTLSHandler struct {
+	imapserver.StartTLS
+
+	timeouts *timeoutExtension
+}
+
+func (h *startTLSHandler) Upgrade(conn imapserver.Conn) error {
+	ac := h.timeouts.conn(conn.Context())
+	if ac == nil {
+		return h.StartTLS.Upgrade(conn)
+	}
+
+	ac.SetDeadline(time.Now().Add(h.timeouts.handshakeTimeout))
+	defer ac.SetDeadline(time.Time{})
+	return h.StartTLS.Upgrade(conn)
+}
+
+// NewTimeoutExtension returns an IMAP server extension logging out clients
+// after timeout of inactivity, or after idleTimeout in IDLE. TLS handshakes
+// started with STARTTLS must complete within handshakeTimeout. A zero duration
+// disables the corresponding timeout. Clients are never logged out if timeout
+// is zero.
+//
+// It must be enabled before the IDLE extension.
+func NewTimeoutExtension(timeout, idleTimeout, handshakeTimeout time.Duration) imapserver.Extension {
+	return &timeoutExtension{
+		timeout:          timeout,
+		idleTimeout:      idleTimeout,
+		handshakeTimeout: handshakeTimeout,
+		conns:            make(map[*imapserver.Context]*activityConn),
+	}
+}
@@ -0,0 +1,100 @@
+package imap
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// expectBye checks whether the server sends BYE within d.
+func (tc *testConn) expectBye(d time.Duration, want bool) {
+	tc.t.Helper()
+	tc.c.SetReadDeadline(time.Now().Add(d))
+	defer tc.c.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	line, err := tc.r.ReadString('\n')
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		if want {
+			tc.t.Errorf("no BYE received within %v", d)
+		}
+		return
+	} else if err != nil && err != io.EOF {
+		tc.t.Fatalf("cannot read response: %v", err)
+	}
+	if got := strings.HasPrefix(line, "* BYE "); got != want {
+		tc.t.Errorf("received %q, want BYE = %v", line, want)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+
+	tests := []struct {
+		name string
+		run  func(tc *testConn)
+	}{
+		{
+			name: "inactive",
+			run: func(tc *testConn) {
+				tc.expectBye(10*timeout, true)
+			},
+		},
+		{
+			name: "active",
+			run: func(tc *testConn) {
+				for i := 0; i < 4; i++ {
+					time.Sleep(timeout / 2)
+					if resp := tc.run("NOOP"); !strings.HasPrefix(resp[len(resp)-1], "OK") {
+						t.Fatalf("NOOP response = %q", resp)
+					}
+				}
+				tc.expectBye(10*timeout, true)
+			},
+		},
+		{
+			name: "IDLE",
+			run: func(tc *testConn) {
+				io.WriteString(tc.c, "a100 IDLE\r\n")
+				if line, err := tc.r.ReadString('\n'); err != nil || !strings.HasPrefix(line, "+ ") {
+					t.Fatalf("IDLE response = %q, %v, want a continuation request", line, err)
+				}
+				tc.expectBye(3*timeout, false)
+
+				io.WriteString(tc.c, "DONE\r\n")
+				if line, err := tc.r.ReadString('\n'); err != nil || !strings.HasPrefix(line, "a100 OK") {
+					t.Fatalf("DONE response = %q, %v, want OK", line, err)
+				}
+				tc.expectBye(10*timeout, true)
+			},
+		},
+	}
+	for _, test := range tests {
+		u := newTestUser(t, new(testAPI))
+		tc := newTestConn(t, u, NewTimeoutExtension(timeout, time.Hour, 0))
+		test.run(tc)
+	}
+}
+
+func TestTimeoutDisabled(t *testing.T) {
+	u := newTestUser(t, new(testAPI))
+	ext := NewTimeoutExtension(0, time.Hour, 0).(*timeoutExtension)
+	tc := newTestConn(t, u, ext)
+
+	if ext.Command(idleCapability) != nil {
+		t.Errorf("Command(IDLE) = non-nil with no timeout, want nil")
+	}
+	if ext.Command("STARTTLS") != nil {
+		t.Errorf("Command(STARTTLS) = non-nil with no handshake timeout, want nil")
+	}
+	ext.locker.Lock()
+	n := len(ext.conns)
+	ext.locker.Unlock()
+	if n != 0 {
+		t.Errorf("%v connections tracked with no timeout, want 0", n)
+	}
+	if resp := tc.run("NOOP"); !strings.HasPrefix(resp[len(resp)-1], "OK") {
+		t.Errorf("NOOP response = %q", resp)
+	}
+}
@@ -0,0 +1,225 @@
+package imap
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// UIDPLUS extension, defined in RFC 4315.
+
+const uidPlusCapability = "UIDPLUS"
+
+const (
+	codeAppendUID imap.StatusRespCode = "APPENDUID"
+	codeCopyUID   imap.StatusRespCode = "COPYUID"
+)
+
+// formatUIDList formats UIDs without merging them into ranges, so that the
+// order is preserved.
+func formatUIDList(uids []uint32) imap.Atom {
+	l := make([]string, len(uids))
+	for i, uid := range uids {
+		l[i] = strconv.FormatUint(uint64(uid), 10)
+	}
+	return imap.Atom(strings.Join(l, ","))
+}
+
+type appendHandler struct {
+	imapserver.Append
+
+	catenate []catenatePart
+}
+
+func (h *appendHandler) Parse(fields []interface{}) error {
+	n := len(fields)
+	if n < 2 {
+		return h.Append.Parse(fields)
+	}
+	if name, ok := fields[n-2].(string); !ok || !strings.EqualFold(name, "CATENATE") {
+		return h.Append.Parse(fields)
+	}
+
+	l, ok := fields[n-1].([]interface{})
+	if !ok {
+		return errors.New("CATENATE expects a list")
+	}
+	var err error
+	if h.catenate, err = parseCatenate(l); err != nil {
+		return err
+	}
+	// The message is assembled when the command is handled
+	return h.Append.Parse(append(fields[:n-2:n-2], new(bytes.Buffer)))
+}
+
+func (h *appendHandler) Handle(conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	u, ok := ctx.User.(*user)
+	if !ok {
+		return h.Append.Handle(conn)
+	}
+	mbox := u.getMailbox(h.Mailbox)
+	if mbox == nil {
+		return imapserver.ErrStatusResp(&imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: imap.CodeTryCreate,
+			Info: imapbackend.ErrNoSuchMailbox.Error(),
+		})
+	}
+
+	if h.catenate != nil {
+		selected, _ := ctx.Mailbox.(*mailbox)
+		var err error
+		if h.Message, err = u.catenate(h.catenate, selected); err != nil {
+			return err
+		}
+	}
+
+	uid, err := mbox.createMessage(h.Flags, h.Date, h.Message)
+	if err != nil {
+		return err
+	}
+	if uid == 0 {
+		return nil
+	}
+
+	uidValidity, err := mbox.db.UidValidity()
+	if err != nil {
+		return err
+	}
+	return imapserver.ErrStatusResp(&imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      codeAppendUID,
+		Arguments: []interface{}{uidValidity, uid},
+		Info:      "APPEND completed",
+	})
+}
+
+type copyHandler struct {
+	imapserver.Copy
+}
+
+func (h *copyHandler) handle(uid bool, conn imapserver.Conn) error {
+	ctx := conn.Context()
+	mbox, ok := ctx.Mailbox.(*mailbox)
+	if !ok {
+		if uid {
+			return h.Copy.UidHandle(conn)
+		}
+		return h.Copy.Handle(conn)
+	}
+
+	srcUIDs, destUIDs, err := mbox.copyMessages(uid, h.SeqSet, h.Mailbox)
+	if err != nil {
+		return err
+	}
+	if len(srcUIDs) == 0 {
+		return nil
+	}
+
+	uidValidity, err := mbox.u.getMailbox(h.Mailbox).db.UidValidity()
+	if err != nil {
+		return err
+	}
+
+	info := "COPY completed"
+	if uid {
+		info = "UID " + info
+	}
+	return imapserver.ErrStatusResp(&imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      codeCopyUID,
+		Arguments: []interface{}{uidValidity, formatUIDList(srcUIDs), formatUIDList(destUIDs)},
+		Info:      info,
+	})
+}
+
+func (h *copyHandler) Handle(conn imapserver.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *copyHandler) UidHandle(conn imapserver.Conn) error {
+	return h.handle(true, conn)
+}
+
+type expungeHandler struct {
+	imapserver.Expunge
+
+	uids *imap.SeqSet
+}
+
+func (h *expungeHandler) Parse(fields []interface{}) error {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	s, ok := fields[0].(string)
+	if !ok {
+		return errors.New("invalid UID set")
+	}
+	var err error
+	h.uids, err = imap.ParseSeqSet(s)
+	return err
+}
+
+func (h *expungeHandler) UidHandle(conn imapserver.Conn) error {
+	if h.uids == nil {
+		return errors.New("missing UID set")
+	}
+
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+	if ctx.MailboxReadOnly {
+		return imapserver.ErrMailboxReadOnly
+	}
+
+	mbox, ok := ctx.Mailbox.(*mailbox)
+	if !ok {
+		return errors.New("UID EXPUNGE is not supported by this mailbox")
+	}
+	// Expunge updates are sent by the backend
+	return mbox.expunge(h.uids)
+}
+
+type uidPlusExtension struct{}
+
+func (ext *uidPlusExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{uidPlusCapability, catenateCapability}
+	}
+	return nil
+}
+
+func (ext *uidPlusExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "APPEND":
+		return func() imapserver.Handler {
+			return &utf8Handler{Handler: &appendHandler{}, mailboxArgs: []int{0}}
+		}
+	case "COPY":
+		return func() imapserver.Handler {
+			return &utf8Handler{Handler: &copyHandler{}, mailboxArgs: []int{1}}
+		}
+	case "EXPUNGE":
+		return func() imapserver.Handler {
+			return &expungeHandler{}
+		}
+	}
+	return nil
+}
+
+// NewUIDPlusExtension returns an IMAP server extension implementing UIDPLUS.
+func NewUIDPlusExtension() imapserver.Extension {
+	return &uidPlusExtension{}
+}
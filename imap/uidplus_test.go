@@ -0,0 +1,92 @@
+package imap
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestFormatUIDList(t *testing.T) {
+	tests := []struct {
+		uids []uint32
+		want imap.Atom
+	}{
+		{[]uint32{1}, "1"},
+		{[]uint32{3, 1, 2}, "3,1,2"},
+		{[]uint32{1, 2, 3}, "1,2,3"},
+	}
+	for _, tc := range tests {
+		if got := formatUIDList(tc.uids); got != tc.want {
+			t.Errorf("formatUIDList(%v) = %v, want %v", tc.uids, got, tc.want)
+		}
+	}
+}
+
+func TestCopyMessagesUIDs(t *testing.T) {
+	api := new(testAPI)
+	u := newTestUser(t, api)
+	// msg3 is already in the destination, msg2 won't be after polling
+	addTestMessages(t, u,
+		&protonmail.Message{ID: "msg1", LabelIDs: []string{protonmail.LabelInbox, protonmail.LabelAllMail}},
+		&protonmail.Message{ID: "msg2", LabelIDs: []string{protonmail.LabelInbox, protonmail.LabelAllMail}},
+		&protonmail.Message{ID: "msg3", LabelIDs: []string{protonmail.LabelInbox, protonmail.LabelAllMail, protonmail.LabelArchive}},
+	)
+
+	seqSet, _ := imap.ParseSeqSet("2:3")
+	srcUIDs, destUIDs, err := u.getMailboxByLabel(protonmail.LabelInbox).copyMessages(true, seqSet, "Archive")
+	if err != nil {
+		t.Fatalf("copyMessages() = %v", err)
+	}
+	if want := []uint32{3}; !reflect.DeepEqual(srcUIDs, want) {
+		t.Errorf("copyMessages() returned source UIDs %v, want %v", srcUIDs, want)
+	}
+	if want := []uint32{1}; !reflect.DeepEqual(destUIDs, want) {
+		t.Errorf("copyMessages() returned destination UIDs %v, want %v", destUIDs, want)
+	}
+	want := []apiRequest{{"/messages/label", protonmail.LabelArchive, []string{"msg2", "msg3"}}}
+	if requests := api.reset(); !reflect.DeepEqual(requests, want) {
+		t.Errorf("requests = %v, want %v", requests, want)
+	}
+}
+
+func TestExpungeUIDs(t *testing.T) {
+	tests := []struct {
+		name string
+		uids string
+		want []apiRequest
+	}{
+		{name: "all", want: []apiRequest{{"/messages/delete", "", []string{"msg1", "msg3"}}}},
+		{name: "subset", uids: "1:2", want: []apiRequest{{"/messages/delete", "", []string{"msg1"}}}},
+		{name: "none deleted", uids: "2"},
+	}
+	for _, tc := range tests {
+		api := new(testAPI)
+		u := newTestUser(t, api)
+		for _, id := range []string{"msg1", "msg2", "msg3"} {
+			addTestMessages(t, u, &protonmail.Message{ID: id, LabelIDs: []string{protonmail.LabelTrash}})
+		}
+		mbox := u.getMailboxByLabel(protonmail.LabelTrash)
+		mbox.deleted["msg1"] = struct{}{}
+		mbox.deleted["msg3"] = struct{}{}
+
+		var uids *imap.SeqSet
+		if tc.uids != "" {
+			uids, _ = imap.ParseSeqSet(tc.uids)
+		}
+		if err := mbox.expunge(uids); err != nil {
+			t.Errorf("%v: expunge() = %v", tc.name, err)
+			continue
+		}
+		requests := api.reset()
+		for _, req := range requests {
+			sort.Strings(req.ids)
+		}
+		if !reflect.DeepEqual(requests, tc.want) {
+			t.Errorf("%v: requests = %v, want %v", tc.name, requests, tc.want)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package imap
 
 import (
-	"log"
+	"fmt"
+	"log/slog"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap-specialuse"
@@ -10,7 +13,9 @@ import (
 	"golang.org/x/crypto/openpgp"
 
 	"github.com/emersion/hydroxide/events"
+	"github.com/emersion/hydroxide/imap/cache"
 	"github.com/emersion/hydroxide/imap/database"
+	"github.com/emersion/hydroxide/metrics"
 	"github.com/emersion/hydroxide/protonmail"
 )
 
@@ -40,18 +45,59 @@ type user struct {
 
 	locker    sync.Mutex
 	mailboxes map[string]*mailbox
+	labels    map[string]*protonmail.Label
+	// keywords contains label IDs indexed by lowercase keyword, labelKeywords
+	// contains keywords indexed by label ID
+	keywords      map[string]string
+	labelKeywords map[string]string
+	notify        *notifyRegistration
+	// selected is the mailbox selected in read-write mode, if any
+	selected *mailbox
+
+	recent  *recentMessages
+	quota   userQuota
+	updates chan<- imapbackend.Update
+	// scans tracks mailbox scans running in the background
+	scans sync.WaitGroup
+
+	cache    *cache.Cache
+	cacheKey *[32]byte
+
+	offlineState *offlineState
+	// expungeDelete is true if expunged messages are permanently deleted
+	expungeDelete bool
+	// matchDrafts is true if drafts without a Message-Id matching the draft
+	// they replace are matched by subject and recipients
+	matchDrafts bool
+	// offline is true if the API is unreachable
+	offline bool
 
 	done      chan<- struct{}
 	eventSent chan struct{}
+
+	log *slog.Logger
 }
 
-func newUser(be *backend, c *protonmail.Client, u *protonmail.User, privateKeys openpgp.EntityList, addrs []*protonmail.Address) (*user, error) {
+// sessionCounter is used to generate IDs correlating the log lines of a
+// session.
+var sessionCounter uint64
+
+func newUser(be *backend, c *protonmail.Client, u *protonmail.User, privateKeys openpgp.EntityList, addrs []*protonmail.Address, cacheKey *[32]byte) (*user, error) {
 	uu := &user{
-		c:           c,
-		u:           u,
-		privateKeys: privateKeys,
-		addrs:       addrs,
-		eventSent:   make(chan struct{}),
+		c:             c,
+		u:             u,
+		privateKeys:   privateKeys,
+		addrs:         addrs,
+		eventSent:     make(chan struct{}),
+		recent:        be.recent,
+		updates:       be.updates,
+		quota:         userQuota{used: u.UsedSpace, max: u.MaxSpace, updated: time.Now()},
+		cache:         be.cache,
+		cacheKey:      cacheKey,
+		offlineState:  be.offline,
+		expungeDelete: be.expungeDelete,
+		matchDrafts:   be.matchDrafts,
+		log:           slog.Default().With("session", fmt.Sprintf("imap-%v", atomic.AddUint64(&sessionCounter, 1)), "user", u.Name),
 	}
 
 	db, err := database.Open(u.Name + ".db")
@@ -60,6 +106,10 @@ func newUser(be *backend, c *protonmail.Client, u *protonmail.User, privateKeys
 	}
 	uu.db = db
 
+	if err := checkScans(db, be.eventsManager, u.Name); err != nil {
+		uu.log.Warn("cannot check mailbox scans", "err", err)
+	}
+
 	if err := uu.initMailboxes(); err != nil {
 		return nil, err
 	}
@@ -70,6 +120,7 @@ func newUser(be *backend, c *protonmail.Client, u *protonmail.User, privateKeys
 	go uu.receiveEvents(be.updates, ch)
 	uu.eventsReceiver = be.eventsManager.Register(c, u.Name, ch, done)
 
+	metrics.IMAPSessions.Inc()
 	return uu, nil
 }
 
@@ -89,14 +140,37 @@ func (u *user) initMailboxes() error {
 			name:    data.name,
 			label:   data.label,
 			flags:   data.flags,
+			attrs:   []string{imap.NoInferiorsAttr},
 			u:       u,
 			db:      mboxDB,
 			deleted: make(map[string]struct{}),
 		}
 	}
 
+	labels, err := u.c.ListLabels(protonmail.LabelMessage)
+	if protonmail.IsUnreachable(err) {
+		u.setOffline(err)
+		if account := u.offlineState.account(u.u.Name); account != nil {
+			labels = account.labels
+		}
+	} else if err != nil {
+		return err
+	} else {
+		u.offlineState.setLabels(u.u.Name, labels)
+	}
+	if err := u.setLabels(labels); err != nil {
+		return err
+	}
+
 	counts, err := u.c.CountMessages("")
-	if err != nil {
+	if protonmail.IsUnreachable(err) {
+		u.setOffline(err)
+		for _, mbox := range u.mailboxes {
+			if mbox.total, err = mbox.countLocal(); err != nil {
+				return err
+			}
+		}
+	} else if err != nil {
 		return err
 	}
 
@@ -118,7 +192,7 @@ func (u *user) ListMailboxes(subscribed bool) ([]imapbackend.Mailbox, error) {
 	u.locker.Lock()
 	defer u.locker.Unlock()
 
-	list := make([]imapbackend.Mailbox, 0, len(u.mailboxes))
+	list := u.listContainers()
 	for _, mbox := range u.mailboxes {
 		list = append(list, mbox)
 	}
@@ -151,21 +225,18 @@ func (u *user) GetMailbox(name string) (imapbackend.Mailbox, error) {
 	return mbox, nil
 }
 
-func (u *user) CreateMailbox(name string) error {
-	return errNotYetImplemented // TODO
-}
-
-func (u *user) DeleteMailbox(name string) error {
-	return errNotYetImplemented // TODO
-}
-
-func (u *user) RenameMailbox(existingName, newName string) error {
-	return errNotYetImplemented // TODO
-}
-
 func (u *user) Logout() error {
+	metrics.IMAPSessions.Dec()
 	close(u.done)
 
+	u.locker.Lock()
+	for _, mbox := range u.mailboxes {
+		u.recent.release(mbox)
+		mbox.cancelScan()
+	}
+	u.locker.Unlock()
+	u.scans.Wait()
+
 	if err := u.db.Close(); err != nil {
 		return err
 	}
@@ -178,124 +249,229 @@ func (u *user) Logout() error {
 
 func (u *user) poll() {
 	go u.eventsReceiver.Poll()
+	if u.isOffline() {
+		// No event will be received until the API is reachable again
+		return
+	}
 	<-u.eventSent
 }
 
-func (u *user) receiveEvents(updates chan<- imapbackend.Update, events <-chan *protonmail.Event) {
-	for event := range events {
-		var eventUpdates []imapbackend.Update
+// addRecent marks a message which has just been added to a mailbox as recent.
+func (u *user) addRecent(mbox *mailbox, id string) {
+	u.locker.Lock()
+	selected := u.selected == mbox
+	u.locker.Unlock()
 
-		if event.Refresh&protonmail.EventRefreshMail != 0 {
-			log.Println("Reinitializing the whole IMAP database")
+	u.recent.add(mbox, id, selected)
+}
 
-			u.locker.Lock()
-			for _, mbox := range u.mailboxes {
-				if err := mbox.reset(); err != nil {
-					log.Printf("cannot reset mailbox %s: %v", mbox.name, err)
-				}
+// selectMailbox is called when a mailbox is selected. If readOnly is false,
+// the messages recent in the mailbox are reported to this session.
+func (u *user) selectMailbox(mbox *mailbox, readOnly bool) {
+	u.locker.Lock()
+	if readOnly {
+		u.selected = nil
+	} else {
+		u.selected = mbox
+	}
+	u.locker.Unlock()
+
+	if !readOnly {
+		u.recent.report(mbox)
+	}
+}
+
+func (u *user) messageEventUpdates(eventMessage *protonmail.EventMessage) []imapbackend.Update {
+	var updates []imapbackend.Update
+	switch eventMessage.Action {
+	case protonmail.EventCreate:
+		u.log.Debug("received create event", "message", eventMessage.ID)
+		seqNums, err := u.db.CreateMessage(eventMessage.Created)
+		if err != nil {
+			u.log.Warn("cannot handle create event: cannot create message in local DB", "message", eventMessage.ID, "err", err)
+			break
+		}
+
+		// TODO: what if the message was already in the local DB?
+		for labelID, seqNum := range seqNums {
+			if mbox := u.getMailboxByLabel(labelID); mbox != nil {
+				u.addRecent(mbox, eventMessage.ID)
+
+				update := new(imapbackend.MailboxUpdate)
+				update.Update = imapbackend.NewUpdate(u.u.Name, mbox.name)
+				update.MailboxStatus = imap.NewMailboxStatus(mbox.name, []imap.StatusItem{imap.StatusMessages})
+				update.MailboxStatus.Messages = seqNum
+				updates = append(updates, update)
 			}
-			u.locker.Unlock()
+		}
+	case protonmail.EventUpdate, protonmail.EventUpdateFlags:
+		u.log.Debug("received update event", "message", eventMessage.ID)
+		if eventMessage.Action == protonmail.EventUpdate && u.cache != nil {
+			u.cache.Remove(eventMessage.ID)
+		}
+		createdSeqNums, deletedSeqNums, err := u.db.UpdateMessage(eventMessage.ID, eventMessage.Updated)
+		if err != nil {
+			u.log.Warn("cannot handle update event: cannot update message in local DB", "message", eventMessage.ID, "err", err)
+			break
+		}
 
-			if err := u.db.ResetMessages(); err != nil {
-				log.Printf("cannot reset user: %v", err)
+		for labelID, seqNum := range createdSeqNums {
+			if mbox := u.getMailboxByLabel(labelID); mbox != nil {
+				u.addRecent(mbox, eventMessage.ID)
+
+				update := new(imapbackend.MailboxUpdate)
+				update.Update = imapbackend.NewUpdate(u.u.Name, mbox.name)
+				update.MailboxStatus = imap.NewMailboxStatus(mbox.name, []imap.StatusItem{imap.StatusMessages})
+				update.MailboxStatus.Messages = seqNum
+				updates = append(updates, update)
+			}
+		}
+		for labelID, seqNum := range deletedSeqNums {
+			if mbox := u.getMailboxByLabel(labelID); mbox != nil {
+				u.recent.remove(mbox, eventMessage.ID)
+
+				update := new(imapbackend.ExpungeUpdate)
+				update.Update = imapbackend.NewUpdate(u.u.Name, mbox.name)
+				update.SeqNum = seqNum
+				updates = append(updates, update)
 			}
+		}
 
-			if err := u.initMailboxes(); err != nil {
-				log.Printf("cannot reinitialize mailboxes: %v", err)
+		// Send message updates
+		msg, err := u.db.Message(eventMessage.ID)
+		if err != nil {
+			u.log.Warn("cannot handle update event: cannot get updated message from local DB", "message", eventMessage.ID, "err", err)
+			break
+		}
+		for _, labelID := range msg.LabelIDs {
+			if _, created := createdSeqNums[labelID]; created {
+				// This message has been added to the label's mailbox
+				// No need to send a message update
+				continue
 			}
-		} else {
-			for _, eventMessage := range event.Messages {
-				switch eventMessage.Action {
-				case protonmail.EventCreate:
-					log.Println("Received create event for message", eventMessage.ID)
-					seqNums, err := u.db.CreateMessage(eventMessage.Created)
-					if err != nil {
-						log.Printf("cannot handle create event for message %s: cannot create message in local DB: %v", eventMessage.ID, err)
-						break
-					}
-
-					// TODO: what if the message was already in the local DB?
-					for labelID, seqNum := range seqNums {
-						if mbox := u.getMailboxByLabel(labelID); mbox != nil {
-							update := new(imapbackend.MailboxUpdate)
-							update.Update = imapbackend.NewUpdate(u.u.Name, mbox.name)
-							update.MailboxStatus = imap.NewMailboxStatus(mbox.name, []imap.StatusItem{imap.StatusMessages})
-							update.MailboxStatus.Messages = seqNum
-							eventUpdates = append(eventUpdates, update)
-						}
-					}
-				case protonmail.EventUpdate, protonmail.EventUpdateFlags:
-					log.Println("Received update event for message", eventMessage.ID)
-					createdSeqNums, deletedSeqNums, err := u.db.UpdateMessage(eventMessage.ID, eventMessage.Updated)
-					if err != nil {
-						log.Printf("cannot handle update event for message %s: cannot update message in local DB: %v", eventMessage.ID, err)
-						break
-					}
-
-					for labelID, seqNum := range createdSeqNums {
-						if mbox := u.getMailboxByLabel(labelID); mbox != nil {
-							update := new(imapbackend.MailboxUpdate)
-							update.Update = imapbackend.NewUpdate(u.u.Name, mbox.name)
-							update.MailboxStatus = imap.NewMailboxStatus(mbox.name, []imap.StatusItem{imap.StatusMessages})
-							update.MailboxStatus.Messages = seqNum
-							eventUpdates = append(eventUpdates, update)
-						}
-					}
-					for labelID, seqNum := range deletedSeqNums {
-						if mbox := u.getMailboxByLabel(labelID); mbox != nil {
-							update := new(imapbackend.ExpungeUpdate)
-							update.Update = imapbackend.NewUpdate(u.u.Name, mbox.name)
-							update.SeqNum = seqNum
-							eventUpdates = append(eventUpdates, update)
-						}
-					}
-
-					// Send message updates
-					msg, err := u.db.Message(eventMessage.ID)
-					if err != nil {
-						log.Printf("cannot handle update event for message %s: cannot get updated message from local DB: %v", eventMessage.ID, err)
-						break
-					}
-					for _, labelID := range msg.LabelIDs {
-						if _, created := createdSeqNums[labelID]; created {
-							// This message has been added to the label's mailbox
-							// No need to send a message update
-							continue
-						}
-
-						if mbox := u.getMailboxByLabel(labelID); mbox != nil {
-							seqNum, _, err := mbox.db.FromApiID(eventMessage.ID)
-							if err != nil {
-								log.Printf("cannot handle update event for message %s: cannot get message sequence number in %s: %v", eventMessage.ID, mbox.name, err)
-								continue
-							}
-
-							update := new(imapbackend.MessageUpdate)
-							update.Update = imapbackend.NewUpdate(u.u.Name, mbox.name)
-							update.Message = imap.NewMessage(seqNum, []imap.FetchItem{imap.FetchFlags})
-							update.Message.Flags = fetchFlags(msg)
-							eventUpdates = append(eventUpdates, update)
-						}
-					}
-				case protonmail.EventDelete:
-					log.Println("Received delete event for message", eventMessage.ID)
-					seqNums, err := u.db.DeleteMessage(eventMessage.ID)
-					if err != nil {
-						log.Printf("cannot handle delete event for message %s: cannot delete message from local DB: %v", eventMessage.ID, err)
-						break
-					}
-
-					for labelID, seqNum := range seqNums {
-						if mbox := u.getMailboxByLabel(labelID); mbox != nil {
-							update := new(imapbackend.ExpungeUpdate)
-							update.Update = imapbackend.NewUpdate(u.u.Name, mbox.name)
-							update.SeqNum = seqNum
-							eventUpdates = append(eventUpdates, update)
-						}
-					}
+
+			if mbox := u.getMailboxByLabel(labelID); mbox != nil {
+				seqNum, _, err := mbox.db.FromApiID(eventMessage.ID)
+				if err != nil {
+					u.log.Warn("cannot handle update event: cannot get message sequence number", "message", eventMessage.ID, "mailbox", mbox.name, "err", err)
+					continue
 				}
+
+				update := new(imapbackend.MessageUpdate)
+				update.Update = imapbackend.NewUpdate(u.u.Name, mbox.name)
+				update.Message = imap.NewMessage(seqNum, []imap.FetchItem{imap.FetchFlags})
+				// Keep \Deleted and \Recent, otherwise clients see them
+				// flap
+				update.Message.Flags = mbox.fetchFlags(msg)
+				updates = append(updates, update)
+			}
+		}
+	case protonmail.EventDelete:
+		u.log.Debug("received delete event", "message", eventMessage.ID)
+		if u.cache != nil {
+			u.cache.Remove(eventMessage.ID)
+		}
+		seqNums, err := u.db.DeleteMessage(eventMessage.ID)
+		if err != nil {
+			u.log.Warn("cannot handle delete event: cannot delete message from local DB", "message", eventMessage.ID, "err", err)
+			break
+		}
+
+		for labelID, seqNum := range seqNums {
+			if mbox := u.getMailboxByLabel(labelID); mbox != nil {
+				u.recent.remove(mbox, eventMessage.ID)
+
+				update := new(imapbackend.ExpungeUpdate)
+				update.Update = imapbackend.NewUpdate(u.u.Name, mbox.name)
+				update.SeqNum = seqNum
+				updates = append(updates, update)
 			}
+		}
+	}
+	return updates
+}
 
+// renewMessage removes a message from the local database and adds it back,
+// so that it gets new UIDs. Clients are notified as if it had been deleted
+// and created again.
+func (u *user) renewMessage(msg *protonmail.Message) error {
+	if _, err := u.db.Message(msg.ID); err == database.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	updates := u.messageEventUpdates(&protonmail.EventMessage{
+		ID:     msg.ID,
+		Action: protonmail.EventDelete,
+	})
+	updates = append(updates, u.messageEventUpdates(&protonmail.EventMessage{
+		ID:      msg.ID,
+		Action:  protonmail.EventCreate,
+		Created: msg,
+	})...)
+
+	u.notifyStatus(updates)
+	for _, update := range updates {
+		u.updates <- update
+	}
+	return nil
+}
+
+func (u *user) receiveEvents(updates chan<- imapbackend.Update, ch <-chan *protonmail.Event) {
+	var eventUpdates []imapbackend.Update
+	// Labels are refreshed once per event, even if many have changed
+	labelsChanged := false
+	var lastEventID string
+
+	var d events.Dispatcher
+	d.OnRefresh(func(refresh protonmail.EventRefresh) {
+		if refresh&protonmail.EventRefreshMail == 0 {
+			return
+		}
+
+		u.log.Info("reinitializing the whole IMAP database")
+
+		u.locker.Lock()
+		for _, mbox := range u.mailboxes {
+			if err := mbox.reset(); err != nil {
+				u.log.Warn("cannot reset mailbox", "mailbox", mbox.name, "err", err)
+			}
+		}
+		u.locker.Unlock()
+
+		if err := u.db.ResetMessages(); err != nil {
+			u.log.Warn("cannot reset user", "err", err)
+		}
+
+		if err := u.initMailboxes(); err != nil {
+			u.log.Warn("cannot reinitialize mailboxes", "err", err)
+		}
+	})
+	d.OnMessage(func(eventMessage *protonmail.EventMessage) {
+		eventUpdates = append(eventUpdates, u.messageEventUpdates(eventMessage)...)
+	})
+	d.OnLabel(func(eventLabel *protonmail.EventLabel) {
+		if eventLabel.Label != nil && eventLabel.Label.Type != protonmail.LabelMessage {
+			return
+		}
+
+		u.log.Debug("received label event", "label", eventLabel.ID)
+		labelsChanged = true
+	})
+
+	for event := range ch {
+		eventUpdates = nil
+		labelsChanged = false
+		d.Dispatch(event)
+		if labelsChanged {
+			if err := u.refreshLabels(); err != nil {
+				u.log.Warn("cannot handle label events: cannot refresh labels", "labels", len(event.Labels), "err", err)
+			}
+		}
+		u.setOnline()
+
+		if event.Refresh&protonmail.EventRefreshMail == 0 {
 			u.locker.Lock()
 			for _, count := range event.MessageCounts {
 				if mbox, ok := u.mailboxes[count.LabelID]; ok {
@@ -306,10 +482,19 @@ func (u *user) receiveEvents(updates chan<- imapbackend.Update, events <-chan *p
 			u.locker.Unlock()
 		}
 
+		u.notifyStatus(eventUpdates)
+
 		for _, update := range eventUpdates {
 			updates <- update
 		}
-		go func() {
+		if event.ID != lastEventID {
+			// Mailbox scans are valid as long as all events are applied
+			if err := u.db.SetEventID(event.ID); err != nil {
+				u.log.Warn("cannot save last event ID", "err", err)
+			}
+			lastEventID = event.ID
+		}
+		go func(eventUpdates []imapbackend.Update) {
 			for _, update := range eventUpdates {
 				<-update.Done()
 			}
@@ -318,6 +503,6 @@ func (u *user) receiveEvents(updates chan<- imapbackend.Update, events <-chan *p
 			case u.eventSent <- struct{}{}:
 			default:
 			}
-		}()
+		}(eventUpdates)
 	}
 }
@@ -0,0 +1,78 @@
+package imap
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestRenewMessage(t *testing.T) {
+	u := newTestUser(t, new(testAPI))
+	updates := make(chan imapbackend.Update, 10)
+	u.updates = updates
+	draft := &protonmail.Message{ID: "draft", Subject: "Hello", LabelIDs: []string{protonmail.LabelDraft}}
+	addTestMessages(t, u, draft, &protonmail.Message{ID: "other", LabelIDs: []string{protonmail.LabelDraft}})
+	mbox := u.getMailboxByLabel(protonmail.LabelDraft)
+
+	if err := u.renewMessage(&protonmail.Message{ID: "unknown", LabelIDs: []string{protonmail.LabelDraft}}); err != nil {
+		t.Errorf("renewMessage() with an unknown message = %v", err)
+	} else if n := len(updates); n != 0 {
+		t.Errorf("renewMessage() with an unknown message sent %v updates, want none", n)
+	}
+
+	updated := &protonmail.Message{ID: "draft", Subject: "Hi", LabelIDs: []string{protonmail.LabelDraft}}
+	if err := u.renewMessage(updated); err != nil {
+		t.Fatalf("renewMessage() = %v", err)
+	}
+
+	seqNum, uid, err := mbox.db.FromApiID("draft")
+	if err != nil {
+		t.Fatalf("FromApiID() = %v", err)
+	} else if seqNum != 2 || uid != 3 {
+		t.Errorf("FromApiID() = %v, %v, want 2, 3", seqNum, uid)
+	}
+	if msg, err := u.db.Message("draft"); err != nil {
+		t.Fatalf("Message() = %v", err)
+	} else if msg.Subject != "Hi" {
+		t.Errorf("Message().Subject = %q, want %q", msg.Subject, "Hi")
+	}
+
+	if n := len(updates); n != 2 {
+		t.Fatalf("renewMessage() sent %v updates, want 2", n)
+	}
+	if update, ok := (<-updates).(*imapbackend.ExpungeUpdate); !ok || update.SeqNum != 1 {
+		t.Errorf("first update = %#v, want an expunge of message 1", update)
+	}
+	if update, ok := (<-updates).(*imapbackend.MailboxUpdate); !ok || update.MailboxStatus.Messages != 2 {
+		t.Errorf("second update = %#v, want a mailbox update with 2 messages", update)
+	}
+}
+
+func TestMessageEventFlags(t *testing.T) {
+	u := newTestUser(t, new(testAPI))
+	addTestMessages(t, u, &protonmail.Message{ID: "msg1", Unread: 1, LabelIDs: []string{protonmail.LabelInbox}})
+	mbox := u.getMailboxByLabel(protonmail.LabelInbox)
+	mbox.deleted["msg1"] = struct{}{}
+
+	read := 0
+	updates := u.messageEventUpdates(&protonmail.EventMessage{
+		ID:      "msg1",
+		Action:  protonmail.EventUpdateFlags,
+		Updated: &protonmail.EventMessageUpdate{Unread: &read, LabelIDs: []string{protonmail.LabelInbox}},
+	})
+	if len(updates) != 1 {
+		t.Fatalf("messageEventUpdates() = %v updates, want 1", len(updates))
+	}
+	update, ok := updates[0].(*imapbackend.MessageUpdate)
+	if !ok {
+		t.Fatalf("messageEventUpdates() = %#v, want a message update", updates[0])
+	}
+	// Locally deleted messages keep \Deleted
+	if want := []string{imap.SeenFlag, imap.DeletedFlag}; !reflect.DeepEqual(update.Message.Flags, want) {
+		t.Errorf("message update flags = %v, want %v", update.Message.Flags, want)
+	}
+}
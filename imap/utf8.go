@@ -0,0 +1,202 @@
+package imap
+
+import (
+	"errors"
+	"unicode/utf8"
+
+	"github.com/emersion/go-imap"
+	imapmove "github.com/emersion/go-imap-move"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// UTF8=ACCEPT extension, defined in RFC 6855. Mailbox names sent by clients
+// are accepted in UTF-8 even if the extension isn't enabled. Mailbox names
+// are sent in UTF-8 instead of modified UTF-7 once the client has enabled
+// the extension.
+
+const utf8AcceptCapability = "UTF8=ACCEPT"
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeMailboxName decodes a mailbox name sent by a client, either in
+// modified UTF-7 or in UTF-8.
+func decodeMailboxName(s string) (string, error) {
+	if !isASCII(s) {
+		if !utf8.ValidString(s) {
+			return "", errors.New("mailbox name is neither UTF-7 nor UTF-8")
+		}
+		return s, nil
+	}
+	return utf7.Encoding.NewDecoder().String(s)
+}
+
+// utf8MailboxArg converts a mailbox name argument sent in UTF-8 to modified
+// UTF-7, which command parsers expect. Other arguments are left unchanged.
+func utf8MailboxArg(f interface{}) interface{} {
+	s, err := imap.ParseString(f)
+	if err != nil || isASCII(s) || !utf8.ValidString(s) {
+		return f
+	}
+	if s, err = utf7.Encoding.NewEncoder().String(s); err != nil {
+		return f
+	}
+	return s
+}
+
+func utf8Enabled(conn imapserver.Conn) bool {
+	return enabledCondStore(conn).utf8Accept
+}
+
+// formatMailboxName formats a mailbox name in a response.
+func formatMailboxName(name string, utf8Accept bool) string {
+	if utf8Accept {
+		return name
+	}
+	name, _ = utf7.Encoding.NewEncoder().String(name)
+	return name
+}
+
+// listResp is a LIST response for a single mailbox.
+type listResp struct {
+	info       *imap.MailboxInfo
+	utf8Accept bool
+}
+
+func (r *listResp) WriteTo(w *imap.Writer) error {
+	fields := []interface{}{imap.Atom("LIST")}
+	fields = append(fields, r.info.Format()...)
+	fields[len(fields)-1] = formatMailboxName(r.info.Name, r.utf8Accept)
+	return imap.NewUntaggedResp(fields).WriteTo(w)
+}
+
+// statusResp is a STATUS response.
+type statusResp struct {
+	status     *imap.MailboxStatus
+	utf8Accept bool
+}
+
+func (r *statusResp) WriteTo(w *imap.Writer) error {
+	fields := []interface{}{
+		imap.Atom("STATUS"),
+		formatMailboxName(r.status.Name, r.utf8Accept),
+		r.status.Format(),
+	}
+	return imap.NewUntaggedResp(fields).WriteTo(w)
+}
+
+// utf8Handler wraps a command to accept mailbox names in UTF-8.
+type utf8Handler struct {
+	imapserver.Handler
+
+	// mailboxArgs contains the indexes of the mailbox name arguments
+	mailboxArgs []int
+}
+
+func (h *utf8Handler) Parse(fields []interface{}) error {
+	for _, i := range h.mailboxArgs {
+		if i < len(fields) {
+			fields[i] = utf8MailboxArg(fields[i])
+		}
+	}
+	return h.Handler.Parse(fields)
+}
+
+func (h *utf8Handler) UidHandle(conn imapserver.Conn) error {
+	uidHandler, ok := h.Handler.(imapserver.UidHandler)
+	if !ok {
+		return errors.New("Command unsupported with UID")
+	}
+	return uidHandler.UidHandle(conn)
+}
+
+type statusHandler struct {
+	imapserver.Status
+}
+
+func (h *statusHandler) Handle(conn imapserver.Conn) error {
+	if !utf8Enabled(conn) {
+		return h.Status.Handle(conn)
+	}
+
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	mbox, err := ctx.User.GetMailbox(h.Mailbox)
+	if err != nil {
+		return err
+	}
+	status, err := mbox.Status(h.Items)
+	if err != nil {
+		return err
+	}
+	return conn.WriteResp(&statusResp{status: status, utf8Accept: true})
+}
+
+type utf8Extension struct {
+	move imapserver.Extension
+}
+
+func (ext *utf8Extension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{utf8AcceptCapability}
+	}
+	return nil
+}
+
+func (ext *utf8Extension) Command(name string) imapserver.HandlerFactory {
+	var newHandler func() imapserver.Handler
+	var mailboxArgs []int
+	switch name {
+	case "CREATE":
+		newHandler = func() imapserver.Handler { return &imapserver.Create{} }
+		mailboxArgs = []int{0}
+	case "DELETE":
+		newHandler = func() imapserver.Handler { return &imapserver.Delete{} }
+		mailboxArgs = []int{0}
+	case "RENAME":
+		newHandler = func() imapserver.Handler { return &imapserver.Rename{} }
+		mailboxArgs = []int{0, 1}
+	case "SUBSCRIBE":
+		newHandler = func() imapserver.Handler { return &imapserver.Subscribe{} }
+		mailboxArgs = []int{0}
+	case "UNSUBSCRIBE":
+		newHandler = func() imapserver.Handler { return &imapserver.Unsubscribe{} }
+		mailboxArgs = []int{0}
+	case "LSUB":
+		newHandler = func() imapserver.Handler {
+			h := &imapserver.List{}
+			h.Subscribed = true
+			return h
+		}
+		mailboxArgs = []int{0, 1}
+	case "STATUS":
+		newHandler = func() imapserver.Handler { return &statusHandler{} }
+		mailboxArgs = []int{0}
+	case "MOVE":
+		newHandler = ext.move.Command(name)
+		mailboxArgs = []int{1}
+	default:
+		return nil
+	}
+
+	return func() imapserver.Handler {
+		return &utf8Handler{Handler: newHandler(), mailboxArgs: mailboxArgs}
+	}
+}
+
+// NewUTF8Extension returns an IMAP server extension implementing
+// UTF8=ACCEPT. It needs to be enabled with the CONDSTORE extension, which
+// implements ENABLE.
+func NewUTF8Extension() imapserver.Extension {
+	return &utf8Extension{move: imapmove.NewExtension()}
+}
@@ -0,0 +1,117 @@
+package imap
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeMailboxName(t *testing.T) {
+	tests := []struct {
+		s, want string
+		wantErr bool
+	}{
+		{s: "INBOX", want: "INBOX"},
+		{s: "Caf&AOk-", want: "Café"},
+		{s: "Café", want: "Café"},
+		{s: "&Jjo-!", want: "☺!"},
+		{s: "Caf\xe9", wantErr: true},
+		{s: "&invalid", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := decodeMailboxName(tc.s)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("decodeMailboxName(%q) = %q, want an error", tc.s, got)
+			}
+		} else if err != nil {
+			t.Errorf("decodeMailboxName(%q) = %v", tc.s, err)
+		} else if got != tc.want {
+			t.Errorf("decodeMailboxName(%q) = %q, want %q", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestUTF8MailboxArg(t *testing.T) {
+	tests := []struct {
+		f, want interface{}
+	}{
+		{"INBOX", "INBOX"},
+		{"Café", "Caf&AOk-"},
+		{"Caf&AOk-", "Caf&AOk-"},
+		{"Caf\xe9", "Caf\xe9"},
+		{[]interface{}{"Café"}, []interface{}{"Café"}},
+	}
+	for _, tc := range tests {
+		if got := utf8MailboxArg(tc.f); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("utf8MailboxArg(%q) = %q, want %q", tc.f, got, tc.want)
+		}
+	}
+}
+
+func TestFormatMailboxName(t *testing.T) {
+	tests := []struct {
+		name       string
+		utf8Accept bool
+		want       string
+	}{
+		{"INBOX", false, "INBOX"},
+		{"Café", false, "Caf&AOk-"},
+		{"Café", true, "Café"},
+		{"a&b", false, "a&-b"},
+		{"a&b", true, "a&b"},
+	}
+	for _, tc := range tests {
+		if got := formatMailboxName(tc.name, tc.utf8Accept); got != tc.want {
+			t.Errorf("formatMailboxName(%q, %v) = %q, want %q", tc.name, tc.utf8Accept, got, tc.want)
+		}
+	}
+}
+
+func TestUTF8Accept(t *testing.T) {
+	u := newTestUser(t, new(testAPI))
+	mboxDB, err := u.db.Mailbox("custom")
+	if err != nil {
+		t.Fatalf("database.User.Mailbox() = %v", err)
+	}
+	mbox := &mailbox{
+		name:        "Café",
+		label:       "custom",
+		custom:      true,
+		u:           u,
+		db:          mboxDB,
+		initialized: true,
+		deleted:     make(map[string]struct{}),
+		total:       2,
+	}
+	u.mailboxes["custom"] = mbox
+	tc := newTestConn(t, u, NewCondStoreExtension(), NewUTF8Extension(), NewListExtension())
+
+	tests := []struct {
+		cmd  string
+		want []string
+	}{
+		{`LIST "" Caf*`, []string{`* LIST () "/" Caf&AOk-`}},
+		{`STATUS Caf&AOk- (MESSAGES)`, []string{`* STATUS Caf&AOk- (MESSAGES 2)`}},
+		{`STATUS "Café" (MESSAGES)`, []string{`* STATUS Caf&AOk- (MESSAGES 2)`}},
+		{`ENABLE UTF8=ACCEPT`, []string{`* ENABLED UTF8=ACCEPT`}},
+		// Non-ASCII names are sent as literals
+		{`LIST "" Caf*`, []string{`* LIST () "/" {5}`, `Café`}},
+		{`STATUS "Café" (MESSAGES)`, []string{`* STATUS {5}`, `Café (MESSAGES 2)`}},
+		{`STATUS Caf&AOk- (MESSAGES)`, []string{`* STATUS {5}`, `Café (MESSAGES 2)`}},
+	}
+	for _, test := range tests {
+		resp := tc.run(test.cmd)
+		if status := resp[len(resp)-1]; !strings.HasPrefix(status, "OK") {
+			t.Errorf("%v: status = %v, want OK", test.cmd, status)
+			continue
+		}
+		if resp = resp[:len(resp)-1]; !reflect.DeepEqual(resp, test.want) {
+			t.Errorf("%v: response = %q, want %q", test.cmd, resp, test.want)
+		}
+	}
+
+	if resp := tc.run(`STATUS "Caf` + "\xe9" + `" (MESSAGES)`); strings.HasPrefix(resp[len(resp)-1], "OK") {
+		t.Errorf("STATUS with an invalid name = %v, want an error", resp[len(resp)-1])
+	}
+}
@@ -0,0 +1,109 @@
+package imports
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// ReadFilters reads filters written by exports.ExportFilters.
+func ReadFilters(r io.Reader) ([]*protonmail.Filter, error) {
+	var filters []*protonmail.Filter
+	if err := json.NewDecoder(r).Decode(&filters); err != nil {
+		return nil, fmt.Errorf("cannot parse filters: %v", err)
+	}
+
+	names := make(map[string]bool)
+	for _, f := range filters {
+		if f.Name == "" {
+			return nil, errors.New("filters must have a name")
+		}
+		if names[f.Name] {
+			return nil, fmt.Errorf("duplicate filter %q", f.Name)
+		}
+		names[f.Name] = true
+	}
+	return filters, nil
+}
+
+// ImportFilters uploads filters. Existing filters with the same name are
+// updated, others are created. Filters are ordered as in the list, before
+// filters which aren't part of it. All scripts are validated before any
+// change is made.
+func ImportFilters(c *protonmail.Client, filters []*protonmail.Filter) (created, updated int, err error) {
+	for _, f := range filters {
+		issues, err := c.CheckSieve(f.Version, f.Sieve)
+		if err != nil {
+			return 0, 0, fmt.Errorf("cannot check filter %q: %v", f.Name, err)
+		}
+		if len(issues) > 0 {
+			msgs := make([]string, len(issues))
+			for i, issue := range issues {
+				msgs[i] = issue.Message
+			}
+			return 0, 0, fmt.Errorf("filter %q is invalid: %v", f.Name, strings.Join(msgs, "; "))
+		}
+	}
+
+	existing, err := c.ListFilters()
+	if err != nil {
+		return 0, 0, err
+	}
+	sort.SliceStable(existing, func(i, j int) bool {
+		return existing[i].Priority < existing[j].Priority
+	})
+	byName := make(map[string]*protonmail.Filter, len(existing))
+	for _, f := range existing {
+		byName[f.Name] = f
+	}
+
+	var order []string
+	imported := make(map[string]bool)
+	for _, f := range filters {
+		f = &protonmail.Filter{
+			Name:    f.Name,
+			Status:  f.Status,
+			Version: f.Version,
+			Sieve:   f.Sieve,
+		}
+
+		if old, ok := byName[f.Name]; ok {
+			f.ID = old.ID
+			if _, err := c.UpdateFilter(f); err != nil {
+				return created, updated, fmt.Errorf("cannot update filter %q: %v", f.Name, err)
+			}
+			if old.Status != f.Status {
+				if err := c.SetFilterStatus(f.ID, f.Status); err != nil {
+					return created, updated, fmt.Errorf("cannot update status of filter %q: %v", f.Name, err)
+				}
+			}
+			updated++
+		} else {
+			newFilter, err := c.CreateFilter(f)
+			if err != nil {
+				return created, updated, fmt.Errorf("cannot create filter %q: %v", f.Name, err)
+			}
+			f.ID = newFilter.ID
+			created++
+		}
+
+		order = append(order, f.ID)
+		imported[f.ID] = true
+	}
+
+	for _, f := range existing {
+		if !imported[f.ID] {
+			order = append(order, f.ID)
+		}
+	}
+	if err := c.OrderFilters(order); err != nil {
+		return created, updated, fmt.Errorf("cannot order filters: %v", err)
+	}
+
+	return created, updated, nil
+}
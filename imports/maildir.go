@@ -0,0 +1,67 @@
+package imports
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func isMaildir(dir string) bool {
+	fi, err := os.Stat(filepath.Join(dir, "cur"))
+	return err == nil && fi.IsDir()
+}
+
+// maildirFolder returns the folder name of a Maildir, given its path relative
+// to the import root. Maildir++ folders are named ".Folder.Subfolder".
+func maildirFolder(rel string) string {
+	if rel == "." {
+		return "Inbox"
+	}
+	rel = filepath.ToSlash(rel)
+	if strings.HasPrefix(rel, ".") && !strings.Contains(rel, "/") {
+		return strings.Replace(rel[1:], ".", "/", -1)
+	}
+	return rel
+}
+
+// maildirSeen checks whether the S flag is set in a Maildir filename.
+func maildirSeen(name string) bool {
+	i := strings.LastIndex(name, ":2,")
+	if i < 0 {
+		return false
+	}
+	return strings.Contains(name[i+len(":2,"):], "S")
+}
+
+func walkMaildir(dir, folder string, fn walkFunc) error {
+	for _, sub := range []string{"new", "cur"} {
+		files, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		for _, fi := range files {
+			if !fi.Mode().IsRegular() {
+				continue
+			}
+
+			b, err := ioutil.ReadFile(filepath.Join(dir, sub, fi.Name()))
+			if err != nil {
+				return err
+			}
+
+			err = fn(&sourceMessage{
+				folder: folder,
+				seen:   sub == "cur" && maildirSeen(fi.Name()),
+				b:      b,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package imports
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/emersion/go-message"
+)
+
+func mboxFolder(rel string) string {
+	return strings.TrimSuffix(filepath.ToSlash(rel), ".mbox")
+}
+
+// mboxSeen checks whether the Status header field of a message contains the R
+// flag.
+func mboxSeen(b []byte) bool {
+	e, err := message.Read(bytes.NewReader(b))
+	if err != nil {
+		return false
+	}
+	return strings.Contains(e.Header.Get("Status"), "R")
+}
+
+// unquoteMboxLine reverts the mboxrd quoting of lines starting with "From ".
+func unquoteMboxLine(l string) string {
+	if strings.HasPrefix(l, ">") && strings.HasPrefix(strings.TrimLeft(l, ">"), "From ") {
+		return l[1:]
+	}
+	return l
+}
+
+func walkMbox(path, folder string, fn walkFunc) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var msg bytes.Buffer
+	started := false
+	flush := func() error {
+		if !started {
+			return nil
+		}
+		// Remove the empty line separating messages
+		b := msg.Bytes()
+		if bytes.HasSuffix(b, []byte("\n\n")) {
+			b = b[:len(b)-1]
+		}
+		msg.Reset()
+
+		return fn(&sourceMessage{
+			folder: folder,
+			seen:   mboxSeen(b),
+			b:      append([]byte(nil), b...),
+		})
+	}
+
+	br := bufio.NewReader(f)
+	for {
+		l, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if l == "" && err == io.EOF {
+			break
+		}
+
+		if strings.HasPrefix(l, "From ") {
+			if err := flush(); err != nil {
+				return err
+			}
+			started = true
+		} else if started {
+			l = strings.TrimSuffix(strings.TrimSuffix(l, "\n"), "\r")
+			msg.WriteString(unquoteMboxLine(l))
+			msg.WriteString("\n")
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	return flush()
+}
@@ -0,0 +1,321 @@
+// Package imports reads messages from local mail stores and imports them to
+// ProtonMail.
+package imports
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+var systemLabels = map[string]string{
+	"inbox":   protonmail.LabelInbox,
+	"archive": protonmail.LabelArchive,
+	"drafts":  protonmail.LabelDraft,
+	"sent":    protonmail.LabelSent,
+	"starred": protonmail.LabelStarred,
+	"spam":    protonmail.LabelSpam,
+	"junk":    protonmail.LabelSpam,
+	"trash":   protonmail.LabelTrash,
+}
+
+type ImportOptions struct {
+	// The name of the label messages are imported to, unless their folder is
+	// listed in Mapping. Defaults to Inbox.
+	Label string
+	// Maps source folder names to label names.
+	Mapping map[string]string
+}
+
+// ReadMapping reads a mapping between source folders and labels. Each line
+// contains a folder name and a label name separated by "=". Empty lines and
+// lines starting with "#" are ignored.
+func ReadMapping(r io.Reader) (map[string]string, error) {
+	mapping := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(l, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid mapping line: %q", l)
+		}
+		mapping[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return mapping, scanner.Err()
+}
+
+// sourceMessage is a message read from a local mail store.
+type sourceMessage struct {
+	folder string
+	seen   bool
+	b      []byte
+}
+
+type walkFunc func(msg *sourceMessage) error
+
+type importer struct {
+	c           *protonmail.Client
+	privateKeys openpgp.EntityList
+	addrs       []*protonmail.Address
+	options     *ImportOptions
+
+	labels     map[string]string // label name → label ID
+	messageIDs map[string]struct{}
+
+	imported, skipped int
+}
+
+func (imp *importer) labelID(name string) (string, error) {
+	if id, ok := systemLabels[strings.ToLower(name)]; ok {
+		return id, nil
+	}
+
+	if imp.labels == nil {
+		labels, err := imp.c.ListLabels(protonmail.LabelMessage)
+		if err != nil {
+			return "", err
+		}
+		imp.labels = make(map[string]string, len(labels))
+		for _, label := range labels {
+			imp.labels[label.Name] = label.ID
+		}
+	}
+
+	if id, ok := imp.labels[name]; ok {
+		return id, nil
+	}
+
+	log.Printf("Creating label %q", name)
+	label, err := imp.c.CreateLabel(&protonmail.Label{
+		Name: name,
+		Type: protonmail.LabelMessage,
+	})
+	if err != nil {
+		return "", fmt.Errorf("cannot create label %q: %v", name, err)
+	}
+	imp.labels[name] = label.ID
+	return label.ID, nil
+}
+
+func (imp *importer) folderLabel(folder string) string {
+	if name, ok := imp.options.Mapping[folder]; ok {
+		return name
+	}
+	if imp.options.Label != "" {
+		return imp.options.Label
+	}
+	return "Inbox"
+}
+
+// address returns the address a message has been sent to or from, and its
+// private key.
+func (imp *importer) address(h mail.Header, sent bool) (*protonmail.Address, *openpgp.Entity, error) {
+	var fields []string
+	if sent {
+		fields = []string{"From"}
+	} else {
+		fields = []string{"Delivered-To", "To", "Cc"}
+	}
+
+	var emails []string
+	for _, k := range fields {
+		l, _ := h.AddressList(k)
+		for _, addr := range l {
+			emails = append(emails, addr.Address)
+		}
+	}
+
+	var candidates []*protonmail.Address
+	for _, email := range emails {
+		for _, addr := range imp.addrs {
+			if strings.EqualFold(addr.Email, email) {
+				candidates = append(candidates, addr)
+			}
+		}
+	}
+	// Fallback to the user's addresses, in order
+	candidates = append(candidates, imp.addrs...)
+
+	for _, addr := range candidates {
+		if addr.Send == protonmail.AddressSendDisabled || len(addr.Keys) == 0 {
+			continue
+		}
+
+		// TODO: get appropriate private key
+		encryptedPrivateKey, err := addr.Keys[0].Entity()
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot parse private key of %v: %v", addr.Email, err)
+		}
+		for _, e := range imp.privateKeys {
+			if e.PrimaryKey.KeyId == encryptedPrivateKey.PrimaryKey.KeyId {
+				return addr, e, nil
+			}
+		}
+	}
+
+	return nil, nil, errors.New("no address with a private key")
+}
+
+// isDuplicate checks whether a message with the same Message-Id has already
+// been imported.
+func (imp *importer) isDuplicate(h mail.Header) (bool, error) {
+	id := strings.Trim(strings.TrimSpace(h.Get("Message-Id")), "<>")
+	if id == "" {
+		return false, nil
+	}
+
+	if _, ok := imp.messageIDs[id]; ok {
+		return true, nil
+	}
+	imp.messageIDs[id] = struct{}{}
+
+	total, _, err := imp.c.ListMessages(&protonmail.MessageFilter{
+		ExternalID: id,
+		Limit:      1,
+	})
+	if err != nil {
+		return false, err
+	}
+	return total > 0, nil
+}
+
+func (imp *importer) importMessage(msg *sourceMessage) error {
+	e, err := message.Read(bytes.NewReader(msg.b))
+	if err != nil {
+		return err
+	}
+	h := mail.Header{Header: e.Header}
+
+	if dup, err := imp.isDuplicate(h); err != nil {
+		return err
+	} else if dup {
+		imp.skipped++
+		return nil
+	}
+
+	labelID, err := imp.labelID(imp.folderLabel(msg.folder))
+	if err != nil {
+		return err
+	}
+
+	meta := &protonmail.ImportMessageMetadata{
+		Unread:   1,
+		Type:     protonmail.MessageInbox,
+		LabelIDs: []string{labelID},
+	}
+	if msg.seen {
+		meta.Unread = 0
+	}
+	switch labelID {
+	case protonmail.LabelSent:
+		meta.Type = protonmail.MessageSent
+	case protonmail.LabelDraft:
+		meta.Type = protonmail.MessageDraft
+	case protonmail.LabelInbox, protonmail.LabelArchive, protonmail.LabelSpam, protonmail.LabelTrash, protonmail.LabelStarred:
+	default:
+		// Messages with a custom label must also be in a system folder
+		meta.LabelIDs = append(meta.LabelIDs, protonmail.LabelArchive)
+	}
+	if date, err := h.Date(); err == nil {
+		meta.Time = date.Unix()
+	}
+
+	addr, privateKey, err := imp.address(h, meta.Type == protonmail.MessageSent)
+	if err != nil {
+		return err
+	}
+	meta.AddressID = addr.ID
+
+	if _, err := imp.c.ImportMessage(meta, bytes.NewReader(msg.b), privateKey); err != nil {
+		return err
+	}
+	imp.imported++
+
+	if n := imp.imported + imp.skipped; n%100 == 0 {
+		log.Printf("Processed %v messages: %v imported, %v skipped", n, imp.imported, imp.skipped)
+	}
+	return nil
+}
+
+// walk walks path, which can be a Maildir, a mbox file or a directory
+// containing Maildirs and mbox files.
+func walk(path string, fn walkFunc) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return walkMbox(path, mboxFolder(filepath.Base(path)), fn)
+	}
+
+	return filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			if !isMaildir(p) {
+				return nil
+			}
+			if err := walkMaildir(p, maildirFolder(rel), fn); err != nil {
+				return err
+			}
+			if rel == "." {
+				// Maildir++ folders are stored in the main Maildir
+				return nil
+			}
+			return filepath.SkipDir
+		}
+
+		if filepath.Ext(p) == ".mbox" {
+			return walkMbox(p, mboxFolder(rel), fn)
+		}
+		return nil
+	})
+}
+
+// ImportMessages imports all messages from a Maildir or mbox at path. Messages
+// which have already been imported are skipped.
+func ImportMessages(c *protonmail.Client, privateKeys openpgp.EntityList, path string, options *ImportOptions) (imported, skipped int, err error) {
+	addrs, err := c.ListAddresses()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	imp := &importer{
+		c:           c,
+		privateKeys: privateKeys,
+		addrs:       addrs,
+		options:     options,
+		messageIDs:  make(map[string]struct{}),
+	}
+
+	err = walk(path, func(msg *sourceMessage) error {
+		if err := imp.importMessage(msg); err != nil {
+			return fmt.Errorf("cannot import message from %v: %v", msg.folder, err)
+		}
+		return nil
+	})
+	return imp.imported, imp.skipped, err
+}
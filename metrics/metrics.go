@@ -0,0 +1,225 @@
+// Package metrics exposes hydroxide metrics in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	APIRequests = newCounterVec("hydroxide_api_requests_total",
+		"ProtonMail API requests, by endpoint and HTTP status.", "method", "endpoint", "status")
+	APIRequestDuration = newHistogramVec("hydroxide_api_request_duration_seconds",
+		"ProtonMail API request latency, by endpoint.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}, "method", "endpoint")
+	APIRateLimited = newCounterVec("hydroxide_api_rate_limited_total",
+		"ProtonMail API responses asking to slow down.")
+	APIThrottled = newCounterVec("hydroxide_api_throttled_total",
+		"ProtonMail API requests delayed by the local rate limiter.")
+	TokenRefreshes = newCounterVec("hydroxide_token_refreshes_total",
+		"Access token refreshes.")
+	IMAPSessions = newGauge("hydroxide_imap_sessions",
+		"Active IMAP sessions.")
+	SMTPSessions = newGauge("hydroxide_smtp_sessions",
+		"Active SMTP sessions.")
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	registryLock sync.Mutex
+	registry     []metric
+)
+
+func register(m metric) {
+	registryLock.Lock()
+	registry = append(registry, m)
+	registryLock.Unlock()
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	l := make([]string, len(names))
+	for i, name := range names {
+		l[i] = fmt.Sprintf("%v=%q", name, values[i])
+	}
+	return "{" + strings.Join(l, ",") + "}"
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CounterVec is a set of counters partitioned by labels.
+type CounterVec struct {
+	name, help string
+	labels     []string
+
+	locker sync.Mutex
+	values map[string]float64
+	keys   map[string][]string
+}
+
+func newCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+		keys:   make(map[string][]string),
+	}
+	register(c)
+	return c
+}
+
+// Inc increments the counter for the provided label values.
+func (c *CounterVec) Inc(labelValues ...string) {
+	k := strings.Join(labelValues, "\x00")
+	c.locker.Lock()
+	c.values[k]++
+	c.keys[k] = labelValues
+	c.locker.Unlock()
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v counter\n", c.name, c.help, c.name)
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%v 0\n", c.name)
+	}
+	for _, k := range sortedKeys(c.keys) {
+		fmt.Fprintf(w, "%v%v %v\n", c.name, formatLabels(c.labels, c.keys[k]), c.values[k])
+	}
+}
+
+// Gauge is a value which can go up and down.
+type Gauge struct {
+	name, help string
+	value      int64
+}
+
+func newGauge(name, help string) *Gauge {
+	g := &Gauge{name: name, help: help}
+	register(g)
+	return g
+}
+
+func (g *Gauge) Inc() {
+	atomic.AddInt64(&g.value, 1)
+}
+
+func (g *Gauge) Dec() {
+	atomic.AddInt64(&g.value, -1)
+}
+
+func (g *Gauge) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v gauge\n", g.name, g.help, g.name)
+	fmt.Fprintf(w, "%v %v\n", g.name, atomic.LoadInt64(&g.value))
+}
+
+type histogram struct {
+	counts []uint64 // One per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec is a set of histograms partitioned by labels.
+type HistogramVec struct {
+	name, help string
+	buckets    []float64
+	labels     []string
+
+	locker sync.Mutex
+	values map[string]*histogram
+	keys   map[string][]string
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		labels:  labels,
+		values:  make(map[string]*histogram),
+		keys:    make(map[string][]string),
+	}
+	register(h)
+	return h
+}
+
+// Observe adds a value to the histogram for the provided label values.
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	k := strings.Join(labelValues, "\x00")
+
+	h.locker.Lock()
+	defer h.locker.Unlock()
+
+	hist, ok := h.values[k]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[k] = hist
+		h.keys[k] = labelValues
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v histogram\n", h.name, h.help, h.name)
+	names := append(append([]string(nil), h.labels...), "le")
+	for _, k := range sortedKeys(h.keys) {
+		hist := h.values[k]
+		values := append(append([]string(nil), h.keys[k]...), "")
+
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += hist.counts[i]
+			values[len(values)-1] = fmt.Sprint(le)
+			fmt.Fprintf(w, "%v_bucket%v %v\n", h.name, formatLabels(names, values), cumulative)
+		}
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(w, "%v_bucket%v %v\n", h.name, formatLabels(names, values), hist.count)
+
+		labels := formatLabels(h.labels, h.keys[k])
+		fmt.Fprintf(w, "%v_sum%v %v\n", h.name, labels, hist.sum)
+		fmt.Fprintf(w, "%v_count%v %v\n", h.name, labels, hist.count)
+	}
+}
+
+// Handler returns an HTTP handler serving all metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		registryLock.Lock()
+		defer registryLock.Unlock()
+		for _, m := range registry {
+			m.write(w)
+		}
+	})
+}
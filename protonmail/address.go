@@ -0,0 +1,71 @@
+package protonmail
+
+import (
+	"mime"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/emersion/hydroxide/charset"
+)
+
+// DisplayName returns the decoded name of an address. Names which are the
+// same as the address itself are dropped.
+func (addr *MessageAddress) DisplayName() string {
+	name := strings.TrimSpace(charset.DecodeHeader(addr.Name))
+	if strings.EqualFold(name, addr.Address) {
+		return ""
+	}
+	return name
+}
+
+// String formats the address as defined in RFC 5322. The name is quoted or
+// encoded as defined in RFC 2047 if needed.
+func (addr *MessageAddress) String() string {
+	return (&mail.Address{Name: addr.DisplayName(), Address: addr.Address}).String()
+}
+
+func isAtext(r rune) bool {
+	switch {
+	case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == ' ':
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", r)
+}
+
+// formatPhrase formats a display name.
+func formatPhrase(s string) string {
+	atext := true
+	for _, r := range s {
+		if r >= utf8.RuneSelf {
+			return mime.QEncoding.Encode("utf-8", s)
+		}
+		atext = atext && isAtext(r)
+	}
+	if atext && s != "" {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// FormatAddressList formats addresses as the value of an address header
+// field. Consecutive addresses which belong to the same contact group are
+// formatted with the group syntax.
+func FormatAddressList(l []*MessageAddress) string {
+	var parts []string
+	for i := 0; i < len(l); {
+		group := l[i].Group
+		if group == "" {
+			parts = append(parts, l[i].String())
+			i++
+			continue
+		}
+
+		var members []string
+		for ; i < len(l) && l[i].Group == group; i++ {
+			members = append(members, l[i].String())
+		}
+		parts = append(parts, formatPhrase(group)+": "+strings.Join(members, ", ")+";")
+	}
+	return strings.Join(parts, ", ")
+}
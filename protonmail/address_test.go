@@ -0,0 +1,79 @@
+package protonmail
+
+import (
+	"testing"
+)
+
+func TestMessageAddressDisplayName(t *testing.T) {
+	tests := []struct {
+		addr MessageAddress
+		want string
+	}{
+		{MessageAddress{Address: "alice@example.org", Name: "Alice"}, "Alice"},
+		{MessageAddress{Address: "alice@example.org", Name: " Alice "}, "Alice"},
+		{MessageAddress{Address: "alice@example.org", Name: "=?utf-8?q?Al=C3=AFce?="}, "Alïce"},
+		{MessageAddress{Address: "alice@example.org", Name: "Alice@Example.org"}, ""},
+		{MessageAddress{Address: "alice@example.org"}, ""},
+	}
+	for _, tc := range tests {
+		if got := tc.addr.DisplayName(); got != tc.want {
+			t.Errorf("DisplayName(%q) = %q, want %q", tc.addr.Name, got, tc.want)
+		}
+	}
+}
+
+func TestMessageAddressString(t *testing.T) {
+	tests := []struct {
+		addr MessageAddress
+		want string
+	}{
+		{MessageAddress{Address: "alice@example.org", Name: "Alice"}, `"Alice" <alice@example.org>`},
+		{MessageAddress{Address: "alice@example.org", Name: "=?utf-8?q?Al=C3=AFce?="}, "=?utf-8?q?Al=C3=AFce?= <alice@example.org>"},
+		{MessageAddress{Address: "alice@example.org", Name: "alice@example.org"}, "<alice@example.org>"},
+	}
+	for _, tc := range tests {
+		if got := tc.addr.String(); got != tc.want {
+			t.Errorf("String(%q) = %q, want %q", tc.addr.Name, got, tc.want)
+		}
+	}
+}
+
+func TestFormatPhrase(t *testing.T) {
+	tests := []struct {
+		s, want string
+	}{
+		{"Friends", "Friends"},
+		{"Close friends", "Close friends"},
+		{"Friends, family", `"Friends, family"`},
+		{`The "best"`, `"The \"best\""`},
+		{"", `""`},
+		{"Amis proches é", "=?utf-8?q?Amis_proches_=C3=A9?="},
+	}
+	for _, tc := range tests {
+		if got := formatPhrase(tc.s); got != tc.want {
+			t.Errorf("formatPhrase(%q) = %q, want %q", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestFormatAddressList(t *testing.T) {
+	alice := &MessageAddress{Address: "alice@example.org"}
+	bob := &MessageAddress{Address: "bob@example.org", Group: "Friends"}
+	carol := &MessageAddress{Address: "carol@example.org", Group: "Friends"}
+	dave := &MessageAddress{Address: "dave@example.org", Group: "Work, team"}
+	tests := []struct {
+		l    []*MessageAddress
+		want string
+	}{
+		{nil, ""},
+		{[]*MessageAddress{alice}, "<alice@example.org>"},
+		{[]*MessageAddress{alice, bob, carol}, "<alice@example.org>, Friends: <bob@example.org>, <carol@example.org>;"},
+		{[]*MessageAddress{bob, alice, carol}, "Friends: <bob@example.org>;, <alice@example.org>, Friends: <carol@example.org>;"},
+		{[]*MessageAddress{dave}, `"Work, team": <dave@example.org>;`},
+	}
+	for _, tc := range tests {
+		if got := FormatAddressList(tc.l); got != tc.want {
+			t.Errorf("FormatAddressList() = %q, want %q", got, tc.want)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package protonmail
 
 import (
+	"context"
 	"net/http"
 )
 
@@ -39,12 +40,20 @@ type Address struct {
 	DisplayName string
 	Signature   string // HTML
 	HasKeys     int
-	Keys        []*PrivateKey
+	// CatchAll is set if the address receives messages sent to unknown
+	// addresses of its domain
+	CatchAll int
+	Keys     []*PrivateKey
 }
 
 func (c *Client) ListAddresses() ([]*Address, error) {
+	return c.ListAddressesContext(context.Background())
+}
+
+// ListAddressesContext is like ListAddresses, but with a context.
+func (c *Client) ListAddressesContext(ctx context.Context) ([]*Address, error) {
 	// TODO: Page, PageSize
-	req, err := c.newRequest(http.MethodGet, "/addresses", nil)
+	req, err := c.newRequest(ctx, http.MethodGet, "/addresses", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -2,14 +2,19 @@ package protonmail
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/packet"
@@ -21,6 +26,34 @@ type AttachmentKey struct {
 	Algo string
 }
 
+// AttachmentHeaders contains the MIME header fields of an attachment, with
+// lower-case keys.
+type AttachmentHeaders map[string]string
+
+func (h *AttachmentHeaders) UnmarshalJSON(b []byte) error {
+	// Values are strings, or lists of strings for repeated fields. Empty
+	// headers may be encoded as an empty list.
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		*h = nil
+		return nil
+	}
+
+	*h = make(AttachmentHeaders, len(raw))
+	for k, v := range raw {
+		var s string
+		if err := json.Unmarshal(v, &s); err != nil {
+			var l []string
+			if err := json.Unmarshal(v, &l); err != nil || len(l) == 0 {
+				continue
+			}
+			s = l[0]
+		}
+		(*h)[strings.ToLower(k)] = s
+	}
+	return nil
+}
+
 type Attachment struct {
 	ID         string
 	MessageID  string
@@ -28,13 +61,23 @@ type Attachment struct {
 	Size       int
 	MIMEType   string
 	ContentID  string
-	KeyPackets string // encrypted with the user's key, base64-encoded
-	//Headers    map[string]string
-	Signature string
+	KeyPackets string            // encrypted with the user's key, base64-encoded
+	Headers    AttachmentHeaders `json:",omitempty"`
+	Signature  string
 
 	unencryptedKey *packet.EncryptedKey
 }
 
+// IsInline returns true if the attachment is displayed in the message body,
+// for instance an image referenced by its Content-ID in an HTML message.
+func (att *Attachment) IsInline() bool {
+	if v, ok := att.Headers["content-disposition"]; ok {
+		disp, _, err := mime.ParseMediaType(v)
+		return err == nil && strings.EqualFold(disp, "inline")
+	}
+	return false
+}
+
 // GenerateKey generates an encrypted key and encrypts it to the provided
 // recipients. Usually, the recipient is the user himself.
 //
@@ -105,10 +148,30 @@ func (att *Attachment) Read(ciphertext io.Reader, keyring openpgp.KeyRing, promp
 	}
 }
 
-// GetAttachment downloads an attachment's payload. The returned io.ReadCloser
-// may be encrypted, use Attachment.Read to decrypt it.
-func (c *Client) GetAttachment(id string) (io.ReadCloser, error) {
-	req, err := c.newRequest(http.MethodGet, "/attachments/"+id, nil)
+// ListAttachments returns the metadata of the attachments of a message. The
+// message body isn't decrypted and the attachments aren't downloaded, use
+// GetAttachment to read them one at a time.
+func (c *Client) ListAttachments(messageID string) ([]*Attachment, error) {
+	return c.ListAttachmentsContext(context.Background(), messageID)
+}
+
+// ListAttachmentsContext is like ListAttachments, but with a context.
+func (c *Client) ListAttachmentsContext(ctx context.Context, messageID string) ([]*Attachment, error) {
+	msg, err := c.GetMessageContext(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, att := range msg.Attachments {
+		if att.MessageID == "" {
+			att.MessageID = msg.ID
+		}
+	}
+	return msg.Attachments, nil
+}
+
+func (c *Client) getAttachment(ctx context.Context, id string) (io.ReadCloser, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/attachments/"+id, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -119,15 +182,113 @@ func (c *Client) GetAttachment(id string) (io.ReadCloser, error) {
 	}
 
 	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
 		return nil, fmt.Errorf("cannot get attachment %q: %v %v", id, resp.Status, resp.StatusCode)
 	}
 
 	return resp.Body, nil
 }
 
+type attachmentReader struct {
+	io.Reader
+	body io.Closer
+}
+
+func (r *attachmentReader) Close() error {
+	return r.body.Close()
+}
+
+// GetAttachment downloads an attachment's payload and decrypts it on the fly.
+// Attachments without key packets are returned as is. keyring must contain
+// the private keys of the address the message has been received with.
+// Closing the returned io.ReadCloser closes the underlying HTTP response body,
+// it must be closed even if the payload isn't read until EOF.
+func (c *Client) GetAttachment(att *Attachment, keyring openpgp.KeyRing) (io.ReadCloser, error) {
+	return c.GetAttachmentContext(context.Background(), att, keyring)
+}
+
+// GetAttachmentContext is like GetAttachment, but with a context.
+func (c *Client) GetAttachmentContext(ctx context.Context, att *Attachment, keyring openpgp.KeyRing) (io.ReadCloser, error) {
+	body, err := c.getAttachment(ctx, att.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	md, err := att.Read(body, keyring, nil)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+
+	// TODO: check signature
+	return &attachmentReader{md.UnverifiedBody, body}, nil
+}
+
+// ReadAttachment downloads an attachment's payload, decrypts it and returns it
+// in full.
+func (c *Client) ReadAttachment(att *Attachment, keyring openpgp.KeyRing) ([]byte, error) {
+	return c.ReadAttachmentContext(context.Background(), att, keyring)
+}
+
+// ReadAttachmentContext is like ReadAttachment, but with a context.
+func (c *Client) ReadAttachmentContext(ctx context.Context, att *Attachment, keyring openpgp.KeyRing) ([]byte, error) {
+	rc, err := c.GetAttachmentContext(ctx, att, keyring)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return ioutil.ReadAll(rc)
+}
+
+// ReadAttachments downloads attachments concurrently, decrypts them and returns
+// them in full, in the same order as atts. An attachment which cannot be read
+// doesn't prevent the others from being read: its error is returned in errs.
+func (c *Client) ReadAttachments(atts []*Attachment, keyring openpgp.KeyRing) (bodies [][]byte, errs []error) {
+	return c.ReadAttachmentsContext(context.Background(), atts, keyring)
+}
+
+// ReadAttachmentsContext is like ReadAttachments, but with a context. Once ctx
+// is done, downloads in progress are aborted and the remaining attachments
+// aren't downloaded.
+func (c *Client) ReadAttachmentsContext(ctx context.Context, atts []*Attachment, keyring openpgp.KeyRing) (bodies [][]byte, errs []error) {
+	n := c.AttachmentParallelism
+	if n <= 0 {
+		n = DefaultAttachmentParallelism
+	}
+
+	bodies = make([][]byte, len(atts))
+	errs = make([]error, len(atts))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, n)
+	for i, att := range atts {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+			continue
+		}
+		wg.Add(1)
+		go func(i int, att *Attachment) {
+			defer wg.Done()
+			bodies[i], errs[i] = c.ReadAttachmentContext(ctx, att, keyring)
+			<-sem
+		}(i, att)
+	}
+	wg.Wait()
+
+	return bodies, errs
+}
+
 // CreateAttachment uploads a new attachment. r must be an PGP data packet
 // encrypted with att.KeyPackets.
 func (c *Client) CreateAttachment(att *Attachment, r io.Reader) (created *Attachment, err error) {
+	return c.CreateAttachmentContext(context.Background(), att, r)
+}
+
+// CreateAttachmentContext is like CreateAttachment, but with a context.
+func (c *Client) CreateAttachmentContext(ctx context.Context, att *Attachment, r io.Reader) (created *Attachment, err error) {
 	pr, pw := io.Pipe()
 	mw := multipart.NewWriter(pw)
 
@@ -178,7 +339,7 @@ func (c *Client) CreateAttachment(att *Attachment, r io.Reader) (created *Attach
 		pw.CloseWithError(mw.Close())
 	}()
 
-	req, err := c.newRequest(http.MethodPost, "/attachments", pr)
+	req, err := c.newRequest(ctx, http.MethodPost, "/attachments", pr)
 	if err != nil {
 		return nil, err
 	}
@@ -195,3 +356,17 @@ func (c *Client) CreateAttachment(att *Attachment, r io.Reader) (created *Attach
 
 	return respData.Attachment, nil
 }
+
+func (c *Client) DeleteAttachment(id string) error {
+	return c.DeleteAttachmentContext(context.Background(), id)
+}
+
+// DeleteAttachmentContext is like DeleteAttachment, but with a context.
+func (c *Client) DeleteAttachmentContext(ctx context.Context, id string) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, "/attachments/"+id, nil)
+	if err != nil {
+		return err
+	}
+
+	return c.doJSON(req, nil)
+}
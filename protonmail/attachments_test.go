@@ -0,0 +1,417 @@
+package protonmail
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestGetAttachment(t *testing.T) {
+	e := newTestEntity(t)
+	other := newTestEntity(t)
+
+	encrypted := &Attachment{ID: "encrypted", Name: "hello.txt"}
+	if _, err := encrypted.GenerateKey([]*openpgp.Entity{e}); err != nil {
+		t.Fatalf("GenerateKey() = %v", err)
+	}
+	var ciphertext bytes.Buffer
+	w, err := encrypted.Encrypt(&ciphertext, nil)
+	if err != nil {
+		t.Fatalf("Encrypt() = %v", err)
+	}
+	w.Write([]byte("Hello"))
+	w.Close()
+
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/attachments/encrypted":
+			w.Write(ciphertext.Bytes())
+		case "/attachments/plaintext":
+			w.Write([]byte("Hi"))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	tests := []struct {
+		name    string
+		att     *Attachment
+		keyRing openpgp.EntityList
+		want    string
+		wantErr bool
+	}{
+		{name: "encrypted", att: encrypted, keyRing: openpgp.EntityList{e}, want: "Hello"},
+		{name: "plaintext", att: &Attachment{ID: "plaintext"}, want: "Hi"},
+		{name: "wrong key", att: encrypted, keyRing: openpgp.EntityList{other}, wantErr: true},
+		{name: "not found", att: &Attachment{ID: "unknown"}, wantErr: true},
+	}
+	for _, tc := range tests {
+		b, err := c.ReadAttachment(tc.att, tc.keyRing)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%v: ReadAttachment() = nil, want an error", tc.name)
+			}
+		} else if err != nil {
+			t.Errorf("%v: ReadAttachment() = %v", tc.name, err)
+		} else if string(b) != tc.want {
+			t.Errorf("%v: ReadAttachment() = %q, want %q", tc.name, b, tc.want)
+		}
+	}
+}
+
+func TestReadAttachments(t *testing.T) {
+	tests := []struct {
+		name        string
+		parallelism int
+		n           int
+		wantMax     int
+	}{
+		{name: "sequential", parallelism: 1, n: 4, wantMax: 1},
+		{name: "parallel", parallelism: 2, n: 6, wantMax: 2},
+		{name: "default", n: 10, wantMax: DefaultAttachmentParallelism},
+		{name: "none", n: 0},
+	}
+	for _, tc := range tests {
+		var locker sync.Mutex
+		var active, max int
+		c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			locker.Lock()
+			active++
+			if active > max {
+				max = active
+			}
+			locker.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			locker.Lock()
+			active--
+			locker.Unlock()
+
+			id := strings.TrimPrefix(r.URL.Path, "/attachments/")
+			if id == "att1" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte("body of " + id))
+		})
+		c.AttachmentParallelism = tc.parallelism
+
+		atts := make([]*Attachment, tc.n)
+		for i := range atts {
+			atts[i] = &Attachment{ID: fmt.Sprintf("att%v", i)}
+		}
+		bodies, errs := c.ReadAttachments(atts, nil)
+		if len(bodies) != tc.n || len(errs) != tc.n {
+			t.Errorf("%v: ReadAttachments() returned %v bodies and %v errors, want %v", tc.name, len(bodies), len(errs), tc.n)
+			continue
+		}
+		for i, att := range atts {
+			if i == 1 {
+				if errs[i] == nil {
+					t.Errorf("%v: ReadAttachments() didn't return an error for %v", tc.name, att.ID)
+				}
+				continue
+			}
+			if errs[i] != nil {
+				t.Errorf("%v: ReadAttachments() returned an error for %v: %v", tc.name, att.ID, errs[i])
+			} else if want := "body of " + att.ID; string(bodies[i]) != want {
+				t.Errorf("%v: ReadAttachments() returned %q for %v, want %q", tc.name, bodies[i], att.ID, want)
+			}
+		}
+		if max != tc.wantMax {
+			t.Errorf("%v: %v concurrent downloads, want %v", tc.name, max, tc.wantMax)
+		}
+	}
+}
+
+func TestReadAttachmentsCanceled(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello"))
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	atts := []*Attachment{{ID: "att0"}, {ID: "att1"}}
+	_, errs := c.ReadAttachmentsContext(ctx, atts, nil)
+	for i, err := range errs {
+		if err == nil {
+			t.Errorf("ReadAttachmentsContext() with a canceled context read %v", atts[i].ID)
+		}
+	}
+}
+
+func TestAttachmentHeaders(t *testing.T) {
+	tests := []struct {
+		json string
+		want AttachmentHeaders
+	}{
+		{`{"Content-Disposition":"inline"}`, AttachmentHeaders{"content-disposition": "inline"}},
+		{`{"X-List":["a","b"],"content-id":"<id>"}`, AttachmentHeaders{"x-list": "a", "content-id": "<id>"}},
+		{`{"X-Empty":[],"X-Number":1}`, AttachmentHeaders{}},
+		{`[]`, nil},
+		{`null`, AttachmentHeaders{}},
+	}
+	for _, tc := range tests {
+		var att Attachment
+		if err := json.Unmarshal([]byte(`{"Headers":`+tc.json+`}`), &att); err != nil {
+			t.Errorf("json.Unmarshal(%v) = %v", tc.json, err)
+		} else if !reflect.DeepEqual(att.Headers, tc.want) {
+			t.Errorf("json.Unmarshal(%v) = %v, want %v", tc.json, att.Headers, tc.want)
+		}
+	}
+}
+
+func TestAttachmentIsInline(t *testing.T) {
+	tests := []struct {
+		headers AttachmentHeaders
+		want    bool
+	}{
+		{AttachmentHeaders{"content-disposition": "inline"}, true},
+		{AttachmentHeaders{"content-disposition": `INLINE; filename="a.png"`}, true},
+		{AttachmentHeaders{"content-disposition": "attachment"}, false},
+		{AttachmentHeaders{"content-disposition": "inline; invalid"}, false},
+		{AttachmentHeaders{"content-id": "<id>"}, false},
+		{nil, false},
+	}
+	for _, tc := range tests {
+		att := &Attachment{Headers: tc.headers}
+		if got := att.IsInline(); got != tc.want {
+			t.Errorf("IsInline() with headers %v = %v, want %v", tc.headers, got, tc.want)
+		}
+	}
+}
+
+func TestDeleteAttachment(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte(`{"Code":2001,"Error":"Method not allowed"}`))
+		} else if r.URL.Path == "/attachments/att" {
+			w.Write([]byte(`{"Code":1000}`))
+		} else {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"Code":2501,"Error":"Attachment does not exist"}`))
+		}
+	})
+
+	tests := []struct {
+		id      string
+		wantErr bool
+	}{
+		{"att", false},
+		{"unknown", true},
+	}
+	for _, tc := range tests {
+		err := c.DeleteAttachment(tc.id)
+		if tc.wantErr && err == nil {
+			t.Errorf("DeleteAttachment(%q) = nil, want an error", tc.id)
+		} else if !tc.wantErr && err != nil {
+			t.Errorf("DeleteAttachment(%q) = %v", tc.id, err)
+		}
+	}
+}
+
+func TestListAttachments(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/messages/msg":
+			w.Write([]byte(`{"Code":1000,"Message":{"ID":"msg","Attachments":[` +
+				`{"ID":"att1","Name":"a.txt","Size":3,"MIMEType":"text/plain"},` +
+				`{"ID":"att2","MessageID":"other","Name":"b.png","Size":42,"MIMEType":"image/png","ContentID":"<b>"}]}}`))
+		case "/messages/empty":
+			w.Write([]byte(`{"Code":1000,"Message":{"ID":"empty"}}`))
+		default:
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"Code":15052,"Error":"Message does not exist"}`))
+		}
+	})
+
+	tests := []struct {
+		messageID string
+		want      []*Attachment
+		wantErr   bool
+	}{
+		{
+			messageID: "msg",
+			want: []*Attachment{
+				{ID: "att1", MessageID: "msg", Name: "a.txt", Size: 3, MIMEType: "text/plain"},
+				{ID: "att2", MessageID: "other", Name: "b.png", Size: 42, MIMEType: "image/png", ContentID: "<b>"},
+			},
+		},
+		{messageID: "empty"},
+		{messageID: "unknown", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := c.ListAttachments(tc.messageID)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("ListAttachments(%q) = %v, want an error", tc.messageID, got)
+			}
+		} else if err != nil {
+			t.Errorf("ListAttachments(%q) = %v", tc.messageID, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ListAttachments(%q) = %v, want %v", tc.messageID, got, tc.want)
+		}
+	}
+}
+
+func BenchmarkReadAttachments(b *testing.B) {
+	const latency = 10 * time.Millisecond
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(latency)
+		w.Write(bytes.Repeat([]byte("a"), 64*1024))
+	}))
+	defer srv.Close()
+
+	var atts []*Attachment
+	for i := 0; i < 8; i++ {
+		atts = append(atts, &Attachment{ID: fmt.Sprintf("att%v", i)})
+	}
+
+	benchmarks := []struct {
+		name        string
+		parallelism int
+	}{
+		{"serial", 1},
+		{"default", 0},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			c := &Client{RootURL: srv.URL, HTTPClient: srv.Client(), AttachmentParallelism: bm.parallelism}
+			for i := 0; i < b.N; i++ {
+				_, errs := c.ReadAttachments(atts, nil)
+				for _, err := range errs {
+					if err != nil {
+						b.Fatalf("ReadAttachments() = %v", err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// closeRecorder records whether response bodies are closed.
+type closeRecorder struct {
+	http.RoundTripper
+
+	locker sync.Mutex
+	closed []bool
+}
+
+type recordedBody struct {
+	io.ReadCloser
+	rec *closeRecorder
+	i   int
+}
+
+func (b *recordedBody) Close() error {
+	b.rec.locker.Lock()
+	b.rec.closed[b.i] = true
+	b.rec.locker.Unlock()
+	return b.ReadCloser.Close()
+}
+
+func (rec *closeRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rec.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	rec.locker.Lock()
+	resp.Body = &recordedBody{resp.Body, rec, len(rec.closed)}
+	rec.closed = append(rec.closed, false)
+	rec.locker.Unlock()
+	return resp, nil
+}
+
+func TestGetAttachmentStreaming(t *testing.T) {
+	const size = 4 << 20
+	payload := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+
+	e := newTestEntity(t)
+	att := &Attachment{ID: "att", Name: "big.bin"}
+	if _, err := att.GenerateKey([]*openpgp.Entity{e}); err != nil {
+		t.Fatalf("GenerateKey() = %v", err)
+	}
+	var ciphertext bytes.Buffer
+	w, err := att.Encrypt(&ciphertext, nil)
+	if err != nil {
+		t.Fatalf("Encrypt() = %v", err)
+	}
+	w.Write(payload)
+	w.Close()
+
+	// The second half of the payload is only sent once the client has read
+	// the first part of the attachment: it must be decrypted on the fly
+	resume := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		half := ciphertext.Len() / 2
+		w.Write(ciphertext.Bytes()[:half])
+		w.(http.Flusher).Flush()
+		select {
+		case <-resume:
+		case <-time.After(10 * time.Second):
+			return
+		}
+		w.Write(ciphertext.Bytes()[half:])
+	}))
+	defer srv.Close()
+
+	rec := &closeRecorder{RoundTripper: srv.Client().Transport}
+	c := &Client{RootURL: srv.URL, HTTPClient: &http.Client{Transport: rec}, MaxRetries: -1}
+
+	rc, err := c.GetAttachment(att, openpgp.EntityList{e})
+	if err != nil {
+		t.Fatalf("GetAttachment() = %v", err)
+	}
+	first := make([]byte, size/4)
+	if _, err := io.ReadFull(rc, first); err != nil {
+		t.Fatalf("cannot read the first part of the attachment: %v", err)
+	} else if !bytes.Equal(first, payload[:len(first)]) {
+		t.Errorf("the first part of the attachment doesn't match the payload")
+	}
+	close(resume)
+
+	rest, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("cannot read the rest of the attachment: %v", err)
+	} else if !bytes.Equal(rest, payload[len(first):]) {
+		t.Errorf("the rest of the attachment doesn't match the payload")
+	}
+
+	// Closing before EOF closes the HTTP body and stops the decryption
+	rc2, err := c.GetAttachment(att, openpgp.EntityList{e})
+	if err != nil {
+		t.Fatalf("GetAttachment() = %v", err)
+	}
+	if _, err := io.ReadFull(rc2, first[:1024]); err != nil {
+		t.Fatalf("cannot read the attachment: %v", err)
+	}
+	if err := rc2.Close(); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+	if _, err := ioutil.ReadAll(rc2); err == nil {
+		t.Errorf("reading a closed attachment = nil, want an error")
+	}
+
+	rc.Close()
+	rec.locker.Lock()
+	defer rec.locker.Unlock()
+	if !reflect.DeepEqual(rec.closed, []bool{true, true}) {
+		t.Errorf("closed response bodies = %v, want %v", rec.closed, []bool{true, true})
+	}
+}
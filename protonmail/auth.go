@@ -1,10 +1,12 @@
 package protonmail
 
 import (
+	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strings"
 	"time"
@@ -20,8 +22,17 @@ type authInfoReq struct {
 	Username     string
 }
 
+// TwoFactorMethod is a bitmask of the two-factor authentication methods
+// enabled for an account.
+type TwoFactorMethod int
+
+const (
+	TwoFactorTOTP TwoFactorMethod = 1 << iota
+	TwoFactorU2F
+)
+
 type AuthInfo struct {
-	TwoFactor       int
+	TwoFactor       TwoFactorMethod
 	version         int
 	modulus         string
 	serverEphemeral string
@@ -50,13 +61,18 @@ func (resp *AuthInfoResp) authInfo() *AuthInfo {
 }
 
 func (c *Client) AuthInfo(username string) (*AuthInfo, error) {
+	return c.AuthInfoContext(context.Background(), username)
+}
+
+// AuthInfoContext is like AuthInfo, but with a context.
+func (c *Client) AuthInfoContext(ctx context.Context, username string) (*AuthInfo, error) {
 	reqData := &authInfoReq{
 		ClientID:     c.ClientID,
 		ClientSecret: c.ClientSecret,
 		Username:     username,
 	}
 
-	req, err := c.newJSONRequest(http.MethodPost, "/auth/info", reqData)
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/auth/info", reqData)
 	if err != nil {
 		return nil, err
 	}
@@ -66,6 +82,7 @@ func (c *Client) AuthInfo(username string) (*AuthInfo, error) {
 		return nil, err
 	}
 
+	c.authStage("auth info fetched")
 	return respData.authInfo(), nil
 }
 
@@ -93,6 +110,9 @@ type Auth struct {
 	RefreshToken string
 	EventID      string
 	PasswordMode PasswordMode
+	// Only populated if a U2F security key needs to sign the challenge, see
+	// Client.AuthU2F
+	U2F *U2FChallenge `json:",omitempty"`
 
 	accessToken string
 	privateKey  string
@@ -120,32 +140,55 @@ func (resp *authResp) auth() *Auth {
 }
 
 func (c *Client) Auth(username, password, twoFactorCode string, info *AuthInfo) (*Auth, error) {
+	return c.AuthContext(context.Background(), username, password, twoFactorCode, info)
+}
+
+// AuthContext is like Auth, but with a context.
+func (c *Client) AuthContext(ctx context.Context, username, password, twoFactorCode string, info *AuthInfo) (*Auth, error) {
 	if info == nil {
 		var err error
-		if info, err = c.AuthInfo(username); err != nil {
+		if info, err = c.AuthInfoContext(ctx, username); err != nil {
 			return nil, err
 		}
 	}
 
-	proofs, err := srp([]byte(password), info)
+	if info.TwoFactor&TwoFactorTOTP != 0 && twoFactorCode == "" {
+		return nil, ErrTwoFactorRequired
+	}
+
+	modulusKey := c.ModulusKey
+	if modulusKey == "" {
+		modulusKey = defaultModulusKey
+	}
+	modulus, err := DecodeModulusWithKey(info.modulus, modulusKey)
 	if err != nil {
 		return nil, err
 	}
+	c.authStage("SRP modulus verified")
+
+	proofs, err := srp([]byte(password), info, modulus)
+	if err != nil {
+		return nil, fmt.Errorf("cannot compute SRP proof: %v", err)
+	}
+	c.authStage("SRP proof computed")
 
 	reqData := &authReq{
 		ClientID:        c.ClientID,
 		ClientSecret:    c.ClientSecret,
 		Username:        username,
 		SRPSession:      info.srpSession,
-		ClientEphemeral: base64.StdEncoding.EncodeToString(proofs.clientEphemeral),
-		ClientProof:     base64.StdEncoding.EncodeToString(proofs.clientProof),
+		ClientEphemeral: base64.StdEncoding.EncodeToString(proofs.ClientEphemeral),
+		ClientProof:     base64.StdEncoding.EncodeToString(proofs.ClientProof),
 		TwoFactorCode:   twoFactorCode,
 	}
 
-	req, err := c.newJSONRequest(http.MethodPost, "/auth", reqData)
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/auth", reqData)
 	if err != nil {
 		return nil, err
 	}
+	if c.HumanVerification != nil {
+		c.HumanVerification.setHeaders(req)
+	}
 
 	var respData authResp
 	if err := c.doJSON(req, &respData); err != nil {
@@ -153,12 +196,92 @@ func (c *Client) Auth(username, password, twoFactorCode string, info *AuthInfo)
 	}
 
 	if err := proofs.VerifyServerProof(respData.ServerProof); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("cannot verify server proof: %v", err)
+	}
+	c.authStage("server proof verified")
+	if twoFactorCode != "" {
+		c.authStage("two-factor code accepted")
 	}
 
 	return respData.auth(), nil
 }
 
+// AuthTOTP is like Auth, but computes the two-factor code from a base32-encoded
+// TOTP secret. If the code is rejected, the codes of the adjacent time windows
+// are tried to handle clock skew.
+func (c *Client) AuthTOTP(username, password, totpSecret string, info *AuthInfo) (*Auth, error) {
+	return c.AuthTOTPContext(context.Background(), username, password, totpSecret, info)
+}
+
+// AuthTOTPContext is like AuthTOTP, but with a context.
+func (c *Client) AuthTOTPContext(ctx context.Context, username, password, totpSecret string, info *AuthInfo) (*Auth, error) {
+	now := time.Now()
+	var err error
+	for i, offset := range []time.Duration{0, -totpPeriod, totpPeriod} {
+		// Each SRP session can only be used once
+		if info == nil || i > 0 {
+			if info, err = c.AuthInfoContext(ctx, username); err != nil {
+				return nil, err
+			}
+		}
+
+		var code string
+		code, err = GenerateTOTP(totpSecret, now.Add(offset))
+		if err != nil {
+			return nil, err
+		}
+
+		var auth *Auth
+		auth, err = c.AuthContext(ctx, username, password, code, info)
+		// Only a rejected code may be caused by clock skew, other errors
+		// would be returned again with each new SRP session
+		if errors.Is(err, ErrInvalidTwoFactorCode) {
+			continue
+		}
+		return auth, err
+	}
+	return nil, err
+}
+
+type U2FRegisteredKey struct {
+	Version   string
+	KeyHandle string
+}
+
+type U2FChallenge struct {
+	Challenge      string
+	RegisteredKeys []*U2FRegisteredKey
+}
+
+// AuthU2F completes a U2F two-factor authentication. session is the UID of the
+// Auth returned by Client.Auth and assertion is the JSON-encoded response of
+// the security key to Auth.U2F.
+func (c *Client) AuthU2F(session string, assertion []byte) error {
+	return c.AuthU2FContext(context.Background(), session, assertion)
+}
+
+// AuthU2FContext is like AuthU2F, but with a context.
+func (c *Client) AuthU2FContext(ctx context.Context, session string, assertion []byte) error {
+	if !json.Valid(assertion) {
+		return errors.New("invalid U2F assertion: not JSON")
+	}
+
+	reqData := struct {
+		U2F json.RawMessage
+	}{assertion}
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/auth/2fa", &reqData)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Pm-Uid", session)
+
+	if err := c.doJSON(req, nil); err != nil {
+		return err
+	}
+	c.authStage("U2F assertion accepted")
+	return nil
+}
+
 type authRefreshReq struct {
 	ClientID     string
 	UID          string `json:"Uid"`
@@ -172,13 +295,18 @@ type authRefreshReq struct {
 }
 
 func (c *Client) AuthRefresh(expiredAuth *Auth) (*Auth, error) {
+	return c.AuthRefreshContext(context.Background(), expiredAuth)
+}
+
+// AuthRefreshContext is like AuthRefresh, but with a context.
+func (c *Client) AuthRefreshContext(ctx context.Context, expiredAuth *Auth) (*Auth, error) {
 	reqData := &authRefreshReq{
 		ClientID:     c.ClientID,
 		UID:          expiredAuth.UID,
 		RefreshToken: expiredAuth.RefreshToken,
 	}
 
-	req, err := c.newJSONRequest(http.MethodPost, "/auth/refresh", reqData)
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/auth/refresh", reqData)
 	if err != nil {
 		return nil, err
 	}
@@ -194,6 +322,52 @@ func (c *Client) AuthRefresh(expiredAuth *Auth) (*Auth, error) {
 	return auth, nil
 }
 
+// RefreshAuth refreshes an expired auth and sets the client's access token to
+// the new one. Contrary to AuthRefresh, the client must already be unlocked.
+func (c *Client) RefreshAuth(expiredAuth *Auth) (*Auth, error) {
+	return c.RefreshAuthContext(context.Background(), expiredAuth)
+}
+
+// RefreshAuthContext is like RefreshAuth, but with a context.
+func (c *Client) RefreshAuthContext(ctx context.Context, expiredAuth *Auth) (*Auth, error) {
+	if c.keyRing == nil {
+		return nil, errors.New("cannot refresh auth: client is locked")
+	}
+
+	auth, err := c.AuthRefreshContext(ctx, expiredAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, err := decryptAccessToken(auth.accessToken, c.keyRing)
+	if err != nil {
+		return nil, err
+	}
+
+	c.uid = auth.UID
+	c.accessToken = accessToken
+	return auth, nil
+}
+
+func decryptAccessToken(accessToken string, keyRing openpgp.KeyRing) (string, error) {
+	block, err := armor.Decode(strings.NewReader(accessToken))
+	if err != nil {
+		return "", err
+	}
+
+	msg, err := openpgp.ReadMessage(block.Body, keyRing, nil, nil)
+	if err != nil {
+		return "", err
+	}
+
+	// TODO: maybe check signature
+	b, err := ioutil.ReadAll(msg.UnverifiedBody)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
 func unlockKey(e *openpgp.Entity, passphraseBytes []byte) error {
 	var privateKeys []*packet.PrivateKey
 
@@ -218,17 +392,30 @@ func unlockKey(e *openpgp.Entity, passphraseBytes []byte) error {
 	return nil
 }
 
+// ErrInvalidPassphrase is returned by Unlock when the account keys cannot be
+// decrypted with the provided passphrase.
+var ErrInvalidPassphrase = errors.New("invalid key passphrase")
+
+// ErrInvalidMailboxPassword is returned by UnlockWithMailboxPassword when the
+// account keys cannot be decrypted with the mailbox password.
+var ErrInvalidMailboxPassword = errors.New("invalid mailbox password")
+
 func (c *Client) Unlock(auth *Auth, passphrase string) (openpgp.EntityList, error) {
+	return c.UnlockContext(context.Background(), auth, passphrase)
+}
+
+// UnlockContext is like Unlock, but with a context.
+func (c *Client) UnlockContext(ctx context.Context, auth *Auth, passphrase string) (openpgp.EntityList, error) {
 	passphraseBytes := []byte(passphrase)
 	if auth.keySalt != "" {
 		keySalt, err := base64.StdEncoding.DecodeString(auth.keySalt)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("cannot decode key salt: %v", err)
 		}
 
 		passphraseBytes, err = computeKeyPassword(passphraseBytes, keySalt)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("cannot compute key password: %v", err)
 		}
 	}
 
@@ -236,7 +423,7 @@ func (c *Client) Unlock(auth *Auth, passphrase string) (openpgp.EntityList, erro
 
 	keyRing, err := openpgp.ReadArmoredKeyRing(strings.NewReader(auth.privateKey))
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("cannot read auth key ring: %v", err)
 	}
 	if len(keyRing) == 0 {
 		return nil, errors.New("auth key ring is empty")
@@ -244,34 +431,25 @@ func (c *Client) Unlock(auth *Auth, passphrase string) (openpgp.EntityList, erro
 
 	for _, e := range keyRing {
 		if err := unlockKey(e, passphraseBytes); err != nil {
-			return nil, err
+			return nil, ErrInvalidPassphrase
 		}
 	}
 
-	// Decrypt access token
-
-	block, err := armor.Decode(strings.NewReader(auth.accessToken))
-	if err != nil {
-		return nil, err
-	}
+	c.authStage("key ring decrypted")
 
-	msg, err := openpgp.ReadMessage(block.Body, keyRing, nil, nil)
+	accessToken, err := decryptAccessToken(auth.accessToken, keyRing)
 	if err != nil {
-		return nil, err
-	}
-
-	// TODO: maybe check signature
-	accessTokenBytes, err := ioutil.ReadAll(msg.UnverifiedBody)
-	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("cannot decrypt access token: %v", err)
 	}
+	c.authStage("access token decrypted")
 
 	c.uid = auth.UID
-	c.accessToken = string(accessTokenBytes)
+	c.accessToken = accessToken
 	c.keyRing = keyRing
+	c.keyPassphrase = passphraseBytes
 
 	// Unlock additional private keys
-	addrs, err := c.ListAddresses()
+	addrs, err := c.ListAddressesContext(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -280,7 +458,7 @@ func (c *Client) Unlock(auth *Auth, passphrase string) (openpgp.EntityList, erro
 		for _, key := range addr.Keys {
 			entity, err := key.Entity()
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("cannot read address key: %v", err)
 			}
 
 			found := false
@@ -295,7 +473,7 @@ func (c *Client) Unlock(auth *Auth, passphrase string) (openpgp.EntityList, erro
 			}
 
 			if err := unlockKey(entity, passphraseBytes); err != nil {
-				log.Printf("warning: failed to unlock key %v: %v", entity.PrimaryKey.KeyIdString(), err)
+				c.logger().Warn("failed to unlock key", "key", entity.PrimaryKey.KeyIdString(), "err", err)
 				continue
 			}
 
@@ -306,8 +484,37 @@ func (c *Client) Unlock(auth *Auth, passphrase string) (openpgp.EntityList, erro
 	return keyRing, nil
 }
 
+// UnlockWithMailboxPassword is like Unlock, but picks the password used to
+// decrypt keys depending on the account's password mode: the login password in
+// single-password mode and the mailbox password in two-password mode.
+func (c *Client) UnlockWithMailboxPassword(auth *Auth, loginPassword, mailboxPassword []byte) (openpgp.EntityList, error) {
+	return c.UnlockWithMailboxPasswordContext(context.Background(), auth, loginPassword, mailboxPassword)
+}
+
+// UnlockWithMailboxPasswordContext is like UnlockWithMailboxPassword, but with a context.
+func (c *Client) UnlockWithMailboxPasswordContext(ctx context.Context, auth *Auth, loginPassword, mailboxPassword []byte) (openpgp.EntityList, error) {
+	passphrase := loginPassword
+	if auth.PasswordMode == PasswordTwo {
+		if len(mailboxPassword) == 0 {
+			return nil, errors.New("a mailbox password is required in two-password mode")
+		}
+		passphrase = mailboxPassword
+	}
+
+	keyRing, err := c.UnlockContext(ctx, auth, string(passphrase))
+	if err == ErrInvalidPassphrase && auth.PasswordMode == PasswordTwo {
+		err = ErrInvalidMailboxPassword
+	}
+	return keyRing, err
+}
+
 func (c *Client) Logout() error {
-	req, err := c.newRequest(http.MethodDelete, "/auth", nil)
+	return c.LogoutContext(context.Background())
+}
+
+// LogoutContext is like Logout, but with a context.
+func (c *Client) LogoutContext(ctx context.Context) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, "/auth", nil)
 	if err != nil {
 		return err
 	}
@@ -319,5 +526,6 @@ func (c *Client) Logout() error {
 	c.uid = ""
 	c.accessToken = ""
 	c.keyRing = nil
+	c.keyPassphrase = nil
 	return nil
 }
@@ -0,0 +1,169 @@
+package protonmail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// newTestAuth returns an auth whose private key is e, encrypted with
+// passphrase.
+func newTestAuth(t *testing.T, e *openpgp.Entity, passphrase string, mode PasswordMode) *Auth {
+	var b bytes.Buffer
+	aw, err := armor.Encode(&b, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := serializeEncryptedEntity(aw, e, []byte(passphrase), nil); err != nil {
+		t.Fatalf("serializeEncryptedEntity() = %v", err)
+	}
+	aw.Close()
+
+	return &Auth{
+		UID:          "uid",
+		PasswordMode: mode,
+		accessToken:  encryptArmored(t, e, "token"),
+		privateKey:   b.String(),
+	}
+}
+
+func TestUnlockWithMailboxPassword(t *testing.T) {
+	e := newTestEntity(t)
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Code":1000,"Addresses":[]}`))
+	})
+
+	single := newTestAuth(t, e, "login", PasswordSingle)
+	two := newTestAuth(t, e, "mailbox", PasswordTwo)
+	tests := []struct {
+		name           string
+		auth           *Auth
+		login, mailbox string
+		wantErr        error
+		wantOtherErr   bool
+	}{
+		{name: "single", auth: single, login: "login"},
+		{name: "single ignores mailbox password", auth: single, login: "login", mailbox: "mailbox"},
+		{name: "single wrong password", auth: single, login: "mailbox", mailbox: "login", wantErr: ErrInvalidPassphrase},
+		{name: "two", auth: two, login: "login", mailbox: "mailbox"},
+		{name: "two wrong mailbox password", auth: two, login: "mailbox", mailbox: "login", wantErr: ErrInvalidMailboxPassword},
+		{name: "two missing mailbox password", auth: two, login: "mailbox", wantOtherErr: true},
+	}
+	for _, tc := range tests {
+		keyRing, err := c.UnlockWithMailboxPassword(tc.auth, []byte(tc.login), []byte(tc.mailbox))
+		switch {
+		case tc.wantOtherErr:
+			if err == nil || err == ErrInvalidPassphrase || err == ErrInvalidMailboxPassword {
+				t.Errorf("%v: UnlockWithMailboxPassword() = %v, want another error", tc.name, err)
+			}
+		case err != tc.wantErr:
+			t.Errorf("%v: UnlockWithMailboxPassword() = %v, want %v", tc.name, err, tc.wantErr)
+		case err == nil:
+			if len(keyRing) != 1 || keyRing[0].PrivateKey.Encrypted {
+				t.Errorf("%v: UnlockWithMailboxPassword() didn't return the unlocked key", tc.name)
+			}
+			if c.accessToken != "token" {
+				t.Errorf("%v: access token = %q, want %q", tc.name, c.accessToken, "token")
+			}
+		}
+		c.accessToken = ""
+	}
+}
+
+func TestAuthStages(t *testing.T) {
+	s := newTestSRPServer(t, "password")
+	c := newTestSRPClient(t, s)
+	var stages []string
+	c.AuthStage = func(stage string) {
+		stages = append(stages, stage)
+	}
+
+	info, err := c.AuthInfo("user")
+	if err != nil {
+		t.Fatalf("AuthInfo() = %v", err)
+	}
+	if _, err := c.Auth("user", "password", "", info); err != nil {
+		t.Fatalf("Auth() = %v", err)
+	}
+	want := []string{"auth info fetched", "SRP modulus verified", "SRP proof computed", "server proof verified"}
+	if !reflect.DeepEqual(stages, want) {
+		t.Errorf("Auth() stages = %q, want %q", stages, want)
+	}
+
+	stages = nil
+	e := newTestEntity(t)
+	c = newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Code":1000,"Addresses":[]}`))
+	})
+	c.AuthStage = func(stage string) {
+		stages = append(stages, stage)
+	}
+	if _, err := c.Unlock(newTestAuth(t, e, "password", PasswordSingle), "password"); err != nil {
+		t.Fatalf("Unlock() = %v", err)
+	}
+	want = []string{"key ring decrypted", "access token decrypted"}
+	if !reflect.DeepEqual(stages, want) {
+		t.Errorf("Unlock() stages = %q, want %q", stages, want)
+	}
+
+	// Steps are reported in errors
+	a := newTestAuth(t, e, "password", PasswordSingle)
+	a.accessToken = "invalid"
+	_, err = c.Unlock(a, "password")
+	if err == nil || !strings.HasPrefix(err.Error(), "cannot decrypt access token: ") {
+		t.Errorf("Unlock() with an invalid access token = %v, want a decryption error", err)
+	}
+	a.privateKey = "invalid"
+	_, err = c.Unlock(a, "password")
+	if err == nil || !strings.HasPrefix(err.Error(), "cannot read auth key ring: ") {
+		t.Errorf("Unlock() with an invalid key ring = %v, want a key ring error", err)
+	}
+}
+
+func TestAuthModulusKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		modulusKey bool
+		unsigned   bool
+		wantErr    error
+	}{
+		{name: "custom key", modulusKey: true},
+		{name: "ProtonMail key", wantErr: ErrInvalidModulusSignature},
+		{name: "unsigned", modulusKey: true, unsigned: true, wantErr: ErrInvalidModulusSignature},
+	}
+	for _, tc := range tests {
+		s := newTestSRPServer(t, "password")
+		if tc.unsigned {
+			s.signed = base64.StdEncoding.EncodeToString(s.modulus)
+		}
+		authRequests := 0
+		c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/auth" {
+				authRequests++
+			}
+			s.ServeHTTP(w, r)
+		})
+		if tc.modulusKey {
+			c.ModulusKey = s.modulusKey
+		}
+
+		_, err := c.Auth("user", "password", "", nil)
+		if err != tc.wantErr {
+			t.Errorf("%v: Auth() = %v, want %v", tc.name, err, tc.wantErr)
+		}
+		// The password isn't sent if the modulus can't be trusted
+		want := 1
+		if tc.wantErr != nil {
+			want = 0
+		}
+		if authRequests != want {
+			t.Errorf("%v: Auth() sent %v auth requests, want %v", tc.name, authRequests, want)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package protonmail
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// Calendar events are split in cards, like contacts. Encrypted cards are
+// encrypted with a session key, stored separately in a key packet encrypted
+// with the calendar key. Calendar keys are locked with a passphrase, which is
+// encrypted with the address keys of the calendar members.
+
+type Calendar struct {
+	ID          string
+	Name        string
+	Description string
+	Color       string
+	Display     int
+}
+
+type CalendarKey struct {
+	ID           string
+	CalendarID   string
+	PassphraseID string
+	PrivateKey   string
+	Flags        PrivateKeyFlags
+}
+
+type CalendarMemberPassphrase struct {
+	MemberID   string
+	Passphrase string
+	Signature  string
+}
+
+type CalendarPassphrase struct {
+	ID                string
+	MemberPassphrases []*CalendarMemberPassphrase
+}
+
+type CalendarEventCardType int
+
+const (
+	CalendarEventCardCleartext CalendarEventCardType = iota
+	CalendarEventCardEncrypted
+	CalendarEventCardSigned
+	CalendarEventCardEncryptedAndSigned
+)
+
+func (t CalendarEventCardType) Encrypted() bool {
+	switch t {
+	case CalendarEventCardEncrypted, CalendarEventCardEncryptedAndSigned:
+		return true
+	default:
+		return false
+	}
+}
+
+type CalendarEventCard struct {
+	Type      CalendarEventCardType
+	Data      string
+	Signature string
+	Author    string
+}
+
+// Read returns the iCalendar data of the card. keyPacket is the key packet
+// of the event and keyring contains the calendar keys. Signatures aren't
+// checked, since they're made with the author's address keys.
+func (card *CalendarEventCard) Read(keyPacket []byte, keyring openpgp.KeyRing) (io.Reader, error) {
+	if !card.Type.Encrypted() {
+		return strings.NewReader(card.Data), nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(card.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	r := io.MultiReader(bytes.NewReader(keyPacket), bytes.NewReader(data))
+	md, err := openpgp.ReadMessage(r, keyring, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return md.UnverifiedBody, nil
+}
+
+type CalendarEvent struct {
+	ID            string
+	UID           string
+	CalendarID    string
+	SharedEventID string
+	CreateTime    int64
+	LastEditTime  int64
+	StartTime     int64
+	EndTime       int64
+	FullDay       int
+	Author        string
+
+	SharedKeyPacket   string
+	CalendarKeyPacket string
+	SharedEvents      []*CalendarEventCard
+	CalendarEvents    []*CalendarEventCard
+	AttendeesEvents   []*CalendarEventCard
+	PersonalEvents    []*CalendarEventCard
+}
+
+// Cards returns all the cards of the event, with the key packets needed to
+// decrypt them.
+func (event *CalendarEvent) Cards() ([]*CalendarEventCard, [][]byte, error) {
+	sharedKeyPacket, err := base64.StdEncoding.DecodeString(event.SharedKeyPacket)
+	if err != nil {
+		return nil, nil, err
+	}
+	calendarKeyPacket := sharedKeyPacket
+	if event.CalendarKeyPacket != "" {
+		calendarKeyPacket, err = base64.StdEncoding.DecodeString(event.CalendarKeyPacket)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var cards []*CalendarEventCard
+	var keyPackets [][]byte
+	add := func(l []*CalendarEventCard, keyPacket []byte) {
+		for _, card := range l {
+			cards = append(cards, card)
+			keyPackets = append(keyPackets, keyPacket)
+		}
+	}
+	add(event.SharedEvents, sharedKeyPacket)
+	add(event.AttendeesEvents, sharedKeyPacket)
+	add(event.CalendarEvents, calendarKeyPacket)
+	add(event.PersonalEvents, nil)
+	return cards, keyPackets, nil
+}
+
+// CalendarEventType selects events by how they overlap with the time window
+// of a CalendarEventFilter.
+type CalendarEventType int
+
+const (
+	CalendarEventPartDayInsideWindow CalendarEventType = iota
+	CalendarEventPartDayBeforeWindow
+	CalendarEventFullDayInsideWindow
+	CalendarEventFullDayBeforeWindow
+)
+
+type CalendarEventFilter struct {
+	Start, End time.Time
+	Timezone   string
+	Type       CalendarEventType
+	Page       int
+	PageSize   int
+}
+
+func (c *Client) ListCalendars() ([]*Calendar, error) {
+	return c.ListCalendarsContext(context.Background())
+}
+
+// ListCalendarsContext is like ListCalendars, but with a context.
+func (c *Client) ListCalendarsContext(ctx context.Context) ([]*Calendar, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/calendar/v1", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Calendars []*Calendar
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Calendars, nil
+}
+
+func (c *Client) ListCalendarKeys(calendarID string) ([]*CalendarKey, error) {
+	return c.ListCalendarKeysContext(context.Background(), calendarID)
+}
+
+// ListCalendarKeysContext is like ListCalendarKeys, but with a context.
+func (c *Client) ListCalendarKeysContext(ctx context.Context, calendarID string) ([]*CalendarKey, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/calendar/v1/"+calendarID+"/keys", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Keys []*CalendarKey
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Keys, nil
+}
+
+func (c *Client) GetCalendarPassphrase(calendarID string) (*CalendarPassphrase, error) {
+	return c.GetCalendarPassphraseContext(context.Background(), calendarID)
+}
+
+// GetCalendarPassphraseContext is like GetCalendarPassphrase, but with a
+// context.
+func (c *Client) GetCalendarPassphraseContext(ctx context.Context, calendarID string) (*CalendarPassphrase, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/calendar/v1/"+calendarID+"/passphrase", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Passphrase *CalendarPassphrase
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Passphrase, nil
+}
+
+// UnlockCalendarKeys returns the unlocked keys of a calendar. addrKeys are the
+// unlocked address keys of the user.
+func (c *Client) UnlockCalendarKeys(calendarID string, addrKeys openpgp.KeyRing) (openpgp.EntityList, error) {
+	return c.UnlockCalendarKeysContext(context.Background(), calendarID, addrKeys)
+}
+
+// UnlockCalendarKeysContext is like UnlockCalendarKeys, but with a context.
+func (c *Client) UnlockCalendarKeysContext(ctx context.Context, calendarID string, addrKeys openpgp.KeyRing) (openpgp.EntityList, error) {
+	passphrase, err := c.GetCalendarPassphraseContext(ctx, calendarID)
+	if err != nil {
+		return nil, err
+	}
+
+	var passphraseBytes []byte
+	for _, mp := range passphrase.MemberPassphrases {
+		block, err := armor.Decode(strings.NewReader(mp.Passphrase))
+		if err != nil {
+			continue
+		}
+		md, err := openpgp.ReadMessage(block.Body, addrKeys, nil, nil)
+		if err != nil {
+			continue
+		}
+		if passphraseBytes, err = ioutil.ReadAll(md.UnverifiedBody); err == nil {
+			break
+		}
+		passphraseBytes = nil
+	}
+	if passphraseBytes == nil {
+		return nil, errors.New("cannot decrypt calendar passphrase")
+	}
+
+	keys, err := c.ListCalendarKeysContext(ctx, calendarID)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyRing openpgp.EntityList
+	for _, key := range keys {
+		if key.PassphraseID != passphrase.ID {
+			continue
+		}
+
+		e, err := (&PrivateKey{PrivateKey: key.PrivateKey}).Entity()
+		if err != nil {
+			return nil, err
+		}
+		if err := unlockKey(e, passphraseBytes); err != nil {
+			c.logger().Warn("failed to unlock calendar key", "calendar", calendarID, "key", key.ID, "err", err)
+			continue
+		}
+		keyRing = append(keyRing, e)
+	}
+	if len(keyRing) == 0 {
+		return nil, errors.New("no calendar key could be unlocked")
+	}
+	return keyRing, nil
+}
+
+func (c *Client) ListCalendarEvents(calendarID string, filter *CalendarEventFilter) ([]*CalendarEvent, error) {
+	return c.ListCalendarEventsContext(context.Background(), calendarID, filter)
+}
+
+// ListCalendarEventsContext is like ListCalendarEvents, but with a context.
+func (c *Client) ListCalendarEventsContext(ctx context.Context, calendarID string, filter *CalendarEventFilter) ([]*CalendarEvent, error) {
+	v := url.Values{}
+	v.Set("Start", strconv.FormatInt(filter.Start.Unix(), 10))
+	v.Set("End", strconv.FormatInt(filter.End.Unix(), 10))
+	if filter.Timezone != "" {
+		v.Set("Timezone", filter.Timezone)
+	}
+	v.Set("Type", strconv.Itoa(int(filter.Type)))
+	v.Set("Page", strconv.Itoa(filter.Page))
+	if filter.PageSize > 0 {
+		v.Set("PageSize", strconv.Itoa(filter.PageSize))
+	}
+
+	req, err := c.newRequest(ctx, http.MethodGet, "/calendar/v1/"+calendarID+"/events?"+v.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Events []*CalendarEvent
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Events, nil
+}
+
+func (c *Client) GetCalendarEvent(calendarID, eventID string) (*CalendarEvent, error) {
+	return c.GetCalendarEventContext(context.Background(), calendarID, eventID)
+}
+
+// GetCalendarEventContext is like GetCalendarEvent, but with a context.
+func (c *Client) GetCalendarEventContext(ctx context.Context, calendarID, eventID string) (*CalendarEvent, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/calendar/v1/"+calendarID+"/events/"+eventID, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Event *CalendarEvent
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Event, nil
+}
@@ -2,6 +2,7 @@ package protonmail
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"net/http"
 	"net/url"
@@ -234,13 +235,18 @@ type ContactImport struct {
 }
 
 func (c *Client) ListContacts(page, pageSize int) (total int, contacts []*Contact, err error) {
+	return c.ListContactsContext(context.Background(), page, pageSize)
+}
+
+// ListContactsContext is like ListContacts, but with a context.
+func (c *Client) ListContactsContext(ctx context.Context, page, pageSize int) (total int, contacts []*Contact, err error) {
 	v := url.Values{}
 	v.Set("Page", strconv.Itoa(page))
 	if pageSize > 0 {
 		v.Set("PageSize", strconv.Itoa(pageSize))
 	}
 
-	req, err := c.newRequest(http.MethodGet, "/contacts?"+v.Encode(), nil)
+	req, err := c.newRequest(ctx, http.MethodGet, "/contacts?"+v.Encode(), nil)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -258,13 +264,18 @@ func (c *Client) ListContacts(page, pageSize int) (total int, contacts []*Contac
 }
 
 func (c *Client) ListContactsEmails(page, pageSize int) (total int, emails []*ContactEmail, err error) {
+	return c.ListContactsEmailsContext(context.Background(), page, pageSize)
+}
+
+// ListContactsEmailsContext is like ListContactsEmails, but with a context.
+func (c *Client) ListContactsEmailsContext(ctx context.Context, page, pageSize int) (total int, emails []*ContactEmail, err error) {
 	v := url.Values{}
 	v.Set("Page", strconv.Itoa(page))
 	if pageSize > 0 {
 		v.Set("PageSize", strconv.Itoa(pageSize))
 	}
 
-	req, err := c.newRequest(http.MethodGet, "/contacts/emails?"+v.Encode(), nil)
+	req, err := c.newRequest(ctx, http.MethodGet, "/contacts/emails?"+v.Encode(), nil)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -282,13 +293,18 @@ func (c *Client) ListContactsEmails(page, pageSize int) (total int, emails []*Co
 }
 
 func (c *Client) ListContactsExport(page, pageSize int) (total int, contacts []*ContactExport, err error) {
+	return c.ListContactsExportContext(context.Background(), page, pageSize)
+}
+
+// ListContactsExportContext is like ListContactsExport, but with a context.
+func (c *Client) ListContactsExportContext(ctx context.Context, page, pageSize int) (total int, contacts []*ContactExport, err error) {
 	v := url.Values{}
 	v.Set("Page", strconv.Itoa(page))
 	if pageSize > 0 {
 		v.Set("PageSize", strconv.Itoa(pageSize))
 	}
 
-	req, err := c.newRequest(http.MethodGet, "/contacts/export?"+v.Encode(), nil)
+	req, err := c.newRequest(ctx, http.MethodGet, "/contacts/export?"+v.Encode(), nil)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -305,8 +321,47 @@ func (c *Client) ListContactsExport(page, pageSize int) (total int, contacts []*
 	return respData.Total, respData.Contacts, nil
 }
 
+func (c *Client) doContactsEmails(ctx context.Context, action, labelID string, ids []string) error {
+	reqData := struct {
+		LabelID         string
+		ContactEmailIDs []string
+	}{labelID, ids}
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/contacts/emails/"+action, &reqData)
+	if err != nil {
+		return err
+	}
+
+	// TODO: the response contains one response per contact email
+	return c.doJSON(req, nil)
+}
+
+// LabelContactsEmails adds contact emails to a contact group.
+func (c *Client) LabelContactsEmails(labelID string, ids []string) error {
+	return c.LabelContactsEmailsContext(context.Background(), labelID, ids)
+}
+
+// LabelContactsEmailsContext is like LabelContactsEmails, but with a context.
+func (c *Client) LabelContactsEmailsContext(ctx context.Context, labelID string, ids []string) error {
+	return c.doContactsEmails(ctx, "label", labelID, ids)
+}
+
+// UnlabelContactsEmails removes contact emails from a contact group.
+func (c *Client) UnlabelContactsEmails(labelID string, ids []string) error {
+	return c.UnlabelContactsEmailsContext(context.Background(), labelID, ids)
+}
+
+// UnlabelContactsEmailsContext is like UnlabelContactsEmails, but with a context.
+func (c *Client) UnlabelContactsEmailsContext(ctx context.Context, labelID string, ids []string) error {
+	return c.doContactsEmails(ctx, "unlabel", labelID, ids)
+}
+
 func (c *Client) GetContact(id string) (*Contact, error) {
-	req, err := c.newRequest(http.MethodGet, "/contacts/"+id, nil)
+	return c.GetContactContext(context.Background(), id)
+}
+
+// GetContactContext is like GetContact, but with a context.
+func (c *Client) GetContactContext(ctx context.Context, id string) (*Contact, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/contacts/"+id, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -335,11 +390,16 @@ func (resp *CreateContactResp) Err() error {
 }
 
 func (c *Client) CreateContacts(contacts []*ContactImport) ([]*CreateContactResp, error) {
+	return c.CreateContactsContext(context.Background(), contacts)
+}
+
+// CreateContactsContext is like CreateContacts, but with a context.
+func (c *Client) CreateContactsContext(ctx context.Context, contacts []*ContactImport) ([]*CreateContactResp, error) {
 	reqData := struct {
 		Contacts                  []*ContactImport
 		Overwrite, Groups, Labels int
 	}{contacts, 0, 0, 0}
-	req, err := c.newJSONRequest(http.MethodPost, "/contacts", &reqData)
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/contacts", &reqData)
 	if err != nil {
 		return nil, err
 	}
@@ -356,7 +416,12 @@ func (c *Client) CreateContacts(contacts []*ContactImport) ([]*CreateContactResp
 }
 
 func (c *Client) UpdateContact(id string, contact *ContactImport) (*Contact, error) {
-	req, err := c.newJSONRequest(http.MethodPut, "/contacts/"+id, contact)
+	return c.UpdateContactContext(context.Background(), id, contact)
+}
+
+// UpdateContactContext is like UpdateContact, but with a context.
+func (c *Client) UpdateContactContext(ctx context.Context, id string, contact *ContactImport) (*Contact, error) {
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/contacts/"+id, contact)
 	if err != nil {
 		return nil, err
 	}
@@ -384,10 +449,15 @@ func (resp *DeleteContactResp) Err() error {
 }
 
 func (c *Client) DeleteContacts(ids []string) ([]*DeleteContactResp, error) {
+	return c.DeleteContactsContext(context.Background(), ids)
+}
+
+// DeleteContactsContext is like DeleteContacts, but with a context.
+func (c *Client) DeleteContactsContext(ctx context.Context, ids []string) ([]*DeleteContactResp, error) {
 	reqData := struct {
 		IDs []string
 	}{ids}
-	req, err := c.newJSONRequest(http.MethodPut, "/contacts/delete", &reqData)
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/contacts/delete", &reqData)
 	if err != nil {
 		return nil, err
 	}
@@ -404,7 +474,12 @@ func (c *Client) DeleteContacts(ids []string) ([]*DeleteContactResp, error) {
 }
 
 func (c *Client) DeleteAllContacts() error {
-	req, err := c.newRequest(http.MethodDelete, "/contacts", nil)
+	return c.DeleteAllContactsContext(context.Background())
+}
+
+// DeleteAllContactsContext is like DeleteAllContacts, but with a context.
+func (c *Client) DeleteAllContactsContext(ctx context.Context) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, "/contacts", nil)
 	if err != nil {
 		return err
 	}
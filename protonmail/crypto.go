@@ -1,13 +1,20 @@
 package protonmail
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
 	"hash"
 	"io"
 	"time"
 
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/packet"
+	"golang.org/x/crypto/openpgp/s2k"
 )
 
 // primaryIdentity returns the Identity marked as primary or the first identity
@@ -202,3 +209,125 @@ func (c noOpCloser) Write(data []byte) (n int, err error) {
 func (c noOpCloser) Close() error {
 	return nil
 }
+
+// readPacketBody returns the body of a serialized packet, written with a new
+// format header.
+func readPacketBody(b []byte) ([]byte, error) {
+	if len(b) < 2 || b[0]&0xC0 != 0xC0 {
+		return nil, errors.New("expected a new format packet")
+	}
+
+	var n, offset int
+	switch l := int(b[1]); {
+	case l < 192:
+		n, offset = l, 2
+	case l < 224:
+		if len(b) < 3 {
+			return nil, errors.New("truncated packet header")
+		}
+		n, offset = (l-192)<<8+int(b[2])+192, 3
+	case l == 255:
+		if len(b) < 6 {
+			return nil, errors.New("truncated packet header")
+		}
+		n, offset = int(binary.BigEndian.Uint32(b[2:6])), 6
+	default:
+		return nil, errors.New("partial packet lengths aren't supported")
+	}
+
+	if len(b) < offset+n {
+		return nil, errors.New("truncated packet")
+	}
+	return b[offset : offset+n], nil
+}
+
+// serializeEncryptedPrivateKey writes the private key pk, encrypted with
+// passphrase. x/crypto/openpgp can only serialize unencrypted private keys.
+func serializeEncryptedPrivateKey(w io.Writer, pk *packet.PrivateKey, passphrase []byte, config *packet.Config) error {
+	var pubBuf, privBuf bytes.Buffer
+	if err := pk.PublicKey.Serialize(&pubBuf); err != nil {
+		return err
+	}
+	if err := pk.Serialize(&privBuf); err != nil {
+		return err
+	}
+	pub, err := readPacketBody(pubBuf.Bytes())
+	if err != nil {
+		return err
+	}
+	priv, err := readPacketBody(privBuf.Bytes())
+	if err != nil {
+		return err
+	}
+	// The unencrypted body is the public key, a zero S2K usage byte, the
+	// private key and a two-byte checksum
+	if len(priv) < len(pub)+3 {
+		return errors.New("invalid private key packet")
+	}
+	secret := priv[len(pub)+1 : len(priv)-2]
+
+	var body bytes.Buffer
+	body.Write(pub)
+	body.WriteByte(254) // SHA-1 checksum
+	body.WriteByte(byte(packet.CipherAES256))
+
+	key := make([]byte, packet.CipherAES256.KeySize())
+	s2kConfig := &s2k.Config{Hash: crypto.SHA256}
+	if err := s2k.Serialize(&body, key, config.Random(), passphrase, s2kConfig); err != nil {
+		return err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	iv := make([]byte, block.BlockSize())
+	if _, err := io.ReadFull(config.Random(), iv); err != nil {
+		return err
+	}
+	body.Write(iv)
+
+	checksum := sha1.Sum(secret)
+	encrypted := append(append([]byte(nil), secret...), checksum[:]...)
+	cipher.NewCFBEncrypter(block, iv).XORKeyStream(encrypted, encrypted)
+	body.Write(encrypted)
+
+	tag := byte(5) // secret key
+	if pk.IsSubkey {
+		tag = 7 // secret subkey
+	}
+	var header [6]byte
+	header[0] = 0xC0 | tag
+	header[1] = 255
+	binary.BigEndian.PutUint32(header[2:], uint32(body.Len()))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(body.Bytes())
+	return err
+}
+
+// serializeEncryptedEntity writes the private keys of e, encrypted with
+// passphrase, along with its identities and subkeys.
+func serializeEncryptedEntity(w io.Writer, e *openpgp.Entity, passphrase []byte, config *packet.Config) error {
+	if err := serializeEncryptedPrivateKey(w, e.PrivateKey, passphrase, config); err != nil {
+		return err
+	}
+	for _, ident := range e.Identities {
+		if err := ident.UserId.Serialize(w); err != nil {
+			return err
+		}
+		if err := ident.SelfSignature.Serialize(w); err != nil {
+			return err
+		}
+	}
+	for _, subkey := range e.Subkeys {
+		if err := serializeEncryptedPrivateKey(w, subkey.PrivateKey, passphrase, config); err != nil {
+			return err
+		}
+		if err := subkey.Sig.Serialize(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
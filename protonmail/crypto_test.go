@@ -0,0 +1,104 @@
+package protonmail
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestReadPacketBody(t *testing.T) {
+	long := bytes.Repeat([]byte{'a'}, 1000)
+	tests := []struct {
+		name    string
+		b       []byte
+		want    []byte
+		wantErr bool
+	}{
+		{name: "one-octet length", b: []byte{0xC2, 3, 'a', 'b', 'c', 'd'}, want: []byte("abc")},
+		{name: "two-octet length", b: append([]byte{0xC2, 192 + (1000-192)>>8, (1000 - 192) & 0xFF}, long...), want: long},
+		{name: "five-octet length", b: append([]byte{0xC2, 255, 0, 0, 3, 232}, long...), want: long},
+		{name: "old format", b: []byte{0x88, 3, 'a', 'b', 'c'}, wantErr: true},
+		{name: "partial length", b: []byte{0xC2, 224, 'a'}, wantErr: true},
+		{name: "truncated header", b: []byte{0xC2, 255, 0}, wantErr: true},
+		{name: "truncated body", b: []byte{0xC2, 3, 'a'}, wantErr: true},
+		{name: "empty", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := readPacketBody(tc.b)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%v: readPacketBody() = nil, want an error", tc.name)
+			}
+		} else if err != nil {
+			t.Errorf("%v: readPacketBody() = %v", tc.name, err)
+		} else if !bytes.Equal(got, tc.want) {
+			t.Errorf("%v: readPacketBody() = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSerializeEncryptedEntity(t *testing.T) {
+	e := newTestEntity(t)
+
+	var b bytes.Buffer
+	if err := serializeEncryptedEntity(&b, e, []byte("passphrase"), nil); err != nil {
+		t.Fatalf("serializeEncryptedEntity() = %v", err)
+	}
+
+	for _, tc := range []struct {
+		passphrase string
+		wantErr    bool
+	}{
+		{"passphrase", false},
+		{"wrong", true},
+	} {
+		keyRing, err := openpgp.ReadKeyRing(bytes.NewReader(b.Bytes()))
+		if err != nil {
+			t.Fatalf("openpgp.ReadKeyRing() = %v", err)
+		}
+		if len(keyRing) != 1 || len(keyRing[0].Subkeys) != len(e.Subkeys) {
+			t.Fatalf("openpgp.ReadKeyRing() didn't return the entity and its subkeys")
+		}
+		got := keyRing[0]
+		if got.PrimaryKey.KeyId != e.PrimaryKey.KeyId || !got.PrivateKey.Encrypted {
+			t.Fatalf("serializeEncryptedEntity() didn't write the encrypted private key")
+		}
+
+		err = got.PrivateKey.Decrypt([]byte(tc.passphrase))
+		for _, subkey := range got.Subkeys {
+			if err == nil {
+				err = subkey.PrivateKey.Decrypt([]byte(tc.passphrase))
+			}
+		}
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("Decrypt(%q) = nil, want an error", tc.passphrase)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Decrypt(%q) = %v", tc.passphrase, err)
+			continue
+		}
+
+		// The decrypted key can decrypt messages encrypted to the original
+		md, err := openpgp.ReadMessage(bytes.NewReader(encryptBinary(t, e, "Hello")), keyRing, nil, nil)
+		if err != nil {
+			t.Errorf("openpgp.ReadMessage() = %v", err)
+		} else if !md.IsEncrypted || md.DecryptedWith.PrivateKey == nil {
+			t.Errorf("message wasn't decrypted with the serialized key")
+		}
+	}
+}
+
+func encryptBinary(t *testing.T, to *openpgp.Entity, s string) []byte {
+	var b bytes.Buffer
+	w, err := openpgp.Encrypt(&b, []*openpgp.Entity{to}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(s))
+	w.Close()
+	return b.Bytes()
+}
@@ -1,6 +1,7 @@
 package protonmail
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 )
@@ -18,7 +19,7 @@ type Event struct {
 	Messages []*EventMessage
 	Contacts []*EventContact
 	//ContactEmails
-	//Labels
+	Labels []*EventLabel
 	//User
 	//Members
 	//Domains
@@ -160,12 +161,38 @@ type EventContact struct {
 	Contact *Contact
 }
 
+type EventLabel struct {
+	ID     string
+	Action EventAction
+	// Only populated for EventCreate and EventUpdate
+	Label *Label
+}
+
+// IsInvalidEvent checks whether GetEvent failed because the API rejected the
+// last event ID, e.g. because it's too old.
+func IsInvalidEvent(err error) bool {
+	apiErr, ok := err.(*APIError)
+	if !ok {
+		return false
+	}
+	switch apiErr.HTTPStatus {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
 func (c *Client) GetEvent(last string) (*Event, error) {
+	return c.GetEventContext(context.Background(), last)
+}
+
+// GetEventContext is like GetEvent, but with a context.
+func (c *Client) GetEventContext(ctx context.Context, last string) (*Event, error) {
 	if last == "" {
 		last = "latest"
 	}
 
-	req, err := c.newRequest(http.MethodGet, "/events/"+last, nil)
+	req, err := c.newRequest(ctx, http.MethodGet, "/events/"+last, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,59 @@
+package protonmail
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestIsInvalidEvent(t *testing.T) {
+	tests := []struct {
+		status int
+		want   bool
+	}{
+		{http.StatusBadRequest, true},
+		{http.StatusNotFound, true},
+		{http.StatusUnprocessableEntity, true},
+		{http.StatusUnauthorized, false},
+		{http.StatusTooManyRequests, false},
+		{http.StatusInternalServerError, false},
+	}
+	for _, tc := range tests {
+		c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.status)
+			w.Write([]byte(`{"Code":2501,"Error":"Invalid event ID"}`))
+		})
+		_, err := c.GetEvent("old")
+		if err == nil {
+			t.Errorf("%v: GetEvent() = nil, want an error", tc.status)
+		} else if got := IsInvalidEvent(err); got != tc.want {
+			t.Errorf("%v: IsInvalidEvent(%v) = %v, want %v", tc.status, err, got, tc.want)
+		}
+	}
+
+	if IsInvalidEvent(errors.New("network error")) {
+		t.Errorf("IsInvalidEvent() with a non-API error = true, want false")
+	}
+}
+
+func TestGetEvent(t *testing.T) {
+	var paths []string
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Write([]byte(`{"Code":1000,"EventID":"event2","Refresh":1,"Messages":[{"ID":"msg1","Action":1,"Message":{"ID":"msg1","Subject":"Hello"}}]}`))
+	})
+
+	for _, last := range []string{"", "event1"} {
+		event, err := c.GetEvent(last)
+		if err != nil {
+			t.Errorf("GetEvent(%q) = %v", last, err)
+			continue
+		}
+		if event.ID != "event2" || event.Refresh != EventRefreshMail || len(event.Messages) != 1 || event.Messages[0].Created == nil || event.Messages[0].Created.Subject != "Hello" {
+			t.Errorf("GetEvent(%q) = %+v", last, event)
+		}
+	}
+	if want := []string{"/events/latest", "/events/event1"}; len(paths) != 2 || paths[0] != want[0] || paths[1] != want[1] {
+		t.Errorf("requested %q, want %q", paths, want)
+	}
+}
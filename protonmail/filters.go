@@ -0,0 +1,178 @@
+package protonmail
+
+import (
+	"context"
+	"net/http"
+)
+
+type FilterStatus int
+
+const (
+	FilterDisabled FilterStatus = iota
+	FilterEnabled
+)
+
+// A Filter is a server-side mail rule, written in Sieve.
+type Filter struct {
+	ID       string `json:",omitempty"`
+	Name     string
+	Status   FilterStatus
+	Priority int `json:",omitempty"`
+	Version  int
+	Sieve    string
+}
+
+// SieveIssue is a problem found in a Sieve script by CheckSieve.
+type SieveIssue struct {
+	Message string
+}
+
+// ListFilters returns all filters, in no particular order. Filters are applied
+// by ascending priority.
+func (c *Client) ListFilters() ([]*Filter, error) {
+	return c.ListFiltersContext(context.Background())
+}
+
+// ListFiltersContext is like ListFilters, but with a context.
+func (c *Client) ListFiltersContext(ctx context.Context) ([]*Filter, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/filters", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Filters []*Filter
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Filters, nil
+}
+
+func (c *Client) CreateFilter(filter *Filter) (*Filter, error) {
+	return c.CreateFilterContext(context.Background(), filter)
+}
+
+// CreateFilterContext is like CreateFilter, but with a context.
+func (c *Client) CreateFilterContext(ctx context.Context, filter *Filter) (*Filter, error) {
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/filters", filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Filter *Filter
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Filter, nil
+}
+
+// UpdateFilter updates the name and the script of a filter. Use
+// SetFilterStatus to enable or disable it.
+func (c *Client) UpdateFilter(filter *Filter) (*Filter, error) {
+	return c.UpdateFilterContext(context.Background(), filter)
+}
+
+// UpdateFilterContext is like UpdateFilter, but with a context.
+func (c *Client) UpdateFilterContext(ctx context.Context, filter *Filter) (*Filter, error) {
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/filters/"+filter.ID, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Filter *Filter
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Filter, nil
+}
+
+func (c *Client) SetFilterStatus(id string, status FilterStatus) error {
+	return c.SetFilterStatusContext(context.Background(), id, status)
+}
+
+// SetFilterStatusContext is like SetFilterStatus, but with a context.
+func (c *Client) SetFilterStatusContext(ctx context.Context, id string, status FilterStatus) error {
+	action := "disable"
+	if status == FilterEnabled {
+		action = "enable"
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPut, "/filters/"+id+"/"+action, nil)
+	if err != nil {
+		return err
+	}
+
+	return c.doJSON(req, nil)
+}
+
+func (c *Client) DeleteFilter(id string) error {
+	return c.DeleteFilterContext(context.Background(), id)
+}
+
+// DeleteFilterContext is like DeleteFilter, but with a context.
+func (c *Client) DeleteFilterContext(ctx context.Context, id string) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, "/filters/"+id, nil)
+	if err != nil {
+		return err
+	}
+
+	return c.doJSON(req, nil)
+}
+
+// OrderFilters sets the priority of filters: the first one is applied first.
+func (c *Client) OrderFilters(ids []string) error {
+	return c.OrderFiltersContext(context.Background(), ids)
+}
+
+// OrderFiltersContext is like OrderFilters, but with a context.
+func (c *Client) OrderFiltersContext(ctx context.Context, ids []string) error {
+	reqData := struct {
+		FilterIDs []string
+	}{ids}
+
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/filters/order", &reqData)
+	if err != nil {
+		return err
+	}
+
+	return c.doJSON(req, nil)
+}
+
+// CheckSieve validates a Sieve script without saving it.
+func (c *Client) CheckSieve(version int, sieve string) ([]*SieveIssue, error) {
+	return c.CheckSieveContext(context.Background(), version, sieve)
+}
+
+// CheckSieveContext is like CheckSieve, but with a context.
+func (c *Client) CheckSieveContext(ctx context.Context, version int, sieve string) ([]*SieveIssue, error) {
+	reqData := struct {
+		Version int
+		Sieve   string
+	}{version, sieve}
+
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/filters/check", &reqData)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Issues []*SieveIssue
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Issues, nil
+}
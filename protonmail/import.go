@@ -0,0 +1,115 @@
+package protonmail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// ImportMessageMetadata contains information about a message being imported.
+type ImportMessageMetadata struct {
+	AddressID string
+	Unread    int
+	Type      MessageType
+	Time      int64 `json:",omitempty"`
+	LabelIDs  []string
+}
+
+type ImportMessageResp struct {
+	Name     string
+	Response struct {
+		resp
+		MessageID string
+	}
+}
+
+func (resp *ImportMessageResp) Err() error {
+	return resp.Response.Err()
+}
+
+// ImportMessage imports a raw RFC 822 message, without sending it. The message
+// is encrypted to and signed with key.
+func (c *Client) ImportMessage(meta *ImportMessageMetadata, r io.Reader, key *openpgp.Entity) (string, error) {
+	return c.ImportMessageContext(context.Background(), meta, r, key)
+}
+
+// ImportMessageContext is like ImportMessage, but with a context.
+func (c *Client) ImportMessageContext(ctx context.Context, meta *ImportMessageMetadata, r io.Reader, key *openpgp.Entity) (string, error) {
+	const name = "0"
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	go func() {
+		metadata, err := json.Marshal(map[string]*ImportMessageMetadata{name: meta})
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if err := mw.WriteField("Metadata", string(metadata)); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		w, err := mw.CreateFormFile(name, name+".eml")
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		ciphertext, err := armor.Encode(w, "PGP MESSAGE", nil)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		plaintext, err := openpgp.Encrypt(ciphertext, []*openpgp.Entity{key}, key, nil, nil)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(plaintext, r); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if err := plaintext.Close(); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if err := ciphertext.Close(); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		pw.CloseWithError(mw.Close())
+	}()
+
+	req, err := c.newRequest(ctx, http.MethodPost, "/import", pr)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	var respData struct {
+		resp
+		Responses []*ImportMessageResp
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return "", err
+	}
+
+	if len(respData.Responses) != 1 {
+		return "", errors.New("protonmail: expected exactly one response when importing message")
+	}
+	resp := respData.Responses[0]
+	if err := resp.Err(); err != nil {
+		return "", err
+	}
+	return resp.Response.MessageID, nil
+}
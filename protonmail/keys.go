@@ -1,12 +1,17 @@
 package protonmail
 
 import (
+	"bytes"
+	"context"
+	"crypto"
 	"errors"
 	"net/http"
 	"net/url"
 	"strings"
 
 	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
 )
 
 type PrivateKeyFlags int
@@ -68,11 +73,16 @@ func (pub *PublicKey) Entity() (*openpgp.Entity, error) {
 
 // GetPublicKeys retrieves public keys for a user.
 func (c *Client) GetPublicKeys(email string) (*PublicKeyResp, error) {
+	return c.GetPublicKeysContext(context.Background(), email)
+}
+
+// GetPublicKeysContext is like GetPublicKeys, but with a context.
+func (c *Client) GetPublicKeysContext(ctx context.Context, email string) (*PublicKeyResp, error) {
 	v := url.Values{}
 	v.Set("Email", email)
 	// TODO: Fingerprint
 
-	req, err := c.newRequest(http.MethodGet, "/keys?"+v.Encode(), nil)
+	req, err := c.newRequest(ctx, http.MethodGet, "/keys?"+v.Encode(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -87,3 +97,146 @@ func (c *Client) GetPublicKeys(email string) (*PublicKeyResp, error) {
 
 	return respData.PublicKeyResp, nil
 }
+
+// addressKeyBits is the size of the RSA keys generated for addresses.
+const addressKeyBits = 2048
+
+func (c *Client) GetAddress(id string) (*Address, error) {
+	return c.GetAddressContext(context.Background(), id)
+}
+
+// GetAddressContext is like GetAddress, but with a context.
+func (c *Client) GetAddressContext(ctx context.Context, id string) (*Address, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/addresses/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Address *Address
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Address, nil
+}
+
+// ListAddressKeys returns the private keys of an address, still encrypted.
+func (c *Client) ListAddressKeys(addressID string) ([]*PrivateKey, error) {
+	return c.ListAddressKeysContext(context.Background(), addressID)
+}
+
+// ListAddressKeysContext is like ListAddressKeys, but with a context.
+func (c *Client) ListAddressKeysContext(ctx context.Context, addressID string) ([]*PrivateKey, error) {
+	addr, err := c.GetAddressContext(ctx, addressID)
+	if err != nil {
+		return nil, err
+	}
+	return addr.Keys, nil
+}
+
+type CreateKeyReq struct {
+	AddressID  string
+	PrivateKey string // armored, encrypted
+	Primary    int
+}
+
+func (c *Client) CreateKey(reqData *CreateKeyReq) (*PrivateKey, error) {
+	return c.CreateKeyContext(context.Background(), reqData)
+}
+
+// CreateKeyContext is like CreateKey, but with a context.
+func (c *Client) CreateKeyContext(ctx context.Context, reqData *CreateKeyReq) (*PrivateKey, error) {
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/keys", reqData)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Key *PrivateKey
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Key, nil
+}
+
+// SetPrimaryKey makes a key the one used by default to sign and decrypt
+// messages of its address.
+func (c *Client) SetPrimaryKey(id string) error {
+	return c.SetPrimaryKeyContext(context.Background(), id)
+}
+
+// SetPrimaryKeyContext is like SetPrimaryKey, but with a context.
+func (c *Client) SetPrimaryKeyContext(ctx context.Context, id string) error {
+	req, err := c.newRequest(ctx, http.MethodPut, "/keys/"+id+"/primary", nil)
+	if err != nil {
+		return err
+	}
+
+	return c.doJSON(req, nil)
+}
+
+// GenerateAddressKey creates a new key for an address and uploads it, encrypted
+// with passphrase. If passphrase is nil, the passphrase the client has been
+// unlocked with is used. The new key becomes primary if the address doesn't
+// have a primary key yet. The returned entity is decrypted.
+func (c *Client) GenerateAddressKey(addressID string, passphrase []byte) (*PrivateKey, *openpgp.Entity, error) {
+	return c.GenerateAddressKeyContext(context.Background(), addressID, passphrase)
+}
+
+// GenerateAddressKeyContext is like GenerateAddressKey, but with a context.
+func (c *Client) GenerateAddressKeyContext(ctx context.Context, addressID string, passphrase []byte) (*PrivateKey, *openpgp.Entity, error) {
+	if passphrase == nil {
+		passphrase = c.keyPassphrase
+	}
+	if len(passphrase) == 0 {
+		return nil, nil, errors.New("no passphrase to encrypt the key with")
+	}
+
+	addr, err := c.GetAddressContext(ctx, addressID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	primary := 1
+	for _, key := range addr.Keys {
+		if key.Primary == 1 {
+			primary = 0
+			break
+		}
+	}
+
+	config := &packet.Config{RSABits: addressKeyBits, DefaultHash: crypto.SHA256}
+	e, err := openpgp.NewEntity(addr.Email, "", addr.Email, config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var b bytes.Buffer
+	w, err := armor.Encode(&b, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := serializeEncryptedEntity(w, e, passphrase, config); err != nil {
+		return nil, nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	key, err := c.CreateKeyContext(ctx, &CreateKeyReq{
+		AddressID:  addressID,
+		PrivateKey: b.String(),
+		Primary:    primary,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, e, nil
+}
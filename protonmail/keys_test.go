@@ -0,0 +1,85 @@
+package protonmail
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestGenerateAddressKey(t *testing.T) {
+	tests := []struct {
+		name          string
+		keys          []*PrivateKey
+		passphrase    []byte
+		keyPassphrase []byte
+		wantPrimary   int
+		wantErr       bool
+	}{
+		{name: "first key", passphrase: []byte("passphrase"), wantPrimary: 1},
+		{name: "client passphrase", keyPassphrase: []byte("passphrase"), keys: []*PrivateKey{{ID: "key1", Primary: 1}}, wantPrimary: 0},
+		{name: "no passphrase", wantErr: true},
+	}
+	for _, tc := range tests {
+		var created *CreateKeyReq
+		c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == http.MethodGet && r.URL.Path == "/addresses/addr1":
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"Code":    1000,
+					"Address": &Address{ID: "addr1", Email: "user@example.org", Keys: tc.keys},
+				})
+			case r.Method == http.MethodPost && r.URL.Path == "/keys":
+				created = new(CreateKeyReq)
+				if err := json.NewDecoder(r.Body).Decode(created); err != nil {
+					t.Error(err)
+				}
+				w.Write([]byte(`{"Code":1000,"Key":{"ID":"key2"}}`))
+			default:
+				http.NotFound(w, r)
+			}
+		})
+		c.keyPassphrase = tc.keyPassphrase
+
+		key, e, err := c.GenerateAddressKey("addr1", tc.passphrase)
+		if tc.wantErr {
+			if err == nil || created != nil {
+				t.Errorf("%v: GenerateAddressKey() = %v, want an error and no key created", tc.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: GenerateAddressKey() = %v", tc.name, err)
+			continue
+		}
+		if key.ID != "key2" || e.PrivateKey.Encrypted {
+			t.Errorf("%v: GenerateAddressKey() didn't return the created key and a decrypted entity", tc.name)
+		}
+		if created.AddressID != "addr1" || created.Primary != tc.wantPrimary {
+			t.Errorf("%v: created key for %q with primary %v, want %q with primary %v", tc.name, created.AddressID, created.Primary, "addr1", tc.wantPrimary)
+		}
+		if ident := primaryIdentity(e); ident == nil || ident.UserId.Email != "user@example.org" {
+			t.Errorf("%v: generated key doesn't have the address as identity", tc.name)
+		}
+
+		// The uploaded key is encrypted with the passphrase
+		keyRing, err := openpgp.ReadArmoredKeyRing(strings.NewReader(created.PrivateKey))
+		if err != nil || len(keyRing) != 1 {
+			t.Errorf("%v: cannot read the uploaded key: %v", tc.name, err)
+			continue
+		}
+		uploaded := keyRing[0]
+		if uploaded.PrimaryKey.KeyId != e.PrimaryKey.KeyId || !uploaded.PrivateKey.Encrypted {
+			t.Errorf("%v: the uploaded key isn't the encrypted generated key", tc.name)
+		}
+		passphrase := tc.passphrase
+		if passphrase == nil {
+			passphrase = tc.keyPassphrase
+		}
+		if err := uploaded.PrivateKey.Decrypt(passphrase); err != nil {
+			t.Errorf("%v: cannot decrypt the uploaded key: %v", tc.name, err)
+		}
+	}
+}
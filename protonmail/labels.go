@@ -1,5 +1,12 @@
 package protonmail
 
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
 const (
 	LabelInbox    = "0"
 	LabelAllDraft = "1"
@@ -12,3 +19,106 @@ const (
 	LabelDraft    = "8"
 	LabelStarred  = "10"
 )
+
+type LabelType int
+
+const (
+	LabelMessage LabelType = 1
+	LabelContact LabelType = 2
+)
+
+type Label struct {
+	ID        string
+	Name      string
+	Color     string
+	Display   int
+	Type      LabelType
+	Exclusive int
+	Notify    int
+	Order     int
+	ParentID  string `json:",omitempty"`
+	Path      string `json:",omitempty"`
+}
+
+func (c *Client) ListLabels(t LabelType) ([]*Label, error) {
+	return c.ListLabelsContext(context.Background(), t)
+}
+
+// ListLabelsContext is like ListLabels, but with a context.
+func (c *Client) ListLabelsContext(ctx context.Context, t LabelType) ([]*Label, error) {
+	v := url.Values{}
+	v.Set("Type", strconv.Itoa(int(t)))
+
+	req, err := c.newRequest(ctx, http.MethodGet, "/labels?"+v.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Labels []*Label
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Labels, nil
+}
+
+func (c *Client) CreateLabel(label *Label) (*Label, error) {
+	return c.CreateLabelContext(context.Background(), label)
+}
+
+// CreateLabelContext is like CreateLabel, but with a context.
+func (c *Client) CreateLabelContext(ctx context.Context, label *Label) (*Label, error) {
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/labels", label)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Label *Label
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Label, nil
+}
+
+func (c *Client) UpdateLabel(label *Label) (*Label, error) {
+	return c.UpdateLabelContext(context.Background(), label)
+}
+
+// UpdateLabelContext is like UpdateLabel, but with a context.
+func (c *Client) UpdateLabelContext(ctx context.Context, label *Label) (*Label, error) {
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/labels/"+label.ID, label)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Label *Label
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Label, nil
+}
+
+func (c *Client) DeleteLabel(id string) error {
+	return c.DeleteLabelContext(context.Background(), id)
+}
+
+// DeleteLabelContext is like DeleteLabel, but with a context.
+func (c *Client) DeleteLabelContext(ctx context.Context, id string) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, "/labels/"+id, nil)
+	if err != nil {
+		return err
+	}
+
+	return c.doJSON(req, nil)
+}
@@ -2,8 +2,10 @@ package protonmail
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
@@ -40,6 +42,30 @@ const (
 	_
 )
 
+// SignatureStatus is the result of the verification of a message signature.
+type SignatureStatus int
+
+const (
+	SignatureNone SignatureStatus = iota
+	SignatureValid
+	SignatureInvalid
+	SignatureUnknownKey
+)
+
+func (status SignatureStatus) String() string {
+	switch status {
+	case SignatureNone:
+		return "none"
+	case SignatureValid:
+		return "valid"
+	case SignatureInvalid:
+		return "invalid"
+	case SignatureUnknownKey:
+		return "unknown-key"
+	}
+	return "unknown"
+}
+
 type MessageAction int
 
 const (
@@ -51,10 +77,14 @@ const (
 type MessageAddress struct {
 	Address string
 	Name    string
+	// Group is the name of the contact group the recipient has been added
+	// with, if any
+	Group string `json:",omitempty"`
 }
 
 type Message struct {
 	ID             string
+	ConversationID string
 	Order          int64
 	Subject        string
 	Unread         int
@@ -80,6 +110,10 @@ type Message struct {
 	Attachments    []*Attachment
 	LabelIDs       []string
 	ExternalID     string
+
+	// Populated by CheckSignature, not by the API
+	SignatureStatus      SignatureStatus `json:"-"`
+	SignatureFingerprint string          `json:"-"`
 }
 
 func (msg *Message) Read(keyring openpgp.KeyRing, prompt openpgp.PromptFunction) (*openpgp.MessageDetails, error) {
@@ -100,6 +134,24 @@ func (msg *Message) Read(keyring openpgp.KeyRing, prompt openpgp.PromptFunction)
 	}
 }
 
+// CheckSignature sets msg.SignatureStatus and msg.SignatureFingerprint from
+// the result of the verification of md, returned by Read. md.UnverifiedBody
+// must have been read until EOF.
+func (msg *Message) CheckSignature(md *openpgp.MessageDetails) {
+	msg.SignatureFingerprint = ""
+	switch {
+	case !md.IsSigned:
+		msg.SignatureStatus = SignatureNone
+	case md.SignedBy == nil:
+		msg.SignatureStatus = SignatureUnknownKey
+	case md.SignatureError != nil:
+		msg.SignatureStatus = SignatureInvalid
+	default:
+		msg.SignatureStatus = SignatureValid
+		msg.SignatureFingerprint = fmt.Sprintf("%X", md.SignedBy.PublicKey.Fingerprint)
+	}
+}
+
 type messageWriter struct {
 	plaintext  io.WriteCloser
 	ciphertext io.WriteCloser
@@ -165,7 +217,19 @@ type MessageFilter struct {
 	ExternalID   string
 }
 
+func formatBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
 func (c *Client) ListMessages(filter *MessageFilter) (total int, messages []*Message, err error) {
+	return c.ListMessagesContext(context.Background(), filter)
+}
+
+// ListMessagesContext is like ListMessages, but with a context.
+func (c *Client) ListMessagesContext(ctx context.Context, filter *MessageFilter) (total int, messages []*Message, err error) {
 	v := url.Values{}
 	if filter.Page != 0 {
 		v.Set("Page", strconv.Itoa(filter.Page))
@@ -185,6 +249,36 @@ func (c *Client) ListMessages(filter *MessageFilter) (total int, messages []*Mes
 	if filter.Asc {
 		v.Set("Desc", "0")
 	}
+	if filter.Begin != 0 {
+		v.Set("Begin", strconv.FormatInt(filter.Begin, 10))
+	}
+	if filter.End != 0 {
+		v.Set("End", strconv.FormatInt(filter.End, 10))
+	}
+	if filter.Keyword != "" {
+		v.Set("Keyword", filter.Keyword)
+	}
+	if filter.To != "" {
+		v.Set("To", filter.To)
+	}
+	if filter.From != "" {
+		v.Set("From", filter.From)
+	}
+	if filter.Subject != "" {
+		v.Set("Subject", filter.Subject)
+	}
+	if filter.Attachments != nil {
+		v.Set("Attachments", formatBool(*filter.Attachments))
+	}
+	if filter.Starred != nil {
+		v.Set("Starred", formatBool(*filter.Starred))
+	}
+	if filter.Unread != nil {
+		v.Set("Unread", formatBool(*filter.Unread))
+	}
+	for _, id := range filter.ID {
+		v.Add("ID[]", id)
+	}
 	if filter.Conversation != "" {
 		v.Set("Conversation", filter.Conversation)
 	}
@@ -195,7 +289,7 @@ func (c *Client) ListMessages(filter *MessageFilter) (total int, messages []*Mes
 		v.Set("ExternalID", filter.ExternalID)
 	}
 
-	req, err := c.newRequest(http.MethodGet, "/messages?"+v.Encode(), nil)
+	req, err := c.newRequest(ctx, http.MethodGet, "/messages?"+v.Encode(), nil)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -212,6 +306,51 @@ func (c *Client) ListMessages(filter *MessageFilter) (total int, messages []*Mes
 	return respData.Total, respData.Messages, nil
 }
 
+// IterMessages returns an iterator walking through all pages of messages
+// matching filter, starting at filter.Page. filter isn't modified. Iteration
+// stops when yield returns false or after an error has been yielded.
+//
+// Messages arriving during the iteration shift pages, so messages already
+// yielded are skipped.
+func (c *Client) IterMessages(filter *MessageFilter) func(yield func(*Message, error) bool) {
+	return c.IterMessagesContext(context.Background(), filter)
+}
+
+// IterMessagesContext is like IterMessages, but with a context.
+func (c *Client) IterMessagesContext(ctx context.Context, filter *MessageFilter) func(yield func(*Message, error) bool) {
+	return func(yield func(*Message, error) bool) {
+		f := *filter
+		if f.PageSize == 0 {
+			f.PageSize = 150
+		}
+
+		seen := make(map[string]struct{})
+		for {
+			total, page, err := c.ListMessagesContext(ctx, &f)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+
+			for _, msg := range page {
+				if _, ok := seen[msg.ID]; ok {
+					continue
+				}
+				seen[msg.ID] = struct{}{}
+
+				if !yield(msg, nil) {
+					return
+				}
+			}
+
+			f.Page++
+			if len(page) == 0 || f.Page*f.PageSize >= total {
+				return
+			}
+		}
+	}
+}
+
 type MessageCount struct {
 	LabelID string
 	Total   int
@@ -219,11 +358,16 @@ type MessageCount struct {
 }
 
 func (c *Client) CountMessages(address string) ([]*MessageCount, error) {
+	return c.CountMessagesContext(context.Background(), address)
+}
+
+// CountMessagesContext is like CountMessages, but with a context.
+func (c *Client) CountMessagesContext(ctx context.Context, address string) ([]*MessageCount, error) {
 	v := url.Values{}
 	if address != "" {
 		v.Set("Address", address)
 	}
-	req, err := c.newRequest(http.MethodGet, "/messages/count?"+v.Encode(), nil)
+	req, err := c.newRequest(ctx, http.MethodGet, "/messages/count?"+v.Encode(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -240,7 +384,12 @@ func (c *Client) CountMessages(address string) ([]*MessageCount, error) {
 }
 
 func (c *Client) GetMessage(id string) (*Message, error) {
-	req, err := c.newRequest(http.MethodGet, "/messages/"+id, nil)
+	return c.GetMessageContext(context.Background(), id)
+}
+
+// GetMessageContext is like GetMessage, but with a context.
+func (c *Client) GetMessageContext(ctx context.Context, id string) (*Message, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/messages/"+id, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -259,6 +408,11 @@ func (c *Client) GetMessage(id string) (*Message, error) {
 // CreateDraftMessage creates a new draft message. ToList, CCList, BCCList,
 // Subject, Body and AddressID are required in msg.
 func (c *Client) CreateDraftMessage(msg *Message, parentID string) (*Message, error) {
+	return c.CreateDraftMessageContext(context.Background(), msg, parentID)
+}
+
+// CreateDraftMessageContext is like CreateDraftMessage, but with a context.
+func (c *Client) CreateDraftMessageContext(ctx context.Context, msg *Message, parentID string) (*Message, error) {
 	var actionPtr *MessageAction
 	if parentID != "" {
 		// TODO: support other actions
@@ -271,7 +425,7 @@ func (c *Client) CreateDraftMessage(msg *Message, parentID string) (*Message, er
 		ParentID string         `json:",omitempty"`
 		Action   *MessageAction `json:",omitempty"`
 	}{msg, parentID, actionPtr}
-	req, err := c.newJSONRequest(http.MethodPost, "/messages", &reqData)
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/messages", &reqData)
 	if err != nil {
 		return nil, err
 	}
@@ -288,10 +442,15 @@ func (c *Client) CreateDraftMessage(msg *Message, parentID string) (*Message, er
 }
 
 func (c *Client) UpdateDraftMessage(msg *Message) (*Message, error) {
+	return c.UpdateDraftMessageContext(context.Background(), msg)
+}
+
+// UpdateDraftMessageContext is like UpdateDraftMessage, but with a context.
+func (c *Client) UpdateDraftMessageContext(ctx context.Context, msg *Message) (*Message, error) {
 	reqData := struct {
 		Message *Message
 	}{msg}
-	req, err := c.newJSONRequest(http.MethodPut, "/messages/"+msg.ID, &reqData)
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/messages/"+msg.ID, &reqData)
 	if err != nil {
 		return nil, err
 	}
@@ -307,61 +466,118 @@ func (c *Client) UpdateDraftMessage(msg *Message) (*Message, error) {
 	return respData.Message, nil
 }
 
-func (c *Client) doMessages(action string, ids []string) error {
-	reqData := struct {
-		IDs []string
-	}{ids}
-	req, err := c.newJSONRequest(http.MethodPut, "/messages/"+action, &reqData)
-	if err != nil {
-		return err
+// MaxMessageIDs is the maximum number of message IDs accepted by bulk message
+// requests. Methods taking a list of message IDs split larger lists into
+// several requests.
+const MaxMessageIDs = 150
+
+// forEachChunk calls f with consecutive chunks of at most MaxMessageIDs IDs.
+// It doesn't call f if ids is empty. The remaining chunks are still sent after
+// a failure, so that as many messages as possible are updated, unless the API
+// is unreachable. The first error is returned.
+func forEachChunk(ids []string, f func(ids []string) error) error {
+	var firstErr error
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > MaxMessageIDs {
+			n = MaxMessageIDs
+		}
+		if err := f(ids[:n]); err != nil {
+			if IsUnreachable(err) {
+				return err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		ids = ids[n:]
 	}
+	return firstErr
+}
+
+func (c *Client) doMessages(ctx context.Context, action string, ids []string) error {
+	return forEachChunk(ids, func(ids []string) error {
+		reqData := struct {
+			IDs []string
+		}{ids}
+		req, err := c.newJSONRequest(ctx, http.MethodPut, "/messages/"+action, &reqData)
+		if err != nil {
+			return err
+		}
+
+		// TODO: the response contains one response per message
+		return c.doJSON(req, nil)
+	})
+}
+
+func (c *Client) doLabelMessages(ctx context.Context, action, labelID string, ids []string) error {
+	return forEachChunk(ids, func(ids []string) error {
+		reqData := struct {
+			LabelID string
+			IDs     []string
+		}{labelID, ids}
+		req, err := c.newJSONRequest(ctx, http.MethodPut, "/messages/"+action, &reqData)
+		if err != nil {
+			return err
+		}
 
-	// TODO: the response contains one response per message
-	return c.doJSON(req, nil)
+		// TODO: the response contains one response per message
+		return c.doJSON(req, nil)
+	})
 }
 
 func (c *Client) MarkMessagesRead(ids []string) error {
-	return c.doMessages("read", ids)
+	return c.MarkMessagesReadContext(context.Background(), ids)
+}
+
+// MarkMessagesReadContext is like MarkMessagesRead, but with a context.
+func (c *Client) MarkMessagesReadContext(ctx context.Context, ids []string) error {
+	return c.doMessages(ctx, "read", ids)
 }
 
 func (c *Client) MarkMessagesUnread(ids []string) error {
-	return c.doMessages("unread", ids)
+	return c.MarkMessagesUnreadContext(context.Background(), ids)
+}
+
+// MarkMessagesUnreadContext is like MarkMessagesUnread, but with a context.
+func (c *Client) MarkMessagesUnreadContext(ctx context.Context, ids []string) error {
+	return c.doMessages(ctx, "unread", ids)
 }
 
 func (c *Client) DeleteMessages(ids []string) error {
-	return c.doMessages("delete", ids)
+	return c.DeleteMessagesContext(context.Background(), ids)
+}
+
+// DeleteMessagesContext is like DeleteMessages, but with a context.
+func (c *Client) DeleteMessagesContext(ctx context.Context, ids []string) error {
+	return c.doMessages(ctx, "delete", ids)
 }
 
 func (c *Client) UndeleteMessages(ids []string) error {
-	return c.doMessages("undelete", ids)
+	return c.UndeleteMessagesContext(context.Background(), ids)
+}
+
+// UndeleteMessagesContext is like UndeleteMessages, but with a context.
+func (c *Client) UndeleteMessagesContext(ctx context.Context, ids []string) error {
+	return c.doMessages(ctx, "undelete", ids)
 }
 
 func (c *Client) LabelMessages(labelID string, ids []string) error {
-	reqData := struct {
-		LabelID string
-		IDs     []string
-	}{labelID, ids}
-	req, err := c.newJSONRequest(http.MethodPut, "/messages/label", &reqData)
-	if err != nil {
-		return err
-	}
+	return c.LabelMessagesContext(context.Background(), labelID, ids)
+}
 
-	// TODO: the response contains one response per message
-	return c.doJSON(req, nil)
+// LabelMessagesContext is like LabelMessages, but with a context.
+func (c *Client) LabelMessagesContext(ctx context.Context, labelID string, ids []string) error {
+	return c.doLabelMessages(ctx, "label", labelID, ids)
 }
 
 func (c *Client) UnlabelMessages(labelID string, ids []string) error {
-	reqData := struct {
-		LabelID string
-		IDs     []string
-	}{labelID, ids}
-	req, err := c.newJSONRequest(http.MethodPut, "/messages/unlabel", &reqData)
-	if err != nil {
-		return err
-	}
+	return c.UnlabelMessagesContext(context.Background(), labelID, ids)
+}
 
-	// TODO: the response contains one response per message
-	return c.doJSON(req, nil)
+// UnlabelMessagesContext is like UnlabelMessages, but with a context.
+func (c *Client) UnlabelMessagesContext(ctx context.Context, labelID string, ids []string) error {
+	return c.doLabelMessages(ctx, "unlabel", labelID, ids)
 }
 
 type MessageKeyPacket struct {
@@ -541,7 +757,7 @@ func serializeEncryptedKey(symKey *packet.EncryptedKey, pub *packet.PublicKey, c
 	return encoded.String(), nil
 }
 
-func (set *MessagePackageSet) AddInternal(addr string, pub *openpgp.Entity) (*MessagePackage, error) {
+func (set *MessagePackageSet) addEncrypted(t MessagePackageType, addr string, pub *openpgp.Entity) (*MessagePackage, error) {
 	config := &packet.Config{}
 
 	encKey, ok := encryptionKey(pub, config.Now())
@@ -563,9 +779,9 @@ func (set *MessagePackageSet) AddInternal(addr string, pub *openpgp.Entity) (*Me
 		attachmentKeys[att] = attKey
 	}
 
-	set.Type |= MessagePackageInternal
+	set.Type |= t
 	pkg := &MessagePackage{
-		Type:                 MessagePackageInternal,
+		Type:                 t,
 		BodyKeyPacket:        bodyKey,
 		AttachmentKeyPackets: attachmentKeys,
 		Signature:            set.signature,
@@ -574,17 +790,45 @@ func (set *MessagePackageSet) AddInternal(addr string, pub *openpgp.Entity) (*Me
 	return pkg, nil
 }
 
+func (set *MessagePackageSet) AddInternal(addr string, pub *openpgp.Entity) (*MessagePackage, error) {
+	return set.addEncrypted(MessagePackageInternal, addr, pub)
+}
+
+// AddInlinePGP adds an external recipient which will receive the message
+// encrypted with its public key.
+func (set *MessagePackageSet) AddInlinePGP(addr string, pub *openpgp.Entity) (*MessagePackage, error) {
+	return set.addEncrypted(MessagePackageInlinePGP, addr, pub)
+}
+
 type OutgoingMessage struct {
 	ID string
 
 	// Only if message expires
-	ExpirationTime int // Duration in seconds
+	ExpirationTime int `json:",omitempty"` // Duration in seconds
 
 	Packages []*MessagePackageSet
 }
 
+// SendStatusUnknownError is returned by SendMessage when the message may have
+// been sent, for instance because the request timed out.
+type SendStatusUnknownError struct {
+	Err error
+}
+
+func (err *SendStatusUnknownError) Error() string {
+	return fmt.Sprintf("unknown send status: %v", err.Err)
+}
+
+// SendMessage sends a draft. A draft is only sent once, so it's safe to call
+// SendMessage again with the same draft if a SendStatusUnknownError is
+// returned. Other errors mean that the message hasn't been sent.
 func (c *Client) SendMessage(msg *OutgoingMessage) (sent, parent *Message, err error) {
-	req, err := c.newJSONRequest(http.MethodPost, "/messages/"+msg.ID, msg)
+	return c.SendMessageContext(context.Background(), msg)
+}
+
+// SendMessageContext is like SendMessage, but with a context.
+func (c *Client) SendMessageContext(ctx context.Context, msg *OutgoingMessage) (sent, parent *Message, err error) {
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/messages/"+msg.ID, msg)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -594,7 +838,14 @@ func (c *Client) SendMessage(msg *OutgoingMessage) (sent, parent *Message, err e
 		Sent, Parent *Message
 	}
 	if err := c.doJSON(req, &respData); err != nil {
-		return nil, nil, err
+		// The draft may have been sent by this request or by a previous one
+		if draft, checkErr := c.GetMessageContext(ctx, msg.ID); checkErr == nil && draft.Type != MessageDraft {
+			return draft, nil, nil
+		}
+		if _, ok := err.(*APIError); ok {
+			return nil, nil, err
+		}
+		return nil, nil, &SendStatusUnknownError{err}
 	}
 
 	return respData.Sent, respData.Parent, nil
@@ -0,0 +1,470 @@
+package protonmail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func messageIDs(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("msg%v", i)
+	}
+	return ids
+}
+
+func TestLabelMessagesChunks(t *testing.T) {
+	tests := []struct {
+		n      int
+		chunks []int
+	}{
+		{0, nil},
+		{1, []int{1}},
+		{MaxMessageIDs, []int{MaxMessageIDs}},
+		{MaxMessageIDs + 1, []int{MaxMessageIDs, 1}},
+		{2*MaxMessageIDs + 10, []int{MaxMessageIDs, MaxMessageIDs, 10}},
+	}
+	for _, tc := range tests {
+		var chunks []int
+		var got []string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				LabelID string
+				IDs     []string
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Errorf("invalid request body: %v", err)
+			}
+			if r.URL.Path != "/messages/label" || body.LabelID != LabelStarred {
+				t.Errorf("unexpected request %v with label %q", r.URL.Path, body.LabelID)
+			}
+			chunks = append(chunks, len(body.IDs))
+			got = append(got, body.IDs...)
+			w.Write([]byte(`{"Code":1000}`))
+		}))
+
+		c := &Client{RootURL: srv.URL, HTTPClient: srv.Client()}
+		ids := messageIDs(tc.n)
+		if err := c.LabelMessages(LabelStarred, ids); err != nil {
+			t.Errorf("LabelMessages(%v IDs) = %v", tc.n, err)
+		}
+		srv.Close()
+
+		if !reflect.DeepEqual(chunks, tc.chunks) {
+			t.Errorf("LabelMessages(%v IDs) sent chunks %v, want %v", tc.n, chunks, tc.chunks)
+		}
+		if tc.n > 0 && !reflect.DeepEqual(got, ids) {
+			t.Errorf("LabelMessages(%v IDs) sent different IDs", tc.n)
+		}
+	}
+}
+
+func TestBulkMessageRequests(t *testing.T) {
+	tests := []struct {
+		path    string
+		labelID string
+		do      func(c *Client, ids []string) error
+	}{
+		{"/messages/read", "", (*Client).MarkMessagesRead},
+		{"/messages/unread", "", (*Client).MarkMessagesUnread},
+		{"/messages/delete", "", (*Client).DeleteMessages},
+		{"/messages/undelete", "", (*Client).UndeleteMessages},
+		{"/messages/label", LabelStarred, func(c *Client, ids []string) error { return c.LabelMessages(LabelStarred, ids) }},
+		{"/messages/unlabel", LabelStarred, func(c *Client, ids []string) error { return c.UnlabelMessages(LabelStarred, ids) }},
+	}
+	for _, tc := range tests {
+		var chunks []int
+		c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				LabelID string
+				IDs     []string
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			if r.Method != http.MethodPut || r.URL.Path != tc.path || body.LabelID != tc.labelID {
+				t.Errorf("%v: request = %v %v with label %q", tc.path, r.Method, r.URL.Path, body.LabelID)
+			}
+			chunks = append(chunks, len(body.IDs))
+			w.Write([]byte(`{"Code":1000}`))
+		})
+		if err := tc.do(c, messageIDs(MaxMessageIDs+1)); err != nil {
+			t.Errorf("%v: request = %v", tc.path, err)
+		}
+		if want := []int{MaxMessageIDs, 1}; !reflect.DeepEqual(chunks, want) {
+			t.Errorf("%v: sent chunks %v, want %v", tc.path, chunks, want)
+		}
+	}
+}
+
+func TestMarkMessagesReadPartialFailure(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"Code":2001,"Error":"Invalid ID"}`))
+			return
+		}
+		w.Write([]byte(`{"Code":1000}`))
+	}))
+	defer srv.Close()
+
+	c := &Client{RootURL: srv.URL, HTTPClient: srv.Client(), MaxRetries: -1}
+	err := c.MarkMessagesRead(messageIDs(3 * MaxMessageIDs))
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != 2001 {
+		t.Errorf("MarkMessagesRead() = %v, want the API error of the first chunk", err)
+	}
+	if requests != 3 {
+		t.Errorf("MarkMessagesRead() sent %v requests, want 3", requests)
+	}
+}
+
+func TestForEachChunkUnreachable(t *testing.T) {
+	unreachable := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	calls := 0
+	err := forEachChunk(messageIDs(3*MaxMessageIDs), func(ids []string) error {
+		calls++
+		return unreachable
+	})
+	if err != unreachable {
+		t.Errorf("forEachChunk() = %v, want %v", err, unreachable)
+	}
+	if calls != 1 {
+		t.Errorf("forEachChunk() called f %v times, want 1", calls)
+	}
+}
+
+func TestMessagePackageSetAddEncrypted(t *testing.T) {
+	sender := newTestEntity(t)
+	rcpt := newTestEntity(t)
+
+	tests := []struct {
+		name string
+		add  func(set *MessagePackageSet, addr string, pub *openpgp.Entity) (*MessagePackage, error)
+		want MessagePackageType
+	}{
+		{"internal", (*MessagePackageSet).AddInternal, MessagePackageInternal},
+		{"inline PGP", (*MessagePackageSet).AddInlinePGP, MessagePackageInlinePGP},
+	}
+	for _, tc := range tests {
+		set := NewMessagePackageSet(nil)
+		w, err := set.Encrypt("text/plain", sender)
+		if err != nil {
+			t.Fatalf("%v: Encrypt() = %v", tc.name, err)
+		}
+		w.Write([]byte("Hello"))
+		if err := w.Close(); err != nil {
+			t.Fatalf("%v: Close() = %v", tc.name, err)
+		}
+
+		pkg, err := tc.add(set, "rcpt@example.org", rcpt)
+		if err != nil {
+			t.Errorf("%v: add() = %v", tc.name, err)
+			continue
+		}
+		if pkg.Type != tc.want || set.Type != tc.want {
+			t.Errorf("%v: types = %v, %v, want %v", tc.name, pkg.Type, set.Type, tc.want)
+		}
+		if set.Addresses["rcpt@example.org"] != pkg {
+			t.Errorf("%v: package isn't in the set", tc.name)
+		}
+
+		// The recipient can decrypt the body with its key packet
+		keyPacket, _ := base64.StdEncoding.DecodeString(pkg.BodyKeyPacket)
+		body, _ := base64.StdEncoding.DecodeString(set.Body)
+		keyRing := openpgp.EntityList{rcpt, sender}
+		md, err := openpgp.ReadMessage(bytes.NewReader(append(keyPacket, body...)), keyRing, nil, nil)
+		if err != nil {
+			t.Errorf("%v: openpgp.ReadMessage() = %v", tc.name, err)
+			continue
+		}
+		b, err := ioutil.ReadAll(md.UnverifiedBody)
+		if err != nil {
+			t.Errorf("%v: reading body = %v", tc.name, err)
+		} else if string(b) != "Hello" {
+			t.Errorf("%v: body = %q, want %q", tc.name, b, "Hello")
+		}
+		if md.SignatureError != nil || md.SignedBy == nil {
+			t.Errorf("%v: body isn't signed by the sender: %v", tc.name, md.SignatureError)
+		}
+	}
+}
+
+// encryptSigned returns s encrypted to to and signed by signer, armored.
+func encryptSigned(t *testing.T, to, signer *openpgp.Entity, s string) string {
+	var b bytes.Buffer
+	aw, err := armor.Encode(&b, "PGP MESSAGE", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := openpgp.Encrypt(aw, []*openpgp.Entity{to}, signer, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(s))
+	w.Close()
+	aw.Close()
+	return b.String()
+}
+
+func TestMessageCheckSignature(t *testing.T) {
+	e := newTestEntity(t)
+	signer := newTestEntity(t)
+	signed := encryptSigned(t, e, signer, "Hello")
+	fingerprint := fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint)
+
+	tests := []struct {
+		name            string
+		msg             *Message
+		keyRing         openpgp.EntityList
+		want            SignatureStatus
+		wantFingerprint string
+	}{
+		{
+			name: "unencrypted",
+			msg:  &Message{IsEncrypted: MessageUnencrypted, Body: "Hello"},
+			want: SignatureNone,
+		},
+		{
+			name:    "unsigned",
+			msg:     &Message{IsEncrypted: MessageEncryptedInternal, Body: encryptArmored(t, e, "Hello")},
+			keyRing: openpgp.EntityList{e},
+			want:    SignatureNone,
+		},
+		{
+			name:            "valid",
+			msg:             &Message{IsEncrypted: MessageEncryptedInternal, Body: signed},
+			keyRing:         openpgp.EntityList{e, signer},
+			want:            SignatureValid,
+			wantFingerprint: fingerprint,
+		},
+		{
+			name:    "unknown key",
+			msg:     &Message{IsEncrypted: MessageEncryptedInternal, Body: signed},
+			keyRing: openpgp.EntityList{e},
+			want:    SignatureUnknownKey,
+		},
+	}
+	for _, tc := range tests {
+		// Stale values must be overwritten
+		tc.msg.SignatureFingerprint = "stale"
+
+		md, err := tc.msg.Read(tc.keyRing, nil)
+		if err != nil {
+			t.Errorf("%v: Read() = %v", tc.name, err)
+			continue
+		}
+		if b, err := ioutil.ReadAll(md.UnverifiedBody); err != nil || string(b) != "Hello" {
+			t.Errorf("%v: body = %q, %v", tc.name, b, err)
+		}
+		tc.msg.CheckSignature(md)
+		if tc.msg.SignatureStatus != tc.want || tc.msg.SignatureFingerprint != tc.wantFingerprint {
+			t.Errorf("%v: CheckSignature() set %v %q, want %v %q", tc.name, tc.msg.SignatureStatus, tc.msg.SignatureFingerprint, tc.want, tc.wantFingerprint)
+		}
+	}
+
+	msg := new(Message)
+	msg.CheckSignature(&openpgp.MessageDetails{
+		IsSigned:       true,
+		SignedBy:       &openpgp.Key{PublicKey: signer.PrimaryKey},
+		SignatureError: errors.New("bad signature"),
+	})
+	if msg.SignatureStatus != SignatureInvalid {
+		t.Errorf("CheckSignature() with a signature error set %v, want %v", msg.SignatureStatus, SignatureInvalid)
+	}
+}
+
+func TestIterMessages(t *testing.T) {
+	tests := []struct {
+		name string
+		// total is the number of messages, arrivals is the number of
+		// messages arriving after the first page has been listed
+		total, arrivals int
+		pageSize        int
+		stopAfter       int
+		failPage        int
+		want            int
+		wantErr         bool
+	}{
+		{name: "empty", pageSize: 2},
+		{name: "single page", total: 2, pageSize: 5, want: 2},
+		{name: "exact pages", total: 6, pageSize: 2, want: 6},
+		{name: "partial last page", total: 5, pageSize: 2, want: 5},
+		{name: "default page size", total: 200, want: 200},
+		{name: "arrivals", total: 5, arrivals: 1, pageSize: 2, want: 5},
+		{name: "stop", total: 6, pageSize: 2, stopAfter: 3, want: 3},
+		{name: "error", total: 6, pageSize: 2, failPage: 1, want: 2, wantErr: true},
+	}
+	for _, tc := range tests {
+		var ids []string
+		for i := 0; i < tc.total; i++ {
+			ids = append(ids, fmt.Sprintf("msg%v", i))
+		}
+
+		var pageSizes []string
+		c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			page, _ := strconv.Atoi(q.Get("Page"))
+			pageSize, _ := strconv.Atoi(q.Get("PageSize"))
+			pageSizes = append(pageSizes, q.Get("PageSize"))
+			if tc.failPage != 0 && page == tc.failPage {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"Code":2000,"Error":"Internal error"}`))
+				return
+			}
+
+			var msgs []*Message
+			for i := page * pageSize; i < len(ids) && i < (page+1)*pageSize; i++ {
+				msgs = append(msgs, &Message{ID: ids[i]})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"Code": 1000, "Total": len(ids), "Messages": msgs})
+
+			if page == 0 {
+				// New messages are listed first
+				for i := 0; i < tc.arrivals; i++ {
+					ids = append([]string{fmt.Sprintf("new%v", i)}, ids...)
+				}
+			}
+		})
+
+		filter := &MessageFilter{PageSize: tc.pageSize}
+		var got []string
+		var err error
+		c.IterMessages(filter)(func(msg *Message, iterErr error) bool {
+			if iterErr != nil {
+				err = iterErr
+				return false
+			}
+			got = append(got, msg.ID)
+			return tc.stopAfter == 0 || len(got) < tc.stopAfter
+		})
+
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%v: IterMessages() error = %v, want error: %v", tc.name, err, tc.wantErr)
+		}
+		seen := make(map[string]bool)
+		for _, id := range got {
+			if seen[id] {
+				t.Errorf("%v: IterMessages() yielded %v twice", tc.name, id)
+			}
+			seen[id] = true
+		}
+		if len(got) != tc.want {
+			t.Errorf("%v: IterMessages() yielded %v messages, want %v", tc.name, len(got), tc.want)
+		}
+		if filter.Page != 0 {
+			t.Errorf("%v: IterMessages() modified the filter", tc.name)
+		}
+		if tc.pageSize == 0 && len(pageSizes) > 0 && pageSizes[0] != "150" {
+			t.Errorf("%v: IterMessages() requested pages of %v messages, want 150", tc.name, pageSizes[0])
+		}
+	}
+}
+
+func TestSendMessage(t *testing.T) {
+	const (
+		sendOK = iota
+		sendRejected
+		sendDropped
+	)
+	tests := []struct {
+		name        string
+		send        int
+		draftType   MessageType
+		draftErr    bool
+		wantSent    bool
+		wantAPIErr  bool
+		wantUnknown bool
+	}{
+		{name: "sent", send: sendOK, wantSent: true},
+		{name: "rejected", send: sendRejected, draftType: MessageDraft, wantAPIErr: true},
+		{name: "rejected but sent", send: sendRejected, draftType: MessageSent, wantSent: true},
+		{name: "dropped", send: sendDropped, draftType: MessageDraft, wantUnknown: true},
+		{name: "dropped but sent", send: sendDropped, draftType: MessageSent, wantSent: true},
+		{name: "dropped and check failed", send: sendDropped, draftErr: true, wantUnknown: true},
+	}
+	for _, tc := range tests {
+		c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/messages/draft1" {
+				http.NotFound(w, r)
+				return
+			}
+
+			if r.Method == http.MethodGet {
+				if tc.draftErr {
+					w.WriteHeader(http.StatusInternalServerError)
+					w.Write([]byte(`{"Code":2000,"Error":"Internal error"}`))
+					return
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{"Code": 1000, "Message": &Message{ID: "draft1", Type: tc.draftType}})
+				return
+			}
+
+			switch tc.send {
+			case sendOK:
+				json.NewEncoder(w).Encode(map[string]interface{}{"Code": 1000, "Sent": &Message{ID: "draft1", Type: MessageSent}})
+			case sendRejected:
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				w.Write([]byte(`{"Code":2001,"Error":"Invalid recipient"}`))
+			case sendDropped:
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				conn.Close()
+			}
+		})
+
+		sent, _, err := c.SendMessage(&OutgoingMessage{ID: "draft1"})
+		var apiErr *APIError
+		var unknownErr *SendStatusUnknownError
+		switch {
+		case tc.wantSent:
+			if err != nil {
+				t.Errorf("%v: SendMessage() = %v", tc.name, err)
+			} else if sent == nil || sent.ID != "draft1" {
+				t.Errorf("%v: SendMessage() returned %v, want the sent message", tc.name, sent)
+			}
+		case tc.wantAPIErr:
+			if !errors.As(err, &apiErr) {
+				t.Errorf("%v: SendMessage() = %v, want an API error", tc.name, err)
+			}
+		case tc.wantUnknown:
+			if !errors.As(err, &unknownErr) {
+				t.Errorf("%v: SendMessage() = %v, want SendStatusUnknownError", tc.name, err)
+			}
+		}
+	}
+}
+
+func TestOutgoingMessageExpiration(t *testing.T) {
+	tests := []struct {
+		expirationTime int
+		want           string
+	}{
+		{0, `{"ID":"draft1","Packages":null}`},
+		{3600, `{"ID":"draft1","ExpirationTime":3600,"Packages":null}`},
+	}
+	for _, tc := range tests {
+		b, err := json.Marshal(&OutgoingMessage{ID: "draft1", ExpirationTime: tc.expirationTime})
+		if err != nil {
+			t.Errorf("json.Marshal() = %v", err)
+		} else if string(b) != tc.want {
+			t.Errorf("json.Marshal() with expiration time %v = %v, want %v", tc.expirationTime, string(b), tc.want)
+		}
+	}
+}
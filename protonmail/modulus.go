@@ -0,0 +1,211 @@
+package protonmail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// SRP moduli are signed by ProtonMail with an Ed25519 key. The openpgp package
+// doesn't support EdDSA, so the signature is checked here.
+
+// defaultModulusKey is ProtonMail's public key signing SRP moduli, from
+// https://github.com/ProtonMail/go-srp.
+const defaultModulusKey = `-----BEGIN PGP PUBLIC KEY BLOCK-----
+
+xjMEXAHLgxYJKwYBBAHaRw8BAQdAFurWXXwjTemqjD7CXjXVyKf0of7n9Ctm
+L8v9enkzggHNEnByb3RvbkBzcnAubW9kdWx1c8J3BBAWCgApBQJcAcuDBgsJ
+BwgDAgkQNQWFxOlRjyYEFQgKAgMWAgECGQECGwMCHgEAAPGRAP9sauJsW12U
+MnTQUZpsbJb53d0Wv55mZIIiJL2XulpWPQD/V6NglBd96lZKBmInSXX/kXat
+Sv+y0io+LR8i2+jV+AbOOARcAcuDEgorBgEEAZdVAQUBAQdAeJHUz1c9+KfE
+kSIgcBRE3WuXC4oj5a2/U3oASExGDW4DAQgHwmEEGBYIABMFAlwBy4MJEDUF
+hcTpUY8mAhsMAAD/XQD8DxNI6E78meodQI+wLsrKLeHn32iLvUqJbVDhfWSU
+WO4BAMcm1u02t4VKw++ttECPt+HUgPUq5pqQWe5Q2cW4TMsE
+=Y4Mw
+-----END PGP PUBLIC KEY BLOCK-----`
+
+// ed25519OID is the OID of the Ed25519 curve in OpenPGP keys.
+var ed25519OID = []byte{0x2b, 0x06, 0x01, 0x04, 0x01, 0xda, 0x47, 0x0f, 0x01}
+
+const pubKeyAlgoEdDSA = 22
+
+// ErrInvalidModulusSignature is returned when the SRP modulus isn't signed or
+// its signature can't be verified with the modulus key.
+var ErrInvalidModulusSignature = errors.New("invalid SRP modulus signature")
+
+// readPackets returns the raw OpenPGP packets of r.
+func readPackets(r io.Reader) ([]*packet.OpaquePacket, error) {
+	var packets []*packet.OpaquePacket
+	or := packet.NewOpaqueReader(r)
+	for {
+		p, err := or.Next()
+		if err == io.EOF {
+			return packets, nil
+		} else if err != nil {
+			return nil, err
+		}
+		packets = append(packets, p)
+	}
+}
+
+// parseEdDSAPublicKey returns the Ed25519 key of a public key packet.
+func parseEdDSAPublicKey(b []byte) (ed25519.PublicKey, error) {
+	// Version, creation time, algorithm, OID length
+	if len(b) < 7 || b[0] != 4 || b[5] != pubKeyAlgoEdDSA {
+		return nil, errors.New("not a v4 EdDSA public key")
+	}
+	n := int(b[6])
+	if len(b) < 7+n || !bytes.Equal(b[7:7+n], ed25519OID) {
+		return nil, errors.New("not an Ed25519 public key")
+	}
+	// The MPI contains a 0x40 prefix followed by the point
+	mpi := b[7+n:]
+	if len(mpi) != 2+1+ed25519.PublicKeySize || mpi[2] != 0x40 {
+		return nil, errors.New("invalid Ed25519 public key")
+	}
+	return ed25519.PublicKey(mpi[3:]), nil
+}
+
+func readMPI(b []byte) (mpi, rest []byte, err error) {
+	if len(b) < 2 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	n := (int(binary.BigEndian.Uint16(b)) + 7) / 8
+	if len(b) < 2+n {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	return b[2 : 2+n], b[2+n:], nil
+}
+
+// verifyEdDSASignature checks a v4 EdDSA signature packet over data. data
+// must already contain the prefix required by the signature type, if any.
+func verifyEdDSASignature(pub ed25519.PublicKey, sig, data []byte) error {
+	// Version, type, algorithms, hashed subpackets length
+	if len(sig) < 6 || sig[0] != 4 || sig[2] != pubKeyAlgoEdDSA {
+		return errors.New("not a v4 EdDSA signature")
+	}
+	var h crypto.Hash
+	switch sig[3] {
+	case 8:
+		h = crypto.SHA256
+	case 10:
+		h = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported signature hash algorithm %v", sig[3])
+	}
+
+	hashedLen := 6 + int(binary.BigEndian.Uint16(sig[4:]))
+	if len(sig) < hashedLen+2 {
+		return io.ErrUnexpectedEOF
+	}
+	hashed := sig[:hashedLen]
+	rest := sig[hashedLen:]
+	unhashedLen := 2 + int(binary.BigEndian.Uint16(rest))
+	if len(rest) < unhashedLen+2 {
+		return io.ErrUnexpectedEOF
+	}
+	rest = rest[unhashedLen:]
+	prefix, rest := rest[:2], rest[2:]
+
+	r, rest, err := readMPI(rest)
+	if err != nil {
+		return err
+	}
+	s, _, err := readMPI(rest)
+	if err != nil {
+		return err
+	}
+	if len(r) > 32 || len(s) > 32 {
+		return errors.New("invalid EdDSA signature")
+	}
+
+	hasher := h.New()
+	hasher.Write(data)
+	hasher.Write(hashed)
+	var trailer [6]byte
+	trailer[0], trailer[1] = 4, 0xff
+	binary.BigEndian.PutUint32(trailer[2:], uint32(len(hashed)))
+	hasher.Write(trailer[:])
+	digest := hasher.Sum(nil)
+	if !bytes.Equal(digest[:2], prefix) {
+		return ErrInvalidModulusSignature
+	}
+
+	signature := make([]byte, ed25519.SignatureSize)
+	copy(signature[32-len(r):32], r)
+	copy(signature[64-len(s):], s)
+	if !ed25519.Verify(pub, digest, signature) {
+		return ErrInvalidModulusSignature
+	}
+	return nil
+}
+
+// readModulusKey returns the Ed25519 key of an armored OpenPGP public key.
+func readModulusKey(armored string) (ed25519.PublicKey, error) {
+	block, err := armor.Decode(strings.NewReader(armored))
+	if err != nil {
+		return nil, err
+	}
+	packets, err := readPackets(block.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(packets) == 0 || packets[0].Tag != 6 {
+		return nil, errors.New("missing public key packet")
+	}
+	return parseEdDSAPublicKey(packets[0].Contents)
+}
+
+// DecodeModulus verifies the signature of a clearsigned SRP modulus, as
+// returned by the API, and returns the decoded modulus.
+func DecodeModulus(signed string) ([]byte, error) {
+	return DecodeModulusWithKey(signed, defaultModulusKey)
+}
+
+// DecodeModulusWithKey is like DecodeModulus, but verifies the signature with
+// an armored Ed25519 public key instead of ProtonMail's.
+func DecodeModulusWithKey(signed, armoredKey string) ([]byte, error) {
+	block, _ := clearsign.Decode([]byte(signed))
+	if block == nil {
+		return nil, ErrInvalidModulusSignature
+	}
+
+	pub, err := readModulusKey(armoredKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read modulus key: %v", err)
+	}
+
+	b, err := ioutil.ReadAll(block.ArmoredSignature.Body)
+	if err != nil {
+		return nil, ErrInvalidModulusSignature
+	}
+	packets, err := readPackets(bytes.NewReader(b))
+	if err != nil {
+		return nil, ErrInvalidModulusSignature
+	}
+	verified := false
+	for _, p := range packets {
+		if p.Tag == 2 && verifyEdDSASignature(pub, p.Contents, block.Bytes) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, ErrInvalidModulusSignature
+	}
+
+	return base64.StdEncoding.DecodeString(string(block.Plaintext))
+}
@@ -0,0 +1,60 @@
+package protonmail
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReadModulusKey(t *testing.T) {
+	if _, err := readModulusKey(defaultModulusKey); err != nil {
+		t.Errorf("readModulusKey(defaultModulusKey) = %v", err)
+	}
+
+	_, armored := newTestModulusKey(t)
+	if _, err := readModulusKey(armored); err != nil {
+		t.Errorf("readModulusKey() = %v", err)
+	}
+
+	// RSA keys aren't supported
+	e := newTestEntity(t)
+	var b bytes.Buffer
+	if err := e.PrimaryKey.Serialize(&b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readModulusKey(armorString(t, "PGP PUBLIC KEY BLOCK", b.Bytes())); err == nil {
+		t.Errorf("readModulusKey() with an RSA key = nil, want an error")
+	}
+}
+
+func TestDecodeModulus(t *testing.T) {
+	key, armored := newTestModulusKey(t)
+	otherKey, _ := newTestModulusKey(t)
+	modulus := testModulus()
+	signed := signModulus(t, key, modulus)
+
+	tests := []struct {
+		name    string
+		signed  string
+		key     string
+		wantErr error
+	}{
+		{name: "valid", signed: signed, key: armored},
+		{name: "other key", signed: signModulus(t, otherKey, modulus), key: armored, wantErr: ErrInvalidModulusSignature},
+		{name: "ProtonMail key", signed: signed, key: defaultModulusKey, wantErr: ErrInvalidModulusSignature},
+		{name: "tampered", signed: strings.Replace(signed, "\n\n", "\n\nAAAA", 1), key: armored, wantErr: ErrInvalidModulusSignature},
+		{name: "not signed", signed: "AAAA", key: armored, wantErr: ErrInvalidModulusSignature},
+	}
+	for _, tc := range tests {
+		got, err := DecodeModulusWithKey(tc.signed, tc.key)
+		if err != tc.wantErr {
+			t.Errorf("%v: DecodeModulusWithKey() = %v, want %v", tc.name, err, tc.wantErr)
+		} else if err == nil && !bytes.Equal(got, modulus) {
+			t.Errorf("%v: DecodeModulusWithKey() returned the wrong modulus", tc.name)
+		}
+	}
+
+	if _, err := DecodeModulusWithKey(signed, "invalid"); err == nil || err == ErrInvalidModulusSignature {
+		t.Errorf("DecodeModulusWithKey() with an invalid key = %v, want a key error", err)
+	}
+}
@@ -3,14 +3,23 @@ package protonmail
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log/slog"
+	mathrand "math/rand"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/openpgp"
+
+	"github.com/emersion/hydroxide/metrics"
 )
 
 const Version = 3
@@ -24,10 +33,14 @@ type resp struct {
 
 func (r *resp) Err() error {
 	if err := r.RawAPIError; err != nil {
-		return &APIError{
+		apiErr := &APIError{
 			Code:    r.Code,
 			Message: err.Message,
 		}
+		if r.Code == codeHumanVerificationRequired {
+			return newHumanVerificationError(apiErr, err.Details)
+		}
+		return apiErr
 	}
 	return nil
 }
@@ -38,18 +51,76 @@ type maybeError interface {
 
 type RawAPIError struct {
 	Message string `json:"Error"`
+	Details json.RawMessage
 }
 
 type APIError struct {
 	Code    int
 	Message string
+	// HTTPStatus is the status code of the HTTP response
+	HTTPStatus int
 }
 
 func (err *APIError) Error() string {
+	if err.Code == 0 {
+		return err.Message
+	}
 	return fmt.Sprintf("[%v] %v", err.Code, err.Message)
 }
 
+// Well-known API error codes.
+const (
+	codePasswordWrong  = 8002
+	codeTwoFactorWrong = 8003
+)
+
+var (
+	// ErrInvalidCredentials matches API errors returned when logging in with
+	// a wrong username or password.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrTwoFactorRequired is returned by Auth when the account requires a
+	// TOTP code and none has been provided.
+	ErrTwoFactorRequired = errors.New("a two-factor code is required")
+	// ErrInvalidTwoFactorCode matches API errors returned when logging in with
+	// a wrong two-factor code.
+	ErrInvalidTwoFactorCode = errors.New("invalid two-factor code")
+	// ErrRateLimited matches API errors returned when too many requests have
+	// been sent, after all retries have failed.
+	ErrRateLimited = errors.New("too many requests, try again later")
+	// ErrMessageTooLarge matches API errors returned when an upload exceeds
+	// the maximum size.
+	ErrMessageTooLarge = errors.New("message too large")
+)
+
+// Is allows API errors to be compared with ErrInvalidCredentials,
+// ErrInvalidTwoFactorCode, ErrRateLimited and ErrMessageTooLarge using
+// errors.Is.
+func (err *APIError) Is(target error) bool {
+	switch target {
+	case ErrInvalidCredentials:
+		return err.Code == codePasswordWrong
+	case ErrInvalidTwoFactorCode:
+		return err.Code == codeTwoFactorWrong
+	case ErrRateLimited:
+		return err.HTTPStatus == http.StatusTooManyRequests
+	case ErrMessageTooLarge:
+		return err.HTTPStatus == http.StatusRequestEntityTooLarge
+	}
+	return false
+}
+
+// IsUnreachable checks whether a request failed because the API couldn't be
+// reached, e.g. because the network is down.
+func IsUnreachable(err error) bool {
+	_, ok := err.(net.Error)
+	return ok
+}
+
 // Client is a ProtonMail API client.
+//
+// Methods taking a context.Context use it for all the HTTP requests they send,
+// including the download of response bodies. Methods without a context use
+// context.Background().
 type Client struct {
 	RootURL    string
 	AppVersion string
@@ -60,9 +131,38 @@ type Client struct {
 	HTTPClient *http.Client
 	ReAuth     func() error
 
+	// MaxRetries is the maximum number of times a request is retried when the
+	// server is rate-limiting or failing. If zero, DefaultMaxRetries is used. To
+	// disable retries, set it to a negative value.
+	MaxRetries int
+	// RetryDelay is the base delay of the exponential backoff used when the
+	// server doesn't send a Retry-After header. If zero, DefaultRetryDelay is
+	// used.
+	RetryDelay time.Duration
+	// AttachmentParallelism is the maximum number of attachments downloaded
+	// concurrently, e.g. by ReadAttachments. If zero,
+	// DefaultAttachmentParallelism is used.
+	AttachmentParallelism int
+	// Logger is used to log API calls and warnings. If nil, slog.Default()
+	// is used.
+	Logger *slog.Logger
+	// AuthStage, if set, is called with a short description of each
+	// authentication step as it succeeds.
+	AuthStage func(stage string)
+	// RateLimiter, if set, delays requests to stay below a rate limit.
+	RateLimiter *RateLimiter
+	// ModulusKey is the armored public key used to verify the signature of SRP
+	// moduli. If empty, ProtonMail's key is used.
+	ModulusKey string
+	// HumanVerification, if set, is sent with authentication requests to
+	// complete a human verification challenge, see HumanVerificationError.
+	HumanVerification *HumanVerification
+
 	uid         string
 	accessToken string
 	keyRing     openpgp.EntityList
+	// keyPassphrase is the passphrase used to unlock keyRing
+	keyPassphrase []byte
 }
 
 func (c *Client) setRequestAuthorization(req *http.Request) {
@@ -72,8 +172,8 @@ func (c *Client) setRequestAuthorization(req *http.Request) {
 	}
 }
 
-func (c *Client) newRequest(method, path string, body io.Reader) (*http.Request, error) {
-	req, err := http.NewRequest(method, c.RootURL+path, body)
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.RootURL+path, body)
 	if err != nil {
 		return nil, err
 	}
@@ -84,7 +184,7 @@ func (c *Client) newRequest(method, path string, body io.Reader) (*http.Request,
 	return req, nil
 }
 
-func (c *Client) newJSONRequest(method, path string, body interface{}) (*http.Request, error) {
+func (c *Client) newJSONRequest(ctx context.Context, method, path string, body interface{}) (*http.Request, error) {
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(body); err != nil {
 		return nil, err
@@ -93,7 +193,7 @@ func (c *Client) newJSONRequest(method, path string, body interface{}) (*http.Re
 
 	//log.Printf(">> %v %v\n%v", method, path, string(b))
 
-	req, err := c.newRequest(method, path, bytes.NewReader(b))
+	req, err := c.newRequest(ctx, method, path, bytes.NewReader(b))
 	if err != nil {
 		return nil, err
 	}
@@ -105,13 +205,160 @@ func (c *Client) newJSONRequest(method, path string, body interface{}) (*http.Re
 	return req, nil
 }
 
+const (
+	DefaultMaxRetries            = 3
+	DefaultRetryDelay            = time.Second
+	DefaultAttachmentParallelism = 4
+)
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryDelay returns the duration to wait before retrying a request. It
+// returns false if the request must not be retried.
+func (c *Client) retryDelay(req *http.Request, resp *http.Response, attempt int) (time.Duration, bool) {
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		// The request hasn't been processed, it's always safe to retry
+		if v := resp.Header.Get("Retry-After"); v != "" {
+			if sec, err := strconv.Atoi(v); err == nil && sec >= 0 {
+				return time.Duration(sec) * time.Second, true
+			}
+			if t, err := http.ParseTime(v); err == nil {
+				return time.Until(t), true
+			}
+		}
+	case resp.StatusCode/100 == 5:
+		// The request may have been partially processed
+		if !isIdempotent(req.Method) {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+
+	base := c.RetryDelay
+	if base == 0 {
+		base = DefaultRetryDelay
+	}
+	delay := base << uint(attempt)
+	// Add up to 50% of jitter
+	delay += time.Duration(mathrand.Int63n(int64(delay)/2 + 1))
+	return delay, true
+}
+
+// rewindBody resets the request body so that the request can be sent again.
+func rewindBody(req *http.Request) error {
+	if req.Body == nil {
+		return nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return err
+	}
+	req.Body = body
+	return nil
+}
+
+func (c *Client) doWithRetry(httpClient *http.Client, req *http.Request) (*http.Response, error) {
+	maxRetries := c.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = DefaultMaxRetries
+	}
+	canRetry := req.Body == nil || req.GetBody != nil
+
+	for attempt := 0; ; attempt++ {
+		if err := c.RateLimiter.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+
+		resp, err := httpClient.Do(req)
+		if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+			metrics.APIRateLimited.Inc()
+		}
+		if err != nil || attempt >= maxRetries || !canRetry {
+			return resp, err
+		}
+
+		delay, ok := c.retryDelay(req, resp, attempt)
+		if !ok {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		if err := rewindBody(req); err != nil {
+			return nil, err
+		}
+
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-req.Context().Done():
+			t.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// metricsEndpoint replaces IDs in an API path, so that the number of distinct
+// endpoints in metrics stays low.
+func metricsEndpoint(path string) string {
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		if len(part) > 32 || strings.ContainsAny(part, "=0123456789") {
+			parts[i] = ":id"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+func (c *Client) authStage(stage string) {
+	if c.AuthStage != nil {
+		c.AuthStage(stage)
+	}
+}
+
+func (c *Client) logger() *slog.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return slog.Default()
+}
+
+// doLogged sends a request and logs it. Headers aren't logged, so that auth
+// tokens aren't leaked.
+func (c *Client) doLogged(httpClient *http.Client, req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := c.doWithRetry(httpClient, req)
+	duration := time.Since(start)
+
+	endpoint := metricsEndpoint(req.URL.Path)
+	metrics.APIRequestDuration.Observe(duration.Seconds(), req.Method, endpoint)
+
+	attrs := []interface{}{"method", req.Method, "path", req.URL.Path, "duration", duration}
+	if err != nil {
+		metrics.APIRequests.Inc(req.Method, endpoint, "error")
+		c.logger().Debug("API request failed", append(attrs, "err", err)...)
+	} else {
+		metrics.APIRequests.Inc(req.Method, endpoint, strconv.Itoa(resp.StatusCode))
+		c.logger().Debug("API request", append(attrs, "status", resp.StatusCode)...)
+	}
+	return resp, err
+}
+
 func (c *Client) do(req *http.Request) (*http.Response, error) {
 	httpClient := c.HTTPClient
 	if httpClient == nil {
 		httpClient = http.DefaultClient
 	}
 
-	resp, err := httpClient.Do(req)
+	resp, err := c.doLogged(httpClient, req)
 	if err != nil {
 		return resp, err
 	}
@@ -122,18 +369,17 @@ func (c *Client) do(req *http.Request) (*http.Response, error) {
 	if resp.StatusCode == http.StatusUnauthorized && hasAuth && c.ReAuth != nil && canRetry {
 		resp.Body.Close()
 		c.accessToken = ""
+		metrics.TokenRefreshes.Inc()
 		if err := c.ReAuth(); err != nil {
 			return resp, err
 		}
 		c.setRequestAuthorization(req) // Access token has changed
-		if req.Body != nil {
-			body, err := req.GetBody()
-			if err != nil {
-				return resp, err
-			}
-			req.Body = body
+		if err := rewindBody(req); err != nil {
+			return resp, err
 		}
-		return c.do(req)
+		// Only re-authenticate once, to avoid looping if the new token is
+		// rejected too
+		return c.doLogged(httpClient, req)
 	}
 
 	return resp, nil
@@ -153,11 +399,24 @@ func (c *Client) doJSON(req *http.Request, respData interface{}) error {
 	defer resp.Body.Close()
 
 	if err := json.NewDecoder(resp.Body).Decode(respData); err != nil {
+		if resp.StatusCode/100 != 2 {
+			// Some errors, e.g. from proxies, aren't JSON
+			return &APIError{
+				Message:    fmt.Sprintf("HTTP %v %v", resp.StatusCode, http.StatusText(resp.StatusCode)),
+				HTTPStatus: resp.StatusCode,
+			}
+		}
 		return err
 	}
 
 	if maybeError, ok := respData.(maybeError); ok {
 		if err := maybeError.Err(); err != nil {
+			switch apiErr := err.(type) {
+			case *APIError:
+				apiErr.HTTPStatus = resp.StatusCode
+			case *HumanVerificationError:
+				apiErr.HTTPStatus = resp.StatusCode
+			}
 			return err
 		}
 	}
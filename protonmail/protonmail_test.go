@@ -0,0 +1,348 @@
+package protonmail
+
+import (
+	"bytes"
+	"context"
+	_ "crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+	_ "golang.org/x/crypto/ripemd160"
+)
+
+// newTestClient returns a client sending requests to a test server calling
+// handler.
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return &Client{RootURL: srv.URL, HTTPClient: srv.Client(), MaxRetries: -1}
+}
+
+func newTestEntity(t *testing.T) *openpgp.Entity {
+	e, err := openpgp.NewEntity("Test", "", "test@example.org", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatalf("openpgp.NewEntity() = %v", err)
+	}
+	return e
+}
+
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+func encryptArmored(t *testing.T, to *openpgp.Entity, s string) string {
+	var b bytes.Buffer
+	aw, err := armor.Encode(&b, "PGP MESSAGE", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := openpgp.Encrypt(aw, []*openpgp.Entity{to}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	aw.Close()
+	return b.String()
+}
+
+func TestReAuth(t *testing.T) {
+	tests := []struct {
+		name string
+		// validToken is the only access token accepted by the server
+		validToken string
+		reAuthErr  error
+		noReAuth   bool
+		wantReAuth int
+		wantErr    bool
+	}{
+		{name: "valid token", validToken: "old"},
+		{name: "expired token", validToken: "new", wantReAuth: 1},
+		{name: "rejected new token", validToken: "other", wantReAuth: 1, wantErr: true},
+		{name: "reauth failure", validToken: "new", reAuthErr: ErrInvalidCredentials, wantReAuth: 1, wantErr: true},
+		{name: "no reauth", validToken: "new", noReAuth: true, wantErr: true},
+	}
+	for _, tc := range tests {
+		var bodies []string
+		c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			b, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, string(b))
+			if r.Header.Get("X-Pm-Uid") != "uid" || r.Header.Get("Authorization") != "Bearer "+tc.validToken {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"Code":401,"Error":"Invalid access token"}`))
+				return
+			}
+			w.Write([]byte(`{"Code":1000}`))
+		})
+		c.uid = "uid"
+		c.accessToken = "old"
+		reAuths := 0
+		if !tc.noReAuth {
+			c.ReAuth = func() error {
+				reAuths++
+				if tc.reAuthErr != nil {
+					return tc.reAuthErr
+				}
+				c.accessToken = "new"
+				return nil
+			}
+		}
+
+		err := c.MarkMessagesRead([]string{"msg"})
+		if tc.wantErr != (err != nil) {
+			t.Errorf("%v: MarkMessagesRead() = %v, want error: %v", tc.name, err, tc.wantErr)
+		}
+		if reAuths != tc.wantReAuth {
+			t.Errorf("%v: ReAuth called %v times, want %v", tc.name, reAuths, tc.wantReAuth)
+		}
+		for _, b := range bodies {
+			if b != bodies[0] {
+				t.Errorf("%v: retried request body = %q, want %q", tc.name, b, bodies[0])
+			}
+		}
+	}
+}
+
+func TestRefreshAuth(t *testing.T) {
+	e := newTestEntity(t)
+	var refreshToken string
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/auth/refresh":
+			refreshToken = "refreshed"
+			w.Write([]byte(`{"Code":1000,"Uid":"new-uid","RefreshToken":"refresh2","ExpiresIn":3600,"AccessToken":` + jsonString(encryptArmored(t, e, "new-token")) + `}`))
+		case "/users":
+			if r.Header.Get("X-Pm-Uid") != "new-uid" || r.Header.Get("Authorization") != "Bearer new-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"Code":401,"Error":"Invalid access token"}`))
+				return
+			}
+			w.Write([]byte(`{"Code":1000,"User":{"ID":"user"}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	expired := &Auth{UID: "uid", RefreshToken: "refresh1", PasswordMode: PasswordTwo}
+	if _, err := c.RefreshAuth(expired); err == nil {
+		t.Errorf("RefreshAuth() on a locked client = nil, want an error")
+	}
+	if refreshToken != "" {
+		t.Errorf("RefreshAuth() on a locked client sent a refresh request")
+	}
+
+	c.keyRing = openpgp.EntityList{e}
+	auth, err := c.RefreshAuth(expired)
+	if err != nil {
+		t.Fatalf("RefreshAuth() = %v", err)
+	}
+	if auth.RefreshToken != "refresh2" || auth.PasswordMode != PasswordTwo {
+		t.Errorf("RefreshAuth() = %+v, want the new refresh token and the previous password mode", auth)
+	}
+	if _, err := c.GetCurrentUser(); err != nil {
+		t.Errorf("GetCurrentUser() after RefreshAuth() = %v", err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	c := &Client{RetryDelay: time.Second}
+	tests := []struct {
+		name       string
+		method     string
+		status     int
+		retryAfter string
+		attempt    int
+		ok         bool
+		min, max   time.Duration
+	}{
+		{name: "success", method: http.MethodGet, status: http.StatusOK},
+		{name: "client error", method: http.MethodGet, status: http.StatusUnprocessableEntity},
+		{name: "rate-limited", method: http.MethodPost, status: http.StatusTooManyRequests, ok: true, min: time.Second, max: 1500 * time.Millisecond},
+		{name: "retry-after seconds", method: http.MethodPost, status: http.StatusTooManyRequests, retryAfter: "7", ok: true, min: 7 * time.Second, max: 7 * time.Second},
+		{name: "invalid retry-after", method: http.MethodGet, status: http.StatusTooManyRequests, retryAfter: "soon", attempt: 1, ok: true, min: 2 * time.Second, max: 3 * time.Second},
+		{name: "server error", method: http.MethodGet, status: http.StatusServiceUnavailable, attempt: 2, ok: true, min: 4 * time.Second, max: 6 * time.Second},
+		{name: "idempotent server error", method: http.MethodPut, status: http.StatusBadGateway, ok: true, min: time.Second, max: 1500 * time.Millisecond},
+		{name: "non-idempotent server error", method: http.MethodPost, status: http.StatusInternalServerError},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(tc.method, "/", nil)
+		resp := &http.Response{StatusCode: tc.status, Header: make(http.Header)}
+		if tc.retryAfter != "" {
+			resp.Header.Set("Retry-After", tc.retryAfter)
+		}
+
+		delay, ok := c.retryDelay(req, resp, tc.attempt)
+		if ok != tc.ok {
+			t.Errorf("%v: retryDelay() = %v, want %v", tc.name, ok, tc.ok)
+		} else if ok && (delay < tc.min || delay > tc.max) {
+			t.Errorf("%v: retryDelay() = %v, want between %v and %v", tc.name, delay, tc.min, tc.max)
+		}
+	}
+}
+
+func TestDoWithRetry(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		maxRetries int
+		statuses   []int
+		want       int
+		requests   int
+	}{
+		{name: "success", method: http.MethodGet, statuses: []int{200}, want: 200, requests: 1},
+		{name: "rate-limited once", method: http.MethodPost, statuses: []int{429, 200}, want: 200, requests: 2},
+		{name: "server errors", method: http.MethodGet, statuses: []int{503, 502, 200}, want: 200, requests: 3},
+		{name: "non-idempotent server error", method: http.MethodPost, statuses: []int{503, 200}, want: 503, requests: 1},
+		{name: "too many retries", method: http.MethodGet, maxRetries: 2, statuses: []int{503, 503, 503, 200}, want: 503, requests: 3},
+		{name: "retries disabled", method: http.MethodGet, maxRetries: -1, statuses: []int{429, 200}, want: 429, requests: 1},
+	}
+	for _, tc := range tests {
+		requests := 0
+		c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			if b, _ := ioutil.ReadAll(r.Body); string(b) != "body" {
+				t.Errorf("%v: request body = %q, want %q", tc.name, b, "body")
+			}
+			w.WriteHeader(tc.statuses[requests])
+			requests++
+		})
+		c.MaxRetries = tc.maxRetries
+		c.RetryDelay = time.Millisecond
+
+		req, err := c.newRequest(context.Background(), tc.method, "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Body = ioutil.NopCloser(strings.NewReader("body"))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("body")), nil
+		}
+
+		resp, err := c.doWithRetry(c.HTTPClient, req)
+		if err != nil {
+			t.Errorf("%v: doWithRetry() = %v", tc.name, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want || requests != tc.requests {
+			t.Errorf("%v: doWithRetry() = %v after %v requests, want %v after %v requests", tc.name, resp.StatusCode, requests, tc.want, tc.requests)
+		}
+	}
+}
+
+func TestDoWithRetryCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		// Cancel while waiting to retry
+		time.AfterFunc(50*time.Millisecond, cancel)
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	c.MaxRetries = 0
+
+	req, err := c.newRequest(ctx, http.MethodGet, "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.doWithRetry(c.HTTPClient, req); err != context.Canceled {
+		t.Errorf("doWithRetry() = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestAPIErrorIs(t *testing.T) {
+	tests := []struct {
+		err    *APIError
+		target error
+		want   bool
+	}{
+		{&APIError{Code: codePasswordWrong, HTTPStatus: 422}, ErrInvalidCredentials, true},
+		{&APIError{Code: codeTwoFactorWrong, HTTPStatus: 422}, ErrInvalidCredentials, false},
+		{&APIError{Code: codeTwoFactorWrong, HTTPStatus: 422}, ErrInvalidTwoFactorCode, true},
+		{&APIError{Code: 2028, HTTPStatus: http.StatusTooManyRequests}, ErrRateLimited, true},
+		{&APIError{HTTPStatus: http.StatusTooManyRequests}, ErrMessageTooLarge, false},
+		{&APIError{HTTPStatus: http.StatusRequestEntityTooLarge}, ErrMessageTooLarge, true},
+		{&APIError{Code: codePasswordWrong}, ErrTwoFactorRequired, false},
+	}
+	for _, tc := range tests {
+		// Errors are usually wrapped by callers
+		err := fmt.Errorf("cannot do something: %w", tc.err)
+		if got := errors.Is(err, tc.target); got != tc.want {
+			t.Errorf("errors.Is(%v, %v) = %v, want %v", tc.err, tc.target, got, tc.want)
+		}
+	}
+}
+
+func TestDoJSONError(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   *APIError
+	}{
+		{
+			name:   "JSON",
+			status: http.StatusUnprocessableEntity,
+			body:   `{"Code":8002,"Error":"Incorrect login credentials"}`,
+			want:   &APIError{Code: 8002, Message: "Incorrect login credentials", HTTPStatus: http.StatusUnprocessableEntity},
+		},
+		{
+			name:   "not JSON",
+			status: http.StatusBadGateway,
+			body:   "<html>Bad Gateway</html>",
+			want:   &APIError{Message: "HTTP 502 Bad Gateway", HTTPStatus: http.StatusBadGateway},
+		},
+		{
+			name:   "empty body",
+			status: http.StatusTooManyRequests,
+			want:   &APIError{Message: "HTTP 429 Too Many Requests", HTTPStatus: http.StatusTooManyRequests},
+		},
+	}
+	for _, tc := range tests {
+		c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.status)
+			io.WriteString(w, tc.body)
+		})
+		req, err := c.newRequest(context.Background(), http.MethodGet, "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var respData resp
+		err = c.doJSON(req, &respData)
+		apiErr, ok := err.(*APIError)
+		if !ok {
+			t.Errorf("%v: doJSON() = %v, want an API error", tc.name, err)
+		} else if *apiErr != *tc.want {
+			t.Errorf("%v: doJSON() = %#v, want %#v", tc.name, apiErr, tc.want)
+		}
+	}
+
+	// The body of successful responses must be valid
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "not JSON")
+	})
+	req, err := c.newRequest(context.Background(), http.MethodGet, "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var respData resp
+	if err := c.doJSON(req, &respData); err == nil {
+		t.Errorf("doJSON() with an invalid successful response = nil, want an error")
+	} else if _, ok := err.(*APIError); ok {
+		t.Errorf("doJSON() with an invalid successful response = %v, want a decoding error", err)
+	}
+}
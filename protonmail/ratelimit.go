@@ -0,0 +1,81 @@
+package protonmail
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/emersion/hydroxide/metrics"
+)
+
+// RateLimiter limits the rate of API requests sent by a client, so that a
+// single busy IMAP or SMTP session doesn't exhaust the account's server-side
+// rate limit. It's a token bucket handing out tokens in request order, so the
+// rate is shared between pending requests rather than between sessions: a
+// session gets a share proportional to the number of requests it sends
+// concurrently. Most operations send one request at a time, attachment
+// downloads send up to Client.AttachmentParallelism.
+//
+// Requests over the limit are delayed, not rejected.
+type RateLimiter struct {
+	interval time.Duration
+	burst    time.Duration
+
+	mu sync.Mutex
+	// next is the time at which the next token becomes available
+	next time.Time
+}
+
+// NewRateLimiter creates a new rate limiter allowing rate requests per second
+// on average, and bursts of up to burst requests.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	interval := time.Duration(float64(time.Second) / rate)
+	return &RateLimiter{
+		interval: interval,
+		burst:    time.Duration(burst-1) * interval,
+	}
+}
+
+// reserve takes a token and returns when it can be used.
+func (l *RateLimiter) reserve(now time.Time) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Unused tokens accumulate up to the burst size
+	if min := now.Add(-l.burst); l.next.Before(min) {
+		l.next = min
+	}
+	t := l.next
+	l.next = l.next.Add(l.interval)
+	if t.Before(now) {
+		return now
+	}
+	return t
+}
+
+// Wait blocks until a request can be sent. If the context is cancelled while
+// waiting, the token is lost.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	now := time.Now()
+	delay := l.reserve(now).Sub(now)
+	if delay <= 0 {
+		return nil
+	}
+	metrics.APIThrottled.Inc()
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
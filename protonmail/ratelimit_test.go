@@ -0,0 +1,171 @@
+package protonmail
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	const ms = time.Millisecond
+	l := NewRateLimiter(10, 3)
+	start := time.Now()
+
+	tests := []struct {
+		now, want time.Duration
+	}{
+		// Burst
+		{0, 0},
+		{0, 0},
+		{0, 0},
+		// Delayed in request order
+		{0, 100 * ms},
+		{0, 200 * ms},
+		{50 * ms, 300 * ms},
+		// Tokens accumulated while idle
+		{1000 * ms, 1000 * ms},
+		{1000 * ms, 1000 * ms},
+		{1000 * ms, 1000 * ms},
+		{1000 * ms, 1100 * ms},
+	}
+	for i, tc := range tests {
+		if got := l.reserve(start.Add(tc.now)).Sub(start); got != tc.want {
+			t.Errorf("request %v: reserve(%v) = %v, want %v", i, tc.now, got, tc.want)
+		}
+	}
+
+	// A burst smaller than 1 is a burst of one request
+	l = NewRateLimiter(10, 0)
+	if got := l.reserve(start).Sub(start); got != 0 {
+		t.Errorf("reserve() = %v, want 0", got)
+	}
+	if got := l.reserve(start).Sub(start); got != 100*ms {
+		t.Errorf("reserve() = %v, want %v", got, 100*ms)
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	var nilLimiter *RateLimiter
+	if err := nilLimiter.Wait(context.Background()); err != nil {
+		t.Errorf("Wait() without a limiter = %v", err)
+	}
+
+	l := NewRateLimiter(0.1, 1)
+	if err := l.Wait(context.Background()); err != nil {
+		t.Errorf("Wait() = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Wait() over the limit = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestClientRateLimiter(t *testing.T) {
+	requests := 0
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"Code":1000}`))
+	})
+	c.RateLimiter = NewRateLimiter(20, 1)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		req, err := c.newRequest(context.Background(), http.MethodGet, "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var respData resp
+		if err := c.doJSON(req, &respData); err != nil {
+			t.Fatalf("doJSON() = %v", err)
+		}
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("3 requests at 20 requests per second took %v, want at least 100ms", d)
+	}
+
+	// Requests waiting for the limiter can be cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.RateLimiter = NewRateLimiter(0.1, 1)
+	c.RateLimiter.Wait(context.Background())
+	req, err := c.newRequest(ctx, http.MethodGet, "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var respData resp
+	if err := c.doJSON(req, &respData); err == nil {
+		t.Errorf("doJSON() with a cancelled context = nil, want an error")
+	}
+	if requests != 3 {
+		t.Errorf("server received %v requests, want 3", requests)
+	}
+}
+
+// runSession sends requests through l with the given concurrency until stop
+// is closed, and returns the number of requests sent.
+func runSession(l *RateLimiter, concurrency int, stop <-chan struct{}) <-chan int {
+	ch := make(chan int, 1)
+	var locker sync.Mutex
+	var wg sync.WaitGroup
+	n := 0
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				l.Wait(context.Background())
+				locker.Lock()
+				n++
+				locker.Unlock()
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		ch <- n
+	}()
+	return ch
+}
+
+func TestRateLimiterSessions(t *testing.T) {
+	const interval = 20 * time.Millisecond
+
+	tests := []struct {
+		name string
+		// concurrency is the number of requests sent at once by the busy
+		// session
+		concurrency int
+	}{
+		{"serial", 1},
+		{"concurrent", DefaultAttachmentParallelism},
+	}
+	for _, tc := range tests {
+		l := NewRateLimiter(float64(time.Second/interval), 1)
+		stop := make(chan struct{})
+		busy := runSession(l, tc.concurrency, stop)
+		time.Sleep(5 * interval)
+
+		// A quiet session only waits for the requests pending before its own,
+		// with some slack for scheduling
+		max := time.Duration(tc.concurrency+1) * interval
+		for i := 0; i < 5; i++ {
+			start := time.Now()
+			l.Wait(context.Background())
+			if d := time.Since(start); d > 2*max {
+				t.Errorf("%v: request %v of the quiet session waited %v, want at most %v", tc.name, i, d, max)
+			}
+		}
+		close(stop)
+		if n := <-busy; n == 0 {
+			t.Errorf("%v: busy session starved", tc.name)
+		}
+	}
+}
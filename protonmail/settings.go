@@ -0,0 +1,56 @@
+package protonmail
+
+import (
+	"context"
+	"net/http"
+)
+
+type UserSettingsEmail struct {
+	Value  string
+	Status int
+	Notify int
+	Reset  int
+}
+
+type UserSettingsPassword struct {
+	Mode           PasswordMode
+	ExpirationTime int64
+}
+
+type UserSettingsTwoFactor struct {
+	// Enabled is a bitmask of the enabled methods
+	Enabled        TwoFactorMethod
+	Allowed        TwoFactorMethod
+	ExpirationTime int64
+}
+
+type UserSettings struct {
+	Email     UserSettingsEmail
+	Password  UserSettingsPassword
+	TwoFactor UserSettingsTwoFactor `json:"2FA"`
+	News      int
+	Locale    string
+	LogAuth   int
+}
+
+func (c *Client) GetSettings() (*UserSettings, error) {
+	return c.GetSettingsContext(context.Background())
+}
+
+// GetSettingsContext is like GetSettings, but with a context.
+func (c *Client) GetSettingsContext(ctx context.Context) (*UserSettings, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/settings", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		UserSettings *UserSettings
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.UserSettings, nil
+}
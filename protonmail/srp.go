@@ -1,36 +1,16 @@
 package protonmail
 
 import (
-	"bytes"
 	"crypto/rand"
 	"crypto/subtle"
 	"encoding/base64"
 	"errors"
 	"io"
 	"math/big"
-
-	"golang.org/x/crypto/openpgp"
-	"golang.org/x/crypto/openpgp/clearsign"
-	openpgperrors "golang.org/x/crypto/openpgp/errors"
 )
 
 var randReader io.Reader = rand.Reader
 
-func decodeModulus(msg string) ([]byte, error) {
-	block, _ := clearsign.Decode([]byte(msg))
-	if block == nil {
-		return nil, errors.New("invalid modulus signed PGP block")
-	}
-
-	// TODO: check signature key
-	_, err := openpgp.CheckDetachedSignature(nil, bytes.NewReader(block.Plaintext), block.ArmoredSignature.Body)
-	if err != nil && err != openpgperrors.ErrUnknownIssuer {
-		return nil, err
-	}
-
-	return base64.StdEncoding.DecodeString(string(block.Plaintext))
-}
-
 func reverse(b []byte) {
 	for i := 0; i < len(b)/2; i++ {
 		j := len(b) - 1 - i
@@ -46,19 +26,23 @@ func itoa(i *big.Int, l int) []byte {
 	return b
 }
 
+// atoi decodes a little-endian integer. b isn't modified.
 func atoi(b []byte) *big.Int {
+	b = append([]byte(nil), b...)
 	reverse(b)
 	return big.NewInt(0).SetBytes(b)
 }
 
-type proofs struct {
-	clientEphemeral     []byte
-	clientProof         []byte
-	expectedServerProof []byte
+// SRPProofs contains the values computed by the client during an SRP
+// exchange.
+type SRPProofs struct {
+	ClientEphemeral     []byte
+	ClientProof         []byte
+	ExpectedServerProof []byte
 }
 
 // From https://github.com/ProtonMail/WebClient/blob/public/src/app/authentication/services/srp.js#L13
-func generateProofs(l int, hash func([]byte) []byte, modulusBytes, hashedBytes, serverEphemeralBytes []byte) (*proofs, error) {
+func generateProofs(l int, hash func([]byte) []byte, modulusBytes, hashedBytes, serverEphemeralBytes []byte) (*SRPProofs, error) {
 	generator := big.NewInt(2)
 
 	multiplier := atoi(hash(append(itoa(generator, l), modulusBytes...)))
@@ -128,32 +112,41 @@ func generateProofs(l int, hash func([]byte) []byte, modulusBytes, hashedBytes,
 	serverProof = append(serverProof, itoa(sharedSession, l)...)
 	serverProof = hash(serverProof)
 
-	return &proofs{
-		clientEphemeral:     itoa(clientEphemeral, l),
-		clientProof:         clientProof,
-		expectedServerProof: serverProof,
+	return &SRPProofs{
+		ClientEphemeral:     itoa(clientEphemeral, l),
+		ClientProof:         clientProof,
+		ExpectedServerProof: serverProof,
 	}, nil
 }
 
-func (p *proofs) VerifyServerProof(serverProofString string) error {
+// VerifyServerProof checks the base64-encoded server proof returned by the
+// API. A valid server proof shows the server knows the password verifier.
+func (p *SRPProofs) VerifyServerProof(serverProofString string) error {
 	serverProof, err := base64.StdEncoding.DecodeString(serverProofString)
 	if err != nil {
 		return err
 	}
 
-	if subtle.ConstantTimeCompare(p.expectedServerProof, serverProof) != 1 {
+	if subtle.ConstantTimeCompare(p.ExpectedServerProof, serverProof) != 1 {
 		return errors.New("invalid server proof")
 	}
 	return nil
 }
 
+// GenerateSRPProofs computes the client proofs of an SRP exchange. The
+// modulus must have been checked with DecodeModulus beforehand.
+//
 // From https://github.com/ProtonMail/WebClient/blob/public/src/app/authentication/services/srp.js#L135
-func srp(password []byte, info *AuthInfo) (*proofs, error) {
-	modulus, err := decodeModulus(info.modulus)
+func GenerateSRPProofs(password []byte, version int, salt, modulus, serverEphemeral []byte) (*SRPProofs, error) {
+	hashed, err := hashPassword(version, password, salt, modulus)
 	if err != nil {
 		return nil, err
 	}
 
+	return generateProofs(2048, expandHash, modulus, hashed, serverEphemeral)
+}
+
+func srp(password []byte, info *AuthInfo, modulus []byte) (*SRPProofs, error) {
 	serverEphemeral, err := base64.StdEncoding.DecodeString(info.serverEphemeral)
 	if err != nil {
 		return nil, err
@@ -164,15 +157,5 @@ func srp(password []byte, info *AuthInfo) (*proofs, error) {
 		return nil, err
 	}
 
-	hashed, err := hashPassword(info.version, password, salt, modulus)
-	if err != nil {
-		return nil, err
-	}
-
-	proofs, err := generateProofs(2048, expandHash, modulus, hashed, serverEphemeral)
-	if err != nil {
-		return nil, err
-	}
-
-	return proofs, nil
+	return GenerateSRPProofs(password, info.version, salt, modulus, serverEphemeral)
 }
@@ -0,0 +1,330 @@
+package protonmail
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"testing"
+
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+// testModulusHex is the 2048-bit MODP prime from RFC 3526.
+const testModulusHex = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3BE39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF6955817183995497CEA956AE515D2261898FA051015728E5A8AACAA68FFFFFFFFFFFFFFFF"
+
+// testModulus returns the test SRP modulus, in little-endian order.
+func testModulus() []byte {
+	n, _ := new(big.Int).SetString(testModulusHex, 16)
+	return itoa(n, 2048)
+}
+
+func writePacket(b *bytes.Buffer, tag byte, body []byte) {
+	b.WriteByte(0xC0 | tag)
+	b.WriteByte(255)
+	binary.Write(b, binary.BigEndian, uint32(len(body)))
+	b.Write(body)
+}
+
+func writeMPI(b *bytes.Buffer, mpi []byte) {
+	for len(mpi) > 1 && mpi[0] == 0 {
+		mpi = mpi[1:]
+	}
+	bits := len(mpi) * 8
+	for i := 7; i >= 0 && mpi[0]>>uint(i) == 0; i-- {
+		bits--
+	}
+	binary.Write(b, binary.BigEndian, uint16(bits))
+	b.Write(mpi)
+}
+
+func armorString(t *testing.T, blockType string, b []byte) string {
+	var out bytes.Buffer
+	w, err := armor.Encode(&out, blockType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(b)
+	w.Close()
+	return out.String()
+}
+
+// newTestModulusKey generates an Ed25519 key signing SRP moduli, and returns
+// it along with the armored OpenPGP public key.
+func newTestModulusKey(t *testing.T) (ed25519.PrivateKey, string) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var body bytes.Buffer
+	body.Write([]byte{4, 0, 0, 0, 0, pubKeyAlgoEdDSA, byte(len(ed25519OID))})
+	body.Write(ed25519OID)
+	writeMPI(&body, append([]byte{0x40}, pub...))
+
+	var b bytes.Buffer
+	writePacket(&b, 6, body.Bytes())
+	return priv, armorString(t, "PGP PUBLIC KEY BLOCK", b.Bytes())
+}
+
+// signModulus returns the modulus clearsigned with key, as returned by the
+// API.
+func signModulus(t *testing.T, key ed25519.PrivateKey, modulus []byte) string {
+	text := base64.StdEncoding.EncodeToString(modulus)
+	clearsigned := func(sig []byte) string {
+		return "-----BEGIN PGP SIGNED MESSAGE-----\nHash: SHA256\n\n" + text + "\n" + armorString(t, "PGP SIGNATURE", sig)
+	}
+
+	// Get the canonical text which is signed
+	block, _ := clearsign.Decode([]byte(clearsigned(nil)))
+	if block == nil {
+		t.Fatal("cannot decode clearsigned modulus")
+	}
+
+	// Text signature, no subpacket
+	hashed := []byte{4, 1, pubKeyAlgoEdDSA, 8, 0, 0}
+	h := sha256.New()
+	h.Write(block.Bytes)
+	h.Write(hashed)
+	h.Write([]byte{4, 0xff, 0, 0, 0, byte(len(hashed))})
+	digest := h.Sum(nil)
+	sig := ed25519.Sign(key, digest)
+
+	var body bytes.Buffer
+	body.Write(hashed)
+	body.Write([]byte{0, 0})
+	body.Write(digest[:2])
+	writeMPI(&body, sig[:32])
+	writeMPI(&body, sig[32:])
+
+	var b bytes.Buffer
+	writePacket(&b, 2, body.Bytes())
+	return clearsigned(b.Bytes())
+}
+
+// testSRPServer implements the server side of the SRP exchange, for a single
+// user. Two-factor codes are accepted if listed in totpCodes.
+type testSRPServer struct {
+	t          *testing.T
+	modulusKey string
+	signed     string
+	modulus    []byte
+	salt       []byte
+	verifier   *big.Int
+	totpCodes  []string
+	// u2f advertises U2F in addition to TOTP
+	u2f bool
+
+	// Set by the last /auth/info request
+	secret, ephemeral *big.Int
+	// twoFactorCodes contains the codes sent to /auth
+	twoFactorCodes []string
+}
+
+func newTestSRPServer(t *testing.T, password string) *testSRPServer {
+	key, modulusKey := newTestModulusKey(t)
+	modulus := testModulus()
+	salt := []byte("0123456789")
+
+	hashed, err := hashPassword(4, []byte(password), append([]byte(nil), salt...), modulus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := atoi(append([]byte(nil), modulus...))
+	verifier := new(big.Int).Exp(big.NewInt(2), atoi(hashed), n)
+
+	return &testSRPServer{
+		t:          t,
+		modulusKey: modulusKey,
+		signed:     signModulus(t, key, modulus),
+		modulus:    modulus,
+		salt:       salt,
+		verifier:   verifier,
+	}
+}
+
+func (s *testSRPServer) n() *big.Int {
+	return atoi(append([]byte(nil), s.modulus...))
+}
+
+func (s *testSRPServer) multiplier() *big.Int {
+	k := atoi(expandHash(append(itoa(big.NewInt(2), 2048), s.modulus...)))
+	return k.Mod(k, s.n())
+}
+
+// serverProof checks the client proof and returns the server proof, or nil if
+// the client proof is invalid.
+func (s *testSRPServer) serverProof(clientEphemeral, clientProof []byte) []byte {
+	n := s.n()
+	a := atoi(append([]byte(nil), clientEphemeral...))
+	u := atoi(expandHash(append(itoa(a, 2048), itoa(s.ephemeral, 2048)...)))
+
+	shared := new(big.Int).Exp(s.verifier, u, n)
+	shared.Mul(shared, a).Mod(shared, n)
+	shared.Exp(shared, s.secret, n)
+
+	var expected []byte
+	expected = append(expected, itoa(a, 2048)...)
+	expected = append(expected, itoa(s.ephemeral, 2048)...)
+	expected = append(expected, itoa(shared, 2048)...)
+	if !bytes.Equal(expandHash(expected), clientProof) {
+		return nil
+	}
+
+	var proof []byte
+	proof = append(proof, itoa(a, 2048)...)
+	proof = append(proof, clientProof...)
+	proof = append(proof, itoa(shared, 2048)...)
+	return expandHash(proof)
+}
+
+func (s *testSRPServer) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.t.Error(err)
+	}
+}
+
+func (s *testSRPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/auth/info":
+		n := s.n()
+		var err error
+		if s.secret, err = rand.Int(rand.Reader, new(big.Int).Sub(n, big.NewInt(1))); err != nil {
+			s.t.Error(err)
+			return
+		}
+		s.ephemeral = new(big.Int).Exp(big.NewInt(2), s.secret, n)
+		s.ephemeral.Add(s.ephemeral, new(big.Int).Mul(s.multiplier(), s.verifier)).Mod(s.ephemeral, n)
+
+		var twoFactor TwoFactorMethod
+		if s.totpCodes != nil {
+			twoFactor = TwoFactorTOTP
+		}
+		if s.u2f {
+			twoFactor |= TwoFactorU2F
+		}
+		s.writeJSON(w, http.StatusOK, map[string]interface{}{
+			"Code":            1000,
+			"TwoFactor":       twoFactor,
+			"Version":         4,
+			"Modulus":         s.signed,
+			"ServerEphemeral": base64.StdEncoding.EncodeToString(itoa(s.ephemeral, 2048)),
+			"Salt":            base64.StdEncoding.EncodeToString(s.salt),
+			"SRPSession":      "session",
+		})
+	case "/auth":
+		var req authReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.t.Error(err)
+			return
+		}
+		clientEphemeral, _ := base64.StdEncoding.DecodeString(req.ClientEphemeral)
+		clientProof, _ := base64.StdEncoding.DecodeString(req.ClientProof)
+		proof := s.serverProof(clientEphemeral, clientProof)
+		if proof == nil {
+			s.writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{"Code": codePasswordWrong, "Error": "Incorrect login credentials"})
+			return
+		}
+
+		if s.totpCodes != nil {
+			s.twoFactorCodes = append(s.twoFactorCodes, req.TwoFactorCode)
+			valid := false
+			for _, code := range s.totpCodes {
+				valid = valid || code == req.TwoFactorCode
+			}
+			if !valid {
+				s.writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{"Code": codeTwoFactorWrong, "Error": "Incorrect code"})
+				return
+			}
+		}
+
+		s.writeJSON(w, http.StatusOK, map[string]interface{}{
+			"Code":         1000,
+			"Uid":          "uid",
+			"RefreshToken": "refresh",
+			"PasswordMode": PasswordSingle,
+			"ServerProof":  base64.StdEncoding.EncodeToString(proof),
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newTestSRPClient returns a client sending requests to s.
+func newTestSRPClient(t *testing.T, s *testSRPServer) *Client {
+	c := newTestClient(t, s.ServeHTTP)
+	c.ModulusKey = s.modulusKey
+	return c
+}
+
+func TestGenerateSRPProofs(t *testing.T) {
+	s := newTestSRPServer(t, "password")
+	n := s.n()
+	var err error
+	if s.secret, err = rand.Int(rand.Reader, new(big.Int).Sub(n, big.NewInt(1))); err != nil {
+		t.Fatal(err)
+	}
+	s.ephemeral = new(big.Int).Exp(big.NewInt(2), s.secret, n)
+	s.ephemeral.Add(s.ephemeral, new(big.Int).Mul(s.multiplier(), s.verifier)).Mod(s.ephemeral, n)
+	serverEphemeral := itoa(s.ephemeral, 2048)
+
+	tests := []struct {
+		name, password string
+		wantValid      bool
+	}{
+		{"valid", "password", true},
+		{"wrong password", "wrong", false},
+	}
+	for _, tc := range tests {
+		proofs, err := GenerateSRPProofs([]byte(tc.password), 4, s.salt, s.modulus, serverEphemeral)
+		if err != nil {
+			t.Errorf("%v: GenerateSRPProofs() = %v", tc.name, err)
+			continue
+		}
+		serverProof := s.serverProof(proofs.ClientEphemeral, proofs.ClientProof)
+		if valid := serverProof != nil; valid != tc.wantValid {
+			t.Errorf("%v: server accepted the client proof = %v, want %v", tc.name, valid, tc.wantValid)
+		}
+		if serverProof == nil {
+			continue
+		}
+		if err := proofs.VerifyServerProof(base64.StdEncoding.EncodeToString(serverProof)); err != nil {
+			t.Errorf("%v: VerifyServerProof() = %v", tc.name, err)
+		}
+		if err := proofs.VerifyServerProof(base64.StdEncoding.EncodeToString(proofs.ClientProof)); err == nil {
+			t.Errorf("%v: VerifyServerProof() with an invalid proof = nil, want an error", tc.name)
+		}
+	}
+
+	invalid := []struct {
+		name                     string
+		modulus, serverEphemeral []byte
+	}{
+		{"zero server ephemeral", s.modulus, make([]byte, 256)},
+		{"server ephemeral equal to the modulus", s.modulus, s.modulus},
+		{"short modulus", s.modulus[:128], serverEphemeral[:128]},
+	}
+	for _, tc := range invalid {
+		if _, err := GenerateSRPProofs([]byte("password"), 4, s.salt, append([]byte(nil), tc.modulus...), append([]byte(nil), tc.serverEphemeral...)); err == nil {
+			t.Errorf("%v: GenerateSRPProofs() = nil, want an error", tc.name)
+		}
+	}
+}
+
+func TestAtoi(t *testing.T) {
+	b := []byte{1, 2}
+	if got := atoi(b); got.Int64() != 0x0201 {
+		t.Errorf("atoi(%v) = %v, want %v", b, got, 0x0201)
+	}
+	if !bytes.Equal(b, []byte{1, 2}) {
+		t.Errorf("atoi() modified its argument to %v", b)
+	}
+}
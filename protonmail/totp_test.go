@@ -0,0 +1,110 @@
+package protonmail
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// testTOTPSecret is the secret of the RFC 6238 test vectors.
+const testTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestGenerateTOTP(t *testing.T) {
+	// From RFC 6238 appendix B, truncated to 6 digits
+	tests := []struct {
+		secret string
+		unix   int64
+		want   string
+	}{
+		{testTOTPSecret, 59, "287082"},
+		{testTOTPSecret, 1111111109, "081804"},
+		{testTOTPSecret, 1111111111, "050471"},
+		{testTOTPSecret, 1234567890, "005924"},
+		{testTOTPSecret, 2000000000, "279037"},
+		{"gezd gnbv gy3t qojq gezd gnbv gy3t qojq", 59, "287082"},
+		{testTOTPSecret + "====", 59, "287082"},
+	}
+	for _, tc := range tests {
+		got, err := GenerateTOTP(tc.secret, time.Unix(tc.unix, 0))
+		if err != nil {
+			t.Errorf("GenerateTOTP(%q, %v) = %v", tc.secret, tc.unix, err)
+		} else if got != tc.want {
+			t.Errorf("GenerateTOTP(%q, %v) = %v, want %v", tc.secret, tc.unix, got, tc.want)
+		}
+	}
+
+	if _, err := GenerateTOTP("not base32!", time.Now()); err == nil {
+		t.Errorf("GenerateTOTP() with an invalid secret = nil, want an error")
+	}
+}
+
+func TestAuthTOTP(t *testing.T) {
+	now := time.Now()
+	code := func(offset time.Duration) string {
+		code, err := GenerateTOTP(testTOTPSecret, now.Add(offset))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		// accepted is the offset of the code accepted by the server
+		accepted []time.Duration
+		attempts int
+		wantErr  error
+	}{
+		{name: "current code", password: "password", accepted: []time.Duration{0}, attempts: 1},
+		{name: "server behind", password: "password", accepted: []time.Duration{-totpPeriod}, attempts: 2},
+		{name: "server ahead", password: "password", accepted: []time.Duration{totpPeriod}, attempts: 3},
+		{name: "clock too far", password: "password", accepted: []time.Duration{3 * totpPeriod}, attempts: 3, wantErr: ErrInvalidTwoFactorCode},
+		{name: "wrong password", password: "wrong", accepted: []time.Duration{0}, wantErr: ErrInvalidCredentials},
+	}
+	for _, tc := range tests {
+		s := newTestSRPServer(t, "password")
+		s.totpCodes = []string{}
+		for _, offset := range tc.accepted {
+			s.totpCodes = append(s.totpCodes, code(offset))
+		}
+		c := newTestSRPClient(t, s)
+
+		auth, err := c.AuthTOTP("user", tc.password, testTOTPSecret, nil)
+		if tc.wantErr != nil {
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("%v: AuthTOTP() = %v, want %v", tc.name, err, tc.wantErr)
+			}
+		} else if err != nil {
+			t.Errorf("%v: AuthTOTP() = %v", tc.name, err)
+		} else if auth.UID != "uid" {
+			t.Errorf("%v: AuthTOTP() returned UID %q, want %q", tc.name, auth.UID, "uid")
+		}
+		if len(s.twoFactorCodes) != tc.attempts {
+			t.Errorf("%v: AuthTOTP() sent %v codes, want %v", tc.name, len(s.twoFactorCodes), tc.attempts)
+		}
+	}
+}
+
+func TestAuthTwoFactorRequired(t *testing.T) {
+	for _, u2f := range []bool{false, true} {
+		s := newTestSRPServer(t, "password")
+		s.totpCodes = []string{"123456"}
+		s.u2f = u2f
+		c := newTestSRPClient(t, s)
+
+		if _, err := c.Auth("user", "password", "", nil); err != ErrTwoFactorRequired {
+			t.Errorf("Auth() without a code (U2F: %v) = %v, want %v", u2f, err, ErrTwoFactorRequired)
+		}
+		if len(s.twoFactorCodes) != 0 {
+			t.Errorf("Auth() without a code (U2F: %v) sent %v codes, want none", u2f, len(s.twoFactorCodes))
+		}
+
+		if _, err := c.Auth("user", "password", "654321", nil); !errors.Is(err, ErrInvalidTwoFactorCode) {
+			t.Errorf("Auth() with a wrong code (U2F: %v) = %v, want %v", u2f, err, ErrInvalidTwoFactorCode)
+		}
+		if _, err := c.Auth("user", "password", "123456", nil); err != nil {
+			t.Errorf("Auth() with a valid code (U2F: %v) = %v", u2f, err)
+		}
+	}
+}
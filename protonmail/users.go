@@ -1,27 +1,47 @@
 package protonmail
 
 import (
+	"context"
 	"net/http"
 )
 
+// UserService is a bitmask of ProtonMail services.
+type UserService int
+
+const (
+	ServiceMail UserService = 1 << 0
+	ServiceVPN  UserService = 1 << 2
+)
+
+// DefaultMaxUpload is the maximum size of the attachments of a message for
+// most accounts.
+const DefaultMaxUpload = 25 * 1024 * 1024
+
 type User struct {
-	ID         string
-	Name       string
-	UsedSpace  int
-	Currency   string // e.g. EUR
-	Credit     int
-	MaxSpace   int
-	MaxUpload  int
-	Role       int // TODO
-	Private    int
-	Subscribed int // TODO
-	Services   int // TODO
-	Delinquent int
-	Keys       []*PrivateKey
+	ID          string
+	Name        string
+	DisplayName string
+	Email       string
+	UsedSpace   int
+	Currency    string // e.g. EUR
+	Credit      int
+	MaxSpace    int
+	MaxUpload   int
+	Role        int // TODO
+	Private     int
+	Subscribed  UserService
+	Services    UserService
+	Delinquent  int
+	Keys        []*PrivateKey
 }
 
 func (c *Client) GetCurrentUser() (*User, error) {
-	req, err := c.newRequest(http.MethodGet, "/users", nil)
+	return c.GetCurrentUserContext(context.Background())
+}
+
+// GetCurrentUserContext is like GetCurrentUser, but with a context.
+func (c *Client) GetCurrentUserContext(ctx context.Context) (*User, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/users", nil)
 	if err != nil {
 		return nil, err
 	}
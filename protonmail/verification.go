@@ -0,0 +1,118 @@
+package protonmail
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+const codeHumanVerificationRequired = 9001
+
+const (
+	headerHumanVerificationToken     = "X-Pm-Human-Verification-Token"
+	headerHumanVerificationTokenType = "X-Pm-Human-Verification-Token-Type"
+)
+
+// HumanVerificationMethod is a way to prove that a request is sent by a
+// human.
+type HumanVerificationMethod string
+
+const (
+	// HumanVerificationCaptcha requires solving a CAPTCHA in a web browser.
+	HumanVerificationCaptcha HumanVerificationMethod = "captcha"
+	// HumanVerificationEmail sends a code to an e-mail address, see
+	// Client.SendVerificationCode.
+	HumanVerificationEmail HumanVerificationMethod = "email"
+	// HumanVerificationSMS sends a code to a phone number, see
+	// Client.SendVerificationCode.
+	HumanVerificationSMS HumanVerificationMethod = "sms"
+)
+
+// HumanVerificationError is returned when the API requires a human
+// verification before processing a request. The request needs to be sent
+// again with Client.HumanVerification set.
+type HumanVerificationError struct {
+	*APIError
+	// Token identifies the challenge
+	Token string
+	// Methods lists the accepted verification methods
+	Methods []HumanVerificationMethod
+}
+
+// HasMethod checks whether a verification method is accepted.
+func (err *HumanVerificationError) HasMethod(method HumanVerificationMethod) bool {
+	for _, m := range err.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// CaptchaURL returns the URL of the web page presenting the CAPTCHA of the
+// challenge.
+func (err *HumanVerificationError) CaptchaURL(rootURL string) string {
+	return rootURL + "/core/v4/captcha?Token=" + url.QueryEscape(err.Token)
+}
+
+type humanVerificationDetails struct {
+	HumanVerificationToken   string
+	HumanVerificationMethods []HumanVerificationMethod
+}
+
+func newHumanVerificationError(apiErr *APIError, details json.RawMessage) *HumanVerificationError {
+	var d humanVerificationDetails
+	if len(details) > 0 {
+		// Still return an error if the details are malformed
+		json.Unmarshal(details, &d)
+	}
+	return &HumanVerificationError{
+		APIError: apiErr,
+		Token:    d.HumanVerificationToken,
+		Methods:  d.HumanVerificationMethods,
+	}
+}
+
+// HumanVerification is the solution of a human verification challenge.
+type HumanVerification struct {
+	Method HumanVerificationMethod
+	// Token is the solved CAPTCHA token, or the code received by e-mail or
+	// SMS
+	Token string
+}
+
+func (hv *HumanVerification) setHeaders(req *http.Request) {
+	req.Header.Set(headerHumanVerificationTokenType, string(hv.Method))
+	req.Header.Set(headerHumanVerificationToken, hv.Token)
+}
+
+// VerificationDestination is where a verification code is sent. Only one of
+// its fields must be set.
+type VerificationDestination struct {
+	Address string `json:",omitempty"`
+	Phone   string `json:",omitempty"`
+}
+
+type verificationCodeReq struct {
+	Type        HumanVerificationMethod
+	Destination *VerificationDestination
+}
+
+// SendVerificationCode asks the API to send a human verification code by
+// e-mail or SMS. The code can then be used as a HumanVerification token.
+func (c *Client) SendVerificationCode(method HumanVerificationMethod, dest *VerificationDestination) error {
+	return c.SendVerificationCodeContext(context.Background(), method, dest)
+}
+
+// SendVerificationCodeContext is like SendVerificationCode, but with a
+// context.
+func (c *Client) SendVerificationCodeContext(ctx context.Context, method HumanVerificationMethod, dest *VerificationDestination) error {
+	reqData := &verificationCodeReq{Type: method, Destination: dest}
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/users/code", reqData)
+	if err != nil {
+		return err
+	}
+
+	return c.doJSON(req, nil)
+}
@@ -0,0 +1,154 @@
+package protonmail
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestHumanVerificationError(t *testing.T) {
+	err := &HumanVerificationError{
+		Token:   "a b&c",
+		Methods: []HumanVerificationMethod{HumanVerificationCaptcha, HumanVerificationEmail},
+	}
+
+	tests := []struct {
+		method HumanVerificationMethod
+		want   bool
+	}{
+		{HumanVerificationCaptcha, true},
+		{HumanVerificationEmail, true},
+		{HumanVerificationSMS, false},
+	}
+	for _, tc := range tests {
+		if got := err.HasMethod(tc.method); got != tc.want {
+			t.Errorf("HasMethod(%q) = %v, want %v", tc.method, got, tc.want)
+		}
+	}
+
+	want := "https://mail.example.org/api/core/v4/captcha?Token=a+b%26c"
+	if got := err.CaptchaURL("https://mail.example.org/api"); got != want {
+		t.Errorf("CaptchaURL() = %q, want %q", got, want)
+	}
+}
+
+func TestRespErrHumanVerification(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    *HumanVerificationError
+		wantErr *APIError
+	}{
+		{
+			name: "details",
+			body: `{"Code":9001,"Error":"Human verification required","Details":{"HumanVerificationToken":"token","HumanVerificationMethods":["captcha","sms"]}}`,
+			want: &HumanVerificationError{
+				APIError: &APIError{Code: 9001, Message: "Human verification required"},
+				Token:    "token",
+				Methods:  []HumanVerificationMethod{HumanVerificationCaptcha, HumanVerificationSMS},
+			},
+		},
+		{
+			name: "malformed details",
+			body: `{"Code":9001,"Error":"Human verification required","Details":"oops"}`,
+			want: &HumanVerificationError{APIError: &APIError{Code: 9001, Message: "Human verification required"}},
+		},
+		{
+			name:    "other error",
+			body:    `{"Code":2001,"Error":"Invalid input","Details":{"HumanVerificationToken":"token"}}`,
+			wantErr: &APIError{Code: 2001, Message: "Invalid input"},
+		},
+	}
+	for _, tc := range tests {
+		var r resp
+		if err := json.Unmarshal([]byte(tc.body), &r); err != nil {
+			t.Fatal(err)
+		}
+		err := r.Err()
+		if tc.want != nil {
+			if hvErr, ok := err.(*HumanVerificationError); !ok || !reflect.DeepEqual(hvErr, tc.want) {
+				t.Errorf("%v: Err() = %#v, want %#v", tc.name, err, tc.want)
+			}
+		} else if !reflect.DeepEqual(err, tc.wantErr) {
+			t.Errorf("%v: Err() = %#v, want %#v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestAuthHumanVerification(t *testing.T) {
+	tests := []struct {
+		name    string
+		hv      *HumanVerification
+		wantErr bool
+	}{
+		{name: "challenge", wantErr: true},
+		{name: "solved", hv: &HumanVerification{Method: HumanVerificationCaptcha, Token: "solved"}},
+		{name: "wrong token", hv: &HumanVerification{Method: HumanVerificationCaptcha, Token: "wrong"}, wantErr: true},
+	}
+	for _, tc := range tests {
+		s := newTestSRPServer(t, "password")
+		c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/auth" && (r.Header.Get(headerHumanVerificationTokenType) != "captcha" || r.Header.Get(headerHumanVerificationToken) != "solved") {
+				s.writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+					"Code":  codeHumanVerificationRequired,
+					"Error": "Human verification required",
+					"Details": map[string]interface{}{
+						"HumanVerificationToken":   "challenge",
+						"HumanVerificationMethods": []string{"captcha"},
+					},
+				})
+				return
+			}
+			s.ServeHTTP(w, r)
+		})
+		c.ModulusKey = s.modulusKey
+		c.HumanVerification = tc.hv
+
+		_, err := c.Auth("user", "password", "", nil)
+		if !tc.wantErr {
+			if err != nil {
+				t.Errorf("%v: Auth() = %v", tc.name, err)
+			}
+			continue
+		}
+		hvErr, ok := err.(*HumanVerificationError)
+		if !ok {
+			t.Errorf("%v: Auth() = %v, want a HumanVerificationError", tc.name, err)
+			continue
+		}
+		if hvErr.Token != "challenge" || !hvErr.HasMethod(HumanVerificationCaptcha) {
+			t.Errorf("%v: Auth() = %#v, want the challenge", tc.name, hvErr)
+		}
+		if hvErr.HTTPStatus != http.StatusUnprocessableEntity {
+			t.Errorf("%v: HTTPStatus = %v, want %v", tc.name, hvErr.HTTPStatus, http.StatusUnprocessableEntity)
+		}
+	}
+}
+
+func TestSendVerificationCode(t *testing.T) {
+	tests := []struct {
+		method HumanVerificationMethod
+		dest   *VerificationDestination
+		want   string
+	}{
+		{HumanVerificationEmail, &VerificationDestination{Address: "user@example.org"}, `{"Type":"email","Destination":{"Address":"user@example.org"}}`},
+		{HumanVerificationSMS, &VerificationDestination{Phone: "+33123456789"}, `{"Type":"sms","Destination":{"Phone":"+33123456789"}}`},
+	}
+	for _, tc := range tests {
+		var got json.RawMessage
+		c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || r.URL.Path != "/users/code" {
+				t.Errorf("%v: request = %v %v, want POST /users/code", tc.method, r.Method, r.URL.Path)
+			}
+			json.NewDecoder(r.Body).Decode(&got)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"Code":1000}`))
+		})
+		if err := c.SendVerificationCode(tc.method, tc.dest); err != nil {
+			t.Errorf("%v: SendVerificationCode() = %v", tc.method, err)
+		} else if string(got) != tc.want {
+			t.Errorf("%v: request body = %s, want %s", tc.method, got, tc.want)
+		}
+	}
+}
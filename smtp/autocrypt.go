@@ -0,0 +1,49 @@
+package smtp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// Autocrypt header fields advertise the sender's public key, so that the
+// recipients' mail clients can start encrypting replies. See
+// https://autocrypt.org/level1.html.
+
+// Values of the prefer-encrypt attribute.
+const (
+	AutocryptMutual       = "mutual"
+	AutocryptNoPreference = "nopreference"
+)
+
+// autocryptLineLen is the length of the folded lines of the key data.
+const autocryptLineLen = 76
+
+// formatAutocrypt formats the value of the Autocrypt header field of an
+// address. Only the public part of the key is included.
+func formatAutocrypt(addr string, e *openpgp.Entity, preferEncrypt string) (string, error) {
+	var b bytes.Buffer
+	if err := e.Serialize(&b); err != nil {
+		return "", fmt.Errorf("cannot serialize public key: %v", err)
+	}
+	keydata := base64.StdEncoding.EncodeToString(b.Bytes())
+
+	var sb strings.Builder
+	sb.WriteString("addr=" + addr + ";")
+	if preferEncrypt == AutocryptMutual {
+		sb.WriteString(" prefer-encrypt=mutual;")
+	}
+	sb.WriteString(" keydata=")
+	for len(keydata) > 0 {
+		n := autocryptLineLen
+		if n > len(keydata) {
+			n = len(keydata)
+		}
+		sb.WriteString("\r\n " + keydata[:n])
+		keydata = keydata[n:]
+	}
+	return sb.String(), nil
+}
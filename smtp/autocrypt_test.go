@@ -0,0 +1,53 @@
+package smtp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestFormatAutocrypt(t *testing.T) {
+	e := newTestEntity(t)
+	tests := []struct {
+		preferEncrypt string
+		wantPrefix    string
+	}{
+		{AutocryptMutual, "addr=user@example.org; prefer-encrypt=mutual; keydata="},
+		{AutocryptNoPreference, "addr=user@example.org; keydata="},
+	}
+	for _, tc := range tests {
+		v, err := formatAutocrypt("user@example.org", e, tc.preferEncrypt)
+		if err != nil {
+			t.Errorf("formatAutocrypt(%q) = %v", tc.preferEncrypt, err)
+			continue
+		}
+		if !strings.HasPrefix(v, tc.wantPrefix+"\r\n ") {
+			t.Errorf("formatAutocrypt(%q) = %q, want prefix %q", tc.preferEncrypt, v, tc.wantPrefix)
+			continue
+		}
+
+		lines := strings.Split(strings.TrimPrefix(v, tc.wantPrefix), "\r\n ")[1:]
+		for _, l := range lines {
+			if len(l) > autocryptLineLen {
+				t.Errorf("formatAutocrypt(%q) has a %v-byte line, want at most %v", tc.preferEncrypt, len(l), autocryptLineLen)
+			}
+		}
+
+		b, err := base64.StdEncoding.DecodeString(strings.Join(lines, ""))
+		if err != nil {
+			t.Errorf("formatAutocrypt(%q) has invalid key data: %v", tc.preferEncrypt, err)
+			continue
+		}
+		el, err := openpgp.ReadKeyRing(bytes.NewReader(b))
+		if err != nil {
+			t.Errorf("formatAutocrypt(%q) has an invalid key: %v", tc.preferEncrypt, err)
+		} else if len(el) != 1 || el[0].PrimaryKey.KeyId != e.PrimaryKey.KeyId {
+			t.Errorf("formatAutocrypt(%q) doesn't contain the sender's key", tc.preferEncrypt)
+		} else if el[0].PrivateKey != nil {
+			t.Errorf("formatAutocrypt(%q) contains the private key", tc.preferEncrypt)
+		}
+	}
+}
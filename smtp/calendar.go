@@ -0,0 +1,28 @@
+package smtp
+
+import (
+	"mime"
+	"strings"
+)
+
+// Calendar invites are text/calendar parts, usually alongside the text of the
+// message in a multipart/alternative. ProtonMail only sends one body, so
+// invites are uploaded as attachments, like the web app does. The method
+// parameter must be kept for clients to recognize the invite.
+
+const calendarFilename = "invite.ics"
+
+// formatCalendarType formats the MIME type of a calendar attachment. iCalendar
+// objects are always UTF-8, so the charset parameter is dropped.
+func formatCalendarType(t string, params map[string]string) string {
+	kept := make(map[string]string, len(params))
+	for k, v := range params {
+		if !strings.EqualFold(k, "charset") {
+			kept[k] = v
+		}
+	}
+	if formatted := mime.FormatMediaType(t, kept); formatted != "" {
+		return formatted
+	}
+	return t
+}
@@ -0,0 +1,103 @@
+package smtp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestFormatCalendarType(t *testing.T) {
+	tests := []struct {
+		params map[string]string
+		want   string
+	}{
+		{nil, "text/calendar"},
+		{map[string]string{"method": "REQUEST"}, "text/calendar; method=REQUEST"},
+		{map[string]string{"method": "REPLY", "charset": "utf-8"}, "text/calendar; method=REPLY"},
+		{map[string]string{"Charset": "iso-8859-1"}, "text/calendar"},
+	}
+	for _, tc := range tests {
+		if got := formatCalendarType("text/calendar", tc.params); got != tc.want {
+			t.Errorf("formatCalendarType(%v) = %q, want %q", tc.params, got, tc.want)
+		}
+	}
+}
+
+func TestUploadAttachment(t *testing.T) {
+	e := newTestEntity(t)
+
+	var fields map[string]string
+	var decrypted string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/attachments" {
+			http.NotFound(w, r)
+			return
+		}
+		mr, err := r.MultipartReader()
+		if err != nil {
+			t.Errorf("MultipartReader() = %v", err)
+			return
+		}
+		fields = make(map[string]string)
+		var packets bytes.Buffer
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Errorf("NextPart() = %v", err)
+				return
+			}
+			b, _ := ioutil.ReadAll(p)
+			switch p.FormName() {
+			case "KeyPackets", "DataPacket":
+				packets.Write(b)
+			default:
+				fields[p.FormName()] = string(b)
+			}
+		}
+		md, err := openpgp.ReadMessage(&packets, openpgp.EntityList{e}, nil, nil)
+		if err != nil {
+			t.Errorf("openpgp.ReadMessage() = %v", err)
+		} else {
+			b, _ := ioutil.ReadAll(md.UnverifiedBody)
+			decrypted = string(b)
+		}
+		w.Write([]byte(`{"Code":1000,"Attachment":{"ID":"att1"}}`))
+	}))
+	defer srv.Close()
+
+	s := &session{c: &protonmail.Client{RootURL: srv.URL, HTTPClient: srv.Client(), MaxRetries: -1}}
+	att := &protonmail.Attachment{
+		MessageID: "draft1",
+		Name:      calendarFilename,
+		MIMEType:  formatCalendarType("text/calendar", map[string]string{"method": "REQUEST", "charset": "utf-8"}),
+	}
+	const ics = "BEGIN:VCALENDAR\r\nMETHOD:REQUEST\r\nEND:VCALENDAR\r\n"
+	keys := make(map[string]*packet.EncryptedKey)
+	if err := s.uploadAttachment(att, strings.NewReader(ics), e, keys); err != nil {
+		t.Fatalf("uploadAttachment() = %v", err)
+	}
+
+	if keys["att1"] == nil {
+		t.Errorf("uploadAttachment() didn't add the attachment key, got %v", keys)
+	}
+	want := map[string]string{"Filename": "invite.ics", "MessageID": "draft1", "MIMEType": "text/calendar; method=REQUEST"}
+	for k, v := range want {
+		if fields[k] != v {
+			t.Errorf("uploaded %v = %q, want %q", k, fields[k], v)
+		}
+	}
+	if decrypted != ics {
+		t.Errorf("uploaded attachment = %q, want %q", decrypted, ics)
+	}
+}
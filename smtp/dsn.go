@@ -0,0 +1,229 @@
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-smtp"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// Delivery status notifications, defined in RFC 3461 and RFC 3464.
+//
+// go-smtp doesn't allow backends to advertise extensions nor to read MAIL
+// parameters, so DSN isn't advertised in EHLO and RET and ENVID are accepted
+// but ignored. Bounces only contain the header of the original message, which
+// is allowed regardless of RET.
+
+// dsnRecipient contains the DSN parameters of a recipient.
+type dsnRecipient struct {
+	notifyFailure bool
+	// orcpt is the original recipient, e.g. "rfc822;user@example.org"
+	orcpt string
+}
+
+var errInvalidNotify = &smtp.SMTPError{
+	Code:    501,
+	Message: "5.5.4 Invalid NOTIFY parameter",
+}
+
+func parseNotify(v string) (failure bool, err error) {
+	values := strings.Split(strings.ToUpper(v), ",")
+	for _, v := range values {
+		switch v {
+		case "NEVER":
+			if len(values) > 1 {
+				return false, errInvalidNotify
+			}
+		case "FAILURE":
+			failure = true
+		case "SUCCESS", "DELAY":
+			// Messages are delivered by ProtonMail, we don't know when
+		default:
+			return false, errInvalidNotify
+		}
+	}
+	return failure, nil
+}
+
+// decodeXtext decodes a value encoded as defined in RFC 3461 section 4.
+func decodeXtext(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '+' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("invalid xtext %q", s)
+		}
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid xtext %q", s)
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// parseRcpt parses the argument of a RCPT command. go-smtp strips the angle
+// brackets around the address, but leaves the parameters. Since no extension
+// defining other parameters is advertised, unknown parameters are ignored.
+func parseRcpt(arg string) (string, *dsnRecipient, error) {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		return "", nil, &smtp.SMTPError{Code: 501, Message: "5.1.3 Missing recipient address"}
+	}
+
+	addr := strings.Trim(fields[0], "<>")
+	rcpt := &dsnRecipient{notifyFailure: true}
+	for _, param := range fields[1:] {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		var err error
+		switch strings.ToUpper(kv[0]) {
+		case "NOTIFY":
+			rcpt.notifyFailure, err = parseNotify(kv[1])
+		case "ORCPT":
+			rcpt.orcpt, err = decodeXtext(kv[1])
+			if err != nil || !strings.Contains(rcpt.orcpt, ";") {
+				err = &smtp.SMTPError{Code: 501, Message: "5.5.4 Invalid ORCPT parameter"}
+			}
+		}
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	return addr, rcpt, nil
+}
+
+// failedRecipient is a recipient the message couldn't be sent to.
+type failedRecipient struct {
+	addr string
+	// status is the enhanced status code, as defined in RFC 3463
+	status string
+	err    error
+}
+
+func reportingMTA() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "localhost"
+	}
+	return hostname
+}
+
+func writeDSNHeader(b *bytes.Buffer, k, v string) {
+	b.WriteString(k + ": " + v + "\r\n")
+}
+
+// formatDSN formats a message reporting failed deliveries. h is the header of
+// the original message.
+func formatDSN(from, to string, h mail.Header, arrival time.Time, failed []*failedRecipient, rcpts map[string]*dsnRecipient) ([]byte, error) {
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+
+	writeDSNHeader(&b, "From", "Mail Delivery System <"+from+">")
+	writeDSNHeader(&b, "To", "<"+to+">")
+	writeDSNHeader(&b, "Subject", "Undelivered Mail Returned to Sender")
+	writeDSNHeader(&b, "Date", time.Now().Format(time.RFC1123Z))
+	writeDSNHeader(&b, "Auto-Submitted", "auto-replied")
+	writeDSNHeader(&b, "MIME-Version", "1.0")
+	writeDSNHeader(&b, "Content-Type", "multipart/report; report-type=delivery-status; boundary="+mw.Boundary())
+	b.WriteString("\r\n")
+
+	th := make(textproto.MIMEHeader)
+	th.Set("Content-Type", "text/plain; charset=utf-8")
+	w, err := mw.CreatePart(th)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(w, "Your message couldn't be delivered to the following recipients:\r\n\r\n")
+	for _, rcpt := range failed {
+		fmt.Fprintf(w, "<%v>: %v\r\n", rcpt.addr, rcpt.err)
+	}
+
+	th = make(textproto.MIMEHeader)
+	th.Set("Content-Type", "message/delivery-status")
+	w, err = mw.CreatePart(th)
+	if err != nil {
+		return nil, err
+	}
+	var status bytes.Buffer
+	writeDSNHeader(&status, "Reporting-MTA", "dns; "+reportingMTA())
+	writeDSNHeader(&status, "Arrival-Date", arrival.Format(time.RFC1123Z))
+	for _, rcpt := range failed {
+		status.WriteString("\r\n")
+		if params := rcpts[strings.ToLower(rcpt.addr)]; params != nil && params.orcpt != "" {
+			writeDSNHeader(&status, "Original-Recipient", params.orcpt)
+		}
+		writeDSNHeader(&status, "Final-Recipient", "rfc822; "+rcpt.addr)
+		writeDSNHeader(&status, "Action", "failed")
+		writeDSNHeader(&status, "Status", rcpt.status)
+	}
+	if _, err := w.Write(status.Bytes()); err != nil {
+		return nil, err
+	}
+
+	th = make(textproto.MIMEHeader)
+	th.Set("Content-Type", "text/rfc822-headers")
+	w, err = mw.CreatePart(th)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write([]byte(formatHeader(h))); err != nil {
+		return nil, err
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// bounce stores a delivery status notification for failed recipients in the
+// sender's Inbox.
+func (s *session) bounce(h mail.Header, fromAddr *protonmail.Address, privateKey *openpgp.Entity, arrival time.Time, failed []*failedRecipient) error {
+	var notify []*failedRecipient
+	for _, rcpt := range failed {
+		if params := s.rcpts[strings.ToLower(rcpt.addr)]; params == nil || params.notifyFailure {
+			notify = append(notify, rcpt)
+		}
+	}
+	if len(notify) == 0 {
+		return nil
+	}
+
+	daemon := "MAILER-DAEMON"
+	if i := strings.LastIndex(fromAddr.Email, "@"); i >= 0 {
+		daemon += fromAddr.Email[i:]
+	}
+
+	b, err := formatDSN(daemon, fromAddr.Email, h, arrival, notify, s.rcpts)
+	if err != nil {
+		return err
+	}
+
+	meta := &protonmail.ImportMessageMetadata{
+		AddressID: fromAddr.ID,
+		Unread:    1,
+		Type:      protonmail.MessageInbox,
+		LabelIDs:  []string{protonmail.LabelInbox},
+	}
+	_, err = s.c.ImportMessage(meta, bytes.NewReader(b), privateKey)
+	return err
+}
@@ -0,0 +1,286 @@
+package smtp
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-smtp"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestParseRcpt(t *testing.T) {
+	tests := []struct {
+		arg      string
+		addr     string
+		rcpt     dsnRecipient
+		wantCode int
+	}{
+		{arg: "user@example.org", addr: "user@example.org", rcpt: dsnRecipient{notifyFailure: true}},
+		{arg: "<user@example.org>", addr: "user@example.org", rcpt: dsnRecipient{notifyFailure: true}},
+		// go-smtp only trims the leading angle bracket when there are
+		// parameters
+		{arg: "user@example.org> NOTIFY=FAILURE", addr: "user@example.org", rcpt: dsnRecipient{notifyFailure: true}},
+		{arg: "user@example.org> NOTIFY=NEVER", addr: "user@example.org"},
+		{arg: "user@example.org NOTIFY=NEVER", addr: "user@example.org"},
+		{arg: "user@example.org NOTIFY=success,delay", addr: "user@example.org"},
+		{arg: "user@example.org NOTIFY=SUCCESS,FAILURE", addr: "user@example.org", rcpt: dsnRecipient{notifyFailure: true}},
+		{arg: "user@example.org NOTIFY=NEVER,FAILURE", wantCode: 501},
+		{arg: "user@example.org NOTIFY=SOMETIMES", wantCode: 501},
+		{
+			arg:  "user@example.org ORCPT=rfc822;alias+2Bx@example.org",
+			addr: "user@example.org",
+			rcpt: dsnRecipient{notifyFailure: true, orcpt: "rfc822;alias+x@example.org"},
+		},
+		{arg: "user@example.org ORCPT=alias@example.org", wantCode: 501},
+		{arg: "user@example.org ORCPT=rfc822;alias+2", wantCode: 501},
+		{arg: "user@example.org X-UNKNOWN=1 SMTPUTF8", addr: "user@example.org", rcpt: dsnRecipient{notifyFailure: true}},
+		{arg: "", wantCode: 501},
+	}
+	for _, tc := range tests {
+		addr, rcpt, err := parseRcpt(tc.arg)
+		if tc.wantCode != 0 {
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != tc.wantCode {
+				t.Errorf("parseRcpt(%q) = %v, want code %v", tc.arg, err, tc.wantCode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRcpt(%q) = %v", tc.arg, err)
+			continue
+		}
+		if addr != tc.addr || *rcpt != tc.rcpt {
+			t.Errorf("parseRcpt(%q) = %q, %+v, want %q, %+v", tc.arg, addr, *rcpt, tc.addr, tc.rcpt)
+		}
+	}
+}
+
+// testSessionBackend returns the same session to all clients.
+type testSessionBackend struct {
+	s *session
+}
+
+func (be *testSessionBackend) Login(_ *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	return be.s, nil
+}
+
+func (be *testSessionBackend) AnonymousLogin(_ *smtp.ConnectionState) (smtp.Session, error) {
+	return be.s, nil
+}
+
+func TestDSNParameters(t *testing.T) {
+	s := &session{addrs: []*protonmail.Address{
+		{Email: "a@example.org", Status: protonmail.AddressEnabled, Send: protonmail.AddressSendPrimary},
+	}}
+	srv := smtp.NewServer(&testSessionBackend{s})
+	srv.Domain = "localhost"
+	srv.AllowInsecureAuth = true
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	c, err := textproto.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("greeting: %v", err)
+	}
+
+	tests := []struct {
+		cmd  string
+		code int
+	}{
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<a@example.org> RET=HDRS", 250},
+		{"RCPT TO:<c@example.org> NOTIFY=FAILURE", 250},
+		{"RCPT TO:<d@example.org> NOTIFY=NEVER ORCPT=rfc822;d@example.org", 250},
+		{"RCPT TO:<e@example.org> NOTIFY=SOMETIMES", 501},
+	}
+	for _, tc := range tests {
+		id, err := c.Cmd("%v", tc.cmd)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.cmd, err)
+		}
+		c.StartResponse(id)
+		code, msg, err := c.ReadResponse(0)
+		c.EndResponse(id)
+		if code != tc.code {
+			t.Errorf("%v: response = %v %v (%v), want %v", tc.cmd, code, msg, err, tc.code)
+		}
+	}
+
+	if s.from != "a@example.org" {
+		t.Errorf("sender = %q, want %q", s.from, "a@example.org")
+	}
+	want := map[string]*dsnRecipient{
+		"c@example.org": {notifyFailure: true},
+		"d@example.org": {orcpt: "rfc822;d@example.org"},
+	}
+	if !reflect.DeepEqual(s.rcpts, want) {
+		t.Errorf("recipients = %v, want %v", s.rcpts, want)
+	}
+}
+
+func TestFormatDSN(t *testing.T) {
+	h := mail.Header{Header: make(message.Header)}
+	h.SetSubject("Hello")
+	failed := []*failedRecipient{
+		{addr: "a@example.org", status: "5.1.1", err: errors.New("no such user")},
+		{addr: "B@example.org", status: "5.0.0", err: errors.New("rejected")},
+	}
+	rcpts := map[string]*dsnRecipient{
+		"b@example.org": {notifyFailure: true, orcpt: "rfc822;b-alias@example.org"},
+	}
+
+	b, err := formatDSN("postmaster@example.org", "sender@example.org", h, time.Now(), failed, rcpts)
+	if err != nil {
+		t.Fatalf("formatDSN() = %v", err)
+	}
+	s := string(b)
+	for _, want := range []string{
+		"To: <sender@example.org>\r\n",
+		"Content-Type: multipart/report; report-type=delivery-status;",
+		"<a@example.org>: no such user\r\n",
+		"Final-Recipient: rfc822; a@example.org\r\nAction: failed\r\nStatus: 5.1.1\r\n",
+		"Original-Recipient: rfc822;b-alias@example.org\r\nFinal-Recipient: rfc822; B@example.org\r\n",
+		"Content-Type: text/rfc822-headers",
+		"Subject: Hello\r\n",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("formatDSN() doesn't contain %q", want)
+		}
+	}
+}
+
+func TestDecodeXtext(t *testing.T) {
+	tests := []struct {
+		s, want string
+		wantErr bool
+	}{
+		{s: "rfc822;user@example.org", want: "rfc822;user@example.org"},
+		{s: "user+2Btag@example.org", want: "user+tag@example.org"},
+		{s: "a+3Db+20c", want: "a=b c"},
+		{s: "a+2", wantErr: true},
+		{s: "a+ZZ", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := decodeXtext(tc.s)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("decodeXtext(%q) = %q, want an error", tc.s, got)
+			}
+		} else if err != nil {
+			t.Errorf("decodeXtext(%q) = %v", tc.s, err)
+		} else if got != tc.want {
+			t.Errorf("decodeXtext(%q) = %q, want %q", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestBounce(t *testing.T) {
+	key := newTestEntity(t)
+	failed := []*failedRecipient{
+		{addr: "a@example.org", status: "5.1.1", err: errors.New("no such user")},
+		{addr: "b@example.org", status: "5.1.1", err: errors.New("no such user")},
+	}
+
+	tests := []struct {
+		name  string
+		rcpts map[string]*dsnRecipient
+		// want is the list of recipients in the DSN, nil if there is none
+		want []string
+	}{
+		{name: "default", want: []string{"a@example.org", "b@example.org"}},
+		{
+			name: "never notify",
+			rcpts: map[string]*dsnRecipient{
+				"a@example.org": {},
+				"b@example.org": {},
+			},
+		},
+		{
+			name: "some",
+			rcpts: map[string]*dsnRecipient{
+				"a@example.org": {},
+				"b@example.org": {notifyFailure: true},
+			},
+			want: []string{"b@example.org"},
+		},
+	}
+	for _, tc := range tests {
+		var imported []string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/import" {
+				http.NotFound(w, r)
+				return
+			}
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				t.Errorf("%v: cannot parse import request: %v", tc.name, err)
+				return
+			}
+			if !strings.Contains(r.FormValue("Metadata"), `"AddressID":"addr1"`) {
+				t.Errorf("%v: invalid import metadata: %v", tc.name, r.FormValue("Metadata"))
+			}
+			f, _, err := r.FormFile("0")
+			if err != nil {
+				t.Errorf("%v: %v", tc.name, err)
+				return
+			}
+			defer f.Close()
+			block, err := armor.Decode(f)
+			if err != nil {
+				t.Errorf("%v: %v", tc.name, err)
+				return
+			}
+			md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{key}, nil, nil)
+			if err != nil {
+				t.Errorf("%v: %v", tc.name, err)
+				return
+			}
+			b, _ := ioutil.ReadAll(md.UnverifiedBody)
+			for _, addr := range []string{"a@example.org", "b@example.org"} {
+				if strings.Contains(string(b), "Final-Recipient: rfc822; "+addr) {
+					imported = append(imported, addr)
+				}
+			}
+			if !strings.Contains(string(b), "From: Mail Delivery System <MAILER-DAEMON@example.org>") {
+				t.Errorf("%v: DSN isn't sent by the mailer daemon", tc.name)
+			}
+			w.Write([]byte(`{"Code":1001,"Responses":[{"Name":"0","Response":{"Code":1000,"MessageID":"dsn"}}]}`))
+		}))
+
+		s := &session{
+			c:     &protonmail.Client{RootURL: srv.URL, HTTPClient: srv.Client(), MaxRetries: -1},
+			rcpts: tc.rcpts,
+		}
+		h := mail.Header{Header: make(message.Header)}
+		h.SetSubject("Hello")
+		fromAddr := &protonmail.Address{ID: "addr1", Email: "sender@example.org"}
+		if err := s.bounce(h, fromAddr, key, time.Now(), failed); err != nil {
+			t.Errorf("%v: bounce() = %v", tc.name, err)
+		}
+		srv.Close()
+
+		if !reflect.DeepEqual(imported, tc.want) {
+			t.Errorf("%v: DSN recipients = %v, want %v", tc.name, imported, tc.want)
+		}
+	}
+}
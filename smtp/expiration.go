@@ -0,0 +1,45 @@
+package smtp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Messages with an X-Pm-Expiration header field are deleted from the
+// recipients' mailboxes after the given duration, like messages set to expire
+// in the web app. The value is a number of seconds or a duration such as
+// "12h". Only copies stored by ProtonMail expire: messages sent in plaintext
+// to external recipients don't.
+
+const expirationHeader = "X-Pm-Expiration"
+
+// maxExpiration is the maximum expiration time accepted by ProtonMail.
+const maxExpiration = 28 * 24 * time.Hour
+
+// parseExpiration parses the value of the X-Pm-Expiration header field and
+// returns the expiration time, in seconds.
+func parseExpiration(v string) (int, error) {
+	v = strings.TrimSpace(v)
+
+	var d time.Duration
+	if sec, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(sec) * time.Second
+	} else if d, err = time.ParseDuration(v); err != nil {
+		return 0, &smtp.SMTPError{
+			Code:    554,
+			Message: fmt.Sprintf("5.6.0 Invalid %v header field %q", expirationHeader, v),
+		}
+	}
+
+	if d < time.Second || d > maxExpiration {
+		return 0, &smtp.SMTPError{
+			Code:    554,
+			Message: "5.6.0 Message expiration must be between 1 second and 4 weeks",
+		}
+	}
+	return int(d / time.Second), nil
+}
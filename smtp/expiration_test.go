@@ -0,0 +1,36 @@
+package smtp
+
+import (
+	"testing"
+)
+
+func TestParseExpiration(t *testing.T) {
+	tests := []struct {
+		v       string
+		want    int
+		wantErr bool
+	}{
+		{v: "3600", want: 3600},
+		{v: " 60 ", want: 60},
+		{v: "12h", want: 12 * 3600},
+		{v: "1h30m", want: 5400},
+		{v: "672h", want: 28 * 24 * 3600},
+		{v: "673h", wantErr: true},
+		{v: "0", wantErr: true},
+		{v: "-10", wantErr: true},
+		{v: "500ms", wantErr: true},
+		{v: "tomorrow", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := parseExpiration(tc.v)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseExpiration(%q) = %v, want an error", tc.v, got)
+			}
+		} else if err != nil {
+			t.Errorf("parseExpiration(%q) = %v", tc.v, err)
+		} else if got != tc.want {
+			t.Errorf("parseExpiration(%q) = %v, want %v", tc.v, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package smtp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// outboxTTL is the duration during which a client can retry sending a
+// message without sending it twice.
+const outboxTTL = 24 * time.Hour
+
+type outboxEntry struct {
+	// outgoing is nil once the message has been sent
+	outgoing *protonmail.OutgoingMessage
+	time     time.Time
+}
+
+// outbox keeps track of messages whose send status is unknown or which have
+// been sent recently. If a client sends the same message again, e.g. because
+// it got a temporary error, the draft created the first time is reused so
+// that recipients don't get the message twice.
+type outbox struct {
+	locker  sync.Mutex
+	entries map[string]*outboxEntry
+}
+
+func outboxKey(username, from string, b []byte) string {
+	h := sha256.New()
+	h.Write([]byte(username + "\x00" + from + "\x00"))
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns the entry of a message, or nil if it hasn't been sent nor
+// attempted recently.
+func (o *outbox) get(key string) *outboxEntry {
+	o.locker.Lock()
+	defer o.locker.Unlock()
+
+	entry, ok := o.entries[key]
+	if !ok || time.Since(entry.time) > outboxTTL {
+		return nil
+	}
+	return entry
+}
+
+func (o *outbox) put(key string, outgoing *protonmail.OutgoingMessage) {
+	o.locker.Lock()
+	defer o.locker.Unlock()
+
+	for k, entry := range o.entries {
+		if time.Since(entry.time) > outboxTTL {
+			delete(o.entries, k)
+		}
+	}
+
+	if o.entries == nil {
+		o.entries = make(map[string]*outboxEntry)
+	}
+	o.entries[key] = &outboxEntry{outgoing: outgoing, time: time.Now()}
+}
+
+func (o *outbox) remove(key string) {
+	o.locker.Lock()
+	delete(o.entries, key)
+	o.locker.Unlock()
+}
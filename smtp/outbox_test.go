@@ -0,0 +1,138 @@
+package smtp
+
+import (
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestOutboxKey(t *testing.T) {
+	k := outboxKey("user", "from@example.org", []byte("Hello"))
+	if k != outboxKey("user", "from@example.org", []byte("Hello")) {
+		t.Errorf("outboxKey() isn't stable")
+	}
+	for _, other := range []string{
+		outboxKey("other", "from@example.org", []byte("Hello")),
+		outboxKey("user", "other@example.org", []byte("Hello")),
+		outboxKey("user", "from@example.org", []byte("Bye")),
+		outboxKey("user", "from@example.orgHello", nil),
+	} {
+		if other == k {
+			t.Errorf("outboxKey() returned the same key for another message")
+		}
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	var o outbox
+	if o.get("a") != nil {
+		t.Errorf("get() on an empty outbox returned an entry")
+	}
+
+	outgoing := &protonmail.OutgoingMessage{ID: "draft1"}
+	o.put("a", outgoing)
+	o.put("b", nil)
+	if entry := o.get("a"); entry == nil || entry.outgoing != outgoing {
+		t.Errorf("get() = %v, want the pending message", entry)
+	}
+	if entry := o.get("b"); entry == nil || entry.outgoing != nil {
+		t.Errorf("get() = %v, want the sent message", entry)
+	}
+
+	// Expired entries are ignored, and dropped on the next put
+	o.entries["a"].time = time.Now().Add(-outboxTTL - time.Minute)
+	if o.get("a") != nil {
+		t.Errorf("get() returned an expired entry")
+	}
+	o.put("c", nil)
+	if _, ok := o.entries["a"]; ok {
+		t.Errorf("put() didn't drop the expired entry")
+	}
+
+	o.remove("b")
+	if o.get("b") != nil {
+		t.Errorf("get() returned a removed entry")
+	}
+}
+
+func TestSendOutgoing(t *testing.T) {
+	tests := []struct {
+		name string
+		send func(w http.ResponseWriter)
+		// draftType is the type of the draft once the request has failed
+		draftType protonmail.MessageType
+		wantErr   error
+		wantFail  bool
+		// wantEntry is true if the message is still in the outbox, wantSent
+		// if it's marked as sent
+		wantEntry, wantSent bool
+	}{
+		{
+			name: "sent",
+			send: func(w http.ResponseWriter) {
+				w.Write([]byte(`{"Code":1000,"Sent":{"ID":"draft1","Type":2}}`))
+			},
+			wantEntry: true,
+			wantSent:  true,
+		},
+		{
+			name: "rejected",
+			send: func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				w.Write([]byte(`{"Code":2001,"Error":"Invalid recipient"}`))
+			},
+			draftType: protonmail.MessageDraft,
+			wantFail:  true,
+		},
+		{
+			name: "unknown status",
+			send: func(w http.ResponseWriter) {
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+			},
+			draftType: protonmail.MessageDraft,
+			wantErr:   errSendStatusUnknown,
+			wantEntry: true,
+		},
+	}
+	for _, tc := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet {
+				w.Write([]byte(`{"Code":1000,"Message":{"ID":"draft1","Type":` + strconv.Itoa(int(tc.draftType)) + `}}`))
+				return
+			}
+			tc.send(w)
+		}))
+		c := &protonmail.Client{RootURL: srv.URL, HTTPClient: srv.Client(), MaxRetries: -1}
+		be := &backend{}
+		log := slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+
+		err := be.sendOutgoing(c, log, "key", &protonmail.OutgoingMessage{ID: "draft1"})
+		srv.Close()
+		switch {
+		case tc.wantErr != nil:
+			if err != tc.wantErr {
+				t.Errorf("%v: sendOutgoing() = %v, want %v", tc.name, err, tc.wantErr)
+			}
+		case tc.wantFail:
+			if err == nil {
+				t.Errorf("%v: sendOutgoing() = nil, want an error", tc.name)
+			}
+		case err != nil:
+			t.Errorf("%v: sendOutgoing() = %v", tc.name, err)
+		}
+
+		entry := be.outbox.get("key")
+		if (entry != nil) != tc.wantEntry {
+			t.Errorf("%v: outbox entry = %v, want an entry: %v", tc.name, entry, tc.wantEntry)
+		} else if entry != nil && (entry.outgoing == nil) != tc.wantSent {
+			t.Errorf("%v: outbox entry sent = %v, want %v", tc.name, entry.outgoing == nil, tc.wantSent)
+		}
+	}
+}
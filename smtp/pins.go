@@ -0,0 +1,101 @@
+package smtp
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/emersion/hydroxide/config"
+	"golang.org/x/crypto/openpgp"
+)
+
+// Pins map recipient addresses to the fingerprint of the key messages sent to
+// them must be encrypted with. Messages aren't sent if ProtonMail returns
+// another key, or no key at all.
+
+const pinsFile = "pins.json"
+
+func loadPins() (map[string]string, error) {
+	pins := make(map[string]string)
+
+	p, err := config.Path(pinsFile)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return pins, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &pins); err != nil {
+		return nil, fmt.Errorf("cannot read %v: %v", pinsFile, err)
+	}
+	return pins, nil
+}
+
+func savePins(pins map[string]string) error {
+	p, err := config.Path(pinsFile)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(pins, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// parseFingerprint normalizes a hex-encoded V4 key fingerprint. Spaces and an
+// optional 0x prefix are allowed.
+func parseFingerprint(s string) (string, error) {
+	s = strings.ToUpper(strings.Replace(s, " ", "", -1))
+	s = strings.TrimPrefix(s, "0X")
+	if b, err := hex.DecodeString(s); err != nil || len(b) != 20 {
+		return "", fmt.Errorf("invalid key fingerprint %q", s)
+	}
+	return s, nil
+}
+
+func formatFingerprint(e *openpgp.Entity) string {
+	return fmt.Sprintf("%X", e.PrimaryKey.Fingerprint)
+}
+
+// PinKey pins the key of a recipient address.
+func PinKey(addr, fingerprint string) error {
+	fingerprint, err := parseFingerprint(fingerprint)
+	if err != nil {
+		return err
+	}
+
+	pins, err := loadPins()
+	if err != nil {
+		return err
+	}
+	pins[strings.ToLower(addr)] = fingerprint
+	return savePins(pins)
+}
+
+// UnpinKey removes the pin of a recipient address. It's a no-op if the address
+// isn't pinned.
+func UnpinKey(addr string) error {
+	pins, err := loadPins()
+	if err != nil {
+		return err
+	}
+	addr = strings.ToLower(addr)
+	if _, ok := pins[addr]; !ok {
+		return nil
+	}
+	delete(pins, addr)
+	return savePins(pins)
+}
@@ -0,0 +1,79 @@
+package smtp
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/hydroxide/config"
+)
+
+const testFingerprint = "0123456789ABCDEF0123456789ABCDEF01234567"
+
+func TestParseFingerprint(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    string
+		wantErr bool
+	}{
+		{s: testFingerprint, want: testFingerprint},
+		{s: "0123 4567 89ab cdef 0123  4567 89AB CDEF 0123 4567", want: testFingerprint},
+		{s: "0x" + testFingerprint, want: testFingerprint},
+		{s: testFingerprint[:38], wantErr: true},
+		{s: testFingerprint + "89", wantErr: true},
+		{s: "not a fingerprint", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := parseFingerprint(tc.s)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseFingerprint(%q) = %q, want an error", tc.s, got)
+			}
+		} else if err != nil {
+			t.Errorf("parseFingerprint(%q) = %v", tc.s, err)
+		} else if got != tc.want {
+			t.Errorf("parseFingerprint(%q) = %q, want %q", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestPinKey(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	if pins, err := loadPins(); err != nil || len(pins) != 0 {
+		t.Errorf("loadPins() without pins file = %v, %v, want no pin", pins, err)
+	}
+	if err := PinKey("Alice@Example.org", "0x"+testFingerprint); err != nil {
+		t.Fatalf("PinKey() = %v", err)
+	}
+	if err := PinKey("bob@example.org", testFingerprint); err != nil {
+		t.Fatalf("PinKey() = %v", err)
+	}
+	if err := PinKey("carol@example.org", "invalid"); err == nil {
+		t.Errorf("PinKey() with an invalid fingerprint = nil, want an error")
+	}
+	if err := UnpinKey("BOB@example.org"); err != nil {
+		t.Fatalf("UnpinKey() = %v", err)
+	}
+	if err := UnpinKey("dave@example.org"); err != nil {
+		t.Errorf("UnpinKey() for an address without pin = %v", err)
+	}
+
+	want := map[string]string{"alice@example.org": testFingerprint}
+	if pins, err := loadPins(); err != nil {
+		t.Fatalf("loadPins() = %v", err)
+	} else if !reflect.DeepEqual(pins, want) {
+		t.Errorf("loadPins() = %v, want %v", pins, want)
+	}
+
+	p, err := config.Path(pinsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadPins(); err == nil {
+		t.Errorf("loadPins() with an invalid pins file = nil, want an error")
+	}
+}
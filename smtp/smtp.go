@@ -2,17 +2,26 @@ package smtp
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log/slog"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/emersion/go-message"
 	"github.com/emersion/go-message/mail"
 	"github.com/emersion/go-smtp"
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/packet"
 
 	"github.com/emersion/hydroxide/auth"
+	"github.com/emersion/hydroxide/charset"
+	"github.com/emersion/hydroxide/metrics"
 	"github.com/emersion/hydroxide/protonmail"
 )
 
@@ -27,6 +36,29 @@ func toPMAddressList(addresses []*mail.Address) []*protonmail.MessageAddress {
 	return l
 }
 
+// parseMsgID parses a message identifier, as found in the Message-Id and
+// In-Reply-To header fields.
+func parseMsgID(s string) string {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "<")
+	s = strings.TrimSuffix(s, ">")
+	return strings.TrimSpace(s)
+}
+
+// parseMsgIDList parses a list of message identifiers, as found in the
+// References header field.
+func parseMsgIDList(s string) []string {
+	var l []string
+	for _, id := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\r' || r == '\n' || r == ','
+	}) {
+		if id = parseMsgID(id); id != "" {
+			l = append(l, id)
+		}
+	}
+	return l
+}
+
 func formatHeader(h mail.Header) string {
 	var b bytes.Buffer
 	for k, values := range h.Header {
@@ -37,34 +69,350 @@ func formatHeader(h mail.Header) string {
 	return b.String()
 }
 
+type encryptedRecipient struct {
+	pub      *openpgp.Entity
+	internal bool
+}
+
+var errPinMismatch = errors.New("no key matches the pinned key")
+
+// recipientKey picks the key messages sent to addr are encrypted with, among
+// the keys returned by the API. If pin isn't empty, only the key with this
+// fingerprint can be used. It returns nil if messages are sent in plaintext.
+func recipientKey(addr string, resp *protonmail.PublicKeyResp, pin string) (*encryptedRecipient, error) {
+	for _, k := range resp.Keys {
+		if k.Send != 1 {
+			continue
+		}
+		pub, err := k.Entity()
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse public key for address %q: %v", addr, err)
+		}
+		if pin == "" || formatFingerprint(pub) == pin {
+			return &encryptedRecipient{
+				pub:      pub,
+				internal: resp.RecipientType == protonmail.RecipientInternal,
+			}, nil
+		}
+	}
+	if pin != "" {
+		return nil, errPinMismatch
+	}
+	return nil, nil
+}
+
+var errUnknownSender = &smtp.SMTPError{
+	Code:    553,
+	Message: "5.7.1 Sender address is not owned by the authenticated user",
+}
+
+var errShuttingDown = &smtp.SMTPError{
+	Code:    421,
+	Message: "4.3.2 Service shutting down, try again later",
+}
+
+var errSendStatusUnknown = &smtp.SMTPError{
+	Code:    451,
+	Message: "4.4.0 Unknown message status, sending the same message again is safe",
+}
+
+var errMessageTooLarge = &smtp.SMTPError{
+	Code:    552,
+	Message: "5.3.4 Message exceeds the account's size limit",
+}
+
+// messageOverhead is the size allowed for the headers and the text parts of a
+// message, in addition to its attachments.
+const messageOverhead = 1024 * 1024
+
+// maxMessageBytes returns the maximum size of a message whose attachments fit
+// in maxUpload bytes. Attachments are usually base64-encoded, which adds a
+// third to their size.
+func maxMessageBytes(maxUpload int) int {
+	return maxUpload/3*4 + messageOverhead
+}
+
+// DefaultMaxMessageBytes is the maximum size of messages accepted before the
+// account is known.
+var DefaultMaxMessageBytes = maxMessageBytes(protonmail.DefaultMaxUpload)
+
+// stripAddressTag removes the subaddress tag from an address, e.g.
+// "user+tag@example.org" becomes "user@example.org".
+func stripAddressTag(addr string) string {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return addr
+	}
+	local, domain := addr[:at], addr[at:]
+	if i := strings.Index(local, "+"); i >= 0 {
+		local = local[:i]
+	}
+	return local + domain
+}
+
+// findAddress returns the user's address matching email, ignoring any
+// subaddress tag.
+func findAddress(addrs []*protonmail.Address, email string) *protonmail.Address {
+	for _, addr := range addrs {
+		if strings.EqualFold(addr.Email, email) {
+			return addr
+		}
+	}
+
+	email = stripAddressTag(email)
+	for _, addr := range addrs {
+		if strings.EqualFold(stripAddressTag(addr.Email), email) {
+			return addr
+		}
+	}
+
+	// Any address of a domain with a catch-all address is owned
+	domain := addressDomain(email)
+	for _, addr := range addrs {
+		if addr.CatchAll != 0 && domain != "" && strings.EqualFold(addressDomain(addr.Email), domain) {
+			return addr
+		}
+	}
+	return nil
+}
+
+func addressDomain(addr string) string {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return ""
+	}
+	return addr[at+1:]
+}
+
+// senderAddress returns the user's address messages from email are sent with.
+func (s *session) senderAddress(email string) (*protonmail.Address, error) {
+	addr := findAddress(s.addrs, email)
+	if addr == nil {
+		return nil, errUnknownSender
+	}
+	if addr.Status != protonmail.AddressEnabled || addr.Send == protonmail.AddressSendDisabled {
+		return nil, &smtp.SMTPError{
+			Code:    550,
+			Message: fmt.Sprintf("5.7.1 Address <%v> is disabled, cannot send", addr.Email),
+		}
+	}
+	return addr, nil
+}
+
 type session struct {
+	be          *backend
 	c           *protonmail.Client
 	u           *protonmail.User
 	privateKeys openpgp.EntityList
 	addrs       []*protonmail.Address
+
+	from  string
+	rcpts map[string]*dsnRecipient
+
+	log *slog.Logger
 }
 
+// sessionCounter is used to generate IDs correlating the log lines of a
+// session.
+var sessionCounter uint64
+
 func (s *session) Mail(from string) error {
+	// An empty reverse-path is used for bounces
+	if from != "" {
+		if _, err := s.senderAddress(from); err != nil {
+			return err
+		}
+	}
+	s.from = from
 	return nil
 }
 
 func (s *session) Rcpt(to string) error {
+	addr, rcpt, err := parseRcpt(to)
+	if err != nil {
+		return err
+	}
+	if s.rcpts == nil {
+		s.rcpts = make(map[string]*dsnRecipient)
+	}
+	s.rcpts[strings.ToLower(addr)] = rcpt
 	return nil
 }
 
 func (s *session) Data(r io.Reader) error {
+	if !s.be.beginSend() {
+		return errShuttingDown
+	}
+	defer s.be.sending.Done()
+
+	maxBytes := DefaultMaxMessageBytes
+	if s.u.MaxUpload > 0 {
+		maxBytes = maxMessageBytes(s.u.MaxUpload)
+	}
+	// Stop reading as soon as the limit is exceeded, the rest of the message
+	// is discarded
+	b, err := ioutil.ReadAll(io.LimitReader(r, int64(maxBytes)+1))
+	if err != nil {
+		return err
+	}
+	if len(b) > maxBytes {
+		s.log.Info("rejecting message exceeding the size limit", "from", s.from, "limit", maxBytes)
+		return errMessageTooLarge
+	}
+
+	key := outboxKey(s.u.Name, s.from, b)
+	if s.be.isDelayed(key) {
+		s.log.Info("message already scheduled, ignoring retry", "from", s.from)
+		return nil
+	} else if entry := s.be.outbox.get(key); entry != nil && entry.outgoing == nil {
+		s.log.Info("message already sent, ignoring retry", "from", s.from)
+		return nil
+	} else if entry != nil {
+		err = s.be.sendOutgoing(s.c, s.log.With("from", s.from), key, entry.outgoing)
+	} else {
+		err = s.send(bytes.NewReader(b), key)
+	}
+	if err != nil {
+		s.log.Warn("cannot send message", "from", s.from, "err", err)
+		return err
+	}
+	if s.be.sendDelay > 0 {
+		s.log.Info("message scheduled", "from", s.from, "delay", s.be.sendDelay)
+	} else {
+		s.log.Info("message sent", "from", s.from)
+	}
+	return nil
+}
+
+// maxParentLookups is the maximum number of message identifiers looked up
+// when searching for the parent of a message.
+const maxParentLookups = 3
+
+// findParent returns the ID of the message replied to, looked up with the
+// In-Reply-To and References header fields. It returns an empty string if the
+// parent isn't found.
+func (s *session) findParent(h mail.Header, addressID string) (string, error) {
+	var ids []string
+	if id := parseMsgID(h.Get("In-Reply-To")); id != "" {
+		ids = append(ids, id)
+	}
+	// The last reference is the parent
+	refs := parseMsgIDList(h.Get("References"))
+	for i := len(refs) - 1; i >= 0 && len(ids) < maxParentLookups; i-- {
+		if len(ids) == 0 || refs[i] != ids[0] {
+			ids = append(ids, refs[i])
+		}
+	}
+
+	for _, id := range ids {
+		filter := protonmail.MessageFilter{
+			Limit:      1,
+			ExternalID: id,
+			AddressID:  addressID,
+		}
+		total, msgs, err := s.c.ListMessages(&filter)
+		if err != nil {
+			return "", err
+		}
+		if total >= 1 && len(msgs) > 0 {
+			return msgs[0].ID, nil
+		}
+	}
+	return "", nil
+}
+
+// uploadAttachment encrypts and uploads an attachment of a draft. The session
+// key of the attachment is added to keys.
+func (s *session) uploadAttachment(att *protonmail.Attachment, r io.Reader, privateKey *openpgp.Entity, keys map[string]*packet.EncryptedKey) error {
+	attKey, err := att.GenerateKey([]*openpgp.Entity{privateKey})
+	if err != nil {
+		return fmt.Errorf("cannot generate attachment key: %v", err)
+	}
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		cleartext, err := att.Encrypt(pw, privateKey)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(cleartext, r); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(cleartext.Close())
+	}()
+
+	att, err = s.c.CreateAttachment(att, pr)
+	if err != nil {
+		return fmt.Errorf("cannot upload attachment: %v", err)
+	}
+
+	keys[att.ID] = attKey
+	return nil
+}
+
+// addressKey returns the decrypted primary key of an address. If the address
+// doesn't have any key and key generation is enabled, a new key is generated.
+func (s *session) addressKey(addr *protonmail.Address) (*openpgp.Entity, error) {
+	if len(addr.Keys) == 0 {
+		if !s.be.generateKeys {
+			return nil, errors.New("sender address has no private key")
+		}
+
+		s.log.Info("generating key for sender address", "address", addr.Email)
+		key, e, err := s.c.GenerateAddressKey(addr.ID, nil)
+		if err != nil {
+			return nil, fmt.Errorf("cannot generate sender address key: %v", err)
+		}
+		if key != nil {
+			addr.Keys = append(addr.Keys, key)
+		}
+		s.privateKeys = append(openpgp.EntityList{e}, s.privateKeys...)
+		return e, nil
+	}
+
+	key := addr.Keys[0]
+	for _, k := range addr.Keys {
+		if k.Primary == 1 {
+			key = k
+			break
+		}
+	}
+
+	encryptedPrivateKey, err := key.Entity()
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse sender private key: %v", err)
+	}
+
+	for _, e := range s.privateKeys {
+		if e.PrimaryKey.KeyId == encryptedPrivateKey.PrimaryKey.KeyId {
+			return e, nil
+		}
+	}
+	return nil, errors.New("sender address key hasn't been decrypted")
+}
+
+func (s *session) send(r io.Reader, key string) error {
+	arrival := time.Now()
+
 	// Parse the incoming MIME message header
 	mr, err := mail.CreateReader(r)
 	if err != nil {
 		return err
 	}
 
-	subject, _ := mr.Header.Subject()
-	fromList, _ := mr.Header.AddressList("From")
-	toList, _ := mr.Header.AddressList("To")
-	ccList, _ := mr.Header.AddressList("Cc")
-	bccList, _ := mr.Header.AddressList("Bcc")
+	subject := charset.DecodeHeader(mr.Header.Get("Subject"))
+	fromList, _ := charset.AddressList(mr.Header, "From")
+	toList, _ := charset.AddressList(mr.Header, "To")
+	ccList, _ := charset.AddressList(mr.Header, "Cc")
+	bccList, _ := charset.AddressList(mr.Header, "Bcc")
 
+	if len(fromList) == 0 && s.from != "" {
+		// Fallback to the envelope sender
+		fromList = []*mail.Address{{Address: s.from}}
+	}
 	if len(fromList) != 1 {
 		return errors.New("the From field must contain exactly one address")
 	}
@@ -72,37 +420,96 @@ func (s *session) Data(r io.Reader) error {
 		return errors.New("no recipient specified")
 	}
 
-	rawFrom := fromList[0]
-	fromAddrStr := rawFrom.Address
-	var fromAddr *protonmail.Address
-	for _, addr := range s.addrs {
-		if strings.EqualFold(addr.Email, fromAddrStr) {
-			fromAddr = addr
-			break
+	var expirationTime int
+	if v := mr.Header.Get(expirationHeader); v != "" {
+		if expirationTime, err = parseExpiration(v); err != nil {
+			return err
 		}
+		mr.Header.Del(expirationHeader)
 	}
-	if fromAddr == nil {
-		return errors.New("unknown sender address")
+
+	rawFrom := fromList[0]
+	fromAddr, err := s.senderAddress(rawFrom.Address)
+	if err != nil {
+		return err
 	}
-	if len(fromAddr.Keys) == 0 {
-		return errors.New("sender address has no private key")
+	privateKey, err := s.addressKey(fromAddr)
+	if err != nil {
+		return err
 	}
 
-	// TODO: get appropriate private key
-	encryptedPrivateKey, err := fromAddr.Keys[0].Entity()
+	// Split internal recipients and plaintext recipients
+
+	recipients := make([]*mail.Address, 0, len(toList)+len(ccList)+len(bccList))
+	recipients = append(recipients, toList...)
+	recipients = append(recipients, ccList...)
+	recipients = append(recipients, bccList...)
+
+	pins, err := loadPins()
 	if err != nil {
-		return fmt.Errorf("cannot parse sender private key: %v", err)
+		return err
 	}
 
-	var privateKey *openpgp.Entity
-	for _, e := range s.privateKeys {
-		if e.PrimaryKey.KeyId == encryptedPrivateKey.PrimaryKey.KeyId {
-			privateKey = e
-			break
+	var plaintextRecipients []string
+	var failedRecipients []*failedRecipient
+	encryptedRecipients := make(map[string]*encryptedRecipient)
+	for _, rcpt := range recipients {
+		if s.be.forcePlaintext(rcpt.Address) {
+			plaintextRecipients = append(plaintextRecipients, rcpt.Address)
+			continue
+		}
+
+		resp, err := s.c.GetPublicKeys(rcpt.Address)
+		if apiErr, ok := err.(*protonmail.APIError); ok {
+			// The address has been rejected by ProtonMail, send the message
+			// to the other recipients and bounce
+			failedRecipients = append(failedRecipients, &failedRecipient{
+				addr:   rcpt.Address,
+				status: "5.1.1",
+				err:    apiErr,
+			})
+			continue
+		} else if err != nil {
+			s.log.Warn("cannot get public key", "address", rcpt.Address, "err", err)
+			return &smtp.SMTPError{
+				Code:    451,
+				Message: fmt.Sprintf("4.4.3 Cannot look up recipient <%v>, try again later", rcpt.Address),
+			}
+		}
+
+		pin := pins[strings.ToLower(rcpt.Address)]
+		encrypted, err := recipientKey(rcpt.Address, resp, pin)
+		if err == errPinMismatch {
+			s.log.Warn("recipient key doesn't match pinned key", "address", rcpt.Address, "fingerprint", pin)
+			return &smtp.SMTPError{
+				Code:    554,
+				Message: fmt.Sprintf("5.7.1 No key of recipient <%v> matches the pinned key %v, not sending", rcpt.Address, pin),
+			}
+		} else if err != nil {
+			return err
+		}
+
+		if encrypted == nil {
+			plaintextRecipients = append(plaintextRecipients, rcpt.Address)
+		} else {
+			encryptedRecipients[rcpt.Address] = encrypted
 		}
 	}
-	if privateKey == nil {
-		return errors.New("sender address key hasn't been decrypted")
+
+	if len(plaintextRecipients) == 0 && len(encryptedRecipients) == 0 {
+		return &smtp.SMTPError{
+			Code:    550,
+			Message: fmt.Sprintf("%v Cannot send message to <%v>: %v", failedRecipients[0].status, failedRecipients[0].addr, failedRecipients[0].err),
+		}
+	}
+
+	if s.be.autocrypt != "" && len(plaintextRecipients) > 0 {
+		// Recipients of encrypted messages already have the key
+		autocrypt, err := formatAutocrypt(rawFrom.Address, privateKey, s.be.autocrypt)
+		if err != nil {
+			return err
+		}
+		mr.Header.Set("Autocrypt", autocrypt)
 	}
 
 	msg := &protonmail.Message{
@@ -127,30 +534,34 @@ func (s *session) Data(r io.Reader) error {
 		return err
 	}
 
-	parentID := ""
-	inReplyToList, _ := mr.Header.AddressList("In-Reply-To")
-	if len(inReplyToList) == 1 {
-		inReplyTo := inReplyToList[0].Address
-
-		filter := protonmail.MessageFilter{
-			Limit:      1,
-			ExternalID: inReplyTo,
-			AddressID:  fromAddr.ID,
-		}
-		total, msgs, err := s.c.ListMessages(&filter)
-		if err != nil {
-			return err
-		}
-		if total == 1 {
-			parentID = msgs[0].ID
-		}
+	parentID, err := s.findParent(mr.Header, fromAddr.ID)
+	if err != nil {
+		return err
 	}
 
-	msg, err = s.c.CreateDraftMessage(msg, parentID)
+	// Keep the client's Message-ID so that replies can be threaded
+	msg.ExternalID = parseMsgID(mr.Header.Get("Message-Id"))
+
+	draft, err := s.c.CreateDraftMessage(msg, parentID)
+	if _, ok := err.(*protonmail.APIError); ok && msg.ExternalID != "" {
+		s.log.Warn("custom Message-ID rejected, using a generated one", "message-id", msg.ExternalID, "err", err)
+		mr.Header.Del("Message-Id")
+		msg.Header = formatHeader(mr.Header)
+		msg.ExternalID = ""
+		draft, err = s.c.CreateDraftMessage(msg, parentID)
+	}
 	if err != nil {
 		return fmt.Errorf("cannot create draft message: %v", err)
 	}
 
+	// The draft returned by the API doesn't contain the headers supplied by
+	// the client, restore them so that they aren't lost when updating it
+	draft.Header = msg.Header
+	if msg.ExternalID != "" {
+		draft.ExternalID = msg.ExternalID
+	}
+	msg = draft
+
 	// Parse the incoming MIME message body
 	// Save the message text into a buffer
 	// Upload attachments
@@ -163,28 +574,43 @@ func (s *session) Data(r io.Reader) error {
 		p, err := mr.NextPart()
 		if err == io.EOF {
 			break
-		} else if err != nil {
+		} else if err != nil && !message.IsUnknownEncoding(err) {
 			return err
 		}
 
 		switch h := p.Header.(type) {
 		case mail.TextHeader:
-			t, _, err := h.ContentType()
+			t, params, err := h.ContentType()
 			if err != nil {
 				break
 			}
 
+			if t == "text/calendar" {
+				// Calendar invites are sent as attachments, as the web app does
+				att := &protonmail.Attachment{
+					MessageID: msg.ID,
+					Name:      calendarFilename,
+					MIMEType:  formatCalendarType(t, params),
+				}
+				if err := s.uploadAttachment(att, p.Body, privateKey, attachmentKeys); err != nil {
+					return err
+				}
+				break
+			}
+
 			if body != nil && t != "text/html" {
 				break
 			}
 
-			body = &bytes.Buffer{}
-			bodyType = t
-			if _, err := io.Copy(body, p.Body); err != nil {
+			b, err := ioutil.ReadAll(p.Body)
+			if err != nil {
 				return err
 			}
+			// Parts with a missing or unknown charset aren't converted
+			body = bytes.NewBuffer(charset.Fallback(b))
+			bodyType = t
 		case mail.AttachmentHeader:
-			t, _, err := h.ContentType()
+			t, params, err := h.ContentType()
 			if err != nil {
 				break
 			}
@@ -193,6 +619,9 @@ func (s *session) Data(r io.Reader) error {
 			if err != nil {
 				break
 			}
+			if t == "text/calendar" {
+				t = formatCalendarType(t, params)
+			}
 
 			att := &protonmail.Attachment{
 				MessageID: msg.ID,
@@ -201,33 +630,9 @@ func (s *session) Data(r io.Reader) error {
 				ContentID: h.Get("Content-Id"),
 				// TODO: Header
 			}
-
-			attKey, err := att.GenerateKey([]*openpgp.Entity{privateKey})
-			if err != nil {
-				return fmt.Errorf("cannot generate attachment key: %v", err)
-			}
-
-			pr, pw := io.Pipe()
-
-			go func() {
-				cleartext, err := att.Encrypt(pw, privateKey)
-				if err != nil {
-					pw.CloseWithError(err)
-					return
-				}
-				if _, err := io.Copy(cleartext, p.Body); err != nil {
-					pw.CloseWithError(err)
-					return
-				}
-				pw.CloseWithError(cleartext.Close())
-			}()
-
-			att, err = s.c.CreateAttachment(att, pr)
-			if err != nil {
-				return fmt.Errorf("cannot upload attachment: %v", err)
+			if err := s.uploadAttachment(att, p.Body, privateKey, attachmentKeys); err != nil {
+				return err
 			}
-
-			attachmentKeys[att.ID] = attKey
 		}
 	}
 
@@ -253,37 +658,11 @@ func (s *session) Data(r io.Reader) error {
 		return fmt.Errorf("cannot update draft message: %v", err)
 	}
 
-	// Split internal recipients and plaintext recipients
-
-	recipients := make([]*mail.Address, 0, len(toList)+len(ccList)+len(bccList))
-	recipients = append(recipients, toList...)
-	recipients = append(recipients, ccList...)
-	recipients = append(recipients, bccList...)
-
-	var plaintextRecipients []string
-	encryptedRecipients := make(map[string]*openpgp.Entity)
-	for _, rcpt := range recipients {
-		resp, err := s.c.GetPublicKeys(rcpt.Address)
-		if err != nil {
-			return fmt.Errorf("cannot get public key for address %q: %v", rcpt.Address, err)
-		}
-
-		if len(resp.Keys) == 0 {
-			plaintextRecipients = append(plaintextRecipients, rcpt.Address)
-			continue
-		}
-
-		// TODO: only keys with Send == 1
-		pub, err := resp.Keys[0].Entity()
-		if err != nil {
-			return err
-		}
-
-		encryptedRecipients[rcpt.Address] = pub
-	}
-
 	// Create and send the outgoing message
-	outgoing := &protonmail.OutgoingMessage{ID: msg.ID}
+	outgoing := &protonmail.OutgoingMessage{
+		ID:             msg.ID,
+		ExpirationTime: expirationTime,
+	}
 
 	if len(plaintextRecipients) > 0 {
 		plaintextSet := protonmail.NewMessagePackageSet(attachmentKeys)
@@ -329,8 +708,14 @@ func (s *session) Data(r io.Reader) error {
 			return err
 		}
 
-		for rcpt, pub := range encryptedRecipients {
-			if _, err := encryptedSet.AddInternal(rcpt, pub); err != nil {
+		for addr, rcpt := range encryptedRecipients {
+			// TODO: PGP/MIME for external recipients
+			if rcpt.internal {
+				_, err = encryptedSet.AddInternal(addr, rcpt.pub)
+			} else {
+				_, err = encryptedSet.AddInlinePGP(addr, rcpt.pub)
+			}
+			if err != nil {
 				return err
 			}
 		}
@@ -338,28 +723,188 @@ func (s *session) Data(r io.Reader) error {
 		outgoing.Packages = append(outgoing.Packages, encryptedSet)
 	}
 
-	_, _, err = s.c.SendMessage(outgoing)
-	if err != nil {
+	if s.be.sendDelay > 0 {
+		s.be.sendLater(s.c, s.log.With("from", s.from), key, outgoing)
+	} else if err := s.be.sendOutgoing(s.c, s.log.With("from", s.from), key, outgoing); err != nil {
+		return err
+	}
+
+	if len(failedRecipients) > 0 {
+		if err := s.bounce(mr.Header, fromAddr, privateKey, arrival, failedRecipients); err != nil {
+			s.log.Warn("cannot store delivery status notification", "from", s.from, "err", err)
+		}
+	}
+	return nil
+}
+
+// sendOutgoing sends a message and records its status in the outbox.
+func (be *backend) sendOutgoing(c *protonmail.Client, log *slog.Logger, key string, outgoing *protonmail.OutgoingMessage) error {
+	be.outbox.put(key, outgoing)
+	if _, _, err := c.SendMessage(outgoing); err != nil {
+		if _, ok := err.(*protonmail.SendStatusUnknownError); ok {
+			log.Warn("cannot check whether message has been sent", "draft", outgoing.ID, "err", err)
+			return errSendStatusUnknown
+		}
+		be.outbox.remove(key)
 		return fmt.Errorf("cannot send message: %v", err)
 	}
 
+	be.outbox.put(key, nil)
 	return nil
 }
 
-func (s *session) Reset() {}
+func (be *backend) isDelayed(key string) bool {
+	be.locker.Lock()
+	defer be.locker.Unlock()
+	return be.delayed[key]
+}
+
+// draftCancelled checks whether a delayed message must not be sent anymore
+// because its draft has been deleted or sent in the meantime.
+func draftCancelled(c *protonmail.Client, id string) (cancelled bool, reason string) {
+	draft, err := c.GetMessage(id)
+	if _, ok := err.(*protonmail.APIError); ok {
+		return true, "draft deleted"
+	} else if err != nil {
+		// Try to send the message anyway
+		return false, ""
+	}
+
+	if draft.Type != protonmail.MessageDraft {
+		return true, "draft already sent"
+	}
+	for _, labelID := range draft.LabelIDs {
+		if labelID == protonmail.LabelTrash {
+			return true, "draft deleted"
+		}
+	}
+	return false, ""
+}
+
+// sendLater sends a message once the send delay has elapsed, unless its draft
+// is deleted in the meantime. Delayed messages are sent right away when
+// shutting down.
+func (be *backend) sendLater(c *protonmail.Client, log *slog.Logger, key string, outgoing *protonmail.OutgoingMessage) {
+	be.outbox.put(key, outgoing)
+
+	be.locker.Lock()
+	be.delayed[key] = true
+	be.locker.Unlock()
+
+	// The caller holds a send, so that Shutdown can't be waiting yet
+	be.sending.Add(1)
+	go func() {
+		defer be.sending.Done()
+		defer func() {
+			be.locker.Lock()
+			delete(be.delayed, key)
+			be.locker.Unlock()
+		}()
+
+		t := time.NewTimer(be.sendDelay)
+		select {
+		case <-t.C:
+		case <-be.flush:
+			t.Stop()
+		}
+
+		if cancelled, reason := draftCancelled(c, outgoing.ID); cancelled {
+			log.Info("delayed message cancelled", "draft", outgoing.ID, "reason", reason)
+			be.outbox.remove(key)
+			return
+		}
+		if err := be.sendOutgoing(c, log, key, outgoing); err != nil {
+			log.Warn("cannot send delayed message", "draft", outgoing.ID, "err", err)
+			return
+		}
+		log.Info("delayed message sent", "draft", outgoing.ID)
+	}()
+}
+
+func (s *session) Reset() {
+	s.from = ""
+	s.rcpts = nil
+}
 
 func (s *session) Logout() error {
+	metrics.SMTPSessions.Dec()
 	s.c = nil
 	s.u = nil
 	s.privateKeys = nil
 	return nil
 }
 
+// Backend is an SMTP backend which can be shut down gracefully.
+type Backend interface {
+	smtp.Backend
+
+	// Shutdown rejects new messages and waits for the messages being sent
+	// to be processed, until ctx is done.
+	Shutdown(ctx context.Context) error
+}
+
 type backend struct {
-	sessions *auth.Manager
+	sessions            *auth.Manager
+	plaintextRecipients map[string]bool
+	generateKeys        bool
+
+	locker       sync.Mutex
+	shuttingDown bool
+	sending      sync.WaitGroup
+
+	outbox outbox
+
+	sendDelay time.Duration
+	// autocrypt is the prefer-encrypt value of Autocrypt header fields, if
+	// they're enabled
+	autocrypt string
+	// delayed contains the outbox keys of messages waiting for the send
+	// delay, flush is closed to send them right away
+	delayed map[string]bool
+	flush   chan struct{}
+}
+
+func (be *backend) beginSend() bool {
+	be.locker.Lock()
+	defer be.locker.Unlock()
+	if be.shuttingDown {
+		return false
+	}
+	be.sending.Add(1)
+	return true
+}
+
+func (be *backend) Shutdown(ctx context.Context) error {
+	be.locker.Lock()
+	if !be.shuttingDown {
+		close(be.flush)
+	}
+	be.shuttingDown = true
+	be.locker.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		be.sending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (be *backend) forcePlaintext(addr string) bool {
+	return be.plaintextRecipients[strings.ToLower(addr)]
 }
 
 func (be *backend) Login(_ *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	password, appPassword, err := auth.ResolveAppPassword(username, password)
+	if err != nil {
+		return nil, err
+	}
 	c, privateKeys, err := be.sessions.Auth(username, password)
 	if err != nil {
 		return nil, err
@@ -377,13 +922,44 @@ func (be *backend) Login(_ *smtp.ConnectionState, username, password string) (sm
 
 	// TODO: decrypt private keys in u.Addresses
 
-	return &session{c, u, privateKeys, addrs}, nil
+	metrics.SMTPSessions.Inc()
+	s := &session{
+		be:          be,
+		c:           c,
+		u:           u,
+		privateKeys: privateKeys,
+		addrs:       addrs,
+		log:         slog.Default().With("session", fmt.Sprintf("smtp-%v", atomic.AddUint64(&sessionCounter, 1)), "user", username),
+	}
+	if appPassword != "" {
+		s.log.Info("logged in with app password", "app-password", appPassword)
+	}
+	return s, nil
 }
 
 func (be *backend) AnonymousLogin(_ *smtp.ConnectionState) (smtp.Session, error) {
 	return nil, smtp.ErrAuthRequired
 }
 
-func New(sessions *auth.Manager) smtp.Backend {
-	return &backend{sessions}
+// New creates a new SMTP backend. Messages sent to plaintextRecipients are
+// never end-to-end encrypted, even if a public key is available. If
+// generateKeys is true, a key is generated for sender addresses which don't
+// have any. If sendDelay is positive, messages are sent after this delay,
+// during which sending can be cancelled by deleting the draft. If autocrypt
+// isn't empty, an Autocrypt header field with this prefer-encrypt value is
+// added to messages sent in plaintext to some recipients.
+func New(sessions *auth.Manager, plaintextRecipients []string, generateKeys bool, sendDelay time.Duration, autocrypt string) Backend {
+	m := make(map[string]bool, len(plaintextRecipients))
+	for _, addr := range plaintextRecipients {
+		m[strings.ToLower(addr)] = true
+	}
+	return &backend{
+		sessions:            sessions,
+		plaintextRecipients: m,
+		generateKeys:        generateKeys,
+		sendDelay:           sendDelay,
+		autocrypt:           autocrypt,
+		delayed:             make(map[string]bool),
+		flush:               make(chan struct{}),
+	}
 }
@@ -0,0 +1,539 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	_ "crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-smtp"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+	_ "golang.org/x/crypto/ripemd160"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func newTestEntity(t *testing.T) *openpgp.Entity {
+	e, err := openpgp.NewEntity("Test", "", "test@example.org", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatalf("openpgp.NewEntity() = %v", err)
+	}
+	return e
+}
+
+func armorPublicKey(t *testing.T, e *openpgp.Entity) string {
+	var b bytes.Buffer
+	aw, err := armor.Encode(&b, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Serialize(aw); err != nil {
+		t.Fatal(err)
+	}
+	aw.Close()
+	return b.String()
+}
+
+func TestRecipientKey(t *testing.T) {
+	first, second := newTestEntity(t), newTestEntity(t)
+	firstKey := &protonmail.PublicKey{Send: 1, PublicKey: armorPublicKey(t, first)}
+	secondKey := &protonmail.PublicKey{Send: 1, PublicKey: armorPublicKey(t, second)}
+	noSendKey := &protonmail.PublicKey{Send: 0, PublicKey: armorPublicKey(t, first)}
+
+	tests := []struct {
+		name     string
+		resp     *protonmail.PublicKeyResp
+		pin      string
+		want     *openpgp.Entity
+		internal bool
+		wantErr  bool
+	}{
+		{
+			name: "no key",
+			resp: &protonmail.PublicKeyResp{RecipientType: protonmail.RecipientExternal},
+		},
+		{
+			name:     "internal",
+			resp:     &protonmail.PublicKeyResp{RecipientType: protonmail.RecipientInternal, Keys: []*protonmail.PublicKey{firstKey, secondKey}},
+			want:     first,
+			internal: true,
+		},
+		{
+			name: "external",
+			resp: &protonmail.PublicKeyResp{RecipientType: protonmail.RecipientExternal, Keys: []*protonmail.PublicKey{firstKey}},
+			want: first,
+		},
+		{
+			name:     "skips keys not for sending",
+			resp:     &protonmail.PublicKeyResp{RecipientType: protonmail.RecipientInternal, Keys: []*protonmail.PublicKey{noSendKey, secondKey}},
+			want:     second,
+			internal: true,
+		},
+		{
+			name: "only keys not for sending",
+			resp: &protonmail.PublicKeyResp{RecipientType: protonmail.RecipientInternal, Keys: []*protonmail.PublicKey{noSendKey}},
+		},
+		{
+			name:     "pinned",
+			resp:     &protonmail.PublicKeyResp{RecipientType: protonmail.RecipientInternal, Keys: []*protonmail.PublicKey{firstKey, secondKey}},
+			pin:      formatFingerprint(second),
+			want:     second,
+			internal: true,
+		},
+		{
+			name:    "pinned key missing",
+			resp:    &protonmail.PublicKeyResp{RecipientType: protonmail.RecipientInternal, Keys: []*protonmail.PublicKey{firstKey}},
+			pin:     formatFingerprint(second),
+			wantErr: true,
+		},
+		{
+			name:    "pinned without keys",
+			resp:    &protonmail.PublicKeyResp{RecipientType: protonmail.RecipientExternal},
+			pin:     formatFingerprint(second),
+			wantErr: true,
+		},
+		{
+			name:    "invalid key",
+			resp:    &protonmail.PublicKeyResp{Keys: []*protonmail.PublicKey{{Send: 1, PublicKey: "invalid"}}},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		rcpt, err := recipientKey("rcpt@example.org", tc.resp, tc.pin)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%v: recipientKey() = nil, want an error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: recipientKey() = %v", tc.name, err)
+		} else if tc.want == nil {
+			if rcpt != nil {
+				t.Errorf("%v: recipientKey() = %v, want nil", tc.name, rcpt)
+			}
+		} else if rcpt == nil {
+			t.Errorf("%v: recipientKey() = nil, want a key", tc.name)
+		} else if rcpt.pub.PrimaryKey.KeyId != tc.want.PrimaryKey.KeyId || rcpt.internal != tc.internal {
+			t.Errorf("%v: recipientKey() = %X (internal: %v), want %X (internal: %v)", tc.name, rcpt.pub.PrimaryKey.KeyId, rcpt.internal, tc.want.PrimaryKey.KeyId, tc.internal)
+		}
+	}
+}
+
+func TestStripAddressTag(t *testing.T) {
+	tests := []struct {
+		addr, want string
+	}{
+		{"user@example.org", "user@example.org"},
+		{"user+tag@example.org", "user@example.org"},
+		{"user+tag+other@example.org", "user@example.org"},
+		{"user@plus+domain", "user@plus+domain"},
+		{"user+tag", "user+tag"},
+	}
+	for _, tc := range tests {
+		if got := stripAddressTag(tc.addr); got != tc.want {
+			t.Errorf("stripAddressTag(%q) = %q, want %q", tc.addr, got, tc.want)
+		}
+	}
+}
+
+func TestSenderAddress(t *testing.T) {
+	primary := &protonmail.Address{Email: "user@example.org", Status: protonmail.AddressEnabled, Send: protonmail.AddressSendPrimary}
+	tagged := &protonmail.Address{Email: "user+work@example.org", Status: protonmail.AddressEnabled, Send: protonmail.AddressSendSecondary}
+	catchAll := &protonmail.Address{Email: "me@catchall.org", Status: protonmail.AddressEnabled, Send: protonmail.AddressSendSecondary, CatchAll: 1}
+	disabled := &protonmail.Address{Email: "old@example.org", Status: protonmail.AddressDisabled, Send: protonmail.AddressSendSecondary}
+	receiveOnly := &protonmail.Address{Email: "inbox@example.org", Status: protonmail.AddressEnabled, Send: protonmail.AddressSendDisabled}
+	s := &session{addrs: []*protonmail.Address{primary, tagged, catchAll, disabled, receiveOnly}}
+
+	tests := []struct {
+		email    string
+		want     *protonmail.Address
+		wantCode int
+	}{
+		{email: "user@example.org", want: primary},
+		{email: "USER@Example.org", want: primary},
+		{email: "user+tag@example.org", want: primary},
+		{email: "user+work@example.org", want: tagged},
+		{email: "anything@catchall.org", want: catchAll},
+		{email: "anything+tag@CATCHALL.org", want: catchAll},
+		{email: "other@example.org", wantCode: 553},
+		{email: "user@example.com", wantCode: 553},
+		{email: "old@example.org", wantCode: 550},
+		{email: "inbox@example.org", wantCode: 550},
+	}
+	for _, tc := range tests {
+		addr, err := s.senderAddress(tc.email)
+		if tc.wantCode != 0 {
+			if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != tc.wantCode {
+				t.Errorf("senderAddress(%q) = %v, want code %v", tc.email, err, tc.wantCode)
+			}
+		} else if err != nil {
+			t.Errorf("senderAddress(%q) = %v", tc.email, err)
+		} else if addr != tc.want {
+			t.Errorf("senderAddress(%q) = %v, want %v", tc.email, addr.Email, tc.want.Email)
+		}
+	}
+}
+
+func TestSessionMail(t *testing.T) {
+	s := &session{addrs: []*protonmail.Address{
+		{Email: "user@example.org", Status: protonmail.AddressEnabled, Send: protonmail.AddressSendPrimary},
+		{Email: "old@example.org", Status: protonmail.AddressDisabled},
+	}}
+	tests := []struct {
+		from    string
+		wantErr bool
+	}{
+		{"user@example.org", false},
+		// Bounces
+		{"", false},
+		{"old@example.org", true},
+		{"other@example.org", true},
+	}
+	for _, tc := range tests {
+		s.from = "previous"
+		err := s.Mail(tc.from)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("Mail(%q) = nil, want an error", tc.from)
+			}
+		} else if err != nil {
+			t.Errorf("Mail(%q) = %v", tc.from, err)
+		} else if s.from != tc.from {
+			t.Errorf("Mail(%q) set the sender to %q", tc.from, s.from)
+		}
+	}
+}
+
+func TestAddressDomain(t *testing.T) {
+	tests := []struct {
+		addr, want string
+	}{
+		{"user@example.org", "example.org"},
+		{"\"a@b\"@example.org", "example.org"},
+		{"user", ""},
+	}
+	for _, tc := range tests {
+		if got := addressDomain(tc.addr); got != tc.want {
+			t.Errorf("addressDomain(%q) = %q, want %q", tc.addr, got, tc.want)
+		}
+	}
+}
+
+func TestParseMsgID(t *testing.T) {
+	tests := []struct {
+		s, want string
+	}{
+		{"<id@example.org>", "id@example.org"},
+		{"  <id@example.org> ", "id@example.org"},
+		{"id@example.org", "id@example.org"},
+		{"< id@example.org >", "id@example.org"},
+		{"", ""},
+		{"<>", ""},
+	}
+	for _, tc := range tests {
+		if got := parseMsgID(tc.s); got != tc.want {
+			t.Errorf("parseMsgID(%q) = %q, want %q", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestParseMsgIDList(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+	}{
+		{"<a@example.org> <b@example.org>", []string{"a@example.org", "b@example.org"}},
+		{"<a@example.org>\r\n\t<b@example.org>,<c@example.org>", []string{"a@example.org", "b@example.org", "c@example.org"}},
+		{"<a@example.org> <> ", []string{"a@example.org"}},
+		{"", nil},
+	}
+	for _, tc := range tests {
+		if got := parseMsgIDList(tc.s); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseMsgIDList(%q) = %q, want %q", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestFindParent(t *testing.T) {
+	tests := []struct {
+		name       string
+		inReplyTo  string
+		references string
+		// known maps the external IDs of the messages on the server to their ID
+		known      map[string]string
+		want       string
+		wantLookup []string
+	}{
+		{
+			name:       "in-reply-to",
+			inReplyTo:  "<parent@example.org>",
+			references: "<root@example.org> <parent@example.org>",
+			known:      map[string]string{"parent@example.org": "msg1"},
+			want:       "msg1",
+			wantLookup: []string{"parent@example.org"},
+		},
+		{
+			name:       "references only",
+			references: "<root@example.org> <parent@example.org>",
+			known:      map[string]string{"root@example.org": "msg1"},
+			want:       "msg1",
+			wantLookup: []string{"parent@example.org", "root@example.org"},
+		},
+		{
+			name:       "lookups limited",
+			inReplyTo:  "<e@example.org>",
+			references: "<a@example.org> <b@example.org> <c@example.org> <d@example.org>",
+			known:      map[string]string{"a@example.org": "msg1"},
+			wantLookup: []string{"e@example.org", "d@example.org", "c@example.org"},
+		},
+		{
+			name: "no parent",
+		},
+	}
+	for _, tc := range tests {
+		var lookups []string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/messages" || r.URL.Query().Get("AddressID") != "addr1" {
+				t.Errorf("%v: unexpected request %v", tc.name, r.URL)
+			}
+			externalID := r.URL.Query().Get("ExternalID")
+			lookups = append(lookups, externalID)
+			if id, ok := tc.known[externalID]; ok {
+				fmt.Fprintf(w, `{"Code":1000,"Total":1,"Messages":[{"ID":%q}]}`, id)
+			} else {
+				w.Write([]byte(`{"Code":1000,"Total":0,"Messages":[]}`))
+			}
+		}))
+
+		s := &session{c: &protonmail.Client{RootURL: srv.URL, HTTPClient: srv.Client(), MaxRetries: -1}}
+		h := mail.Header{Header: make(message.Header)}
+		if tc.inReplyTo != "" {
+			h.Set("In-Reply-To", tc.inReplyTo)
+		}
+		if tc.references != "" {
+			h.Set("References", tc.references)
+		}
+
+		got, err := s.findParent(h, "addr1")
+		srv.Close()
+		if err != nil {
+			t.Errorf("%v: findParent() = %v", tc.name, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%v: findParent() = %q, want %q", tc.name, got, tc.want)
+		}
+		if !reflect.DeepEqual(lookups, tc.wantLookup) {
+			t.Errorf("%v: looked up %q, want %q", tc.name, lookups, tc.wantLookup)
+		}
+	}
+}
+
+func TestMaxMessageBytes(t *testing.T) {
+	tests := []struct {
+		maxUpload, want int
+	}{
+		{0, messageOverhead},
+		{3, 4 + messageOverhead},
+		{protonmail.DefaultMaxUpload, 34952532 + messageOverhead},
+	}
+	for _, tc := range tests {
+		if got := maxMessageBytes(tc.maxUpload); got != tc.want {
+			t.Errorf("maxMessageBytes(%v) = %v, want %v", tc.maxUpload, got, tc.want)
+		}
+	}
+	if DefaultMaxMessageBytes != maxMessageBytes(protonmail.DefaultMaxUpload) {
+		t.Errorf("DefaultMaxMessageBytes = %v, want %v", DefaultMaxMessageBytes, maxMessageBytes(protonmail.DefaultMaxUpload))
+	}
+}
+
+// countingReader is an endless reader counting the bytes read.
+type countingReader struct {
+	n int
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 'a'
+	}
+	r.n += len(b)
+	return len(b), nil
+}
+
+func TestDataTooLarge(t *testing.T) {
+	tests := []struct {
+		maxUpload int
+		want      int
+	}{
+		{0, DefaultMaxMessageBytes},
+		{3000, maxMessageBytes(3000)},
+	}
+	for _, tc := range tests {
+		s := &session{
+			be:  &backend{},
+			u:   &protonmail.User{Name: "user", MaxUpload: tc.maxUpload},
+			log: slog.New(slog.NewTextHandler(ioutil.Discard, nil)),
+		}
+		r := &countingReader{}
+		if err := s.Data(io.LimitReader(r, int64(tc.want)+1)); err != errMessageTooLarge {
+			t.Errorf("Data() with %v bytes and MaxUpload %v = %v, want %v", tc.want+1, tc.maxUpload, err, errMessageTooLarge)
+		}
+
+		r = &countingReader{}
+		s.Data(r)
+		// The reader is buffered, allow a few extra bytes
+		if r.n > tc.want+64*1024 {
+			t.Errorf("Data() with MaxUpload %v read %v bytes, want at most %v", tc.maxUpload, r.n, tc.want+1)
+		}
+	}
+}
+
+// testDraftServer serves a draft, and records whether it's sent.
+type testDraftServer struct {
+	draft string
+
+	locker sync.Mutex
+	sent   int
+}
+
+func (s *testDraftServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path != "/messages/draft1":
+		http.NotFound(w, r)
+	case r.Method == http.MethodGet && s.draft == "":
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`{"Code":15052,"Error":"Message does not exist"}`))
+	case r.Method == http.MethodGet:
+		fmt.Fprintf(w, `{"Code":1000,"Message":%v}`, s.draft)
+	default:
+		s.locker.Lock()
+		s.sent++
+		s.locker.Unlock()
+		w.Write([]byte(`{"Code":1000,"Sent":{"ID":"draft1","Type":2}}`))
+	}
+}
+
+func (s *testDraftServer) sentCount() int {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	return s.sent
+}
+
+func TestDraftCancelled(t *testing.T) {
+	tests := []struct {
+		name      string
+		draft     string
+		cancelled bool
+	}{
+		{name: "draft", draft: `{"ID":"draft1","Type":1,"LabelIDs":["1","8"]}`},
+		{name: "deleted", cancelled: true},
+		{name: "trashed", draft: `{"ID":"draft1","Type":1,"LabelIDs":["3"]}`, cancelled: true},
+		{name: "sent", draft: `{"ID":"draft1","Type":2,"LabelIDs":["2"]}`, cancelled: true},
+	}
+	for _, tc := range tests {
+		srv := httptest.NewServer(&testDraftServer{draft: tc.draft})
+		c := &protonmail.Client{RootURL: srv.URL, HTTPClient: srv.Client(), MaxRetries: -1}
+		cancelled, reason := draftCancelled(c, "draft1")
+		srv.Close()
+		if cancelled != tc.cancelled {
+			t.Errorf("%v: draftCancelled() = %v (%v), want %v", tc.name, cancelled, reason, tc.cancelled)
+		}
+	}
+
+	// Messages are sent if the draft can't be checked
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	c := &protonmail.Client{RootURL: srv.URL, HTTPClient: srv.Client(), MaxRetries: -1}
+	if cancelled, reason := draftCancelled(c, "draft1"); cancelled {
+		t.Errorf("draftCancelled() with the API unreachable = true (%v), want false", reason)
+	}
+}
+
+func TestSendLater(t *testing.T) {
+	tests := []struct {
+		name     string
+		draft    string
+		wantSent int
+	}{
+		{name: "sent", draft: `{"ID":"draft1","Type":1,"LabelIDs":["8"]}`, wantSent: 1},
+		{name: "cancelled", draft: `{"ID":"draft1","Type":1,"LabelIDs":["3"]}`},
+	}
+	for _, tc := range tests {
+		s := &testDraftServer{draft: tc.draft}
+		srv := httptest.NewServer(s)
+		c := &protonmail.Client{RootURL: srv.URL, HTTPClient: srv.Client(), MaxRetries: -1}
+		log := slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+
+		be := New(nil, nil, false, 10*time.Millisecond, "").(*backend)
+		if !be.beginSend() {
+			t.Fatalf("%v: beginSend() = false", tc.name)
+		}
+		be.sendLater(c, log, "key", &protonmail.OutgoingMessage{ID: "draft1"})
+		if !be.isDelayed("key") {
+			t.Errorf("%v: isDelayed() = false right after sendLater()", tc.name)
+		}
+		if s.sentCount() != 0 {
+			t.Errorf("%v: message sent before the delay", tc.name)
+		}
+		be.sending.Done()
+
+		be.sending.Wait()
+		srv.Close()
+		if be.isDelayed("key") {
+			t.Errorf("%v: isDelayed() = true after the delay", tc.name)
+		}
+		if n := s.sentCount(); n != tc.wantSent {
+			t.Errorf("%v: message sent %v times, want %v", tc.name, n, tc.wantSent)
+		}
+
+		entry := be.outbox.get("key")
+		if tc.wantSent > 0 && (entry == nil || entry.outgoing != nil) {
+			t.Errorf("%v: outbox entry = %v, want a sent message", tc.name, entry)
+		} else if tc.wantSent == 0 && entry != nil {
+			t.Errorf("%v: outbox entry = %v, want none", tc.name, entry)
+		}
+	}
+}
+
+func TestShutdownFlushesDelayedMessages(t *testing.T) {
+	s := &testDraftServer{draft: `{"ID":"draft1","Type":1,"LabelIDs":["8"]}`}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	c := &protonmail.Client{RootURL: srv.URL, HTTPClient: srv.Client(), MaxRetries: -1}
+	log := slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+
+	be := New(nil, nil, false, time.Hour, "").(*backend)
+	be.beginSend()
+	be.sendLater(c, log, "key", &protonmail.OutgoingMessage{ID: "draft1"})
+	be.sending.Done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := be.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+	if n := s.sentCount(); n != 1 {
+		t.Errorf("message sent %v times, want 1", n)
+	}
+	if be.beginSend() {
+		t.Errorf("beginSend() after Shutdown() = true, want false")
+	}
+	// Shutting down twice is fine
+	if err := be.Shutdown(ctx); err != nil {
+		t.Errorf("second Shutdown() = %v", err)
+	}
+}